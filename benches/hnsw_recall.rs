@@ -0,0 +1,120 @@
+use code_rag::storage::hnsw::{HnswGraph, HnswParams};
+use code_rag::storage::similarity::{normalize, unit_cosine_distance};
+use criterion::{criterion_group, criterion_main, BenchmarkId, Criterion};
+
+/// Dimension of small embedding models such as `bge-small-en-v1.5`.
+const DIM: usize = 384;
+/// Results compared per query.
+const K: usize = 10;
+const QUERIES: usize = 200;
+/// Vectors indexed unless `HNSW_BENCH_VECTORS` says otherwise.
+const DEFAULT_VECTORS: usize = 20_000;
+
+/// Deterministic values in `[-1, 1)`.
+fn pseudo_random(state: &mut u64) -> f32 {
+    *state = state
+        .wrapping_mul(6364136223846793005)
+        .wrapping_add(1442695040888963407);
+    ((*state >> 40) as f32 / (1u64 << 24) as f32) * 2.0 - 1.0
+}
+
+/// Unit vectors scattered around 100 centers, closer to real embeddings than
+/// uniform noise, which has no neighbors worth finding.
+fn clustered(count: usize, seed: u64) -> Vec<Vec<f32>> {
+    let mut state = 7;
+    let centers: Vec<Vec<f32>> = (0..100)
+        .map(|_| (0..DIM).map(|_| pseudo_random(&mut state)).collect())
+        .collect();
+    let mut state = seed;
+    (0..count)
+        .map(|i| {
+            let center = &centers[i % centers.len()];
+            let mut v: Vec<f32> = center
+                .iter()
+                .map(|c| c + 0.6 * pseudo_random(&mut state))
+                .collect();
+            normalize(&mut v);
+            v
+        })
+        .collect()
+}
+
+/// Indices of the `K` nearest vectors by exhaustive scan.
+fn exact_top(vectors: &[Vec<f32>], query: &[f32]) -> Vec<String> {
+    let mut ranked: Vec<(f32, usize)> = vectors
+        .iter()
+        .enumerate()
+        .map(|(i, v)| (unit_cosine_distance(query, v), i))
+        .collect();
+    ranked.sort_by(|a, b| a.0.total_cmp(&b.0));
+    ranked.iter().take(K).map(|(_, i)| i.to_string()).collect()
+}
+
+/// Prints recall@10 of each `M`/`efConstruction`/`efSearch` combination
+/// against brute force, then times queries of each and of the exact scan.
+///
+/// Set `HNSW_BENCH_VECTORS` to the size of your index to tune for it; graph
+/// construction dominates the run time for large values.
+fn bench_recall(c: &mut Criterion) {
+    let count = std::env::var("HNSW_BENCH_VECTORS")
+        .ok()
+        .and_then(|v| v.parse().ok())
+        .unwrap_or(DEFAULT_VECTORS);
+    let vectors = clustered(count, 1);
+    let queries = clustered(QUERIES, 2);
+    let truth: Vec<Vec<String>> = queries.iter().map(|q| exact_top(&vectors, q)).collect();
+
+    let mut group = c.benchmark_group(format!("hnsw_{}", count));
+    group.sample_size(10);
+    group.bench_function("exact", |b| b.iter(|| exact_top(&vectors, &queries[0])));
+
+    for (m, ef_construction) in [(8, 100), (16, 200), (32, 200)] {
+        let params = HnswParams {
+            m,
+            ef_construction,
+            ..Default::default()
+        };
+        let started = std::time::Instant::now();
+        let mut graph = HnswGraph::new(params);
+        for (i, v) in vectors.iter().enumerate() {
+            graph
+                .insert("default", "bench.rs", &i.to_string(), v.clone())
+                .unwrap();
+        }
+        println!(
+            "M={} efConstruction={}: built over {} vectors in {:.1?}",
+            m,
+            ef_construction,
+            count,
+            started.elapsed()
+        );
+
+        for ef_search in [16, 64, 256] {
+            let found: usize = queries
+                .iter()
+                .zip(&truth)
+                .map(|(q, expected)| {
+                    graph
+                        .search(q, K, ef_search, None)
+                        .iter()
+                        .filter(|n| expected.contains(&n.id))
+                        .count()
+                })
+                .sum();
+            println!(
+                "  efSearch={:<4} recall@{} = {:.3}",
+                ef_search,
+                K,
+                found as f64 / (QUERIES * K) as f64
+            );
+            let id = format!("m{}_efc{}_ef{}", m, ef_construction, ef_search);
+            group.bench_with_input(BenchmarkId::new("search", id), &ef_search, |b, &ef| {
+                b.iter(|| graph.search(&queries[0], K, ef, None))
+            });
+        }
+    }
+    group.finish();
+}
+
+criterion_group!(benches, bench_recall);
+criterion_main!(benches);
@@ -0,0 +1,91 @@
+use code_rag::storage::similarity::{cosine_distance, normalize, unit_cosine_distance, Metric};
+use criterion::{criterion_group, criterion_main, BenchmarkId, Criterion, Throughput};
+
+/// Dimension of small embedding models such as `bge-small-en-v1.5`.
+const DIM: usize = 384;
+
+/// Deterministic vectors so runs are comparable.
+fn vectors(count: usize, seed: u64) -> Vec<f32> {
+    let mut state = seed;
+    (0..count * DIM)
+        .map(|_| {
+            state = state
+                .wrapping_mul(6364136223846793005)
+                .wrapping_add(1442695040888963407);
+            ((state >> 40) as f32 / (1u64 << 24) as f32) * 2.0 - 1.0
+        })
+        .collect()
+}
+
+/// Full scan of `count` vectors, as `SqliteStore::search_chunks` does.
+///
+/// `scalar` computes both norms per comparison (the previous implementation);
+/// `unit_dot` compares pre-normalized vectors with one vectorized dot product.
+/// The 1M case holds about 1.5 GB of vectors.
+fn bench_scan(c: &mut Criterion) {
+    let mut group = c.benchmark_group("cosine_scan");
+    group.sample_size(10);
+
+    for count in [100_000, 1_000_000] {
+        let mut stored = vectors(count, 1);
+        let query = vectors(1, 2);
+        group.throughput(Throughput::Elements(count as u64));
+        group.bench_with_input(BenchmarkId::new("scalar", count), &stored, |b, raw| {
+            b.iter(|| {
+                raw.chunks_exact(DIM)
+                    .map(|v| cosine_distance(&query, v))
+                    .fold(f32::INFINITY, f32::min)
+            })
+        });
+
+        // Normalized in place so both variants share one allocation
+        for vector in stored.chunks_exact_mut(DIM) {
+            normalize(vector);
+        }
+        let mut unit_query = query.clone();
+        normalize(&mut unit_query);
+        group.bench_with_input(BenchmarkId::new("unit_dot", count), &stored, |b, unit| {
+            b.iter(|| {
+                unit.chunks_exact(DIM)
+                    .map(|v| unit_cosine_distance(&unit_query, v))
+                    .fold(f32::INFINITY, f32::min)
+            })
+        });
+    }
+    group.finish();
+}
+
+/// Full scan of 100k vectors by each `distance_metric`, prepared as the
+/// stores keep them. Cosine and dot share a kernel; L2 subtracts before
+/// multiplying.
+fn bench_metrics(c: &mut Criterion) {
+    let mut group = c.benchmark_group("metric_scan");
+    group.sample_size(10);
+
+    let count = 100_000;
+    group.throughput(Throughput::Elements(count as u64));
+    for metric in [Metric::Cosine, Metric::Dot, Metric::L2] {
+        let mut stored = vectors(count, 1);
+        for vector in stored.chunks_exact_mut(DIM) {
+            metric.prepare(vector);
+        }
+        let mut query = vectors(1, 2);
+        metric.prepare(&mut query);
+        group.bench_with_input(
+            BenchmarkId::new(metric.as_str(), count),
+            &stored,
+            |b, stored| {
+                b.iter(|| {
+                    stored
+                        .chunks_exact(DIM)
+                        .map(|v| metric.distance(&query, v))
+                        .fold(f32::INFINITY, f32::min)
+                })
+            },
+        );
+    }
+    group.finish();
+}
+
+criterion_group!(benches, bench_scan, bench_metrics);
+criterion_main!(benches);
@@ -8,7 +8,15 @@ use std::sync::{Arc, Mutex};
 use tantivy::collector::TopDocs;
 use tantivy::query::QueryParser;
 use tantivy::schema::*;
-use tantivy::{Index, IndexReader, IndexWriter, ReloadPolicy, TantivyDocument, Term};
+use tantivy::{
+    Index, IndexReader, IndexSettings, IndexWriter, ReloadPolicy, TantivyDocument, Term,
+};
+
+mod tokenizer;
+pub use tokenizer::{identifier_words, CodeTokenizer, CODE_TOKENIZER};
+
+/// Default weight of doc comment matches relative to code matches.
+pub const DEFAULT_DOC_BOOST: f32 = 2.0;
 
 /// Full-text search index using the BM25 ranking algorithm.
 ///
@@ -16,6 +24,15 @@ use tantivy::{Index, IndexReader, IndexWriter, ReloadPolicy, TantivyDocument, Te
 /// Uses Tantivy for the underlying inverted index implementation with configurable
 /// merge policies for optimizing read vs write performance.
 ///
+/// Code is tokenized with [`CodeTokenizer`], which splits camelCase and
+/// snake_case identifiers into words. Indexes created before it existed keep
+/// their original tokenizer until they are rebuilt with `index --force`.
+///
+/// Doc comments ([`CodeChunk::doc`]) are indexed in a separate `doc` field whose
+/// matches count [`with_doc_boost`](Self::with_doc_boost) times as much as
+/// matches in the code, so natural-language queries favor documented symbols.
+/// A doc match returns the chunk holding the declaration itself.
+///
 /// # Examples
 ///
 /// ```no_run
@@ -39,6 +56,17 @@ pub struct BM25Index {
     line_start_field: Field,
     line_end_field: Field,
     workspace_field: Field,
+    /// Missing in indexes created before doc comments were indexed
+    doc_field: Option<Field>,
+    /// Missing in indexes created before Go packages were recorded
+    package_field: Option<Field>,
+    /// Missing in indexes created before test code was flagged
+    is_test_field: Option<Field>,
+    /// Missing in indexes created before collections were recorded
+    collection_field: Option<Field>,
+    /// Missing in indexes created before user tags were recorded
+    tags_field: Option<Field>,
+    doc_boost: f32,
 }
 
 /// A single search result from the BM25 index.
@@ -58,6 +86,14 @@ pub struct BM25Result {
     pub line_end: u64,
     /// BM25 relevance score (higher is better)
     pub score: f32,
+    /// Go package of the chunk, see [`CodeChunk::package`]
+    pub package: Option<String>,
+    /// Whether the chunk is test code, see [`CodeChunk::is_test`]
+    pub is_test: bool,
+    /// Collection the chunk was indexed into, see [`CodeChunk::collection`]
+    pub collection: Option<String>,
+    /// User tags of the chunk, see [`CodeChunk::tags`]
+    pub tags: Vec<String>,
 }
 
 impl BM25Index {
@@ -77,17 +113,50 @@ impl BM25Index {
         let mut schema_builder = Schema::builder();
         schema_builder.add_text_field("id", STRING | STORED); // Unique ID
         schema_builder.add_text_field("filename", STRING | STORED); // Filename
-        schema_builder.add_text_field("code", TEXT | STORED);
+        let code_indexing = TextFieldIndexing::default()
+            .set_tokenizer(CODE_TOKENIZER)
+            .set_index_option(IndexRecordOption::WithFreqsAndPositions);
+        schema_builder.add_text_field(
+            "code",
+            TextOptions::default()
+                .set_indexing_options(code_indexing)
+                .set_stored(),
+        );
         schema_builder.add_u64_field("line_start", STORED);
         schema_builder.add_u64_field("line_end", STORED);
         schema_builder.add_text_field("workspace", STRING | STORED); // Workspace isolation
+        schema_builder.add_text_field(
+            "doc",
+            TextOptions::default().set_indexing_options(
+                TextFieldIndexing::default()
+                    .set_tokenizer(CODE_TOKENIZER)
+                    .set_index_option(IndexRecordOption::WithFreqsAndPositions),
+            ),
+        );
+
+        schema_builder.add_text_field("package", STRING | STORED);
+        schema_builder.add_bool_field("is_test", STORED);
+        schema_builder.add_text_field("collection", STRING | STORED);
+        schema_builder.add_text_field("tags", STRING | STORED);
 
-        let schema = schema_builder.build();
+        let current_schema = schema_builder.build();
 
-        let index = Index::open_or_create(
-            tantivy::directory::MmapDirectory::open(&index_path)?,
-            schema.clone(),
-        )?;
+        let directory = tantivy::directory::MmapDirectory::open(&index_path)?;
+        let index = if Index::exists(&directory)? {
+            Index::open(directory)?
+        } else {
+            Index::create(directory, current_schema.clone(), IndexSettings::default())?
+        };
+        index.tokenizers().register(CODE_TOKENIZER, CodeTokenizer);
+
+        // Older indexes are opened with the schema they were written with
+        let schema = index.schema();
+        if schema != current_schema {
+            tracing::warn!(
+                "BM25 index at {} predates identifier-aware tokenization, doc comment indexing, Go package, test code, collection or tag metadata; re-index with --force to enable them.",
+                index_path.display()
+            );
+        }
 
         let writer = if readonly {
             None
@@ -133,6 +202,11 @@ impl BM25Index {
         let line_start_field = schema.get_field("line_start")?;
         let line_end_field = schema.get_field("line_end")?;
         let workspace_field = schema.get_field("workspace")?;
+        let doc_field = schema.get_field("doc").ok();
+        let package_field = schema.get_field("package").ok();
+        let is_test_field = schema.get_field("is_test").ok();
+        let collection_field = schema.get_field("collection").ok();
+        let tags_field = schema.get_field("tags").ok();
 
         Ok(Self {
             index,
@@ -145,9 +219,21 @@ impl BM25Index {
             line_start_field,
             line_end_field,
             workspace_field,
+            doc_field,
+            package_field,
+            is_test_field,
+            collection_field,
+            tags_field,
+            doc_boost: DEFAULT_DOC_BOOST,
         })
     }
 
+    /// Sets how much a doc comment match weighs relative to a code match.
+    pub fn with_doc_boost(mut self, boost: f32) -> Self {
+        self.doc_boost = boost;
+        self
+    }
+
     /// Indexes code chunks with workspace isolation.
     ///
     /// Deletes existing chunks with the same ID to prevent duplicates.
@@ -170,7 +256,7 @@ impl BM25Index {
         let workspace_field = self.workspace_field;
 
         for chunk in chunks {
-            let chunk_id = format!("{}-{}-{}", chunk.filename, chunk.line_start, chunk.line_end);
+            let chunk_id = chunk.id();
 
             // Delete existing document with this ID to prevent duplicates (though upstream logic might handle this)
             // tantivy delete is term-based.
@@ -184,6 +270,25 @@ impl BM25Index {
             doc.add_u64(line_start_field, chunk.line_start as u64);
             doc.add_u64(line_end_field, chunk.line_end as u64);
             doc.add_text(workspace_field, workspace);
+            if let (Some(doc_field), Some(text)) = (self.doc_field, &chunk.doc) {
+                doc.add_text(doc_field, text);
+            }
+            if let (Some(package_field), Some(package)) = (self.package_field, &chunk.package) {
+                doc.add_text(package_field, package);
+            }
+            if let Some(is_test_field) = self.is_test_field {
+                doc.add_bool(is_test_field, chunk.is_test);
+            }
+            if let (Some(collection_field), Some(collection)) =
+                (self.collection_field, &chunk.collection)
+            {
+                doc.add_text(collection_field, collection);
+            }
+            if let Some(tags_field) = self.tags_field {
+                for tag in &chunk.tags {
+                    doc.add_text(tags_field, tag);
+                }
+            }
 
             writer.add_document(doc)?;
         }
@@ -346,7 +451,12 @@ impl BM25Index {
         let line_end_field = self.line_end_field;
         let workspace_field = self.workspace_field;
 
-        let query_parser = QueryParser::for_index(&self.index, vec![code_field, filename_field]);
+        let mut fields = vec![code_field, filename_field];
+        fields.extend(self.doc_field);
+        let mut query_parser = QueryParser::for_index(&self.index, fields);
+        if let Some(doc_field) = self.doc_field {
+            query_parser.set_field_boost(doc_field, self.doc_boost);
+        }
         let mut query = query_parser.parse_query(query_str)?;
 
         if let Some(ws) = workspace {
@@ -388,6 +498,31 @@ impl BM25Index {
                 .get_first(line_end_field)
                 .and_then(|v| v.as_u64())
                 .ok_or_else(|| anyhow!("Missing or invalid 'line_end' field in document"))?;
+            let package = self
+                .package_field
+                .and_then(|f| retrieved_doc.get_first(f))
+                .and_then(|v| v.as_str())
+                .map(str::to_string);
+            let is_test = self
+                .is_test_field
+                .and_then(|f| retrieved_doc.get_first(f))
+                .and_then(|v| v.as_bool())
+                .unwrap_or(false);
+            let collection = self
+                .collection_field
+                .and_then(|f| retrieved_doc.get_first(f))
+                .and_then(|v| v.as_str())
+                .map(str::to_string);
+            let tags = self
+                .tags_field
+                .map(|f| {
+                    retrieved_doc
+                        .get_all(f)
+                        .filter_map(|v| v.as_str())
+                        .map(str::to_string)
+                        .collect()
+                })
+                .unwrap_or_default();
 
             results.push(BM25Result {
                 id,
@@ -396,6 +531,10 @@ impl BM25Index {
                 line_start,
                 line_end,
                 score,
+                package,
+                is_test,
+                collection,
+                tags,
             });
         }
 
@@ -435,6 +574,7 @@ mod tests {
                 line_end: 3,
                 last_modified: 0,
                 calls: vec![],
+                ..Default::default()
             },
             CodeChunk {
                 filename: "test.py".to_string(),
@@ -443,6 +583,7 @@ mod tests {
                 line_end: 2,
                 last_modified: 0,
                 calls: vec![],
+                ..Default::default()
             },
         ];
 
@@ -473,6 +614,7 @@ mod tests {
             line_end: 3,
             last_modified: 0,
             calls: vec![],
+            ..Default::default()
         }];
         index
             .add_chunks(&chunks, "default")
@@ -499,4 +641,129 @@ mod tests {
             "Should have deleted file contents"
         );
     }
+
+    #[test]
+    fn test_identifier_words_match_across_styles() {
+        let (index, _temp_dir) = setup_test_index();
+
+        let chunks = vec![
+            CodeChunk {
+                filename: "user.go".to_string(),
+                code: "func (s *Service) RegisterUser(name string) error {}".to_string(),
+                line_start: 1,
+                line_end: 1,
+                ..Default::default()
+            },
+            CodeChunk {
+                filename: "user.py".to_string(),
+                code: "def register_user(name): pass".to_string(),
+                line_start: 1,
+                line_end: 1,
+                ..Default::default()
+            },
+            CodeChunk {
+                filename: "other.go".to_string(),
+                code: "func Register(u User) {}".to_string(),
+                line_start: 1,
+                line_end: 1,
+                ..Default::default()
+            },
+        ];
+        index
+            .add_chunks(&chunks, "default")
+            .expect("Failed to add chunks");
+        index.commit().expect("Failed to commit");
+        index.reader.reload().expect("Failed to reload");
+
+        let search = |q: &str| -> Vec<String> {
+            let mut files: Vec<String> = index
+                .search(q, 10, Some("default"))
+                .expect("Search failed")
+                .into_iter()
+                .map(|r| r.filename)
+                .collect();
+            files.sort();
+            files
+        };
+
+        // Identifiers are matched as a phrase of their words
+        assert_eq!(search("RegisterUser"), vec!["user.go", "user.py"]);
+        assert_eq!(search("register_user"), vec!["user.go", "user.py"]);
+        assert_eq!(search("user"), vec!["other.go", "user.go", "user.py"]);
+    }
+
+    #[test]
+    fn test_doc_comment_matches_rank_first() {
+        let (index, _temp_dir) = setup_test_index();
+
+        let chunks = vec![
+            CodeChunk {
+                filename: "audit.go".to_string(),
+                code: "func Audit() { log(\"authentication attempt\") }".to_string(),
+                line_start: 1,
+                line_end: 1,
+                ..Default::default()
+            },
+            CodeChunk {
+                filename: "auth.go".to_string(),
+                code: "// Login handles authentication.\nfunc Login(user string) {}".to_string(),
+                line_start: 1,
+                line_end: 2,
+                doc: Some("Login handles authentication.".to_string()),
+                package: Some("auth".to_string()),
+                ..Default::default()
+            },
+        ];
+        index
+            .add_chunks(&chunks, "default")
+            .expect("Failed to add chunks");
+        index.commit().expect("Failed to commit");
+        index.reader.reload().expect("Failed to reload");
+
+        let results = index
+            .search("authentication", 10, Some("default"))
+            .expect("Search failed");
+        assert_eq!(results.len(), 2);
+        assert_eq!(results[0].filename, "auth.go");
+        // The match returns the full code chunk
+        assert!(results[0].code.contains("func Login"));
+        assert_eq!(results[0].package.as_deref(), Some("auth"));
+        assert_eq!(results[1].package, None);
+    }
+
+    #[test]
+    fn test_opens_index_with_legacy_tokenizer() {
+        let temp_dir = TempDir::new().expect("Failed to create temp dir");
+        let index_path = temp_dir.path().join("bm25_index");
+        fs::create_dir_all(&index_path).unwrap();
+
+        let mut schema_builder = Schema::builder();
+        schema_builder.add_text_field("id", STRING | STORED);
+        schema_builder.add_text_field("filename", STRING | STORED);
+        schema_builder.add_text_field("code", TEXT | STORED);
+        schema_builder.add_u64_field("line_start", STORED);
+        schema_builder.add_u64_field("line_end", STORED);
+        schema_builder.add_text_field("workspace", STRING | STORED);
+        Index::create_in_dir(&index_path, schema_builder.build()).unwrap();
+
+        let db_path = temp_dir.path().to_str().unwrap();
+        let index = BM25Index::new(db_path, false, "log").expect("Failed to open legacy index");
+        let chunks = vec![CodeChunk {
+            filename: "legacy.rs".to_string(),
+            code: "fn legacy_func() {}".to_string(),
+            line_start: 1,
+            line_end: 1,
+            ..Default::default()
+        }];
+        index
+            .add_chunks(&chunks, "default")
+            .expect("Failed to add chunks");
+        index.commit().expect("Failed to commit");
+        index.reader.reload().expect("Failed to reload");
+
+        let results = index
+            .search("legacy_func", 10, Some("default"))
+            .expect("Search failed");
+        assert_eq!(results.len(), 1);
+    }
 }
@@ -0,0 +1,176 @@
+use tantivy::tokenizer::{Token, TokenStream, Tokenizer};
+
+/// Name under which [`CodeTokenizer`] is registered on the BM25 index.
+pub const CODE_TOKENIZER: &str = "code";
+
+/// Tokens longer than this are dropped, like tantivy's default tokenizer does.
+const MAX_TOKEN_LEN: usize = 40;
+
+/// Tokenizer for source code that splits identifiers into their words.
+///
+/// `RegisterUser`, `registerUser` and `register_user` all produce the tokens
+/// `register`, `user` at consecutive positions, so a keyword search for
+/// either spelling matches the others as a phrase, and `user` alone matches
+/// too. Acronyms stay together (`HTTPServer` is `http`, `server`), and digits
+/// stick to the word they follow (`sha256`).
+#[derive(Clone, Default)]
+pub struct CodeTokenizer;
+
+pub struct CodeTokenStream {
+    tokens: Vec<Token>,
+    current: usize,
+}
+
+impl Tokenizer for CodeTokenizer {
+    type TokenStream<'a> = CodeTokenStream;
+
+    fn token_stream<'a>(&'a mut self, text: &'a str) -> Self::TokenStream<'a> {
+        let tokens = split_words(text)
+            .into_iter()
+            .enumerate()
+            .map(|(position, (offset_from, offset_to))| Token {
+                offset_from,
+                offset_to,
+                position,
+                text: text[offset_from..offset_to].to_lowercase(),
+                position_length: 1,
+            })
+            .collect();
+        CodeTokenStream { tokens, current: 0 }
+    }
+}
+
+impl TokenStream for CodeTokenStream {
+    fn advance(&mut self) -> bool {
+        if self.current < self.tokens.len() {
+            self.current += 1;
+            true
+        } else {
+            false
+        }
+    }
+
+    fn token(&self) -> &Token {
+        &self.tokens[self.current - 1]
+    }
+
+    fn token_mut(&mut self) -> &mut Token {
+        &mut self.tokens[self.current - 1]
+    }
+}
+
+/// The words of `text` as [`CodeTokenizer`] indexes them: split at `_` and
+/// case changes, lowercased.
+pub fn identifier_words(text: &str) -> Vec<String> {
+    split_words(text)
+        .into_iter()
+        .map(|(from, to)| text[from..to].to_lowercase())
+        .collect()
+}
+
+/// Byte ranges of the words in `text`, splitting identifiers at `_` and case changes.
+fn split_words(text: &str) -> Vec<(usize, usize)> {
+    let mut words = Vec::new();
+    let mut start: Option<usize> = None;
+    let chars: Vec<(usize, char)> = text.char_indices().collect();
+
+    for (i, &(offset, c)) in chars.iter().enumerate() {
+        if !c.is_alphanumeric() {
+            if let Some(s) = start.take() {
+                words.push((s, offset));
+            }
+            continue;
+        }
+        let Some(s) = start else {
+            start = Some(offset);
+            continue;
+        };
+        let prev = chars[i - 1].1;
+        let next = chars.get(i + 1).map(|&(_, n)| n);
+        // fooBar | FOOBar: a new word starts at an uppercase letter that follows
+        // a lowercase letter or digit, or that starts a lowercase run after capitals
+        let boundary = c.is_uppercase()
+            && (prev.is_lowercase()
+                || prev.is_numeric()
+                || (prev.is_uppercase() && next.is_some_and(char::is_lowercase)));
+        if boundary {
+            words.push((s, offset));
+            start = Some(offset);
+        }
+    }
+    if let Some(s) = start {
+        words.push((s, text.len()));
+    }
+
+    words.retain(|&(from, to)| to - from <= MAX_TOKEN_LEN);
+    words
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn words(text: &str) -> Vec<String> {
+        let mut tokenizer = CodeTokenizer;
+        let mut stream = tokenizer.token_stream(text);
+        let mut words = Vec::new();
+        while stream.advance() {
+            words.push(stream.token().text.clone());
+        }
+        words
+    }
+
+    #[test]
+    fn test_splits_identifiers() {
+        assert_eq!(words("RegisterUser"), vec!["register", "user"]);
+        assert_eq!(words("registerUser"), vec!["register", "user"]);
+        assert_eq!(words("register_user"), vec!["register", "user"]);
+        assert_eq!(words("REGISTER_USER"), vec!["register", "user"]);
+        assert_eq!(words("HTTPServer"), vec!["http", "server"]);
+        assert_eq!(words("parseJSON"), vec!["parse", "json"]);
+        assert_eq!(words("sha256Sum"), vec!["sha256", "sum"]);
+    }
+
+    #[test]
+    fn test_splits_code() {
+        assert_eq!(
+            words("func (s *AuthService) Authenticate(user string) {"),
+            vec![
+                "func",
+                "s",
+                "auth",
+                "service",
+                "authenticate",
+                "user",
+                "string"
+            ]
+        );
+        assert_eq!(words("naïveCafé"), vec!["naïve", "café"]);
+    }
+
+    #[test]
+    fn test_offsets_and_positions() {
+        let mut tokenizer = CodeTokenizer;
+        let mut stream = tokenizer.token_stream("a.getUserID()");
+        let mut tokens = Vec::new();
+        while stream.advance() {
+            let t = stream.token();
+            tokens.push((t.text.clone(), t.offset_from, t.offset_to, t.position));
+        }
+        assert_eq!(
+            tokens,
+            vec![
+                ("a".to_string(), 0, 1, 0),
+                ("get".to_string(), 2, 5, 1),
+                ("user".to_string(), 5, 9, 2),
+                ("id".to_string(), 9, 11, 3),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_drops_long_tokens() {
+        let long = "a".repeat(MAX_TOKEN_LEN + 1);
+        assert_eq!(words(&format!("keep {} this", long)), vec!["keep", "this"]);
+    }
+}
@@ -0,0 +1,380 @@
+use crate::indexer::{CodeChunk, DocType};
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, BTreeSet, HashMap, VecDeque};
+use std::fs;
+use std::path::{Path, PathBuf};
+
+/// File name of the call graph stored next to the LanceDB tables.
+pub const CALL_GRAPH_FILE: &str = "callgraph.json";
+
+/// Current on-disk format version of the call graph.
+pub const CALL_GRAPH_VERSION: u32 = 1;
+
+/// A symbol declared in an indexed file and the calls made from its body.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct SymbolNode {
+    /// Symbol ID, e.g. `main.AuthService.Authenticate`
+    pub symbol: String,
+    /// ID of the chunk holding the declaration
+    pub chunk_id: String,
+    /// Raw call expressions, e.g. `service.Authenticate`
+    pub calls: Vec<String>,
+}
+
+/// Caller/callee relations between indexed symbols.
+///
+/// Symbols are recorded per file while chunking, so incremental re-indexing
+/// only replaces the entries of files that changed. Call expressions are
+/// resolved to symbols by their last name segment, preferring symbols of the
+/// caller's own package or module.
+///
+/// # Examples
+///
+/// ```no_run
+/// use code_rag::callgraph::CallGraph;
+///
+/// # fn main() -> anyhow::Result<()> {
+/// let graph = CallGraph::load("./.lancedb")?.unwrap_or_default();
+/// for symbol in graph.neighbors("main.HandleLogin", 1) {
+///     println!("{}", symbol);
+/// }
+/// # Ok(())
+/// # }
+/// ```
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct CallGraph {
+    pub version: u32,
+    pub files: BTreeMap<String, Vec<SymbolNode>>,
+    #[serde(skip)]
+    edges: Option<Edges>,
+}
+
+/// Resolved adjacency, built lazily from `files`.
+#[derive(Debug, Clone, Default)]
+struct Edges {
+    callees: HashMap<String, BTreeSet<String>>,
+    callers: HashMap<String, BTreeSet<String>>,
+    nodes: HashMap<String, (String, String)>,
+}
+
+impl Default for CallGraph {
+    fn default() -> Self {
+        Self {
+            version: CALL_GRAPH_VERSION,
+            files: BTreeMap::new(),
+            edges: None,
+        }
+    }
+}
+
+impl CallGraph {
+    /// Returns the call graph location for a database directory.
+    pub fn path(db_path: &str) -> PathBuf {
+        Path::new(db_path).join(CALL_GRAPH_FILE)
+    }
+
+    /// Loads the call graph stored in `db_path`, or `Ok(None)` if none was written.
+    pub fn load(db_path: &str) -> Result<Option<Self>> {
+        let path = Self::path(db_path);
+        if !path.exists() {
+            return Ok(None);
+        }
+        let content = fs::read_to_string(&path)
+            .with_context(|| format!("Failed to read call graph {}", path.display()))?;
+        let mut graph: Self = serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse call graph {}", path.display()))?;
+        if graph.version > CALL_GRAPH_VERSION {
+            anyhow::bail!(
+                "Call graph {} has format version {} but this build only understands version {}. \
+                Upgrade code-rag or re-index with --force.",
+                path.display(),
+                graph.version,
+                CALL_GRAPH_VERSION
+            );
+        }
+        graph.edges = Some(graph.resolve());
+        Ok(Some(graph))
+    }
+
+    /// Writes the call graph to `db_path` via a temporary file and rename.
+    pub fn save(&self, db_path: &str) -> Result<()> {
+        fs::create_dir_all(db_path)
+            .with_context(|| format!("Failed to create database directory {}", db_path))?;
+        let path = Self::path(db_path);
+        let tmp_path = path.with_extension("json.tmp");
+        let content = serde_json::to_string(self)?;
+        fs::write(&tmp_path, content)
+            .with_context(|| format!("Failed to write call graph {}", tmp_path.display()))?;
+        fs::rename(&tmp_path, &path)
+            .with_context(|| format!("Failed to replace call graph {}", path.display()))?;
+        Ok(())
+    }
+
+    /// Replaces the symbols recorded for `filename` with those of `chunks`.
+    ///
+    /// Chunks without a symbol (line-based fallbacks) and files of
+    /// documentation are ignored.
+    pub fn insert_file(&mut self, filename: &str, chunks: &[CodeChunk]) {
+        let mut nodes: Vec<SymbolNode> = Vec::new();
+        // The symbols of doc sections are heading paths, not callable names
+        let chunks = if DocType::of_file(filename) == DocType::Code {
+            chunks
+        } else {
+            &[]
+        };
+        for chunk in chunks {
+            let Some(symbol) = &chunk.symbol else {
+                continue;
+            };
+            // Oversized declarations are split into several chunks sharing a symbol
+            if let Some(node) = nodes.iter_mut().find(|n| &n.symbol == symbol) {
+                for call in &chunk.calls {
+                    if !node.calls.contains(call) {
+                        node.calls.push(call.clone());
+                    }
+                }
+                continue;
+            }
+            nodes.push(SymbolNode {
+                symbol: symbol.clone(),
+                chunk_id: chunk.id(),
+                calls: chunk.calls.clone(),
+            });
+        }
+        self.edges = None;
+        if nodes.is_empty() {
+            self.files.remove(filename);
+        } else {
+            self.files.insert(filename.to_string(), nodes);
+        }
+    }
+
+    /// Copies the entry of `filename` from `previous`, for files that didn't change.
+    pub fn keep_file(&mut self, previous: &CallGraph, filename: &str) {
+        if let Some(nodes) = previous.files.get(filename) {
+            self.edges = None;
+            self.files.insert(filename.to_string(), nodes.clone());
+        }
+    }
+
+    /// Returns `(filename, chunk_id)` of the declaration of `symbol`.
+    pub fn location(&self, symbol: &str) -> Option<(String, String)> {
+        match &self.edges {
+            Some(edges) => edges.nodes.get(symbol).cloned(),
+            None => self.resolve().nodes.get(symbol).cloned(),
+        }
+    }
+
+    /// Symbols within `hops` call-graph edges of `symbol`, in either direction.
+    ///
+    /// Results are ordered by distance, then by name; `symbol` itself is excluded.
+    pub fn neighbors(&self, symbol: &str, hops: usize) -> Vec<String> {
+        let resolved;
+        let edges = match &self.edges {
+            Some(edges) => edges,
+            None => {
+                resolved = self.resolve();
+                &resolved
+            }
+        };
+
+        let mut seen: BTreeSet<&str> = BTreeSet::from([symbol]);
+        let mut found = Vec::new();
+        let mut queue = VecDeque::from([(symbol, 0)]);
+        while let Some((current, depth)) = queue.pop_front() {
+            if depth == hops {
+                continue;
+            }
+            let next = edges
+                .callees
+                .get(current)
+                .into_iter()
+                .chain(edges.callers.get(current))
+                .flatten()
+                .map(String::as_str)
+                .collect::<BTreeSet<_>>();
+            for neighbor in next {
+                if seen.insert(neighbor) {
+                    found.push(neighbor.to_string());
+                    queue.push_back((neighbor, depth + 1));
+                }
+            }
+        }
+        found
+    }
+
+    fn resolve(&self) -> Edges {
+        let mut edges = Edges::default();
+        // Last name segment -> symbols carrying it
+        let mut by_name: HashMap<&str, Vec<&str>> = HashMap::new();
+        for (filename, nodes) in &self.files {
+            for node in nodes {
+                by_name
+                    .entry(last_segment(&node.symbol))
+                    .or_default()
+                    .push(&node.symbol);
+                edges.nodes.insert(
+                    node.symbol.clone(),
+                    (filename.clone(), node.chunk_id.clone()),
+                );
+            }
+        }
+
+        for node in self.files.values().flatten() {
+            let package = first_segment(&node.symbol);
+            for call in &node.calls {
+                let Some(candidates) = by_name.get(last_segment(call)) else {
+                    continue;
+                };
+                let local: Vec<&str> = candidates
+                    .iter()
+                    .copied()
+                    .filter(|c| first_segment(c) == package)
+                    .collect();
+                let targets = match (local.len(), candidates.len()) {
+                    (0, 1) => candidates.clone(),
+                    (0, _) => continue, // Ambiguous across packages
+                    _ => local,
+                };
+                for target in targets {
+                    if target == node.symbol {
+                        continue;
+                    }
+                    edges
+                        .callees
+                        .entry(node.symbol.clone())
+                        .or_default()
+                        .insert(target.to_string());
+                    edges
+                        .callers
+                        .entry(target.to_string())
+                        .or_default()
+                        .insert(node.symbol.clone());
+                }
+            }
+        }
+        edges
+    }
+}
+
+fn last_segment(name: &str) -> &str {
+    name.rsplit('.').next().unwrap_or(name)
+}
+
+fn first_segment(name: &str) -> &str {
+    name.split('.').next().unwrap_or(name)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn chunk(symbol: &str, line_start: usize, calls: &[&str]) -> CodeChunk {
+        CodeChunk {
+            filename: "main.go".to_string(),
+            line_start,
+            line_end: line_start + 1,
+            symbol: Some(symbol.to_string()),
+            calls: calls.iter().map(|c| c.to_string()).collect(),
+            ..Default::default()
+        }
+    }
+
+    fn auth_graph() -> CallGraph {
+        let mut graph = CallGraph::default();
+        graph.insert_file(
+            "main.go",
+            &[
+                chunk("main.NewAuthService", 21, &["make"]),
+                chunk("main.AuthService.Authenticate", 28, &["fmt.Errorf"]),
+                chunk(
+                    "main.HandleLogin",
+                    50,
+                    &["r.FormValue", "NewAuthService", "service.Authenticate"],
+                ),
+                chunk("main.main", 65, &["http.HandleFunc", "fmt.Println"]),
+            ],
+        );
+        graph
+    }
+
+    #[test]
+    fn test_neighbors_include_callers_and_callees() {
+        let graph = auth_graph();
+        assert_eq!(
+            graph.neighbors("main.HandleLogin", 1),
+            vec!["main.AuthService.Authenticate", "main.NewAuthService"]
+        );
+        assert_eq!(
+            graph.neighbors("main.NewAuthService", 1),
+            vec!["main.HandleLogin"]
+        );
+        assert_eq!(
+            graph.neighbors("main.NewAuthService", 2),
+            vec!["main.HandleLogin", "main.AuthService.Authenticate"]
+        );
+        assert!(graph.neighbors("main.main", 3).is_empty());
+    }
+
+    #[test]
+    fn test_go_test_asset_graph() {
+        let source = include_str!("../test_assets/test.go");
+        let chunks = crate::indexer::GoSymbolChunker::new(1024, 128).chunk("test.go", source, 0);
+
+        let mut graph = CallGraph::default();
+        graph.insert_file("test.go", &chunks);
+
+        let neighbors = graph.neighbors("main.HandleLogin", 1);
+        assert!(neighbors.contains(&"main.NewAuthService".to_string()));
+        assert!(neighbors.contains(&"main.AuthService.Authenticate".to_string()));
+    }
+
+    #[test]
+    fn test_prefers_callees_in_same_package() {
+        let mut graph = CallGraph::default();
+        graph.insert_file(
+            "a/a.go",
+            &[chunk("a.Run", 1, &["Helper"]), chunk("a.Helper", 5, &[])],
+        );
+        graph.insert_file("b/b.go", &[chunk("b.Helper", 1, &[])]);
+        assert_eq!(graph.neighbors("a.Run", 1), vec!["a.Helper"]);
+    }
+
+    #[test]
+    fn test_save_load_and_keep_file() {
+        let dir = TempDir::new().unwrap();
+        let db_path = dir.path().to_str().unwrap();
+
+        let graph = auth_graph();
+        graph.save(db_path).unwrap();
+        let loaded = CallGraph::load(db_path).unwrap().unwrap();
+        assert_eq!(loaded.files, graph.files);
+        assert_eq!(
+            loaded.location("main.HandleLogin"),
+            Some((
+                "main.go".to_string(),
+                chunk("main.HandleLogin", 50, &[]).id()
+            ))
+        );
+
+        let mut next = CallGraph::default();
+        next.keep_file(&loaded, "main.go");
+        next.keep_file(&loaded, "missing.go");
+        assert_eq!(next.files, graph.files);
+    }
+
+    #[test]
+    fn test_insert_file_without_symbols_removes_entry() {
+        let mut graph = auth_graph();
+        graph.insert_file(
+            "main.go",
+            &[CodeChunk {
+                filename: "main.go".to_string(),
+                ..Default::default()
+            }],
+        );
+        assert!(graph.files.is_empty());
+    }
+}
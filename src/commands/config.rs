@@ -0,0 +1,133 @@
+use colored::*;
+use serde::Serialize;
+use serde_json::Value;
+use std::collections::BTreeMap;
+use std::path::PathBuf;
+
+use crate::config::AppConfig;
+use crate::core::CodeRagError;
+
+/// Effective configuration, printed by `code-rag config print --json`.
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct EffectiveConfig<'a> {
+    /// Config files that were loaded, lowest precedence first
+    pub files: &'a [PathBuf],
+    /// The settings, with header values masked (see [`masked_values`])
+    pub config: Value,
+    /// Where each set value came from
+    pub origins: &'a BTreeMap<String, String>,
+    /// Keys that matched no setting and were ignored
+    pub unknown_keys: &'a [String],
+}
+
+/// Prints the resolved configuration with the source of every value, so
+/// users can see which of defaults, files, environment and flags won.
+pub fn print_config(config: &AppConfig, json: bool) -> Result<(), CodeRagError> {
+    let provenance = &config.provenance;
+    let values = masked_values(config)?;
+    if json {
+        let output = EffectiveConfig {
+            files: &provenance.files,
+            config: values,
+            origins: &provenance.origins,
+            unknown_keys: &provenance.unknown_keys,
+        };
+        println!("{}", serde_json::to_string_pretty(&output)?);
+        return Ok(());
+    }
+
+    if provenance.files.is_empty() {
+        println!("{}", "# Config files: none".dimmed());
+    }
+    for file in &provenance.files {
+        println!("{} {}", "# Config file:".dimmed(), file.display());
+    }
+
+    let Value::Object(values) = values else {
+        return Ok(());
+    };
+    let mut keys: Vec<&String> = values.keys().collect();
+    keys.sort();
+    for key in keys {
+        let value = &values[key];
+        if value.is_null() {
+            println!("{}", format!("# {} is unset", key).dimmed());
+            continue;
+        }
+        let origin = provenance
+            .origins
+            .get(key)
+            .map(String::as_str)
+            .unwrap_or("default");
+        println!(
+            "{} = {}  {}",
+            key,
+            toml_value(value),
+            format!("# {}", origin).dimmed()
+        );
+    }
+
+    if !provenance.unknown_keys.is_empty() {
+        println!(
+            "\n{} {}",
+            "# Unknown keys (ignored):".yellow(),
+            provenance.unknown_keys.join(", ")
+        );
+    }
+    Ok(())
+}
+
+/// The settings as JSON, with the values of `embedding_headers` masked since
+/// they usually carry API keys.
+fn masked_values(config: &AppConfig) -> Result<Value, CodeRagError> {
+    let mut values = serde_json::to_value(config)?;
+    if let Some(Value::Object(headers)) = values.get_mut("embedding_headers") {
+        for value in headers.values_mut() {
+            *value = Value::String("***".to_string());
+        }
+    }
+    Ok(values)
+}
+
+/// Formats a setting as a TOML value; maps become inline tables.
+fn toml_value(value: &Value) -> String {
+    match value {
+        Value::Object(map) => {
+            if map.is_empty() {
+                return "{}".to_string();
+            }
+            let entries: Vec<String> = map
+                .iter()
+                .map(|(k, v)| format!("{} = {}", Value::String(k.clone()), toml_value(v)))
+                .collect();
+            format!("{{ {} }}", entries.join(", "))
+        }
+        Value::Array(items) => {
+            let items: Vec<String> = items.iter().map(toml_value).collect();
+            format!("[{}]", items.join(", "))
+        }
+        other => other.to_string(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    #[test]
+    fn test_toml_value() {
+        assert_eq!(toml_value(&json!("./.lancedb")), "\"./.lancedb\"");
+        assert_eq!(toml_value(&json!(0.5)), "0.5");
+        assert_eq!(
+            toml_value(&json!(["target", "*.lock"])),
+            "[\"target\", \"*.lock\"]"
+        );
+        assert_eq!(toml_value(&json!({})), "{}");
+        assert_eq!(
+            toml_value(&json!({"api": "/srv/api"})),
+            "{ \"api\" = \"/srv/api\" }"
+        );
+    }
+}
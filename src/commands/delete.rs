@@ -0,0 +1,399 @@
+use anyhow::Result;
+use serde::Serialize;
+use std::collections::{BTreeMap, HashSet};
+use std::path::Path;
+use tracing::{info, warn};
+
+use crate::bm25::BM25Index;
+use crate::callgraph::CallGraph;
+use crate::config::AppConfig;
+use crate::core::CodeRagError;
+use crate::indexer::CodeChunk;
+use crate::manifest::{
+    bump_index_version, clear_in_progress, is_in_progress, mark_in_progress, IndexManifest,
+};
+use crate::search::{symbol_matches, CandidateFilter};
+use crate::storage::{open_configured_store, store_exists, VectorStore};
+
+pub struct DeleteOptions {
+    /// Glob of the files whose chunks are removed (e.g. `internal/legacy/**`);
+    /// all files if `None`
+    pub pattern: Option<String>,
+    /// Only remove the chunks indexed into this collection
+    pub collection: Option<String>,
+    /// Only remove the chunks of this symbol, matched like `similar` targets
+    pub symbol: Option<String>,
+    pub workspace: String,
+    pub json: bool,
+}
+
+/// What `code-rag delete` removed.
+#[derive(Serialize, Debug, Default, PartialEq)]
+#[serde(rename_all = "camelCase")]
+pub struct DeleteReport {
+    pub workspace: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub pattern: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub collection: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub symbol: Option<String>,
+    /// Files that lost chunks, sorted
+    pub files: Vec<String>,
+    pub removed_chunks: usize,
+}
+
+impl DeleteReport {
+    /// The files the deletion was aimed at, for messages.
+    fn target(&self) -> String {
+        match (&self.pattern, &self.collection) {
+            (Some(pattern), Some(collection)) => format!(
+                "files matching '{}' in collection '{}'",
+                pattern, collection
+            ),
+            (Some(pattern), None) => format!("files matching '{}'", pattern),
+            (None, Some(collection)) => format!("collection '{}'", collection),
+            (None, None) => "the index".to_string(),
+        }
+    }
+}
+
+/// Chunks removed from the vector store, which the secondary indexes must follow.
+#[derive(Debug, Default)]
+struct Removal {
+    /// Chunks each touched file keeps; empty when the whole file was removed
+    kept: BTreeMap<String, Vec<CodeChunk>>,
+    removed_ids: HashSet<String>,
+    removed_chunks: usize,
+}
+
+/// Removes the chunks of files matching `filter` from `storage`, or with
+/// `symbol` only the chunks of that symbol.
+async fn remove_from_store(
+    storage: &dyn VectorStore,
+    filter: &CandidateFilter,
+    symbol: Option<&str>,
+    workspace: &str,
+) -> Result<Removal> {
+    let mut chunk_counts: BTreeMap<String, usize> = BTreeMap::new();
+    for info in storage.list_chunk_info(workspace).await? {
+        if filter.matches(&info.filename, None)
+            && filter.matches_collection(info.collection.as_deref())
+        {
+            *chunk_counts.entry(info.filename).or_default() += 1;
+        }
+    }
+
+    let mut removal = Removal::default();
+    let Some(symbol) = symbol else {
+        let files: Vec<String> = chunk_counts.keys().cloned().collect();
+        if !files.is_empty() {
+            // Through `replace_files`, which keeps the stores' own indexes in step
+            storage
+                .replace_files(workspace, &files, &[], Vec::new())
+                .await?;
+        }
+        removal.removed_chunks = chunk_counts.values().sum();
+        removal.kept = files.into_iter().map(|f| (f, Vec::new())).collect();
+        return Ok(removal);
+    };
+
+    for filename in chunk_counts.into_keys() {
+        let rows = storage.get_file_chunks(&filename, workspace).await?;
+        let (removed, kept): (Vec<_>, Vec<_>) = rows.into_iter().partition(|(chunk, _)| {
+            chunk
+                .symbol
+                .as_deref()
+                .is_some_and(|s| symbol_matches(s, symbol))
+        });
+        if removed.is_empty() {
+            continue;
+        }
+        // Stores replace by file, so the remaining chunks are written back
+        let (kept_chunks, kept_vectors): (Vec<CodeChunk>, Vec<Vec<f32>>) = kept.into_iter().unzip();
+        storage
+            .replace_files(
+                workspace,
+                std::slice::from_ref(&filename),
+                &kept_chunks,
+                kept_vectors,
+            )
+            .await?;
+        removal.removed_chunks += removed.len();
+        removal
+            .removed_ids
+            .extend(removed.iter().map(|(chunk, _)| chunk.id()));
+        removal.kept.insert(filename, kept_chunks);
+    }
+    Ok(removal)
+}
+
+/// Removes what `remove_from_store` matches from the vector store, then from
+/// the BM25 index, call graph and manifest.
+async fn remove_everywhere(
+    storage: &dyn VectorStore,
+    filter: &CandidateFilter,
+    symbol: Option<&str>,
+    workspace: &str,
+    actual_db: &str,
+    config: &AppConfig,
+) -> Result<Removal, CodeRagError> {
+    let removal = remove_from_store(storage, filter, symbol, workspace)
+        .await
+        .map_err(|e| CodeRagError::Database(e.to_string()))?;
+
+    if !removal.kept.is_empty() {
+        let bm25_index = BM25Index::new(actual_db, false, &config.merge_policy)
+            .map_err(|e| CodeRagError::Tantivy(e.to_string()))?;
+        for (filename, kept) in &removal.kept {
+            bm25_index
+                .delete_file(filename, workspace)
+                .and_then(|()| bm25_index.add_chunks(kept, workspace))
+                .map_err(|e| CodeRagError::Tantivy(e.to_string()))?;
+        }
+        bm25_index
+            .commit()
+            .map_err(|e| CodeRagError::Tantivy(e.to_string()))?;
+
+        match CallGraph::load(actual_db) {
+            Ok(Some(mut graph)) => {
+                for (filename, kept) in &removal.kept {
+                    graph.insert_file(filename, kept);
+                }
+                if let Err(e) = graph.save(actual_db) {
+                    warn!("Failed to write call graph: {}", e);
+                }
+            }
+            Ok(None) => {}
+            Err(e) => warn!("Ignoring unreadable call graph: {}", e),
+        }
+
+        let manifest =
+            IndexManifest::load(actual_db).map_err(|e| CodeRagError::Database(e.to_string()))?;
+        if let Some(mut manifest) = manifest {
+            for (filename, kept) in &removal.kept {
+                if kept.is_empty() {
+                    manifest.remove(filename);
+                } else if let Some(entry) = manifest.files.get_mut(filename) {
+                    entry
+                        .chunk_ids
+                        .retain(|id| !removal.removed_ids.contains(id));
+                }
+            }
+            manifest
+                .save(actual_db)
+                .map_err(|e| CodeRagError::Database(e.to_string()))?;
+        }
+
+        if let Err(e) = bump_index_version(actual_db) {
+            warn!("Failed to update index version: {}", e);
+        }
+        if let Err(e) = storage.flush().await {
+            warn!("Failed to save vector index: {:#}", e);
+        }
+    }
+    Ok(removal)
+}
+
+/// Removes indexed files matching `pattern` or indexed into `collection`, or
+/// a single symbol's chunks of them, from the vector store, BM25 index, call graph and manifest.
+///
+/// The complement of `index --update` for code deleted or moved outside a
+/// watch session: no source file is read and nothing is re-embedded.
+pub async fn delete_chunks(options: DeleteOptions, config: &AppConfig) -> Result<(), CodeRagError> {
+    let actual_db = if options.workspace == "default" {
+        config.db_path.clone()
+    } else {
+        Path::new(&config.db_path)
+            .join(&options.workspace)
+            .to_string_lossy()
+            .to_string()
+    };
+    if !store_exists(&config.storage_backend, &actual_db, "code_chunks") {
+        return Err(CodeRagError::Database(format!(
+            "No index found for workspace '{}' at {}.\n\
+            Run 'code-rag index --path <path> --workspace {}' to create it.",
+            options.workspace, actual_db, options.workspace
+        )));
+    }
+    if is_in_progress(&actual_db) {
+        return Err(CodeRagError::Database(format!(
+            "Index at {} is being written or a previous indexing run was interrupted. \
+            Wait for it to finish, or re-index with --force.",
+            actual_db
+        )));
+    }
+    let filter = CandidateFilter::new(
+        None,
+        None,
+        options.pattern.iter().cloned().collect(),
+        Vec::new(),
+    )
+    .map_err(|e| CodeRagError::Search(e.to_string()))?
+    .with_collections(options.collection.iter().cloned().collect());
+
+    let storage = open_configured_store(config, &actual_db, "code_chunks")
+        .await
+        .map_err(|e| CodeRagError::Database(e.to_string()))?;
+    mark_in_progress(&actual_db).map_err(|e| CodeRagError::Database(e.to_string()))?;
+    let removed = remove_everywhere(
+        storage.as_ref(),
+        &filter,
+        options.symbol.as_deref(),
+        &options.workspace,
+        &actual_db,
+        config,
+    )
+    .await;
+    // The marker goes on failure too: it would block every search, and a
+    // failed delete is repeated rather than recovered with --force
+    let cleared = clear_in_progress(&actual_db);
+    let removal = removed?;
+    cleared.map_err(|e| CodeRagError::Database(e.to_string()))?;
+
+    let report = DeleteReport {
+        workspace: options.workspace,
+        pattern: options.pattern,
+        collection: options.collection,
+        symbol: options.symbol,
+        files: removal.kept.into_keys().collect(),
+        removed_chunks: removal.removed_chunks,
+    };
+    if report.files.is_empty() {
+        match &report.symbol {
+            Some(symbol) => warn!(
+                "No chunk of symbol '{}' in {} in workspace '{}'",
+                symbol,
+                report.target(),
+                report.workspace
+            ),
+            None => warn!(
+                "No indexed file in {} in workspace '{}'",
+                report.target(),
+                report.workspace
+            ),
+        }
+    }
+    info!(
+        files = report.files.len(),
+        chunks = report.removed_chunks,
+        "Deleted chunks"
+    );
+
+    if options.json {
+        println!("{}", serde_json::to_string_pretty(&report)?);
+    } else {
+        let noun = if report.files.len() == 1 {
+            "file"
+        } else {
+            "files"
+        };
+        println!(
+            "Removed {} chunks from {} {}.",
+            report.removed_chunks,
+            report.files.len(),
+            noun
+        );
+        for file in &report.files {
+            println!("  {}", file);
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::storage::SqliteStore;
+
+    fn chunk(filename: &str, symbol: &str, line_start: usize) -> CodeChunk {
+        CodeChunk {
+            filename: filename.to_string(),
+            code: format!("func {}() {{}}", symbol),
+            line_start,
+            line_end: line_start + 2,
+            symbol: Some(symbol.to_string()),
+            language: Some("go".to_string()),
+            ..Default::default()
+        }
+    }
+
+    async fn store() -> SqliteStore {
+        let store = SqliteStore::open_in_memory().unwrap();
+        store.init(2).await.unwrap();
+        let mut tagged = chunk("./repo/web/app.go", "web.App", 1);
+        tagged.collection = Some("frontend".to_string());
+        let chunks = [
+            tagged,
+            chunk("./repo/legacy/old.go", "legacy.Old", 1),
+            chunk("./repo/legacy/older.go", "legacy.Older", 1),
+            chunk("./repo/auth/login.go", "auth.Login", 1),
+            chunk("./repo/auth/login.go", "auth.Logout", 10),
+        ];
+        store
+            .add_code_chunks("default", &chunks, vec![vec![1.0, 0.0]; chunks.len()])
+            .await
+            .unwrap();
+        store
+    }
+
+    fn glob(pattern: &str) -> CandidateFilter {
+        CandidateFilter::new(None, None, vec![pattern.to_string()], Vec::new()).unwrap()
+    }
+
+    #[tokio::test]
+    async fn test_remove_files_by_glob() {
+        let store = store().await;
+        let removal = remove_from_store(&store, &glob("legacy/**"), None, "default")
+            .await
+            .unwrap();
+        assert_eq!(removal.removed_chunks, 2);
+        assert!(removal.kept.values().all(Vec::is_empty));
+        let remaining = store.list_chunk_info("default").await.unwrap();
+        assert_eq!(remaining.len(), 3);
+        assert!(remaining.iter().all(|i| !i.filename.contains("legacy")));
+
+        let none = remove_from_store(&store, &glob("nothing/**"), None, "default")
+            .await
+            .unwrap();
+        assert_eq!(none.removed_chunks, 0);
+        assert!(none.kept.is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_remove_collection() {
+        let store = store().await;
+        let filter = CandidateFilter::default().with_collections(vec!["frontend".to_string()]);
+        let removal = remove_from_store(&store, &filter, None, "default")
+            .await
+            .unwrap();
+        assert_eq!(removal.removed_chunks, 1);
+        assert_eq!(
+            removal.kept.keys().collect::<Vec<_>>(),
+            vec!["./repo/web/app.go"]
+        );
+        let remaining = store.list_chunk_info("default").await.unwrap();
+        assert_eq!(remaining.len(), 4);
+        assert!(remaining.iter().all(|i| i.collection.is_none()));
+    }
+
+    #[tokio::test]
+    async fn test_remove_single_symbol() {
+        let store = store().await;
+        let removal = remove_from_store(&store, &glob("auth/login.go"), Some("Logout"), "default")
+            .await
+            .unwrap();
+        assert_eq!(removal.removed_chunks, 1);
+        assert_eq!(removal.removed_ids.len(), 1);
+        let kept = &removal.kept["./repo/auth/login.go"];
+        assert_eq!(kept.len(), 1);
+        assert_eq!(kept[0].symbol.as_deref(), Some("auth.Login"));
+
+        let rows = store
+            .get_file_chunks("./repo/auth/login.go", "default")
+            .await
+            .unwrap();
+        assert_eq!(rows.len(), 1);
+        assert_eq!(rows[0].0.symbol.as_deref(), Some("auth.Login"));
+    }
+}
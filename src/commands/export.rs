@@ -0,0 +1,388 @@
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, BTreeSet};
+use std::fs::File;
+use std::io::{BufWriter, Write};
+use std::path::{Path, PathBuf};
+use tracing::{info, warn};
+
+use crate::config::AppConfig;
+use crate::core::CodeRagError;
+use crate::indexer::{ChunkLocation, ChunkPart, CodeChunk};
+use crate::manifest::{is_in_progress, IndexManifest};
+use crate::storage::{open_store, store_exists, Metric, VectorStore};
+
+/// Version of the JSON Lines export format, recorded in its header. Bumped
+/// when a change would make older versions of `import` misread it.
+pub const EXPORT_FORMAT_VERSION: u32 = 1;
+
+pub struct ExportOptions {
+    /// File to write; standard output if `None` or `-`
+    pub output: Option<PathBuf>,
+    pub workspace: String,
+}
+
+/// A line of an export: the header first, then one chunk per line.
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq)]
+#[serde(tag = "type", rename_all = "camelCase")]
+pub enum ExportRecord {
+    Header(ExportHeader),
+    Chunk(ExportedChunk),
+}
+
+/// First line of an export, describing the index it was taken from.
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq)]
+#[serde(rename_all = "camelCase")]
+pub struct ExportHeader {
+    pub format_version: u32,
+    pub workspace: String,
+    /// Embedding model that produced the vectors, if the index recorded it
+    pub embedding_model: Option<String>,
+    pub embedding_dim: usize,
+    /// Distance the index ranked by; exports without it are cosine
+    #[serde(default)]
+    pub distance_metric: Metric,
+    /// Number of chunk lines that follow
+    pub chunks: usize,
+    /// Content hash and mtime of each file as of the last `index` run, so an
+    /// imported index can be updated incrementally
+    #[serde(default)]
+    pub files: BTreeMap<String, ExportedFile>,
+}
+
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq)]
+pub struct ExportedFile {
+    pub hash: String,
+    pub mtime: i64,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub collection: Option<String>,
+    /// See [`FileEntry::merged`](crate::manifest::FileEntry::merged)
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub merged: BTreeMap<String, usize>,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub tags: Vec<String>,
+}
+
+/// A stored chunk with its embedding, field for field.
+#[derive(Serialize, Deserialize, Debug, Clone, PartialEq)]
+#[serde(rename_all = "camelCase")]
+pub struct ExportedChunk {
+    /// [`CodeChunk::id`], checked against the other fields on import
+    pub id: String,
+    pub file: String,
+    pub line_start: usize,
+    pub line_end: usize,
+    pub last_modified: i64,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub symbol: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub language: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub package: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub part: Option<ChunkPart>,
+    #[serde(default)]
+    pub occurrence: u32,
+    #[serde(default)]
+    pub overlap_lines: usize,
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub redacted: bool,
+    #[serde(default, skip_serializing_if = "std::ops::Not::not")]
+    pub is_test: bool,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub changed_at: Option<i64>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub collection: Option<String>,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub calls: Vec<String>,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub imports: Vec<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub doc: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub summary: Option<String>,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub duplicates: Vec<ChunkLocation>,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub tags: Vec<String>,
+    pub code: String,
+    /// The stored embedding, at unit length
+    pub vector: Vec<f32>,
+}
+
+impl ExportedChunk {
+    pub fn new(chunk: CodeChunk, vector: Vec<f32>) -> Self {
+        Self {
+            id: chunk.id(),
+            file: chunk.filename,
+            line_start: chunk.line_start,
+            line_end: chunk.line_end,
+            last_modified: chunk.last_modified,
+            symbol: chunk.symbol,
+            language: chunk.language,
+            package: chunk.package,
+            part: chunk.part,
+            occurrence: chunk.occurrence,
+            overlap_lines: chunk.overlap_lines,
+            redacted: chunk.redacted,
+            is_test: chunk.is_test,
+            changed_at: chunk.changed_at,
+            collection: chunk.collection,
+            calls: chunk.calls,
+            imports: chunk.imports,
+            doc: chunk.doc,
+            summary: chunk.summary,
+            duplicates: chunk.duplicates,
+            tags: chunk.tags,
+            code: chunk.code,
+            vector,
+        }
+    }
+
+    /// The chunk and its embedding as they were stored.
+    pub fn into_chunk(self) -> (CodeChunk, Vec<f32>) {
+        let chunk = CodeChunk {
+            filename: self.file,
+            code: self.code,
+            line_start: self.line_start,
+            line_end: self.line_end,
+            last_modified: self.last_modified,
+            calls: self.calls,
+            symbol: self.symbol,
+            language: self.language,
+            redacted: self.redacted,
+            occurrence: self.occurrence,
+            overlap_lines: self.overlap_lines,
+            summary: self.summary,
+            doc: self.doc,
+            package: self.package,
+            imports: self.imports,
+            part: self.part,
+            changed_at: self.changed_at,
+            is_test: self.is_test,
+            collection: self.collection,
+            duplicates: self.duplicates,
+            tags: self.tags,
+        };
+        (chunk, self.vector)
+    }
+}
+
+/// Database directory of `workspace`, nested under `db_path` unless it is the
+/// default one.
+pub(super) fn workspace_db(config: &AppConfig, workspace: &str) -> String {
+    if workspace == "default" {
+        config.db_path.clone()
+    } else {
+        Path::new(&config.db_path)
+            .join(workspace)
+            .to_string_lossy()
+            .to_string()
+    }
+}
+
+/// The stored chunks of `filename` with their embeddings, by line.
+async fn file_rows(
+    storage: &dyn VectorStore,
+    filename: &str,
+    workspace: &str,
+) -> Result<Vec<(CodeChunk, Vec<f32>)>, CodeRagError> {
+    let mut rows = storage
+        .get_file_chunks(filename, workspace)
+        .await
+        .map_err(|e| CodeRagError::Database(e.to_string()))?;
+    rows.sort_by_cached_key(|(chunk, _)| (chunk.line_start, chunk.line_end, chunk.id()));
+    Ok(rows)
+}
+
+fn write_record(out: &mut impl Write, record: &ExportRecord) -> Result<(), CodeRagError> {
+    serde_json::to_writer(&mut *out, record)?;
+    out.write_all(b"\n").map_err(CodeRagError::Io)
+}
+
+/// Writes every chunk of a workspace index, with its embedding, as JSON
+/// Lines: an [`ExportHeader`] and then one [`ExportedChunk`] per line.
+///
+/// Files are written in path order and the chunks of a file by line, so two
+/// exports of the same index are identical and exports of successive versions
+/// diff cleanly. [`import_index`](super::import::import_index) rebuilds an
+/// index from the output without re-embedding anything.
+pub async fn export_index(options: ExportOptions, config: &AppConfig) -> Result<(), CodeRagError> {
+    let actual_db = workspace_db(config, &options.workspace);
+    if !store_exists(&config.storage_backend, &actual_db, "code_chunks") {
+        return Err(CodeRagError::Database(format!(
+            "No index found for workspace '{}' at {}.\n\
+            Run 'code-rag index --path <path> --workspace {}' to create it.",
+            options.workspace, actual_db, options.workspace
+        )));
+    }
+    if is_in_progress(&actual_db) {
+        warn!(
+            "Index at {} is being written or a previous indexing run was interrupted; the export may be incomplete.",
+            actual_db
+        );
+    }
+    let manifest = IndexManifest::load(&actual_db)
+        .map_err(|e| CodeRagError::Database(e.to_string()))?
+        .unwrap_or_default();
+    let metric = config
+        .metric()
+        .map_err(|e| CodeRagError::Database(e.to_string()))?;
+    let storage = open_store(&config.storage_backend, metric, &actual_db, "code_chunks")
+        .await
+        .map_err(|e| CodeRagError::Database(e.to_string()))?;
+    let infos = storage
+        .list_chunk_info(&options.workspace)
+        .await
+        .map_err(|e| CodeRagError::Database(e.to_string()))?;
+    let total = infos.len();
+    let filenames: BTreeSet<String> = infos.into_iter().map(|info| info.filename).collect();
+
+    let mut out: Box<dyn Write + Send> =
+        match options.output.as_deref().filter(|p| *p != Path::new("-")) {
+            Some(path) => Box::new(BufWriter::new(File::create(path).map_err(|e| {
+                CodeRagError::Io(std::io::Error::new(
+                    e.kind(),
+                    format!("Failed to create {}: {}", path.display(), e),
+                ))
+            })?)),
+            None => Box::new(BufWriter::new(std::io::stdout())),
+        };
+
+    // Indexes built before the manifest recorded the model only tell the
+    // dimension through their vectors
+    let mut files = filenames.iter();
+    let mut rows = match files.next() {
+        Some(filename) => file_rows(storage.as_ref(), filename, &options.workspace).await?,
+        None => Vec::new(),
+    };
+    let header = ExportHeader {
+        format_version: EXPORT_FORMAT_VERSION,
+        workspace: options.workspace.clone(),
+        embedding_model: manifest.embedding_model.clone(),
+        embedding_dim: manifest
+            .embedding_dim
+            .or_else(|| rows.first().map(|(_, vector)| vector.len()))
+            .unwrap_or_default(),
+        distance_metric: storage
+            .stored_metric()
+            .await
+            .map_err(|e| CodeRagError::Database(e.to_string()))?
+            .unwrap_or(metric),
+        chunks: total,
+        files: manifest
+            .files
+            .iter()
+            // Files all of whose chunks were merged into others have no rows
+            .filter(|(file, entry)| filenames.contains(*file) || !entry.merged.is_empty())
+            .map(|(file, entry)| {
+                let exported = ExportedFile {
+                    hash: entry.hash.clone(),
+                    mtime: entry.mtime,
+                    collection: entry.collection.clone(),
+                    merged: entry.merged.clone(),
+                    tags: entry.tags.clone(),
+                };
+                (file.clone(), exported)
+            })
+            .collect(),
+    };
+    write_record(&mut out, &ExportRecord::Header(header))?;
+
+    let mut exported = 0;
+    loop {
+        for (chunk, vector) in rows {
+            let record = ExportRecord::Chunk(ExportedChunk::new(chunk, vector));
+            write_record(&mut out, &record)?;
+            exported += 1;
+        }
+        rows = match files.next() {
+            Some(filename) => file_rows(storage.as_ref(), filename, &options.workspace).await?,
+            None => break,
+        };
+    }
+    out.flush().map_err(CodeRagError::Io)?;
+
+    info!(
+        "Exported {} chunks of {} files from workspace '{}'.",
+        exported,
+        filenames.len(),
+        options.workspace
+    );
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_chunk_round_trip() {
+        let chunk = CodeChunk {
+            filename: "./internal/auth/service.go".to_string(),
+            code: "func (s *Service) Authenticate() error {\n\treturn nil\n}".to_string(),
+            line_start: 12,
+            line_end: 14,
+            last_modified: 1_700_000_000,
+            calls: vec!["auth.check".to_string()],
+            symbol: Some("auth.Service.Authenticate".to_string()),
+            language: Some("go".to_string()),
+            occurrence: 1,
+            package: Some("auth".to_string()),
+            part: Some(ChunkPart { index: 2, count: 3 }),
+            changed_at: Some(1_690_000_000),
+            is_test: true,
+            collection: Some("backend".to_string()),
+            tags: vec!["security".to_string()],
+            ..Default::default()
+        };
+        // Values whose shortest decimal form is easy to get wrong
+        let vector = vec![0.1, -0.0, 1e-38, 0.333_333_34, f32::MIN_POSITIVE];
+
+        let line = serde_json::to_string(&ExportRecord::Chunk(ExportedChunk::new(
+            chunk.clone(),
+            vector.clone(),
+        )))
+        .unwrap();
+        let value: serde_json::Value = serde_json::from_str(&line).unwrap();
+        assert_eq!(value["type"], "chunk");
+        assert_eq!(value["lineStart"], 12);
+        assert_eq!(value["part"]["count"], 3);
+        assert!(value.get("summary").is_none());
+
+        let ExportRecord::Chunk(exported) = serde_json::from_str(&line).unwrap() else {
+            panic!("not a chunk: {}", line);
+        };
+        assert_eq!(exported.id, chunk.id());
+        let (restored, restored_vector) = exported.into_chunk();
+        assert_eq!(restored.id(), chunk.id());
+        assert_eq!(restored.part, chunk.part);
+        assert_eq!(restored.changed_at, chunk.changed_at);
+        assert!(restored.is_test);
+        assert_eq!(restored.collection.as_deref(), Some("backend"));
+        assert_eq!(restored.tags, vec!["security"]);
+        let bits = |v: &[f32]| v.iter().map(|x| x.to_bits()).collect::<Vec<_>>();
+        assert_eq!(bits(&restored_vector), bits(&vector));
+    }
+
+    #[test]
+    fn test_header_shape() {
+        let header = ExportRecord::Header(ExportHeader {
+            format_version: EXPORT_FORMAT_VERSION,
+            workspace: "default".to_string(),
+            embedding_model: Some("nomic-embed-text-v1.5".to_string()),
+            embedding_dim: 768,
+            distance_metric: Metric::Dot,
+            chunks: 0,
+            files: BTreeMap::new(),
+        });
+        let value = serde_json::to_value(&header).unwrap();
+        assert_eq!(value["type"], "header");
+        assert_eq!(value["formatVersion"], EXPORT_FORMAT_VERSION);
+        assert_eq!(value["embeddingDim"], 768);
+        assert_eq!(value["distanceMetric"], "dot");
+        assert_eq!(
+            serde_json::from_value::<ExportRecord>(value).unwrap(),
+            header
+        );
+    }
+}
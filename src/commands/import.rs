@@ -0,0 +1,439 @@
+use std::collections::BTreeMap;
+use std::fs::{self, File};
+use std::io::{BufRead, BufReader};
+use std::path::{Path, PathBuf};
+use tracing::{info, warn};
+
+use super::export::{workspace_db, ExportHeader, ExportRecord, EXPORT_FORMAT_VERSION};
+use crate::bm25::BM25Index;
+use crate::callgraph::CallGraph;
+use crate::config::AppConfig;
+use crate::core::CodeRagError;
+use crate::indexer::CodeChunk;
+use crate::manifest::{
+    bump_index_version, clear_in_progress, mark_in_progress, FileEntry, IndexManifest,
+};
+use crate::storage::{open_configured_store, store_exists, VectorStore};
+
+/// Chunks written to the vector store and BM25 at a time.
+const IMPORT_BATCH_SIZE: usize = 256;
+
+pub struct ImportOptions {
+    /// Export to read; standard input if `None` or `-`
+    pub input: Option<PathBuf>,
+    /// Workspace to create; the one the export was taken from if `None`
+    pub workspace: Option<String>,
+    /// Replace the workspace's index if it has one, as `index --force` does
+    pub force: bool,
+}
+
+/// Parses line `number` (1-indexed) of an export.
+fn parse_record(line: &str, number: usize) -> Result<ExportRecord, CodeRagError> {
+    serde_json::from_str(line).map_err(|e| {
+        CodeRagError::Generic(format!("Invalid export record on line {}: {}", number, e))
+    })
+}
+
+/// Checks that `header` describes an export this version can import.
+fn check_header(header: &ExportHeader) -> Result<(), CodeRagError> {
+    if header.format_version > EXPORT_FORMAT_VERSION {
+        return Err(CodeRagError::Generic(format!(
+            "The export has format version {}, newer than the version {} this build of code-rag reads. \
+            Upgrade code-rag to import it.",
+            header.format_version, EXPORT_FORMAT_VERSION
+        )));
+    }
+    if header.embedding_dim == 0 {
+        return Err(CodeRagError::Generic(
+            "The export header records no embedding dimension".to_string(),
+        ));
+    }
+    Ok(())
+}
+
+/// Name the configured embedder records in the manifest, worked out without
+/// loading it: a local model directory is known by its path.
+fn configured_model(config: &AppConfig) -> String {
+    match config.embedding_provider.to_lowercase().as_str() {
+        "fastembed" | "" => config
+            .embedding_model_path
+            .clone()
+            .unwrap_or_else(|| config.embedding_model.clone()),
+        _ => config.embedding_model.clone(),
+    }
+}
+
+/// Writes imported chunks to the vector store and BM25 index in batches.
+struct Importer<'a> {
+    storage: &'a dyn VectorStore,
+    bm25_index: &'a BM25Index,
+    workspace: &'a str,
+    chunks: Vec<CodeChunk>,
+    vectors: Vec<Vec<f32>>,
+    /// Chunks stored so far by file, for the call graph and the manifest
+    by_file: BTreeMap<String, Vec<CodeChunk>>,
+    imported: usize,
+}
+
+impl Importer<'_> {
+    async fn push(&mut self, chunk: CodeChunk, vector: Vec<f32>) -> Result<(), CodeRagError> {
+        self.chunks.push(chunk);
+        self.vectors.push(vector);
+        if self.chunks.len() >= IMPORT_BATCH_SIZE {
+            self.flush().await?;
+        }
+        Ok(())
+    }
+
+    async fn flush(&mut self) -> Result<(), CodeRagError> {
+        if self.chunks.is_empty() {
+            return Ok(());
+        }
+        self.storage
+            .add_code_chunks(
+                self.workspace,
+                &self.chunks,
+                std::mem::take(&mut self.vectors),
+            )
+            .await
+            .map_err(|e| CodeRagError::Database(e.to_string()))?;
+        self.bm25_index
+            .add_chunks(&self.chunks, self.workspace)
+            .map_err(|e| CodeRagError::Tantivy(e.to_string()))?;
+        self.imported += self.chunks.len();
+        for chunk in self.chunks.drain(..) {
+            self.by_file
+                .entry(chunk.filename.clone())
+                .or_default()
+                .push(chunk);
+        }
+        Ok(())
+    }
+}
+
+/// Builds a workspace index from the output of
+/// [`export_index`](super::export::export_index): the chunks and their
+/// embeddings go into the store configured by `storage_backend` and
+/// `vector_index`, and the BM25 index, call graph and manifest are rebuilt
+/// from them. Nothing is embedded, so no model needs to be loaded.
+///
+/// The export must have been embedded by the configured model, or searches
+/// would compare query vectors with vectors of another model. Every chunk is
+/// checked against its ID and the header's dimension before it is stored; a
+/// mismatch stops the import, since it means the export was edited or
+/// truncated mid-line.
+pub async fn import_index(options: ImportOptions, config: &AppConfig) -> Result<(), CodeRagError> {
+    let reader: Box<dyn BufRead + Send> =
+        match options.input.as_deref().filter(|p| *p != Path::new("-")) {
+            Some(path) => Box::new(BufReader::new(File::open(path).map_err(|e| {
+                CodeRagError::Io(std::io::Error::new(
+                    e.kind(),
+                    format!("Failed to read {}: {}", path.display(), e),
+                ))
+            })?)),
+            None => Box::new(BufReader::new(std::io::stdin())),
+        };
+    let mut lines = reader
+        .lines()
+        .enumerate()
+        .filter(|(_, line)| !matches!(line, Ok(l) if l.trim().is_empty()));
+
+    let header =
+        match lines.next() {
+            Some((i, line)) => match parse_record(&line.map_err(CodeRagError::Io)?, i + 1)? {
+                ExportRecord::Header(header) => header,
+                ExportRecord::Chunk(_) => return Err(CodeRagError::Generic(
+                    "The export doesn't start with a header; was it written by 'code-rag export'?"
+                        .to_string(),
+                )),
+            },
+            None => return Err(CodeRagError::Generic("The export is empty".to_string())),
+        };
+    check_header(&header)?;
+    let metric = config
+        .metric()
+        .map_err(|e| CodeRagError::Generic(e.to_string()))?;
+    if header.distance_metric != metric {
+        return Err(CodeRagError::Generic(format!(
+            "The export was indexed with the {} distance metric, but distance_metric is {}. \
+            Set distance_metric = \"{}\" to import it.",
+            header.distance_metric, metric, header.distance_metric
+        )));
+    }
+    let model = configured_model(config);
+    if let Some(exported) = header.embedding_model.as_deref().filter(|m| *m != model) {
+        return Err(CodeRagError::DimensionMismatch(format!(
+            "The export was embedded with '{}', but the configured embedding model is '{}'. \
+            Configure '{}' to import it, or re-index the sources instead.",
+            exported, model, exported
+        )));
+    }
+
+    let workspace = options
+        .workspace
+        .unwrap_or_else(|| header.workspace.clone());
+    let actual_db = workspace_db(config, &workspace);
+    if options.force {
+        if Path::new(&actual_db).exists() {
+            info!("Force flag set. Removing database at: {}", actual_db);
+            fs::remove_dir_all(&actual_db).map_err(CodeRagError::Io)?;
+        }
+    } else if store_exists(&config.storage_backend, &actual_db, "code_chunks") {
+        return Err(CodeRagError::Database(format!(
+            "Workspace '{}' already has an index at {}. Pass --force to replace it.",
+            workspace, actual_db
+        )));
+    }
+
+    mark_in_progress(&actual_db).map_err(|e| CodeRagError::Database(e.to_string()))?;
+    bump_index_version(&actual_db).map_err(|e| CodeRagError::Database(e.to_string()))?;
+    let storage = open_configured_store(config, &actual_db, "code_chunks")
+        .await
+        .map_err(|e| CodeRagError::Database(e.to_string()))?;
+    storage
+        .init(header.embedding_dim)
+        .await
+        .map_err(|e| CodeRagError::from_anyhow(e, CodeRagError::Database))?;
+    let bm25_index = BM25Index::new(&actual_db, false, &config.merge_policy)
+        .map_err(|e| CodeRagError::Tantivy(e.to_string()))?;
+
+    let mut importer = Importer {
+        storage: storage.as_ref(),
+        bm25_index: &bm25_index,
+        workspace: &workspace,
+        chunks: Vec::with_capacity(IMPORT_BATCH_SIZE),
+        vectors: Vec::with_capacity(IMPORT_BATCH_SIZE),
+        by_file: BTreeMap::new(),
+        imported: 0,
+    };
+    for (i, line) in lines {
+        let exported = match parse_record(&line.map_err(CodeRagError::Io)?, i + 1)? {
+            ExportRecord::Chunk(chunk) => chunk,
+            ExportRecord::Header(_) => {
+                return Err(CodeRagError::Generic(format!(
+                    "Unexpected second header on line {}",
+                    i + 1
+                )))
+            }
+        };
+        if exported.vector.len() != header.embedding_dim {
+            return Err(CodeRagError::Generic(format!(
+                "The chunk on line {} has a {}-dimensional vector, but the header says {}",
+                i + 1,
+                exported.vector.len(),
+                header.embedding_dim
+            )));
+        }
+        let id = exported.id.clone();
+        let (chunk, vector) = exported.into_chunk();
+        if chunk.id() != id {
+            return Err(CodeRagError::Generic(format!(
+                "The chunk on line {} doesn't match its ID {}; was the export edited?",
+                i + 1,
+                id
+            )));
+        }
+        importer.push(chunk, vector).await?;
+    }
+    importer.flush().await?;
+    let Importer {
+        by_file, imported, ..
+    } = importer;
+
+    bm25_index
+        .commit()
+        .map_err(|e| CodeRagError::Tantivy(e.to_string()))?;
+    let mut call_graph = CallGraph::default();
+    let mut manifest = IndexManifest {
+        embedding_model: header.embedding_model.clone(),
+        embedding_dim: Some(header.embedding_dim),
+        ..Default::default()
+    };
+    for (filename, file_chunks) in &by_file {
+        call_graph.insert_file(filename, file_chunks);
+        // Without a recorded hash the next `index --update` re-embeds the file
+        if let Some(file) = header.files.get(filename) {
+            let entry = FileEntry {
+                hash: file.hash.clone(),
+                mtime: file.mtime,
+                chunk_ids: file_chunks.iter().map(CodeChunk::id).collect(),
+                collection: file.collection.clone(),
+                merged: file.merged.clone(),
+                tags: file.tags.clone(),
+            };
+            manifest.insert(filename.clone(), entry);
+        }
+    }
+    for (filename, file) in &header.files {
+        // Deduplicated into other files, without chunks of its own
+        if !by_file.contains_key(filename) && !file.merged.is_empty() {
+            let entry = FileEntry {
+                hash: file.hash.clone(),
+                mtime: file.mtime,
+                chunk_ids: Vec::new(),
+                collection: file.collection.clone(),
+                merged: file.merged.clone(),
+                tags: file.tags.clone(),
+            };
+            manifest.insert(filename.clone(), entry);
+        }
+    }
+    if let Err(e) = call_graph.save(&actual_db) {
+        warn!("Failed to write call graph: {}", e);
+    }
+    if let Err(e) = storage.flush().await {
+        warn!("Failed to save vector index: {:#}", e);
+    }
+    manifest
+        .save(&actual_db)
+        .map_err(|e| CodeRagError::Database(e.to_string()))?;
+    if let Err(e) = storage.create_filename_index().await {
+        warn!("Optimization warning: {}", e);
+    }
+    clear_in_progress(&actual_db).map_err(|e| CodeRagError::Database(e.to_string()))?;
+
+    if imported != header.chunks {
+        warn!(
+            "The export header lists {} chunks but {} were imported; the export may be truncated.",
+            header.chunks, imported
+        );
+    }
+    info!(
+        "Imported {} chunks of {} files into workspace '{}' at {}.",
+        imported,
+        by_file.len(),
+        workspace,
+        actual_db
+    );
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::commands::export::{export_index, ExportOptions};
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_check_header() {
+        let mut header = ExportHeader {
+            format_version: EXPORT_FORMAT_VERSION,
+            workspace: "default".to_string(),
+            embedding_model: None,
+            embedding_dim: 384,
+            distance_metric: Default::default(),
+            chunks: 0,
+            files: BTreeMap::new(),
+        };
+        assert!(check_header(&header).is_ok());
+
+        header.format_version = EXPORT_FORMAT_VERSION + 1;
+        let err = check_header(&header).unwrap_err();
+        assert!(err.to_string().contains("Upgrade code-rag"), "{}", err);
+
+        header.format_version = EXPORT_FORMAT_VERSION;
+        header.embedding_dim = 0;
+        assert!(check_header(&header).is_err());
+    }
+
+    #[test]
+    fn test_parse_record_reports_line() {
+        let err = parse_record("{\"type\": \"chunk\"}", 7).unwrap_err();
+        assert!(err.to_string().contains("line 7"), "{}", err);
+        assert!(matches!(
+            parse_record(
+                "{\"type\":\"header\",\"formatVersion\":1,\"workspace\":\"w\",\
+                 \"embeddingModel\":null,\"embeddingDim\":3,\"chunks\":0}",
+                1
+            ),
+            Ok(ExportRecord::Header(_))
+        ));
+    }
+
+    #[tokio::test]
+    async fn test_export_import_round_trip() {
+        let dir = TempDir::new().unwrap();
+        let mut config = AppConfig::load(false).unwrap();
+        config.db_path = dir.path().join("db").to_string_lossy().to_string();
+        config.storage_backend = "sqlite".to_string();
+
+        let source = workspace_db(&config, "default");
+        let chunk = |filename: &str, line: usize| CodeChunk {
+            filename: filename.to_string(),
+            code: format!("fn f{}() {{}}", line),
+            line_start: line,
+            line_end: line,
+            symbol: Some(format!("f{}", line)),
+            ..Default::default()
+        };
+        let chunks = vec![chunk("a.rs", 1), chunk("a.rs", 2), chunk("b.rs", 1)];
+        let vectors = vec![
+            vec![1.0, 0.0, 0.0],
+            vec![0.0, 1.0, 0.0],
+            vec![0.6, 0.8, 0.0],
+        ];
+        let storage = open_configured_store(&config, &source, "code_chunks")
+            .await
+            .unwrap();
+        storage.init(3).await.unwrap();
+        storage
+            .add_code_chunks("default", &chunks, vectors.clone())
+            .await
+            .unwrap();
+        IndexManifest {
+            embedding_model: Some(configured_model(&config)),
+            embedding_dim: Some(3),
+            ..Default::default()
+        }
+        .save(&source)
+        .unwrap();
+
+        let export = dir.path().join("index.jsonl");
+        let exported = ExportOptions {
+            output: Some(export.clone()),
+            workspace: "default".to_string(),
+        };
+        export_index(exported, &config).await.unwrap();
+        let import = |workspace: &str| ImportOptions {
+            input: Some(export.clone()),
+            workspace: Some(workspace.to_string()),
+            force: false,
+        };
+        import_index(import("copy"), &config).await.unwrap();
+
+        let copy = workspace_db(&config, "copy");
+        let imported = open_configured_store(&config, &copy, "code_chunks")
+            .await
+            .unwrap();
+        for filename in ["a.rs", "b.rs"] {
+            let mut want = storage.get_file_chunks(filename, "default").await.unwrap();
+            let mut got = imported.get_file_chunks(filename, "copy").await.unwrap();
+            want.sort_by_key(|(c, _)| c.line_start);
+            got.sort_by_key(|(c, _)| c.line_start);
+            assert_eq!(want.len(), got.len());
+            for ((want, want_vector), (got, got_vector)) in want.iter().zip(&got) {
+                assert_eq!(got.id(), want.id());
+                assert_eq!(got.symbol, want.symbol);
+                assert_eq!(got_vector, want_vector);
+            }
+        }
+        let manifest = IndexManifest::load(&copy).unwrap().unwrap();
+        assert!(manifest
+            .check_embedder(&configured_model(&config), 3)
+            .is_ok());
+
+        // Vectors of another model would be compared with the wrong queries
+        config.embedding_model = "bge-small-en-v1.5".to_string();
+        let err = import_index(import("other"), &config).await.unwrap_err();
+        assert!(
+            matches!(err, CodeRagError::DimensionMismatch(_)),
+            "{:?}",
+            err
+        );
+        assert!(!store_exists(
+            &config.storage_backend,
+            &workspace_db(&config, "other"),
+            "code_chunks"
+        ));
+    }
+}
@@ -1,37 +1,125 @@
-use std::collections::HashMap;
+use std::collections::{BTreeMap, HashMap, HashSet};
 use std::fs;
-use std::path::Path;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
 
-use ignore::WalkBuilder;
-use indicatif::{ProgressBar, ProgressStyle};
-use tracing::{error, info, warn};
+use tracing::{debug, error, info, warn};
 
 use crate::bm25::BM25Index;
+use crate::callgraph::CallGraph;
 use crate::config::AppConfig;
-use crate::core::CodeRagError;
-use crate::embedding::Embedder;
-use crate::indexer::CodeChunker;
-use crate::storage::Storage;
+use crate::core::{CancelToken, CodeRagError};
+use crate::embedding::{default_concurrency, Embedder, EmbeddingCache, PoolOptions};
+use crate::indexer::{blame_chunks, CodeChunker, NonText, TagRules};
+use crate::manifest::{
+    bump_index_version, clear_in_progress, hash_bytes, is_in_progress, mark_in_progress, FileEntry,
+    IndexManifest,
+};
+use crate::ops::indexer::embed_facets;
+use crate::redact::Redactor;
+use crate::storage::{open_configured_store, VectorStore};
+use crate::summary::Summarizer;
+
+mod dedup;
+mod git;
+mod plan;
+mod progress;
+mod since;
+mod walk;
+use dedup::{forced_files, linked_files, Deduplicator};
+use git::Revision;
+pub use plan::{plan_index, print_plan, ChunkPlan, PlannedChunk};
+use progress::IndexProgress;
+pub use progress::ProgressMode;
+pub use since::parse_since;
+use since::ChangeWindow;
+pub use walk::RAGIGNORE_FILE;
+use walk::{PathRules, SkipReason, SkipReport};
+
+/// Minimum time between two checkpoints of a running index.
+///
+/// Chunks are stored batch by batch regardless; a checkpoint additionally
+/// commits BM25 and rewrites `checkpoint.json`, which is too costly per batch.
+/// `--resume` finds files stored after the last checkpoint in the vector store.
+const CHECKPOINT_INTERVAL: Duration = Duration::from_secs(30);
 
 pub struct IndexOptions {
     pub path: Option<String>,
     pub db_path: Option<String>,
     pub update: bool,
     pub force: bool,
+    /// Continue an interrupted run from its checkpoint; implies `update`
+    pub resume: bool,
     pub workspace: String,
     pub batch_size: Option<usize>,
     pub threads: Option<usize>,
+    /// Embedding batches in flight at once; `None` means one per CPU
+    pub concurrency: Option<usize>,
+    /// Languages to index (names such as `python` or extensions); empty means all
+    pub languages: Vec<String>,
+    /// Only index paths matching one of these globs; empty means all
+    pub include: Vec<String>,
+    /// Never index paths matching these globs
+    pub exclude: Vec<String>,
+    /// Collection to tag the chunks with; files of other collections are left as they are
+    pub collection: Option<String>,
+    /// Index the files of this git revision instead of the working tree, into
+    /// a collection named after it unless `collection` is set
+    pub rev: Option<String>,
+    /// Only look at files modified at or after this Unix time, see
+    /// [`parse_since`]; implies `update`
+    pub since: Option<i64>,
+    /// Only look at files git reports changed since this ref; implies `update`
+    pub since_ref: Option<String>,
+    /// Only report the chunks that would be embedded, see [`plan_index`]
+    pub dry_run: bool,
+    /// Print the `dry_run` report as JSON
+    pub json: bool,
+    /// How to report progress; see [`ProgressMode::detect`]
+    pub progress: ProgressMode,
+    /// Stops the run between files and embedding batches, keeping what it
+    /// completed for `--resume`
+    pub cancel: CancelToken,
 }
 
-pub async fn index_codebase(options: IndexOptions, config: &AppConfig) -> Result<(), CodeRagError> {
+pub async fn index_codebase(
+    mut options: IndexOptions,
+    config: &AppConfig,
+) -> Result<(), CodeRagError> {
+    if options.collection.is_none() {
+        options.collection = options.rev.clone();
+    }
     let actual_path = options
         .path
         .unwrap_or_else(|| config.default_index_path.clone());
     let force = options.force;
-    let update = options.update;
+    let resume = options.resume;
+    let index_path = Path::new(&actual_path);
+    let mut window = ChangeWindow::new(options.since, options.since_ref.as_deref(), index_path)?;
+    let update = options.update || resume || window.is_some();
     let batch_size = options.batch_size;
     let workspace_arg = options.workspace.clone();
 
+    let path_rules = PathRules::new(options.include.clone(), options.exclude.clone())
+        .map_err(|e| CodeRagError::Generic(e.to_string()))?;
+    if options.dry_run {
+        let mut plan = plan_index(
+            index_path,
+            &path_rules,
+            &options.languages,
+            config,
+            &options.cancel,
+        )?;
+        plan.workspace = workspace_arg;
+        return print_plan(&plan, options.json);
+    }
+    let mut revision = options
+        .rev
+        .as_deref()
+        .map(|rev| Revision::open(index_path, rev))
+        .transpose()?;
+
     // Determine DB path and Table name based on Nested Strategy
     // 1. If explicit DB path provided (e.g. from start command), trust it and use "code_chunks".
     // 2. If CLI default, nest the workspace if it's not "default".
@@ -53,48 +141,131 @@ pub async fn index_codebase(options: IndexOptions, config: &AppConfig) -> Result
         }
     };
 
-    if force {
+    // Rebuilding one collection must leave the others in place; its files are
+    // deleted from the tables below instead
+    if force && options.collection.is_none() {
         info!("Force flag set. Removing database at: {}", actual_db);
         if Path::new(&actual_db).exists() {
             fs::remove_dir_all(&actual_db).map_err(CodeRagError::Io)?;
         }
     }
 
-    info!("Indexing path: {}", actual_path);
-    let index_path = Path::new(&actual_path);
+    match &revision {
+        Some(revision) => info!(
+            "Indexing path: {} at {} ({})",
+            actual_path, revision.name, revision.commit
+        ),
+        None => info!("Indexing path: {}", actual_path),
+    }
 
     // 1. Load Models with Spinner
-    let pb_model = ProgressBar::new_spinner();
-    pb_model.set_style(
-        ProgressStyle::default_spinner()
-            .template("{spinner:.blue} {msg}")
-            .map_err(|e| CodeRagError::Tantivy(e.to_string()))?,
-    );
-    pb_model.enable_steady_tick(std::time::Duration::from_millis(120));
+    let pb_model = options.progress.spinner()?;
     pb_model.set_message("Loading embedding model...");
 
-    let mut embedder = Embedder::new(
-        config.embedding_model.clone(),
-        config.reranker_model.clone(),
-        config.embedding_model_path.clone(),
-        config.reranker_model_path.clone(),
-        config.device.clone(),
-    )?;
+    let embedder = Arc::new(Embedder::from_config(
+        config,
+        options.progress == ProgressMode::Off,
+    )?);
 
     pb_model.set_message("Warming up ONNX Runtime...");
     let warmup_text = vec!["warmup".to_string()];
     let _ = embedder.embed(warmup_text.clone(), None)?;
 
     pb_model.finish_with_message("Models loaded.");
+    options.cancel.check()?;
 
-    // 2. Initialize Storage
-    let storage = Storage::new(&actual_db, &table_name)
+    // Refuse to mix vectors from different embedding models in one index
+    let mut stored_manifest =
+        IndexManifest::load(&actual_db).map_err(|e| CodeRagError::Database(e.to_string()))?;
+    if let Some(stored) = &stored_manifest {
+        stored.check_embedder(embedder.model_name(), embedder.dim())?;
+    }
+    let mut other_collections = stored_manifest
+        .as_mut()
+        .map(|stored| stored.take_other_collections(options.collection.as_deref()))
+        .unwrap_or_default();
+    let embed_cache = load_embedding_cache(config, &embedder);
+    let checkpoint = if resume {
+        let checkpoint = match IndexManifest::load_checkpoint(&actual_db)
+            .map_err(|e| CodeRagError::Database(e.to_string()))?
+        {
+            Some(checkpoint) => checkpoint,
+            // Interrupted before its first checkpoint; what it stored is
+            // found in the vector store file by file
+            None if is_in_progress(&actual_db) => IndexManifest::default(),
+            None => {
+                return Err(CodeRagError::Database(format!(
+                    "No checkpoint found in {}; there is no interrupted run to resume. \
+                    Use --update instead.",
+                    actual_db
+                )))
+            }
+        };
+        checkpoint.check_embedder(embedder.model_name(), embedder.dim())?;
+        info!(
+            "Resuming from checkpoint with {} completed files.",
+            checkpoint.files.len()
+        );
+        Some(checkpoint)
+    } else {
+        None
+    };
+
+    // A leftover marker means an earlier run died mid-write; its manifest no longer
+    // describes what is in the tables, so incremental updates can't be trusted.
+    if update && !resume && is_in_progress(&actual_db) {
+        return Err(CodeRagError::Database(format!(
+            "A previous indexing run on {} did not finish and the index may be incomplete. \
+            Continue it with --resume, or re-index with --force to rebuild it.",
+            actual_db
+        )));
+    }
+    // 2. Initialize Storage, before the marker so a store built for another
+    // distance metric is refused without flagging the index as interrupted
+    let storage = open_configured_store(config, &actual_db, &table_name)
         .await
         .map_err(|e| CodeRagError::Database(e.to_string()))?;
     storage
         .init(embedder.dim())
         .await
-        .map_err(|e| CodeRagError::Database(e.to_string()))?;
+        .map_err(|e| CodeRagError::from_anyhow(e, CodeRagError::Database))?;
+
+    // Settings and `.ragtags` are checked before the marker, so that a typo in
+    // them doesn't leave the index flagged as interrupted. Tag rules are read
+    // from the working tree even when indexing an older revision
+    let tag_rules =
+        TagRules::load(index_path).map_err(|e| CodeRagError::Generic(format!("{:#}", e)))?;
+    let chunker = CodeChunker::from_config(config)
+        .map_err(|e| CodeRagError::Generic(format!("{:#}", e)))?
+        .with_collection(options.collection.clone())
+        .with_tags(tag_rules.clone());
+    let redactor =
+        Redactor::from_config(config).map_err(|e| CodeRagError::Generic(format!("{:#}", e)))?;
+    if redactor.is_none() {
+        warn!("Secret redaction is disabled; chunk text is indexed as-is.");
+    }
+    let summarizer =
+        Summarizer::from_config(config).map_err(|e| CodeRagError::Generic(format!("{:#}", e)))?;
+    let mut dedup = Deduplicator::from_config(config);
+    // Merged locations are kept in the `duplicates` column; a table created
+    // before it would drop them on insert
+    if dedup.is_some() {
+        let missing = storage
+            .missing_columns()
+            .await
+            .map_err(|e| CodeRagError::from_anyhow(e, CodeRagError::Database))?;
+        if missing.iter().any(|column| column == "duplicates") {
+            return Err(CodeRagError::Generic(format!(
+                "dedup_chunks needs the 'duplicates' column, which table '{}' was created without. \
+                Re-index with --force to rebuild it, or turn dedup_chunks off.",
+                table_name
+            )));
+        }
+    }
+
+    mark_in_progress(&actual_db).map_err(|e| CodeRagError::Database(e.to_string()))?;
+    // Cached query results stop matching as soon as the index is touched
+    bump_index_version(&actual_db).map_err(|e| CodeRagError::Database(e.to_string()))?;
 
     // 3. Initialize BM25 Index
     let bm25_index = match BM25Index::new(&actual_db, false, &config.merge_policy) {
@@ -108,150 +279,559 @@ pub async fn index_codebase(options: IndexOptions, config: &AppConfig) -> Result
         }
     };
 
-    let chunker = CodeChunker::new(config.chunk_size, config.chunk_overlap);
+    if force && options.collection.is_some() {
+        let owned: Vec<String> = stored_manifest
+            .iter()
+            .flat_map(|stored| stored.files.keys().cloned())
+            .collect();
+        info!(
+            "Force flag set. Removing the {} files of collection '{}'.",
+            owned.len(),
+            options.collection.as_deref().unwrap_or_default()
+        );
+        for batch in owned.chunks(256) {
+            storage
+                .batch_delete_files(batch, &workspace_arg)
+                .await
+                .map_err(|e| CodeRagError::Database(e.to_string()))?;
+            bm25_index
+                .batch_delete_files(batch, &workspace_arg)
+                .map_err(|e| CodeRagError::Tantivy(e.to_string()))?;
+        }
+    }
 
-    // 4. Scan Files
-    // 4. Setup Progress Bar & Walker
-    let pb_index = ProgressBar::new_spinner();
-    pb_index.set_style(
-        ProgressStyle::default_spinner()
-            .template("{spinner:.green} [{elapsed_precise}] {pos} files processed ({msg})")
-            .map_err(|e| CodeRagError::Tantivy(e.to_string()))?,
-    );
-    pb_index.enable_steady_tick(std::time::Duration::from_millis(120));
-    pb_index.set_message("Initializing...");
+    // 4. Setup Progress Reporting
+    let progress = Arc::new(IndexProgress::new(options.progress)?);
+    progress.set_stage("Initializing...");
 
-    let existing_files = if update {
-        pb_index.set_message("Fetching existing metadata...");
+    // Previous state: prefer the content-hash manifest; indexes created before the
+    // manifest existed fall back to mtime comparison against the stored metadata.
+    let previous_manifest = if update && !force {
+        stored_manifest
+    } else {
+        None
+    };
+    let existing_files = if update && previous_manifest.is_none() {
+        progress.set_stage("Fetching existing metadata...");
         storage
-            .get_indexed_metadata(&table_name)
+            .get_indexed_metadata(&workspace_arg)
             .await
             .map_err(|e| CodeRagError::Database(e.to_string()))?
     } else {
         HashMap::new()
     };
+    let mut previous = previous_manifest.unwrap_or_default();
+    // Files the interrupted run finished; their stored chunks differ from the
+    // last complete run, and so do their call graph entries.
+    let mut resumed_files = HashSet::new();
+    if let Some(checkpoint) = checkpoint {
+        for (filename, entry) in checkpoint.files {
+            if previous.get(&filename) != Some(&entry) {
+                resumed_files.insert(filename.clone());
+            }
+            previous.insert(filename, entry);
+        }
+    }
+    let linked = linked_files(&previous);
+    if let Some(window) = window.as_mut() {
+        // Partners of the selected files may have to be re-indexed with them
+        window.add(linked.iter().cloned());
+    }
+    let previous_graph = if update || !other_collections.is_empty() {
+        CallGraph::load(&actual_db).unwrap_or_else(|e| {
+            warn!("Ignoring unreadable call graph: {}", e);
+            None
+        })
+    } else {
+        None
+    }
+    .unwrap_or_default();
+    let mut call_graph = CallGraph::default();
+    let mut manifest = IndexManifest {
+        embedding_model: Some(embedder.model_name().to_string()),
+        embedding_dim: Some(embedder.dim()),
+        ..Default::default()
+    };
 
-    let builder = WalkBuilder::new(index_path);
-    let walker = builder.build();
-
-    // 5. Indexing Loop (Streaming)
-    let mut chunks_buffer = Vec::new();
-    let mut pending_deletes = Vec::new();
-    let mut visited_files = std::collections::HashSet::new();
     let batch_size_val = batch_size.unwrap_or(256);
     tracing::info!("Using batch size: {}", batch_size_val);
+    let pool = PoolOptions {
+        concurrency: options
+            .concurrency
+            .or(config.embedding_concurrency)
+            .unwrap_or_else(default_concurrency),
+        cancel: options.cancel.clone(),
+        ..Default::default()
+    };
+    tracing::info!("Embedding with {} concurrent batches", pool.concurrency);
 
-    for result in walker {
-        match result {
-            Ok(entry) => {
-                if !entry.file_type().is_some_and(|ft| ft.is_file()) {
-                    continue;
-                }
+    // 5. Scan files and hash their contents
+    let mut skipped = SkipReport::default();
+    let scanned = match revision.as_mut() {
+        Some(revision) => scan_revision(
+            revision,
+            index_path,
+            &path_rules,
+            &options.languages,
+            config,
+            &mut skipped,
+            &options.cancel,
+        ),
+        None => scan_files(
+            index_path,
+            &path_rules,
+            &options.languages,
+            config,
+            window.as_ref(),
+            &mut skipped,
+            &options.cancel,
+        ),
+    };
+    let candidates = match scanned {
+        Err(CodeRagError::Cancelled(_)) => {
+            return Err(stop_cancelled(
+                &manifest,
+                &bm25_index,
+                storage.as_ref(),
+                &actual_db,
+                &progress,
+                &options.cancel,
+            )
+            .await)
+        }
+        candidates => candidates?,
+    };
+    progress.set_total_files(candidates.len());
+    // Track visited files for stale cleanup
+    let visited_files: HashSet<String> = candidates.iter().map(|c| c.filename.clone()).collect();
+    // Files outside the window are put back into the manifest as they were
+    let mut untouched = Vec::new();
+    if let Some(window) = &window {
+        let outside: Vec<String> = previous
+            .files
+            .keys()
+            .filter(|f| !visited_files.contains(*f) && !window.lists(f))
+            .cloned()
+            .collect();
+        for filename in outside {
+            if let Some(entry) = previous.remove(&filename) {
+                untouched.push((filename, entry));
+            }
+        }
+        info!(
+            "Selected {} files {}; {} indexed files are left as they are.",
+            candidates.len(),
+            window,
+            untouched.len()
+        );
+        for candidate in &candidates {
+            info!("  {}", candidate.filename);
+        }
+    }
 
-                let path = entry.path();
-                let path_str = path.to_string_lossy();
-                if config.exclusions.iter().any(|ex| path_str.contains(ex)) {
-                    continue;
-                }
+    // Unchanged files sharing chunks with a changed or removed one are
+    // re-indexed along with it, so the stored copy lists the right locations.
+    // All of them are once dedup_chunks is off, to store their chunks again
+    let forced = if dedup.is_some() {
+        let hashes: HashMap<&str, &str> = candidates
+            .iter()
+            .map(|c| (c.filename.as_str(), c.hash.as_str()))
+            .collect();
+        forced_files(&previous, |f| {
+            hashes.get(f).copied() != previous.get(f).map(|e| e.hash.as_str())
+        })
+    } else {
+        linked.clone()
+    };
+    if !forced.is_empty() {
+        info!(
+            "Re-indexing {} unchanged files that share chunks with others.",
+            forced.len()
+        );
+    }
 
-                let fname_short = path.file_name().unwrap_or_default().to_string_lossy();
-                pb_index.set_message(format!("Processing {}", fname_short));
-                pb_index.inc(1);
+    // Files that disappeared since the last run, keyed by content hash, so that a
+    // moved file can reuse its stored vectors instead of being re-embedded.
+    let mut vanished_by_hash: HashMap<String, Vec<String>> = HashMap::new();
+    for (filename, entry) in &previous.files {
+        if !visited_files.contains(filename) {
+            vanished_by_hash
+                .entry(entry.hash.clone())
+                .or_default()
+                .push(filename.clone());
+        }
+    }
 
-                let ext = path.extension().and_then(|s| s.to_str()).unwrap_or("");
-                if CodeChunker::get_language(ext).is_none() {
-                    continue;
-                }
+    // 6. Indexing Loop (Streaming)
+    let mut chunks_buffer = Vec::new();
+    let mut pending_deletes = Vec::new();
+    let mut pending_entries = Vec::new();
+    let mut summary = IndexSummary::default();
+    let mut failed_renames = Vec::new();
+    let mut unembedded = Vec::new();
+    // Vectors of chunks an interrupted run already stored, by chunk ID
+    let mut reused = HashMap::new();
+    let mut last_checkpoint = Instant::now();
+    let mut cancelled = false;
 
-                if let Ok(metadata) = fs::metadata(path) {
-                    // OOM Protection: Skip large files
-                    if metadata.len() > config.max_file_size_bytes as u64 {
-                        warn!(
-                            "Skipping file {} (size: {} bytes) - exceeds limit of {} bytes",
-                            path_str,
-                            metadata.len(),
-                            config.max_file_size_bytes
-                        );
-                        continue;
-                    }
+    for candidate in candidates {
+        if options.cancel.is_cancelled() {
+            cancelled = true;
+            break;
+        }
+        let fname_short = candidate
+            .path
+            .file_name()
+            .unwrap_or_default()
+            .to_string_lossy()
+            .to_string();
+        progress.file_started(&fname_short);
+        let path_tags = tag_rules.path_tags(&candidate.filename);
 
-                    let modified = metadata
-                        .modified()
-                        .unwrap_or(std::time::SystemTime::UNIX_EPOCH);
-                    let mtime = modified
-                        .duration_since(std::time::UNIX_EPOCH)
-                        .unwrap_or_default()
-                        .as_secs() as i64;
-                    let fname_str = path_str.to_string();
+        if other_collections.remove(&candidate.filename).is_some() {
+            // Indexed into another collection before; it moves to this one
+            pending_deletes.push(candidate.filename.clone());
+        } else if let Some(entry) = previous.get(&candidate.filename) {
+            if entry.hash == candidate.hash
+                && entry.tags == path_tags
+                && !forced.contains(&candidate.filename)
+            {
+                summary.unchanged += 1;
+                if resumed_files.contains(&candidate.filename) {
+                    match storage
+                        .get_file_chunks(&candidate.filename, &workspace_arg)
+                        .await
+                    {
+                        Ok(rows) => {
+                            let chunks: Vec<_> = rows.into_iter().map(|(c, _)| c).collect();
+                            call_graph.insert_file(&candidate.filename, &chunks);
+                        }
+                        Err(e) => warn!(
+                            "Failed to read chunks of {} for the call graph: {}",
+                            candidate.filename, e
+                        ),
+                    }
+                } else {
+                    call_graph.keep_file(&previous_graph, &candidate.filename);
+                }
+                manifest.insert(candidate.filename, entry.clone());
+                continue; // Unchanged
+            }
+            // Content changed, mark old version for deletion
+            pending_deletes.push(candidate.filename.clone());
+        } else if let Some(old_filename) =
+            vanished_by_hash.get_mut(&candidate.hash).and_then(|names| {
+                // Chunks moving to other tags are re-indexed to carry them
+                let movable = names.iter().rposition(|name| {
+                    !linked.contains(name)
+                        && previous.get(name).is_some_and(|e| e.tags == path_tags)
+                })?;
+                Some(names.remove(movable))
+            })
+        {
+            match storage
+                .rename_file(
+                    &old_filename,
+                    &candidate.filename,
+                    &workspace_arg,
+                    candidate.mtime,
+                )
+                .await
+            {
+                Ok(moved) if !moved.is_empty() => {
+                    if let Err(e) = bm25_index.delete_file(&old_filename, &workspace_arg) {
+                        error!("Error removing renamed file from BM25: {}", e);
+                    }
+                    if let Err(e) = bm25_index.add_chunks(&moved, &workspace_arg) {
+                        error!("Error adding renamed file to BM25: {}", e);
+                    }
+                    info!("Renamed: {} -> {}", old_filename, candidate.filename);
+                    summary.renamed += 1;
+                    call_graph.insert_file(&candidate.filename, &moved);
+                    manifest.insert(
+                        candidate.filename,
+                        FileEntry {
+                            hash: candidate.hash,
+                            mtime: candidate.mtime,
+                            chunk_ids: moved.iter().map(|c| c.id()).collect(),
+                            collection: options.collection.clone(),
+                            merged: BTreeMap::new(),
+                            tags: path_tags,
+                        },
+                    );
+                    continue;
+                }
+                Ok(_) => {}
+                Err(e) => {
+                    warn!(
+                        "Failed to move chunks of {} to {}: {}. Re-indexing instead.",
+                        old_filename, candidate.filename, e
+                    );
+                    failed_renames.push(old_filename);
+                }
+            }
+        } else if let Some(stored_mtime) = existing_files.get(&candidate.filename) {
+            // A resumed run may have stored the file without its BM25 entries
+            if *stored_mtime == candidate.mtime && !resume {
+                summary.unchanged += 1;
+                call_graph.keep_file(&previous_graph, &candidate.filename);
+                continue; // Unchanged (legacy index without manifest)
+            }
+            pending_deletes.push(candidate.filename.clone());
+        }
 
-                    // Track visited files for stale cleanup
-                    visited_files.insert(fname_str.clone());
+        // An interrupted run may have stored some or all chunks of a file it
+        // did not get to checkpoint
+        let stored = if resume {
+            storage
+                .get_file_chunks(&candidate.filename, &workspace_arg)
+                .await
+                .unwrap_or_else(|e| {
+                    warn!(
+                        "Failed to read stored chunks of {}: {}. Re-embedding it.",
+                        candidate.filename, e
+                    );
+                    Vec::new()
+                })
+        } else {
+            Vec::new()
+        };
 
-                    if update {
-                        if let Some(stored_mtime) = existing_files.get(&fname_str) {
-                            if *stored_mtime == mtime {
-                                continue; // Unchanged
+        let content = match (&candidate.blob, revision.as_mut()) {
+            (Some(blob), Some(revision)) => revision.read(blob),
+            _ => fs::read(&candidate.path),
+        };
+        let content = match content {
+            Ok(content) => Some(content),
+            Err(e) => {
+                warn!("Error reading file {}: {}", candidate.filename, e);
+                skipped.record(SkipReason::Unreadable);
+                None
+            }
+        };
+        if let Some(content) = content {
+            let mut reader = std::io::Cursor::new(content);
+            let chunk_started = Instant::now();
+            match chunker.chunk_file(&candidate.filename, &mut reader, candidate.mtime) {
+                Ok(mut new_chunks) => {
+                    debug!(
+                        file = %candidate.filename,
+                        chunks = new_chunks.len(),
+                        elapsed_ms = chunk_started.elapsed().as_millis() as u64,
+                        "Chunked file"
+                    );
+                    // Blame describes the working tree, not an older revision
+                    if config.blame_timestamps && candidate.blob.is_none() {
+                        blame_chunks(&mut new_chunks, &candidate.path);
+                    }
+                    if let Some(redactor) = &redactor {
+                        summary.redacted += redactor.redact_chunks(&mut new_chunks);
+                    }
+                    if let Some(summarizer) = &summarizer {
+                        // LLM requests are dropped, and so aborted, on cancellation
+                        match options
+                            .cancel
+                            .run(summarizer.summarize_chunks(&mut new_chunks))
+                            .await
+                        {
+                            Ok(summarized) => summary.summarized += summarized,
+                            Err(_) => {
+                                cancelled = true;
+                                break;
                             }
-                            // File changed, mark old version for deletion
-                            pending_deletes.push(fname_str.clone());
                         }
                     }
+                    call_graph.insert_file(&candidate.filename, &new_chunks);
+                    progress.add_chunks(new_chunks.len());
 
-                    if let Ok(file) = fs::File::open(path) {
-                        let mut reader = std::io::BufReader::new(file);
-                        match chunker.chunk_file(&fname_str, &mut reader, mtime) {
-                            Ok(new_chunks) => chunks_buffer.extend(new_chunks),
-                            Err(e) => warn!("Error chunking file {}: {}", fname_str, e),
+                    if !stored.is_empty() {
+                        let ids: HashSet<String> = new_chunks.iter().map(|c| c.id()).collect();
+                        let rows = stored.len();
+                        let stored: HashMap<String, Vec<f32>> =
+                            stored.into_iter().map(|(c, v)| (c.id(), v)).collect();
+                        summary.resumed += 1;
+                        // With dedup_chunks the file is rewritten, which leaves
+                        // out the chunks stored elsewhere this run
+                        if dedup.is_none()
+                            && rows == ids.len()
+                            && stored.keys().all(|id| ids.contains(id))
+                        {
+                            // Stored in full after the last checkpoint; only BM25,
+                            // committed at checkpoints, may have lost it
+                            pending_deletes.retain(|f| f != &candidate.filename);
+                            if let Err(e) =
+                                bm25_index.delete_file(&candidate.filename, &workspace_arg)
+                            {
+                                error!("Error removing resumed file from BM25: {}", e);
+                            }
+                            if let Err(e) = bm25_index.add_chunks(&new_chunks, &workspace_arg) {
+                                error!("Error adding resumed file to BM25: {}", e);
+                            }
+                            manifest.insert(
+                                candidate.filename,
+                                FileEntry {
+                                    hash: candidate.hash,
+                                    mtime: candidate.mtime,
+                                    chunk_ids: new_chunks.iter().map(|c| c.id()).collect(),
+                                    collection: options.collection.clone(),
+                                    merged: BTreeMap::new(),
+                                    tags: path_tags,
+                                },
+                            );
+                            continue;
+                        }
+                        // Partially stored: rewrite the file, embedding only the
+                        // chunks that are missing
+                        reused.extend(stored.into_iter().filter(|(id, _)| ids.contains(id)));
+                        if !pending_deletes.contains(&candidate.filename) {
+                            pending_deletes.push(candidate.filename.clone());
                         }
                     }
-                }
 
-                if chunks_buffer.len() >= batch_size_val || pending_deletes.len() >= batch_size_val
-                {
-                    let mut ctx = IndexingContext {
-                        embedder: &mut embedder,
-                        storage: &storage,
-                        bm25_index: &bm25_index,
-                        pb: &pb_index,
-                        workspace: &workspace_arg,
-                    };
-                    process_batch(&mut chunks_buffer, &mut pending_deletes, &mut ctx).await?;
+                    summary.reindexed += 1;
+                    pending_entries.push((
+                        candidate.filename,
+                        FileEntry {
+                            hash: candidate.hash,
+                            mtime: candidate.mtime,
+                            chunk_ids: new_chunks.iter().map(|c| c.id()).collect(),
+                            collection: options.collection.clone(),
+                            merged: BTreeMap::new(),
+                            tags: path_tags,
+                        },
+                    ));
+                    chunks_buffer.extend(new_chunks);
+                }
+                Err(e) => {
+                    warn!("Error chunking file {}: {}", candidate.filename, e);
+                    skipped.record(SkipReason::Unreadable);
                 }
             }
-            Err(err) => warn!("Error walking directory: {}", err),
+        }
+
+        if chunks_buffer.len() >= batch_size_val || pending_deletes.len() >= batch_size_val {
+            let mut ctx = IndexingContext {
+                embedder: &embedder,
+                pool: &pool,
+                storage: storage.as_ref(),
+                bm25_index: &bm25_index,
+                progress: &progress,
+                workspace: &workspace_arg,
+                unembedded: &mut unembedded,
+                reused: &mut reused,
+                embed_cache: embed_cache.as_ref(),
+                dedup: dedup.as_mut(),
+            };
+            let failed =
+                match process_batch(&mut chunks_buffer, &mut pending_deletes, &mut ctx).await {
+                    Err(CodeRagError::EmbedderAuth(message)) => {
+                        flush_duplicates(dedup.as_mut(), storage.as_ref(), &workspace_arg).await?;
+                        return Err(stop_unauthorized(
+                            message,
+                            &manifest,
+                            &bm25_index,
+                            storage.as_ref(),
+                            &actual_db,
+                            &progress,
+                        )
+                        .await);
+                    }
+                    failed => failed?,
+                };
+            if let Some(dedup) = dedup.as_mut() {
+                dedup.annotate(&mut pending_entries);
+            }
+            commit_entries(&mut manifest, &mut pending_entries, &failed);
+
+            if last_checkpoint.elapsed() >= CHECKPOINT_INTERVAL {
+                flush_duplicates(dedup.as_mut(), storage.as_ref(), &workspace_arg).await?;
+                save_checkpoint(&manifest, &bm25_index, &actual_db);
+                last_checkpoint = Instant::now();
+            }
         }
     }
 
-    if !chunks_buffer.is_empty() || !pending_deletes.is_empty() {
+    if !cancelled && (!chunks_buffer.is_empty() || !pending_deletes.is_empty()) {
         let mut ctx = IndexingContext {
-            embedder: &mut embedder,
-            storage: &storage,
+            embedder: &embedder,
+            pool: &pool,
+            storage: storage.as_ref(),
             bm25_index: &bm25_index,
-            pb: &pb_index,
+            progress: &progress,
             workspace: &workspace_arg,
+            unembedded: &mut unembedded,
+            reused: &mut reused,
+            embed_cache: embed_cache.as_ref(),
+            dedup: dedup.as_mut(),
         };
-        process_batch(&mut chunks_buffer, &mut pending_deletes, &mut ctx).await?;
+        let failed = match process_batch(&mut chunks_buffer, &mut pending_deletes, &mut ctx).await {
+            Err(CodeRagError::EmbedderAuth(message)) => {
+                flush_duplicates(dedup.as_mut(), storage.as_ref(), &workspace_arg).await?;
+                return Err(stop_unauthorized(
+                    message,
+                    &manifest,
+                    &bm25_index,
+                    storage.as_ref(),
+                    &actual_db,
+                    &progress,
+                )
+                .await);
+            }
+            failed => failed?,
+        };
+        if let Some(dedup) = dedup.as_mut() {
+            dedup.annotate(&mut pending_entries);
+        }
+        commit_entries(&mut manifest, &mut pending_entries, &failed);
+    } else if !cancelled {
+        // Files that produced no chunks still belong in the manifest.
+        commit_entries(&mut manifest, &mut pending_entries, &HashSet::new());
+    }
+    // Also when cancelled, as the files merged so far are in the manifest
+    flush_duplicates(dedup.as_mut(), storage.as_ref(), &workspace_arg).await?;
+    if cancelled || options.cancel.is_cancelled() {
+        // Chunks still buffered were never stored; the resumed run redoes their files
+        return Err(stop_cancelled(
+            &manifest,
+            &bm25_index,
+            storage.as_ref(),
+            &actual_db,
+            &progress,
+            &options.cancel,
+        )
+        .await);
+    }
+    for (filename, entry) in other_collections.into_iter().chain(untouched) {
+        call_graph.keep_file(&previous_graph, &filename);
+        manifest.insert(filename, entry);
     }
 
-    // 6. Stale File Cleanup (Post-Indexing)
+    // 7. Stale File Cleanup (Post-Indexing)
     if update {
-        let stale_files: Vec<String> = existing_files
-            .keys()
-            .filter(|f| !visited_files.contains(*f))
-            .cloned()
-            .collect();
+        let mut stale_files: Vec<String> = vanished_by_hash.into_values().flatten().collect();
+        stale_files.extend(failed_renames);
+        stale_files.extend(
+            existing_files
+                .keys()
+                .filter(|f| !visited_files.contains(*f))
+                .filter(|f| window.as_ref().map_or(true, |w| w.lists(f)))
+                .cloned(),
+        );
+        stale_files.sort();
+        stale_files.dedup();
 
         if !stale_files.is_empty() {
             info!("Found {} stale files to remove.", stale_files.len());
-            pb_index.set_message("Cleaning up stale files...");
+            progress.set_stage("Cleaning up stale files...");
+            summary.removed = stale_files.len();
 
             // Process in batches
             for chunk in stale_files.chunks(batch_size_val) {
                 let batch: Vec<String> = chunk.to_vec();
-                if let Err(e) = storage.batch_delete_files(&batch, &table_name).await {
+                if let Err(e) = storage.batch_delete_files(&batch, &workspace_arg).await {
                     error!("Error removing stale files from storage: {}", e);
                 }
-                if let Err(e) = bm25_index.batch_delete_files(&batch, &table_name) {
+                if let Err(e) = bm25_index.batch_delete_files(&batch, &workspace_arg) {
                     error!("Error removing stale files from BM25: {}", e);
                 }
             }
@@ -259,12 +839,91 @@ pub async fn index_codebase(options: IndexOptions, config: &AppConfig) -> Result
     }
 
     // Commit BM25 index once at the end (single expensive I/O operation)
-    pb_index.set_message("Committing BM25 index...");
+    progress.set_stage("Committing BM25 index...");
     if let Err(e) = bm25_index.commit() {
         warn!("Failed to commit BM25 index: {}", e);
     }
 
-    pb_index.finish_with_message("Indexing complete.");
+    if let Err(e) = call_graph.save(&actual_db) {
+        warn!("Failed to write call graph: {}", e);
+    }
+    if let Err(e) = bump_index_version(&actual_db) {
+        warn!("Failed to update index version: {}", e);
+    }
+    // A graph that isn't saved is rebuilt the next time the index is opened;
+    // a saved one records the version bumped just before
+    if let Err(e) = storage.flush().await {
+        warn!("Failed to save vector index: {:#}", e);
+    }
+
+    match manifest.save(&actual_db) {
+        Ok(()) => {
+            if let Err(e) = clear_in_progress(&actual_db) {
+                warn!("Failed to clear indexing marker: {}", e);
+            }
+            if let Err(e) = IndexManifest::clear_checkpoint(&actual_db) {
+                warn!("Failed to remove indexing checkpoint: {}", e);
+            }
+        }
+        Err(e) => warn!("Failed to write index manifest: {}", e),
+    }
+
+    progress.finish("Indexing complete.");
+    info!(
+        "Indexed {} files: {} unchanged, {} renamed, {} re-indexed, {} removed.",
+        manifest.files.len(),
+        summary.unchanged,
+        summary.renamed,
+        summary.reindexed,
+        summary.removed
+    );
+    if skipped.total() > 0 {
+        info!("Skipped {} files: {}.", skipped.total(), skipped.summary());
+    }
+    if skipped.count(SkipReason::TooLarge) > 0 {
+        info!("Raise the limit with --max-file-size, or pass --index-large to index them.");
+    }
+    if chunker.fallbacks() > 0 {
+        warn!(
+            "{} files could not be parsed and were indexed by lines.",
+            chunker.fallbacks()
+        );
+    }
+    if summary.resumed > 0 {
+        info!(
+            "Finished {} files the interrupted run had partly or fully stored.",
+            summary.resumed
+        );
+    }
+    if summary.redacted > 0 {
+        info!("Redacted secrets in {} chunks.", summary.redacted);
+    }
+    if summary.summarized > 0 {
+        info!("Summarized {} oversized chunks.", summary.summarized);
+    }
+    let merged = dedup.as_ref().map_or(0, |d| d.total);
+    if merged > 0 {
+        info!(
+            "Merged {} duplicate chunks into copies stored once.",
+            merged
+        );
+    }
+    if let Some(cache) = &embed_cache {
+        let (hits, misses) = cache.stats();
+        info!(
+            "Embedding cache: {} chunks reused a cached vector, {} were not in the cache.",
+            hits, misses
+        );
+    }
+    if !unembedded.is_empty() {
+        error!(
+            "{} chunks could not be embedded; their files were not indexed and will be retried by the next --update run:",
+            unembedded.len()
+        );
+        for (chunk_id, e) in &unembedded {
+            error!("  {}: {}", chunk_id, e);
+        }
+    }
 
     info!("Optimizing index (creating filename index)...");
     if let Err(e) = storage.create_filename_index().await {
@@ -274,80 +933,561 @@ pub async fn index_codebase(options: IndexOptions, config: &AppConfig) -> Result
     Ok(())
 }
 
+/// Walks `index_path` and returns the files to index with their content hashes,
+/// counting the files left out in `skipped`. Files outside `window` are
+/// passed over without being read. Fails if `cancel` is cancelled during the
+/// walk.
+fn scan_files(
+    index_path: &Path,
+    path_rules: &PathRules,
+    languages: &[String],
+    config: &AppConfig,
+    window: Option<&ChangeWindow>,
+    skipped: &mut SkipReport,
+    cancel: &CancelToken,
+) -> Result<Vec<FileCandidate>, CodeRagError> {
+    let walk_skipped = Arc::new(Mutex::new(SkipReport::default()));
+    let walker = walk::walk(index_path, walk_skipped.clone())
+        .map_err(|e| CodeRagError::Generic(e.to_string()))?;
+
+    let mut candidates = Vec::new();
+    let walk_started = Instant::now();
+    for result in walker {
+        cancel.check()?;
+        match result {
+            Ok(entry) => {
+                if !entry.file_type().is_some_and(|ft| ft.is_file()) {
+                    continue;
+                }
+
+                let path = entry.path();
+                let path_str = path.to_string_lossy();
+                if let Some(reason) = check_path(path, path_rules, languages, config) {
+                    skipped.record(reason);
+                    continue;
+                }
+
+                if let Ok(metadata) = fs::metadata(path) {
+                    // OOM Protection: Skip large files before reading them
+                    if let Some(reason) = check_size(&path_str, metadata.len(), config) {
+                        skipped.record(reason);
+                        continue;
+                    }
+
+                    let modified = metadata
+                        .modified()
+                        .unwrap_or(std::time::SystemTime::UNIX_EPOCH);
+                    let mtime = modified
+                        .duration_since(std::time::UNIX_EPOCH)
+                        .unwrap_or_default()
+                        .as_secs() as i64;
+                    if window.is_some_and(|w| !w.contains(&path_str, mtime)) {
+                        continue;
+                    }
+
+                    // Read in full (it is within the size limit) to check the
+                    // content and hash it in one pass
+                    let content = match fs::read(path) {
+                        Ok(content) => content,
+                        Err(e) => {
+                            warn!("Error reading file {}: {}", path_str, e);
+                            skipped.record(SkipReason::Unreadable);
+                            continue;
+                        }
+                    };
+                    if let Some(reason) = check_content(&path_str, &content) {
+                        skipped.record(reason);
+                        continue;
+                    }
+                    let hash = hash_bytes(&content);
+
+                    candidates.push(FileCandidate {
+                        path: path.to_path_buf(),
+                        filename: path_str.to_string(),
+                        mtime,
+                        hash,
+                        blob: None,
+                    });
+                } else {
+                    skipped.record(SkipReason::Unreadable);
+                }
+            }
+            Err(err) => warn!("Error walking directory: {}", err),
+        }
+    }
+    debug!(
+        files = candidates.len(),
+        skipped = skipped.total(),
+        elapsed_ms = walk_started.elapsed().as_millis() as u64,
+        "Walked {}",
+        index_path.display()
+    );
+
+    if let Ok(walk_skipped) = walk_skipped.lock() {
+        skipped.merge(&walk_skipped);
+    }
+    Ok(candidates)
+}
+
+/// Lists the files of `revision` under `index_path` like [`scan_files`] lists
+/// the working tree, applying the same rules. Files are named
+/// `<revision>:<path>`, so they never clash with the working tree's.
+fn scan_revision(
+    revision: &mut Revision,
+    index_path: &Path,
+    path_rules: &PathRules,
+    languages: &[String],
+    config: &AppConfig,
+    skipped: &mut SkipReport,
+    cancel: &CancelToken,
+) -> Result<Vec<FileCandidate>, CodeRagError> {
+    let mut candidates = Vec::new();
+    for file in revision.files()? {
+        cancel.check()?;
+        let path = index_path.join(&file.path);
+        let path_str = path.to_string_lossy();
+        if let Some(reason) = check_path(&path, path_rules, languages, config)
+            .or_else(|| check_size(&path_str, file.size, config))
+        {
+            skipped.record(reason);
+            continue;
+        }
+        let content = match revision.read(&file.blob) {
+            Ok(content) => content,
+            Err(e) => {
+                warn!("Error reading {} at {}: {}", path_str, revision.name, e);
+                skipped.record(SkipReason::Unreadable);
+                continue;
+            }
+        };
+        if let Some(reason) = check_content(&path_str, &content) {
+            skipped.record(reason);
+            continue;
+        }
+        candidates.push(FileCandidate {
+            filename: format!("{}:{}", revision.name, path_str),
+            path,
+            mtime: revision.time,
+            hash: hash_bytes(&content),
+            blob: Some(file.blob),
+        });
+    }
+    debug!(
+        files = candidates.len(),
+        skipped = skipped.total(),
+        "Listed {} at {}",
+        index_path.display(),
+        revision.commit
+    );
+    Ok(candidates)
+}
+
+/// Why the file at `path` is left out by name, if it is: configured
+/// exclusions, `--include`/`--exclude`, unsupported or unselected languages.
+fn check_path(
+    path: &Path,
+    path_rules: &PathRules,
+    languages: &[String],
+    config: &AppConfig,
+) -> Option<SkipReason> {
+    let path_str = path.to_string_lossy();
+    if config.exclusions.iter().any(|ex| path_str.contains(ex)) {
+        return Some(SkipReason::Excluded);
+    }
+    if let Some(reason) = path_rules.check(&path_str) {
+        return Some(reason);
+    }
+
+    let ext = path.extension().and_then(|s| s.to_str()).unwrap_or("");
+    if !CodeChunker::is_supported(ext) {
+        return Some(SkipReason::Unsupported);
+    }
+    if !languages.is_empty() {
+        let language = CodeChunker::language_name(ext).unwrap_or(ext);
+        if !languages
+            .iter()
+            .any(|l| l.eq_ignore_ascii_case(language) || l.eq_ignore_ascii_case(ext))
+        {
+            return Some(SkipReason::Language);
+        }
+    }
+    None
+}
+
+fn check_size(path_str: &str, size: u64, config: &AppConfig) -> Option<SkipReason> {
+    let limit = config.max_file_size().filter(|l| size > *l)?;
+    warn!(
+        "Skipping file {} (size: {} bytes) - exceeds limit of {} bytes",
+        path_str, size, limit
+    );
+    Some(SkipReason::TooLarge)
+}
+
+fn check_content(path_str: &str, content: &[u8]) -> Option<SkipReason> {
+    match NonText::detect(content)? {
+        NonText::Binary => {
+            debug!("Skipping binary file {}", path_str);
+            Some(SkipReason::Binary)
+        }
+        NonText::NotUtf8 => {
+            warn!("Skipping file {} - not valid UTF-8", path_str);
+            Some(SkipReason::NotUtf8)
+        }
+    }
+}
+
+struct FileCandidate {
+    path: PathBuf,
+    filename: String,
+    mtime: i64,
+    hash: String,
+    /// Object to read the contents from, for files of a `--rev` revision
+    blob: Option<String>,
+}
+
+#[derive(Default)]
+struct IndexSummary {
+    unchanged: usize,
+    renamed: usize,
+    reindexed: usize,
+    removed: usize,
+    /// Chunks whose text had secrets replaced
+    redacted: usize,
+    /// Chunks that got a summary for tight context budgets
+    summarized: usize,
+    /// Files an interrupted run had stored chunks of, finished by `--resume`
+    resumed: usize,
+}
+
+/// Records manifest entries once their chunks made it into storage.
+///
+/// Entries of files in `failed` are dropped so the next `--update` run retries them.
+fn commit_entries(
+    manifest: &mut IndexManifest,
+    pending: &mut Vec<(String, FileEntry)>,
+    failed: &HashSet<String>,
+) {
+    for (filename, entry) in pending.drain(..) {
+        if !failed.contains(&filename) {
+            manifest.insert(filename, entry);
+        }
+    }
+}
+
+/// Commits BM25 and records the files stored so far, so `--resume` can skip
+/// them if this run is killed. Failures only cost the resumed run more work.
+fn save_checkpoint(manifest: &IndexManifest, bm25_index: &BM25Index, db_path: &str) {
+    if let Err(e) = bm25_index.commit() {
+        warn!("Failed to commit BM25 index for checkpoint: {}", e);
+        return;
+    }
+    match manifest.save_checkpoint(db_path) {
+        Ok(()) => debug!(files = manifest.files.len(), "Saved indexing checkpoint"),
+        Err(e) => warn!("Failed to save indexing checkpoint: {}", e),
+    }
+}
+
+/// Saves what a cancelled run completed: a checkpoint of the finished files
+/// and BM25, and the vector store. The in-progress marker stays, so the index
+/// reports itself incomplete until `--resume` finishes the run. Returns the
+/// error the run stops with.
+async fn stop_cancelled(
+    manifest: &IndexManifest,
+    bm25_index: &BM25Index,
+    storage: &dyn VectorStore,
+    db_path: &str,
+    progress: &IndexProgress,
+    cancel: &CancelToken,
+) -> CodeRagError {
+    progress.finish("Indexing cancelled.");
+    save_stopped(manifest, bm25_index, storage, db_path).await;
+    let reason = match cancel.error() {
+        CodeRagError::Cancelled(reason) => reason,
+        other => other.to_string(),
+    };
+    CodeRagError::Cancelled(format!(
+        "{} after {} files were indexed. Run 'code-rag index --resume' to continue.",
+        reason,
+        manifest.files.len()
+    ))
+}
+
+/// Saves what a run stopped by rejected credentials completed, as
+/// [`stop_cancelled`] does, so `--resume` continues from there once they are
+/// fixed. Returns the error the run stops with.
+async fn stop_unauthorized(
+    message: String,
+    manifest: &IndexManifest,
+    bm25_index: &BM25Index,
+    storage: &dyn VectorStore,
+    db_path: &str,
+    progress: &IndexProgress,
+) -> CodeRagError {
+    progress.finish("Indexing stopped.");
+    save_stopped(manifest, bm25_index, storage, db_path).await;
+    CodeRagError::EmbedderAuth(format!(
+        "{} {} files were indexed before; run 'code-rag index --resume' to continue.",
+        message,
+        manifest.files.len()
+    ))
+}
+
+/// Checkpoints the finished files and BM25 and saves the vector store of a
+/// run that stops early.
+async fn save_stopped(
+    manifest: &IndexManifest,
+    bm25_index: &BM25Index,
+    storage: &dyn VectorStore,
+    db_path: &str,
+) {
+    save_checkpoint(manifest, bm25_index, db_path);
+    if let Err(e) = storage.flush().await {
+        warn!("Failed to save vector index: {:#}", e);
+    }
+}
+
 struct IndexingContext<'a> {
-    embedder: &'a mut Embedder,
-    storage: &'a Storage,
+    embedder: &'a Arc<Embedder>,
+    pool: &'a PoolOptions,
+    storage: &'a dyn VectorStore,
     bm25_index: &'a BM25Index,
-    pb: &'a ProgressBar,
+    progress: &'a Arc<IndexProgress>,
     workspace: &'a str,
+    /// `(chunk ID, error)` of chunks that could not be embedded
+    unembedded: &'a mut Vec<(String, String)>,
+    /// Stored vectors to use instead of embedding, by chunk ID
+    reused: &'a mut HashMap<String, Vec<f32>>,
+    /// Vectors of previously embedded texts, consulted before the embedder
+    embed_cache: Option<&'a EmbeddingCache>,
+    /// Leaves out chunks stored elsewhere, with `dedup_chunks`
+    dedup: Option<&'a mut Deduplicator>,
 }
 
+/// Opens the `embedding_cache` for `embedder`'s model. Indexing works
+/// without it, so a cache that can't be opened is only a warning.
+pub(crate) fn load_embedding_cache(
+    config: &AppConfig,
+    embedder: &Embedder,
+) -> Option<EmbeddingCache> {
+    match EmbeddingCache::from_config(config, embedder.model_name(), embedder.dim()) {
+        Ok(cache) => cache,
+        Err(e) => {
+            warn!("Embedding cache disabled: {:#}", e);
+            None
+        }
+    }
+}
+
+/// Writes the locations of the duplicates merged so far to their stored copies.
+async fn flush_duplicates(
+    dedup: Option<&mut Deduplicator>,
+    storage: &dyn VectorStore,
+    workspace: &str,
+) -> Result<(), CodeRagError> {
+    let Some(dedup) = dedup else {
+        return Ok(());
+    };
+    dedup
+        .flush(storage, workspace)
+        .await
+        .map_err(|e| CodeRagError::Database(format!("Failed to record duplicate chunks: {:#}", e)))
+}
+
+/// Removes the stored chunks of `files` after all, for a batch with nothing
+/// to replace them with.
+async fn delete_replaced(files: &[String], ctx: &IndexingContext<'_>) {
+    if files.is_empty() {
+        return;
+    }
+    if let Err(e) = ctx.storage.batch_delete_files(files, ctx.workspace).await {
+        error!("Error batch deleting chunks: {}", e);
+    }
+}
+
+/// Embeds `chunks` and stores them in place of the chunks of the files in
+/// `pending_deletes`.
+///
+/// Returns the files whose chunks were not stored. A file with any chunk that
+/// failed to embed is left out entirely rather than stored incomplete. The
+/// store swaps old chunks for new in one [`VectorStore::replace_files`], so a
+/// search running meanwhile, e.g. by a server sharing the index, never finds
+/// a re-indexed file missing.
 async fn process_batch(
     chunks: &mut Vec<crate::indexer::CodeChunk>,
     pending_deletes: &mut Vec<String>,
     ctx: &mut IndexingContext<'_>,
-) -> Result<(), CodeRagError> {
-    // 1. Process Deletions
-    if !pending_deletes.is_empty() {
-        if let Err(e) = ctx
-            .storage
-            .batch_delete_files(pending_deletes, ctx.workspace)
-            .await
-        {
-            error!("Error batch deleting chunks: {}", e);
-        }
-        if let Err(e) = ctx
-            .bm25_index
-            .batch_delete_files(pending_deletes, ctx.workspace)
-        {
+) -> Result<HashSet<String>, CodeRagError> {
+    let replaced = std::mem::take(pending_deletes);
+    // BM25 deletions only show once committed, after the new documents are added
+    if !replaced.is_empty() {
+        if let Err(e) = ctx.bm25_index.batch_delete_files(&replaced, ctx.workspace) {
             error!("Error batch deleting BM25 docs: {}", e);
         }
-        pending_deletes.clear();
     }
 
+    let mut merges = ctx
+        .dedup
+        .as_deref()
+        .map(|dedup| dedup.merge_identical(chunks))
+        .unwrap_or_default();
+    // Merged chunks need no vector of their own
+    ctx.progress.add_embedded(merges.count());
     if chunks.is_empty() {
-        return Ok(());
+        delete_replaced(&replaced, ctx).await;
+        if let Some(dedup) = ctx.dedup.as_deref_mut() {
+            dedup.commit(merges, &[], &HashSet::new());
+        }
+        return Ok(HashSet::new());
     }
 
-    ctx.pb.set_message("Embedding batch...");
-    let texts: Vec<String> = chunks.iter().map(|c| c.code.clone()).collect();
-
-    match ctx.embedder.embed(texts, None) {
-        Ok(embeddings) => {
-            let ids: Vec<String> = chunks
-                .iter()
-                .map(|c| format!("{}-{}-{}", c.filename, c.line_start, c.line_end))
-                .collect();
-            let filenames: Vec<String> = chunks.iter().map(|c| c.filename.clone()).collect();
-            let codes: Vec<String> = chunks.iter().map(|c| c.code.clone()).collect();
-            let starts: Vec<i32> = chunks.iter().map(|c| c.line_start as i32).collect();
-            let ends: Vec<i32> = chunks.iter().map(|c| c.line_end as i32).collect();
-            let mtimes: Vec<i64> = chunks.iter().map(|c| c.last_modified).collect();
-            let calls: Vec<Vec<String>> = chunks.iter().map(|c| c.calls.clone()).collect();
-
-            if let Err(e) = ctx
-                .storage
-                .add_chunks(
-                    ctx.workspace,
-                    ids,
-                    filenames,
-                    codes,
-                    starts,
-                    ends,
-                    mtimes,
-                    calls,
-                    embeddings,
-                )
-                .await
-            {
-                error!("Error storing chunks: {}", e);
+    let total = chunks.len();
+    let ids: Vec<String> = chunks.iter().map(|c| c.id()).collect();
+    let mut embeddings: Vec<Option<Vec<f32>>> =
+        ids.iter().map(|id| ctx.reused.remove(id)).collect();
+    // Indices of the chunks without a stored vector to reuse
+    let mut missing: Vec<usize> = (0..total).filter(|&i| embeddings[i].is_none()).collect();
+    if let Some(cache) = ctx.embed_cache {
+        let texts: Vec<&str> = missing.iter().map(|&i| chunks[i].code.as_str()).collect();
+        match cache.get_many(&texts) {
+            Ok(found) => {
+                for (&i, vector) in missing.iter().zip(found) {
+                    embeddings[i] = vector;
+                }
+                missing.retain(|&i| embeddings[i].is_none());
             }
-            if let Err(e) = ctx.bm25_index.add_chunks(chunks, ctx.workspace) {
-                error!("Error adding to BM25: {}", e);
+            Err(e) => warn!("Embedding cache lookup failed: {:#}", e),
+        }
+    }
+
+    ctx.progress.add_embedded(total - missing.len());
+    ctx.progress.start_batch(missing.len());
+    let texts: Vec<String> = missing.iter().map(|&i| chunks[i].code.clone()).collect();
+    let embed_started = Instant::now();
+    // The pool blocks until its last batch is done, keep it off the runtime
+    let (embedder, pool, progress) = (
+        Arc::clone(ctx.embedder),
+        ctx.pool.clone(),
+        Arc::clone(ctx.progress),
+    );
+    let embedded = tokio::task::spawn_blocking(move || {
+        embedder.embed_concurrently(&texts, &pool, |done| progress.batch_embedded(done))
+    })
+    .await
+    .map_err(|e| CodeRagError::Embedding(format!("Embedding task failed: {}", e)))?;
+    debug!(
+        chunks = missing.len(),
+        reused = total - missing.len(),
+        failed_batches = embedded.failed.len(),
+        elapsed_ms = embed_started.elapsed().as_millis() as u64,
+        "Embedded chunks"
+    );
+
+    let mut failed: HashSet<String> = HashSet::new();
+    for batch in &embedded.failed {
+        for &i in &missing[batch.start..batch.start + batch.len] {
+            failed.insert(chunks[i].filename.clone());
+            ctx.unembedded.push((ids[i].clone(), batch.error.clone()));
+        }
+    }
+    for (&i, vector) in missing.iter().zip(embedded.vectors) {
+        embeddings[i] = vector;
+    }
+    if let Some(cache) = ctx.embed_cache {
+        let fresh: Vec<(&str, &[f32])> = missing
+            .iter()
+            .filter_map(|&i| Some((chunks[i].code.as_str(), embeddings[i].as_deref()?)))
+            .collect();
+        if let Err(e) = cache.insert_many(&fresh) {
+            warn!("Failed to update embedding cache: {:#}", e);
+        }
+    }
+    // Every later batch would fail the same way; stop instead of writing an
+    // index with nothing embedded
+    if let Some(batch) = embedded.failed.iter().find(|b| b.auth_failure) {
+        return Err(CodeRagError::EmbedderAuth(format!(
+            "The embedding endpoint rejected the credentials during indexing: {}. Check OPENAI_API_KEY and embedding_headers.",
+            batch.error
+        )));
+    }
+
+    merges.propagate(&mut failed);
+
+    let mut ready = Vec::with_capacity(total);
+    let mut vectors = Vec::with_capacity(total);
+    for (chunk, vector) in chunks.drain(..).zip(embeddings) {
+        match vector {
+            Some(vector) if !failed.contains(&chunk.filename) => {
+                ready.push(chunk);
+                vectors.push(vector);
             }
+            _ => {}
         }
-        Err(e) => error!("Error generating embeddings: {}", e),
     }
-    chunks.clear();
-    Ok(())
+    if let Some(dedup) = ctx.dedup.as_deref() {
+        dedup
+            .merge_similar(
+                &mut ready,
+                &mut vectors,
+                &mut merges,
+                ctx.storage,
+                ctx.workspace,
+            )
+            .await;
+    }
+    if ready.is_empty() {
+        delete_replaced(&replaced, ctx).await;
+        if let Some(dedup) = ctx.dedup.as_deref_mut() {
+            dedup.commit(merges, &[], &failed);
+        }
+        return Ok(failed);
+    }
+
+    let (embedder, pool) = (Arc::clone(ctx.embedder), ctx.pool.clone());
+    let embed = |texts: Vec<String>| async move {
+        // Off the runtime, like the chunks' own vectors
+        let embedded =
+            tokio::task::spawn_blocking(move || embedder.embed_concurrently(&texts, &pool, |_| {}))
+                .await?;
+        if let Some(batch) = embedded.failed.first() {
+            anyhow::bail!("{}", batch.error);
+        }
+        Ok(embedded.vectors.into_iter().flatten().collect())
+    };
+    let facet_vectors =
+        match embed_facets(&ready, ctx.storage.facets(), ctx.embed_cache, embed).await {
+            Ok(facet_vectors) => facet_vectors,
+            Err(e) => {
+                // The chunks are still searchable by their own vectors; facets of
+                // chunks that kept their ID stay as stored
+                warn!(
+                    "Error embedding chunk facets, storing the chunks without them: {:#}",
+                    e
+                );
+                Vec::new()
+            }
+        };
+
+    let store_started = Instant::now();
+    if let Err(e) = ctx
+        .storage
+        .replace_files_with_facets(ctx.workspace, &replaced, &ready, vectors, facet_vectors)
+        .await
+    {
+        error!("Error storing chunks: {}", e);
+        failed.extend(ready.iter().map(|c| c.filename.clone()));
+        failed.extend(merges.sources().cloned());
+        return Ok(failed);
+    }
+    if let Some(dedup) = ctx.dedup.as_deref_mut() {
+        dedup.commit(merges, &ready, &failed);
+    }
+    debug!(
+        chunks = ready.len(),
+        elapsed_ms = store_started.elapsed().as_millis() as u64,
+        "Stored chunks"
+    );
+    if let Err(e) = ctx.bm25_index.add_chunks(&ready, ctx.workspace) {
+        error!("Error adding to BM25: {}", e);
+    }
+    Ok(failed)
 }
@@ -0,0 +1,518 @@
+use std::collections::{BTreeMap, HashMap, HashSet};
+
+use futures_util::stream::{self, StreamExt};
+use tracing::{debug, warn};
+
+use crate::config::AppConfig;
+use crate::indexer::{normalize_code, ChunkLocation, CodeChunk};
+use crate::manifest::{hash_bytes, FileEntry, IndexManifest};
+use crate::storage::similarity::cosine_distance;
+use crate::storage::VectorStore;
+
+/// Stored chunks a near-duplicate is compared with.
+const NEAR_CANDIDATES: usize = 4;
+
+/// Near-duplicate lookups in the store run at a time.
+const LOOKUP_CONCURRENCY: usize = 8;
+
+/// What a chunk must share with another to be merged into it, besides its text.
+#[derive(Clone, PartialEq, Eq, Hash)]
+struct Kind {
+    collection: Option<String>,
+    language: Option<String>,
+    is_test: bool,
+    tags: Vec<String>,
+}
+
+impl Kind {
+    fn of(chunk: &CodeChunk) -> Self {
+        Self {
+            collection: chunk.collection.clone(),
+            language: chunk.language.clone(),
+            is_test: chunk.is_test,
+            tags: chunk.tags.clone(),
+        }
+    }
+}
+
+/// Key of chunks with the same text apart from trailing whitespace.
+fn text_key(chunk: &CodeChunk) -> (Kind, String) {
+    (
+        Kind::of(chunk),
+        hash_bytes(normalize_code(&chunk.code).as_bytes()),
+    )
+}
+
+/// A chunk left out of a batch, to be listed as a location of `into`.
+struct Merge {
+    /// File and ID of the stored chunk
+    into: (String, String),
+    source: ChunkLocation,
+    id: String,
+}
+
+/// Merges found in one batch, applied once the batch is stored.
+#[derive(Default)]
+pub(super) struct BatchMerges {
+    merges: Vec<Merge>,
+}
+
+impl BatchMerges {
+    /// Adds to `failed` the files whose chunks were merged into a chunk of a
+    /// failed file, which won't be stored either.
+    pub fn propagate(&self, failed: &mut HashSet<String>) {
+        loop {
+            let before = failed.len();
+            for merge in &self.merges {
+                if failed.contains(&merge.into.0) {
+                    failed.insert(merge.source.filename.clone());
+                }
+            }
+            if failed.len() == before {
+                return;
+            }
+        }
+    }
+
+    /// Chunks merged in this batch.
+    pub fn count(&self) -> usize {
+        self.merges.len()
+    }
+
+    /// Files that had chunks merged in this batch.
+    pub fn sources(&self) -> impl Iterator<Item = &String> {
+        self.merges.iter().map(|m| &m.source.filename)
+    }
+}
+
+/// Chunks of a file merged into copies stored elsewhere.
+#[derive(Default)]
+struct FileMerges {
+    ids: HashSet<String>,
+    into: BTreeMap<String, usize>,
+}
+
+/// Stores each chunk repeated across the files of a run once, recording the
+/// other copies in [`CodeChunk::duplicates`] (the `dedup_chunks` config key).
+///
+/// Chunks with the same text apart from trailing whitespace are dropped before they
+/// are embedded. With a `dedup_similarity` below 1, chunks whose embedding is
+/// that close to one stored earlier in the run are dropped after. Either way
+/// the chunk must have the same collection, language, test status and tags. Only
+/// chunks stored by this run take duplicates, so files an `--update` keeps
+/// are never rewritten; [`forced_files`] re-indexes the files a change
+/// affects instead.
+pub(super) struct Deduplicator {
+    similarity: f32,
+    /// Chunks stored this run, by [`text_key`]
+    stored: HashMap<(Kind, String), (String, String)>,
+    /// Files stored this run, which near-duplicates may be merged into
+    stored_files: HashSet<String>,
+    /// Locations not yet written to their stored chunk, by its file and ID
+    pending: BTreeMap<String, HashMap<String, Vec<ChunkLocation>>>,
+    /// Merged chunks of the files not yet committed to the manifest
+    merged: HashMap<String, FileMerges>,
+    /// Chunks merged over the run
+    pub total: usize,
+}
+
+impl Deduplicator {
+    /// A deduplicator if `dedup_chunks` is on.
+    pub fn from_config(config: &AppConfig) -> Option<Self> {
+        config.dedup_chunks.then(|| Self {
+            similarity: config.dedup_similarity,
+            stored: HashMap::new(),
+            stored_files: HashSet::new(),
+            pending: BTreeMap::new(),
+            merged: HashMap::new(),
+            total: 0,
+        })
+    }
+
+    /// Takes the chunks out of `chunks` whose text was already stored this
+    /// run or comes earlier in the batch.
+    pub fn merge_identical(&self, chunks: &mut Vec<CodeChunk>) -> BatchMerges {
+        let mut batch = BatchMerges::default();
+        let mut first: HashMap<(Kind, String), (String, String)> = HashMap::new();
+        chunks.retain(|chunk| {
+            let key = text_key(chunk);
+            let into = match self.stored.get(&key).or_else(|| first.get(&key)) {
+                Some(into) => into.clone(),
+                None => {
+                    first.insert(key, (chunk.filename.clone(), chunk.id()));
+                    return true;
+                }
+            };
+            batch.merges.push(Merge::of(chunk, into));
+            false
+        });
+        batch
+    }
+
+    /// Takes the chunks out of `chunks` whose vector is at least
+    /// `dedup_similarity` close to another of the batch or one stored this
+    /// run; a no-op when only identical text is merged.
+    ///
+    /// Each chunk needs a lookup in the store; they run side by side, and not
+    /// at all before the run has stored anything.
+    pub async fn merge_similar(
+        &self,
+        chunks: &mut Vec<CodeChunk>,
+        vectors: &mut Vec<Vec<f32>>,
+        batch: &mut BatchMerges,
+        storage: &dyn VectorStore,
+        workspace: &str,
+    ) {
+        if self.similarity >= 1.0 {
+            return;
+        }
+        // Chunks identical ones were merged into stay, or those would dangle
+        let targets: HashSet<(String, String)> =
+            batch.merges.iter().map(|m| m.into.clone()).collect();
+        let is_target = |chunk: &CodeChunk| targets.contains(&(chunk.filename.clone(), chunk.id()));
+
+        let mut stored_match: Vec<Option<(String, String)>> = vec![None; chunks.len()];
+        if !self.stored_files.is_empty() {
+            let (chunks, vectors) = (&*chunks, &*vectors);
+            let found: Vec<(usize, Option<(String, String)>)> = stream::iter(0..chunks.len())
+                .filter(|&i| std::future::ready(!is_target(&chunks[i])))
+                .map(|i| async move {
+                    let found = self
+                        .nearest_stored(&chunks[i], &vectors[i], storage, workspace)
+                        .await;
+                    (i, found)
+                })
+                .buffer_unordered(LOOKUP_CONCURRENCY)
+                .collect()
+                .await;
+            for (i, found) in found {
+                stored_match[i] = found;
+            }
+        }
+
+        let mut kept: Vec<usize> = Vec::new();
+        let mut into_of: Vec<Option<(String, String)>> = vec![None; chunks.len()];
+        for i in 0..chunks.len() {
+            if is_target(&chunks[i]) {
+                kept.push(i);
+                continue;
+            }
+            let kind = Kind::of(&chunks[i]);
+            let earlier = kept
+                .iter()
+                .copied()
+                .find(|&j| Kind::of(&chunks[j]) == kind && self.similar(&vectors[i], &vectors[j]));
+            into_of[i] = match earlier {
+                Some(j) => Some((chunks[j].filename.clone(), chunks[j].id())),
+                None => stored_match[i].take(),
+            };
+            if into_of[i].is_none() {
+                kept.push(i);
+            }
+        }
+
+        let rows: Vec<(CodeChunk, Vec<f32>)> = chunks.drain(..).zip(vectors.drain(..)).collect();
+        for ((chunk, vector), into) in rows.into_iter().zip(into_of) {
+            match into {
+                Some(into) => batch.merges.push(Merge::of(&chunk, into)),
+                None => {
+                    chunks.push(chunk);
+                    vectors.push(vector);
+                }
+            }
+        }
+    }
+
+    /// File and ID of a chunk stored this run that `vector` is a
+    /// near-duplicate of.
+    async fn nearest_stored(
+        &self,
+        chunk: &CodeChunk,
+        vector: &[f32],
+        storage: &dyn VectorStore,
+        workspace: &str,
+    ) -> Option<(String, String)> {
+        let hits = match storage
+            .search_chunks(vector.to_vec(), NEAR_CANDIDATES, None, Some(workspace))
+            .await
+        {
+            Ok(hits) => hits,
+            Err(e) => {
+                warn!("Near-duplicate lookup failed: {}", e);
+                return None;
+            }
+        };
+        let kind = Kind::of(chunk);
+        hits.into_iter()
+            .find(|hit| {
+                self.stored_files.contains(&hit.chunk.filename)
+                    && Kind::of(&hit.chunk) == kind
+                    && self.similar(vector, &hit.vector)
+            })
+            .map(|hit| (hit.chunk.filename, hit.id))
+    }
+
+    fn similar(&self, a: &[f32], b: &[f32]) -> bool {
+        1.0 - cosine_distance(a, b) >= self.similarity
+    }
+
+    /// Records `batch` once `stored`, the chunks it kept, are in the store;
+    /// merges of files in `failed` are dropped.
+    pub fn commit(&mut self, batch: BatchMerges, stored: &[CodeChunk], failed: &HashSet<String>) {
+        for chunk in stored {
+            self.stored
+                .entry(text_key(chunk))
+                .or_insert_with(|| (chunk.filename.clone(), chunk.id()));
+            self.stored_files.insert(chunk.filename.clone());
+        }
+        for merge in batch.merges {
+            if failed.contains(&merge.source.filename) {
+                continue;
+            }
+            let (file, id) = merge.into;
+            let merged = self
+                .merged
+                .entry(merge.source.filename.clone())
+                .or_default();
+            merged.ids.insert(merge.id);
+            *merged.into.entry(file.clone()).or_default() += 1;
+            self.pending
+                .entry(file)
+                .or_default()
+                .entry(id)
+                .or_default()
+                .push(merge.source);
+            self.total += 1;
+        }
+    }
+
+    /// Leaves the merged chunks out of the `chunk_ids` of `pending` entries
+    /// and records where they went.
+    pub fn annotate(&mut self, pending: &mut [(String, FileEntry)]) {
+        for (filename, entry) in pending {
+            if let Some(merged) = self.merged.remove(filename.as_str()) {
+                entry.chunk_ids.retain(|id| !merged.ids.contains(id));
+                entry.merged = merged.into;
+            }
+        }
+    }
+
+    /// Writes the locations recorded since the last flush to their stored
+    /// chunks, rewriting each file that got any.
+    pub async fn flush(
+        &mut self,
+        storage: &dyn VectorStore,
+        workspace: &str,
+    ) -> anyhow::Result<()> {
+        for (filename, mut locations) in std::mem::take(&mut self.pending) {
+            let (mut chunks, vectors): (Vec<CodeChunk>, Vec<Vec<f32>>) = storage
+                .get_file_chunks(&filename, workspace)
+                .await?
+                .into_iter()
+                .unzip();
+            for chunk in &mut chunks {
+                if let Some(found) = locations.remove(&chunk.id()) {
+                    chunk.duplicates.extend(found);
+                    chunk.duplicates.sort_by(|a, b| {
+                        (&a.filename, a.line_start).cmp(&(&b.filename, b.line_start))
+                    });
+                }
+            }
+            debug!(file = %filename, "Recorded duplicate locations");
+            storage
+                .replace_files(workspace, &[filename], &chunks, vectors)
+                .await?;
+        }
+        Ok(())
+    }
+}
+
+impl Merge {
+    fn of(chunk: &CodeChunk, into: (String, String)) -> Self {
+        Self {
+            into,
+            source: ChunkLocation {
+                filename: chunk.filename.clone(),
+                line_start: chunk.line_start,
+                line_end: chunk.line_end,
+            },
+            id: chunk.id(),
+        }
+    }
+}
+
+/// Files of `previous` that `--update` must re-index although they are
+/// unchanged, because they share chunks, either way, with a file that is
+/// `changed` or gone from the manifest: the stored copy has to be rewritten
+/// with the locations that are still correct.
+pub(super) fn forced_files(
+    previous: &IndexManifest,
+    changed: impl Fn(&str) -> bool,
+) -> HashSet<String> {
+    let mut links: HashMap<&str, Vec<&str>> = HashMap::new();
+    for (filename, entry) in &previous.files {
+        for into in entry.merged.keys() {
+            links.entry(filename).or_default().push(into);
+            links.entry(into).or_default().push(filename);
+        }
+    }
+    let mut reached: HashSet<&str> = HashSet::new();
+    let mut queue: Vec<&str> = links
+        .keys()
+        .copied()
+        .filter(|f| previous.get(f).is_none() || changed(f))
+        .collect();
+    while let Some(file) = queue.pop() {
+        if !reached.insert(file) {
+            continue;
+        }
+        queue.extend(links.get(file).into_iter().flatten().copied());
+    }
+    reached
+        .into_iter()
+        .filter(|f| previous.get(f).is_some() && !changed(f))
+        .map(str::to_string)
+        .collect()
+}
+
+/// Files of `previous` that share chunks with another file, which can't be
+/// renamed in place since the locations recorded for them would go stale.
+pub(super) fn linked_files(previous: &IndexManifest) -> HashSet<String> {
+    previous
+        .files
+        .iter()
+        .filter(|(_, entry)| !entry.merged.is_empty())
+        .flat_map(|(filename, entry)| {
+            std::iter::once(filename.clone()).chain(entry.merged.keys().cloned())
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn chunk(filename: &str, code: &str, line_start: usize) -> CodeChunk {
+        CodeChunk {
+            filename: filename.to_string(),
+            code: code.to_string(),
+            line_start,
+            line_end: line_start + 2,
+            language: Some("go".to_string()),
+            ..Default::default()
+        }
+    }
+
+    fn deduplicator() -> Deduplicator {
+        Deduplicator {
+            similarity: 1.0,
+            stored: HashMap::new(),
+            stored_files: HashSet::new(),
+            pending: BTreeMap::new(),
+            merged: HashMap::new(),
+            total: 0,
+        }
+    }
+
+    fn entry(hash: &str, chunks: &[&CodeChunk]) -> FileEntry {
+        FileEntry {
+            hash: hash.to_string(),
+            mtime: 0,
+            chunk_ids: chunks.iter().map(|c| c.id()).collect(),
+            collection: None,
+            merged: BTreeMap::new(),
+            tags: Vec::new(),
+        }
+    }
+
+    #[test]
+    fn test_merge_identical() {
+        let mut dedup = deduplicator();
+        let a = chunk("a.go", "func Max(a, b int) int {}", 1);
+        let b = chunk("b.go", "func Max(a, b int) int {}  \n", 10);
+        let other = chunk("b.go", "func Min(a, b int) int {}", 20);
+        let mut test = chunk("b_test.go", "func Max(a, b int) int {}", 1);
+        test.is_test = true;
+
+        let mut chunks = vec![a.clone(), b.clone(), other.clone(), test.clone()];
+        let merges = dedup.merge_identical(&mut chunks);
+        // Trailing whitespace doesn't matter; test status does
+        let kept: Vec<&str> = chunks.iter().map(|c| c.filename.as_str()).collect();
+        assert_eq!(kept, vec!["a.go", "b.go", "b_test.go"]);
+        assert_eq!(merges.count(), 1);
+        dedup.commit(merges, &chunks, &HashSet::new());
+
+        let mut pending = vec![
+            ("a.go".to_string(), entry("1", &[&a])),
+            ("b.go".to_string(), entry("2", &[&b, &other])),
+        ];
+        dedup.annotate(&mut pending);
+        assert_eq!(pending[0].1.chunk_ids, vec![a.id()]);
+        assert!(pending[0].1.merged.is_empty());
+        assert_eq!(pending[1].1.chunk_ids, vec![other.id()]);
+        assert_eq!(
+            pending[1].1.merged,
+            BTreeMap::from([("a.go".to_string(), 1)])
+        );
+        assert_eq!(
+            dedup.pending["a.go"][&a.id()],
+            vec![ChunkLocation {
+                filename: "b.go".to_string(),
+                line_start: 10,
+                line_end: 12,
+            }]
+        );
+
+        // Later batches merge into the chunks stored earlier
+        let mut chunks = vec![chunk("c.go", "func Max(a, b int) int {}", 5)];
+        let merges = dedup.merge_identical(&mut chunks);
+        assert!(chunks.is_empty());
+        dedup.commit(merges, &[], &HashSet::new());
+        assert_eq!(dedup.total, 2);
+        assert_eq!(dedup.pending["a.go"][&a.id()].len(), 2);
+    }
+
+    #[test]
+    fn test_failed_merges_are_dropped() {
+        let mut dedup = deduplicator();
+        let mut chunks = vec![
+            chunk("a.go", "func Max() {}", 1),
+            chunk("b.go", "func Max() {}", 1),
+            chunk("c.go", "func Max() {}", 1),
+        ];
+        let merges = dedup.merge_identical(&mut chunks);
+        let mut failed = HashSet::from(["a.go".to_string()]);
+        merges.propagate(&mut failed);
+        // Their copy is never stored, so the others aren't either
+        assert_eq!(failed.len(), 3);
+        dedup.commit(merges, &[], &failed);
+        assert_eq!(dedup.total, 0);
+        assert!(dedup.pending.is_empty());
+    }
+
+    #[test]
+    fn test_forced_files() {
+        let shared = chunk("a.go", "func Max() {}", 1);
+        let mut previous = IndexManifest::default();
+        previous.insert("a.go".to_string(), entry("1", &[&shared]));
+        let mut b = entry("2", &[]);
+        b.merged.insert("a.go".to_string(), 1);
+        previous.insert("b.go".to_string(), b);
+        let mut c = entry("3", &[]);
+        c.merged.insert("a.go".to_string(), 1);
+        previous.insert("c.go".to_string(), c);
+        previous.insert("d.go".to_string(), entry("4", &[]));
+
+        assert!(forced_files(&previous, |_| false).is_empty());
+        // Everything sharing the copy in a.go is rewritten with it
+        let forced = forced_files(&previous, |f| f == "b.go");
+        assert_eq!(
+            forced,
+            HashSet::from(["a.go".to_string(), "c.go".to_string()])
+        );
+        assert_eq!(
+            linked_files(&previous),
+            HashSet::from(["a.go".to_string(), "b.go".to_string(), "c.go".to_string()])
+        );
+    }
+}
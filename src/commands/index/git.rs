@@ -0,0 +1,353 @@
+use std::io::{BufRead, BufReader, Read, Write};
+use std::path::{Path, PathBuf};
+use std::process::{Child, ChildStdin, ChildStdout, Command, Stdio};
+
+use crate::core::CodeRagError;
+
+/// A commit of the repository being indexed, whose files `index --rev` reads
+/// with the `git` CLI instead of from the working tree.
+pub(super) struct Revision {
+    /// The revision as given, e.g. `v1.2`; file names are prefixed with it
+    pub name: String,
+    /// Full ID of the commit it resolved to
+    pub commit: String,
+    /// Commit time, which stands in for the files' modification times
+    pub time: i64,
+    /// Indexed directory; tree paths are relative to it
+    dir: PathBuf,
+    blobs: Option<BlobReader>,
+}
+
+/// A file of the revision's tree under the indexed directory.
+#[derive(Debug, PartialEq)]
+pub(super) struct TreeFile {
+    /// Relative to the indexed directory, with `/` separators
+    pub path: String,
+    pub blob: String,
+    pub size: u64,
+}
+
+/// Runs `git` in `dir` and returns its output, or its complaint as the error.
+fn git(dir: &Path, args: &[&str]) -> Result<Vec<u8>, CodeRagError> {
+    let output = Command::new("git")
+        .args(args)
+        .current_dir(dir)
+        .output()
+        .map_err(|e| CodeRagError::Generic(format!("Indexing a git revision needs git: {}", e)))?;
+    if !output.status.success() {
+        return Err(CodeRagError::Generic(
+            String::from_utf8_lossy(&output.stderr).trim().to_string(),
+        ));
+    }
+    Ok(output.stdout)
+}
+
+impl Revision {
+    /// Resolves `rev` (a tag, branch or commit) in the repository containing
+    /// `dir`, failing clearly when `dir` isn't in one or `rev` isn't a commit.
+    pub fn open(dir: &Path, rev: &str) -> Result<Self, CodeRagError> {
+        if !dir.is_dir() {
+            return Err(CodeRagError::Generic(format!(
+                "Cannot index revision '{}' of {}: not a directory",
+                rev,
+                dir.display()
+            )));
+        }
+        // A leading '-' would be read as an option
+        if rev.is_empty() || rev.starts_with('-') {
+            return Err(CodeRagError::Generic(format!(
+                "Invalid git revision '{}'",
+                rev
+            )));
+        }
+        let in_work_tree = git(dir, &["rev-parse", "--is-inside-work-tree"])
+            .map(|out| out.trim_ascii() == b"true")
+            .unwrap_or(false);
+        if !in_work_tree {
+            return Err(CodeRagError::Generic(format!(
+                "{} is not in a git repository; --rev can only index git history",
+                dir.display()
+            )));
+        }
+        let commit = git(
+            dir,
+            &[
+                "rev-parse",
+                "--verify",
+                "--quiet",
+                &format!("{}^{{commit}}", rev),
+            ],
+        )
+        .map_err(|_| {
+            CodeRagError::Generic(format!(
+                "Unknown git revision '{}' in {}",
+                rev,
+                dir.display()
+            ))
+        })?;
+        let commit = String::from_utf8_lossy(&commit).trim().to_string();
+        let time = git(dir, &["show", "-s", "--format=%ct", &commit])?;
+        Ok(Self {
+            name: rev.to_string(),
+            time: String::from_utf8_lossy(&time).trim().parse().unwrap_or(0),
+            commit,
+            dir: dir.to_path_buf(),
+            blobs: None,
+        })
+    }
+
+    /// Regular files of the commit under the indexed directory; symlinks and
+    /// submodules are left out.
+    pub fn files(&self) -> Result<Vec<TreeFile>, CodeRagError> {
+        // Run in the indexed directory, ls-tree lists just its subtree
+        let output = git(&self.dir, &["ls-tree", "-r", "-z", "--long", &self.commit])?;
+        Ok(parse_ls_tree(&String::from_utf8_lossy(&output)))
+    }
+
+    /// Files under the indexed directory that differ between the commit and
+    /// the working tree, deleted and untracked ones included, relative to it
+    /// with `/` separators. A renamed file is listed under both names, so the
+    /// chunks of the old one are removed.
+    pub fn changed_files(&self) -> Result<Vec<String>, CodeRagError> {
+        let diff = git(
+            &self.dir,
+            &[
+                "diff",
+                "--name-only",
+                "--no-renames",
+                "-z",
+                "--relative",
+                &self.commit,
+                "--",
+            ],
+        )?;
+        let untracked = git(
+            &self.dir,
+            &["ls-files", "--others", "--exclude-standard", "-z"],
+        )?;
+        let mut files = Vec::new();
+        for output in [diff, untracked] {
+            let output = String::from_utf8_lossy(&output);
+            files.extend(
+                output
+                    .split('\0')
+                    .filter(|path| !path.is_empty())
+                    .map(str::to_string),
+            );
+        }
+        Ok(files)
+    }
+
+    /// Contents of `blob`, read through one long-running `git cat-file`.
+    pub fn read(&mut self, blob: &str) -> std::io::Result<Vec<u8>> {
+        if self.blobs.is_none() {
+            self.blobs = Some(BlobReader::spawn(&self.dir)?);
+        }
+        let blobs = self.blobs.as_mut().expect("started above");
+        let result = blobs.read(blob);
+        if result.is_err() {
+            // The stream may be out of step; the next read starts over
+            self.blobs = None;
+        }
+        result
+    }
+}
+
+/// Reads `git ls-tree -r -z --long` output: `<mode> <type> <blob> <size>\t<path>`
+/// entries separated by NUL.
+fn parse_ls_tree(output: &str) -> Vec<TreeFile> {
+    output
+        .split('\0')
+        .filter_map(|entry| {
+            let (meta, path) = entry.split_once('\t')?;
+            let mut fields = meta.split_whitespace();
+            let (mode, kind, blob, size) = (
+                fields.next()?,
+                fields.next()?,
+                fields.next()?,
+                fields.next()?,
+            );
+            // 120000 are symlinks, whose blob is the link target
+            if kind != "blob" || mode == "120000" {
+                return None;
+            }
+            Some(TreeFile {
+                path: path.to_string(),
+                blob: blob.to_string(),
+                size: size.parse().ok()?,
+            })
+        })
+        .collect()
+}
+
+/// A `git cat-file --batch` process answering blob requests one at a time.
+struct BlobReader {
+    child: Child,
+    stdin: Option<ChildStdin>,
+    stdout: BufReader<ChildStdout>,
+}
+
+impl BlobReader {
+    fn spawn(dir: &Path) -> std::io::Result<Self> {
+        let mut child = Command::new("git")
+            .args(["cat-file", "--batch"])
+            .current_dir(dir)
+            .stdin(Stdio::piped())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::null())
+            .spawn()?;
+        let stdin = child.stdin.take();
+        let stdout = child.stdout.take().map(BufReader::new);
+        match stdout {
+            Some(stdout) => Ok(Self {
+                child,
+                stdin,
+                stdout,
+            }),
+            None => Err(std::io::Error::other("git cat-file has no output")),
+        }
+    }
+
+    fn read(&mut self, blob: &str) -> std::io::Result<Vec<u8>> {
+        let stdin = self
+            .stdin
+            .as_mut()
+            .ok_or_else(|| std::io::Error::other("git cat-file was closed"))?;
+        writeln!(stdin, "{}", blob)?;
+        stdin.flush()?;
+
+        // `<blob> blob <size>`, or `<blob> missing`
+        let mut header = String::new();
+        self.stdout.read_line(&mut header)?;
+        let size: usize = match header.split_whitespace().collect::<Vec<_>>()[..] {
+            [_, "blob", size] => size.parse().map_err(std::io::Error::other)?,
+            _ => {
+                return Err(std::io::Error::new(
+                    std::io::ErrorKind::NotFound,
+                    format!("git cat-file: {}", header.trim()),
+                ))
+            }
+        };
+        // The contents are followed by a newline
+        let mut content = vec![0; size + 1];
+        self.stdout.read_exact(&mut content)?;
+        content.truncate(size);
+        Ok(content)
+    }
+}
+
+impl Drop for BlobReader {
+    fn drop(&mut self) {
+        // Closing its input ends the process
+        self.stdin.take();
+        let _ = self.child.wait();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+
+    #[test]
+    fn test_parse_ls_tree() {
+        let output = "100644 blob f2ad6c76f0115a6ba5b00456a849810e7ec0af20       2\tdeep/y.rs\0\
+            120000 blob 9234717be61c0aab89900d18be166b87cc0b3578       4\tlink.rs\0\
+            160000 commit 4c1e2f0a6b7d8e9f00112233445566778899aabb       -\tvendor/lib\0\
+            100755 blob 61780798228d17af2d34fce4cfbdf35556832472    1024\tname with spaces.sh\0";
+        assert_eq!(
+            parse_ls_tree(output),
+            vec![
+                TreeFile {
+                    path: "deep/y.rs".to_string(),
+                    blob: "f2ad6c76f0115a6ba5b00456a849810e7ec0af20".to_string(),
+                    size: 2,
+                },
+                TreeFile {
+                    path: "name with spaces.sh".to_string(),
+                    blob: "61780798228d17af2d34fce4cfbdf35556832472".to_string(),
+                    size: 1024,
+                },
+            ]
+        );
+    }
+
+    fn run_git(dir: &Path, args: &[&str]) {
+        let status = Command::new("git")
+            .args(["-c", "user.name=Test", "-c", "user.email=test@example.com"])
+            .args(args)
+            .current_dir(dir)
+            .stdout(Stdio::null())
+            .status()
+            .unwrap();
+        assert!(status.success(), "git {:?}", args);
+    }
+
+    #[test]
+    fn test_revision_files() {
+        if Command::new("git").arg("--version").output().is_err() {
+            return;
+        }
+        let repo = tempfile::tempdir().unwrap();
+        let root = repo.path();
+        fs::create_dir_all(root.join("src")).unwrap();
+        fs::write(root.join("src/auth.rs"), "fn login() {}\n").unwrap();
+        fs::write(root.join("src/legacy.rs"), "fn legacy() {}\n").unwrap();
+        fs::write(root.join("src/session.rs"), "fn open_session() {}\n").unwrap();
+        fs::write(root.join("README.md"), "# Old\n").unwrap();
+        run_git(root, &["init", "-q"]);
+        run_git(root, &["add", "-A"]);
+        run_git(root, &["commit", "-q", "-m", "First"]);
+        run_git(root, &["tag", "v1"]);
+        fs::write(root.join("src/auth.rs"), "fn login(token: &str) {}\n").unwrap();
+        run_git(root, &["commit", "-q", "-am", "Second"]);
+
+        let mut revision = Revision::open(&root.join("src"), "v1").unwrap();
+        assert_eq!(revision.name, "v1");
+        assert!(revision.time > 0);
+        let files = revision.files().unwrap();
+        let paths: Vec<&str> = files.iter().map(|f| f.path.as_str()).collect();
+        assert_eq!(paths, vec!["auth.rs", "legacy.rs", "session.rs"]);
+        assert_eq!(revision.read(&files[0].blob).unwrap(), b"fn login() {}\n");
+        // The reader stays usable after a bad request
+        assert!(revision
+            .read("0000000000000000000000000000000000000000")
+            .is_err());
+        assert_eq!(revision.read(&files[0].blob).unwrap(), b"fn login() {}\n");
+
+        // Against the working tree, with untracked files and only under src
+        fs::write(root.join("src/new.rs"), "fn new() {}\n").unwrap();
+        fs::write(root.join("README.md"), "# New\n").unwrap();
+        fs::remove_file(root.join("src/legacy.rs")).unwrap();
+        run_git(root, &["mv", "src/session.rs", "src/sessions.rs"]);
+        let mut changed = revision.changed_files().unwrap();
+        changed.sort();
+        // Deleted files, and renamed ones under their old name too
+        assert_eq!(
+            changed,
+            vec![
+                "auth.rs",
+                "legacy.rs",
+                "new.rs",
+                "session.rs",
+                "sessions.rs"
+            ]
+        );
+
+        let err = Revision::open(root, "v9").err().unwrap();
+        assert!(
+            err.to_string().contains("Unknown git revision 'v9'"),
+            "{}",
+            err
+        );
+        assert!(Revision::open(root, "--all").is_err());
+
+        let plain = tempfile::tempdir().unwrap();
+        let err = Revision::open(plain.path(), "v1").err().unwrap();
+        assert!(
+            err.to_string().contains("not in a git repository"),
+            "{}",
+            err
+        );
+    }
+}
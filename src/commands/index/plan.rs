@@ -0,0 +1,221 @@
+use serde::Serialize;
+use std::collections::BTreeMap;
+use std::fs;
+use std::path::Path;
+use tracing::warn;
+
+use super::scan_files;
+use super::walk::{PathRules, SkipReason, SkipReport};
+use crate::config::AppConfig;
+use crate::context::{default_counter, TokenCounter};
+use crate::core::{CancelToken, CodeRagError};
+use crate::indexer::{ChunkPart, CodeChunk, CodeChunker};
+use crate::redact::Redactor;
+
+/// A chunk an index run would embed.
+#[derive(Debug, Clone, Serialize)]
+pub struct PlannedChunk {
+    pub filename: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub symbol: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub part: Option<ChunkPart>,
+    pub line_start: usize,
+    pub line_end: usize,
+    /// Estimated tokens of the chunk text
+    pub tokens: usize,
+    #[serde(skip_serializing_if = "std::ops::Not::not")]
+    pub redacted: bool,
+}
+
+/// What `index --dry-run` found: the chunks a full run would embed and store.
+#[derive(Debug, Default, Serialize)]
+pub struct ChunkPlan {
+    pub path: String,
+    pub workspace: String,
+    /// Files that would be chunked
+    pub files: usize,
+    /// Sum of the chunk token estimates
+    pub total_tokens: usize,
+    /// Files left out, by reason
+    pub skipped: BTreeMap<String, usize>,
+    pub chunks: Vec<PlannedChunk>,
+}
+
+impl ChunkPlan {
+    /// Adds the chunks of one file, estimating their size with `counter`.
+    pub fn add_file(&mut self, chunks: &[CodeChunk], counter: &dyn TokenCounter) {
+        self.files += 1;
+        for chunk in chunks {
+            let tokens = counter.count(&chunk.code);
+            self.total_tokens += tokens;
+            self.chunks.push(PlannedChunk {
+                filename: chunk.filename.clone(),
+                symbol: chunk.symbol.clone(),
+                part: chunk.part,
+                line_start: chunk.line_start,
+                line_end: chunk.line_end,
+                tokens,
+                redacted: chunk.redacted,
+            });
+        }
+    }
+
+    pub fn largest(&self) -> Option<&PlannedChunk> {
+        self.chunks.iter().max_by_key(|c| c.tokens)
+    }
+}
+
+/// Walks and chunks `index_path` like an index run, without loading the
+/// embedder or opening the store.
+///
+/// Chunks are redacted as they would be before embedding; summaries are not
+/// generated since they may need LLM calls. Stops with
+/// [`CodeRagError::Cancelled`] once `cancel` is cancelled.
+pub fn plan_index(
+    index_path: &Path,
+    path_rules: &PathRules,
+    languages: &[String],
+    config: &AppConfig,
+    cancel: &CancelToken,
+) -> Result<ChunkPlan, CodeRagError> {
+    let chunker =
+        CodeChunker::from_config(config).map_err(|e| CodeRagError::Generic(format!("{:#}", e)))?;
+    let redactor =
+        Redactor::from_config(config).map_err(|e| CodeRagError::Generic(format!("{:#}", e)))?;
+    let counter = default_counter();
+
+    let mut skipped = SkipReport::default();
+    let candidates = scan_files(
+        index_path,
+        path_rules,
+        languages,
+        config,
+        None,
+        &mut skipped,
+        cancel,
+    )?;
+    let mut plan = ChunkPlan {
+        path: index_path.to_string_lossy().to_string(),
+        ..Default::default()
+    };
+    for candidate in candidates {
+        cancel.check()?;
+        let file = match fs::File::open(&candidate.path) {
+            Ok(file) => file,
+            Err(e) => {
+                warn!("Error reading file {}: {}", candidate.filename, e);
+                skipped.record(SkipReason::Unreadable);
+                continue;
+            }
+        };
+        let mut reader = std::io::BufReader::new(file);
+        match chunker.chunk_file(&candidate.filename, &mut reader, candidate.mtime) {
+            Ok(mut chunks) => {
+                if let Some(redactor) = &redactor {
+                    redactor.redact_chunks(&mut chunks);
+                }
+                plan.add_file(&chunks, counter.as_ref());
+            }
+            Err(e) => {
+                warn!("Error chunking file {}: {}", candidate.filename, e);
+                skipped.record(SkipReason::Unreadable);
+            }
+        }
+    }
+    plan.skipped = skipped.by_reason();
+    Ok(plan)
+}
+
+/// Prints one line per chunk followed by totals, or the plan as JSON.
+pub fn print_plan(plan: &ChunkPlan, json: bool) -> Result<(), CodeRagError> {
+    if json {
+        println!("{}", serde_json::to_string_pretty(plan)?);
+        return Ok(());
+    }
+
+    for chunk in &plan.chunks {
+        let symbol = match (&chunk.symbol, chunk.part) {
+            (Some(symbol), Some(part)) => format!("{} ({})", symbol, part),
+            (Some(symbol), None) => symbol.clone(),
+            (None, _) => "-".to_string(),
+        };
+        println!(
+            "{}:{}-{}  {}  ~{} tokens{}",
+            chunk.filename,
+            chunk.line_start,
+            chunk.line_end,
+            symbol,
+            chunk.tokens,
+            if chunk.redacted { "  (redacted)" } else { "" }
+        );
+    }
+    println!();
+    println!(
+        "Dry run: {} chunks from {} files in workspace '{}', ~{} tokens to embed.",
+        plan.chunks.len(),
+        plan.files,
+        plan.workspace,
+        plan.total_tokens
+    );
+    if let Some(largest) = plan.largest() {
+        println!(
+            "Largest chunk: {}:{}-{} (~{} tokens).",
+            largest.filename, largest.line_start, largest.line_end, largest.tokens
+        );
+    }
+    if !plan.skipped.is_empty() {
+        let reasons: Vec<String> = plan
+            .skipped
+            .iter()
+            .map(|(reason, count)| format!("{} {}", count, reason))
+            .collect();
+        println!(
+            "Skipped {} files: {}.",
+            plan.skipped.values().sum::<usize>(),
+            reasons.join(", ")
+        );
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::context::HeuristicCounter;
+
+    #[test]
+    fn test_plan_counts_chunks_and_tokens() {
+        let chunks = vec![
+            CodeChunk {
+                filename: "src/auth.go".to_string(),
+                code: "func Login() {}".to_string(),
+                line_start: 3,
+                line_end: 5,
+                symbol: Some("main.Login".to_string()),
+                ..Default::default()
+            },
+            CodeChunk {
+                filename: "src/auth.go".to_string(),
+                code: "x".repeat(400),
+                line_start: 7,
+                line_end: 40,
+                redacted: true,
+                ..Default::default()
+            },
+        ];
+        let mut plan = ChunkPlan::default();
+        plan.add_file(&chunks, &HeuristicCounter);
+
+        assert_eq!(plan.files, 1);
+        assert_eq!(plan.total_tokens, 4 + 100);
+        let largest = plan.largest().unwrap();
+        assert_eq!((largest.line_start, largest.tokens), (7, 100));
+
+        let json = serde_json::to_value(&plan).unwrap();
+        assert_eq!(json["chunks"][0]["symbol"], "main.Login");
+        assert!(json["chunks"][0].get("redacted").is_none());
+        assert!(json["chunks"][1].get("symbol").is_none());
+        assert_eq!(json["chunks"][1]["redacted"], true);
+    }
+}
@@ -0,0 +1,333 @@
+use indicatif::{HumanDuration, ProgressBar, ProgressStyle};
+use std::collections::VecDeque;
+use std::io::IsTerminal;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+use tracing::info;
+
+use crate::core::CodeRagError;
+
+/// Span of the rolling window that throughput and ETA are measured over.
+///
+/// Long enough to cover a few embedding batches, during which no file is
+/// processed, so the ETA doesn't jump with every batch.
+const RATE_WINDOW: Duration = Duration::from_secs(30);
+
+/// Time between two progress lines when stderr is not a terminal.
+const LOG_INTERVAL: Duration = Duration::from_secs(10);
+
+/// How indexing progress is reported.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ProgressMode {
+    /// A progress bar redrawn in place on stderr
+    Bar,
+    /// A log line every [`LOG_INTERVAL`], for CI and redirected output
+    Log,
+    /// Nothing (`--quiet`)
+    Off,
+}
+
+impl ProgressMode {
+    /// `Bar` when stderr is a terminal, `Log` when it isn't, `Off` if `quiet`.
+    pub fn detect(quiet: bool) -> Self {
+        if quiet {
+            ProgressMode::Off
+        } else if std::io::stderr().is_terminal() {
+            ProgressMode::Bar
+        } else {
+            ProgressMode::Log
+        }
+    }
+
+    /// Spinner for the steps before indexing starts (loading the model, ...),
+    /// hidden unless progress is drawn as a bar.
+    pub fn spinner(self) -> Result<ProgressBar, CodeRagError> {
+        if self != ProgressMode::Bar {
+            return Ok(ProgressBar::hidden());
+        }
+        let spinner = ProgressBar::new_spinner();
+        spinner.set_style(
+            ProgressStyle::default_spinner()
+                .template("{spinner:.blue} {msg}")
+                .map_err(|e| CodeRagError::Generic(e.to_string()))?,
+        );
+        spinner.enable_steady_tick(Duration::from_millis(120));
+        Ok(spinner)
+    }
+}
+
+/// `(time, files, embedded)` samples of the last [`RATE_WINDOW`].
+#[derive(Debug, Default)]
+struct RateWindow {
+    samples: VecDeque<(Instant, usize, usize)>,
+}
+
+impl RateWindow {
+    /// Records the counters at `at`, at most one sample per second.
+    fn record(&mut self, at: Instant, files: usize, embedded: usize) {
+        let recent = self
+            .samples
+            .back()
+            .is_some_and(|(last, _, _)| at.duration_since(*last) < Duration::from_secs(1));
+        if !recent {
+            self.samples.push_back((at, files, embedded));
+        }
+        while self
+            .samples
+            .front()
+            .is_some_and(|(first, _, _)| at.duration_since(*first) > RATE_WINDOW)
+        {
+            self.samples.pop_front();
+        }
+    }
+
+    /// Files and embeddings per second from the oldest sample to `at`;
+    /// `None` until the window spans a second.
+    fn rates(&self, at: Instant, files: usize, embedded: usize) -> Option<(f64, f64)> {
+        let &(since, first_files, first_embedded) = self.samples.front()?;
+        let secs = at.duration_since(since).as_secs_f64();
+        if secs < 1.0 {
+            return None;
+        }
+        Some((
+            files.saturating_sub(first_files) as f64 / secs,
+            embedded.saturating_sub(first_embedded) as f64 / secs,
+        ))
+    }
+}
+
+/// Counters and rates shown by one progress update.
+#[derive(Debug, Clone, PartialEq)]
+struct Snapshot {
+    files: usize,
+    total_files: usize,
+    chunks: usize,
+    embedded: usize,
+    /// `(files, embeddings)` per second over the rolling window
+    rates: Option<(f64, f64)>,
+}
+
+impl Snapshot {
+    /// Time left at the current file rate; `None` while that is unknown or zero.
+    fn eta(&self) -> Option<Duration> {
+        let (files_per_sec, _) = self.rates?;
+        if files_per_sec <= 0.0 {
+            return None;
+        }
+        let remaining = self.total_files.saturating_sub(self.files) as f64;
+        Some(Duration::from_secs_f64(remaining / files_per_sec))
+    }
+
+    /// Everything but the file count, which the bar shows itself.
+    fn counters(&self) -> String {
+        let mut text = format!("{} chunks, {} embedded", self.chunks, self.embedded);
+        if let Some((_, embedded_per_sec)) = self.rates {
+            text.push_str(&format!(", {:.1} chunks/s", embedded_per_sec));
+        }
+        if let Some(eta) = self.eta() {
+            text.push_str(&format!(", ETA {}", HumanDuration(eta)));
+        }
+        text
+    }
+}
+
+/// Progress of an indexing run: files processed, chunks produced and
+/// chunks embedded, with the embedding throughput and the time left.
+///
+/// Updates only touch atomic counters and the internally synchronized bar,
+/// so the embedding workers report to it directly from their threads.
+pub struct IndexProgress {
+    mode: ProgressMode,
+    bar: ProgressBar,
+    files: AtomicUsize,
+    total_files: AtomicUsize,
+    chunks: AtomicUsize,
+    embedded: AtomicUsize,
+    /// `embedded` when the current embedding batch started
+    batch_start: AtomicUsize,
+    /// What the run is doing right now, shown after the counters
+    stage: Mutex<String>,
+    window: Mutex<RateWindow>,
+    last_log: Mutex<Instant>,
+}
+
+impl IndexProgress {
+    pub fn new(mode: ProgressMode) -> Result<Self, CodeRagError> {
+        let bar = if mode == ProgressMode::Bar {
+            let bar = ProgressBar::new(0);
+            bar.set_style(
+                ProgressStyle::default_bar()
+                    .template(
+                        "{spinner:.green} [{elapsed_precise}] {bar:30.cyan/blue} {pos}/{len} files, {msg}",
+                    )
+                    .map_err(|e| CodeRagError::Generic(e.to_string()))?
+                    .progress_chars("=> "),
+            );
+            bar.enable_steady_tick(Duration::from_millis(120));
+            bar
+        } else {
+            ProgressBar::hidden()
+        };
+        Ok(Self {
+            mode,
+            bar,
+            files: AtomicUsize::new(0),
+            total_files: AtomicUsize::new(0),
+            chunks: AtomicUsize::new(0),
+            embedded: AtomicUsize::new(0),
+            batch_start: AtomicUsize::new(0),
+            stage: Mutex::new(String::new()),
+            window: Mutex::new(RateWindow::default()),
+            last_log: Mutex::new(Instant::now()),
+        })
+    }
+
+    /// Number of files the run will go through, known once they are scanned.
+    pub fn set_total_files(&self, total: usize) {
+        self.total_files.store(total, Ordering::Relaxed);
+        self.bar.set_length(total as u64);
+        self.refresh();
+    }
+
+    pub fn set_stage(&self, stage: impl Into<String>) {
+        if let Ok(mut current) = self.stage.lock() {
+            *current = stage.into();
+        }
+        self.refresh();
+    }
+
+    /// Counts the file `name` as processed.
+    pub fn file_started(&self, name: &str) {
+        self.files.fetch_add(1, Ordering::Relaxed);
+        self.set_stage(format!("Processing {}", name));
+    }
+
+    pub fn add_chunks(&self, chunks: usize) {
+        self.chunks.fetch_add(chunks, Ordering::Relaxed);
+    }
+
+    /// Counts chunks whose vector was reused instead of embedded.
+    pub fn add_embedded(&self, chunks: usize) {
+        self.embedded.fetch_add(chunks, Ordering::Relaxed);
+        self.refresh();
+    }
+
+    /// Starts an embedding batch of `chunks`, reported with [`Self::batch_embedded`].
+    pub fn start_batch(&self, chunks: usize) {
+        self.batch_start
+            .store(self.embedded.load(Ordering::Relaxed), Ordering::Relaxed);
+        self.set_stage(format!("Embedding {} chunks", chunks));
+    }
+
+    /// Progress callback of the embedding workers: `done` chunks of the
+    /// current batch are embedded. Workers may report out of order, so the
+    /// count never goes back.
+    pub fn batch_embedded(&self, done: usize) {
+        let embedded = self.batch_start.load(Ordering::Relaxed) + done;
+        self.embedded.fetch_max(embedded, Ordering::Relaxed);
+        self.refresh();
+    }
+
+    pub fn finish(&self, message: &'static str) {
+        self.bar.finish_with_message(message);
+    }
+
+    fn snapshot(&self) -> Snapshot {
+        let files = self.files.load(Ordering::Relaxed);
+        let embedded = self.embedded.load(Ordering::Relaxed);
+        let now = Instant::now();
+        let rates = self.window.lock().ok().and_then(|mut window| {
+            window.record(now, files, embedded);
+            window.rates(now, files, embedded)
+        });
+        Snapshot {
+            files,
+            total_files: self.total_files.load(Ordering::Relaxed),
+            chunks: self.chunks.load(Ordering::Relaxed),
+            embedded,
+            rates,
+        }
+    }
+
+    fn refresh(&self) {
+        let stage = self
+            .stage
+            .lock()
+            .map(|stage| stage.clone())
+            .unwrap_or_default();
+        match self.mode {
+            ProgressMode::Off => {}
+            ProgressMode::Bar => {
+                let snapshot = self.snapshot();
+                self.bar.set_position(snapshot.files as u64);
+                self.bar
+                    .set_message(format!("{} | {}", snapshot.counters(), stage));
+            }
+            ProgressMode::Log => {
+                // A worker that finds another one logging skips this update
+                let Ok(mut last_log) = self.last_log.try_lock() else {
+                    return;
+                };
+                if last_log.elapsed() < LOG_INTERVAL {
+                    return;
+                }
+                *last_log = Instant::now();
+                let snapshot = self.snapshot();
+                info!(
+                    "Progress: {}/{} files, {} ({})",
+                    snapshot.files,
+                    snapshot.total_files,
+                    snapshot.counters(),
+                    stage
+                );
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_rate_window() {
+        let start = Instant::now();
+        let at = |secs: u64| start + Duration::from_secs(secs);
+        let mut window = RateWindow::default();
+        window.record(at(0), 0, 0);
+        assert_eq!(window.rates(at(0), 0, 0), None);
+
+        window.record(at(10), 20, 100);
+        assert_eq!(window.rates(at(10), 20, 100), Some((2.0, 10.0)));
+
+        // Samples older than the window no longer count
+        window.record(at(40), 80, 400);
+        assert_eq!(window.samples.len(), 2);
+        assert_eq!(window.rates(at(40), 80, 400), Some((2.0, 10.0)));
+    }
+
+    #[test]
+    fn test_snapshot_counters_and_eta() {
+        let mut snapshot = Snapshot {
+            files: 10,
+            total_files: 100,
+            chunks: 50,
+            embedded: 40,
+            rates: None,
+        };
+        assert_eq!(snapshot.counters(), "50 chunks, 40 embedded");
+        assert_eq!(snapshot.eta(), None);
+
+        snapshot.rates = Some((3.0, 12.5));
+        assert_eq!(snapshot.eta(), Some(Duration::from_secs(30)));
+        assert_eq!(
+            snapshot.counters(),
+            "50 chunks, 40 embedded, 12.5 chunks/s, ETA 30 seconds"
+        );
+
+        // Nothing finished in the window: rate zero, no ETA
+        snapshot.rates = Some((0.0, 0.0));
+        assert_eq!(snapshot.eta(), None);
+    }
+}
@@ -0,0 +1,239 @@
+use std::collections::HashSet;
+use std::fmt;
+use std::path::Path;
+
+use time::format_description::well_known::Rfc3339;
+use time::{Date, Month, OffsetDateTime, PrimitiveDateTime, Time};
+
+use super::git::Revision;
+use crate::core::CodeRagError;
+
+/// Parses the argument of `index --since` into a Unix time: a duration back
+/// from now such as `90m`, `2h`, `1d12h` or `2w` (units `s`, `m`, `h`, `d`
+/// and `w`), a UTC date or time such as `2024-05-01` or
+/// `2024-05-01T12:00:00Z`, or Unix seconds.
+pub fn parse_since(text: &str) -> Result<i64, String> {
+    let text = text.trim();
+    if let Ok(seconds) = text.parse::<i64>() {
+        return Ok(seconds);
+    }
+    if let Some(seconds) = parse_duration(text) {
+        return Ok(OffsetDateTime::now_utc().unix_timestamp() - seconds);
+    }
+    parse_timestamp(text).ok_or_else(|| {
+        format!(
+            "Invalid --since '{}' (use a duration such as 2h or 7d, a date such as 2024-05-01, \
+            or a time such as 2024-05-01T12:00:00Z)",
+            text
+        )
+    })
+}
+
+/// Seconds in `1d12h` and the like.
+fn parse_duration(text: &str) -> Option<i64> {
+    if text.is_empty() {
+        return None;
+    }
+    let mut total: i64 = 0;
+    let mut rest = text;
+    while !rest.is_empty() {
+        let digits = rest
+            .find(|c: char| !c.is_ascii_digit())
+            .unwrap_or(rest.len());
+        let number: i64 = rest[..digits].parse().ok()?;
+        let unit = rest[digits..].chars().next()?;
+        let seconds = match unit {
+            's' => 1,
+            'm' => 60,
+            'h' => 60 * 60,
+            'd' => 24 * 60 * 60,
+            'w' => 7 * 24 * 60 * 60,
+            _ => return None,
+        };
+        total = total.checked_add(number.checked_mul(seconds)?)?;
+        rest = &rest[digits + unit.len_utf8()..];
+    }
+    Some(total)
+}
+
+/// Unix time of `YYYY-MM-DD`, optionally followed by `T` or a space, then
+/// `HH:MM` or `HH:MM:SS` and an optional `Z`, read as UTC.
+fn parse_timestamp(text: &str) -> Option<i64> {
+    let (date, time) = match text.split_once(['T', ' ']) {
+        Some((date, time)) => (date, Some(time.strip_suffix('Z').unwrap_or(time))),
+        None => (text, None),
+    };
+    let mut fields = date.splitn(3, '-').map(str::parse::<i32>);
+    let (year, month, day) = (
+        fields.next()?.ok()?,
+        fields.next()?.ok()?,
+        fields.next()?.ok()?,
+    );
+    let date = Date::from_calendar_date(
+        year,
+        Month::try_from(u8::try_from(month).ok()?).ok()?,
+        u8::try_from(day).ok()?,
+    )
+    .ok()?;
+    let time = match time {
+        Some(time) => {
+            let fields: Vec<u8> = time
+                .split(':')
+                .map(|f| f.parse().ok())
+                .collect::<Option<_>>()?;
+            match fields[..] {
+                [hour, minute] => Time::from_hms(hour, minute, 0).ok()?,
+                [hour, minute, second] => Time::from_hms(hour, minute, second).ok()?,
+                _ => return None,
+            }
+        }
+        None => Time::MIDNIGHT,
+    };
+    Some(
+        PrimitiveDateTime::new(date, time)
+            .assume_utc()
+            .unix_timestamp(),
+    )
+}
+
+/// The files a run with `--since` or `--since-ref` looks at: those modified
+/// since a time, and those git reports changed since a ref. The index keeps
+/// every other file as it is.
+pub(super) struct ChangeWindow {
+    /// Files modified at or after this Unix time are in the window
+    modified_since: Option<i64>,
+    since_ref: Option<String>,
+    /// Files in the window whatever their modification time, as indexed;
+    /// those deleted since the ref are among them
+    files: HashSet<String>,
+}
+
+impl ChangeWindow {
+    /// The window of `--since` and `--since-ref`, if either is given, asking
+    /// git for the files under `index_path` changed since the ref.
+    pub fn new(
+        since: Option<i64>,
+        since_ref: Option<&str>,
+        index_path: &Path,
+    ) -> Result<Option<Self>, CodeRagError> {
+        if since.is_none() && since_ref.is_none() {
+            return Ok(None);
+        }
+        let mut files = HashSet::new();
+        if let Some(rev) = since_ref {
+            let base = Revision::open(index_path, rev)?;
+            files.extend(
+                base.changed_files()?
+                    .iter()
+                    .map(|path| native_path(index_path, path)),
+            );
+        }
+        Ok(Some(Self {
+            modified_since: since,
+            since_ref: since_ref.map(str::to_string),
+            files,
+        }))
+    }
+
+    /// Takes `files` into the window whatever their modification time.
+    pub fn add(&mut self, files: impl IntoIterator<Item = String>) {
+        self.files.extend(files);
+    }
+
+    /// Whether the file is in the window.
+    pub fn contains(&self, filename: &str, mtime: i64) -> bool {
+        self.lists(filename) || self.modified_since.is_some_and(|since| mtime >= since)
+    }
+
+    /// Whether the file is in the window even if it no longer exists.
+    pub fn lists(&self, filename: &str) -> bool {
+        self.files.contains(filename)
+    }
+}
+
+/// `path`, relative to `index_path` with git's `/` separators, named like
+/// the walker names files: with the platform's separators.
+fn native_path(index_path: &Path, path: &str) -> String {
+    path.split('/')
+        .fold(index_path.to_path_buf(), |dir, part| dir.join(part))
+        .to_string_lossy()
+        .to_string()
+}
+
+impl fmt::Display for ChangeWindow {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        let mut parts = Vec::new();
+        if let Some(since) = self.modified_since {
+            let time = OffsetDateTime::from_unix_timestamp(since)
+                .ok()
+                .and_then(|t| t.format(&Rfc3339).ok())
+                .unwrap_or_else(|| since.to_string());
+            parts.push(format!("modified since {}", time));
+        }
+        if let Some(rev) = &self.since_ref {
+            parts.push(format!("changed since {}", rev));
+        }
+        write!(f, "{}", parts.join(" or "))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_since() {
+        let now = OffsetDateTime::now_utc().unix_timestamp();
+        let two_hours = parse_since("2h").unwrap();
+        assert!((now - 2 * 3600 - two_hours).abs() <= 2);
+        let mixed = parse_since("1d12h").unwrap();
+        assert!((now - 36 * 3600 - mixed).abs() <= 2);
+
+        assert_eq!(parse_since("1714521600").unwrap(), 1_714_521_600);
+        assert_eq!(parse_since("2024-05-01").unwrap(), 1_714_521_600);
+        assert_eq!(
+            parse_since("2024-05-01T12:30:00Z").unwrap(),
+            1_714_521_600 + 12 * 3600 + 30 * 60
+        );
+        assert_eq!(
+            parse_since("2024-05-01 12:30").unwrap(),
+            1_714_521_600 + 12 * 3600 + 30 * 60
+        );
+
+        for bad in ["", "2x", "h", "2024-13-01", "2024-05-01T25:00", "yesterday"] {
+            assert!(parse_since(bad).is_err(), "{}", bad);
+        }
+    }
+
+    #[test]
+    fn test_window() {
+        let mut window = ChangeWindow {
+            modified_since: Some(100),
+            since_ref: None,
+            files: HashSet::new(),
+        };
+        assert!(window.contains("./a.go", 100));
+        assert!(!window.contains("./a.go", 99));
+        window.add(["./a.go".to_string()]);
+        assert!(window.contains("./a.go", 99));
+        assert!(window.lists("./a.go"));
+        assert!(!window.lists("./b.go"));
+        assert_eq!(window.to_string(), "modified since 1970-01-01T00:01:40Z");
+    }
+
+    #[test]
+    fn test_native_path() {
+        let root = Path::new(".");
+        assert_eq!(
+            native_path(root, "src/auth/login.rs"),
+            root.join("src")
+                .join("auth")
+                .join("login.rs")
+                .to_string_lossy()
+        );
+        assert_eq!(
+            native_path(root, "main.rs"),
+            root.join("main.rs").to_string_lossy()
+        );
+    }
+}
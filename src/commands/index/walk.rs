@@ -0,0 +1,242 @@
+use crate::search::CandidateFilter;
+use anyhow::Result;
+use ignore::{Walk, WalkBuilder};
+use std::collections::BTreeMap;
+use std::path::Path;
+use std::sync::{Arc, Mutex};
+
+/// Ignore file with `.gitignore` syntax for exclusions that only apply to indexing.
+pub const RAGIGNORE_FILE: &str = ".ragignore";
+
+/// Why a file found under the index root was not indexed.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+pub enum SkipReason {
+    /// Matched `--exclude` or the `exclusions` config key
+    Excluded,
+    /// Didn't match any `--include` glob
+    NotIncluded,
+    /// Symlink whose target lies outside the index root
+    OutsideRoot,
+    /// No chunker for the file extension
+    Unsupported,
+    /// Filtered out by `--languages`
+    Language,
+    /// Larger than `max_file_size_bytes` (or `--max-file-size`)
+    TooLarge,
+    /// Binary content, see [`NonText::Binary`](crate::indexer::NonText::Binary)
+    Binary,
+    /// Text that isn't UTF-8
+    NotUtf8,
+    /// Could not be read or hashed
+    Unreadable,
+}
+
+impl SkipReason {
+    fn label(self) -> &'static str {
+        match self {
+            SkipReason::Excluded => "excluded",
+            SkipReason::NotIncluded => "not included",
+            SkipReason::OutsideRoot => "symlink outside root",
+            SkipReason::Unsupported => "unsupported file type",
+            SkipReason::Language => "language filtered",
+            SkipReason::TooLarge => "too large",
+            SkipReason::Binary => "binary",
+            SkipReason::NotUtf8 => "not UTF-8",
+            SkipReason::Unreadable => "unreadable",
+        }
+    }
+}
+
+/// Number of skipped files per reason.
+#[derive(Debug, Default)]
+pub struct SkipReport {
+    counts: BTreeMap<SkipReason, usize>,
+}
+
+impl SkipReport {
+    pub fn record(&mut self, reason: SkipReason) {
+        *self.counts.entry(reason).or_default() += 1;
+    }
+
+    pub fn merge(&mut self, other: &SkipReport) {
+        for (reason, count) in &other.counts {
+            *self.counts.entry(*reason).or_default() += count;
+        }
+    }
+
+    pub fn count(&self, reason: SkipReason) -> usize {
+        self.counts.get(&reason).copied().unwrap_or(0)
+    }
+
+    pub fn total(&self) -> usize {
+        self.counts.values().sum()
+    }
+
+    /// Count per reason label, e.g. `too large`.
+    pub fn by_reason(&self) -> BTreeMap<String, usize> {
+        self.counts
+            .iter()
+            .map(|(reason, count)| (reason.label().to_string(), *count))
+            .collect()
+    }
+
+    /// Breakdown by reason, e.g. `10 unsupported file type, 2 too large`.
+    pub fn summary(&self) -> String {
+        let reasons: Vec<String> = self
+            .counts
+            .iter()
+            .map(|(reason, count)| format!("{} {}", count, reason.label()))
+            .collect();
+        reasons.join(", ")
+    }
+}
+
+/// `--include`/`--exclude` globs, matched like search path globs (`**` recurses).
+pub struct PathRules {
+    include: Option<CandidateFilter>,
+    exclude: Option<CandidateFilter>,
+}
+
+impl PathRules {
+    pub fn new(include: Vec<String>, exclude: Vec<String>) -> Result<Self> {
+        let filter = |globs: Vec<String>| -> Result<Option<CandidateFilter>> {
+            if globs.is_empty() {
+                Ok(None)
+            } else {
+                CandidateFilter::new(None, None, globs, Vec::new()).map(Some)
+            }
+        };
+        Ok(Self {
+            include: filter(include)?,
+            exclude: filter(exclude)?,
+        })
+    }
+
+    /// Returns why `filename` is ruled out, if it is. Excludes win over includes.
+    pub fn check(&self, filename: &str) -> Option<SkipReason> {
+        if self
+            .exclude
+            .as_ref()
+            .is_some_and(|f| f.matches(filename, None))
+        {
+            return Some(SkipReason::Excluded);
+        }
+        if self
+            .include
+            .as_ref()
+            .is_some_and(|f| !f.matches(filename, None))
+        {
+            return Some(SkipReason::NotIncluded);
+        }
+        None
+    }
+}
+
+/// Walks `root` honoring `.gitignore` (including nested ones, with or without a
+/// git repository), `.ignore` and [`RAGIGNORE_FILE`].
+///
+/// Symlinks are not followed: one resolving inside `root` would index its
+/// target a second time, so it is pruned silently, and one pointing outside
+/// `root` is pruned and counted in `skipped`.
+pub fn walk(root: &Path, skipped: Arc<Mutex<SkipReport>>) -> Result<Walk> {
+    let canonical_root = root.canonicalize()?;
+    let mut builder = WalkBuilder::new(root);
+    builder
+        .require_git(false)
+        .add_custom_ignore_filename(RAGIGNORE_FILE)
+        .filter_entry(move |entry| {
+            if !entry.path_is_symlink() {
+                return true;
+            }
+            let reason = match entry.path().canonicalize() {
+                // The walk reaches the target itself
+                Ok(target) if target.starts_with(&canonical_root) => return false,
+                Ok(_) => SkipReason::OutsideRoot,
+                Err(_) => SkipReason::Unreadable,
+            };
+            if let Ok(mut skipped) = skipped.lock() {
+                skipped.record(reason);
+            }
+            false
+        });
+    Ok(builder.build())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+    use tempfile::TempDir;
+
+    fn walked_files(root: &Path, skipped: Arc<Mutex<SkipReport>>) -> Vec<String> {
+        let mut files: Vec<String> = walk(root, skipped)
+            .unwrap()
+            .filter_map(|e| e.ok())
+            .filter(|e| e.file_type().is_some_and(|ft| ft.is_file()))
+            .map(|e| {
+                e.path()
+                    .strip_prefix(root)
+                    .unwrap()
+                    .to_string_lossy()
+                    .replace('\\', "/")
+            })
+            .collect();
+        files.sort();
+        files
+    }
+
+    #[test]
+    fn test_walk_honors_nested_gitignore_and_ragignore() {
+        let dir = TempDir::new().unwrap();
+        let root = dir.path();
+        fs::create_dir_all(root.join("vendor/lib")).unwrap();
+        fs::create_dir_all(root.join("src/gen")).unwrap();
+        fs::write(root.join(".gitignore"), "vendor/\n").unwrap();
+        fs::write(root.join("src/.gitignore"), "gen/\n").unwrap();
+        fs::write(root.join(".ragignore"), "*_fixture.rs\n").unwrap();
+        fs::write(root.join("vendor/lib/dep.rs"), "fn dep() {}").unwrap();
+        fs::write(root.join("src/gen/out.rs"), "fn out() {}").unwrap();
+        fs::write(root.join("src/main.rs"), "fn main() {}").unwrap();
+        fs::write(root.join("src/big_fixture.rs"), "fn f() {}").unwrap();
+
+        let skipped = Arc::new(Mutex::new(SkipReport::default()));
+        assert_eq!(walked_files(root, skipped.clone()), vec!["src/main.rs"]);
+        assert_eq!(skipped.lock().unwrap().total(), 0);
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_walk_skips_symlinks() {
+        let outside = TempDir::new().unwrap();
+        fs::write(outside.path().join("secret.rs"), "fn secret() {}").unwrap();
+
+        let dir = TempDir::new().unwrap();
+        let root = dir.path();
+        fs::create_dir(root.join("src")).unwrap();
+        fs::write(root.join("src/lib.rs"), "fn lib() {}").unwrap();
+        std::os::unix::fs::symlink(outside.path(), root.join("escape")).unwrap();
+        std::os::unix::fs::symlink(root.join("src/lib.rs"), root.join("alias.rs")).unwrap();
+        std::os::unix::fs::symlink(root.join("src"), root.join("source")).unwrap();
+
+        // Links within the root would index src/lib.rs three times
+        let skipped = Arc::new(Mutex::new(SkipReport::default()));
+        assert_eq!(walked_files(root, skipped.clone()), vec!["src/lib.rs"]);
+        assert_eq!(skipped.lock().unwrap().summary(), "1 symlink outside root");
+    }
+
+    #[test]
+    fn test_path_rules() {
+        let rules =
+            PathRules::new(vec!["src/**".to_string()], vec!["**/*_test.go".to_string()]).unwrap();
+        assert_eq!(rules.check("./repo/src/main.go"), None);
+        assert_eq!(
+            rules.check("./repo/src/main_test.go"),
+            Some(SkipReason::Excluded)
+        );
+        assert_eq!(
+            rules.check("./repo/docs/guide.go"),
+            Some(SkipReason::NotIncluded)
+        );
+        assert!(PathRules::new(vec!["[".to_string()], Vec::new()).is_err());
+    }
+}
@@ -1,6 +1,12 @@
+pub mod config;
+pub mod delete;
+pub mod export;
+pub mod import;
 pub mod index;
 pub mod mcp;
 pub mod search;
 pub mod serve;
 pub mod start;
+pub mod stats;
+pub mod verify;
 pub mod watch;
@@ -3,15 +3,41 @@ use std::fs;
 use tracing::{error, warn};
 
 use crate::bm25::BM25Index;
+use crate::callgraph::CallGraph;
+use crate::commands::stats::require_index;
 use crate::config::AppConfig;
-use crate::core::CodeRagError;
+use crate::core::{CancelToken, CodeRagError};
 use crate::embedding::Embedder;
+use crate::highlight::highlight;
+use crate::indexer::DocType;
 use crate::llm::client::OllamaClient;
 use crate::llm::expander::QueryExpander;
+use crate::manifest::{ensure_compatible_embedder, is_in_progress};
+use crate::redact::Redactor;
 use crate::reporting::generate_html_report;
-use crate::search::CodeSearcher;
-use crate::storage::Storage;
+use crate::rerank::{create_reranker, OnnxRerankerOptions};
+use crate::search::{
+    attach_source_context, retain_min_score, CandidateFilter, CodeSearcher, QueryCache,
+    ScoreExplanation, SearchResult, TestFilter,
+};
+use crate::storage::{open_configured_store, store_exists};
 use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+mod batch;
+mod eval;
+mod json;
+mod multi;
+mod repl;
+mod similar;
+pub use batch::{run_batch, BatchOptions, JsonBatchEntry, DEFAULT_BATCH_CONCURRENCY};
+pub use eval::{run_eval, EvalOptions, JsonEvalHit, JsonEvalQuery, JsonEvalReport};
+pub use json::{
+    JsonError, JsonErrorOutput, JsonSearchOutput, JsonSearchResult, JsonTiming, JSON_SCHEMA_VERSION,
+};
+pub use multi::{resolve_indexes, IndexTarget};
+pub use repl::{run_repl, ReplOptions};
+pub use similar::{find_similar, SimilarOptions};
 
 pub struct SearchOptions {
     pub limit: Option<usize>,
@@ -20,11 +46,71 @@ pub struct SearchOptions {
     pub json: bool,
     pub ext: Option<String>,
     pub dir: Option<String>,
+    pub path_globs: Vec<String>,
+    pub languages: Vec<String>,
+    /// Only Go declarations in these packages
+    pub packages: Vec<String>,
+    /// Only chunks of these doc types; empty means code and docs
+    pub doc_types: Vec<DocType>,
+    /// Leave out test code, or keep nothing else
+    pub tests: TestFilter,
+    /// Only chunks indexed into these collections; empty means all
+    pub collections: Vec<String>,
+    /// Only chunks carrying one of these user tags; empty means all
+    pub tags: Vec<String>,
+    /// Weights raising, or lowering, the chunks carrying these user tags
+    pub tag_boosts: Vec<(String, f32)>,
     pub no_rerank: bool,
     pub workspace: Option<String>,
 
     pub max_tokens: Option<usize>,
     pub expand: bool,
+    pub expand_graph: usize,
+    pub hybrid_alpha: Option<f32>,
+    pub mmr_lambda: Option<f32>,
+    /// At most this many results of any one file, see [`cap_per_file`](crate::search::cap_per_file)
+    pub max_per_file: Option<usize>,
+    /// Whole declarations for parts of split ones, see
+    /// [`CodeSearcher::expand_to_symbols`](crate::search::CodeSearcher::expand_to_symbols)
+    pub expand_to_symbol: bool,
+    /// Drops results below this cosine similarity; `None` uses `min_score` from the config
+    pub min_score: Option<f32>,
+    /// Weights results by recency, see [`crate::search::apply_recency`]; `None` uses
+    /// `recency_half_life_days` from the config
+    pub recency_half_life: Option<Duration>,
+    /// Lines of the file on disk shown before and after each result
+    pub context_lines: usize,
+    /// Indexes to search and merge instead of `db_path`, see [`resolve_indexes`]
+    pub indexes: Vec<String>,
+    /// The query is a code snippet, see [`CodeSearcher::code_search`]
+    pub code: bool,
+    /// Show what each result's score is made of, see [`ScoreExplanation`]
+    pub explain: bool,
+    /// Stops the search, see [`CodeSearcher::with_cancel`]
+    pub cancel: CancelToken,
+}
+
+/// The snippet of a `--code` search: `query`, or standard input if it is
+/// `-`. Secrets are redacted as in indexed chunks, so a snippet with a key
+/// still matches the chunk it was copied from.
+fn read_code_query(query: String, config: &AppConfig) -> Result<String, CodeRagError> {
+    let code = if query == "-" {
+        std::io::read_to_string(std::io::stdin()).map_err(CodeRagError::Io)?
+    } else {
+        query
+    };
+    let redactor =
+        Redactor::from_config(config).map_err(|e| CodeRagError::Generic(format!("{:#}", e)))?;
+    Ok(redactor.and_then(|r| r.redact(&code)).unwrap_or(code))
+}
+
+/// How a search is announced in text output; snippets can span many lines.
+fn describe_query(query: &str, code: bool) -> String {
+    if code {
+        format!("code like the {}-line snippet", query.lines().count())
+    } else {
+        format!("'{}'", query)
+    }
 }
 
 pub async fn search_codebase(
@@ -32,6 +118,15 @@ pub async fn search_codebase(
     options: SearchOptions,
     config: &AppConfig,
 ) -> Result<(), CodeRagError> {
+    let query = if options.code {
+        read_code_query(query, config)?
+    } else {
+        query
+    };
+    if !options.indexes.is_empty() {
+        return multi::search_indexes(query, options, config).await;
+    }
+
     let SearchOptions {
         limit,
         db_path,
@@ -39,13 +134,34 @@ pub async fn search_codebase(
         json,
         ext,
         dir,
+        path_globs,
+        languages,
+        packages,
+        doc_types,
+        tests,
+        collections,
+        tags,
+        tag_boosts,
         no_rerank,
         workspace,
 
         max_tokens,
         expand,
+        expand_graph,
+        hybrid_alpha,
+        mmr_lambda,
+        max_per_file,
+        expand_to_symbol,
+        min_score,
+        recency_half_life,
+        context_lines,
+        indexes: _,
+        code,
+        explain,
+        cancel,
     } = options;
 
+    let started = Instant::now();
     let actual_limit = limit.unwrap_or(config.default_limit);
     let base_db = db_path.unwrap_or_else(|| config.db_path.clone());
     let workspace_name = workspace.clone().unwrap_or_else(|| "default".to_string());
@@ -62,18 +178,21 @@ pub async fn search_codebase(
         )
     };
 
-    // Check if workspace exists before attempting to open
+    // Point at the indexed workspaces when asked for another one
     let workspace_path = std::path::Path::new(&actual_db);
-    if !workspace_path.exists() {
+    if workspace_name != "default" && !workspace_path.exists() {
         // Scan for available workspaces
         let mut available: Vec<String> = Vec::new();
         if let Ok(entries) = std::fs::read_dir(&base_db) {
             for entry in entries.flatten() {
                 if entry.path().is_dir() {
                     if let Some(name) = entry.file_name().to_str() {
-                        // Only list directories that contain code_chunks.lance
-                        let table_path = entry.path().join("code_chunks.lance");
-                        if table_path.exists() {
+                        // Only list directories that contain a chunk table
+                        if store_exists(
+                            &config.storage_backend,
+                            &entry.path().to_string_lossy(),
+                            "code_chunks",
+                        ) {
                             available.push(name.to_string());
                         }
                     }
@@ -82,8 +201,9 @@ pub async fn search_codebase(
         }
 
         // Also check if default workspace exists
-        let default_table = std::path::Path::new(&base_db).join("code_chunks.lance");
-        if default_table.exists() && !available.contains(&"default".to_string()) {
+        if store_exists(&config.storage_backend, &base_db, "code_chunks")
+            && !available.contains(&"default".to_string())
+        {
             available.insert(0, "default".to_string());
         }
 
@@ -104,35 +224,28 @@ pub async fn search_codebase(
             )
         };
 
-        return Err(CodeRagError::Database(error_msg));
+        return Err(CodeRagError::IndexNotFound(error_msg));
     }
+    require_index(config, &actual_db, &workspace_name).await?;
 
-    let storage = Storage::new(&actual_db, &table_name)
+    let storage = open_configured_store(config, &actual_db, &table_name)
         .await
-        .map_err(|e| CodeRagError::Database(e.to_string()))?;
+        .map_err(|e| CodeRagError::from_anyhow(e, CodeRagError::Database))?;
 
     // Silence embedder logs if outputting JSON
-    let embedder = if json {
-        Embedder::new_with_quiet(
-            true,
-            config.embedding_model.clone(),
-            config.reranker_model.clone(),
-            config.embedding_model_path.clone(),
-            config.reranker_model_path.clone(),
-            config.device.clone(),
-        )?
-    } else {
-        Embedder::new(
-            config.embedding_model.clone(),
-            config.reranker_model.clone(),
-            config.embedding_model_path.clone(),
-            config.reranker_model_path.clone(),
-            config.device.clone(),
-        )?
-    };
+    let embedder = Embedder::from_config(config, json)?;
+    ensure_compatible_embedder(&actual_db, embedder.model_name(), embedder.dim())?;
+    if is_in_progress(&actual_db) {
+        warn!(
+            "Index at {} is being written or a previous indexing run was interrupted; results may be incomplete.",
+            actual_db
+        );
+    }
 
     // Initialize BM25 Index (Optional)
-    let bm25_index = BM25Index::new(&actual_db, true, "log").ok();
+    let bm25_index = BM25Index::new(&actual_db, true, "log")
+        .ok()
+        .map(|index| index.with_doc_boost(config.bm25_doc_boost));
     if bm25_index.is_none() {
         warn!("BM25 index could not be opened. Falling back to pure vector search.");
         warn!("BM25 index could not be opened. Falling back to pure vector search.");
@@ -146,39 +259,132 @@ pub async fn search_codebase(
         None
     };
 
+    let embedder = Arc::new(embedder);
+    let reranker = create_reranker(
+        &config.reranker,
+        Some(embedder.clone()),
+        &config.llm_host,
+        &config.llm_model,
+        &OnnxRerankerOptions::from_config(config),
+    )
+    .map_err(|e| CodeRagError::from_anyhow(e, CodeRagError::Search))?;
+
+    let query_cache = load_query_cache(&actual_db, config);
     let searcher = CodeSearcher::new(
-        Some(Arc::new(storage)),
-        Some(Arc::new(embedder)),
+        Some(storage),
+        Some(embedder),
         bm25_index.map(Arc::new),
         expander,
         config.vector_weight,
         config.bm25_weight,
         config.rrf_k as f64,
-    );
+    )
+    .with_reranker(reranker)
+    .with_rerank_top_k(config.rerank_top_k)
+    .with_symbol_weight(config.symbol_weight)
+    .with_tag_boosts(tag_boosts)
+    .with_explain(explain)
+    .with_call_graph(load_call_graph(&actual_db))
+    .with_query_cache(query_cache.clone())
+    .with_cancel(cancel);
 
     if !json {
-        println!("Searching for: '{}'", query);
+        println!("Searching for: {}", describe_query(&query, code));
     }
 
-    let search_results = searcher
-        .semantic_search(
-            &query,
-            actual_limit,
-            ext,
-            dir,
-            no_rerank,
-            workspace,
-            max_tokens,
-            expand,
+    let filter = CandidateFilter::new(ext, dir, path_globs, languages)
+        .map_err(|e| CodeRagError::from_anyhow(e, CodeRagError::Search))?
+        .with_packages(packages)
+        .with_doc_types(doc_types)
+        .with_tests(tests)
+        .with_collections(collections)
+        .with_tags(tags);
+    let recency_half_life = recency_half_life.or_else(|| config.recency_half_life());
+    let search_started = Instant::now();
+    let search_results = if code {
+        searcher
+            .code_search(
+                &query,
+                actual_limit,
+                &filter,
+                workspace.clone(),
+                max_tokens,
+                hybrid_alpha,
+                mmr_lambda,
+                max_per_file,
+                recency_half_life,
+                expand_to_symbol,
+            )
+            .await
+    } else {
+        searcher
+            .filtered_search(
+                &query,
+                actual_limit,
+                &filter,
+                no_rerank,
+                workspace.clone(),
+                max_tokens,
+                expand,
+                hybrid_alpha,
+                mmr_lambda,
+                max_per_file,
+                recency_half_life,
+                expand_to_symbol,
+            )
+            .await
+    };
+    let mut search_results =
+        search_results.map_err(|e| CodeRagError::from_anyhow(e, CodeRagError::Search))?;
+    save_query_cache(query_cache.as_deref());
+    retain_min_score(&mut search_results, min_score.or(config.min_score));
+    let mut search_results = searcher
+        .expand_with_call_graph(
+            search_results,
+            expand_graph,
+            MAX_GRAPH_CHUNKS,
+            &filter,
+            workspace.as_deref(),
         )
         .await
-        .map_err(|e| CodeRagError::Search(e.to_string()))?;
+        .map_err(|e| CodeRagError::from_anyhow(e, CodeRagError::Search))?;
+    attach_source_context(&mut search_results, context_lines);
 
+    print_results(
+        &query,
+        workspace_name,
+        search_results,
+        (json, html),
+        started,
+        search_started,
+    )
+}
+
+/// Prints results as JSON (`json`), an HTML report (`html`) or plain text.
+fn print_results(
+    query: &str,
+    workspace: String,
+    search_results: Vec<SearchResult>,
+    (json, html): (bool, bool),
+    started: Instant,
+    search_started: Instant,
+) -> Result<(), CodeRagError> {
     if json {
-        println!("{}", serde_json::to_string_pretty(&search_results)?);
+        let output = JsonSearchOutput {
+            schema_version: JSON_SCHEMA_VERSION,
+            query: query.to_string(),
+            workspace,
+            results: search_results.into_iter().map(Into::into).collect(),
+            timing: JsonTiming {
+                load_ms: (search_started - started).as_millis() as u64,
+                search_ms: search_started.elapsed().as_millis() as u64,
+                total_ms: started.elapsed().as_millis() as u64,
+            },
+        };
+        println!("{}", serde_json::to_string_pretty(&output)?);
     } else if html {
-        let report = generate_html_report(&query, &search_results)
-            .map_err(|e| CodeRagError::Search(e.to_string()))?;
+        let report = generate_html_report(query, &search_results)
+            .map_err(|e| CodeRagError::from_anyhow(e, CodeRagError::Search))?;
         let report_path = "results.html";
         fs::write(report_path, report).map_err(CodeRagError::Io)?;
         println!(
@@ -188,21 +394,75 @@ pub async fn search_codebase(
         );
     } else {
         for res in search_results {
-            println!(
-                "\n{} {} (Score: {:.4})",
+            // One header line: rank, location, symbol and score
+            let mut header = format!(
+                "{} {}  {}{}",
                 "Rank".bold(),
-                res.rank.to_string().cyan(),
-                res.score
+                res.rank.to_string().cyan().bold(),
+                res.filename.yellow().bold(),
+                format!(":{}-{}", res.line_start, res.line_end).yellow()
             );
-            println!(
-                "{} {}:{}-{}",
-                "File:".bold(),
-                res.filename.yellow(),
-                res.line_start,
-                res.line_end
+            if let Some(symbol) = &res.symbol {
+                header.push_str(&format!("  {}", symbol.cyan()));
+                if let Some(part) = res.part {
+                    header.push_str(&format!(" ({})", part));
+                }
+            }
+            header.push_str(&format!(
+                "  {}",
+                format!("Score: {:.4}", res.score).dimmed()
+            ));
+            println!("\n{}", header);
+            if let Some(source) = &res.source {
+                println!("{} {}", "Index:".bold(), source.cyan());
+            }
+            if let Some(from) = &res.expanded_from {
+                println!("{} {}", "Related to:".bold(), from.cyan());
+            }
+            if !res.tags.is_empty() {
+                println!("{} {}", "Tags:".bold(), res.tags.join(", ").cyan());
+            }
+            if !res.duplicates.is_empty() {
+                let locations: Vec<String> =
+                    res.duplicates.iter().map(ToString::to_string).collect();
+                println!("{} {}", "Also in:".bold(), locations.join(", ").yellow());
+            }
+            if let Some(explanation) = &res.explanation {
+                print_explanation(&res, explanation);
+            } else if let Some(recency) = res.recency {
+                println!(
+                    "{} cosine {:.4}, recency {:.4}",
+                    "Scores:".bold(),
+                    res.vector_score.unwrap_or(0.0),
+                    recency
+                );
+            } else if let (Some(vector), Some(rerank)) = (res.vector_score, res.rerank_score) {
+                println!(
+                    "{} cosine {:.4}, rerank {:.4}",
+                    "Scores:".bold(),
+                    vector,
+                    rerank
+                );
+            }
+            if res.source_changed {
+                println!("{}", "Source changed since indexing".yellow());
+            }
+            println!("{}", "---".dimmed());
+            print_context(
+                &res.context_before,
+                res.line_start - res.context_before.len() as i32,
             );
-            let snippet: String = res.code.lines().take(10).collect::<Vec<&str>>().join("\n");
-            println!("{}\n{}", "---".dimmed(), snippet);
+            let code = highlight(&res.code, res.language.as_deref(), &res.filename);
+            if res.context_before.is_empty() && res.context_after.is_empty() {
+                let snippet: String = code.lines().take(10).collect::<Vec<&str>>().join("\n");
+                println!("{}", snippet);
+            } else {
+                // With context the chunk is shown whole, so line numbers stay contiguous
+                for (i, line) in code.lines().enumerate() {
+                    println!("{:>5}  {}", res.line_start + i as i32, line);
+                }
+            }
+            print_context(&res.context_after, res.line_end + 1);
             println!("{}", "---".dimmed());
         }
     }
@@ -210,6 +470,106 @@ pub async fn search_codebase(
     Ok(())
 }
 
+/// Prints the parts of a result's score for `search --explain`, one stage of
+/// the ranking per line.
+fn print_explanation(res: &SearchResult, explanation: &ScoreExplanation) {
+    let rank = |name: &str, rank: Option<usize>, share: f32| match rank {
+        Some(rank) => format!("{} #{} {:.4}", name, rank, share),
+        None => format!("{} -", name),
+    };
+    let boosts = |parts: &mut Vec<String>, symbol: f32, tag: f32| {
+        if symbol != 0.0 {
+            parts.push(format!("symbol {:.4}", symbol));
+        }
+        if tag != 0.0 {
+            parts.push(format!("tags {:.4}", tag));
+        }
+    };
+
+    println!("{}", "Explain:".bold());
+    let mut fused = vec![
+        rank("vector", explanation.vector_rank, explanation.vector_rrf),
+        rank("bm25", explanation.bm25_rank, explanation.bm25_rrf),
+    ];
+    boosts(&mut fused, explanation.symbol_boost, explanation.tag_boost);
+    println!(
+        "  fused    {:.4} = {}",
+        explanation.fused_score,
+        fused.join(" + ")
+    );
+    let mut ranked = explanation.fused_score;
+    if let Some(rerank) = res.rerank_score {
+        let mut reranked = vec![format!("rerank {:.4}", rerank)];
+        boosts(
+            &mut reranked,
+            explanation.rerank_symbol_boost,
+            explanation.rerank_tag_boost,
+        );
+        ranked = rerank + explanation.rerank_symbol_boost + explanation.rerank_tag_boost;
+        println!("  reranked {:.4} = {}", ranked, reranked.join(" + "));
+    }
+    if let Some(recency) = res.recency {
+        let scaled = explanation.scaled_score.unwrap_or(ranked);
+        println!(
+            "  recency  {:.4} = scaled {:.4} × recency {:.4}",
+            scaled * recency,
+            scaled,
+            recency
+        );
+    }
+    if let Some(vector) = res.vector_score {
+        println!("  cosine   {:.4}", vector);
+    }
+    let mut matched = Vec::new();
+    if !explanation.symbol_terms.is_empty() {
+        matched.push(format!("symbol: {}", explanation.symbol_terms.join(", ")));
+    }
+    if !explanation.path_terms.is_empty() {
+        matched.push(format!("path: {}", explanation.path_terms.join(", ")));
+    }
+    if !explanation.boosted_tags.is_empty() {
+        matched.push(format!("tags: {}", explanation.boosted_tags.join(", ")));
+    }
+    if !matched.is_empty() {
+        println!("  matched  {}", matched.join("; "));
+    }
+}
+
+/// Prints `--context-lines` lines dimmed, numbered from `first_line`.
+fn print_context(lines: &[String], first_line: i32) {
+    for (i, line) in lines.iter().enumerate() {
+        let numbered = format!("{:>5}  {}", first_line + i as i32, line);
+        println!("{}", numbered.dimmed());
+    }
+}
+
+/// Chunks added at most by `--expand-graph`.
+const MAX_GRAPH_CHUNKS: usize = 10;
+
+/// Loads the call graph written by `index`, if any.
+fn load_call_graph(db_path: &str) -> Option<Arc<CallGraph>> {
+    match CallGraph::load(db_path) {
+        Ok(graph) => graph.map(Arc::new),
+        Err(e) => {
+            warn!("Call graph could not be loaded: {}", e);
+            None
+        }
+    }
+}
+
+/// Opens the query cache kept in `db_path`, unless `query_cache_size` is 0.
+fn load_query_cache(db_path: &str, config: &AppConfig) -> Option<Arc<QueryCache>> {
+    (config.query_cache_size > 0)
+        .then(|| Arc::new(QueryCache::load(db_path, config.query_cache_size)))
+}
+
+/// Writes the cache back for the next run; a failure only costs the next hit.
+fn save_query_cache(cache: Option<&QueryCache>) {
+    if let Some(Err(e)) = cache.map(QueryCache::save) {
+        warn!("Failed to save query cache: {:#}", e);
+    }
+}
+
 pub fn grep_codebase(pattern: String, json: bool, config: &AppConfig) -> Result<(), CodeRagError> {
     let searcher = CodeSearcher::new(
         None,
@@ -249,21 +609,23 @@ pub async fn create_searcher(
 ) -> Result<CodeSearcher, CodeRagError> {
     let actual_db = db_path.unwrap_or_else(|| config.db_path.clone());
 
-    let storage = Storage::new(&actual_db, "code_chunks")
+    let storage = open_configured_store(config, &actual_db, "code_chunks")
         .await
-        .map_err(|e| CodeRagError::Database(e.to_string()))?;
+        .map_err(|e| CodeRagError::from_anyhow(e, CodeRagError::Database))?;
 
     // Use quiet mode for Embedder to avoid polluting stdout/logs too much
-    let embedder = Embedder::new_with_quiet(
-        true,
-        config.embedding_model.clone(),
-        config.reranker_model.clone(),
-        config.embedding_model_path.clone(),
-        config.reranker_model_path.clone(),
-        config.device.clone(),
-    )?;
+    let embedder = Embedder::from_config(config, true)?;
+    ensure_compatible_embedder(&actual_db, embedder.model_name(), embedder.dim())?;
+    if is_in_progress(&actual_db) {
+        warn!(
+            "Index at {} is being written or a previous indexing run was interrupted; results may be incomplete.",
+            actual_db
+        );
+    }
 
-    let bm25_index = BM25Index::new(&actual_db, true, "log").ok();
+    let bm25_index = BM25Index::new(&actual_db, true, "log")
+        .ok()
+        .map(|index| index.with_doc_boost(config.bm25_doc_boost));
 
     let expander = if config.llm_enabled {
         let client = crate::llm::client::OllamaClient::new(&config.llm_host, &config.llm_model);
@@ -274,13 +636,32 @@ pub async fn create_searcher(
         None
     };
 
+    let embedder = std::sync::Arc::new(embedder);
+    let reranker = create_reranker(
+        &config.reranker,
+        Some(embedder.clone()),
+        &config.llm_host,
+        &config.llm_model,
+        &OnnxRerankerOptions::from_config(config),
+    )
+    .map_err(|e| CodeRagError::from_anyhow(e, CodeRagError::Search))?;
+
     Ok(CodeSearcher::new(
-        Some(std::sync::Arc::new(storage)),
-        Some(std::sync::Arc::new(embedder)),
+        Some(storage),
+        Some(embedder),
         bm25_index.map(std::sync::Arc::new),
         expander,
         config.vector_weight,
         config.bm25_weight,
         config.rrf_k as f64,
+    )
+    .with_reranker(reranker)
+    .with_rerank_top_k(config.rerank_top_k)
+    .with_symbol_weight(config.symbol_weight)
+    .with_call_graph(load_call_graph(&actual_db))
+    // Long-lived searchers keep the cache in memory
+    .with_query_cache(
+        (config.query_cache_size > 0)
+            .then(|| Arc::new(QueryCache::new(&actual_db, config.query_cache_size))),
     ))
 }
@@ -0,0 +1,227 @@
+use futures_util::stream::{self, StreamExt};
+use serde::Serialize;
+use std::path::{Path, PathBuf};
+use std::time::Instant;
+use tracing::{info, warn};
+
+use super::{create_searcher, JsonError, JsonSearchResult};
+use crate::commands::stats::require_index;
+use crate::config::AppConfig;
+use crate::core::{CancelToken, CodeRagError};
+use crate::search::{CodeSearcher, QueryOptions, SearchResult};
+
+/// Default `batch --concurrency`.
+pub const DEFAULT_BATCH_CONCURRENCY: usize = 4;
+
+pub struct BatchOptions {
+    /// File with one question per line; standard input if `None` or `-`
+    pub input: Option<PathBuf>,
+    pub limit: Option<usize>,
+    pub workspace: String,
+    /// Questions searched at the same time
+    pub concurrency: usize,
+    pub no_rerank: bool,
+    /// Stops the questions still being searched, see [`CodeSearcher::with_cancel`]
+    pub cancel: CancelToken,
+}
+
+/// Outcome of one question, an element of the array printed by `batch`.
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct JsonBatchEntry {
+    /// Line of the input the question was read from (1-indexed)
+    pub line: usize,
+    pub query: String,
+    /// Ranked chunks as in `search --json`; empty if the search failed
+    pub results: Vec<JsonSearchResult>,
+    /// Why the search failed, `null` if it didn't
+    pub error: Option<JsonError>,
+    pub search_ms: u64,
+}
+
+/// Questions of a batch input with their line numbers: every line that
+/// isn't blank, trimmed.
+fn parse_questions(input: &str) -> Vec<(usize, String)> {
+    input
+        .lines()
+        .enumerate()
+        .map(|(i, line)| (i + 1, line.trim()))
+        .filter(|(_, line)| !line.is_empty())
+        .map(|(number, line)| (number, line.to_string()))
+        .collect()
+}
+
+/// Search settings shared by all questions of a batch (or an evaluation).
+pub(super) struct BatchSearch<'a> {
+    searcher: &'a CodeSearcher,
+    options: QueryOptions,
+}
+
+impl<'a> BatchSearch<'a> {
+    /// Questions ranked like `search` ranks them with `config`: `limit`
+    /// results each, `min_score` and `recency_half_life_days` applied.
+    pub(super) fn new(
+        searcher: &'a CodeSearcher,
+        limit: usize,
+        no_rerank: bool,
+        workspace: String,
+        config: &AppConfig,
+    ) -> Self {
+        Self {
+            searcher,
+            options: QueryOptions {
+                max_chunks: limit,
+                no_rerank,
+                workspace: Some(workspace),
+                min_score: config.min_score,
+                recency_half_life: config.recency_half_life(),
+                ..Default::default()
+            },
+        }
+    }
+
+    /// Only searches paths matching one of `globs`; a batch searches all.
+    pub(super) fn with_path_globs(mut self, globs: Vec<String>) -> Self {
+        self.options.path_globs = globs;
+        self
+    }
+
+    pub(super) async fn search(&self, query: &str) -> anyhow::Result<Vec<SearchResult>> {
+        self.searcher
+            .search_with_options(query, &self.options)
+            .await
+    }
+
+    /// Searches one question. A failure is recorded in the entry rather than
+    /// returned, so it doesn't abort the other questions.
+    async fn answer(&self, line: usize, query: String) -> JsonBatchEntry {
+        let started = Instant::now();
+        let (results, error) = match self.search(&query).await {
+            Ok(results) => (
+                results.into_iter().map(JsonSearchResult::from).collect(),
+                None,
+            ),
+            Err(e) => {
+                warn!("Question on line {} failed: {:#}", line, e);
+                let err = CodeRagError::Search(format!("{:#}", e));
+                (Vec::new(), Some(JsonError::from(&err)))
+            }
+        };
+        JsonBatchEntry {
+            line,
+            query,
+            results,
+            error,
+            search_ms: started.elapsed().as_millis() as u64,
+        }
+    }
+}
+
+/// Contents of the file at `path`, or of standard input if it is `None` or `-`.
+pub(super) fn read_input(path: Option<&Path>) -> Result<String, CodeRagError> {
+    match path.filter(|p| *p != Path::new("-")) {
+        Some(path) => std::fs::read_to_string(path).map_err(|e| {
+            CodeRagError::Io(std::io::Error::new(
+                e.kind(),
+                format!("Failed to read {}: {}", path.display(), e),
+            ))
+        }),
+        None => std::io::read_to_string(std::io::stdin()).map_err(CodeRagError::Io),
+    }
+}
+
+/// Loads the index of `workspace` and the models to search it, once for all
+/// the questions that follow.
+pub(super) async fn open_searcher(
+    workspace: &str,
+    config: &AppConfig,
+) -> Result<CodeSearcher, CodeRagError> {
+    let actual_db = if workspace == "default" {
+        config.db_path.clone()
+    } else {
+        Path::new(&config.db_path)
+            .join(workspace)
+            .to_string_lossy()
+            .to_string()
+    };
+    require_index(config, &actual_db, workspace).await?;
+    let loaded = Instant::now();
+    let searcher = create_searcher(Some(actual_db), config).await?;
+    info!("Loaded index in {:.1}s", loaded.elapsed().as_secs_f64());
+    Ok(searcher)
+}
+
+/// Runs every line of the input as a query against one loaded index and
+/// prints a JSON array with one [`JsonBatchEntry`] per question, in input
+/// order.
+///
+/// Up to `concurrency` questions are searched at once; they share the
+/// searcher, so the index and the models are loaded a single time.
+pub async fn run_batch(options: BatchOptions, config: &AppConfig) -> Result<(), CodeRagError> {
+    let questions = parse_questions(&read_input(options.input.as_deref())?);
+    let searcher = open_searcher(&options.workspace, config)
+        .await?
+        .with_cancel(options.cancel);
+    info!("Answering {} questions", questions.len());
+
+    let batch = BatchSearch::new(
+        &searcher,
+        options.limit.unwrap_or(config.default_limit),
+        options.no_rerank,
+        options.workspace,
+        config,
+    );
+    let started = Instant::now();
+    let entries: Vec<JsonBatchEntry> = stream::iter(questions)
+        .map(|(line, query)| batch.answer(line, query))
+        .buffered(options.concurrency.max(1))
+        .collect()
+        .await;
+
+    let failed = entries.iter().filter(|e| e.error.is_some()).count();
+    info!(
+        "Answered {} questions in {:.1}s ({} failed)",
+        entries.len(),
+        started.elapsed().as_secs_f64(),
+        failed
+    );
+    println!("{}", serde_json::to_string_pretty(&entries)?);
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_questions() {
+        let input =
+            "where are sessions created?\n\n  how is the config loaded?  \r\n\t\nretry policy\n";
+        assert_eq!(
+            parse_questions(input),
+            vec![
+                (1, "where are sessions created?".to_string()),
+                (3, "how is the config loaded?".to_string()),
+                (5, "retry policy".to_string()),
+            ]
+        );
+        assert!(parse_questions("").is_empty());
+    }
+
+    #[test]
+    fn test_entry_shape() {
+        let err = CodeRagError::Search("Embedding failed".to_string());
+        let entry = JsonBatchEntry {
+            line: 2,
+            query: "auth".to_string(),
+            results: Vec::new(),
+            error: Some(JsonError::from(&err)),
+            search_ms: 7,
+        };
+        let value = serde_json::to_value(&entry).unwrap();
+        assert_eq!(value["line"], 2);
+        assert_eq!(value["error"]["kind"], "search");
+        assert_eq!(value["results"], serde_json::json!([]));
+        assert_eq!(value["searchMs"], 7);
+    }
+}
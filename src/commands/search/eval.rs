@@ -0,0 +1,234 @@
+use colored::*;
+use futures_util::stream::{self, StreamExt};
+use serde::Serialize;
+use std::path::PathBuf;
+use std::time::Instant;
+use tracing::{info, warn};
+
+use super::batch::{open_searcher, read_input, BatchSearch};
+use super::{JsonError, JSON_SCHEMA_VERSION};
+use crate::config::AppConfig;
+use crate::core::CodeRagError;
+use crate::eval::{parse_dataset, score_query, EvalCase, EvalSummary, QueryScore};
+
+pub struct EvalOptions {
+    /// JSON Lines dataset; standard input if `None` or `-`
+    pub dataset: Option<PathBuf>,
+    /// Cutoff of the metrics; `default_limit` if `None`
+    pub k: Option<usize>,
+    pub workspace: String,
+    pub concurrency: usize,
+    pub no_rerank: bool,
+    pub json: bool,
+}
+
+/// Report printed by `eval --json`.
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct JsonEvalReport {
+    pub schema_version: u32,
+    pub workspace: String,
+    pub k: usize,
+    pub summary: EvalSummary,
+    /// Questions whose search failed; they are left out of `summary`
+    pub failed: usize,
+    pub queries: Vec<JsonEvalQuery>,
+}
+
+/// One question of the dataset with its metrics.
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct JsonEvalQuery {
+    pub line: usize,
+    pub query: String,
+    pub expected: Vec<String>,
+    /// `null` if the search failed
+    pub score: Option<QueryScore>,
+    /// Top `k` results, by rank
+    pub retrieved: Vec<JsonEvalHit>,
+    pub error: Option<JsonError>,
+}
+
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct JsonEvalHit {
+    pub rank: usize,
+    pub file: String,
+    pub symbol: Option<String>,
+    pub relevant: bool,
+}
+
+impl BatchSearch<'_> {
+    /// Searches one labeled question and scores its top `k` results.
+    async fn evaluate(&self, case: EvalCase, k: usize) -> JsonEvalQuery {
+        let (score, retrieved, error) = match self.search(&case.query).await {
+            Ok(results) => {
+                let hits: Vec<(&str, Option<&str>)> = results
+                    .iter()
+                    .map(|r| (r.filename.as_str(), r.symbol.as_deref()))
+                    .collect();
+                let score = score_query(&case.expected, &hits, k);
+                let retrieved = results
+                    .iter()
+                    .zip(&score.relevant)
+                    .enumerate()
+                    .map(|(i, (r, relevant))| JsonEvalHit {
+                        rank: i + 1,
+                        file: r.filename.clone(),
+                        symbol: r.symbol.clone(),
+                        relevant: *relevant,
+                    })
+                    .collect();
+                (Some(score), retrieved, None)
+            }
+            Err(e) => {
+                warn!("Question on line {} failed: {:#}", case.line, e);
+                let err = CodeRagError::Search(format!("{:#}", e));
+                (None, Vec::new(), Some(JsonError::from(&err)))
+            }
+        };
+        JsonEvalQuery {
+            line: case.line,
+            query: case.query,
+            expected: case.expected,
+            score,
+            retrieved,
+            error,
+        }
+    }
+}
+
+/// Runs the questions of a labeled dataset through the retriever, with the
+/// index, models and ranking settings `search` would use, and reports how
+/// many of the expected files and symbols come back in the top `k`.
+pub async fn run_eval(options: EvalOptions, config: &AppConfig) -> Result<(), CodeRagError> {
+    let cases = parse_dataset(&read_input(options.dataset.as_deref())?)
+        .map_err(|e| CodeRagError::Generic(format!("{:#}", e)))?;
+    if cases.is_empty() {
+        return Err(CodeRagError::Generic(
+            "The evaluation dataset has no questions".to_string(),
+        ));
+    }
+    let k = options.k.unwrap_or(config.default_limit).max(1);
+    let searcher = open_searcher(&options.workspace, config).await?;
+    info!("Evaluating {} questions at k={}", cases.len(), k);
+
+    let batch = BatchSearch::new(
+        &searcher,
+        k,
+        options.no_rerank,
+        options.workspace.clone(),
+        config,
+    );
+    let started = Instant::now();
+    let queries: Vec<JsonEvalQuery> = stream::iter(cases)
+        .map(|case| batch.evaluate(case, k))
+        .buffered(options.concurrency.max(1))
+        .collect()
+        .await;
+    info!("Evaluated in {:.1}s", started.elapsed().as_secs_f64());
+
+    let report = JsonEvalReport {
+        schema_version: JSON_SCHEMA_VERSION,
+        workspace: options.workspace,
+        k,
+        summary: EvalSummary::from_scores(queries.iter().filter_map(|q| q.score.as_ref())),
+        failed: queries.iter().filter(|q| q.error.is_some()).count(),
+        queries,
+    };
+    if options.json {
+        println!("{}", serde_json::to_string_pretty(&report)?);
+    } else {
+        print_report(&report);
+    }
+    Ok(())
+}
+
+fn print_report(report: &JsonEvalReport) {
+    println!(
+        "{} {} questions, workspace '{}'",
+        "Evaluation:".bold(),
+        report.summary.queries,
+        report.workspace
+    );
+    let k = report.k;
+    println!(
+        "  {:<14} {:.3}",
+        format!("Recall@{}", k),
+        report.summary.recall_at_k
+    );
+    println!(
+        "  {:<14} {:.3}",
+        format!("Precision@{}", k),
+        report.summary.precision_at_k
+    );
+    println!("  {:<14} {:.3}", "MRR", report.summary.mrr);
+    if report.failed > 0 {
+        println!(
+            "  {}",
+            format!("{} questions failed and were not scored", report.failed).yellow()
+        );
+    }
+
+    let misses: Vec<(&JsonEvalQuery, &QueryScore)> = report
+        .queries
+        .iter()
+        .filter_map(|q| q.score.as_ref().map(|s| (q, s)))
+        .filter(|(_, s)| !s.missed.is_empty())
+        .collect();
+    if misses.is_empty() {
+        return;
+    }
+    println!("\n{}", format!("Missed labels (top {}):", k).bold());
+    for (query, score) in misses {
+        let rank = score
+            .first_relevant_rank
+            .map_or("-".to_string(), |r| r.to_string());
+        println!(
+            "  line {:<5} recall {:.2}  first hit {:>3}  {}",
+            query.line, score.recall, rank, query.query
+        );
+        for label in &score.missed {
+            println!("    {} {}", "missing".red(), label);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_report_shape() {
+        let score = score_query(
+            &["auth.Login".to_string()],
+            &[("auth/login.go", Some("auth.Login"))],
+            5,
+        );
+        let report = JsonEvalReport {
+            schema_version: JSON_SCHEMA_VERSION,
+            workspace: "default".to_string(),
+            k: 5,
+            summary: EvalSummary::from_scores([&score]),
+            failed: 0,
+            queries: vec![JsonEvalQuery {
+                line: 1,
+                query: "login".to_string(),
+                expected: vec!["auth.Login".to_string()],
+                score: Some(score),
+                retrieved: vec![JsonEvalHit {
+                    rank: 1,
+                    file: "auth/login.go".to_string(),
+                    symbol: Some("auth.Login".to_string()),
+                    relevant: true,
+                }],
+                error: None,
+            }],
+        };
+        let value = serde_json::to_value(&report).unwrap();
+        assert_eq!(value["summary"]["recallAtK"], 1.0);
+        assert_eq!(value["summary"]["mrr"], 1.0);
+        assert_eq!(value["queries"][0]["score"]["firstRelevantRank"], 1);
+        assert_eq!(value["queries"][0]["retrieved"][0]["relevant"], true);
+    }
+}
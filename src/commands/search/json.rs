@@ -0,0 +1,310 @@
+use crate::core::CodeRagError;
+use crate::indexer::{ChunkPart, DocType};
+use crate::search::{ScoreExplanation, SearchResult};
+use serde::Serialize;
+
+/// Version of the `search --json` output format.
+///
+/// Bumped whenever a field is removed, renamed or changes meaning; adding
+/// fields does not change it.
+pub const JSON_SCHEMA_VERSION: u32 = 1;
+
+/// Top-level object printed to stdout by `search --json`.
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct JsonSearchOutput {
+    pub schema_version: u32,
+    pub query: String,
+    pub workspace: String,
+    pub results: Vec<JsonSearchResult>,
+    pub timing: JsonTiming,
+}
+
+/// One ranked chunk. Optional fields are `null` rather than omitted.
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct JsonSearchResult {
+    /// Stable chunk ID; the same chunk keeps it across re-indexing
+    pub id: String,
+    pub rank: usize,
+    pub file: String,
+    pub symbol: Option<String>,
+    pub language: Option<String>,
+    /// Go package of the matched declaration
+    pub package: Option<String>,
+    /// Import paths of the file (Go only, otherwise empty)
+    pub imports: Vec<String>,
+    /// `code`, or `markdown`/`text` for sections of docs
+    pub doc_type: DocType,
+    /// `{"index": 1, "count": 2}` when the declaration was split into parts
+    pub part: Option<ChunkPart>,
+    pub start_line: i32,
+    pub end_line: i32,
+    /// Final ranking score (reranker score, or fused RRF score)
+    pub score: f32,
+    pub vector_score: Option<f32>,
+    pub rerank_score: Option<f32>,
+    /// Symbol of the hit that pulled this chunk in via `--expand-graph`
+    pub expanded_from: Option<String>,
+    /// Whether secrets in `text` were replaced at index time
+    pub redacted: bool,
+    /// Whether the chunk is test code (`_test.go`, `tests/`, `test_patterns`, ...)
+    pub is_test: bool,
+    /// Collection the chunk was indexed into with `index --collection`
+    pub collection: Option<String>,
+    /// User tags from `.ragtags` and `rag:tag` comments, otherwise empty
+    pub tags: Vec<String>,
+    /// Index the result came from when several were searched with `--index`
+    pub source: Option<String>,
+    pub text: String,
+    /// Lines before `startLine` read from disk with `--context-lines`, otherwise empty
+    pub context_before: Vec<String>,
+    /// Lines after `endLine` read from disk with `--context-lines`, otherwise empty
+    pub context_after: Vec<String>,
+    /// Whether the file was missing or shorter than the chunk when reading the context
+    pub source_changed: bool,
+    /// Unix time the chunk last changed: the newest commit of its lines when
+    /// indexed with `blame_timestamps`, otherwise the file's modification time
+    pub last_changed: i64,
+    /// Factor the score was multiplied by with `--recency-half-life`
+    pub recency: Option<f32>,
+    /// Other places the same code was found when the index was built with
+    /// `dedup_chunks`, otherwise empty
+    pub duplicates: Vec<JsonLocation>,
+    /// What `score` is made of with `--explain`, otherwise `null`
+    pub explanation: Option<JsonExplanation>,
+}
+
+/// The parts of a result's score, see [`ScoreExplanation`] for how they add up.
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct JsonExplanation {
+    /// Best rank among the vector hits, `null` for keyword-only hits
+    pub vector_rank: Option<usize>,
+    pub vector_rrf: f32,
+    /// Rank among the BM25 hits, `null` if BM25 didn't find the chunk
+    pub bm25_rank: Option<usize>,
+    pub bm25_rrf: f32,
+    /// Boost for the query naming the symbol or path, before reranking
+    pub symbol_boost: f32,
+    /// Boost for the chunk's `--boost-tag` tags, before reranking
+    pub tag_boost: f32,
+    /// Fused score the reranker's candidates were picked by
+    pub fused_score: f32,
+    pub rerank_symbol_boost: f32,
+    pub rerank_tag_boost: f32,
+    /// Query words found in the symbol
+    pub symbol_terms: Vec<String>,
+    /// Query words found in the path
+    pub path_terms: Vec<String>,
+    /// `--boost-tag` tags the chunk carries
+    pub boosted_tags: Vec<String>,
+    /// Score scaled into [0, 1] for `--recency-half-life`, `null` otherwise
+    pub scaled_score: Option<f32>,
+}
+
+impl From<ScoreExplanation> for JsonExplanation {
+    fn from(explanation: ScoreExplanation) -> Self {
+        Self {
+            vector_rank: explanation.vector_rank,
+            vector_rrf: explanation.vector_rrf,
+            bm25_rank: explanation.bm25_rank,
+            bm25_rrf: explanation.bm25_rrf,
+            symbol_boost: explanation.symbol_boost,
+            tag_boost: explanation.tag_boost,
+            fused_score: explanation.fused_score,
+            rerank_symbol_boost: explanation.rerank_symbol_boost,
+            rerank_tag_boost: explanation.rerank_tag_boost,
+            symbol_terms: explanation.symbol_terms,
+            path_terms: explanation.path_terms,
+            boosted_tags: explanation.boosted_tags,
+            scaled_score: explanation.scaled_score,
+        }
+    }
+}
+
+/// Lines of a file, as in [`JsonSearchResult::duplicates`].
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct JsonLocation {
+    pub file: String,
+    pub start_line: usize,
+    pub end_line: usize,
+}
+
+impl From<SearchResult> for JsonSearchResult {
+    fn from(result: SearchResult) -> Self {
+        Self {
+            id: result.id,
+            rank: result.rank,
+            file: result.filename,
+            symbol: result.symbol,
+            language: result.language,
+            package: result.package,
+            imports: result.imports,
+            doc_type: result.doc_type,
+            part: result.part,
+            start_line: result.line_start,
+            end_line: result.line_end,
+            score: result.score,
+            vector_score: result.vector_score,
+            rerank_score: result.rerank_score,
+            expanded_from: result.expanded_from,
+            redacted: result.redacted,
+            is_test: result.is_test,
+            collection: result.collection,
+            tags: result.tags,
+            source: result.source,
+            text: result.code,
+            context_before: result.context_before,
+            context_after: result.context_after,
+            last_changed: result.last_changed(),
+            source_changed: result.source_changed,
+            recency: result.recency,
+            duplicates: result
+                .duplicates
+                .into_iter()
+                .map(|location| JsonLocation {
+                    file: location.filename,
+                    start_line: location.line_start,
+                    end_line: location.line_end,
+                })
+                .collect(),
+            explanation: result.explanation.map(Into::into),
+        }
+    }
+}
+
+/// Wall-clock durations in milliseconds.
+#[derive(Serialize, Debug, Default)]
+#[serde(rename_all = "camelCase")]
+pub struct JsonTiming {
+    /// Opening the index and loading models
+    pub load_ms: u64,
+    /// Retrieval, reranking and call-graph expansion
+    pub search_ms: u64,
+    pub total_ms: u64,
+}
+
+/// Object printed to stderr by `search --json` when the search fails.
+#[derive(Serialize, Debug)]
+#[serde(rename_all = "camelCase")]
+pub struct JsonErrorOutput {
+    pub schema_version: u32,
+    pub error: JsonError,
+}
+
+#[derive(Serialize, Debug)]
+pub struct JsonError {
+    /// Error category: `io`, `config`, `database`, `embedding`, `search`, ...
+    pub kind: &'static str,
+    pub message: String,
+}
+
+impl From<&CodeRagError> for JsonError {
+    fn from(err: &CodeRagError) -> Self {
+        let kind = match err {
+            CodeRagError::Io(_) => "io",
+            CodeRagError::Config(_) => "config",
+            CodeRagError::Database(_) => "database",
+            CodeRagError::Embedding(_) => "embedding",
+            CodeRagError::Search(_) => "search",
+            CodeRagError::Server(_) => "server",
+            CodeRagError::Serialization(_) => "serialization",
+            CodeRagError::Tantivy(_) => "bm25",
+            CodeRagError::Generic(_) => "generic",
+            CodeRagError::Cancelled(_) => "cancelled",
+            CodeRagError::IndexNotFound(_) => "no_index",
+            CodeRagError::EmptyIndex(_) => "empty_index",
+            CodeRagError::DimensionMismatch(_) => "dimension_mismatch",
+            CodeRagError::EmbedderAuth(_) => "embedder_auth",
+        };
+        Self {
+            kind,
+            message: err.to_string(),
+        }
+    }
+}
+
+impl From<&CodeRagError> for JsonErrorOutput {
+    fn from(err: &CodeRagError) -> Self {
+        Self {
+            schema_version: JSON_SCHEMA_VERSION,
+            error: err.into(),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_output_shape() {
+        let output = JsonSearchOutput {
+            schema_version: JSON_SCHEMA_VERSION,
+            query: "auth".to_string(),
+            workspace: "default".to_string(),
+            results: vec![SearchResult {
+                id: "4f2a".to_string(),
+                rank: 1,
+                score: 0.9,
+                filename: "src/auth.rs".to_string(),
+                code: "fn login() {}".to_string(),
+                line_start: 3,
+                line_end: 5,
+                ..Default::default()
+            }
+            .into()],
+            timing: JsonTiming::default(),
+        };
+        let value = serde_json::to_value(&output).unwrap();
+        assert_eq!(value["schemaVersion"], 1);
+        let result = &value["results"][0];
+        assert_eq!(result["id"], "4f2a");
+        assert_eq!(result["file"], "src/auth.rs");
+        assert_eq!(result["startLine"], 3);
+        assert_eq!(result["endLine"], 5);
+        assert_eq!(result["text"], "fn login() {}");
+        assert!(result["symbol"].is_null());
+        assert_eq!(result["redacted"], false);
+        assert_eq!(result["docType"], "code");
+        assert!(result["source"].is_null());
+        assert_eq!(result["contextBefore"], serde_json::json!([]));
+        assert_eq!(result["sourceChanged"], false);
+        assert!(result["explanation"].is_null());
+        assert!(value["timing"]["totalMs"].is_u64());
+    }
+
+    #[test]
+    fn test_explanation_shape() {
+        let result: JsonSearchResult = SearchResult {
+            explanation: Some(ScoreExplanation {
+                vector_rank: Some(2),
+                vector_rrf: 0.016,
+                symbol_terms: vec!["login".to_string()],
+                ..Default::default()
+            }),
+            ..Default::default()
+        }
+        .into();
+        let value = serde_json::to_value(&result).unwrap();
+        let explanation = &value["explanation"];
+        assert_eq!(explanation["vectorRank"], 2);
+        assert!(explanation["bm25Rank"].is_null());
+        assert_eq!(explanation["symbolTerms"], serde_json::json!(["login"]));
+        assert_eq!(explanation["rerankTagBoost"], 0.0);
+    }
+
+    #[test]
+    fn test_error_output() {
+        let err = CodeRagError::Database("Workspace 'x' does not exist.".to_string());
+        let value = serde_json::to_value(JsonErrorOutput::from(&err)).unwrap();
+        assert_eq!(value["schemaVersion"], 1);
+        assert_eq!(value["error"]["kind"], "database");
+        assert_eq!(
+            value["error"]["message"],
+            "Database error: Workspace 'x' does not exist."
+        );
+    }
+}
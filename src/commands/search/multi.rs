@@ -0,0 +1,363 @@
+use std::collections::HashMap;
+use std::path::Path;
+use std::sync::Arc;
+use std::time::Instant;
+use tracing::warn;
+
+use super::{
+    describe_query, load_call_graph, load_query_cache, print_results, save_query_cache,
+    SearchOptions, MAX_GRAPH_CHUNKS,
+};
+use crate::bm25::BM25Index;
+use crate::config::AppConfig;
+use crate::core::CodeRagError;
+use crate::embedding::Embedder;
+use crate::llm::client::OllamaClient;
+use crate::llm::expander::QueryExpander;
+use crate::manifest::{is_in_progress, IndexManifest};
+use crate::rerank::{create_reranker, OnnxRerankerOptions};
+use crate::search::{
+    attach_source_context, interleave_sources, retain_min_score, CandidateFilter, CodeSearcher,
+};
+use crate::storage::{open_configured_store, store_exists};
+
+/// An index selected with `search --index`.
+#[derive(Debug, Clone, PartialEq)]
+pub struct IndexTarget {
+    /// Name shown with each result, usually the repository directory
+    pub label: String,
+    pub db_path: String,
+}
+
+/// Expands `--index` paths into the indexes to search.
+///
+/// A path holding a chunk table is one index. Any other directory is treated
+/// as a directory of indexes: each subdirectory holding a chunk table is
+/// searched. For workspaces other than `default` the workspace index nested in
+/// each path is used, as with `db_path`.
+pub fn resolve_indexes(
+    paths: &[String],
+    workspace: &str,
+    backend: &str,
+) -> Result<Vec<IndexTarget>, CodeRagError> {
+    let workspace_db = |root: &Path| {
+        if workspace == "default" {
+            root.to_path_buf()
+        } else {
+            root.join(workspace)
+        }
+    };
+    let is_index = |db: &Path| store_exists(backend, &db.to_string_lossy(), "code_chunks");
+
+    let mut targets = Vec::new();
+    for path in paths {
+        let root = Path::new(path);
+        let db = workspace_db(root);
+        if is_index(&db) {
+            targets.push(IndexTarget {
+                label: index_label(root),
+                db_path: db.to_string_lossy().to_string(),
+            });
+            continue;
+        }
+
+        let mut children: Vec<_> = std::fs::read_dir(root)
+            .map(|entries| entries.flatten().map(|e| e.path()).collect())
+            .unwrap_or_default();
+        children.sort();
+        let before = targets.len();
+        for child in children.iter().filter(|c| c.is_dir()) {
+            let db = workspace_db(child);
+            if is_index(&db) {
+                targets.push(IndexTarget {
+                    label: index_label(child),
+                    db_path: db.to_string_lossy().to_string(),
+                });
+            }
+        }
+        if targets.len() == before {
+            return Err(CodeRagError::Database(format!(
+                "No index for workspace '{}' found in {}.",
+                workspace, path
+            )));
+        }
+    }
+
+    // Fall back to the full path where two indexes would share a label
+    let mut counts: HashMap<String, usize> = HashMap::new();
+    for target in &targets {
+        *counts.entry(target.label.clone()).or_insert(0) += 1;
+    }
+    for target in &mut targets {
+        if counts[&target.label] > 1 {
+            target.label = target.db_path.clone();
+        }
+    }
+    Ok(targets)
+}
+
+/// Directory name of an index; hidden directories such as `repo/.lancedb`
+/// are named after their parent.
+fn index_label(path: &Path) -> String {
+    let name = |p: &Path| p.file_name().map(|n| n.to_string_lossy().to_string());
+    match name(path) {
+        Some(n) if !n.starts_with('.') => n,
+        _ => path
+            .parent()
+            .and_then(name)
+            .unwrap_or_else(|| path.to_string_lossy().to_string()),
+    }
+}
+
+/// Fails unless every index was built with the configured embedder.
+///
+/// Query vectors come from that embedder, so similarities against vectors of
+/// another model are meaningless and cannot be normalized into a common scale.
+fn ensure_same_embedder(
+    targets: &[IndexTarget],
+    model: &str,
+    dim: usize,
+) -> Result<(), CodeRagError> {
+    let mut mismatched = Vec::new();
+    for target in targets {
+        let manifest = IndexManifest::load(&target.db_path)
+            .map_err(|e| CodeRagError::from_anyhow(e, CodeRagError::Database))?;
+        let Some(manifest) = manifest else {
+            warn!(
+                "Index '{}' has no manifest; cannot verify its embedding model.",
+                target.label
+            );
+            continue;
+        };
+        if manifest.check_embedder(model, dim).is_err() {
+            mismatched.push(format!(
+                "  {}: '{}' ({} dimensions)",
+                target.label,
+                manifest.embedding_model.as_deref().unwrap_or("unknown"),
+                manifest
+                    .embedding_dim
+                    .map(|d| d.to_string())
+                    .unwrap_or_else(|| "unknown".to_string())
+            ));
+        }
+    }
+    if mismatched.is_empty() {
+        return Ok(());
+    }
+    Err(CodeRagError::DimensionMismatch(format!(
+        "Cannot merge results: these indexes were not built with the configured embedding model '{}' ({} dimensions):\n{}\n\
+        Re-index them with the same model or search them separately.",
+        model,
+        dim,
+        mismatched.join("\n")
+    )))
+}
+
+/// Runs `search` against every index of `options.indexes` and prints the
+/// merged ranking, see [`interleave_sources`].
+pub(super) async fn search_indexes(
+    query: String,
+    options: SearchOptions,
+    config: &AppConfig,
+) -> Result<(), CodeRagError> {
+    let started = Instant::now();
+    let workspace_name = options
+        .workspace
+        .clone()
+        .unwrap_or_else(|| "default".to_string());
+    let targets = resolve_indexes(&options.indexes, &workspace_name, &config.storage_backend)?;
+    if targets.len() > 1 && options.max_tokens.is_some() {
+        return Err(CodeRagError::Search(
+            "--max-tokens cannot be combined with several indexes".to_string(),
+        ));
+    }
+
+    let embedder = Embedder::from_config(config, options.json)?;
+    ensure_same_embedder(&targets, embedder.model_name(), embedder.dim())?;
+    let embedder = Arc::new(embedder);
+    let reranker = create_reranker(
+        &config.reranker,
+        Some(embedder.clone()),
+        &config.llm_host,
+        &config.llm_model,
+        &OnnxRerankerOptions::from_config(config),
+    )
+    .map_err(|e| CodeRagError::from_anyhow(e, CodeRagError::Search))?;
+    let expander = if config.llm_enabled {
+        let client = OllamaClient::new(&config.llm_host, &config.llm_model);
+        Some(Arc::new(QueryExpander::new(Arc::new(client))))
+    } else {
+        None
+    };
+    let filter = CandidateFilter::new(
+        options.ext.clone(),
+        options.dir.clone(),
+        options.path_globs.clone(),
+        options.languages.clone(),
+    )
+    .map_err(|e| CodeRagError::from_anyhow(e, CodeRagError::Search))?
+    .with_packages(options.packages.clone())
+    .with_doc_types(options.doc_types.clone())
+    .with_tests(options.tests)
+    .with_collections(options.collections.clone())
+    .with_tags(options.tags.clone());
+    let limit = options.limit.unwrap_or(config.default_limit);
+    let recency_half_life = options
+        .recency_half_life
+        .or_else(|| config.recency_half_life());
+
+    if !options.json {
+        println!(
+            "Searching {} indexes for: {}",
+            targets.len(),
+            describe_query(&query, options.code)
+        );
+    }
+
+    let search_started = Instant::now();
+    let mut sources = Vec::with_capacity(targets.len());
+    let mut expanded = 0;
+    for target in &targets {
+        if is_in_progress(&target.db_path) {
+            warn!(
+                "Index '{}' is being written or a previous indexing run was interrupted; results may be incomplete.",
+                target.label
+            );
+        }
+        let storage = open_configured_store(config, &target.db_path, "code_chunks")
+            .await
+            .map_err(|e| CodeRagError::from_anyhow(e, CodeRagError::Database))?;
+        let query_cache = load_query_cache(&target.db_path, config);
+        let searcher = CodeSearcher::new(
+            Some(storage),
+            Some(embedder.clone()),
+            BM25Index::new(&target.db_path, true, "log")
+                .ok()
+                .map(|index| Arc::new(index.with_doc_boost(config.bm25_doc_boost))),
+            expander.clone(),
+            config.vector_weight,
+            config.bm25_weight,
+            config.rrf_k as f64,
+        )
+        .with_reranker(reranker.clone())
+        .with_rerank_top_k(config.rerank_top_k)
+        .with_symbol_weight(config.symbol_weight)
+        .with_tag_boosts(options.tag_boosts.clone())
+        .with_explain(options.explain)
+        .with_call_graph(load_call_graph(&target.db_path))
+        .with_query_cache(query_cache.clone())
+        .with_cancel(options.cancel.clone());
+
+        let results = if options.code {
+            searcher
+                .code_search(
+                    &query,
+                    limit,
+                    &filter,
+                    options.workspace.clone(),
+                    options.max_tokens,
+                    options.hybrid_alpha,
+                    options.mmr_lambda,
+                    options.max_per_file,
+                    recency_half_life,
+                    options.expand_to_symbol,
+                )
+                .await
+        } else {
+            searcher
+                .filtered_search(
+                    &query,
+                    limit,
+                    &filter,
+                    options.no_rerank,
+                    options.workspace.clone(),
+                    options.max_tokens,
+                    options.expand,
+                    options.hybrid_alpha,
+                    options.mmr_lambda,
+                    options.max_per_file,
+                    recency_half_life,
+                    options.expand_to_symbol,
+                )
+                .await
+        };
+        let mut results =
+            results.map_err(|e| CodeRagError::Search(format!("{}: {}", target.label, e)))?;
+        save_query_cache(query_cache.as_deref());
+        retain_min_score(&mut results, options.min_score.or(config.min_score));
+        let hits = results.len();
+        let results = searcher
+            .expand_with_call_graph(
+                results,
+                options.expand_graph,
+                MAX_GRAPH_CHUNKS,
+                &filter,
+                options.workspace.as_deref(),
+            )
+            .await
+            .map_err(|e| CodeRagError::Search(format!("{}: {}", target.label, e)))?;
+        expanded += results.len() - hits;
+        sources.push((target.label.clone(), results));
+    }
+
+    let mut results = interleave_sources(sources, limit + expanded);
+    attach_source_context(&mut results, options.context_lines);
+    print_results(
+        &query,
+        workspace_name,
+        results,
+        (options.json, options.html),
+        started,
+        search_started,
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn make_index(path: &Path) {
+        std::fs::create_dir_all(path.join("code_chunks.lance")).unwrap();
+    }
+
+    #[test]
+    fn test_resolve_single_and_directory_of_indexes() {
+        let dir = TempDir::new().unwrap();
+        let root = dir.path();
+        make_index(&root.join("repo-a/.lancedb"));
+        make_index(&root.join("all/repo-b"));
+        make_index(&root.join("all/repo-c"));
+        std::fs::create_dir_all(root.join("all/not-an-index")).unwrap();
+
+        let paths = vec![
+            root.join("repo-a/.lancedb").to_string_lossy().to_string(),
+            root.join("all").to_string_lossy().to_string(),
+        ];
+        let targets = resolve_indexes(&paths, "default", "lancedb").unwrap();
+        let labels: Vec<&str> = targets.iter().map(|t| t.label.as_str()).collect();
+        assert_eq!(labels, vec!["repo-a", "repo-b", "repo-c"]);
+
+        let missing = vec![root.join("all/not-an-index").to_string_lossy().to_string()];
+        assert!(resolve_indexes(&missing, "default", "lancedb").is_err());
+    }
+
+    #[test]
+    fn test_resolve_workspace_and_duplicate_labels() {
+        let dir = TempDir::new().unwrap();
+        let root = dir.path();
+        make_index(&root.join("x/app/backend"));
+        make_index(&root.join("y/app/backend"));
+
+        let paths = vec![
+            root.join("x/app").to_string_lossy().to_string(),
+            root.join("y/app").to_string_lossy().to_string(),
+        ];
+        let targets = resolve_indexes(&paths, "backend", "lancedb").unwrap();
+        assert_eq!(targets.len(), 2);
+        assert!(targets[0].db_path.ends_with("backend"));
+        // Both would be called "app"
+        assert_ne!(targets[0].label, targets[1].label);
+        assert_eq!(targets[0].label, targets[0].db_path);
+    }
+}
@@ -0,0 +1,365 @@
+use colored::*;
+use rustyline::error::ReadlineError;
+use rustyline::DefaultEditor;
+use std::path::PathBuf;
+use std::time::Instant;
+use tracing::warn;
+
+use super::batch::{open_searcher, BatchSearch};
+use super::print_results;
+use crate::config::AppConfig;
+use crate::core::CodeRagError;
+use crate::search::{CandidateFilter, CodeSearcher, RefineOptions, SearchResult};
+
+/// File in the user's data directory that keeps the queries typed at the
+/// prompt across sessions.
+const HISTORY_FILE: &str = "repl_history";
+
+pub struct ReplOptions {
+    /// Results per query; `default_limit` if `None`
+    pub limit: Option<usize>,
+    pub workspace: String,
+    pub no_rerank: bool,
+    /// Start with JSON output, as `:json` would
+    pub json: bool,
+}
+
+/// A line typed at the prompt.
+#[derive(Debug, Clone, PartialEq)]
+enum ReplCommand {
+    /// Anything not starting with `:`
+    Search(String),
+    /// `:limit N`
+    Limit(usize),
+    /// `:glob PATTERN[,PATTERN...]`; no pattern clears the globs
+    Glob(Vec<String>),
+    /// `:json`, switching between JSON and text output
+    Json,
+    /// `:more N`, result `N` of the last search was relevant
+    More(usize),
+    /// `:less N`, result `N` of the last search was not
+    Less(usize),
+    Help,
+    Quit,
+}
+
+impl ReplCommand {
+    /// Parses a line; `None` if it is blank.
+    fn parse(line: &str) -> Result<Option<Self>, String> {
+        let line = line.trim();
+        if line.is_empty() {
+            return Ok(None);
+        }
+        let Some(command) = line.strip_prefix(':') else {
+            return Ok(Some(Self::Search(line.to_string())));
+        };
+        let (name, arg) = command
+            .split_once(char::is_whitespace)
+            .map_or((command, ""), |(name, arg)| (name, arg.trim()));
+        let number = |what: &str| {
+            arg.parse::<usize>()
+                .ok()
+                .filter(|n| *n > 0)
+                .ok_or_else(|| format!(":{} needs {}, e.g. :{} 3", name, what, name))
+        };
+        let command = match name {
+            "limit" => Self::Limit(number("a number of results")?),
+            "glob" => Self::Glob(
+                arg.split(',')
+                    .map(str::trim)
+                    .filter(|glob| !glob.is_empty())
+                    .map(str::to_string)
+                    .collect(),
+            ),
+            "json" => Self::Json,
+            "more" => Self::More(number("the rank of a result")?),
+            "less" => Self::Less(number("the rank of a result")?),
+            "help" | "h" | "?" => Self::Help,
+            "quit" | "q" | "exit" => Self::Quit,
+            _ => return Err(format!("Unknown command :{}, see :help", name)),
+        };
+        Ok(Some(command))
+    }
+}
+
+/// Settings and last results of an interactive session.
+struct Session<'a> {
+    searcher: &'a CodeSearcher,
+    config: &'a AppConfig,
+    workspace: String,
+    no_rerank: bool,
+    limit: usize,
+    globs: Vec<String>,
+    filter: CandidateFilter,
+    json: bool,
+    /// Last query; `:more` and `:less` refine it
+    query: Option<String>,
+    /// Results shown last, whose ranks `:more` and `:less` refer to
+    results: Vec<SearchResult>,
+    positive_ids: Vec<String>,
+    negative_ids: Vec<String>,
+}
+
+impl Session<'_> {
+    /// Runs a new query, forgetting the feedback given on the last one.
+    async fn search(&mut self, query: String) -> Result<(), CodeRagError> {
+        let results = BatchSearch::new(
+            self.searcher,
+            self.limit,
+            self.no_rerank,
+            self.workspace.clone(),
+            self.config,
+        )
+        .with_path_globs(self.globs.clone())
+        .search(&query)
+        .await
+        .map_err(|e| CodeRagError::Search(format!("{:#}", e)))?;
+        self.positive_ids.clear();
+        self.negative_ids.clear();
+        self.query = Some(query);
+        self.show(results)
+    }
+
+    /// Marks result `rank` of the last results as relevant or not and
+    /// searches again with all the feedback given on the query so far.
+    async fn feedback(&mut self, rank: usize, relevant: bool) -> Result<(), CodeRagError> {
+        let query = self
+            .query
+            .clone()
+            .ok_or_else(|| CodeRagError::Search("Search for something first".to_string()))?;
+        let id = self
+            .results
+            .get(rank - 1)
+            .map(|res| res.id.clone())
+            .ok_or_else(|| {
+                CodeRagError::Search(format!(
+                    "There is no result {}, the last search returned {}",
+                    rank,
+                    self.results.len()
+                ))
+            })?;
+        let (add, remove) = if relevant {
+            (&mut self.positive_ids, &mut self.negative_ids)
+        } else {
+            (&mut self.negative_ids, &mut self.positive_ids)
+        };
+        remove.retain(|other| *other != id);
+        if !add.contains(&id) {
+            add.push(id);
+        }
+
+        let options = RefineOptions {
+            limit: self.limit,
+            ..Default::default()
+        };
+        let results = self
+            .searcher
+            .refine_query(
+                &query,
+                &self.positive_ids,
+                &self.negative_ids,
+                &options,
+                &self.filter,
+                Some(&self.workspace),
+            )
+            .await
+            .map_err(|e| CodeRagError::Search(format!("{:#}", e)))?;
+        self.show(results)
+    }
+
+    fn set_globs(&mut self, globs: Vec<String>) -> Result<(), CodeRagError> {
+        self.filter = CandidateFilter::new(None, None, globs.clone(), Vec::new())
+            .map_err(|e| CodeRagError::from_anyhow(e, CodeRagError::Search))?;
+        self.globs = globs;
+        Ok(())
+    }
+
+    fn show(&mut self, results: Vec<SearchResult>) -> Result<(), CodeRagError> {
+        if results.is_empty() && !self.json {
+            println!("{}", "No results".yellow());
+        }
+        let now = Instant::now();
+        print_results(
+            self.query.as_deref().unwrap_or_default(),
+            self.workspace.clone(),
+            results.clone(),
+            (self.json, false),
+            now,
+            now,
+        )?;
+        self.results = results;
+        Ok(())
+    }
+
+    fn print_help(&self) {
+        println!("Type a query to search, or a command:");
+        println!(
+            "  :limit N           results per query (now {})",
+            self.limit
+        );
+        let globs = if self.globs.is_empty() {
+            "none".to_string()
+        } else {
+            self.globs.join(",")
+        };
+        println!(
+            "  :glob PATTERN,...  only search matching files; no pattern clears (now {})",
+            globs
+        );
+        println!(
+            "  :json              switch between JSON and text output (now {})",
+            if self.json { "JSON" } else { "text" }
+        );
+        println!("  :more N            result N is relevant, search again with that");
+        println!("  :less N            result N is not relevant, search again with that");
+        println!("  :quit              exit, as does Ctrl-D");
+    }
+
+    /// Runs one command; `false` once the session should end.
+    async fn run(&mut self, command: ReplCommand) -> Result<bool, CodeRagError> {
+        match command {
+            ReplCommand::Search(query) => self.search(query).await?,
+            ReplCommand::Limit(limit) => self.limit = limit,
+            ReplCommand::Glob(globs) => self.set_globs(globs)?,
+            ReplCommand::Json => self.json = !self.json,
+            ReplCommand::More(rank) => self.feedback(rank, true).await?,
+            ReplCommand::Less(rank) => self.feedback(rank, false).await?,
+            ReplCommand::Help => self.print_help(),
+            ReplCommand::Quit => return Ok(false),
+        }
+        Ok(true)
+    }
+}
+
+/// Where the prompt history is kept, `None` if the platform has no data
+/// directory.
+fn history_path() -> Option<PathBuf> {
+    dirs::data_dir().map(|dir| dir.join("code-rag").join(HISTORY_FILE))
+}
+
+/// Loads the index of a workspace once and searches it for each query typed
+/// at a prompt, with line editing and a history kept across sessions.
+///
+/// A failed query or command is reported and the prompt comes back; Ctrl-C
+/// discards the line being typed and Ctrl-D (or `:quit`) ends the session.
+pub async fn run_repl(options: ReplOptions, config: &AppConfig) -> Result<(), CodeRagError> {
+    let searcher = open_searcher(&options.workspace, config).await?;
+    let mut session = Session {
+        searcher: &searcher,
+        config,
+        workspace: options.workspace,
+        no_rerank: options.no_rerank,
+        limit: options.limit.unwrap_or(config.default_limit).max(1),
+        globs: Vec::new(),
+        filter: CandidateFilter::default(),
+        json: options.json,
+        query: None,
+        results: Vec::new(),
+        positive_ids: Vec::new(),
+        negative_ids: Vec::new(),
+    };
+
+    let mut editor = DefaultEditor::new()
+        .map_err(|e| CodeRagError::Generic(format!("Failed to start the prompt: {}", e)))?;
+    let history = history_path();
+    if let Some(path) = history.as_ref().filter(|path| path.exists()) {
+        if let Err(e) = editor.load_history(path) {
+            warn!("Failed to read the query history: {}", e);
+        }
+    }
+    println!(
+        "Searching workspace '{}'. Type a query, {} for commands, Ctrl-D to exit.",
+        session.workspace,
+        ":help".bold()
+    );
+
+    loop {
+        let line = match editor.readline(&format!("{} ", "code-rag>".cyan().bold())) {
+            Ok(line) => line,
+            Err(ReadlineError::Interrupted) => continue,
+            Err(ReadlineError::Eof) => break,
+            Err(e) => {
+                return Err(CodeRagError::Generic(format!(
+                    "Failed to read the prompt: {}",
+                    e
+                )))
+            }
+        };
+        if !line.trim().is_empty() {
+            let _ = editor.add_history_entry(line.trim());
+        }
+        let command = match ReplCommand::parse(&line) {
+            Ok(Some(command)) => command,
+            Ok(None) => continue,
+            Err(message) => {
+                eprintln!("{}", message.yellow());
+                continue;
+            }
+        };
+        match session.run(command).await {
+            Ok(true) => {}
+            Ok(false) => break,
+            Err(e) => eprintln!("{} {}", "Error:".red().bold(), e),
+        }
+    }
+
+    if let Some(path) = history {
+        let saved = path
+            .parent()
+            .map_or(Ok(()), std::fs::create_dir_all)
+            .map_err(|e| e.to_string())
+            .and_then(|()| editor.save_history(&path).map_err(|e| e.to_string()));
+        if let Err(e) = saved {
+            warn!("Failed to save the query history: {}", e);
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_commands() {
+        assert_eq!(ReplCommand::parse("  \t"), Ok(None));
+        assert_eq!(
+            ReplCommand::parse(" where are sessions created? "),
+            Ok(Some(ReplCommand::Search(
+                "where are sessions created?".to_string()
+            )))
+        );
+        assert_eq!(
+            ReplCommand::parse(":limit 10"),
+            Ok(Some(ReplCommand::Limit(10)))
+        );
+        assert_eq!(
+            ReplCommand::parse(":glob internal/**, cmd/**"),
+            Ok(Some(ReplCommand::Glob(vec![
+                "internal/**".to_string(),
+                "cmd/**".to_string()
+            ])))
+        );
+        assert_eq!(
+            ReplCommand::parse(":glob"),
+            Ok(Some(ReplCommand::Glob(Vec::new())))
+        );
+        assert_eq!(ReplCommand::parse(":json"), Ok(Some(ReplCommand::Json)));
+        assert_eq!(
+            ReplCommand::parse(":more 2"),
+            Ok(Some(ReplCommand::More(2)))
+        );
+        assert_eq!(
+            ReplCommand::parse(":less 1"),
+            Ok(Some(ReplCommand::Less(1)))
+        );
+        assert_eq!(ReplCommand::parse(":q"), Ok(Some(ReplCommand::Quit)));
+
+        assert!(ReplCommand::parse(":limit 0").is_err());
+        assert!(ReplCommand::parse(":more").is_err());
+        assert!(ReplCommand::parse(":less x").is_err());
+        assert!(ReplCommand::parse(":frobnicate")
+            .unwrap_err()
+            .contains(":frobnicate"));
+    }
+}
@@ -0,0 +1,85 @@
+use std::path::Path;
+use std::time::Instant;
+use tracing::warn;
+
+use super::print_results;
+use crate::commands::stats::require_index;
+use crate::config::AppConfig;
+use crate::core::CodeRagError;
+use crate::manifest::is_in_progress;
+use crate::search::{CandidateFilter, CodeSearcher, SimilarTarget};
+use crate::storage::open_configured_store;
+
+pub struct SimilarOptions {
+    pub limit: Option<usize>,
+    pub json: bool,
+    pub workspace: String,
+    pub path_globs: Vec<String>,
+    pub languages: Vec<String>,
+}
+
+/// Prints the chunks most similar to `target` (`file:symbol` or
+/// `file:start-end`), see [`CodeSearcher::similar`].
+pub async fn find_similar(
+    target: String,
+    options: SimilarOptions,
+    config: &AppConfig,
+) -> Result<(), CodeRagError> {
+    let started = Instant::now();
+    let parsed = SimilarTarget::parse(&target)
+        .map_err(|e| CodeRagError::from_anyhow(e, CodeRagError::Search))?;
+    let actual_db = if options.workspace == "default" {
+        config.db_path.clone()
+    } else {
+        Path::new(&config.db_path)
+            .join(&options.workspace)
+            .to_string_lossy()
+            .to_string()
+    };
+    require_index(config, &actual_db, &options.workspace).await?;
+    if is_in_progress(&actual_db) {
+        warn!(
+            "Index at {} is being written or a previous indexing run was interrupted; results may be incomplete.",
+            actual_db
+        );
+    }
+
+    // The query vector comes from the index, so no embedder is loaded
+    let storage = open_configured_store(config, &actual_db, "code_chunks")
+        .await
+        .map_err(|e| CodeRagError::from_anyhow(e, CodeRagError::Database))?;
+    let searcher = CodeSearcher::new(
+        Some(storage),
+        None,
+        None,
+        None,
+        config.vector_weight,
+        config.bm25_weight,
+        config.rrf_k as f64,
+    );
+    let filter = CandidateFilter::new(None, None, options.path_globs, options.languages)
+        .map_err(|e| CodeRagError::from_anyhow(e, CodeRagError::Search))?;
+
+    if !options.json {
+        println!("Finding code similar to: '{}'", target);
+    }
+    let search_started = Instant::now();
+    let results = searcher
+        .similar(
+            &parsed,
+            options.limit.unwrap_or(config.default_limit),
+            &filter,
+            Some(&options.workspace),
+        )
+        .await
+        .map_err(|e| CodeRagError::from_anyhow(e, CodeRagError::Search))?;
+
+    print_results(
+        &target,
+        options.workspace,
+        results,
+        (options.json, false),
+        started,
+        search_started,
+    )
+}
@@ -1,8 +1,10 @@
 use tracing::info;
 
+use super::stats::require_index;
 use crate::config::AppConfig;
 use crate::core::CodeRagError;
-use crate::server::start_server;
+use crate::server::{start_server, API_TOKEN_ENV};
+use crate::storage::{store_exists, HnswParams, MultiVectorParams};
 
 pub async fn serve_api(
     port: Option<u16>,
@@ -19,17 +21,104 @@ pub async fn serve_api(
         host: actual_host,
         port: actual_port,
         db_path: actual_db,
+        storage_backend: config.storage_backend.clone(),
+        vector_index: HnswParams::from_config(config)
+            .map_err(|e| CodeRagError::Server(e.to_string()))?,
+        multi_vector: MultiVectorParams::from_config(config)
+            .map_err(|e| CodeRagError::Server(e.to_string()))?,
+        distance_metric: config
+            .metric()
+            .map_err(|e| CodeRagError::Server(e.to_string()))?,
+        bm25_doc_boost: config.bm25_doc_boost,
+        query_cache_size: config.query_cache_size,
+        embedding_provider: config.embedding_provider.clone(),
+        embedding_remote: crate::embedding::RemoteOptions::from_config(config),
         embedding_model: config.embedding_model.clone(),
         reranker_model: config.reranker_model.clone(),
+        reranker: config.reranker.clone(),
+        rerank_top_k: config.rerank_top_k,
+        symbol_weight: config.symbol_weight,
+        min_score: config.min_score,
         embedding_model_path: config.embedding_model_path.clone(),
         reranker_model_path: config.reranker_model_path.clone(),
+        onnx_reranker: crate::rerank::OnnxRerankerOptions::from_config(config),
         device: config.device.clone(),
         llm_enabled: config.llm_enabled,
         llm_host: config.llm_host.clone(),
         llm_model: config.llm_model.clone(),
+        auth_token: std::env::var(API_TOKEN_ENV)
+            .ok()
+            .filter(|token| !token.trim().is_empty()),
     })
     .await
     .map_err(|e| CodeRagError::Server(e.to_string()))?;
 
     Ok(())
 }
+
+/// Fails with [`CodeRagError::IndexNotFound`] or [`CodeRagError::EmptyIndex`]
+/// if `code-rag serve` would have nothing to search: workspaces are only
+/// loaded on their first request, so the server would otherwise start and
+/// fail every query. `start` skips this,
+/// as its watcher may be about to create the index.
+pub async fn require_served_index(
+    db_path: Option<&str>,
+    config: &AppConfig,
+) -> Result<(), CodeRagError> {
+    let db_path = db_path.unwrap_or(&config.db_path);
+    match require_index(config, db_path, "default").await {
+        Err(CodeRagError::IndexNotFound(_) | CodeRagError::EmptyIndex(_))
+            if has_workspace_index(config, db_path) =>
+        {
+            Ok(())
+        }
+        result => result.map(|_| ()),
+    }
+}
+
+/// True if a directory of `db_path` holds the index of a named workspace.
+fn has_workspace_index(config: &AppConfig, db_path: &str) -> bool {
+    std::fs::read_dir(db_path)
+        .map(|entries| {
+            entries.flatten().any(|entry| {
+                entry.path().is_dir()
+                    && store_exists(
+                        &config.storage_backend,
+                        &entry.path().to_string_lossy(),
+                        "code_chunks",
+                    )
+            })
+        })
+        .unwrap_or(false)
+}
+
+/// Splits a listen address such as `127.0.0.1:7777` or `:7777` into host and port.
+///
+/// An empty host (`:7777`) yields `None`, leaving the host to `server_host`.
+pub fn parse_addr(addr: &str) -> Result<(Option<String>, u16), CodeRagError> {
+    let invalid = || CodeRagError::Server(format!("Invalid listen address '{}'", addr));
+    let (host, port) = addr.rsplit_once(':').ok_or_else(invalid)?;
+    let port = port.parse::<u16>().map_err(|_| invalid())?;
+    let host = host.trim_start_matches('[').trim_end_matches(']');
+    Ok(((!host.is_empty()).then(|| host.to_string()), port))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_addr() {
+        assert_eq!(parse_addr(":7777").unwrap(), (None, 7777));
+        assert_eq!(
+            parse_addr("0.0.0.0:8080").unwrap(),
+            (Some("0.0.0.0".to_string()), 8080)
+        );
+        assert_eq!(
+            parse_addr("[::1]:80").unwrap(),
+            (Some("::1".to_string()), 80)
+        );
+        assert!(parse_addr("7777").is_err());
+        assert!(parse_addr("localhost:http").is_err());
+    }
+}
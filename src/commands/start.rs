@@ -1,10 +1,17 @@
 use anyhow::{Context, Result};
+use std::collections::HashSet;
 use std::path::{Path, PathBuf};
+use std::time::Duration;
 use tokio::task::JoinSet;
-use tracing::{error, info};
+use tracing::{error, info, warn};
 
 use crate::commands::{mcp, serve, watch};
 use crate::config::AppConfig;
+use crate::core::CancelToken;
+use crate::storage::store_exists;
+
+/// How long watchers get to flush their index after Ctrl-C.
+const SHUTDOWN_GRACE: Duration = Duration::from_secs(10);
 
 pub async fn run(config: &AppConfig) -> Result<()> {
     if !config.enable_server && !config.enable_mcp && !config.enable_watch {
@@ -13,6 +20,9 @@ pub async fn run(config: &AppConfig) -> Result<()> {
         ));
     }
 
+    let cancel = CancelToken::new();
+    cancel.cancel_on_interrupt();
+
     // Auto-index empty workspaces before starting services
     if config.enable_server || config.enable_watch {
         info!("Checking workspaces for initial indexing...");
@@ -38,9 +48,8 @@ pub async fn run(config: &AppConfig) -> Result<()> {
                     .to_string()
             };
 
-            // Check if workspace is empty (no code_chunks.lance table)
-            let lance_table_path = Path::new(&db_path).join("code_chunks.lance");
-            if !lance_table_path.exists() {
+            // Check if workspace is empty (no chunk table yet)
+            if !store_exists(&config.storage_backend, &db_path, "code_chunks") {
                 info!(
                     "Workspace '{}' is empty. Triggering initial indexing from '{}'...",
                     name, source_path
@@ -53,11 +62,27 @@ pub async fn run(config: &AppConfig) -> Result<()> {
                     workspace: name.clone(), // Use actual workspace name for tagging chunks
                     update: false,           // Fresh index, not update
                     force: false,            // Don't force reindex
+                    resume: false,
                     batch_size: Some(config.batch_size),
                     threads: config.threads,
+                    concurrency: None,
+                    languages: Vec::new(),
+                    include: Vec::new(),
+                    exclude: Vec::new(),
+                    collection: None,
+                    rev: None,
+                    since: None,
+                    since_ref: None,
+                    dry_run: false,
+                    json: false,
+                    progress: crate::commands::index::ProgressMode::detect(false),
+                    cancel: cancel.clone(),
                 };
 
                 if let Err(e) = crate::commands::index::index_codebase(index_opts, config).await {
+                    if cancel.is_cancelled() {
+                        return Err(e.into());
+                    }
                     error!("Failed to auto-index workspace '{}': {:#}", name, e);
                     info!("Continuing with other services. You can manually index later.");
                 } else {
@@ -129,16 +154,26 @@ pub async fn run(config: &AppConfig) -> Result<()> {
     }
 
     // 3. Start Watcher
+    let mut watchers = HashSet::new();
     if config.enable_watch {
         if config.workspaces.is_empty() {
             let config_clone = config.clone();
-            set.spawn(async move {
+            let cancel = cancel.clone();
+            let task = set.spawn(async move {
                 info!("Starting File Watcher (Default)...");
                 let path = Some(config_clone.default_index_path.clone());
-                watch::watch_codebase(path, None, "default".to_string(), &config_clone)
-                    .await
-                    .context("Watcher task failed")
+                watch::watch_codebase(
+                    path,
+                    None,
+                    "default".to_string(),
+                    None,
+                    cancel,
+                    &config_clone,
+                )
+                .await
+                .context("Watcher task failed")
             });
+            watchers.insert(task.id());
         } else {
             for (name, path_str) in &config.workspaces {
                 let config_clone = config.clone();
@@ -153,15 +188,24 @@ pub async fn run(config: &AppConfig) -> Result<()> {
                 };
                 let db_path = db_path_buf.to_string_lossy().to_string();
 
-                set.spawn(async move {
+                let cancel = cancel.clone();
+                let task = set.spawn(async move {
                     info!(
                         "Starting File Watcher for workspace '{}' at '{}'",
                         name, path_to_watch
                     );
-                    watch::watch_codebase(Some(path_to_watch), Some(db_path), name, &config_clone)
-                        .await
-                        .context("Watcher task failed")
+                    watch::watch_codebase(
+                        Some(path_to_watch),
+                        Some(db_path),
+                        name,
+                        None,
+                        cancel,
+                        &config_clone,
+                    )
+                    .await
+                    .context("Watcher task failed")
                 });
+                watchers.insert(task.id());
             }
         }
     }
@@ -183,8 +227,21 @@ pub async fn run(config: &AppConfig) -> Result<()> {
                     }
                 }
             }
-            _ = tokio::signal::ctrl_c() => {
+            _ = cancel.cancelled() => {
                 info!("\nShutdown signal received. Terminating all services...");
+                // Watchers flush their index before returning
+                let flushed = async {
+                    while !watchers.is_empty() {
+                        match set.join_next_with_id().await {
+                            Some(Ok((id, _))) => watchers.remove(&id),
+                            Some(Err(e)) => watchers.remove(&e.id()),
+                            None => break,
+                        };
+                    }
+                };
+                if tokio::time::timeout(SHUTDOWN_GRACE, flushed).await.is_err() {
+                    warn!("File watchers did not stop in time; recent changes may not be saved.");
+                }
                 // Dropping 'set' will automatically cancel all remaining tasks
                 break;
             }
@@ -0,0 +1,413 @@
+use colored::*;
+use serde::Serialize;
+use std::collections::{BTreeMap, HashMap};
+use std::fs;
+use std::path::Path;
+use tracing::warn;
+
+use crate::config::AppConfig;
+use crate::core::CodeRagError;
+use crate::manifest::{is_in_progress, IndexManifest};
+use crate::storage::{index_status, open_store, store_exists, ChunkInfo};
+
+/// Number of files listed under "Largest files".
+const LARGEST_FILES: usize = 10;
+
+pub struct StatsOptions {
+    pub workspace: String,
+    pub db_path: Option<String>,
+    pub json: bool,
+}
+
+/// Files and chunks sharing a language, extension or collection.
+#[derive(Serialize, Debug, Default, Clone, PartialEq)]
+pub struct Breakdown {
+    pub files: usize,
+    pub chunks: usize,
+}
+
+/// Chunk count of a single file.
+#[derive(Serialize, Debug, Clone, PartialEq)]
+pub struct FileChunks {
+    pub file: String,
+    pub chunks: usize,
+}
+
+/// Summary of a workspace index, printed by `code-rag stats`.
+#[derive(Serialize, Debug, Default)]
+#[serde(rename_all = "camelCase")]
+pub struct IndexStats {
+    pub workspace: String,
+    pub db_path: String,
+    pub total_files: usize,
+    pub total_chunks: usize,
+    /// Keyed by language; `unknown` for chunks indexed without one
+    pub languages: BTreeMap<String, Breakdown>,
+    /// Keyed by lowercase extension with its dot (`.rs`); `(none)` without one
+    pub extensions: BTreeMap<String, Breakdown>,
+    /// Keyed by `index --collection`; `(none)` for chunks indexed without one
+    pub collections: BTreeMap<String, Breakdown>,
+    pub embedding_model: Option<String>,
+    pub embedding_dim: Option<usize>,
+    /// Bytes used on disk by the vector store, BM25 index and metadata files
+    pub size_bytes: u64,
+    /// Oldest file modification time recorded at index time (Unix seconds)
+    pub oldest_mtime: Option<i64>,
+    /// Newest file modification time recorded at index time (Unix seconds)
+    pub newest_mtime: Option<i64>,
+    /// Files with the most chunks, largest first
+    pub largest_files: Vec<FileChunks>,
+    /// Chunks `dedup_chunks` merged into a copy stored elsewhere instead of
+    /// storing them, from the manifest
+    pub duplicates_merged: usize,
+}
+
+impl IndexStats {
+    /// Aggregates stored chunk metadata; the embedding and size fields are left empty.
+    pub fn from_chunks(workspace: &str, db_path: &str, chunks: &[ChunkInfo]) -> Self {
+        let mut per_file: HashMap<&str, (usize, String, String, String)> = HashMap::new();
+        let mut stats = Self {
+            workspace: workspace.to_string(),
+            db_path: db_path.to_string(),
+            total_chunks: chunks.len(),
+            ..Default::default()
+        };
+
+        for chunk in chunks {
+            let language = chunk
+                .language
+                .clone()
+                .unwrap_or_else(|| "unknown".to_string());
+            let extension = Path::new(&chunk.filename)
+                .extension()
+                .map(|e| format!(".{}", e.to_string_lossy().to_lowercase()))
+                .unwrap_or_else(|| "(none)".to_string());
+            let collection = chunk
+                .collection
+                .clone()
+                .unwrap_or_else(|| "(none)".to_string());
+            stats.languages.entry(language.clone()).or_default().chunks += 1;
+            stats
+                .extensions
+                .entry(extension.clone())
+                .or_default()
+                .chunks += 1;
+            stats
+                .collections
+                .entry(collection.clone())
+                .or_default()
+                .chunks += 1;
+            per_file
+                .entry(&chunk.filename)
+                .or_insert((0, language, extension, collection))
+                .0 += 1;
+
+            stats.oldest_mtime = Some(
+                stats
+                    .oldest_mtime
+                    .map_or(chunk.last_modified, |t| t.min(chunk.last_modified)),
+            );
+            stats.newest_mtime = Some(
+                stats
+                    .newest_mtime
+                    .map_or(chunk.last_modified, |t| t.max(chunk.last_modified)),
+            );
+        }
+
+        stats.total_files = per_file.len();
+        for (_, language, extension, collection) in per_file.values() {
+            if let Some(b) = stats.languages.get_mut(language) {
+                b.files += 1;
+            }
+            if let Some(b) = stats.extensions.get_mut(extension) {
+                b.files += 1;
+            }
+            if let Some(b) = stats.collections.get_mut(collection) {
+                b.files += 1;
+            }
+        }
+
+        let mut files: Vec<FileChunks> = per_file
+            .into_iter()
+            .map(|(file, (chunks, ..))| FileChunks {
+                file: file.to_string(),
+                chunks,
+            })
+            .collect();
+        files.sort_by(|a, b| b.chunks.cmp(&a.chunks).then_with(|| a.file.cmp(&b.file)));
+        files.truncate(LARGEST_FILES);
+        stats.largest_files = files;
+        stats
+    }
+}
+
+/// Fails with [`CodeRagError::IndexNotFound`] or [`CodeRagError::EmptyIndex`]
+/// unless the `workspace` index in
+/// `db_path` holds chunks, so commands reading it can say how to create it
+/// instead of failing on a missing table or finding nothing. Returns the
+/// number of chunks.
+pub(super) async fn require_index(
+    config: &AppConfig,
+    db_path: &str,
+    workspace: &str,
+) -> Result<usize, CodeRagError> {
+    let status = index_status(&config.storage_backend, db_path, "code_chunks")
+        .await
+        .map_err(|e| {
+            CodeRagError::Database(format!("Failed to read the index at {}: {}", db_path, e))
+        })?;
+    status.ready(db_path, workspace)
+}
+
+pub async fn show_stats(options: StatsOptions, config: &AppConfig) -> Result<(), CodeRagError> {
+    let base_db = options.db_path.unwrap_or_else(|| config.db_path.clone());
+    let actual_db = if options.workspace == "default" {
+        base_db
+    } else {
+        Path::new(&base_db)
+            .join(&options.workspace)
+            .to_string_lossy()
+            .to_string()
+    };
+
+    require_index(config, &actual_db, &options.workspace).await?;
+    if is_in_progress(&actual_db) {
+        warn!(
+            "Index at {} is being written or a previous indexing run was interrupted; stats may be incomplete.",
+            actual_db
+        );
+    }
+
+    let metric = config
+        .metric()
+        .map_err(|e| CodeRagError::Database(e.to_string()))?;
+    let storage = open_store(&config.storage_backend, metric, &actual_db, "code_chunks")
+        .await
+        .map_err(|e| CodeRagError::Database(e.to_string()))?;
+    let chunks = storage
+        .list_chunk_info(&options.workspace)
+        .await
+        .map_err(|e| CodeRagError::Database(e.to_string()))?;
+
+    let mut stats = IndexStats::from_chunks(&options.workspace, &actual_db, &chunks);
+    if let Some(manifest) =
+        IndexManifest::load(&actual_db).map_err(|e| CodeRagError::Database(e.to_string()))?
+    {
+        stats.embedding_model = manifest.embedding_model;
+        stats.embedding_dim = manifest.embedding_dim;
+        stats.duplicates_merged = manifest.merged_chunks();
+    }
+    stats.size_bytes = index_size(Path::new(&actual_db), &config.storage_backend);
+
+    if options.json {
+        println!("{}", serde_json::to_string_pretty(&stats)?);
+    } else {
+        print_stats(&stats);
+    }
+    Ok(())
+}
+
+fn print_stats(stats: &IndexStats) {
+    println!(
+        "{} {} (workspace '{}')",
+        "Index:".bold(),
+        stats.db_path,
+        stats.workspace
+    );
+    println!("  Files:      {}", stats.total_files);
+    println!("  Chunks:     {}", stats.total_chunks);
+    if stats.duplicates_merged > 0 {
+        println!(
+            "  Merged:     {} duplicate chunks, stored once",
+            stats.duplicates_merged
+        );
+    }
+    let embedding = match (&stats.embedding_model, stats.embedding_dim) {
+        (Some(model), Some(dim)) => format!("{} ({} dimensions)", model, dim),
+        (Some(model), None) => model.clone(),
+        _ => "unknown (index has no manifest)".to_string(),
+    };
+    println!("  Embedding:  {}", embedding);
+    println!("  Size:       {}", format_size(stats.size_bytes));
+    if let (Some(oldest), Some(newest)) = (stats.oldest_mtime, stats.newest_mtime) {
+        println!(
+            "  Modified:   {} .. {}",
+            format_timestamp(oldest),
+            format_timestamp(newest)
+        );
+    }
+
+    // Indexes without collections would only list "(none)"
+    let collections = if stats.collections.keys().any(|c| c != "(none)") {
+        stats.collections.clone()
+    } else {
+        BTreeMap::new()
+    };
+    for (title, breakdown) in [
+        ("By language:", &stats.languages),
+        ("By extension:", &stats.extensions),
+        ("By collection:", &collections),
+    ] {
+        if breakdown.is_empty() {
+            continue;
+        }
+        println!("\n{}", title.bold());
+        let mut rows: Vec<(&String, &Breakdown)> = breakdown.iter().collect();
+        rows.sort_by(|a, b| b.1.chunks.cmp(&a.1.chunks).then_with(|| a.0.cmp(b.0)));
+        for (name, b) in rows {
+            println!("  {:<14} {:>7} files {:>9} chunks", name, b.files, b.chunks);
+        }
+    }
+
+    if !stats.largest_files.is_empty() {
+        println!("\n{}", "Largest files (by chunks):".bold());
+        for f in &stats.largest_files {
+            println!("  {:>7}  {}", f.chunks, f.file);
+        }
+    }
+}
+
+/// Bytes used by the index in `db_path`, not counting the indexes of other
+/// workspaces nested inside it.
+fn index_size(db_path: &Path, backend: &str) -> u64 {
+    let Ok(entries) = fs::read_dir(db_path) else {
+        return 0;
+    };
+    entries
+        .flatten()
+        .map(|entry| {
+            let path = entry.path();
+            if !path.is_dir() {
+                entry.metadata().map(|m| m.len()).unwrap_or(0)
+            } else if store_exists(backend, &path.to_string_lossy(), "code_chunks") {
+                0
+            } else {
+                dir_size(&path)
+            }
+        })
+        .sum()
+}
+
+fn dir_size(path: &Path) -> u64 {
+    let Ok(entries) = fs::read_dir(path) else {
+        return 0;
+    };
+    entries
+        .flatten()
+        .map(|entry| match entry.metadata() {
+            Ok(m) if m.is_dir() => dir_size(&entry.path()),
+            Ok(m) => m.len(),
+            Err(_) => 0,
+        })
+        .sum()
+}
+
+fn format_size(bytes: u64) -> String {
+    const UNITS: [&str; 4] = ["KiB", "MiB", "GiB", "TiB"];
+    if bytes < 1024 {
+        return format!("{} B", bytes);
+    }
+    let mut size = bytes as f64 / 1024.0;
+    let mut unit = 0;
+    while size >= 1024.0 && unit < UNITS.len() - 1 {
+        size /= 1024.0;
+        unit += 1;
+    }
+    format!("{:.1} {}", size, UNITS[unit])
+}
+
+fn format_timestamp(secs: i64) -> String {
+    let format =
+        time::macros::format_description!("[year]-[month]-[day] [hour]:[minute]:[second] UTC");
+    time::OffsetDateTime::from_unix_timestamp(secs)
+        .ok()
+        .and_then(|t| t.format(&format).ok())
+        .unwrap_or_else(|| secs.to_string())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn info(filename: &str, language: Option<&str>, last_modified: i64) -> ChunkInfo {
+        ChunkInfo {
+            filename: filename.to_string(),
+            language: language.map(str::to_string),
+            last_modified,
+            collection: None,
+        }
+    }
+
+    #[test]
+    fn test_from_chunks() {
+        let chunks = vec![
+            info("src/main.rs", Some("rust"), 300),
+            info("src/main.rs", Some("rust"), 300),
+            info("src/lib.rs", Some("rust"), 100),
+            info("app/auth.py", Some("python"), 200),
+            info("Makefile", None, 150),
+        ];
+        let stats = IndexStats::from_chunks("default", ".db", &chunks);
+        assert_eq!(stats.total_files, 4);
+        assert_eq!(stats.total_chunks, 5);
+        assert_eq!(
+            stats.languages["rust"],
+            Breakdown {
+                files: 2,
+                chunks: 3
+            }
+        );
+        assert_eq!(stats.languages["unknown"].files, 1);
+        assert_eq!(stats.extensions[".py"].chunks, 1);
+        assert_eq!(stats.extensions["(none)"].files, 1);
+        assert_eq!(
+            (stats.oldest_mtime, stats.newest_mtime),
+            (Some(100), Some(300))
+        );
+        assert_eq!(stats.largest_files[0].file, "src/main.rs");
+        assert_eq!(stats.largest_files[0].chunks, 2);
+        assert_eq!(stats.collections["(none)"].files, 4);
+
+        let empty = IndexStats::from_chunks("default", ".db", &[]);
+        assert_eq!(empty.total_files, 0);
+        assert_eq!(empty.oldest_mtime, None);
+    }
+
+    #[test]
+    fn test_collections() {
+        let mut backend = info("api/server.go", Some("go"), 1);
+        backend.collection = Some("backend".to_string());
+        let chunks = vec![
+            backend.clone(),
+            backend,
+            info("README.md", Some("markdown"), 1),
+        ];
+        let stats = IndexStats::from_chunks("default", ".db", &chunks);
+        assert_eq!(
+            stats.collections["backend"],
+            Breakdown {
+                files: 1,
+                chunks: 2
+            }
+        );
+        assert_eq!(stats.collections["(none)"].chunks, 1);
+    }
+
+    #[test]
+    fn test_json_shape() {
+        let stats = IndexStats::from_chunks("default", ".db", &[info("a.go", Some("go"), 1)]);
+        let value = serde_json::to_value(&stats).unwrap();
+        assert_eq!(value["totalFiles"], 1);
+        assert_eq!(value["languages"]["go"]["chunks"], 1);
+        assert!(value["embeddingModel"].is_null());
+        assert_eq!(value["largestFiles"][0]["file"], "a.go");
+    }
+
+    #[test]
+    fn test_format_size_and_timestamp() {
+        assert_eq!(format_size(512), "512 B");
+        assert_eq!(format_size(1536), "1.5 KiB");
+        assert_eq!(format_size(5 * 1024 * 1024), "5.0 MiB");
+        assert_eq!(format_timestamp(0), "1970-01-01 00:00:00 UTC");
+    }
+}
@@ -0,0 +1,706 @@
+use colored::*;
+use serde::Serialize;
+use std::collections::{BTreeMap, BTreeSet, HashMap, HashSet};
+use std::path::Path;
+use tracing::{info, warn};
+
+use super::export::workspace_db;
+use crate::bm25::BM25Index;
+use crate::callgraph::CallGraph;
+use crate::config::AppConfig;
+use crate::core::CodeRagError;
+use crate::indexer::{revision_path, CodeChunk};
+use crate::manifest::{
+    bump_index_version, clear_in_progress, is_in_progress, mark_in_progress, IndexManifest,
+};
+use crate::storage::{open_configured_store, store_exists, StoredVector, VectorStore};
+
+pub struct VerifyOptions {
+    pub workspace: String,
+    /// Drop the chunks and manifest entries found broken, see [`plan_repair`]
+    pub repair: bool,
+    pub json: bool,
+}
+
+/// Invariant of an index that a [`Problem`] breaks.
+#[derive(Serialize, Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord)]
+#[serde(rename_all = "kebab-case")]
+pub enum ProblemKind {
+    /// A vector's length differs from the index's dimension
+    WrongDimension,
+    /// A vector has NaN or infinite components, or is all zeros
+    InvalidVector,
+    /// A chunk ID is stored more than once
+    DuplicateId,
+    /// Chunks are stored for a file the manifest doesn't list
+    OrphanedFile,
+    /// The manifest lists chunks of a file that aren't stored
+    MissingChunks,
+    /// Chunks of a file are stored that its manifest entry doesn't list
+    UnlistedChunks,
+    /// An indexed file no longer exists on disk
+    MissingSource,
+    /// `manifest.json` can't be read or parsed
+    UnreadableManifest,
+    /// An indexing run is writing to the index or was interrupted
+    Interrupted,
+}
+
+impl ProblemKind {
+    /// Whether the problem fails the check; the others are warnings.
+    pub fn is_error(self) -> bool {
+        self != Self::MissingSource
+    }
+}
+
+/// A broken invariant found by `code-rag verify`.
+#[derive(Serialize, Debug, Clone, PartialEq)]
+#[serde(rename_all = "camelCase")]
+pub struct Problem {
+    pub kind: ProblemKind,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub file: Option<String>,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub chunk_id: Option<String>,
+    pub message: String,
+}
+
+impl Problem {
+    fn new(kind: ProblemKind, file: Option<&str>, chunk_id: Option<&str>, message: String) -> Self {
+        Self {
+            kind,
+            file: file.map(str::to_string),
+            chunk_id: chunk_id.map(str::to_string),
+            message,
+        }
+    }
+}
+
+/// What `code-rag verify` found, and repaired with `--repair`.
+#[derive(Serialize, Debug, Default)]
+#[serde(rename_all = "camelCase")]
+pub struct VerifyReport {
+    pub workspace: String,
+    pub db_path: String,
+    pub chunks: usize,
+    pub files: usize,
+    /// Dimension the vectors were checked against, `null` for an empty index
+    pub embedding_dim: Option<usize>,
+    pub problems: Vec<Problem>,
+    /// Files whose chunks `--repair` removed; `index --update` indexes them again
+    pub dropped_files: Vec<String>,
+    /// Files `--repair` rewrote without their duplicate or unlisted chunks
+    pub rewritten_files: Vec<String>,
+}
+
+impl VerifyReport {
+    pub fn errors(&self) -> usize {
+        self.problems.iter().filter(|p| p.kind.is_error()).count()
+    }
+
+    /// Whether errors remain that `--repair` didn't fix.
+    fn failed(&self, repaired: bool) -> bool {
+        self.problems.iter().any(|p| {
+            p.kind.is_error()
+                && !(repaired
+                    && !matches!(
+                        p.kind,
+                        ProblemKind::UnreadableManifest | ProblemKind::Interrupted
+                    ))
+        })
+    }
+}
+
+/// The dimension of the index: the one recorded in the manifest, or for
+/// indexes without one the most common vector length.
+fn index_dim(vectors: &[StoredVector], manifest: Option<&IndexManifest>) -> Option<usize> {
+    if let Some(dim) = manifest.and_then(|m| m.embedding_dim) {
+        return Some(dim);
+    }
+    let mut counts: HashMap<usize, usize> = HashMap::new();
+    for stored in vectors {
+        *counts.entry(stored.vector.len()).or_default() += 1;
+    }
+    counts
+        .into_iter()
+        .max_by_key(|(dim, count)| (*count, *dim))
+        .map(|(dim, _)| dim)
+}
+
+/// Checks the stored vectors of one workspace against each other and against
+/// the manifest, if the index has one.
+fn check_index(
+    vectors: &[StoredVector],
+    manifest: Option<&IndexManifest>,
+    dim: Option<usize>,
+) -> Vec<Problem> {
+    let mut problems = Vec::new();
+    let mut seen: HashMap<&str, usize> = HashMap::new();
+    let mut stored: BTreeMap<&str, Vec<&str>> = BTreeMap::new();
+    for v in vectors {
+        let file = Some(v.filename.as_str());
+        let id = Some(v.id.as_str());
+        if dim.is_some_and(|dim| v.vector.len() != dim) {
+            problems.push(Problem::new(
+                ProblemKind::WrongDimension,
+                file,
+                id,
+                format!(
+                    "Vector has {} dimensions, but the index has {}",
+                    v.vector.len(),
+                    dim.unwrap_or_default()
+                ),
+            ));
+        } else if v.vector.iter().any(|x| !x.is_finite()) || v.vector.iter().all(|x| *x == 0.0) {
+            problems.push(Problem::new(
+                ProblemKind::InvalidVector,
+                file,
+                id,
+                "Vector has NaN or infinite components, or is all zeros".to_string(),
+            ));
+        }
+        let copies = seen.entry(&v.id).or_default();
+        *copies += 1;
+        if *copies == 2 {
+            problems.push(Problem::new(
+                ProblemKind::DuplicateId,
+                file,
+                id,
+                "Chunk ID is stored more than once".to_string(),
+            ));
+        }
+        stored.entry(&v.filename).or_default().push(&v.id);
+    }
+
+    let Some(manifest) = manifest else {
+        return problems;
+    };
+    for (file, ids) in &stored {
+        let Some(entry) = manifest.get(file) else {
+            problems.push(Problem::new(
+                ProblemKind::OrphanedFile,
+                Some(*file),
+                None,
+                format!(
+                    "{} chunks are stored for a file the manifest doesn't list",
+                    ids.len()
+                ),
+            ));
+            continue;
+        };
+        let listed: HashSet<&str> = entry.chunk_ids.iter().map(String::as_str).collect();
+        let unlisted = ids.iter().filter(|id| !listed.contains(*id)).count();
+        if unlisted > 0 {
+            problems.push(Problem::new(
+                ProblemKind::UnlistedChunks,
+                Some(*file),
+                None,
+                format!("{} stored chunks aren't listed in the manifest", unlisted),
+            ));
+        }
+    }
+    for (file, entry) in &manifest.files {
+        let ids: HashSet<&str> = stored
+            .get(file.as_str())
+            .map(|ids| ids.iter().copied().collect())
+            .unwrap_or_default();
+        let missing = entry
+            .chunk_ids
+            .iter()
+            .filter(|id| !ids.contains(id.as_str()))
+            .count();
+        if missing > 0 {
+            problems.push(Problem::new(
+                ProblemKind::MissingChunks,
+                Some(file.as_str()),
+                None,
+                format!(
+                    "The manifest lists {} chunks of the file that aren't stored",
+                    missing
+                ),
+            ));
+        }
+    }
+    problems
+}
+
+/// Files `--repair` touches, by what it does to them.
+#[derive(Debug, Default, PartialEq)]
+struct RepairPlan {
+    /// Files whose chunks are all removed, and their manifest entries, so the
+    /// next `index --update` embeds them again
+    drop: BTreeSet<String>,
+    /// Files rewritten with the first copy of each chunk the manifest lists
+    rewrite: BTreeSet<String>,
+}
+
+/// Decides how to fix `problems`. A file with a broken vector or a manifest
+/// entry that doesn't match the store can't be trusted and is dropped; a
+/// file with only surplus chunks keeps the ones the manifest lists.
+fn plan_repair(problems: &[Problem]) -> RepairPlan {
+    let mut plan = RepairPlan::default();
+    for problem in problems {
+        let Some(file) = &problem.file else {
+            continue;
+        };
+        match problem.kind {
+            ProblemKind::WrongDimension
+            | ProblemKind::InvalidVector
+            | ProblemKind::OrphanedFile
+            | ProblemKind::MissingChunks => {
+                plan.drop.insert(file.clone());
+            }
+            ProblemKind::DuplicateId | ProblemKind::UnlistedChunks => {
+                plan.rewrite.insert(file.clone());
+            }
+            ProblemKind::MissingSource
+            | ProblemKind::UnreadableManifest
+            | ProblemKind::Interrupted => {}
+        }
+    }
+    plan.rewrite.retain(|file| !plan.drop.contains(file));
+    plan
+}
+
+/// Applies `plan` to the vector store and returns the chunks each touched
+/// file keeps, empty for dropped files.
+async fn repair_store(
+    storage: &dyn VectorStore,
+    plan: &RepairPlan,
+    manifest: Option<&IndexManifest>,
+    workspace: &str,
+) -> anyhow::Result<BTreeMap<String, Vec<CodeChunk>>> {
+    let mut kept_by_file = BTreeMap::new();
+    let dropped: Vec<String> = plan.drop.iter().cloned().collect();
+    if !dropped.is_empty() {
+        storage.batch_delete_files(&dropped, workspace).await?;
+    }
+    for file in dropped {
+        kept_by_file.insert(file, Vec::new());
+    }
+
+    for file in &plan.rewrite {
+        let listed: Option<HashSet<&str>> = manifest
+            .and_then(|m| m.get(file))
+            .map(|entry| entry.chunk_ids.iter().map(String::as_str).collect());
+        let mut seen = HashSet::new();
+        let (kept, vectors): (Vec<CodeChunk>, Vec<Vec<f32>>) = storage
+            .get_file_chunks(file, workspace)
+            .await?
+            .into_iter()
+            .filter(|(chunk, _)| {
+                let id = chunk.id();
+                listed.as_ref().is_none_or(|l| l.contains(id.as_str())) && seen.insert(id)
+            })
+            .unzip();
+        // Stores replace by file, so the kept chunks are written back
+        storage
+            .replace_files(workspace, std::slice::from_ref(file), &kept, vectors)
+            .await?;
+        kept_by_file.insert(file.clone(), kept);
+    }
+    Ok(kept_by_file)
+}
+
+/// Loads the index of a workspace and checks that every chunk has a usable
+/// vector of the index's dimension, that no chunk ID is stored twice and that
+/// the manifest lists exactly the stored chunks. Indexed files missing on
+/// disk are reported as warnings.
+///
+/// Prints the problems found and fails if any is an error, so the command can
+/// gate CI. With `repair`, broken files are removed from the vector store,
+/// BM25 index, call graph and manifest instead (see [`plan_repair`]), and the
+/// command only fails on problems it can't fix.
+pub async fn verify_index(options: VerifyOptions, config: &AppConfig) -> Result<(), CodeRagError> {
+    let actual_db = workspace_db(config, &options.workspace);
+    if !store_exists(&config.storage_backend, &actual_db, "code_chunks") {
+        return Err(CodeRagError::Database(format!(
+            "No index found for workspace '{}' at {}.\n\
+            Run 'code-rag index --path <path> --workspace {}' to create it.",
+            options.workspace, actual_db, options.workspace
+        )));
+    }
+    let interrupted = is_in_progress(&actual_db);
+    if interrupted && options.repair {
+        return Err(CodeRagError::Database(format!(
+            "Index at {} is being written or a previous indexing run was interrupted. \
+            Wait for it to finish, or continue it with 'index --resume', before repairing.",
+            actual_db
+        )));
+    }
+
+    let storage = open_configured_store(config, &actual_db, "code_chunks")
+        .await
+        .map_err(|e| CodeRagError::Database(e.to_string()))?;
+    let vectors: Vec<StoredVector> = storage
+        .list_vectors()
+        .await
+        .map_err(|e| CodeRagError::Database(e.to_string()))?
+        .into_iter()
+        .filter(|v| v.workspace == options.workspace)
+        .collect();
+
+    let mut problems = Vec::new();
+    if interrupted {
+        problems.push(Problem::new(
+            ProblemKind::Interrupted,
+            None,
+            None,
+            "An indexing run is writing to the index or was interrupted; continue it with \
+            'index --resume' or rebuild it with 'index --force'"
+                .to_string(),
+        ));
+    }
+    let manifest = match IndexManifest::load(&actual_db) {
+        Ok(manifest) => manifest,
+        Err(e) => {
+            problems.push(Problem::new(
+                ProblemKind::UnreadableManifest,
+                None,
+                None,
+                format!("{:#}; rebuild the index with 'index --force'", e),
+            ));
+            None
+        }
+    };
+    let dim = index_dim(&vectors, manifest.as_ref());
+    problems.extend(check_index(&vectors, manifest.as_ref(), dim));
+
+    let files: BTreeSet<&str> = vectors.iter().map(|v| v.filename.as_str()).collect();
+    for file in &files {
+        // Files of a git revision aren't expected in the working tree
+        if revision_path(file).is_none() && !Path::new(file).exists() {
+            problems.push(Problem::new(
+                ProblemKind::MissingSource,
+                Some(*file),
+                None,
+                "File doesn't exist relative to the current directory; 'index --update' \
+                removes it"
+                    .to_string(),
+            ));
+        }
+    }
+    let mut report = VerifyReport {
+        workspace: options.workspace.clone(),
+        db_path: actual_db.clone(),
+        chunks: vectors.len(),
+        files: files.len(),
+        embedding_dim: dim,
+        problems,
+        ..Default::default()
+    };
+    drop(vectors);
+
+    let plan = plan_repair(&report.problems);
+    if options.repair && (!plan.drop.is_empty() || !plan.rewrite.is_empty()) {
+        mark_in_progress(&actual_db).map_err(|e| CodeRagError::Database(e.to_string()))?;
+        let kept = repair_store(
+            storage.as_ref(),
+            &plan,
+            manifest.as_ref(),
+            &options.workspace,
+        )
+        .await
+        .map_err(|e| CodeRagError::Database(e.to_string()))?;
+
+        let bm25_index = BM25Index::new(&actual_db, false, &config.merge_policy)
+            .map_err(|e| CodeRagError::Tantivy(e.to_string()))?;
+        for (filename, chunks) in &kept {
+            bm25_index
+                .delete_file(filename, &options.workspace)
+                .and_then(|()| bm25_index.add_chunks(chunks, &options.workspace))
+                .map_err(|e| CodeRagError::Tantivy(e.to_string()))?;
+        }
+        bm25_index
+            .commit()
+            .map_err(|e| CodeRagError::Tantivy(e.to_string()))?;
+
+        match CallGraph::load(&actual_db) {
+            Ok(Some(mut graph)) => {
+                for (filename, chunks) in &kept {
+                    graph.insert_file(filename, chunks);
+                }
+                if let Err(e) = graph.save(&actual_db) {
+                    warn!("Failed to write call graph: {}", e);
+                }
+            }
+            Ok(None) => {}
+            Err(e) => warn!("Ignoring unreadable call graph: {}", e),
+        }
+        if let Some(mut manifest) = manifest {
+            for file in &plan.drop {
+                manifest.remove(file);
+            }
+            manifest
+                .save(&actual_db)
+                .map_err(|e| CodeRagError::Database(e.to_string()))?;
+        }
+
+        if let Err(e) = bump_index_version(&actual_db) {
+            warn!("Failed to update index version: {}", e);
+        }
+        if let Err(e) = storage.flush().await {
+            warn!("Failed to save vector index: {:#}", e);
+        }
+        clear_in_progress(&actual_db).map_err(|e| CodeRagError::Database(e.to_string()))?;
+        report.dropped_files = plan.drop.into_iter().collect();
+        report.rewritten_files = plan.rewrite.into_iter().collect();
+        info!(
+            dropped = report.dropped_files.len(),
+            rewritten = report.rewritten_files.len(),
+            "Repaired index"
+        );
+    }
+
+    if options.json {
+        println!("{}", serde_json::to_string_pretty(&report)?);
+    } else {
+        print_report(&report, options.repair);
+    }
+    if report.failed(options.repair) {
+        return Err(CodeRagError::Database(format!(
+            "Index verification failed with {} errors",
+            report.errors()
+        )));
+    }
+    Ok(())
+}
+
+fn print_report(report: &VerifyReport, repair: bool) {
+    println!(
+        "{} {} (workspace '{}')",
+        "Index:".bold(),
+        report.db_path,
+        report.workspace
+    );
+    let dim = report
+        .embedding_dim
+        .map(|d| format!(", {} dimensions", d))
+        .unwrap_or_default();
+    println!(
+        "  {} chunks in {} files{}",
+        report.chunks, report.files, dim
+    );
+    if report.problems.is_empty() {
+        println!("{}", "No problems found.".green());
+        return;
+    }
+
+    let errors = report.errors();
+    println!(
+        "\n{} {} errors, {} warnings",
+        "Problems:".bold(),
+        errors,
+        report.problems.len() - errors
+    );
+    for problem in &report.problems {
+        let severity = if problem.kind.is_error() {
+            "error  ".red()
+        } else {
+            "warning".yellow()
+        };
+        let kind = serde_json::to_value(problem.kind)
+            .ok()
+            .and_then(|v| v.as_str().map(str::to_string))
+            .unwrap_or_default();
+        let location = match (&problem.file, &problem.chunk_id) {
+            (Some(file), Some(id)) => format!(" {} [{}]", file, &id[..id.len().min(12)]),
+            (Some(file), None) => format!(" {}", file),
+            _ => String::new(),
+        };
+        println!("  {} {}{}: {}", severity, kind, location, problem.message);
+    }
+
+    if repair {
+        if !report.dropped_files.is_empty() || !report.rewritten_files.is_empty() {
+            println!(
+                "\nRemoved {} files and rewrote {}. Run 'code-rag index --update' to index the removed files again.",
+                report.dropped_files.len(),
+                report.rewritten_files.len()
+            );
+        }
+    } else if report
+        .problems
+        .iter()
+        .any(|p| p.kind.is_error() && p.file.is_some())
+    {
+        println!(
+            "\nRun 'code-rag verify --repair' to drop the broken chunks and manifest entries."
+        );
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::manifest::FileEntry;
+    use crate::storage::SqliteStore;
+
+    fn stored(filename: &str, id: &str, vector: Vec<f32>) -> StoredVector {
+        StoredVector {
+            workspace: "default".to_string(),
+            filename: filename.to_string(),
+            id: id.to_string(),
+            vector,
+        }
+    }
+
+    fn manifest(files: &[(&str, &[&str])]) -> IndexManifest {
+        let mut manifest = IndexManifest {
+            embedding_dim: Some(2),
+            ..Default::default()
+        };
+        for (file, ids) in files {
+            manifest.insert(
+                file.to_string(),
+                FileEntry {
+                    hash: "h".to_string(),
+                    mtime: 1,
+                    chunk_ids: ids.iter().map(|id| id.to_string()).collect(),
+                    collection: None,
+                    merged: BTreeMap::new(),
+                    tags: Vec::new(),
+                },
+            );
+        }
+        manifest
+    }
+
+    fn kinds(problems: &[Problem]) -> Vec<(ProblemKind, Option<&str>)> {
+        problems
+            .iter()
+            .map(|p| (p.kind, p.file.as_deref()))
+            .collect()
+    }
+
+    #[test]
+    fn test_healthy_index() {
+        let vectors = vec![
+            stored("a.go", "1", vec![1.0, 0.0]),
+            stored("a.go", "2", vec![0.0, 1.0]),
+        ];
+        let manifest = manifest(&[("a.go", &["1", "2"]), ("empty.go", &[])]);
+        let dim = index_dim(&vectors, Some(&manifest));
+        assert_eq!(dim, Some(2));
+        assert!(check_index(&vectors, Some(&manifest), dim).is_empty());
+    }
+
+    #[test]
+    fn test_vector_problems() {
+        let vectors = vec![
+            stored("a.go", "1", vec![1.0, 0.0]),
+            stored("a.go", "2", vec![1.0, 0.0, 0.0]),
+            stored("b.go", "3", vec![f32::NAN, 0.0]),
+            stored("b.go", "4", vec![0.0, 0.0]),
+            stored("c.go", "5", vec![0.0, 1.0]),
+            stored("c.go", "5", vec![0.0, 1.0]),
+        ];
+        // Without a manifest the most common length is the dimension
+        let dim = index_dim(&vectors, None);
+        assert_eq!(dim, Some(2));
+        assert_eq!(
+            kinds(&check_index(&vectors, None, dim)),
+            vec![
+                (ProblemKind::WrongDimension, Some("a.go")),
+                (ProblemKind::InvalidVector, Some("b.go")),
+                (ProblemKind::InvalidVector, Some("b.go")),
+                (ProblemKind::DuplicateId, Some("c.go")),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_manifest_mismatches() {
+        let vectors = vec![
+            stored("a.go", "1", vec![1.0, 0.0]),
+            stored("a.go", "stale", vec![1.0, 0.0]),
+            stored("orphan.go", "2", vec![1.0, 0.0]),
+        ];
+        let manifest = manifest(&[("a.go", &["1"]), ("gone.go", &["3"])]);
+        assert_eq!(
+            kinds(&check_index(&vectors, Some(&manifest), Some(2))),
+            vec![
+                (ProblemKind::UnlistedChunks, Some("a.go")),
+                (ProblemKind::OrphanedFile, Some("orphan.go")),
+                (ProblemKind::MissingChunks, Some("gone.go")),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_plan_repair() {
+        let problem = |kind, file: &str| Problem::new(kind, Some(file), None, String::new());
+        let plan = plan_repair(&[
+            problem(ProblemKind::DuplicateId, "a.go"),
+            problem(ProblemKind::DuplicateId, "b.go"),
+            problem(ProblemKind::InvalidVector, "b.go"),
+            problem(ProblemKind::MissingSource, "c.go"),
+            Problem::new(ProblemKind::Interrupted, None, None, String::new()),
+        ]);
+        assert_eq!(plan.drop, BTreeSet::from(["b.go".to_string()]));
+        assert_eq!(plan.rewrite, BTreeSet::from(["a.go".to_string()]));
+    }
+
+    #[test]
+    fn test_failed() {
+        let mut report = VerifyReport::default();
+        assert!(!report.failed(false));
+        report.problems.push(Problem::new(
+            ProblemKind::MissingSource,
+            Some("a.go"),
+            None,
+            String::new(),
+        ));
+        assert!(!report.failed(false));
+        report.problems.push(Problem::new(
+            ProblemKind::OrphanedFile,
+            Some("b.go"),
+            None,
+            String::new(),
+        ));
+        assert!(report.failed(false));
+        assert!(!report.failed(true));
+        report.problems.push(Problem::new(
+            ProblemKind::UnreadableManifest,
+            None,
+            None,
+            String::new(),
+        ));
+        assert!(report.failed(true));
+    }
+
+    #[tokio::test]
+    async fn test_repair_store() {
+        let store = SqliteStore::open_in_memory().unwrap();
+        store.init(2).await.unwrap();
+        let chunk = |filename: &str, line_start: usize| CodeChunk {
+            filename: filename.to_string(),
+            code: format!("line {}", line_start),
+            line_start,
+            line_end: line_start,
+            ..Default::default()
+        };
+        let listed = chunk("a.go", 1);
+        let chunks = [listed.clone(), chunk("a.go", 2), chunk("b.go", 1)];
+        store
+            .add_code_chunks("default", &chunks, vec![vec![1.0, 0.0]; 3])
+            .await
+            .unwrap();
+        let listed_id = listed.id();
+        let manifest = manifest(&[("a.go", &[listed_id.as_str()])]);
+        let plan = RepairPlan {
+            drop: BTreeSet::from(["b.go".to_string()]),
+            rewrite: BTreeSet::from(["a.go".to_string()]),
+        };
+
+        let kept = repair_store(&store, &plan, Some(&manifest), "default")
+            .await
+            .unwrap();
+        assert!(kept["b.go"].is_empty());
+        let kept_ids: Vec<String> = kept["a.go"].iter().map(CodeChunk::id).collect();
+        assert_eq!(kept_ids, vec![listed_id.clone()]);
+        let remaining = store.list_vectors().await.unwrap();
+        assert_eq!(remaining.len(), 1);
+        assert_eq!(remaining[0].id, listed_id);
+    }
+}
@@ -1,17 +1,26 @@
 use tracing::{error, info};
 
 use crate::bm25::BM25Index;
+use crate::commands::index::load_embedding_cache;
 use crate::config::AppConfig;
-use crate::core::CodeRagError;
+use crate::core::{CancelToken, CodeRagError};
 use crate::embedding::Embedder;
-use crate::indexer::CodeChunker;
-use crate::storage::Storage;
-use crate::watcher::start_watcher;
+use crate::indexer::{CodeChunker, TagRules};
+use crate::manifest::ensure_compatible_embedder;
+use crate::redact::Redactor;
+use crate::storage::open_configured_store;
+use crate::summary::Summarizer;
+use crate::watcher::{start_watcher, WatchOptions};
+use std::sync::Arc;
+use std::time::Duration;
 
+/// Keeps the index of `path` up to date until `cancel` is cancelled.
 pub async fn watch_codebase(
     path: Option<String>,
     db_path: Option<String>,
     workspace: String,
+    collection: Option<String>,
+    cancel: CancelToken,
     config: &AppConfig,
 ) -> Result<(), CodeRagError> {
     let actual_path = path.unwrap_or_else(|| config.default_index_path.clone());
@@ -20,24 +29,19 @@ pub async fn watch_codebase(
     info!("Initializing watcher for path: {}", actual_path);
 
     // 1. Initialize Components
-    let embedder = Embedder::new(
-        config.embedding_model.clone(),
-        config.reranker_model.clone(),
-        config.embedding_model_path.clone(),
-        config.reranker_model_path.clone(),
-        config.device.clone(),
-    )?;
+    let embedder = Embedder::from_config(config, false)?;
     embedder
         .init_reranker()
         .map_err(|e: fastembed::Error| CodeRagError::Embedding(e.to_string()))?;
+    ensure_compatible_embedder(&actual_db, embedder.model_name(), embedder.dim())?;
 
-    let storage = Storage::new(&actual_db, &workspace)
+    let storage = open_configured_store(config, &actual_db, &workspace)
         .await
         .map_err(|e| CodeRagError::Database(e.to_string()))?;
     storage
         .init(embedder.dim())
         .await
-        .map_err(|e| CodeRagError::Database(e.to_string()))?; // Ensure schema
+        .map_err(|e| CodeRagError::from_anyhow(e, CodeRagError::Database))?; // Ensure schema
 
     let bm25_index = match BM25Index::new(&actual_db, false, &config.merge_policy) {
         Ok(idx) => idx,
@@ -47,13 +51,25 @@ pub async fn watch_codebase(
         }
     };
 
-    let chunker = CodeChunker::new(config.chunk_size, config.chunk_overlap);
+    let chunker = CodeChunker::from_config(config)
+        .map_err(|e| CodeRagError::Generic(format!("{:#}", e)))?
+        .with_collection(collection)
+        .with_tags(
+            TagRules::load(std::path::Path::new(&actual_path))
+                .map_err(|e| CodeRagError::Generic(format!("{:#}", e)))?,
+        );
+    let redactor =
+        Redactor::from_config(config).map_err(|e| CodeRagError::Generic(format!("{:#}", e)))?;
+    let summarizer =
+        Summarizer::from_config(config).map_err(|e| CodeRagError::Generic(format!("{:#}", e)))?;
 
     info!(
         "✓ File Watcher started successfully for workspace '{}'",
         workspace
     );
 
+    let embedding_cache = load_embedding_cache(config, &embedder);
+
     // 2. Start Watcher
     start_watcher(
         &actual_path,
@@ -62,6 +78,17 @@ pub async fn watch_codebase(
         bm25_index,
         chunker,
         workspace,
+        WatchOptions {
+            db_path: actual_db,
+            debounce: Duration::from_millis(config.watch_debounce_ms),
+            exclusions: config.exclusions.clone(),
+            redactor,
+            summarizer,
+            embedding_cache: embedding_cache.map(Arc::new),
+            blame_timestamps: config.blame_timestamps,
+            max_file_size: config.max_file_size(),
+            cancel,
+        },
     )
     .await
     .map_err(|e| CodeRagError::Generic(e.to_string()))?;
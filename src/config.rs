@@ -1,11 +1,74 @@
-use config::{Config, ConfigError, Environment, File};
-use serde::Deserialize;
-use std::path::PathBuf;
+use crate::storage::Metric;
+use config::builder::DefaultState;
+use config::{Config, ConfigBuilder, ConfigError, Environment, File, Source};
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, BTreeSet};
+use std::path::{Path, PathBuf};
 
-#[derive(Debug, Deserialize, Clone)]
-#[serde(deny_unknown_fields)]
+/// Config file names looked up in each directory, in order of preference.
+pub const CONFIG_FILE_NAMES: &[&str] = &["code-rag.toml", "code-rag.yaml", "code-rag.yml"];
+
+/// Default `max_file_size_bytes`: 1 MiB, above hand-written source files and
+/// below most generated code and minified bundles.
+pub const DEFAULT_MAX_FILE_SIZE: usize = 1024 * 1024;
+
+/// Settings without a default value; unset means "not configured".
+const OPTIONAL_KEYS: &[&str] = &[
+    "embedding_host",
+    "embedding_dim",
+    "embedding_cache",
+    "embedding_model_path",
+    "reranker_model_path",
+    "reranker_onnx_path",
+    "threads",
+    "embedding_concurrency",
+    "min_score",
+    "max_chunk_tokens",
+    "recency_half_life_days",
+];
+
+/// Where the settings of an [`AppConfig`] came from.
+#[derive(Debug, Clone, Default)]
+pub struct ConfigProvenance {
+    /// Config files that were loaded, lowest precedence first
+    pub files: Vec<PathBuf>,
+    /// Source of each setting that is set: `default`, a file path,
+    /// an environment variable or a command-line flag
+    pub origins: BTreeMap<String, String>,
+    /// Keys found in a file or the environment that no setting matches;
+    /// they are ignored
+    pub unknown_keys: Vec<String>,
+}
+
+impl ConfigProvenance {
+    /// Records that `key` was overridden by the command-line `flag`.
+    pub fn set_by_flag(&mut self, key: &str, flag: &str) {
+        self.origins.insert(key.to_string(), flag.to_string());
+    }
+}
+
+#[derive(Debug, Deserialize, Serialize, Clone)]
 pub struct AppConfig {
     pub db_path: String,
+    /// Vector store implementation: `lancedb` or `sqlite`
+    pub storage_backend: String,
+    /// Nearest-neighbor search: `exact` scans, `hnsw` uses an approximate graph
+    pub vector_index: String,
+    /// Distance vectors are ranked by: `cosine`, `dot` or `l2`, see [`Self::metric`]
+    pub distance_metric: String,
+    /// Links per node of the HNSW graph
+    pub hnsw_m: usize,
+    /// Candidates considered when adding a node to the HNSW graph
+    pub hnsw_ef_construction: usize,
+    /// Candidates considered per HNSW query
+    pub hnsw_ef_search: usize,
+    /// Facets embedded besides each chunk: `doc` and `signature` (empty = one vector per chunk)
+    pub multi_vector: Vec<String>,
+    /// How a chunk's vectors combine into its score: `max` or `weighted`
+    pub multi_vector_scoring: String,
+    /// Weights of the `code`, `doc` and `signature` vectors (1.0 if unset)
+    #[serde(default)]
+    pub multi_vector_weights: BTreeMap<String, f32>,
     pub default_index_path: String,
     pub default_limit: usize,
     pub server_host: String,
@@ -15,22 +78,76 @@ pub struct AppConfig {
     pub log_format: String,
     pub log_to_file: bool,
     pub log_dir: String,
+    pub embedding_provider: String, // "fastembed", "openai", "ollama"
+    /// Retries of rate-limited (429) or failed (5xx) remote embedding requests
+    pub embedding_max_retries: u32,
+    /// Delay before the first retry, doubled on each further one
+    pub embedding_retry_base_ms: u64,
+    pub embedding_host: Option<String>,
+    /// Extra HTTP headers of remote embedding requests (e.g. `api-key` for Azure)
+    #[serde(default)]
+    pub embedding_headers: std::collections::HashMap<String, String>,
+    /// Dimension the remote embedding endpoint must return (unset = any)
+    pub embedding_dim: Option<usize>,
+    /// Cache file of vectors by chunk text, shared across indexes (unset = no cache)
+    pub embedding_cache: Option<String>,
+    /// Vectors kept in the embedding cache; the least recently used are evicted
+    pub embedding_cache_size: usize,
     pub embedding_model: String,
     pub reranker_model: String,
+    pub reranker: String, // "cross-encoder", "onnx", "llm", "none"
+    pub rerank_top_k: usize,
     pub embedding_model_path: Option<String>,
     pub reranker_model_path: Option<String>,
+    /// Directory of the cross-encoder used by `reranker = "onnx"`
+    pub reranker_onnx_path: Option<String>,
+    /// (query, chunk) pairs the `onnx` reranker scores per inference call
+    pub rerank_batch_size: usize,
     pub chunk_size: usize,
     pub chunk_overlap: usize,
+    /// Lines repeated between adjacent line-based chunks
+    pub chunk_overlap_lines: usize,
+    /// Chunks are also kept within this many tokens (unset = bytes only)
+    pub max_chunk_tokens: Option<usize>,
+    /// Files larger than this are not indexed (0 = no limit)
     pub max_file_size_bytes: usize,
+    /// Replace secrets in chunk text before it is embedded or stored
+    pub redact_secrets: bool,
+    /// Extra secret regexes, applied after the built-in ones
+    pub redact_patterns: Vec<String>,
+    /// Date chunks by `git blame` of their lines at index time, not by file mtime
+    pub blame_timestamps: bool,
+    /// Globs of test files, replacing the built-in per-language conventions
+    pub test_patterns: Vec<String>,
+    /// Summaries for oversized chunks: `none`, `signature` or `llm`
+    pub summarize_chunks: String,
+    /// Chunks above this many tokens are summarized
+    pub summary_threshold_tokens: usize,
+    /// Store chunks repeated across files once, listing the other copies
+    pub dedup_chunks: bool,
+    /// Cosine similarity from which `dedup_chunks` merges two chunks (1.0 = identical text only)
+    pub dedup_similarity: f32,
     pub vector_weight: f32,
     pub bm25_weight: f32,
+    /// Weight of doc comment matches relative to code matches in BM25
+    pub bm25_doc_boost: f32,
     pub rrf_k: f32,
+    /// Weight of a query naming a result's symbol or path, on top of the fused score
+    pub symbol_weight: f32,
+    /// Search results below this cosine similarity are dropped (unset keeps all)
+    pub min_score: Option<f32>,
+    /// Age in days at which recency weighting halves a result's score (unset = off)
+    pub recency_half_life_days: Option<f64>,
+    /// Queries whose ranked results are cached per index (0 disables the cache)
+    pub query_cache_size: usize,
     pub merge_policy: String, // "log", "sum", "replace"
     pub telemetry_enabled: bool,
     pub telemetry_endpoint: String,
     pub device: String, // "auto", "cpu", "cuda", "metal"
     pub batch_size: usize,
     pub threads: Option<usize>,
+    /// Embedding batches in flight during indexing (unset = one per CPU)
+    pub embedding_concurrency: Option<usize>,
     pub priority: String, // "low", "normal", "high"
     pub llm_enabled: bool,
     pub llm_model: String,
@@ -40,23 +157,136 @@ pub struct AppConfig {
     pub enable_server: bool,
     pub enable_mcp: bool,
     pub enable_watch: bool,
+    pub watch_debounce_ms: u64,
 
     // Multi-Workspace
     #[serde(default)]
     pub workspaces: std::collections::HashMap<String, String>,
+
+    #[serde(skip)]
+    pub provenance: ConfigProvenance,
 }
 
 impl AppConfig {
-    /// Load default config (looks for code-rag.toml in current directory)
+    /// Load config from the discovered config files, see [`from_path`](Self::from_path)
     pub fn new() -> Result<Self, ConfigError> {
         Self::from_path(None)
     }
 
-    /// Load config from a specific file path
+    /// Load config from a specific file path, or the discovered config files.
+    ///
+    /// Settings are resolved in this order, later ones winning: built-in
+    /// defaults, `~/.config/code-rag/code-rag.toml`, the nearest config file
+    /// found from the current directory upward (see [`find_config_file`]) or
+    /// `custom_path` instead of both, then `CODE_RAG__KEY` environment
+    /// variables. Command-line flags are applied on top by the caller.
+    ///
+    /// Unknown keys don't fail the load; they are listed in
+    /// [`ConfigProvenance::unknown_keys`] so the caller can warn about them.
     pub fn from_path(custom_path: Option<String>) -> Result<Self, ConfigError> {
-        // Set all defaults
-        let mut builder = Config::builder()
+        let files = match custom_path {
+            Some(path) => {
+                // Custom config file specified via --config
+                let path_buf = PathBuf::from(&path);
+
+                if !path_buf.exists() {
+                    return Err(ConfigError::Message(format!(
+                        "Config file not found: {}",
+                        path
+                    )));
+                }
+
+                let extension = path_buf.extension().and_then(|s| s.to_str());
+                if !matches!(extension, Some("toml" | "yaml" | "yml")) {
+                    return Err(ConfigError::Message(format!(
+                        "Config file must have a .toml, .yaml or .yml extension: {}",
+                        path
+                    )));
+                }
+                vec![path_buf]
+            }
+            None => {
+                let user = dirs::config_dir().and_then(|dir| config_file_in(&dir.join("code-rag")));
+                let project = std::env::current_dir()
+                    .ok()
+                    .and_then(|dir| find_config_file(&dir));
+                user.into_iter().chain(project).collect()
+            }
+        };
+        Self::from_files(files)
+    }
+
+    fn from_files(files: Vec<PathBuf>) -> Result<Self, ConfigError> {
+        let defaults = Self::defaults()?.build()?.collect()?;
+        let known: BTreeSet<&str> = defaults
+            .keys()
+            .map(String::as_str)
+            .chain(OPTIONAL_KEYS.iter().copied())
+            .collect();
+        let mut origins: BTreeMap<String, String> = defaults
+            .keys()
+            .map(|key| (key.clone(), "default".to_string()))
+            .collect();
+
+        let mut builder = Self::defaults()?;
+        for path in &files {
+            let file = File::from(path.as_path());
+            for key in file.collect()?.into_keys() {
+                origins.insert(key, path.display().to_string());
+            }
+            builder = builder.add_source(file);
+        }
+
+        // Environment: CODE_RAG__KEY=VALUE overrides the files
+        let env = Environment::with_prefix("CODE_RAG").separator("__");
+        for key in env.collect()?.into_keys() {
+            let variable = format!("CODE_RAG__{}", key.replace('.', "__").to_uppercase());
+            let top = key.split('.').next().unwrap_or(&key).to_string();
+            origins.insert(top, format!("env {}", variable));
+        }
+        builder = builder.add_source(env);
+
+        let unknown_keys: Vec<String> = origins
+            .keys()
+            .filter(|key| !known.contains(key.as_str()))
+            .cloned()
+            .collect();
+        for key in &unknown_keys {
+            origins.remove(key);
+        }
+
+        let mut config: Self = builder.build()?.try_deserialize()?;
+        // Not `<= 0.0`, so NaN is turned down as well
+        if !(config.dedup_similarity > 0.0 && config.dedup_similarity <= 1.0) {
+            return Err(ConfigError::Message(format!(
+                "dedup_similarity must be above 0 and at most 1, got {}",
+                config.dedup_similarity
+            )));
+        }
+        config.provenance = ConfigProvenance {
+            files,
+            origins,
+            unknown_keys,
+        };
+        Ok(config)
+    }
+
+    /// Built-in defaults of every setting that has one.
+    fn defaults() -> Result<ConfigBuilder<DefaultState>, ConfigError> {
+        Ok(Config::builder()
             .set_default("db_path", "./.lancedb")?
+            .set_default("storage_backend", "lancedb")?
+            .set_default("vector_index", "exact")?
+            .set_default("distance_metric", "cosine")?
+            .set_default("hnsw_m", 16)?
+            .set_default("hnsw_ef_construction", 200)?
+            .set_default("hnsw_ef_search", 64)?
+            .set_default("multi_vector", Vec::<String>::new())?
+            .set_default("multi_vector_scoring", "max")?
+            .set_default(
+                "multi_vector_weights",
+                std::collections::HashMap::<String, f64>::new(),
+            )?
             .set_default("default_index_path", ".")?
             .set_default("default_limit", 5)?
             .set_default("server_host", "127.0.0.1")?
@@ -66,14 +296,37 @@ impl AppConfig {
             .set_default("log_format", "text")?
             .set_default("log_to_file", false)?
             .set_default("log_dir", "logs")?
+            .set_default("embedding_provider", "fastembed")?
+            .set_default("embedding_max_retries", 5)?
+            .set_default("embedding_retry_base_ms", 500)?
+            .set_default(
+                "embedding_headers",
+                std::collections::HashMap::<String, String>::new(),
+            )?
+            .set_default("embedding_cache_size", 100_000)?
             .set_default("embedding_model", "nomic-embed-text-v1.5")?
             .set_default("reranker_model", "bge-reranker-base")?
+            .set_default("reranker", "cross-encoder")?
+            .set_default("rerank_top_k", 30)?
+            .set_default("rerank_batch_size", 16)?
             .set_default("chunk_size", 1024)?
             .set_default("chunk_overlap", 128)?
-            .set_default("max_file_size_bytes", 10 * 1024 * 1024)?
+            .set_default("chunk_overlap_lines", 3)?
+            .set_default("max_file_size_bytes", DEFAULT_MAX_FILE_SIZE as i64)?
+            .set_default("redact_secrets", true)?
+            .set_default("redact_patterns", Vec::<String>::new())?
+            .set_default("blame_timestamps", false)?
+            .set_default("test_patterns", Vec::<String>::new())?
+            .set_default("summarize_chunks", "none")?
+            .set_default("summary_threshold_tokens", 1000)?
+            .set_default("dedup_chunks", false)?
+            .set_default("dedup_similarity", 1.0)?
             .set_default("vector_weight", 1.0)?
             .set_default("bm25_weight", 1.0)?
+            .set_default("bm25_doc_boost", 2.0)?
             .set_default("rrf_k", 60.0)?
+            .set_default("symbol_weight", crate::search::DEFAULT_SYMBOL_WEIGHT as f64)?
+            .set_default("query_cache_size", 128)?
             .set_default("merge_policy", "log")?
             .set_default("telemetry_enabled", false)?
             .set_default("telemetry_endpoint", "http://localhost:4317")?
@@ -86,64 +339,11 @@ impl AppConfig {
             .set_default("enable_server", false)?
             .set_default("enable_mcp", false)?
             .set_default("enable_watch", false)?
+            .set_default("watch_debounce_ms", 500)?
             .set_default(
                 "workspaces",
                 std::collections::HashMap::<String, String>::new(),
-            )?;
-
-        // Load from file (custom path OR defaults)
-        if let Some(path) = custom_path {
-            // Custom config file specified via --config
-            let path_buf = PathBuf::from(&path);
-
-            if !path_buf.exists() {
-                return Err(ConfigError::Message(format!(
-                    "Config file not found: {}",
-                    path
-                )));
-            }
-
-            if path_buf.extension().and_then(|s| s.to_str()) != Some("toml") {
-                return Err(ConfigError::Message(format!(
-                    "Config file must have .toml extension: {}",
-                    path
-                )));
-            }
-
-            builder = builder.add_source(File::from(path_buf));
-        } else {
-            // No custom path - try standard locations
-            // 1. File: ~/.config/code-rag/code-rag.toml (User Config)
-            if let Some(mut home) = dirs::config_dir() {
-                home.push("code-rag");
-                home.push("code-rag.toml");
-                builder = builder.add_source(File::from(home).required(false));
-            }
-
-            // 2. File: code-rag.toml (Current Directory) - takes precedence
-            if PathBuf::from("code-rag.toml").exists() {
-                builder = builder.add_source(File::with_name("code-rag"));
-            }
-        }
-
-        // 3. Environment: CODE_RAG__KEY=VALUE (always checked, lowest precedence)
-        builder = builder.add_source(Environment::with_prefix("CODE_RAG").separator("__"));
-
-        // Build and deserialize with helpful error messages
-        let config = builder.build()?;
-
-        config.try_deserialize().map_err(|e| {
-            // Provide helpful error for unknown fields
-            let err_msg = e.to_string();
-            if err_msg.contains("unknown field") {
-                ConfigError::Message(format!(
-                    "Invalid configuration key found.\n{}\n\nPlease check your config file for typos.\nRun 'code-rag --help' to see valid options.",
-                    err_msg
-                ))
-            } else {
-                e
-            }
-        })
+            )?)
     }
 
     /// For backward compatibility - old load function
@@ -155,6 +355,78 @@ impl AppConfig {
             Self::from_path(None)
         }
     }
+
+    /// `recency_half_life_days` as a duration; `None` when unset or not positive.
+    pub fn recency_half_life(&self) -> Option<std::time::Duration> {
+        self.recency_half_life_days
+            .and_then(crate::search::half_life_days)
+    }
+
+    /// `distance_metric` parsed; `euclidean` is accepted for `l2`.
+    pub fn metric(&self) -> Result<Metric, ConfigError> {
+        self.distance_metric.parse().map_err(ConfigError::Message)
+    }
+
+    /// `max_file_size_bytes` in bytes; `None` when it is 0 (no limit).
+    pub fn max_file_size(&self) -> Option<u64> {
+        Some(self.max_file_size_bytes as u64).filter(|size| *size > 0)
+    }
+}
+
+/// Parses a size such as `1048576`, `512KB` or `1.5MB`, as taken by
+/// `index --max-file-size`. Units are case-insensitive and binary: `KB`,
+/// `KiB` and `K` all mean 1024 bytes.
+pub fn parse_size(text: &str) -> Result<usize, String> {
+    let text = text.trim();
+    let split = text
+        .find(|c: char| !(c.is_ascii_digit() || c == '.'))
+        .unwrap_or(text.len());
+    let (number, unit) = text.split_at(split);
+    let number: f64 = number
+        .parse()
+        .map_err(|_| format!("Invalid size '{}'", text))?;
+    let multiplier: u64 = match unit.trim().to_ascii_lowercase().as_str() {
+        "" | "b" => 1,
+        "k" | "kb" | "kib" => 1 << 10,
+        "m" | "mb" | "mib" => 1 << 20,
+        "g" | "gb" | "gib" => 1 << 30,
+        _ => {
+            return Err(format!(
+                "Unknown unit '{}' in size '{}' (use B, KB, MB or GB)",
+                unit.trim(),
+                text
+            ))
+        }
+    };
+    Ok((number * multiplier as f64).round() as usize)
+}
+
+/// `path` with a leading `~` replaced by the home directory, for paths set
+/// in config files, which no shell expands. Other paths and systems without a
+/// home directory get `path` back unchanged.
+pub fn expand_home(path: &str) -> String {
+    let rest = match path.strip_prefix('~') {
+        Some(rest) if rest.is_empty() || rest.starts_with(['/', '\\']) => rest,
+        _ => return path.to_string(),
+    };
+    match dirs::home_dir() {
+        Some(home) => format!("{}{}", home.display(), rest),
+        None => path.to_string(),
+    }
+}
+
+/// The first of [`CONFIG_FILE_NAMES`] present in `dir`.
+fn config_file_in(dir: &Path) -> Option<PathBuf> {
+    CONFIG_FILE_NAMES
+        .iter()
+        .map(|name| dir.join(name))
+        .find(|path| path.is_file())
+}
+
+/// Finds the config file nearest to `start`: the first directory from
+/// `start` upward containing one of [`CONFIG_FILE_NAMES`].
+pub fn find_config_file(start: &Path) -> Option<PathBuf> {
+    start.ancestors().find_map(config_file_in)
 }
 
 #[cfg(test)]
@@ -173,6 +445,7 @@ mod tests {
         assert_eq!(config.db_path, "./.lancedb");
         assert_eq!(config.default_limit, 5);
         assert_eq!(config.vector_weight, 1.0);
+        assert_eq!(config.symbol_weight, 1.0);
 
         // Part 2: Env Override Logic
         env::set_var("CODE_RAG__DB_PATH", "/tmp/test_db");
@@ -186,4 +459,103 @@ mod tests {
         env::remove_var("CODE_RAG__DB_PATH");
         env::remove_var("CODE_RAG__DEFAULT_LIMIT");
     }
+
+    #[test]
+    fn test_parse_size() {
+        assert_eq!(parse_size("1048576"), Ok(1048576));
+        assert_eq!(parse_size("512KB"), Ok(512 * 1024));
+        assert_eq!(parse_size("1.5 MiB"), Ok(1536 * 1024));
+        assert_eq!(parse_size("2g"), Ok(2 << 30));
+        assert!(parse_size("MB").is_err());
+        assert!(parse_size("10 parsecs").unwrap_err().contains("parsecs"));
+    }
+
+    #[test]
+    fn test_rejects_dedup_similarity_out_of_range() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("code-rag.toml");
+        for value in ["0.0", "-0.5", "1.5", "nan"] {
+            std::fs::write(&path, format!("dedup_similarity = {}\n", value)).unwrap();
+            let err = AppConfig::from_path(Some(path.to_string_lossy().to_string()))
+                .expect_err(value)
+                .to_string();
+            assert!(err.contains("dedup_similarity"), "{}", err);
+        }
+        std::fs::write(&path, "dedup_similarity = 0.98\n").unwrap();
+        let config = AppConfig::from_path(Some(path.to_string_lossy().to_string())).unwrap();
+        assert_eq!(config.dedup_similarity, 0.98);
+    }
+
+    #[test]
+    fn test_max_file_size_zero_is_no_limit() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("code-rag.toml");
+        let load = |contents: &str| {
+            std::fs::write(&path, contents).unwrap();
+            AppConfig::from_path(Some(path.to_string_lossy().to_string())).unwrap()
+        };
+        assert_eq!(load("").max_file_size(), Some(DEFAULT_MAX_FILE_SIZE as u64));
+        assert_eq!(
+            load("max_file_size_bytes = 2048\n").max_file_size(),
+            Some(2048)
+        );
+        assert_eq!(load("max_file_size_bytes = 0\n").max_file_size(), None);
+    }
+
+    #[test]
+    fn test_expand_home() {
+        let home = dirs::home_dir().unwrap().display().to_string();
+        assert_eq!(expand_home("~"), home);
+        assert_eq!(
+            expand_home("~/models/minilm"),
+            format!("{}/models/minilm", home)
+        );
+        assert_eq!(expand_home("/opt/models"), "/opt/models");
+        assert_eq!(expand_home("~user/models"), "~user/models");
+        assert_eq!(expand_home("models/~"), "models/~");
+    }
+
+    #[test]
+    fn test_find_config_file_searches_upward() {
+        let dir = tempfile::tempdir().unwrap();
+        let nested = dir.path().join("a").join("b");
+        std::fs::create_dir_all(&nested).unwrap();
+        assert_eq!(find_config_file(&nested), None);
+
+        std::fs::write(dir.path().join("code-rag.yaml"), "chunk_size: 512\n").unwrap();
+        assert_eq!(
+            find_config_file(&nested),
+            Some(dir.path().join("code-rag.yaml"))
+        );
+
+        // The nearest directory wins, and .toml over .yaml within one
+        let a = dir.path().join("a");
+        std::fs::write(a.join("code-rag.yaml"), "").unwrap();
+        std::fs::write(a.join("code-rag.toml"), "").unwrap();
+        assert_eq!(find_config_file(&nested), Some(a.join("code-rag.toml")));
+    }
+
+    #[test]
+    fn test_unknown_keys_warn_and_origins() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("code-rag.yaml");
+        std::fs::write(
+            &path,
+            "chunk_size: 512\nembedding_model: bge-small-en-v1.5\nchunk_sise: 256\n",
+        )
+        .unwrap();
+
+        let config = AppConfig::from_files(vec![path.clone()]).unwrap();
+        assert_eq!(config.chunk_size, 512);
+        assert_eq!(config.embedding_model, "bge-small-en-v1.5");
+
+        let provenance = &config.provenance;
+        assert_eq!(provenance.files, vec![path.clone()]);
+        assert_eq!(provenance.unknown_keys, vec!["chunk_sise"]);
+        let origin = |key: &str| provenance.origins.get(key).map(String::as_str);
+        assert_eq!(origin("chunk_size"), Some(path.to_str().unwrap()));
+        assert_eq!(origin("storage_backend"), Some("default"));
+        assert_eq!(origin("chunk_sise"), None);
+        assert_eq!(origin("threads"), None);
+    }
 }
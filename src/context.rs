@@ -1,9 +1,20 @@
+use crate::indexer::ChunkLocation;
 use crate::search::SearchResult;
 use anyhow::Result;
-use tiktoken_rs::cl100k_base;
+use std::sync::{Arc, OnceLock};
+use tiktoken_rs::{cl100k_base, CoreBPE};
+
+mod prompt;
+
+pub use prompt::{PromptTemplate, DEFAULT_PROMPT_TEMPLATE};
+
+/// First line of a summary that replaced a chunk too large for the budget.
+pub const SUMMARY_NOTE: &str = "// summary (full chunk exceeds the token budget)";
 
 #[derive(Debug, Clone)]
 pub struct MergedChunk {
+    /// Chunk ID of the first merged result
+    pub id: String,
     pub filename: String,
     pub start_line: i32,
     pub end_line: i32,
@@ -13,6 +24,25 @@ pub struct MergedChunk {
     pub max_score: f32,
     pub last_modified: i64,
     pub calls: Vec<String>,
+    /// Shared symbol ID of the merged results; `None` when they cover different symbols
+    pub symbol: Option<String>,
+    pub language: Option<String>,
+    /// Best cosine similarity among the merged results
+    pub vector_score: Option<f32>,
+    /// Best reranker score among the merged results
+    pub rerank_score: Option<f32>,
+    /// Whether any of the merged results had secrets redacted
+    pub redacted: bool,
+    /// Whether all of the merged results are test code
+    pub is_test: bool,
+    /// Collection of the file the merged results come from
+    pub collection: Option<String>,
+    /// User tags of any of the merged results
+    pub tags: Vec<String>,
+    /// Summary of a single unmerged result, used if `code` doesn't fit the budget
+    pub summary: Option<String>,
+    /// Other locations of a single unmerged result, see [`SearchResult::duplicates`]
+    pub duplicates: Vec<ChunkLocation>,
 }
 
 pub struct ContextOptimizer {
@@ -39,7 +69,7 @@ impl ContextOptimizer {
         }
 
         let mut all_merged = Vec::new();
-        let bpe = cl100k_base()?; // GPT-4 tokenizer
+        let bpe = cl100k()?; // GPT-4 tokenizer
 
         // 2. Coalesce adjacent chunks within each file
         for (_filename, mut file_results) in by_file {
@@ -61,16 +91,35 @@ impl ContextOptimizer {
                             // Ideally, we'd read the file content between them if minimal, but for now let's just join with a newline.
 
                             let had_gap = res.line_start > curr.end_line + 1;
+                            // Overlapping chunks repeat lines already in `curr`
+                            let repeated = (curr.end_line - res.line_start + 1).max(0) as usize;
+                            let new_code = skip_lines(&res.code, repeated);
                             curr.end_line = std::cmp::max(curr.end_line, res.line_end);
-                            curr.code.push('\n');
-                            if had_gap {
-                                // Add gap marker if there is a gap but it's small enough to merge
-                                curr.code.push_str("... (gap) ...\n");
+                            if !new_code.is_empty() {
+                                curr.code.push('\n');
+                                if had_gap {
+                                    // Add gap marker if there is a gap but it's small enough to merge
+                                    curr.code.push_str("... (gap) ...\n");
+                                }
+                                curr.code.push_str(new_code);
                             }
-                            curr.code.push_str(&res.code);
                             curr.scores.push(res.score);
                             curr.max_score = curr.max_score.max(res.score);
                             curr.last_modified = curr.last_modified.max(res.last_modified);
+                            if curr.symbol != res.symbol {
+                                curr.symbol = None;
+                            }
+                            curr.vector_score = max_option(curr.vector_score, res.vector_score);
+                            curr.rerank_score = max_option(curr.rerank_score, res.rerank_score);
+                            curr.redacted |= res.redacted;
+                            curr.is_test &= res.is_test;
+                            for tag in res.tags {
+                                if let Err(at) = curr.tags.binary_search(&tag) {
+                                    curr.tags.insert(at, tag);
+                                }
+                            }
+                            curr.summary = None;
+                            curr.duplicates.clear();
 
                             // Merge and deduplicate calls
                             for call in res.calls {
@@ -108,16 +157,25 @@ impl ContextOptimizer {
         let mut final_selection = Vec::new();
         let mut current_tokens = 0;
 
-        for chunk in all_merged {
+        for mut chunk in all_merged {
             let tokens = bpe.encode_with_special_tokens(&chunk.code).len();
             if current_tokens + tokens <= self.token_limit {
                 final_selection.push(chunk);
                 current_tokens += tokens;
-            } else {
-                // If we implemented a "soft" break (trimming the chunk), we could fit partial here.
-                // For now, strict exclusion.
                 continue;
             }
+            // Fall back to the stored summary, labeled so it isn't mistaken for code
+            if let Some(summary) = chunk.summary.take() {
+                let code = format!("{}\n{}", SUMMARY_NOTE, summary);
+                let tokens = bpe.encode_with_special_tokens(&code).len();
+                if current_tokens + tokens <= self.token_limit {
+                    chunk.code = code;
+                    final_selection.push(chunk);
+                    current_tokens += tokens;
+                }
+            }
+            // If we implemented a "soft" break (trimming the chunk), we could fit partial here.
+            // For now, strict exclusion.
         }
 
         // Sort back by score or perhaps by file/line for readability?
@@ -136,6 +194,7 @@ impl ContextOptimizer {
 
     fn from_single(res: &SearchResult) -> MergedChunk {
         MergedChunk {
+            id: res.id.clone(),
             filename: res.filename.clone(),
             start_line: res.line_start,
             end_line: res.line_end,
@@ -145,10 +204,292 @@ impl ContextOptimizer {
             max_score: res.score,
             last_modified: res.last_modified,
             calls: res.calls.clone(),
+            symbol: res.symbol.clone(),
+            language: res.language.clone(),
+            vector_score: res.vector_score,
+            rerank_score: res.rerank_score,
+            redacted: res.redacted,
+            is_test: res.is_test,
+            collection: res.collection.clone(),
+            tags: res.tags.clone(),
+            summary: res.summary.clone(),
+            duplicates: res.duplicates.clone(),
         }
     }
 }
 
+/// Counts how many tokens a piece of text occupies in a model's context window.
+///
+/// Implement this to plug in a model-specific tokenizer; [`TiktokenCounter`]
+/// covers OpenAI models and [`HeuristicCounter`] is a tokenizer-free estimate.
+pub trait TokenCounter: Send + Sync {
+    fn count(&self, text: &str) -> usize;
+}
+
+/// The cl100k_base encoding, built on first use and shared afterwards:
+/// building it parses a vocabulary of 100k tokens.
+fn cl100k() -> Result<Arc<CoreBPE>> {
+    static BPE: OnceLock<Arc<CoreBPE>> = OnceLock::new();
+    if let Some(bpe) = BPE.get() {
+        return Ok(bpe.clone());
+    }
+    let bpe = Arc::new(cl100k_base()?);
+    Ok(BPE.get_or_init(|| bpe).clone())
+}
+
+/// Exact token counts for OpenAI models (cl100k_base encoding).
+pub struct TiktokenCounter {
+    bpe: Arc<CoreBPE>,
+}
+
+impl TiktokenCounter {
+    pub fn new() -> Result<Self> {
+        Ok(Self { bpe: cl100k()? })
+    }
+}
+
+impl TokenCounter for TiktokenCounter {
+    fn count(&self, text: &str) -> usize {
+        self.bpe.encode_with_special_tokens(text).len()
+    }
+}
+
+/// [`TiktokenCounter`], or [`HeuristicCounter`] if the encoding can't be loaded.
+pub fn default_counter() -> Arc<dyn TokenCounter> {
+    match TiktokenCounter::new() {
+        Ok(counter) => Arc::new(counter),
+        Err(e) => {
+            tracing::warn!("Tokenizer unavailable ({}); estimating token counts.", e);
+            Arc::new(HeuristicCounter)
+        }
+    }
+}
+
+/// Estimates one token per four characters, rounded up.
+///
+/// Code tokenizes denser than prose on most models, so this tends to
+/// overestimate slightly, which keeps assembled context on the safe side.
+pub struct HeuristicCounter;
+
+impl TokenCounter for HeuristicCounter {
+    fn count(&self, text: &str) -> usize {
+        text.chars().count().div_ceil(4)
+    }
+}
+
+/// Context block produced by [`ContextBuilder::build`].
+#[derive(Debug, Clone)]
+pub struct BuiltContext {
+    /// Chunks joined with provenance headers
+    pub text: String,
+    /// Tokens occupied by `text` according to the builder's counter
+    pub tokens_used: usize,
+    /// Chunks that made it into `text`; the last one may have been trimmed,
+    /// in which case its `code` and `line_end` reflect the kept lines. Chunks
+    /// replaced by their summary hold it in `code`.
+    pub chunks: Vec<SearchResult>,
+    /// Number of `chunks` replaced by their summary
+    pub summarized: usize,
+}
+
+/// Packs ranked chunks into a context block that fits a token budget.
+///
+/// Chunks are added in the order given, each preceded by a header such as
+/// `// file: src/auth.rs (lines 20-40)`. A chunk that doesn't fit but has a
+/// stored summary (see [`Summarizer`](crate::summary::Summarizer)) is replaced
+/// by the summary under a `// summary of file: …` header if that fits.
+/// Otherwise the chunk is trimmed at a line boundary to use up the remaining
+/// budget and packing stops there.
+///
+/// # Examples
+///
+/// ```no_run
+/// use code_rag::context::ContextBuilder;
+/// use code_rag::search::SearchResult;
+///
+/// # fn example(results: Vec<SearchResult>) {
+/// let context = ContextBuilder::new(4000).build(&results);
+/// println!("{} tokens:\n{}", context.tokens_used, context.text);
+/// # }
+/// ```
+pub struct ContextBuilder {
+    budget: usize,
+    counter: Arc<dyn TokenCounter>,
+}
+
+impl ContextBuilder {
+    /// Creates a builder using [`TiktokenCounter`], or [`HeuristicCounter`] if the
+    /// encoding can't be loaded.
+    pub fn new(budget: usize) -> Self {
+        Self::with_counter(budget, default_counter())
+    }
+
+    pub fn with_counter(budget: usize, counter: Arc<dyn TokenCounter>) -> Self {
+        Self { budget, counter }
+    }
+
+    pub fn build(&self, results: &[SearchResult]) -> BuiltContext {
+        let mut context = BuiltContext {
+            text: String::new(),
+            tokens_used: 0,
+            chunks: Vec::new(),
+            summarized: 0,
+        };
+
+        for result in results {
+            let Some(result) = Self::without_overlap(result, &context.chunks) else {
+                continue;
+            };
+            let result = &result;
+            let header = Self::header(&result.filename, result.line_start, result.line_end);
+            let block = format!("{}\n{}\n", header, result.code);
+            let tokens = self.counter.count(&block);
+            if context.tokens_used + tokens <= self.budget {
+                context.text.push_str(&block);
+                context.tokens_used += tokens;
+                context.chunks.push(result.clone());
+                continue;
+            }
+
+            if let Some((block, summarized, tokens)) =
+                self.summary_block(result, self.budget - context.tokens_used)
+            {
+                context.text.push_str(&block);
+                context.tokens_used += tokens;
+                context.chunks.push(summarized);
+                context.summarized += 1;
+                continue;
+            }
+
+            if let Some((block, trimmed, tokens)) =
+                self.trim_to_fit(result, self.budget - context.tokens_used)
+            {
+                context.text.push_str(&block);
+                context.tokens_used += tokens;
+                context.chunks.push(trimmed);
+            }
+            break;
+        }
+
+        context
+    }
+
+    /// Drops the leading overlap lines of `result` when an included chunk of
+    /// the same file already covers them.
+    ///
+    /// Returns `None` if no lines are left.
+    fn without_overlap(result: &SearchResult, included: &[SearchResult]) -> Option<SearchResult> {
+        let overlap_end = result.line_start + result.overlap_lines as i32 - 1;
+        let covered = result.overlap_lines > 0
+            && included.iter().any(|c| {
+                c.filename == result.filename
+                    && c.line_start <= result.line_start
+                    && c.line_end >= overlap_end
+            });
+        if !covered {
+            return Some(result.clone());
+        }
+        let code = skip_lines(&result.code, result.overlap_lines);
+        if code.is_empty() {
+            return None;
+        }
+        let mut trimmed = result.clone();
+        trimmed.code = code.to_string();
+        trimmed.line_start = overlap_end + 1;
+        trimmed.overlap_lines = 0;
+        Some(trimmed)
+    }
+
+    /// Renders the stored summary of `result` if it fits in `remaining` tokens.
+    fn summary_block(
+        &self,
+        result: &SearchResult,
+        remaining: usize,
+    ) -> Option<(String, SearchResult, usize)> {
+        let summary = result.summary.as_ref()?;
+        let block = format!(
+            "// summary of file: {} (lines {}-{}, full chunk exceeds the token budget)\n{}\n",
+            result.filename, result.line_start, result.line_end, summary
+        );
+        let tokens = self.counter.count(&block);
+        if tokens > remaining {
+            return None;
+        }
+        let mut summarized = result.clone();
+        summarized.code = summary.clone();
+        Some((block, summarized, tokens))
+    }
+
+    fn header(filename: &str, line_start: i32, line_end: i32) -> String {
+        format!("// file: {} (lines {}-{})", filename, line_start, line_end)
+    }
+
+    /// Keeps as many leading lines of `result` as fit in `remaining` tokens.
+    ///
+    /// Returns the rendered block, the trimmed chunk and the block's token
+    /// count, or `None` if not even the header and the first line fit.
+    fn trim_to_fit(
+        &self,
+        result: &SearchResult,
+        remaining: usize,
+    ) -> Option<(String, SearchResult, usize)> {
+        let lines: Vec<&str> = result.code.lines().collect();
+
+        // Estimate from per-line counts, then confirm against the rendered block
+        // since tokens don't always split cleanly at newlines.
+        let mut used = self.counter.count(&Self::header(
+            &result.filename,
+            result.line_start,
+            result.line_end,
+        )) + 1;
+        let mut kept_lines = 0;
+        for line in &lines {
+            let tokens = self.counter.count(line) + 1;
+            if used + tokens > remaining {
+                break;
+            }
+            used += tokens;
+            kept_lines += 1;
+        }
+
+        while kept_lines > 0 {
+            let code = lines[..kept_lines].join("\n");
+            let line_end = result.line_start + kept_lines as i32 - 1;
+            let block = format!(
+                "{}\n{}\n",
+                Self::header(&result.filename, result.line_start, line_end),
+                code
+            );
+            let tokens = self.counter.count(&block);
+            if tokens <= remaining {
+                let mut trimmed = result.clone();
+                trimmed.code = code;
+                trimmed.line_end = line_end;
+                return Some((block, trimmed, tokens));
+            }
+            kept_lines -= 1;
+        }
+        None
+    }
+}
+
+/// `code` without its first `n` lines.
+fn skip_lines(code: &str, n: usize) -> &str {
+    if n == 0 {
+        return code;
+    }
+    code.match_indices('\n')
+        .nth(n - 1)
+        .map_or("", |(i, _)| &code[i + 1..])
+}
+
+fn max_option(a: Option<f32>, b: Option<f32>) -> Option<f32> {
+    match (a, b) {
+        (Some(a), Some(b)) => Some(a.max(b)),
+        (a, b) => a.or(b),
+    }
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -164,6 +505,7 @@ mod tests {
             line_end: 12,
             last_modified: 100,
             calls: vec!["call1".into()],
+            ..Default::default()
         };
         let r2 = SearchResult {
             rank: 2,
@@ -174,6 +516,7 @@ mod tests {
             line_end: 16,
             last_modified: 101,
             calls: vec!["call2".into()],
+            ..Default::default()
         };
 
         let optimizer = ContextOptimizer::new(1000);
@@ -199,6 +542,7 @@ mod tests {
             line_end: 10,
             last_modified: 100,
             calls: vec![],
+            ..Default::default()
         };
 
         let optimizer = ContextOptimizer::new(10); // Very small budget
@@ -207,4 +551,162 @@ mod tests {
         // Should be rejected
         assert_eq!(merged.len(), 0);
     }
+
+    #[test]
+    fn test_budget_falls_back_to_summary() {
+        let r1 = SearchResult {
+            score: 0.9,
+            filename: "A.rs".into(),
+            code: "long code ".repeat(100),
+            line_start: 1,
+            line_end: 10,
+            summary: Some("fn long_code()".into()),
+            ..Default::default()
+        };
+
+        let merged = ContextOptimizer::new(30).optimize(vec![r1]).unwrap();
+        assert_eq!(merged.len(), 1);
+        assert_eq!(merged[0].code, format!("{}\nfn long_code()", SUMMARY_NOTE));
+    }
+
+    fn numbered(from: i32, to: i32) -> String {
+        (from..=to)
+            .map(|i| format!("line {}", i))
+            .collect::<Vec<_>>()
+            .join("\n")
+    }
+
+    #[test]
+    fn test_merge_skips_overlapping_lines() {
+        let r1 = ranked("A.rs", &numbered(1, 10), 1);
+        let mut r2 = ranked("A.rs", &numbered(8, 17), 8);
+        r2.overlap_lines = 3;
+        let inside = ranked("A.rs", &numbered(3, 4), 3);
+
+        let merged = ContextOptimizer::new(1000)
+            .optimize(vec![r1, r2, inside])
+            .unwrap();
+        assert_eq!(merged.len(), 1);
+        assert_eq!(merged[0].code, numbered(1, 17));
+        assert_eq!((merged[0].start_line, merged[0].end_line), (1, 17));
+    }
+
+    #[test]
+    fn test_builder_drops_overlap_already_included() {
+        let mut second = ranked("a.rs", &numbered(8, 17), 8);
+        second.overlap_lines = 3;
+        let builder = ContextBuilder::with_counter(1000, Arc::new(HeuristicCounter));
+
+        let context = builder.build(&[ranked("a.rs", &numbered(1, 10), 1), second.clone()]);
+        assert_eq!(context.chunks[1].line_start, 11);
+        assert_eq!(context.chunks[1].code, numbered(11, 17));
+        assert!(context
+            .text
+            .contains("// file: a.rs (lines 11-17)\nline 11\n"));
+
+        // Without the previous chunk the overlap is kept
+        let context = builder.build(&[second]);
+        assert_eq!(context.chunks[0].line_start, 8);
+        assert!(context.chunks[0].code.starts_with("line 8\n"));
+    }
+
+    #[test]
+    fn test_skip_lines() {
+        assert_eq!(skip_lines("a\nb\nc", 0), "a\nb\nc");
+        assert_eq!(skip_lines("a\nb\nc", 2), "c");
+        assert_eq!(skip_lines("a\nb\nc", 3), "");
+        assert_eq!(skip_lines("a\nb\nc", 9), "");
+    }
+
+    fn ranked(filename: &str, code: &str, line_start: i32) -> SearchResult {
+        SearchResult {
+            filename: filename.into(),
+            line_start,
+            line_end: line_start + code.lines().count() as i32 - 1,
+            code: code.into(),
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_heuristic_counter() {
+        assert_eq!(HeuristicCounter.count(""), 0);
+        assert_eq!(HeuristicCounter.count("abcd"), 1);
+        assert_eq!(HeuristicCounter.count("abcde"), 2);
+    }
+
+    #[test]
+    fn test_builder_adds_headers_and_counts_tokens() {
+        let builder = ContextBuilder::with_counter(1000, Arc::new(HeuristicCounter));
+        let results = vec![
+            ranked("auth.go", "func A() {}", 20),
+            ranked("main.go", "func main() {}", 1),
+        ];
+        let context = builder.build(&results);
+
+        assert!(context
+            .text
+            .starts_with("// file: auth.go (lines 20-20)\nfunc A() {}\n"));
+        assert!(context.text.contains("// file: main.go (lines 1-1)\n"));
+        assert_eq!(context.chunks.len(), 2);
+        assert_eq!(context.tokens_used, HeuristicCounter.count(&context.text));
+    }
+
+    #[test]
+    fn test_builder_trims_last_chunk_at_line_boundary() {
+        let code = (1..=20)
+            .map(|i| format!("line number {:02}", i))
+            .collect::<Vec<_>>()
+            .join("\n");
+        let results = vec![ranked("a.rs", "fn a() {}", 1), ranked("b.rs", &code, 100)];
+
+        let builder = ContextBuilder::with_counter(40, Arc::new(HeuristicCounter));
+        let context = builder.build(&results);
+
+        assert!(context.tokens_used <= 40);
+        assert_eq!(context.chunks.len(), 2);
+        let trimmed = &context.chunks[1];
+        assert!(trimmed.line_end < 119);
+        assert!(trimmed
+            .code
+            .ends_with(&format!("line number {:02}", trimmed.line_end - 99)));
+        assert!(context
+            .text
+            .contains(&format!("// file: b.rs (lines 100-{})", trimmed.line_end)));
+    }
+
+    #[test]
+    fn test_builder_substitutes_summary() {
+        let mut large = ranked("big.go", &numbered(1, 200), 10);
+        large.summary = Some("func Big() {\n    ...\ncalls: a, b".into());
+        let results = vec![large.clone(), ranked("small.go", "func S() {}", 1)];
+
+        let builder = ContextBuilder::with_counter(60, Arc::new(HeuristicCounter));
+        let context = builder.build(&results);
+        assert_eq!(context.summarized, 1);
+        assert_eq!(context.chunks.len(), 2);
+        assert!(context.text.starts_with(
+            "// summary of file: big.go (lines 10-209, full chunk exceeds the token budget)\nfunc Big() {"
+        ));
+        assert_eq!(context.chunks[0].code, "func Big() {\n    ...\ncalls: a, b");
+        assert_eq!(context.chunks[0].line_end, 209);
+        // Packing carries on after a summary
+        assert!(context.text.contains("// file: small.go (lines 1-1)"));
+
+        // Without a summary the chunk is trimmed instead
+        large.summary = None;
+        let context = builder.build(&[large]);
+        assert_eq!(context.summarized, 0);
+        assert!(context.chunks[0].line_end < 209);
+    }
+
+    #[test]
+    fn test_builder_stops_when_nothing_fits() {
+        let builder = ContextBuilder::with_counter(3, Arc::new(HeuristicCounter));
+        let context = builder.build(&[ranked("a.rs", "fn a() {}", 1)]);
+
+        assert!(context.text.is_empty());
+        assert_eq!(context.tokens_used, 0);
+        assert!(context.chunks.is_empty());
+    }
 }
@@ -0,0 +1,227 @@
+use crate::search::SearchResult;
+use anyhow::{anyhow, Result};
+use minijinja::{context, Environment, UndefinedBehavior};
+use serde::Serialize;
+use std::sync::{Arc, OnceLock};
+
+/// Layout of the prompt assembled by [`CodeSearcher::query`], reproducing the
+/// file headers of [`ContextBuilder`](super::ContextBuilder).
+///
+/// [`CodeSearcher::query`]: crate::search::CodeSearcher::query
+pub const DEFAULT_PROMPT_TEMPLATE: &str = "\
+{% for chunk in chunks %}
+{% if chunk.summarized %}
+// summary of file: {{ chunk.file }} (lines {{ chunk.lines }}, full chunk exceeds the token budget)
+{% else %}
+// file: {{ chunk.file }} (lines {{ chunk.lines }})
+{% endif %}
+{{ chunk.text }}
+{% else %}
+No relevant code was found in the index.
+{% endfor %}
+
+Question: {{ query }}
+";
+
+const TEMPLATE_NAME: &str = "prompt";
+
+/// A chunk as a prompt template sees it, one of `chunks`.
+#[derive(Serialize)]
+struct PromptChunk<'a> {
+    file: &'a str,
+    symbol: Option<&'a str>,
+    language: Option<&'a str>,
+    /// `start-end`, e.g. `20-40`
+    lines: String,
+    start_line: i32,
+    end_line: i32,
+    text: &'a str,
+    /// Cosine similarity to the query, or the ranking score for keyword-only hits
+    score: f32,
+    /// `text` is the chunk's summary, the code being over the token budget
+    summarized: bool,
+}
+
+impl<'a> From<&'a SearchResult> for PromptChunk<'a> {
+    fn from(result: &'a SearchResult) -> Self {
+        Self {
+            file: &result.filename,
+            symbol: result.symbol.as_deref(),
+            language: result.language.as_deref(),
+            lines: format!("{}-{}", result.line_start, result.line_end),
+            start_line: result.line_start,
+            end_line: result.line_end,
+            text: &result.code,
+            score: result.vector_score.unwrap_or(result.score),
+            // ContextBuilder puts the summary in place of the code
+            summarized: result.summary.as_ref() == Some(&result.code),
+        }
+    }
+}
+
+/// Formats the prompt of [`CodeSearcher::query`] from the question and the
+/// chunks that fit the budget, so it can be framed the way a model expects.
+///
+/// Templates use [minijinja](https://docs.rs/minijinja) (Jinja2) syntax and see
+/// `query` and `chunks`; each chunk has `file`, `symbol`, `language`, `lines`
+/// (`20-40`), `start_line`, `end_line`, `text`, `score` and `summarized`.
+/// The newline after a block tag is dropped, and the one ending the template
+/// kept. Naming a variable that doesn't exist is an error, and
+/// [`parse`](Self::parse) renders the template once on a sample chunk, so
+/// mistakes show up before anything is searched. The token budget of
+/// [`QueryOptions::max_tokens`] covers the chunks, not the template's text.
+///
+/// [`CodeSearcher::query`]: crate::search::CodeSearcher::query
+/// [`QueryOptions::max_tokens`]: crate::search::QueryOptions::max_tokens
+///
+/// # Examples
+///
+/// ```
+/// use code_rag::context::PromptTemplate;
+///
+/// let template = PromptTemplate::parse(
+///     "{% for chunk in chunks %}<file path=\"{{ chunk.file }}\">\n{{ chunk.text }}\n</file>\n{% endfor %}{{ query }}\n",
+/// )
+/// .unwrap();
+/// assert_eq!(template.render("where is login?", &[]).unwrap(), "where is login?\n");
+/// assert!(PromptTemplate::parse("{{ .Query }}").is_err());
+/// ```
+#[derive(Clone)]
+pub struct PromptTemplate {
+    env: Arc<Environment<'static>>,
+}
+
+impl std::fmt::Debug for PromptTemplate {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        let source = self
+            .env
+            .get_template(TEMPLATE_NAME)
+            .map(|t| t.source().to_string())
+            .unwrap_or_default();
+        f.debug_struct("PromptTemplate")
+            .field("source", &source)
+            .finish()
+    }
+}
+
+impl Default for PromptTemplate {
+    /// [`DEFAULT_PROMPT_TEMPLATE`], compiled once.
+    fn default() -> Self {
+        static DEFAULT: OnceLock<PromptTemplate> = OnceLock::new();
+        DEFAULT
+            .get_or_init(|| {
+                PromptTemplate::parse(DEFAULT_PROMPT_TEMPLATE).expect("default template is valid")
+            })
+            .clone()
+    }
+}
+
+impl PromptTemplate {
+    /// Compiles `source`, failing on syntax errors and on variables a sample
+    /// prompt doesn't have.
+    pub fn parse(source: &str) -> Result<Self> {
+        let mut env = Environment::new();
+        env.set_undefined_behavior(UndefinedBehavior::Strict);
+        env.set_trim_blocks(true);
+        env.set_keep_trailing_newline(true);
+        env.add_template_owned(TEMPLATE_NAME, source.to_string())
+            .map_err(|e| anyhow!("Invalid prompt template: {}", e))?;
+        let template = Self { env: Arc::new(env) };
+
+        let sample = SearchResult {
+            filename: "src/auth.rs".to_string(),
+            code: "fn login() {}".to_string(),
+            line_start: 1,
+            line_end: 1,
+            symbol: Some("auth::login".to_string()),
+            language: Some("rust".to_string()),
+            ..Default::default()
+        };
+        template.render("sample question", &[sample])?;
+        Ok(template)
+    }
+
+    /// The prompt for `query` over `chunks`.
+    pub fn render(&self, query: &str, chunks: &[SearchResult]) -> Result<String> {
+        let chunks: Vec<PromptChunk> = chunks.iter().map(PromptChunk::from).collect();
+        self.env
+            .get_template(TEMPLATE_NAME)
+            .and_then(|t| t.render(context! { query => query, chunks => chunks }))
+            .map_err(|e| anyhow!("Invalid prompt template: {}", e))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn chunk(filename: &str, code: &str, line_start: i32, line_end: i32) -> SearchResult {
+        SearchResult {
+            filename: filename.to_string(),
+            code: code.to_string(),
+            line_start,
+            line_end,
+            score: 0.02,
+            vector_score: Some(0.8),
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_default_template() {
+        let template = PromptTemplate::default();
+        let mut summarized = chunk("big.go", "func Big() { ... }", 10, 90);
+        summarized.summary = Some(summarized.code.clone());
+        let prompt = template
+            .render(
+                "where is A?",
+                &[chunk("auth.go", "func A() {}", 20, 22), summarized],
+            )
+            .unwrap();
+        assert_eq!(
+            prompt,
+            "// file: auth.go (lines 20-22)\nfunc A() {}\n\
+             // summary of file: big.go (lines 10-90, full chunk exceeds the token budget)\n\
+             func Big() { ... }\n\
+             \nQuestion: where is A?\n"
+        );
+
+        assert_eq!(
+            template.render("where is A?", &[]).unwrap(),
+            "No relevant code was found in the index.\n\nQuestion: where is A?\n"
+        );
+    }
+
+    #[test]
+    fn test_custom_template() {
+        let template = PromptTemplate::parse(
+            "Answer: {{ query }}\n\
+             {% for chunk in chunks %}\n\
+             {{ loop.index }}. {{ chunk.file }}:{{ chunk.lines }} {{ chunk.symbol or \"-\" }} ({{ \"%.2f\"|format(chunk.score) }})\n\
+             ```{{ chunk.language }}\n{{ chunk.text }}\n```\n\
+             {% endfor %}",
+        )
+        .unwrap();
+        let mut result = chunk("a.rs", "fn a() {}", 1, 3);
+        result.language = Some("rust".to_string());
+        let prompt = template.render("what does a do?", &[result]).unwrap();
+        assert_eq!(
+            prompt,
+            "Answer: what does a do?\n1. a.rs:1-3 - (0.80)\n```rust\nfn a() {}\n```\n"
+        );
+    }
+
+    #[test]
+    fn test_invalid_templates() {
+        let err = PromptTemplate::parse("{{ .Query }}").unwrap_err();
+        assert!(
+            err.to_string().contains("Invalid prompt template"),
+            "{}",
+            err
+        );
+        assert!(PromptTemplate::parse("{% for chunk in chunks %}").is_err());
+        // Misspelled names fail up front rather than printing nothing
+        assert!(PromptTemplate::parse("{{ qeury }}").is_err());
+        assert!(PromptTemplate::parse("{% for c in chunks %}{{ c.path }}{% endfor %}").is_err());
+    }
+}
@@ -0,0 +1,310 @@
+use std::future::Future;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Arc, Mutex, Weak};
+use std::time::Duration;
+use tokio::sync::Notify;
+use tokio::time::Instant;
+
+use super::CodeRagError;
+
+#[derive(Default)]
+struct Inner {
+    cancelled: AtomicBool,
+    notify: Notify,
+    /// Inherited from the parent, or sooner
+    deadline: Option<Instant>,
+    /// Tokens made by [`CancelToken::child`], cancelled along with this one
+    children: Mutex<Vec<Weak<Inner>>>,
+}
+
+impl Inner {
+    fn cancel(&self) {
+        if self.cancelled.swap(true, Ordering::SeqCst) {
+            return;
+        }
+        self.notify.notify_waiters();
+        let children = self
+            .children
+            .lock()
+            .map(|mut children| std::mem::take(&mut *children))
+            .unwrap_or_default();
+        for child in children.iter().filter_map(Weak::upgrade) {
+            child.cancel();
+        }
+    }
+}
+
+/// Cooperative cancellation of a command and the work it starts.
+///
+/// Clones share the same state: once any of them is [cancelled](Self::cancel),
+/// or its deadline has passed, long-running work checks
+/// [`is_cancelled`](Self::is_cancelled) between steps and stops, and futures
+/// run through [`run`](Self::run) are dropped on the spot, which aborts their
+/// HTTP requests. The default token is never cancelled.
+///
+/// The CLI cancels its root token on Ctrl-C; [`child`](Self::child) and
+/// [`with_timeout`](Self::with_timeout) derive tokens for a part of the work
+/// that can also be cancelled on its own.
+///
+/// # Examples
+///
+/// ```
+/// use code_rag::core::CancelToken;
+///
+/// # #[tokio::main]
+/// # async fn main() {
+/// let token = CancelToken::new();
+/// let answer = token.run(async { 42 }).await;
+/// assert_eq!(answer.unwrap(), 42);
+///
+/// token.cancel();
+/// assert!(token.run(std::future::pending::<()>()).await.is_err());
+/// # }
+/// ```
+#[derive(Clone, Default)]
+pub struct CancelToken {
+    inner: Arc<Inner>,
+}
+
+impl std::fmt::Debug for CancelToken {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("CancelToken")
+            .field("cancelled", &self.is_cancelled())
+            .field("deadline", &self.inner.deadline)
+            .finish()
+    }
+}
+
+impl CancelToken {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// A token cancelled with this one, that can also be cancelled alone.
+    pub fn child(&self) -> Self {
+        self.derive(self.inner.deadline)
+    }
+
+    /// A [`child`](Self::child) that is also cancelled once `timeout` has
+    /// passed, unless this token's own deadline is sooner.
+    pub fn with_timeout(&self, timeout: Duration) -> Self {
+        let deadline = Instant::now() + timeout;
+        self.derive(Some(
+            self.inner
+                .deadline
+                .map_or(deadline, |parent| parent.min(deadline)),
+        ))
+    }
+
+    fn derive(&self, deadline: Option<Instant>) -> Self {
+        let child = Self {
+            inner: Arc::new(Inner {
+                deadline,
+                ..Default::default()
+            }),
+        };
+        if let Ok(mut children) = self.inner.children.lock() {
+            children.retain(|c| c.strong_count() > 0);
+            children.push(Arc::downgrade(&child.inner));
+        }
+        // The parent may have been cancelled before the child was registered
+        if self.inner.cancelled.load(Ordering::SeqCst) {
+            child.cancel();
+        }
+        child
+    }
+
+    /// Cancels this token, its clones and its children.
+    pub fn cancel(&self) {
+        self.inner.cancel();
+    }
+
+    fn timed_out(&self) -> bool {
+        self.inner
+            .deadline
+            .is_some_and(|deadline| Instant::now() >= deadline)
+    }
+
+    pub fn is_cancelled(&self) -> bool {
+        self.inner.cancelled.load(Ordering::SeqCst) || self.timed_out()
+    }
+
+    /// The [`CodeRagError::Cancelled`] to return once cancelled, telling a
+    /// deadline from a cancellation.
+    pub fn error(&self) -> CodeRagError {
+        if !self.inner.cancelled.load(Ordering::SeqCst) && self.timed_out() {
+            CodeRagError::Cancelled("Deadline exceeded".to_string())
+        } else {
+            CodeRagError::Cancelled("Operation cancelled".to_string())
+        }
+    }
+
+    /// Fails with [`error`](Self::error) once cancelled.
+    pub fn check(&self) -> Result<(), CodeRagError> {
+        if self.is_cancelled() {
+            Err(self.error())
+        } else {
+            Ok(())
+        }
+    }
+
+    /// Completes once the token is cancelled or its deadline has passed.
+    pub async fn cancelled(&self) {
+        loop {
+            let notified = self.inner.notify.notified();
+            tokio::pin!(notified);
+            // Registered before checking, so a cancel in between isn't missed
+            notified.as_mut().enable();
+            if self.is_cancelled() {
+                return;
+            }
+            match self.inner.deadline {
+                Some(deadline) => {
+                    tokio::select! {
+                        _ = notified => {}
+                        _ = tokio::time::sleep_until(deadline) => {}
+                    }
+                }
+                None => notified.await,
+            }
+        }
+    }
+
+    /// Cancels this token on the first Ctrl-C, so the command can save what it
+    /// completed and stop; a second Ctrl-C exits the process at once.
+    pub fn cancel_on_interrupt(&self) {
+        let token = self.clone();
+        tokio::spawn(async move {
+            if tokio::signal::ctrl_c().await.is_err() {
+                return;
+            }
+            tracing::warn!("Interrupted, stopping... (press Ctrl-C again to exit now)");
+            token.cancel();
+            if tokio::signal::ctrl_c().await.is_ok() {
+                std::process::exit(130);
+            }
+        });
+    }
+
+    /// Blocks the thread for `duration`, for synchronous code waiting to
+    /// retry. Wakes up early with [`error`](Self::error) once cancelled.
+    pub fn sleep(&self, duration: Duration) -> Result<(), CodeRagError> {
+        const POLL_INTERVAL: Duration = Duration::from_millis(20);
+        let until = std::time::Instant::now() + duration;
+        loop {
+            self.check()?;
+            let left = until.saturating_duration_since(std::time::Instant::now());
+            if left.is_zero() {
+                return Ok(());
+            }
+            std::thread::sleep(left.min(POLL_INTERVAL));
+        }
+    }
+
+    /// A guard that cancels this token when dropped, e.g. when the future of
+    /// an HTTP request is dropped because its client went away.
+    pub fn cancel_on_drop(&self) -> CancelOnDrop {
+        CancelOnDrop(self.clone())
+    }
+
+    /// Runs `future` until it completes or the token is cancelled, in which
+    /// case it is dropped and [`error`](Self::error) returned.
+    pub async fn run<F: Future>(&self, future: F) -> Result<F::Output, CodeRagError> {
+        tokio::select! {
+            biased;
+            _ = self.cancelled() => Err(self.error()),
+            output = future => Ok(output),
+        }
+    }
+}
+
+/// Cancels its token when dropped, see [`CancelToken::cancel_on_drop`].
+#[must_use = "the token is cancelled as soon as the guard is dropped"]
+pub struct CancelOnDrop(CancelToken);
+
+impl Drop for CancelOnDrop {
+    fn drop(&mut self) {
+        self.0.cancel();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_cancel_stops_pending_work() {
+        let token = CancelToken::new();
+        assert!(token.check().is_ok());
+
+        let clone = token.clone();
+        let started = Instant::now();
+        let canceller = tokio::spawn(async move {
+            tokio::time::sleep(Duration::from_millis(20)).await;
+            clone.cancel();
+        });
+        let result = token.run(std::future::pending::<()>()).await;
+        canceller.await.unwrap();
+
+        assert!(matches!(result, Err(CodeRagError::Cancelled(_))));
+        assert!(started.elapsed() < Duration::from_secs(5));
+        assert!(token.is_cancelled());
+    }
+
+    #[tokio::test]
+    async fn test_children_follow_parent() {
+        let parent = CancelToken::new();
+        let child = parent.child();
+        let sibling = parent.child();
+        child.cancel();
+        assert!(child.is_cancelled());
+        assert!(!parent.is_cancelled());
+        assert!(!sibling.is_cancelled());
+
+        parent.cancel();
+        assert!(sibling.is_cancelled());
+        // Derived after the parent was cancelled
+        assert!(parent.child().is_cancelled());
+    }
+
+    #[tokio::test]
+    async fn test_timeout() {
+        let token = CancelToken::new().with_timeout(Duration::from_millis(10));
+        let result = token.run(std::future::pending::<()>()).await;
+        let err = result.unwrap_err();
+        assert!(err.to_string().contains("Deadline exceeded"), "{}", err);
+
+        // A child can't outlive its parent's deadline
+        let long = token.with_timeout(Duration::from_secs(3600));
+        assert!(long.is_cancelled());
+
+        let quick = CancelToken::new().with_timeout(Duration::from_secs(3600));
+        assert_eq!(quick.run(async { 1 }).await.unwrap(), 1);
+    }
+
+    #[test]
+    fn test_sleep_wakes_on_cancel() {
+        let token = CancelToken::new();
+        assert!(token.sleep(Duration::from_millis(5)).is_ok());
+
+        let clone = token.clone();
+        let canceller = std::thread::spawn(move || {
+            std::thread::sleep(Duration::from_millis(20));
+            clone.cancel();
+        });
+        let started = std::time::Instant::now();
+        let result = token.sleep(Duration::from_secs(60));
+        canceller.join().unwrap();
+        assert!(matches!(result, Err(CodeRagError::Cancelled(_))));
+        assert!(started.elapsed() < Duration::from_secs(5));
+    }
+
+    #[test]
+    fn test_cancel_on_drop() {
+        let token = CancelToken::new();
+        let guard = token.cancel_on_drop();
+        assert!(!token.is_cancelled());
+        drop(guard);
+        assert!(token.is_cancelled());
+    }
+}
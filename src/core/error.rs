@@ -1,5 +1,13 @@
 use thiserror::Error;
 
+/// Errors of the library and the CLI.
+///
+/// [`IndexNotFound`](Self::IndexNotFound), [`EmptyIndex`](Self::EmptyIndex),
+/// [`DimensionMismatch`](Self::DimensionMismatch) and
+/// [`EmbedderAuth`](Self::EmbedderAuth) mark failures callers commonly handle
+/// on their own, and their messages say how to fix them. Raised inside the
+/// `anyhow` results of the stores and embedders, they keep their variant
+/// through [`CodeRagError::from_anyhow`].
 #[derive(Error, Debug)]
 pub enum CodeRagError {
     #[error("IO error: {0}")]
@@ -28,6 +36,76 @@ pub enum CodeRagError {
 
     #[error("Generic error: {0}")]
     Generic(String),
+
+    /// Work stopped by a [`CancelToken`](super::CancelToken), on Ctrl-C or a deadline
+    #[error("Cancelled: {0}")]
+    Cancelled(String),
+
+    /// Nothing has been indexed at the path, or the workspace doesn't exist
+    #[error("{0}")]
+    IndexNotFound(String),
+
+    /// The index exists but holds no chunks
+    #[error("{0}")]
+    EmptyIndex(String),
+
+    /// The index's vectors don't fit the embedder: they have another
+    /// dimension, or were made by another model
+    #[error("{0}")]
+    DimensionMismatch(String),
+
+    /// The embedding API turned the credentials down (HTTP 401 or 403)
+    #[error("{0}")]
+    EmbedderAuth(String),
+}
+
+impl CodeRagError {
+    /// `err` as the `CodeRagError` it carries, or else `fallback` of its
+    /// message, for wrapping the errors of `anyhow` results. A
+    /// [`BatchError`](crate::embedding::BatchError) whose credentials were
+    /// turned down becomes [`EmbedderAuth`](Self::EmbedderAuth).
+    ///
+    /// ```
+    /// use code_rag::core::CodeRagError;
+    ///
+    /// let typed = anyhow::Error::from(CodeRagError::EmptyIndex("empty".to_string()))
+    ///     .context("Opening the index");
+    /// assert!(matches!(
+    ///     CodeRagError::from_anyhow(typed, CodeRagError::Database),
+    ///     CodeRagError::EmptyIndex(_)
+    /// ));
+    /// let other = CodeRagError::from_anyhow(anyhow::anyhow!("disk full"), CodeRagError::Database);
+    /// assert_eq!(other.to_string(), "Database error: disk full");
+    /// ```
+    pub fn from_anyhow(err: anyhow::Error, fallback: fn(String) -> CodeRagError) -> Self {
+        match err.downcast::<CodeRagError>() {
+            Ok(err) => err,
+            Err(err) if crate::embedding::BatchError::caused_auth_failure(&err) => {
+                CodeRagError::EmbedderAuth(format!(
+                    "{:#}. Check OPENAI_API_KEY and embedding_headers.",
+                    err
+                ))
+            }
+            Err(err) => fallback(err.to_string()),
+        }
+    }
+
+    /// Exit status of the CLI when a command fails with this error: 3 for
+    /// [`IndexNotFound`](Self::IndexNotFound), 4 for
+    /// [`EmptyIndex`](Self::EmptyIndex), 5 for
+    /// [`DimensionMismatch`](Self::DimensionMismatch), 6 for
+    /// [`EmbedderAuth`](Self::EmbedderAuth), 130 when
+    /// [`Cancelled`](Self::Cancelled) and 1 otherwise.
+    pub fn exit_code(&self) -> i32 {
+        match self {
+            CodeRagError::IndexNotFound(_) => 3,
+            CodeRagError::EmptyIndex(_) => 4,
+            CodeRagError::DimensionMismatch(_) => 5,
+            CodeRagError::EmbedderAuth(_) => 6,
+            CodeRagError::Cancelled(_) => 130,
+            _ => 1,
+        }
+    }
 }
 
 // Helper to convert other errors to CodeRagError
@@ -37,9 +115,10 @@ impl From<lancedb::Error> for CodeRagError {
     }
 }
 
+// fastembed's error is anyhow's, which the embedders return too
 impl From<fastembed::Error> for CodeRagError {
     fn from(err: fastembed::Error) -> Self {
-        CodeRagError::Embedding(err.to_string())
+        CodeRagError::from_anyhow(err, CodeRagError::Embedding)
     }
 }
 
@@ -67,6 +146,12 @@ impl axum::response::IntoResponse for CodeRagError {
             }
             CodeRagError::Tantivy(e) => (axum::http::StatusCode::INTERNAL_SERVER_ERROR, e.clone()),
             CodeRagError::Generic(e) => (axum::http::StatusCode::INTERNAL_SERVER_ERROR, e.clone()),
+            CodeRagError::Cancelled(e) => (axum::http::StatusCode::SERVICE_UNAVAILABLE, e.clone()),
+            CodeRagError::IndexNotFound(e) | CodeRagError::EmptyIndex(e) => {
+                (axum::http::StatusCode::NOT_FOUND, e.clone())
+            }
+            CodeRagError::DimensionMismatch(e) => (axum::http::StatusCode::CONFLICT, e.clone()),
+            CodeRagError::EmbedderAuth(e) => (axum::http::StatusCode::BAD_GATEWAY, e.clone()),
         };
 
         let body = serde_json::json!({
@@ -76,3 +161,42 @@ impl axum::response::IntoResponse for CodeRagError {
         (status, axum::Json(body)).into_response()
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::embedding::BatchError;
+
+    #[test]
+    fn test_exit_codes_survive_anyhow() {
+        let mismatch = anyhow::Error::from(CodeRagError::DimensionMismatch("768 vs 384".into()))
+            .context("Failed to open the vector store");
+        assert_eq!(
+            CodeRagError::from_anyhow(mismatch, CodeRagError::Database).exit_code(),
+            5
+        );
+
+        let denied = BatchError {
+            start: 0,
+            len: 1,
+            attempts: 1,
+            status: Some(401),
+            message: "HTTP 401: invalid key".to_string(),
+        };
+        let err = CodeRagError::from_anyhow(
+            anyhow::Error::from(denied).context("OpenAI embedding request failed"),
+            CodeRagError::Search,
+        );
+        assert!(matches!(err, CodeRagError::EmbedderAuth(_)), "{:?}", err);
+        assert!(err.to_string().contains("HTTP 401"), "{}", err);
+        assert_eq!(err.exit_code(), 6);
+
+        let other = CodeRagError::from_anyhow(anyhow::anyhow!("disk full"), CodeRagError::Search);
+        assert_eq!(other.exit_code(), 1);
+        let cancelled = CodeRagError::from_anyhow(
+            CodeRagError::Cancelled("Operation cancelled".into()).into(),
+            CodeRagError::Search,
+        );
+        assert_eq!(cancelled.exit_code(), 130);
+    }
+}
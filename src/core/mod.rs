@@ -1,2 +1,4 @@
+mod cancel;
 pub mod error;
+pub use cancel::{CancelOnDrop, CancelToken};
 pub use error::CodeRagError;
@@ -11,19 +11,169 @@ use ort::execution_providers::CoreMLExecutionProvider;
 
 use std::fs;
 use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+
+use crate::config::AppConfig;
+use crate::core::CancelToken;
+
+mod cache;
+mod ollama;
+mod openai;
+mod pool;
+mod remote;
+mod retry;
+
+pub use cache::EmbeddingCache;
+pub use ollama::OllamaEmbedder;
+pub use openai::OpenAIEmbedder;
+pub use pool::{
+    default_concurrency, embed_concurrently, FailedBatch, PoolOptions, PooledEmbeddings,
+};
+pub use remote::{parse_header, RemoteOptions};
+pub use retry::{BatchError, RetryPolicy};
+
+/// Backend that turns text into embedding vectors.
+///
+/// Implemented by the local fastembed model as well as the remote
+/// [`OpenAIEmbedder`] and [`OllamaEmbedder`] backends. Pass one to
+/// [`Embedder::with_provider`] to choose the backend at construction time.
+///
+/// Calls may arrive from several threads at once (see [`embed_concurrently`]);
+/// backends that can't serve them in parallel serialize internally.
+pub trait EmbeddingProvider: Send + Sync {
+    /// Embeds `texts`, returning one vector per input in the same order.
+    fn embed(&self, texts: Vec<String>, batch_size: Option<usize>) -> Result<Vec<Vec<f32>>>;
+
+    /// Like [`embed`](Self::embed), failing with
+    /// [`CodeRagError::Cancelled`](crate::core::CodeRagError::Cancelled) once
+    /// `cancel` is cancelled. Backends sending several requests check it
+    /// between them and while waiting to retry; by default it is only checked
+    /// before embedding.
+    fn embed_cancellable(
+        &self,
+        texts: Vec<String>,
+        batch_size: Option<usize>,
+        cancel: &CancelToken,
+    ) -> Result<Vec<Vec<f32>>> {
+        cancel.check()?;
+        self.embed(texts, batch_size)
+    }
+
+    /// Length of the vectors produced by this backend.
+    fn dim(&self) -> usize;
+
+    /// Identifier of the model, recorded next to the stored vectors.
+    fn model_name(&self) -> &str;
+
+    /// Largest number of texts worth sending in one call, if the backend has a limit.
+    fn max_batch(&self) -> Option<usize> {
+        None
+    }
+}
+
+/// Local ONNX embedding model served by fastembed.
+struct FastEmbedProvider {
+    model: Mutex<TextEmbedding>,
+    model_name: String,
+    dim: usize,
+}
+
+impl EmbeddingProvider for FastEmbedProvider {
+    fn embed(&self, texts: Vec<String>, batch_size: Option<usize>) -> Result<Vec<Vec<f32>>> {
+        // The session already uses all cores, so calls take turns
+        self.model
+            .lock()
+            .map_err(|e| anyhow::anyhow!("Embedder lock poisoned: {}", e))?
+            .embed(texts, batch_size)
+    }
+
+    fn dim(&self) -> usize {
+        self.dim
+    }
+
+    fn model_name(&self) -> &str {
+        &self.model_name
+    }
+}
 
 /// Text embedding and result reranker.
 ///
 /// Manages embedding model and optional reranker for semantic search.
 pub struct Embedder {
-    model: std::sync::Mutex<TextEmbedding>,
-    reranker: std::sync::Mutex<Option<TextRerank>>,
+    model: Box<dyn EmbeddingProvider>,
+    reranker: Mutex<Option<TextRerank>>,
     reranker_model_name: String,
     reranker_model_path: Option<String>,
+    model_name: String,
     dim: usize,
 }
 
-fn load_tokenizer_files(path: &Path) -> std::io::Result<TokenizerFiles> {
+/// Creates the remote backend named by `provider`.
+///
+/// Returns `Ok(None)` for `"fastembed"`, which is built by [`Embedder::new`]
+/// because it shares the device and model path settings. The remote backends
+/// send a test embedding before returning, so an unreachable endpoint or an
+/// unexpected dimension fails here rather than mid-indexing.
+///
+/// `"openai"` needs `OPENAI_API_KEY` only for the OpenAI API, and sends it
+/// nowhere else; with a `host` it targets any OpenAI-compatible server, which
+/// gets its credentials from the `headers`.
+pub fn create_remote_provider(
+    provider: &str,
+    model: &str,
+    options: &RemoteOptions,
+) -> Result<Option<Box<dyn EmbeddingProvider>>> {
+    match provider.to_lowercase().as_str() {
+        "fastembed" | "" => Ok(None),
+        "openai" => {
+            let embedder = match options.host.as_deref() {
+                Some(url) => OpenAIEmbedder::from_env_at(url, model)?,
+                None => OpenAIEmbedder::from_env(model)?,
+            };
+            let embedder = embedder
+                .with_headers(options.headers.iter().cloned())
+                .with_expected_dim(options.expected_dim)
+                .with_retry_policy(options.retry.clone());
+            Ok(Some(Box::new(embedder.connect()?)))
+        }
+        "ollama" => {
+            let host = options.host.as_deref().unwrap_or(ollama::DEFAULT_HOST);
+            let embedder = OllamaEmbedder::new(host, model)
+                .with_headers(options.headers.iter().cloned())
+                .with_expected_dim(options.expected_dim)
+                .with_retry_policy(options.retry.clone());
+            Ok(Some(Box::new(embedder.connect()?)))
+        }
+        other => anyhow::bail!(
+            "Unknown embedding provider '{}'. Expected one of: fastembed, openai, ollama",
+            other
+        ),
+    }
+}
+
+fn load_reranker(name: &str, cache_dir: Option<&str>, quiet: bool) -> Result<TextRerank> {
+    let model_enum = match name.to_lowercase().as_str() {
+        "bge-reranker-base" => RerankerModel::BGERerankerBase,
+        _ => {
+            tracing::warn!(
+                "Unknown reranker model '{}', defaulting to BGERerankerBase",
+                name
+            );
+            RerankerModel::BGERerankerBase
+        }
+    };
+
+    let mut rerank_init_options = RerankInitOptions::default();
+    rerank_init_options.model_name = model_enum;
+    rerank_init_options.show_download_progress = !quiet;
+    if let Some(path) = cache_dir {
+        rerank_init_options.cache_dir = PathBuf::from(path);
+    }
+
+    TextRerank::try_new(rerank_init_options)
+}
+
+pub(crate) fn load_tokenizer_files(path: &Path) -> std::io::Result<TokenizerFiles> {
     Ok(TokenizerFiles {
         tokenizer_file: fs::read(path.join("tokenizer.json"))?,
         config_file: fs::read(path.join("config.json"))?,
@@ -33,6 +183,57 @@ fn load_tokenizer_files(path: &Path) -> std::io::Result<TokenizerFiles> {
 }
 
 impl Embedder {
+    /// Builds the embedder selected by `embedding_provider` in the configuration.
+    ///
+    /// `"fastembed"` (the default) runs the local ONNX model; `"openai"` and
+    /// `"ollama"` delegate embedding to the respective HTTP APIs. The reranker
+    /// always runs locally.
+    pub fn from_config(config: &AppConfig, quiet: bool) -> Result<Self> {
+        match create_remote_provider(
+            &config.embedding_provider,
+            &config.embedding_model,
+            &RemoteOptions::from_config(config),
+        )? {
+            Some(provider) => Self::with_provider(
+                quiet,
+                provider,
+                config.reranker_model.clone(),
+                config.reranker_model_path.clone(),
+            ),
+            None => Self::new_with_quiet(
+                quiet,
+                config.embedding_model.clone(),
+                config.reranker_model.clone(),
+                config.embedding_model_path.clone(),
+                config.reranker_model_path.clone(),
+                config.device.clone(),
+            ),
+        }
+    }
+
+    /// Wraps a custom embedding backend, pairing it with the local reranker.
+    pub fn with_provider(
+        quiet: bool,
+        provider: Box<dyn EmbeddingProvider>,
+        reranker_model: String,
+        reranker_model_path: Option<String>,
+    ) -> Result<Self> {
+        let reranker = Some(load_reranker(
+            &reranker_model,
+            reranker_model_path.as_deref(),
+            quiet,
+        )?);
+
+        Ok(Self {
+            model_name: provider.model_name().to_string(),
+            dim: provider.dim(),
+            model: provider,
+            reranker: Mutex::new(reranker),
+            reranker_model_name: reranker_model,
+            reranker_model_path,
+        })
+    }
+
     pub fn new(
         embedding_model: String,
         reranker_model: String,
@@ -104,6 +305,11 @@ impl Embedder {
         };
         tracing::info!("Requested Execution Providers: {:?}", providers);
 
+        // Local model directories are identified by their path
+        let model_name = embedding_model_path
+            .clone()
+            .unwrap_or_else(|| embedding_model.clone());
+
         let mut model = if let Some(path_str) = embedding_model_path {
             let path = Path::new(&path_str);
             tracing::info!("Loading user-defined embedding model from: {}", path_str);
@@ -153,29 +359,22 @@ impl Embedder {
             }
         };
 
-        let model_enum = match reranker_model.to_lowercase().as_str() {
-            "bge-reranker-base" => RerankerModel::BGERerankerBase,
-            _ => {
-                tracing::warn!(
-                    "Unknown reranker model '{}', defaulting to BGERerankerBase",
-                    reranker_model
-                );
-                RerankerModel::BGERerankerBase
-            }
-        };
+        let reranker = Some(load_reranker(
+            &reranker_model,
+            reranker_model_path.as_deref(),
+            quiet,
+        )?);
 
-        let mut rerank_init_options = RerankInitOptions::default();
-        rerank_init_options.model_name = model_enum;
-        rerank_init_options.show_download_progress = !quiet;
-        if let Some(ref path) = reranker_model_path {
-            rerank_init_options.cache_dir = PathBuf::from(path);
-        }
-
-        let reranker = Some(TextRerank::try_new(rerank_init_options)?);
+        let provider = FastEmbedProvider {
+            model: Mutex::new(model),
+            model_name: model_name.clone(),
+            dim,
+        };
 
         Ok(Self {
-            model: std::sync::Mutex::new(model),
-            reranker: std::sync::Mutex::new(reranker),
+            model_name,
+            model: Box::new(provider),
+            reranker: Mutex::new(reranker),
             reranker_model_name: reranker_model,
             reranker_model_path,
             dim,
@@ -183,43 +382,63 @@ impl Embedder {
     }
 
     pub fn embed(&self, texts: Vec<String>, batch_size: Option<usize>) -> Result<Vec<Vec<f32>>> {
-        let embeddings = self
-            .model
-            .lock()
-            .map_err(|e| anyhow::anyhow!("Embedder lock poisoned: {}", e))?
-            .embed(texts, batch_size)?;
-        Ok(embeddings)
+        self.embed_cancellable(texts, batch_size, &CancelToken::default())
+    }
+
+    /// [`embed`](Self::embed), stopping early once `cancel` is cancelled, see
+    /// [`EmbeddingProvider::embed_cancellable`].
+    pub fn embed_cancellable(
+        &self,
+        texts: Vec<String>,
+        batch_size: Option<usize>,
+        cancel: &CancelToken,
+    ) -> Result<Vec<Vec<f32>>> {
+        let started = std::time::Instant::now();
+        let count = texts.len();
+        let vectors = self.model.embed_cancellable(texts, batch_size, cancel)?;
+        tracing::debug!(
+            texts = count,
+            elapsed_ms = started.elapsed().as_millis() as u64,
+            "Embedded texts"
+        );
+        Ok(vectors)
+    }
+
+    /// Embeds `texts` on a worker pool, see [`embed_concurrently`].
+    pub fn embed_concurrently(
+        &self,
+        texts: &[String],
+        options: &PoolOptions,
+        on_progress: impl Fn(usize) + Sync,
+    ) -> PooledEmbeddings {
+        embed_concurrently(self.model.as_ref(), texts, options, on_progress)
     }
 
     pub fn dim(&self) -> usize {
         self.dim
     }
 
+    /// Identifier of the embedding model, recorded next to the stored vectors.
+    pub fn model_name(&self) -> &str {
+        &self.model_name
+    }
+
+    /// Identifier of the cross-encoder used by [`rerank`](Self::rerank).
+    pub fn reranker_model_name(&self) -> &str {
+        &self.reranker_model_name
+    }
+
     pub fn init_reranker(&self) -> Result<()> {
         let mut reranker_guard = self
             .reranker
             .lock()
             .map_err(|e| anyhow::anyhow!("Reranker lock poisoned: {}", e))?;
         if reranker_guard.is_none() {
-            let model_enum = match self.reranker_model_name.to_lowercase().as_str() {
-                "bge-reranker-base" => RerankerModel::BGERerankerBase,
-                // "bge-reranker-v2-m3" => RerankerModel::BGERerankerV2M3, // Not verified
-                _ => {
-                    tracing::warn!(
-                        "Unknown reranker model '{}', defaulting to BGERerankerBase",
-                        self.reranker_model_name
-                    );
-                    RerankerModel::BGERerankerBase
-                }
-            };
-
-            let mut rerank_init_options = RerankInitOptions::default();
-            rerank_init_options.model_name = model_enum;
-            if let Some(path) = self.reranker_model_path.as_ref() {
-                rerank_init_options.cache_dir = PathBuf::from(path);
-            }
-
-            *reranker_guard = Some(TextRerank::try_new(rerank_init_options)?);
+            *reranker_guard = Some(load_reranker(
+                &self.reranker_model_name,
+                self.reranker_model_path.as_deref(),
+                false,
+            )?);
         }
         Ok(())
     }
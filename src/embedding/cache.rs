@@ -0,0 +1,263 @@
+use anyhow::{Context, Result};
+use rusqlite::{params, Connection, OptionalExtension};
+use sha2::{Digest, Sha256};
+use std::path::Path;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::Mutex;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+use crate::config::AppConfig;
+
+const SCHEMA: &str = r#"
+CREATE TABLE IF NOT EXISTS embeddings (
+    model TEXT NOT NULL,
+    dim INTEGER NOT NULL,
+    hash TEXT NOT NULL,
+    vector BLOB NOT NULL,
+    last_used INTEGER NOT NULL,
+    PRIMARY KEY (model, dim, hash)
+);
+CREATE INDEX IF NOT EXISTS embeddings_last_used ON embeddings (last_used);
+"#;
+
+/// Content-addressed store of embedding vectors, so text that was embedded
+/// once is never sent to the embedder again.
+///
+/// Vectors are keyed by model, dimension and the SHA-256 of the embedded
+/// text, not by file or chunk ID: an unchanged chunk in an edited file, a
+/// copied function or a second checkout of the same repository all hit the
+/// cache. One cache file can be shared by several indexes and models; it is a
+/// SQLite database, so concurrent `index` and `watch` processes may use it.
+///
+/// The cache holds at most `capacity` vectors over all models; when it is
+/// full the least recently used ones are evicted.
+#[derive(Debug)]
+pub struct EmbeddingCache {
+    conn: Mutex<Connection>,
+    model: String,
+    dim: usize,
+    capacity: usize,
+    hits: AtomicUsize,
+    misses: AtomicUsize,
+}
+
+impl EmbeddingCache {
+    /// Opens (or creates) the cache file at `path` for vectors of `model` with `dim` dimensions.
+    pub fn open(path: &Path, model: &str, dim: usize, capacity: usize) -> Result<Self> {
+        if let Some(parent) = path.parent().filter(|p| !p.as_os_str().is_empty()) {
+            std::fs::create_dir_all(parent).with_context(|| {
+                format!(
+                    "Failed to create embedding cache directory {}",
+                    parent.display()
+                )
+            })?;
+        }
+        let conn = Connection::open(path)
+            .with_context(|| format!("Failed to open embedding cache {}", path.display()))?;
+        // Other processes may hold the file; wait for them rather than fail
+        conn.busy_timeout(Duration::from_secs(5))?;
+        conn.pragma_update_and_check(None, "journal_mode", "WAL", |_| Ok(()))?;
+        Self::from_connection(conn, model, dim, capacity)
+            .with_context(|| format!("Failed to initialize embedding cache {}", path.display()))
+    }
+
+    /// Opens a throwaway in-memory cache.
+    pub fn open_in_memory(model: &str, dim: usize, capacity: usize) -> Result<Self> {
+        Self::from_connection(Connection::open_in_memory()?, model, dim, capacity)
+    }
+
+    /// Opens the cache configured by `embedding_cache`, if any, for `model`.
+    pub fn from_config(config: &AppConfig, model: &str, dim: usize) -> Result<Option<Self>> {
+        config
+            .embedding_cache
+            .as_deref()
+            .map(|path| Self::open(Path::new(path), model, dim, config.embedding_cache_size))
+            .transpose()
+    }
+
+    fn from_connection(conn: Connection, model: &str, dim: usize, capacity: usize) -> Result<Self> {
+        conn.execute_batch(SCHEMA)?;
+        Ok(Self {
+            conn: Mutex::new(conn),
+            model: model.to_string(),
+            dim,
+            capacity,
+            hits: AtomicUsize::new(0),
+            misses: AtomicUsize::new(0),
+        })
+    }
+
+    /// Cache key of `text`: its hex SHA-256.
+    pub fn content_hash(text: &str) -> String {
+        format!("{:x}", Sha256::digest(text.as_bytes()))
+    }
+
+    fn lock(&self) -> Result<std::sync::MutexGuard<'_, Connection>> {
+        self.conn
+            .lock()
+            .map_err(|_| anyhow::anyhow!("Embedding cache lock poisoned"))
+    }
+
+    /// Looks up the vector of each of `texts`; `None` where it isn't cached.
+    /// Hits count as a use for eviction.
+    pub fn get_many(&self, texts: &[&str]) -> Result<Vec<Option<Vec<f32>>>> {
+        let mut conn = self.lock()?;
+        let now = now_millis();
+        let tx = conn.transaction()?;
+        let mut found = Vec::with_capacity(texts.len());
+        {
+            let mut select = tx.prepare_cached(
+                "SELECT vector FROM embeddings WHERE model = ?1 AND dim = ?2 AND hash = ?3",
+            )?;
+            let mut touch = tx.prepare_cached(
+                "UPDATE embeddings SET last_used = ?4 WHERE model = ?1 AND dim = ?2 AND hash = ?3",
+            )?;
+            for text in texts {
+                let hash = Self::content_hash(text);
+                let vector: Option<Vec<u8>> = select
+                    .query_row(params![self.model, self.dim as i64, hash], |row| row.get(0))
+                    .optional()?;
+                let vector = vector
+                    .map(|bytes| decode_vector(&bytes))
+                    .filter(|v| v.len() == self.dim);
+                if vector.is_some() {
+                    touch.execute(params![self.model, self.dim as i64, hash, now])?;
+                }
+                found.push(vector);
+            }
+        }
+        tx.commit()?;
+
+        let hits = found.iter().filter(|v| v.is_some()).count();
+        self.hits.fetch_add(hits, Ordering::Relaxed);
+        self.misses.fetch_add(found.len() - hits, Ordering::Relaxed);
+        Ok(found)
+    }
+
+    /// Stores freshly embedded vectors, then evicts the least recently used
+    /// entries beyond the capacity. Vectors of another dimension are skipped.
+    pub fn insert_many(&self, entries: &[(&str, &[f32])]) -> Result<()> {
+        if entries.is_empty() || self.capacity == 0 {
+            return Ok(());
+        }
+        let mut conn = self.lock()?;
+        let now = now_millis();
+        let tx = conn.transaction()?;
+        {
+            let mut insert = tx.prepare_cached(
+                "INSERT OR REPLACE INTO embeddings (model, dim, hash, vector, last_used) \
+                VALUES (?1, ?2, ?3, ?4, ?5)",
+            )?;
+            for (text, vector) in entries {
+                if vector.len() != self.dim {
+                    continue;
+                }
+                insert.execute(params![
+                    self.model,
+                    self.dim as i64,
+                    Self::content_hash(text),
+                    encode_vector(vector),
+                    now
+                ])?;
+            }
+        }
+        let count: i64 = tx.query_row("SELECT COUNT(*) FROM embeddings", [], |row| row.get(0))?;
+        let excess = count - self.capacity as i64;
+        if excess > 0 {
+            tx.execute(
+                "DELETE FROM embeddings WHERE rowid IN \
+                (SELECT rowid FROM embeddings ORDER BY last_used LIMIT ?1)",
+                params![excess],
+            )?;
+            tracing::debug!(evicted = excess, "Evicted embedding cache entries");
+        }
+        tx.commit()?;
+        Ok(())
+    }
+
+    /// Number of vectors in the cache, over all models.
+    pub fn len(&self) -> Result<usize> {
+        let conn = self.lock()?;
+        let count: i64 = conn.query_row("SELECT COUNT(*) FROM embeddings", [], |row| row.get(0))?;
+        Ok(count as usize)
+    }
+
+    pub fn is_empty(&self) -> Result<bool> {
+        Ok(self.len()? == 0)
+    }
+
+    /// `(hits, misses)` of [`get_many`](Self::get_many) since the cache was opened.
+    pub fn stats(&self) -> (usize, usize) {
+        (
+            self.hits.load(Ordering::Relaxed),
+            self.misses.load(Ordering::Relaxed),
+        )
+    }
+}
+
+fn now_millis() -> i64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_millis() as i64)
+        .unwrap_or(0)
+}
+
+fn encode_vector(vector: &[f32]) -> Vec<u8> {
+    vector.iter().flat_map(|v| v.to_le_bytes()).collect()
+}
+
+fn decode_vector(bytes: &[u8]) -> Vec<f32> {
+    bytes
+        .chunks_exact(4)
+        .map(|b| f32::from_le_bytes([b[0], b[1], b[2], b[3]]))
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_hits_are_keyed_by_content_and_model() {
+        let dir = TempDir::new().unwrap();
+        let path = dir.path().join("cache/embeddings.sqlite");
+        let cache = EmbeddingCache::open(&path, "model-a", 2, 100).unwrap();
+        cache
+            .insert_many(&[("fn a() {}", &[1.0, 0.0]), ("fn b() {}", &[0.0, 1.0])])
+            .unwrap();
+
+        let found = cache.get_many(&["fn b() {}", "fn c() {}"]).unwrap();
+        assert_eq!(found, vec![Some(vec![0.0, 1.0]), None]);
+        assert_eq!(cache.stats(), (1, 1));
+
+        // Another process, or another repository, sharing the file
+        let shared = EmbeddingCache::open(&path, "model-a", 2, 100).unwrap();
+        assert_eq!(
+            shared.get_many(&["fn a() {}"]).unwrap(),
+            vec![Some(vec![1.0, 0.0])]
+        );
+        // Same text, other model or dimension: a miss
+        let other_model = EmbeddingCache::open(&path, "model-b", 2, 100).unwrap();
+        assert_eq!(other_model.get_many(&["fn a() {}"]).unwrap(), vec![None]);
+        let other_dim = EmbeddingCache::open(&path, "model-a", 3, 100).unwrap();
+        assert_eq!(other_dim.get_many(&["fn a() {}"]).unwrap(), vec![None]);
+    }
+
+    #[test]
+    fn test_evicts_least_recently_used() {
+        let cache = EmbeddingCache::open_in_memory("m", 1, 2).unwrap();
+        cache.insert_many(&[("a", &[1.0])]).unwrap();
+        std::thread::sleep(Duration::from_millis(5));
+        cache.insert_many(&[("b", &[2.0])]).unwrap();
+        std::thread::sleep(Duration::from_millis(5));
+        // Using "a" makes "b" the least recently used
+        cache.get_many(&["a"]).unwrap();
+        std::thread::sleep(Duration::from_millis(5));
+        cache.insert_many(&[("c", &[3.0])]).unwrap();
+
+        assert_eq!(cache.len().unwrap(), 2);
+        let found = cache.get_many(&["a", "b", "c"]).unwrap();
+        assert_eq!(found, vec![Some(vec![1.0]), None, Some(vec![3.0])]);
+    }
+}
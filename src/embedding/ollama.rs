@@ -0,0 +1,150 @@
+use anyhow::{anyhow, Context, Result};
+use serde::Deserialize;
+use std::time::Duration;
+
+use super::{BatchError, EmbeddingProvider, RetryPolicy};
+use crate::core::{CancelToken, CodeRagError};
+
+/// Default address of a local Ollama instance.
+pub const DEFAULT_HOST: &str = "http://localhost:11434";
+
+#[derive(Deserialize)]
+struct EmbeddingResponse {
+    embedding: Vec<f32>,
+}
+
+/// Embedding backend using a local Ollama `/api/embeddings` endpoint.
+///
+/// Runs fully offline once the model has been pulled (`ollama pull nomic-embed-text`).
+pub struct OllamaEmbedder {
+    agent: ureq::Agent,
+    host: String,
+    headers: Vec<(String, String)>,
+    model: String,
+    retry: RetryPolicy,
+    expected_dim: Option<usize>,
+    dim: usize,
+}
+
+impl OllamaEmbedder {
+    pub fn new(host: &str, model: &str) -> Self {
+        Self {
+            agent: ureq::AgentBuilder::new()
+                .timeout(Duration::from_secs(120))
+                .build(),
+            host: host.trim_end_matches('/').to_string(),
+            headers: Vec::new(),
+            model: model.to_string(),
+            retry: RetryPolicy::default(),
+            expected_dim: None,
+            dim: 0,
+        }
+    }
+
+    /// Sets how rate-limited (429) and failed (5xx) requests are retried.
+    pub fn with_retry_policy(mut self, retry: RetryPolicy) -> Self {
+        self.retry = retry;
+        self
+    }
+
+    /// Adds HTTP headers sent with every request, e.g. for a proxy in front of Ollama.
+    pub fn with_headers(mut self, headers: impl IntoIterator<Item = (String, String)>) -> Self {
+        self.headers.extend(headers);
+        self
+    }
+
+    /// Makes [`connect`](Self::connect) fail unless the model returns vectors of `dim` values.
+    pub fn with_expected_dim(mut self, dim: Option<usize>) -> Self {
+        self.expected_dim = dim;
+        self
+    }
+
+    /// Probes the server once to make sure the model is available and learn its dimension.
+    pub fn connect(mut self) -> Result<Self> {
+        self.dim = match self.request("warmup", 0, &CancelToken::default()) {
+            // A proxy in front of Ollama checking embedding_headers
+            Err(e) if BatchError::caused_auth_failure(&e) => {
+                return Err(CodeRagError::EmbedderAuth(format!(
+                    "Ollama at {} rejected the credentials for model '{}': {:#}. \
+                    Check embedding_headers.",
+                    self.host, self.model, e
+                ))
+                .into())
+            }
+            probe => probe.with_context(|| {
+                format!(
+                    "Ollama at {} did not answer a test request for model '{}'. \
+                    Check that it is running (embedding_host) and the model is pulled.",
+                    self.host, self.model
+                )
+            })?,
+        }
+        .len();
+        if self.dim == 0 {
+            return Err(anyhow!(
+                "Ollama returned an empty embedding for model '{}'",
+                self.model
+            ));
+        }
+        if let Some(expected) = self.expected_dim.filter(|&d| d != self.dim) {
+            return Err(CodeRagError::DimensionMismatch(format!(
+                "Ollama returned {} dimensions for model '{}', but embedding_dim is {}",
+                self.dim, self.model, expected
+            ))
+            .into());
+        }
+        Ok(self)
+    }
+
+    /// Embeds `prompt`, the text at `index` of the caller's texts.
+    fn request(&self, prompt: &str, index: usize, cancel: &CancelToken) -> Result<Vec<f32>> {
+        let url = format!("{}/api/embeddings", self.host);
+        let response: EmbeddingResponse = self
+            .retry
+            .send(index, 1, cancel, || {
+                let mut request = self.agent.post(&url);
+                for (name, value) in &self.headers {
+                    request = request.set(name, value);
+                }
+                request.send_json(serde_json::json!({
+                    "model": self.model,
+                    "prompt": prompt,
+                }))
+            })
+            .with_context(|| format!("Ollama embedding request to {} failed", url))?
+            .into_json()
+            .context("Failed to decode Ollama embedding response")?;
+        Ok(response.embedding)
+    }
+}
+
+impl EmbeddingProvider for OllamaEmbedder {
+    fn embed(&self, texts: Vec<String>, batch_size: Option<usize>) -> Result<Vec<Vec<f32>>> {
+        self.embed_cancellable(texts, batch_size, &CancelToken::default())
+    }
+
+    fn embed_cancellable(
+        &self,
+        texts: Vec<String>,
+        _batch_size: Option<usize>,
+        cancel: &CancelToken,
+    ) -> Result<Vec<Vec<f32>>> {
+        // The endpoint accepts a single prompt per request
+        texts
+            .iter()
+            .enumerate()
+            .map(|(i, text)| {
+                cancel.check()?;
+                self.request(text, i, cancel)
+            })
+            .collect()
+    }
+
+    fn dim(&self) -> usize {
+        self.dim
+    }
+
+    fn model_name(&self) -> &str {
+        &self.model
+    }
+}
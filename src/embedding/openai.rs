@@ -0,0 +1,315 @@
+use anyhow::{anyhow, Context, Result};
+use serde::Deserialize;
+use std::time::Duration;
+
+use super::{BatchError, EmbeddingProvider, RetryPolicy};
+use crate::core::{CancelToken, CodeRagError};
+
+/// Default OpenAI API root.
+pub const DEFAULT_BASE_URL: &str = "https://api.openai.com/v1";
+
+/// Host of the OpenAI API, the only one `OPENAI_API_KEY` is sent to.
+const OPENAI_API_HOST: &str = "api.openai.com";
+
+/// Maximum number of inputs sent in a single `/embeddings` request.
+pub const DEFAULT_MAX_BATCH: usize = 96;
+
+#[derive(Deserialize)]
+struct EmbeddingResponse {
+    data: Vec<EmbeddingData>,
+}
+
+#[derive(Deserialize)]
+struct EmbeddingData {
+    index: usize,
+    embedding: Vec<f32>,
+}
+
+/// Embedding backend using the OpenAI `/embeddings` API.
+///
+/// Also talks to OpenAI-compatible servers (Azure OpenAI, LM Studio, vLLM,
+/// gateways) through [`with_base_url`](Self::with_base_url) and
+/// [`with_headers`](Self::with_headers).
+///
+/// # Examples
+///
+/// ```no_run
+/// use code_rag::embedding::{Embedder, OpenAIEmbedder};
+///
+/// # fn main() -> anyhow::Result<()> {
+/// let provider = OpenAIEmbedder::from_env("text-embedding-3-small")?.connect()?;
+/// let embedder = Embedder::with_provider(
+///     false,
+///     Box::new(provider),
+///     "bge-reranker-base".to_string(),
+///     None,
+/// )?;
+/// # Ok(())
+/// # }
+/// ```
+pub struct OpenAIEmbedder {
+    agent: ureq::Agent,
+    /// Sent as a bearer token; `None` for servers without authentication
+    api_key: Option<String>,
+    base_url: String,
+    headers: Vec<(String, String)>,
+    model: String,
+    max_batch: usize,
+    retry: RetryPolicy,
+    /// Dimension [`connect`](Self::connect) requires, if known
+    expected_dim: Option<usize>,
+    dim: usize,
+}
+
+impl OpenAIEmbedder {
+    /// Creates a client for `model`, reading the API key from `OPENAI_API_KEY`.
+    pub fn from_env(model: &str) -> Result<Self> {
+        let api_key = std::env::var("OPENAI_API_KEY").map_err(|_| {
+            CodeRagError::EmbedderAuth(
+                "OPENAI_API_KEY must be set to use the OpenAI embedder".to_string(),
+            )
+        })?;
+        Ok(Self::new(api_key, model))
+    }
+
+    /// Creates a client for `model` on the OpenAI-compatible API at `base_url`.
+    ///
+    /// `OPENAI_API_KEY` is only read, and then required, when `base_url` is
+    /// the OpenAI API itself, so the key never reaches another host. Other
+    /// servers get their credentials from [`with_headers`](Self::with_headers),
+    /// e.g. `Authorization: Bearer ...`, or Azure's `api-key`; self-hosted ones
+    /// usually need none.
+    pub fn from_env_at(base_url: &str, model: &str) -> Result<Self> {
+        if is_openai_api(base_url) {
+            return Ok(Self::from_env(model)?.with_base_url(base_url));
+        }
+        Ok(Self::keyless(model).with_base_url(base_url))
+    }
+
+    pub fn new(api_key: String, model: &str) -> Self {
+        Self {
+            api_key: Some(api_key),
+            ..Self::keyless(model)
+        }
+    }
+
+    fn keyless(model: &str) -> Self {
+        Self {
+            agent: ureq::AgentBuilder::new()
+                .timeout(Duration::from_secs(60))
+                .build(),
+            api_key: None,
+            base_url: DEFAULT_BASE_URL.to_string(),
+            headers: Vec::new(),
+            model: model.to_string(),
+            max_batch: DEFAULT_MAX_BATCH,
+            retry: RetryPolicy::default(),
+            expected_dim: None,
+            dim: 0,
+        }
+    }
+
+    /// Overrides the API root (e.g. for Azure or OpenAI-compatible gateways).
+    ///
+    /// A query string is kept after the `/embeddings` path, as Azure expects:
+    /// `https://res.openai.azure.com/openai/deployments/emb?api-version=2024-02-01`.
+    pub fn with_base_url(mut self, base_url: &str) -> Self {
+        self.base_url = base_url.trim().to_string();
+        self
+    }
+
+    /// Adds HTTP headers sent with every request, e.g. `api-key` for Azure.
+    pub fn with_headers(mut self, headers: impl IntoIterator<Item = (String, String)>) -> Self {
+        self.headers.extend(headers);
+        self
+    }
+
+    /// Makes [`connect`](Self::connect) fail unless the endpoint returns vectors of `dim` values.
+    pub fn with_expected_dim(mut self, dim: Option<usize>) -> Self {
+        self.expected_dim = dim;
+        self
+    }
+
+    /// Sets the maximum number of inputs sent per request.
+    pub fn with_max_batch(mut self, max_batch: usize) -> Self {
+        self.max_batch = max_batch.max(1);
+        self
+    }
+
+    /// Sets how rate-limited (429) and failed (5xx) requests are retried.
+    pub fn with_retry_policy(mut self, retry: RetryPolicy) -> Self {
+        self.retry = retry;
+        self
+    }
+
+    /// Probes the API once to validate the endpoint and credentials and learn
+    /// the vector dimension. Credentials the API turns down fail with
+    /// [`CodeRagError::EmbedderAuth`].
+    pub fn connect(mut self) -> Result<Self> {
+        let probe = match self.request(&["warmup".to_string()], 0, &CancelToken::default()) {
+            Err(e) if BatchError::caused_auth_failure(&e) => {
+                return Err(CodeRagError::EmbedderAuth(format!(
+                    "Embedding endpoint {} rejected the credentials for model '{}': {:#}. \
+                    Check OPENAI_API_KEY and embedding_headers.",
+                    self.base_url, self.model, e
+                ))
+                .into())
+            }
+            probe => probe.with_context(|| {
+                format!(
+                    "Embedding endpoint {} did not answer a test request for model '{}'. \
+                    Check embedding_host (--embed-base-url), the API key and embedding_headers.",
+                    self.base_url, self.model
+                )
+            })?,
+        };
+        self.dim = probe
+            .first()
+            .map(|v| v.len())
+            .filter(|&dim| dim > 0)
+            .ok_or_else(|| anyhow!("{} returned no embedding for the probe request", self.url()))?;
+        if let Some(expected) = self.expected_dim.filter(|&d| d != self.dim) {
+            return Err(CodeRagError::DimensionMismatch(format!(
+                "Embedding endpoint {} returned {} dimensions for model '{}', but embedding_dim is {}",
+                self.base_url, self.dim, self.model, expected
+            ))
+            .into());
+        }
+        Ok(self)
+    }
+
+    /// URL of the embeddings route: `/embeddings` appended to the base URL's
+    /// path, before its query string.
+    fn url(&self) -> String {
+        let (path, query) = match self.base_url.split_once('?') {
+            Some((path, query)) => (path, Some(query)),
+            None => (self.base_url.as_str(), None),
+        };
+        let path = path.trim_end_matches('/');
+        match query {
+            Some(query) => format!("{}/embeddings?{}", path, query),
+            None => format!("{}/embeddings", path),
+        }
+    }
+
+    /// Embeds one request worth of `inputs`, which start at index `start` of the caller's texts.
+    fn request(
+        &self,
+        inputs: &[String],
+        start: usize,
+        cancel: &CancelToken,
+    ) -> Result<Vec<Vec<f32>>> {
+        let url = self.url();
+        let response: EmbeddingResponse = self
+            .retry
+            .send(start, inputs.len(), cancel, || {
+                let mut request = self.agent.post(&url);
+                if let Some(key) = &self.api_key {
+                    request = request.set("Authorization", &format!("Bearer {}", key));
+                }
+                for (name, value) in &self.headers {
+                    request = request.set(name, value);
+                }
+                request.send_json(serde_json::json!({
+                    "model": self.model,
+                    "input": inputs,
+                }))
+            })
+            .with_context(|| format!("OpenAI embedding request to {} failed", url))?
+            .into_json()
+            .context("Failed to decode OpenAI embedding response")?;
+
+        let mut data = response.data;
+        if data.len() != inputs.len() {
+            anyhow::bail!(
+                "OpenAI returned {} embeddings for {} inputs",
+                data.len(),
+                inputs.len()
+            );
+        }
+        data.sort_by_key(|d| d.index);
+        Ok(data.into_iter().map(|d| d.embedding).collect())
+    }
+}
+
+/// Whether `base_url` is the OpenAI API, over HTTPS.
+fn is_openai_api(base_url: &str) -> bool {
+    url::Url::parse(base_url.trim())
+        .is_ok_and(|url| url.scheme() == "https" && url.host_str() == Some(OPENAI_API_HOST))
+}
+
+impl EmbeddingProvider for OpenAIEmbedder {
+    fn embed(&self, texts: Vec<String>, batch_size: Option<usize>) -> Result<Vec<Vec<f32>>> {
+        self.embed_cancellable(texts, batch_size, &CancelToken::default())
+    }
+
+    fn embed_cancellable(
+        &self,
+        texts: Vec<String>,
+        batch_size: Option<usize>,
+        cancel: &CancelToken,
+    ) -> Result<Vec<Vec<f32>>> {
+        let batch = batch_size
+            .unwrap_or(self.max_batch)
+            .clamp(1, self.max_batch);
+        let mut vectors = Vec::with_capacity(texts.len());
+        for (i, inputs) in texts.chunks(batch).enumerate() {
+            cancel.check()?;
+            vectors.extend(self.request(inputs, i * batch, cancel)?);
+        }
+        Ok(vectors)
+    }
+
+    fn dim(&self) -> usize {
+        self.dim
+    }
+
+    fn model_name(&self) -> &str {
+        &self.model
+    }
+
+    fn max_batch(&self) -> Option<usize> {
+        Some(self.max_batch)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_embeddings_url() {
+        let url = |base: &str| {
+            OpenAIEmbedder::new("key".to_string(), "m")
+                .with_base_url(base)
+                .url()
+        };
+        assert_eq!(
+            url(DEFAULT_BASE_URL),
+            "https://api.openai.com/v1/embeddings"
+        );
+        assert_eq!(
+            url("http://localhost:1234/v1/"),
+            "http://localhost:1234/v1/embeddings"
+        );
+        assert_eq!(
+            url("https://res.openai.azure.com/openai/deployments/emb?api-version=2024-02-01"),
+            "https://res.openai.azure.com/openai/deployments/emb/embeddings?api-version=2024-02-01"
+        );
+    }
+
+    #[test]
+    fn test_key_only_for_openai_api() {
+        assert!(is_openai_api(DEFAULT_BASE_URL));
+        assert!(is_openai_api("https://API.openai.com/v1/"));
+        assert!(!is_openai_api("http://api.openai.com/v1"));
+        assert!(!is_openai_api("https://api.openai.com.example.net/v1"));
+        assert!(!is_openai_api(
+            "https://gateway.example.com/api.openai.com/v1"
+        ));
+        assert!(!is_openai_api("http://localhost:1234/v1"));
+
+        let embedder = OpenAIEmbedder::from_env_at("http://localhost:1234/v1", "m").unwrap();
+        assert!(embedder.api_key.is_none());
+    }
+}
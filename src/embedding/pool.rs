@@ -0,0 +1,444 @@
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+use std::sync::Mutex;
+use std::thread;
+use std::time::{Duration, Instant};
+
+use super::{BatchError, EmbeddingProvider};
+use crate::core::CancelToken;
+
+/// Settings for [`embed_concurrently`].
+#[derive(Debug, Clone)]
+pub struct PoolOptions {
+    /// Number of batches embedded at the same time
+    pub concurrency: usize,
+    /// Attempts per batch before it is reported as failed
+    pub max_attempts: usize,
+    /// Delay before the first retry; doubled on every further attempt
+    pub retry_delay: Duration,
+    /// Once cancelled, batches not yet started fail instead of being embedded
+    pub cancel: CancelToken,
+}
+
+impl Default for PoolOptions {
+    fn default() -> Self {
+        Self {
+            concurrency: default_concurrency(),
+            max_attempts: 3,
+            retry_delay: Duration::from_millis(500),
+            cancel: CancelToken::default(),
+        }
+    }
+}
+
+/// One worker per available CPU.
+pub fn default_concurrency() -> usize {
+    thread::available_parallelism()
+        .map(|n| n.get())
+        .unwrap_or(1)
+}
+
+/// A batch that still failed after [`PoolOptions::max_attempts`] attempts.
+#[derive(Debug, Clone)]
+pub struct FailedBatch {
+    /// Index of the first text of the batch
+    pub start: usize,
+    pub len: usize,
+    pub error: String,
+    /// The server turned the credentials down, here or in an earlier batch;
+    /// no later attempt can succeed
+    pub auth_failure: bool,
+}
+
+/// Result of [`embed_concurrently`].
+#[derive(Debug, Default)]
+pub struct PooledEmbeddings {
+    /// One entry per input text, in input order; `None` where the batch failed
+    pub vectors: Vec<Option<Vec<f32>>>,
+    pub failed: Vec<FailedBatch>,
+}
+
+/// Embeds `texts` in batches spread over a pool of worker threads.
+///
+/// Batches hold at most [`EmbeddingProvider::max_batch`] texts, and are kept
+/// small enough to give every worker something to do. A failing batch is
+/// retried with exponential backoff; if it keeps failing it is recorded in
+/// [`PooledEmbeddings::failed`] and the remaining batches still run, unless
+/// the server rejected the credentials: the batches after that fail unsent,
+/// marked [`FailedBatch::auth_failure`].
+/// `on_progress` receives the running number of texts processed.
+///
+/// Cancelling [`PoolOptions::cancel`] stops the workers: batches not started
+/// are skipped, retries are not waited for, and remote backends send no
+/// further request of a batch in flight. A request already sent finishes or
+/// times out. The batches left are reported as failed.
+pub fn embed_concurrently(
+    provider: &dyn EmbeddingProvider,
+    texts: &[String],
+    options: &PoolOptions,
+    on_progress: impl Fn(usize) + Sync,
+) -> PooledEmbeddings {
+    if texts.is_empty() {
+        return PooledEmbeddings::default();
+    }
+
+    let concurrency = options.concurrency.max(1);
+    let mut batch_len = texts.len().div_ceil(concurrency);
+    if let Some(max_batch) = provider.max_batch() {
+        batch_len = batch_len.min(max_batch.max(1));
+    }
+    let batches: Vec<(usize, &[String])> = texts
+        .chunks(batch_len)
+        .enumerate()
+        .map(|(i, batch)| (i * batch_len, batch))
+        .collect();
+
+    let next = AtomicUsize::new(0);
+    let done = AtomicUsize::new(0);
+    let denied = AtomicBool::new(false);
+    // (start, len, result, auth failure) per batch, in completion order
+    type Finished = (usize, usize, anyhow::Result<Vec<Vec<f32>>>, bool);
+    let finished: Mutex<Vec<Finished>> = Mutex::new(Vec::new());
+
+    thread::scope(|scope| {
+        for _ in 0..concurrency.min(batches.len()) {
+            scope.spawn(|| loop {
+                let i = next.fetch_add(1, Ordering::Relaxed);
+                let Some(&(start, batch)) = batches.get(i) else {
+                    break;
+                };
+                let (result, auth_failure) = if denied.load(Ordering::Relaxed) {
+                    (
+                        Err(anyhow::anyhow!(
+                            "Not sent, the embedding endpoint rejected the credentials"
+                        )),
+                        true,
+                    )
+                } else {
+                    let result = match options.cancel.check() {
+                        Ok(()) => embed_with_retry(provider, batch, options),
+                        Err(e) => Err(e.into()),
+                    };
+                    let auth_failure = result.as_ref().is_err_and(BatchError::caused_auth_failure);
+                    if auth_failure {
+                        denied.store(true, Ordering::Relaxed);
+                    }
+                    (result, auth_failure)
+                };
+                let processed = done.fetch_add(batch.len(), Ordering::Relaxed) + batch.len();
+                on_progress(processed);
+                if let Ok(mut finished) = finished.lock() {
+                    finished.push((start, batch.len(), result, auth_failure));
+                }
+            });
+        }
+    });
+
+    // Reassemble in input order, whatever order the batches completed in
+    let mut output = PooledEmbeddings {
+        vectors: vec![None; texts.len()],
+        failed: Vec::new(),
+    };
+    let mut finished = finished.into_inner().unwrap_or_default();
+    finished.sort_by_key(|(start, _, _, _)| *start);
+    for (start, len, result, auth_failure) in finished {
+        match result {
+            Ok(vectors) if vectors.len() == len => {
+                for (offset, vector) in vectors.into_iter().enumerate() {
+                    output.vectors[start + offset] = Some(vector);
+                }
+            }
+            Ok(vectors) => output.failed.push(FailedBatch {
+                start,
+                len,
+                error: format!("Got {} embeddings for {} texts", vectors.len(), len),
+                auth_failure,
+            }),
+            Err(e) => output.failed.push(FailedBatch {
+                start,
+                len,
+                error: e.to_string(),
+                auth_failure,
+            }),
+        }
+    }
+    output
+}
+
+fn embed_with_retry(
+    provider: &dyn EmbeddingProvider,
+    batch: &[String],
+    options: &PoolOptions,
+) -> anyhow::Result<Vec<Vec<f32>>> {
+    let mut delay = options.retry_delay;
+    let mut attempt = 1;
+    loop {
+        let started = Instant::now();
+        match provider.embed_cancellable(batch.to_vec(), Some(batch.len()), &options.cancel) {
+            Ok(vectors) => {
+                tracing::debug!(
+                    texts = batch.len(),
+                    attempt,
+                    elapsed_ms = started.elapsed().as_millis() as u64,
+                    "Embedded batch"
+                );
+                return Ok(vectors);
+            }
+            // The HTTP backends already retried this one
+            Err(e) if e.downcast_ref::<BatchError>().is_some() => return Err(e),
+            Err(e) if attempt >= options.max_attempts.max(1) || options.cancel.is_cancelled() => {
+                return Err(e)
+            }
+            Err(e) => {
+                tracing::warn!(
+                    "Embedding a batch of {} texts failed (attempt {}/{}): {}. Retrying in {:?}.",
+                    batch.len(),
+                    attempt,
+                    options.max_attempts,
+                    e,
+                    delay
+                );
+                options.cancel.sleep(delay)?;
+                delay *= 2;
+                attempt += 1;
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::collections::HashMap;
+
+    /// Embeds a text as `[len]` after failing the configured number of times per text.
+    struct FlakyProvider {
+        failures: Mutex<HashMap<String, usize>>,
+        max_batch: Option<usize>,
+    }
+
+    impl FlakyProvider {
+        fn new(failures: &[(&str, usize)], max_batch: Option<usize>) -> Self {
+            Self {
+                failures: Mutex::new(
+                    failures
+                        .iter()
+                        .map(|(text, n)| (text.to_string(), *n))
+                        .collect(),
+                ),
+                max_batch,
+            }
+        }
+    }
+
+    impl EmbeddingProvider for FlakyProvider {
+        fn embed(
+            &self,
+            texts: Vec<String>,
+            _batch_size: Option<usize>,
+        ) -> anyhow::Result<Vec<Vec<f32>>> {
+            let mut failures = self.failures.lock().unwrap();
+            for text in &texts {
+                if let Some(left) = failures.get_mut(text).filter(|n| **n > 0) {
+                    *left -= 1;
+                    anyhow::bail!("transient failure for {}", text);
+                }
+            }
+            Ok(texts.iter().map(|t| vec![t.len() as f32]).collect())
+        }
+
+        fn dim(&self) -> usize {
+            1
+        }
+
+        fn model_name(&self) -> &str {
+            "flaky"
+        }
+
+        fn max_batch(&self) -> Option<usize> {
+            self.max_batch
+        }
+    }
+
+    fn options(max_attempts: usize) -> PoolOptions {
+        PoolOptions {
+            concurrency: 4,
+            max_attempts,
+            retry_delay: Duration::from_millis(1),
+            cancel: CancelToken::default(),
+        }
+    }
+
+    fn texts(n: usize) -> Vec<String> {
+        (1..=n).map(|i| "x".repeat(i)).collect()
+    }
+
+    #[test]
+    fn test_preserves_input_order() {
+        let provider = FlakyProvider::new(&[], Some(3));
+        let progress = AtomicUsize::new(0);
+        let output = embed_concurrently(&provider, &texts(20), &options(1), |n| {
+            progress.fetch_max(n, Ordering::Relaxed);
+        });
+        let lengths: Vec<f32> = output
+            .vectors
+            .iter()
+            .map(|v| v.as_ref().unwrap()[0])
+            .collect();
+        assert_eq!(lengths, (1..=20).map(|i| i as f32).collect::<Vec<_>>());
+        assert!(output.failed.is_empty());
+        assert_eq!(progress.load(Ordering::Relaxed), 20);
+    }
+
+    #[test]
+    fn test_retries_transient_failures() {
+        let provider = FlakyProvider::new(&[("xxx", 2)], Some(2));
+        let output = embed_concurrently(&provider, &texts(6), &options(3), |_| {});
+        assert!(output.failed.is_empty());
+        assert!(output.vectors.iter().all(Option::is_some));
+    }
+
+    #[test]
+    fn test_reports_batches_that_never_embed() {
+        let provider = FlakyProvider::new(&[("xxx", 10)], Some(2));
+        let output = embed_concurrently(&provider, &texts(6), &options(2), |_| {});
+        assert_eq!(output.failed.len(), 1);
+        assert_eq!((output.failed[0].start, output.failed[0].len), (2, 2));
+        assert!(output.failed[0].error.contains("transient failure"));
+        let missing: Vec<usize> = (0..6).filter(|&i| output.vectors[i].is_none()).collect();
+        assert_eq!(missing, vec![2, 3]);
+    }
+
+    /// Cancels `token` when asked to embed `trigger`.
+    struct CancellingProvider {
+        inner: FlakyProvider,
+        token: CancelToken,
+        trigger: String,
+    }
+
+    impl EmbeddingProvider for CancellingProvider {
+        fn embed(
+            &self,
+            texts: Vec<String>,
+            batch_size: Option<usize>,
+        ) -> anyhow::Result<Vec<Vec<f32>>> {
+            if texts.contains(&self.trigger) {
+                self.token.cancel();
+            }
+            self.inner.embed(texts, batch_size)
+        }
+
+        fn dim(&self) -> usize {
+            1
+        }
+
+        fn model_name(&self) -> &str {
+            "cancelling"
+        }
+
+        fn max_batch(&self) -> Option<usize> {
+            self.inner.max_batch()
+        }
+    }
+
+    #[test]
+    fn test_cancel_stops_remaining_batches() {
+        let token = CancelToken::new();
+        let provider = CancellingProvider {
+            inner: FlakyProvider::new(&[], Some(2)),
+            token: token.clone(),
+            trigger: "x".to_string(),
+        };
+        let options = PoolOptions {
+            concurrency: 1,
+            cancel: token,
+            ..options(3)
+        };
+        let output = embed_concurrently(&provider, &texts(6), &options, |_| {});
+        // The batch in flight completes, the others are never sent
+        assert!(output.vectors[0].is_some() && output.vectors[1].is_some());
+        assert!(output.vectors[2..].iter().all(Option::is_none));
+        assert_eq!(output.failed.len(), 2);
+        assert!(
+            output.failed[0].error.contains("cancelled"),
+            "{:?}",
+            output.failed
+        );
+    }
+
+    #[test]
+    fn test_cancel_interrupts_retry_delay() {
+        let token = CancelToken::new();
+        let provider = FlakyProvider::new(&[("x", 1)], None);
+        let options = PoolOptions {
+            concurrency: 1,
+            retry_delay: Duration::from_secs(60),
+            cancel: token.clone(),
+            ..options(3)
+        };
+        let canceller = thread::spawn(move || {
+            thread::sleep(Duration::from_millis(20));
+            token.cancel();
+        });
+        let started = Instant::now();
+        let output = embed_concurrently(&provider, &texts(1), &options, |_| {});
+        canceller.join().unwrap();
+        assert!(started.elapsed() < Duration::from_secs(5));
+        assert_eq!(output.failed.len(), 1);
+        assert!(
+            output.failed[0].error.contains("cancelled"),
+            "{:?}",
+            output.failed
+        );
+    }
+
+    /// Rejects every request with HTTP 401, counting the attempts.
+    struct DeniedProvider {
+        calls: AtomicUsize,
+    }
+
+    impl EmbeddingProvider for DeniedProvider {
+        fn embed(
+            &self,
+            texts: Vec<String>,
+            _batch_size: Option<usize>,
+        ) -> anyhow::Result<Vec<Vec<f32>>> {
+            self.calls.fetch_add(1, Ordering::Relaxed);
+            Err(BatchError {
+                start: 0,
+                len: texts.len(),
+                attempts: 1,
+                status: Some(401),
+                message: "invalid api key".to_string(),
+            }
+            .into())
+        }
+
+        fn dim(&self) -> usize {
+            1
+        }
+
+        fn model_name(&self) -> &str {
+            "denied"
+        }
+
+        fn max_batch(&self) -> Option<usize> {
+            Some(2)
+        }
+    }
+
+    #[test]
+    fn test_rejected_credentials_skip_remaining_batches() {
+        let provider = DeniedProvider {
+            calls: AtomicUsize::new(0),
+        };
+        let options = PoolOptions {
+            concurrency: 1,
+            ..options(3)
+        };
+        let output = embed_concurrently(&provider, &texts(6), &options, |_| {});
+        assert_eq!(provider.calls.load(Ordering::Relaxed), 1);
+        assert_eq!(output.failed.len(), 3);
+        assert!(output.failed.iter().all(|b| b.auth_failure));
+        assert!(output.vectors.iter().all(Option::is_none));
+    }
+}
@@ -0,0 +1,62 @@
+use anyhow::{anyhow, Result};
+
+use super::RetryPolicy;
+use crate::config::AppConfig;
+
+/// Connection settings shared by the remote embedding backends.
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct RemoteOptions {
+    /// API root; `None` uses the backend's default
+    pub host: Option<String>,
+    /// HTTP headers sent with every request
+    pub headers: Vec<(String, String)>,
+    /// Dimension the endpoint must return when probed (unset = any)
+    pub expected_dim: Option<usize>,
+    pub retry: RetryPolicy,
+}
+
+impl RemoteOptions {
+    /// Reads `embedding_host`, `embedding_headers`, `embedding_dim` and the retry settings.
+    pub fn from_config(config: &AppConfig) -> Self {
+        let mut headers: Vec<(String, String)> = config
+            .embedding_headers
+            .iter()
+            .map(|(name, value)| (name.clone(), value.clone()))
+            .collect();
+        headers.sort();
+        Self {
+            host: config.embedding_host.clone(),
+            headers,
+            expected_dim: config.embedding_dim,
+            retry: RetryPolicy::from_config(config),
+        }
+    }
+}
+
+/// Parses a `Name: value` header as given to `--embed-header`.
+pub fn parse_header(header: &str) -> Result<(String, String)> {
+    let (name, value) = header
+        .split_once(':')
+        .ok_or_else(|| anyhow!("Expected a header as 'Name: value', got '{}'", header))?;
+    let name = name.trim();
+    if name.is_empty() || name.contains(char::is_whitespace) {
+        anyhow::bail!("Invalid header name in '{}'", header);
+    }
+    Ok((name.to_string(), value.trim().to_string()))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_header() {
+        assert_eq!(
+            parse_header("api-key: abc:123 ").unwrap(),
+            ("api-key".to_string(), "abc:123".to_string())
+        );
+        assert!(parse_header("no-colon").is_err());
+        assert!(parse_header(": value").is_err());
+        assert!(parse_header("X Bad: value").is_err());
+    }
+}
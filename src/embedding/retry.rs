@@ -0,0 +1,239 @@
+use std::collections::hash_map::RandomState;
+use std::hash::{BuildHasher, Hasher};
+use std::time::Duration;
+
+use crate::config::AppConfig;
+use crate::core::CancelToken;
+
+/// How HTTP embedding backends retry rate-limited (429) and failed (5xx)
+/// requests, and requests whose connection failed or broke off.
+///
+/// Delays grow exponentially from `base_delay` with up to 50% random jitter and
+/// are capped at `max_delay`. A `Retry-After` header from the server takes
+/// precedence over the computed delay, within the same cap.
+#[derive(Debug, Clone, PartialEq)]
+pub struct RetryPolicy {
+    /// Retries after the first attempt; 0 disables retrying
+    pub max_retries: u32,
+    pub base_delay: Duration,
+    pub max_delay: Duration,
+}
+
+impl Default for RetryPolicy {
+    fn default() -> Self {
+        Self {
+            max_retries: 5,
+            base_delay: Duration::from_millis(500),
+            max_delay: Duration::from_secs(60),
+        }
+    }
+}
+
+/// An embedding request that kept failing after all retries.
+///
+/// `start..start + len` is the range of the failing inputs within the texts
+/// passed to [`EmbeddingProvider::embed`](super::EmbeddingProvider::embed);
+/// inputs before `start` were embedded successfully, so a caller can resume
+/// from there.
+#[derive(Debug, Clone, thiserror::Error)]
+#[error("Embedding batch {start}..{} failed after {attempts} attempts: {message}", .start + .len)]
+pub struct BatchError {
+    pub start: usize,
+    pub len: usize,
+    pub attempts: u32,
+    /// HTTP status of the last response, if the server answered
+    pub status: Option<u16>,
+    pub message: String,
+}
+
+impl BatchError {
+    /// Whether the server turned the credentials down, which no retry fixes.
+    pub fn is_auth_failure(&self) -> bool {
+        matches!(self.status, Some(401 | 403))
+    }
+
+    /// Whether `err` is, or was caused by, a [`BatchError`] the server
+    /// answered with 401 or 403.
+    pub(crate) fn caused_auth_failure(err: &anyhow::Error) -> bool {
+        err.downcast_ref::<BatchError>()
+            .is_some_and(BatchError::is_auth_failure)
+    }
+}
+
+impl RetryPolicy {
+    /// Reads `embedding_max_retries` and `embedding_retry_base_ms`.
+    pub fn from_config(config: &AppConfig) -> Self {
+        Self {
+            max_retries: config.embedding_max_retries,
+            base_delay: Duration::from_millis(config.embedding_retry_base_ms),
+            ..Default::default()
+        }
+    }
+
+    /// Sends `request` until it succeeds, fails with a non-retryable error,
+    /// retries run out or `cancel` is cancelled while waiting to retry.
+    /// `start` and `len` locate the batch for [`BatchError`].
+    pub fn send(
+        &self,
+        start: usize,
+        len: usize,
+        cancel: &CancelToken,
+        mut request: impl FnMut() -> Result<ureq::Response, ureq::Error>,
+    ) -> Result<ureq::Response, BatchError> {
+        let mut attempt = 0;
+        loop {
+            attempt += 1;
+            let (status, message, retry_after, retryable) = match request() {
+                Ok(response) => return Ok(response),
+                Err(ureq::Error::Status(code, response)) => {
+                    let retry_after = response.header("Retry-After").and_then(parse_retry_after);
+                    let body = response.into_string().unwrap_or_default();
+                    (
+                        Some(code),
+                        format!("HTTP {}: {}", code, body.trim()),
+                        retry_after,
+                        is_retryable(code),
+                    )
+                }
+                Err(ureq::Error::Transport(transport)) => {
+                    let retryable = is_retryable_transport(transport.kind());
+                    (None, transport.to_string(), None, retryable)
+                }
+            };
+
+            if !retryable || attempt > self.max_retries {
+                return Err(BatchError {
+                    start,
+                    len,
+                    attempts: attempt,
+                    status,
+                    message,
+                });
+            }
+
+            let delay = self.delay(attempt, retry_after);
+            tracing::warn!(
+                "Embedding request failed ({}), retry {}/{} in {:?}",
+                message,
+                attempt,
+                self.max_retries,
+                delay
+            );
+            if let Err(e) = cancel.sleep(delay) {
+                return Err(BatchError {
+                    start,
+                    len,
+                    attempts: attempt,
+                    status,
+                    message: format!("{} ({})", message, e),
+                });
+            }
+        }
+    }
+
+    /// Delay before retry number `attempt` (1-based).
+    fn delay(&self, attempt: u32, retry_after: Option<Duration>) -> Duration {
+        if let Some(retry_after) = retry_after {
+            return retry_after.min(self.max_delay);
+        }
+        let exponential = self
+            .base_delay
+            .saturating_mul(2u32.saturating_pow(attempt.saturating_sub(1)));
+        let jitter = exponential.mul_f64(random_fraction() * 0.5);
+        (exponential + jitter).min(self.max_delay)
+    }
+}
+
+fn is_retryable(status: u16) -> bool {
+    status == 429 || (500..600).contains(&status)
+}
+
+/// Refused, reset or timed-out connections may well succeed on another try;
+/// a bad URL or a TLS or proxy misconfiguration won't.
+fn is_retryable_transport(kind: ureq::ErrorKind) -> bool {
+    matches!(
+        kind,
+        ureq::ErrorKind::ConnectionFailed | ureq::ErrorKind::Io
+    )
+}
+
+/// Parses a `Retry-After` value given in seconds. HTTP dates are not supported.
+fn parse_retry_after(value: &str) -> Option<Duration> {
+    value.trim().parse::<u64>().ok().map(Duration::from_secs)
+}
+
+/// A value in `[0, 1)`, random enough to spread out concurrent retries.
+fn random_fraction() -> f64 {
+    let bits = RandomState::new().build_hasher().finish();
+    (bits >> 11) as f64 / (1u64 << 53) as f64
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn policy() -> RetryPolicy {
+        RetryPolicy {
+            max_retries: 3,
+            base_delay: Duration::from_millis(100),
+            max_delay: Duration::from_millis(350),
+        }
+    }
+
+    #[test]
+    fn test_delay_grows_with_jitter_and_cap() {
+        let policy = policy();
+        for _ in 0..20 {
+            let first = policy.delay(1, None);
+            assert!(first >= Duration::from_millis(100) && first <= Duration::from_millis(150));
+            let second = policy.delay(2, None);
+            assert!(second >= Duration::from_millis(200) && second <= Duration::from_millis(300));
+            assert_eq!(policy.delay(3, None), Duration::from_millis(350));
+        }
+        assert_eq!(
+            policy.delay(1, Some(Duration::from_millis(250))),
+            Duration::from_millis(250)
+        );
+        assert_eq!(
+            policy.delay(1, Some(Duration::from_secs(7))),
+            Duration::from_millis(350)
+        );
+    }
+
+    #[test]
+    fn test_retryable_statuses() {
+        assert!(is_retryable(429));
+        assert!(is_retryable(503));
+        assert!(!is_retryable(400));
+        assert!(!is_retryable(401));
+        assert!(is_retryable_transport(ureq::ErrorKind::ConnectionFailed));
+        assert!(is_retryable_transport(ureq::ErrorKind::Io));
+        assert!(!is_retryable_transport(ureq::ErrorKind::InvalidUrl));
+        assert!(!is_retryable_transport(ureq::ErrorKind::Dns));
+        assert_eq!(parse_retry_after(" 12 "), Some(Duration::from_secs(12)));
+        assert_eq!(parse_retry_after("Wed, 21 Oct 2015 07:28:00 GMT"), None);
+    }
+
+    #[test]
+    fn test_batch_error_names_range() {
+        let err = BatchError {
+            start: 96,
+            len: 96,
+            attempts: 6,
+            status: Some(429),
+            message: "HTTP 429: rate limited".to_string(),
+        };
+        assert_eq!(
+            err.to_string(),
+            "Embedding batch 96..192 failed after 6 attempts: HTTP 429: rate limited"
+        );
+        assert!(!err.is_auth_failure());
+        let denied = BatchError {
+            status: Some(401),
+            ..err
+        };
+        assert!(BatchError::caused_auth_failure(
+            &anyhow::Error::from(denied).context("OpenAI embedding request failed")
+        ));
+    }
+}
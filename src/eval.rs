@@ -0,0 +1,270 @@
+//! Retrieval quality metrics for `code-rag eval`: labeled questions, gold
+//! labels matched against search results, and recall, precision and
+//! reciprocal rank at a cutoff.
+
+use anyhow::{bail, Context, Result};
+use serde::{Deserialize, Serialize};
+use std::path::Path;
+
+use crate::indexer::CodeChunker;
+use crate::search::{normalize_path, symbol_matches};
+
+/// One labeled question of an evaluation dataset.
+#[derive(Debug, Clone, PartialEq, Deserialize)]
+pub struct EvalCase {
+    pub query: String,
+    /// Gold labels, see [`GoldLabel::parse`]
+    pub expected: Vec<String>,
+    /// Line of the dataset the case was read from (1-indexed)
+    #[serde(skip)]
+    pub line: usize,
+}
+
+/// Reads a JSON Lines dataset: one `{"query": ..., "expected": [...]}`
+/// object per line. Blank lines are skipped; a case without a query or
+/// without labels is an error, since it would skew every metric.
+pub fn parse_dataset(input: &str) -> Result<Vec<EvalCase>> {
+    let mut cases = Vec::new();
+    for (i, line) in input.lines().enumerate() {
+        if line.trim().is_empty() {
+            continue;
+        }
+        let mut case: EvalCase = serde_json::from_str(line)
+            .with_context(|| format!("Invalid evaluation case on line {}", i + 1))?;
+        if case.query.trim().is_empty() || case.expected.is_empty() {
+            bail!(
+                "Evaluation case on line {} needs a query and at least one expected label",
+                i + 1
+            );
+        }
+        case.line = i + 1;
+        cases.push(case);
+    }
+    Ok(cases)
+}
+
+/// What a retrieved chunk has to be to count as relevant.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum GoldLabel {
+    /// Any chunk of the file; matches the indexed path or a trailing part of it
+    File(String),
+    /// A symbol ID, or its trailing `.`-separated parts, in any file
+    Symbol(String),
+    /// `file:symbol`, the symbol in that file
+    FileSymbol { file: String, symbol: String },
+}
+
+impl GoldLabel {
+    /// Parses `file:symbol`, a path or a symbol ID.
+    ///
+    /// A label without `:` is a path if it contains a `/` or ends in an
+    /// extension code-rag indexes (`auth/service.go`, `README.md`), and a
+    /// symbol ID otherwise (`auth.Service.Authenticate`, `Authenticate`).
+    pub fn parse(label: &str) -> Self {
+        if let Some((file, symbol)) = label
+            .rsplit_once(':')
+            .filter(|(file, symbol)| !file.is_empty() && !symbol.is_empty())
+        {
+            return Self::FileSymbol {
+                file: file.to_string(),
+                symbol: symbol.to_string(),
+            };
+        }
+        let is_path = label.contains('/')
+            || label.contains('\\')
+            || Path::new(label)
+                .extension()
+                .and_then(|ext| ext.to_str())
+                .is_some_and(CodeChunker::is_supported);
+        if is_path {
+            Self::File(label.to_string())
+        } else {
+            Self::Symbol(label.to_string())
+        }
+    }
+
+    /// Whether a chunk of `filename` with `symbol` satisfies the label.
+    pub fn matches(&self, filename: &str, symbol: Option<&str>) -> bool {
+        let symbol_matches = |wanted: &str| symbol.is_some_and(|s| symbol_matches(s, wanted));
+        match self {
+            Self::File(file) => file_matches(filename, file),
+            Self::Symbol(wanted) => symbol_matches(wanted),
+            Self::FileSymbol { file, symbol } => {
+                file_matches(filename, file) && symbol_matches(symbol)
+            }
+        }
+    }
+}
+
+/// Whether the indexed `filename` is `wanted` or ends with it.
+fn file_matches(filename: &str, wanted: &str) -> bool {
+    let filename = normalize_path(filename);
+    let wanted = normalize_path(wanted);
+    filename == wanted || filename.ends_with(&format!("/{}", wanted))
+}
+
+/// Metrics of one question at cutoff `k`.
+#[derive(Debug, Clone, PartialEq, Serialize)]
+#[serde(rename_all = "camelCase")]
+pub struct QueryScore {
+    /// Share of the gold labels matched by at least one of the top `k` results
+    pub recall: f64,
+    /// Share of the top `k` slots holding a relevant result
+    pub precision: f64,
+    /// 1 / rank of the first relevant result, 0 if none is in the top `k`
+    pub reciprocal_rank: f64,
+    pub first_relevant_rank: Option<usize>,
+    /// Gold labels no result matched
+    pub missed: Vec<String>,
+    /// Whether each of the top `k` results matched a label, by rank
+    pub relevant: Vec<bool>,
+}
+
+/// Scores the ranked `(filename, symbol)` results of a question against its
+/// `expected` labels, looking at the first `k` results only.
+pub fn score_query(
+    expected: &[String],
+    retrieved: &[(&str, Option<&str>)],
+    k: usize,
+) -> QueryScore {
+    let labels: Vec<GoldLabel> = expected.iter().map(|l| GoldLabel::parse(l)).collect();
+    let top = &retrieved[..retrieved.len().min(k)];
+    let relevant: Vec<bool> = top
+        .iter()
+        .map(|(file, symbol)| labels.iter().any(|l| l.matches(file, *symbol)))
+        .collect();
+    let missed: Vec<String> = labels
+        .iter()
+        .zip(expected)
+        .filter(|(label, _)| {
+            !top.iter()
+                .any(|(file, symbol)| label.matches(file, *symbol))
+        })
+        .map(|(_, text)| text.clone())
+        .collect();
+    let first_relevant_rank = relevant.iter().position(|r| *r).map(|i| i + 1);
+    QueryScore {
+        recall: (labels.len() - missed.len()) as f64 / labels.len().max(1) as f64,
+        precision: relevant.iter().filter(|r| **r).count() as f64 / k.max(1) as f64,
+        reciprocal_rank: first_relevant_rank.map_or(0.0, |rank| 1.0 / rank as f64),
+        first_relevant_rank,
+        missed,
+        relevant,
+    }
+}
+
+/// Means of the per-question metrics.
+#[derive(Debug, Clone, Default, PartialEq, Serialize)]
+#[serde(rename_all = "camelCase")]
+pub struct EvalSummary {
+    /// Questions scored; failed searches are left out
+    pub queries: usize,
+    pub recall_at_k: f64,
+    pub precision_at_k: f64,
+    /// Mean reciprocal rank
+    pub mrr: f64,
+}
+
+impl EvalSummary {
+    pub fn from_scores<'a>(scores: impl IntoIterator<Item = &'a QueryScore>) -> Self {
+        let mut summary = Self::default();
+        for score in scores {
+            summary.queries += 1;
+            summary.recall_at_k += score.recall;
+            summary.precision_at_k += score.precision;
+            summary.mrr += score.reciprocal_rank;
+        }
+        if summary.queries > 0 {
+            let n = summary.queries as f64;
+            summary.recall_at_k /= n;
+            summary.precision_at_k /= n;
+            summary.mrr /= n;
+        }
+        summary
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_dataset() {
+        let input = "{\"query\": \"where are sessions created?\", \"expected\": [\"auth.NewSession\"]}\n\
+                     \n\
+                     {\"query\": \"config loading\", \"expected\": [\"config/load.go\", \"README.md\"]}\n";
+        let cases = parse_dataset(input).unwrap();
+        assert_eq!(cases.len(), 2);
+        assert_eq!(cases[1].line, 3);
+        assert_eq!(cases[1].expected, vec!["config/load.go", "README.md"]);
+
+        let err = parse_dataset("{\"query\": \"x\", \"expected\": []}").unwrap_err();
+        assert!(err.to_string().contains("line 1"), "{}", err);
+        let err = parse_dataset("\n{\"query\": \"x\"").unwrap_err();
+        assert!(err.to_string().contains("line 2"), "{}", err);
+    }
+
+    #[test]
+    fn test_gold_labels() {
+        assert_eq!(
+            GoldLabel::parse("internal/auth/service.go"),
+            GoldLabel::File("internal/auth/service.go".to_string())
+        );
+        assert_eq!(
+            GoldLabel::parse("README.md"),
+            GoldLabel::File("README.md".to_string())
+        );
+        assert_eq!(
+            GoldLabel::parse("auth.Service.Authenticate"),
+            GoldLabel::Symbol("auth.Service.Authenticate".to_string())
+        );
+        let label = GoldLabel::parse("auth/service.go:Authenticate");
+        assert!(label.matches(
+            "./internal/auth/service.go",
+            Some("auth.Service.Authenticate")
+        ));
+        assert!(!label.matches("./internal/auth/service.go", Some("auth.Service.Logout")));
+        assert!(!label.matches("./internal/oauth/service.go", Some("oauth.Authenticate")));
+
+        assert!(GoldLabel::parse("Authenticate").matches("a.go", Some("auth.Authenticate")));
+        assert!(!GoldLabel::parse("Authenticate").matches("a.go", None));
+        assert!(GoldLabel::parse("service.go").matches("src\\auth\\service.go", None));
+        assert!(!GoldLabel::parse("vice.go").matches("auth/service.go", None));
+    }
+
+    #[test]
+    fn test_score_query() {
+        let expected = vec!["auth.Login".to_string(), "auth/session.go".to_string()];
+        let retrieved = [
+            ("auth/handler.go", Some("auth.Handle")),
+            ("auth/login.go", Some("auth.Login")),
+            ("auth/login.go", Some("auth.Login")),
+            ("auth/session.go", Some("auth.NewSession")),
+        ];
+
+        let score = score_query(&expected, &retrieved, 3);
+        assert_eq!(score.recall, 0.5);
+        assert_eq!(score.precision, 2.0 / 3.0);
+        assert_eq!(score.reciprocal_rank, 0.5);
+        assert_eq!(score.first_relevant_rank, Some(2));
+        assert_eq!(score.missed, vec!["auth/session.go"]);
+        assert_eq!(score.relevant, vec![false, true, true]);
+
+        let score = score_query(&expected, &retrieved, 10);
+        assert_eq!(score.recall, 1.0);
+        assert_eq!(score.precision, 0.3);
+        assert!(score.missed.is_empty());
+
+        let none = score_query(&expected, &[], 5);
+        assert_eq!(
+            (none.recall, none.precision, none.reciprocal_rank),
+            (0.0, 0.0, 0.0)
+        );
+
+        let summary = EvalSummary::from_scores([&score, &none]);
+        assert_eq!(summary.queries, 2);
+        assert_eq!(summary.recall_at_k, 0.5);
+        assert_eq!(summary.mrr, 0.25);
+        assert_eq!(EvalSummary::from_scores([]), EvalSummary::default());
+    }
+}
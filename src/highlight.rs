@@ -0,0 +1,213 @@
+use colored::{ColoredString, Colorize};
+use std::path::Path;
+use tree_sitter::{Language, Node, Parser};
+
+use crate::indexer::CodeChunker;
+
+/// Token classes colored by [`highlight`].
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum Token {
+    Comment,
+    String,
+    /// Numbers and the literals `true`, `false`, `nil`, ...
+    Constant,
+    Keyword,
+    Type,
+    /// Name of a declared or called function
+    Function,
+}
+
+impl Token {
+    fn paint(self, text: &str) -> ColoredString {
+        match self {
+            Token::Comment => text.bright_black(),
+            Token::String => text.green(),
+            Token::Constant => text.cyan(),
+            Token::Keyword => text.magenta(),
+            Token::Type => text.yellow(),
+            Token::Function => text.bright_blue(),
+        }
+    }
+}
+
+/// Whether `node` names the function its parent declares or calls, also
+/// through a selector such as Go's `pkg.Func()` or a method call `x.do()`.
+fn is_function_name(node: Node) -> bool {
+    let Some(parent) = node.parent() else {
+        return false;
+    };
+    let kind = parent.kind();
+    if (kind.contains("function") || kind.contains("method"))
+        && parent.child_by_field_name("name") == Some(node)
+    {
+        return true;
+    }
+    let is_call =
+        |n: Node| n.kind().contains("call") && n.child_by_field_name("function").is_some();
+    if is_call(parent) {
+        return parent.child_by_field_name("function") == Some(node);
+    }
+    ["field", "property", "attribute"]
+        .iter()
+        .any(|field| parent.child_by_field_name(field) == Some(node))
+        && parent
+            .parent()
+            .filter(|&call| is_call(call))
+            .is_some_and(|call| call.child_by_field_name("function") == Some(parent))
+}
+
+/// Classifies a node by its grammar kind; `None` leaves it to its children.
+///
+/// Kind names differ between grammars (`int_literal` in Go, `integer` in
+/// Python), so this matches the common spellings rather than each grammar's
+/// highlight queries.
+fn classify(node: Node) -> Option<Token> {
+    let kind = node.kind();
+    if kind.contains("comment") {
+        return Some(Token::Comment);
+    }
+    if kind.contains("string") || kind.ends_with("char_literal") || kind == "rune_literal" {
+        return Some(Token::String);
+    }
+    if node.child_count() > 0 {
+        return None;
+    }
+    match kind {
+        "number" | "integer" | "float" | "int_literal" | "integer_literal" | "float_literal"
+        | "imaginary_literal" | "true" | "false" | "nil" | "null" | "none" | "None" => {
+            Some(Token::Constant)
+        }
+        "type_identifier" | "primitive_type" | "predefined_type" | "builtin_type" => {
+            Some(Token::Type)
+        }
+        // Anonymous word tokens are the grammar's keywords (`func`, `return`, ...)
+        _ if !node.is_named()
+            && kind.len() > 1
+            && kind.bytes().all(|b| b.is_ascii_lowercase() || b == b'_') =>
+        {
+            Some(Token::Keyword)
+        }
+        _ if kind.ends_with("identifier") && is_function_name(node) => Some(Token::Function),
+        _ => None,
+    }
+}
+
+/// Byte ranges of `code` to color, in order and non-overlapping.
+fn spans(code: &str, grammar: &Language) -> Vec<(usize, usize, Token)> {
+    fn collect(node: Node, spans: &mut Vec<(usize, usize, Token)>) {
+        if let Some(token) = classify(node) {
+            if node.end_byte() > node.start_byte() {
+                spans.push((node.start_byte(), node.end_byte(), token));
+            }
+            return;
+        }
+        let mut cursor = node.walk();
+        for child in node.children(&mut cursor) {
+            collect(child, spans);
+        }
+    }
+
+    let mut parser = Parser::new();
+    if parser.set_language(grammar).is_err() {
+        return Vec::new();
+    }
+    let Some(tree) = parser.parse(code, None) else {
+        return Vec::new();
+    };
+    let mut spans = Vec::new();
+    collect(tree.root_node(), &mut spans);
+    spans
+}
+
+/// Returns `code` with ANSI colors for comments, strings, keywords and so
+/// on, parsed with the tree-sitter grammar of `language` (the chunk's
+/// language metadata, falling back to the extension of `filename`).
+///
+/// Chunks are fragments of a file, which tree-sitter parses with error
+/// recovery; tokens it can't place are left plain. Each line is colored on
+/// its own, so the result can be split into lines (e.g. to number them)
+/// without a color bleeding into the next line. Code without a grammar, or
+/// with colors turned off (`--no-color`, `NO_COLOR`, output not a terminal),
+/// is returned unchanged.
+pub fn highlight(code: &str, language: Option<&str>, filename: &str) -> String {
+    let grammar = language
+        .and_then(CodeChunker::get_language_by_name)
+        .or_else(|| {
+            Path::new(filename)
+                .extension()
+                .and_then(|ext| ext.to_str())
+                .and_then(CodeChunker::get_language)
+        });
+    let Some(grammar) = grammar else {
+        return code.to_string();
+    };
+    if !colored::control::SHOULD_COLORIZE.should_colorize() {
+        return code.to_string();
+    }
+
+    let mut out = String::with_capacity(code.len() * 2);
+    let mut pos = 0;
+    for (start, end, token) in spans(code, &grammar) {
+        out.push_str(&code[pos..start]);
+        for (i, line) in code[start..end].split('\n').enumerate() {
+            if i > 0 {
+                out.push('\n');
+            }
+            if !line.is_empty() {
+                out.push_str(&token.paint(line).to_string());
+            }
+        }
+        pos = end;
+    }
+    out.push_str(&code[pos..]);
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn tokens(code: &str, language: &str) -> Vec<(&str, Token)> {
+        let grammar = CodeChunker::get_language_by_name(language).unwrap();
+        spans(code, &grammar)
+            .into_iter()
+            .map(|(start, end, token)| (&code[start..end], token))
+            .collect()
+    }
+
+    #[test]
+    fn test_go_tokens() {
+        let code =
+            "// Add sums.\nfunc Add(a int) string {\n\treturn fmt.Sprint(a + 1, \"x\", nil)\n}";
+        let tokens = tokens(code, "go");
+        for expected in [
+            ("// Add sums.", Token::Comment),
+            ("func", Token::Keyword),
+            ("Add", Token::Function),
+            ("int", Token::Type),
+            ("return", Token::Keyword),
+            ("Sprint", Token::Function),
+            ("1", Token::Constant),
+            ("\"x\"", Token::String),
+            ("nil", Token::Constant),
+        ] {
+            assert!(tokens.contains(&expected), "{:?} in {:?}", expected, tokens);
+        }
+        // Parameters and packages stay plain
+        assert!(tokens
+            .iter()
+            .all(|(text, _)| *text != "a" && *text != "fmt"));
+    }
+
+    #[test]
+    fn test_other_grammars() {
+        let tokens = tokens("def run(self):\n    # go\n    return 42\n", "python");
+        assert!(tokens.contains(&("def", Token::Keyword)));
+        assert!(tokens.contains(&("# go", Token::Comment)));
+        assert!(tokens.contains(&("42", Token::Constant)));
+
+        // Docs have no grammar and are returned unchanged
+        let text = "# Title\n\nplain text";
+        assert_eq!(highlight(text, Some("markdown"), "README.md"), text);
+    }
+}
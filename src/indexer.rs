@@ -1,10 +1,102 @@
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::collections::HashMap;
+use std::fmt;
 use std::io::{Read, Seek, SeekFrom};
 use std::path::Path;
+use std::str::FromStr;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::Arc;
 use tree_sitter::{Language, Node, Parser};
 
+use crate::config::AppConfig;
+use crate::context::{default_counter, TokenCounter};
+
+mod blame;
+mod content;
+mod facets;
+mod go;
+mod markdown;
+mod registry;
+mod revision;
+mod tags;
+mod test_files;
+
+pub use blame::{blame_chunks, line_times};
+pub use content::{NonText, BINARY_SNIFF_BYTES};
+pub use facets::Facet;
+pub use go::GoSymbolChunker;
+pub use markdown::{MarkdownChunker, TextChunker};
+use registry::Registered;
+pub use registry::{register_chunker, registered_chunker, Chunker};
+pub(crate) use revision::split_revision;
+pub use revision::{read_revision_file, revision_path};
+pub use tags::{inline_tags, is_valid_tag, TagRules, RAGTAGS_FILE};
+pub use test_files::{TestClassifier, DEFAULT_TEST_PATTERNS};
+
+/// Whether a chunk comes from source code or from documentation.
+///
+/// Derived from the chunk's language, so indexes need no extra column to tell
+/// docs apart; see [`CandidateFilter::with_doc_types`](crate::search::CandidateFilter::with_doc_types).
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum DocType {
+    #[default]
+    Code,
+    /// Markdown split at headings, see [`MarkdownChunker`]
+    Markdown,
+    /// Plain text split at paragraphs, see [`TextChunker`]
+    Text,
+}
+
+impl DocType {
+    /// Doc type of chunks in `language`, as recorded by the chunker.
+    pub fn of_language(language: &str) -> Self {
+        match language {
+            "markdown" => DocType::Markdown,
+            "text" => DocType::Text,
+            _ => DocType::Code,
+        }
+    }
+
+    /// Doc type of chunks from `filename`, by extension.
+    pub fn of_file(filename: &str) -> Self {
+        Path::new(filename)
+            .extension()
+            .and_then(|e| e.to_str())
+            .and_then(CodeChunker::language_name)
+            .map_or(DocType::Code, DocType::of_language)
+    }
+
+    pub fn as_str(self) -> &'static str {
+        match self {
+            DocType::Code => "code",
+            DocType::Markdown => "markdown",
+            DocType::Text => "text",
+        }
+    }
+}
+
+impl FromStr for DocType {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.to_lowercase().as_str() {
+            "code" => Ok(DocType::Code),
+            "markdown" | "md" => Ok(DocType::Markdown),
+            "text" | "txt" => Ok(DocType::Text),
+            _ => Err(format!(
+                "Unknown doc type '{}'; expected code, markdown or text",
+                s
+            )),
+        }
+    }
+}
+
 /// A single logical unit of code extracted from a source file.
 ///
 /// Contains the code content along with metadata for search and context optimization.
+#[derive(Debug, Clone, Default)]
 pub struct CodeChunk {
     /// Source file path (normalized)
     pub filename: String,
@@ -18,6 +110,199 @@ pub struct CodeChunk {
     pub last_modified: i64,
     /// List of function/method calls identified within this chunk
     pub calls: Vec<String>,
+    /// Stable symbol ID of the declaration this chunk covers (e.g. `main.AuthService.Authenticate`)
+    pub symbol: Option<String>,
+    /// Language of the source file (e.g. `python`), see [`CodeChunker::language_name`]
+    pub language: Option<String>,
+    /// Whether [`Redactor`](crate::redact::Redactor) replaced secrets in `code`
+    pub redacted: bool,
+    /// Number of earlier chunks in the same file with the same symbol and
+    /// normalized code, see [`assign_occurrences`]
+    pub occurrence: u32,
+    /// Leading lines repeated from the end of the previous chunk of the file
+    /// (line-based chunks only), so context assembly can skip them
+    pub overlap_lines: usize,
+    /// Compact stand-in for an oversized chunk, see [`Summarizer`](crate::summary::Summarizer)
+    pub summary: Option<String>,
+    /// Doc comment of the declaration without comment markers (Go only), indexed
+    /// as its own BM25 field; the text is also part of `code`
+    pub doc: Option<String>,
+    /// Package the declaration belongs to (Go only)
+    pub package: Option<String>,
+    /// Import paths of the file the chunk comes from (Go only)
+    pub imports: Vec<String>,
+    /// Which part of its declaration this chunk is, if the declaration was
+    /// split to fit the chunk limits; all parts share `symbol`
+    pub part: Option<ChunkPart>,
+    /// Unix time the chunk's lines last changed: the newest commit touching
+    /// them according to `git blame`, when captured at index time (see
+    /// [`blame_chunks`]); `None` means the file's `last_modified` stands in
+    pub changed_at: Option<i64>,
+    /// Whether the chunk is test code, see [`TestClassifier`]
+    pub is_test: bool,
+    /// Collection the file was indexed into with `index --collection`, so
+    /// one index can hold several projects searched apart; `None` if none
+    pub collection: Option<String>,
+    /// User tags from `.ragtags` and `rag:tag` comments, sorted, see [`TagRules`]
+    pub tags: Vec<String>,
+    /// Other places the same code was found when the index was deduplicated
+    /// (`dedup_chunks`); they are stored only as this list
+    pub duplicates: Vec<ChunkLocation>,
+}
+
+/// Lines of a file holding a copy of a stored chunk, see [`CodeChunk::duplicates`].
+#[derive(Debug, Clone, PartialEq, Eq, Hash, Serialize, Deserialize)]
+pub struct ChunkLocation {
+    pub filename: String,
+    pub line_start: usize,
+    pub line_end: usize,
+}
+
+impl fmt::Display for ChunkLocation {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}:{}-{}", self.filename, self.line_start, self.line_end)
+    }
+}
+
+/// Position of a chunk among the parts of a declaration that exceeded the
+/// chunk size or token limit, shown as `part 1/2`.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub struct ChunkPart {
+    /// 1-based
+    pub index: usize,
+    pub count: usize,
+}
+
+impl ChunkPart {
+    /// Labels `chunks`, the parts of one declaration in order, if there are several.
+    pub fn label(chunks: &mut [CodeChunk]) {
+        let count = chunks.len();
+        if count < 2 {
+            return;
+        }
+        for (i, chunk) in chunks.iter_mut().enumerate() {
+            chunk.part = Some(ChunkPart {
+                index: i + 1,
+                count,
+            });
+        }
+    }
+}
+
+impl fmt::Display for ChunkPart {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "part {}/{}", self.index, self.count)
+    }
+}
+
+/// Maximum chunk size in tokens, counted with a model's tokenizer.
+///
+/// Bytes are a poor proxy for what an embedding model accepts: a line of
+/// minified JavaScript holds many times the tokens of a line of Go.
+#[derive(Clone)]
+pub struct TokenLimit {
+    pub max_tokens: usize,
+    pub counter: Arc<dyn TokenCounter>,
+}
+
+impl TokenLimit {
+    pub fn new(max_tokens: usize, counter: Arc<dyn TokenCounter>) -> Self {
+        Self {
+            max_tokens,
+            counter,
+        }
+    }
+
+    pub fn allows(&self, text: &str) -> bool {
+        self.counter.count(text) <= self.max_tokens
+    }
+}
+
+/// Whether `text` fits in one chunk of at most `max_chunk_size` bytes and,
+/// if set, `token_limit` tokens.
+fn fits(text: &str, max_chunk_size: usize, token_limit: Option<&TokenLimit>) -> bool {
+    text.len() <= max_chunk_size && token_limit.is_none_or(|limit| limit.allows(text))
+}
+
+/// Rows where the top-level statements or members of `node`'s body start,
+/// relative to `base_row`. These are the preferred cut points when a
+/// declaration has to be split, see [`CodeChunker::split_declaration`].
+fn statement_rows(node: Node, base_row: usize) -> Vec<usize> {
+    let mut body = node.child_by_field_name("body").unwrap_or(node);
+    // Step through wrappers such as a block holding a single statement list
+    while body.named_child_count() == 1 {
+        match body.named_child(0) {
+            Some(child) if child.named_child_count() > 0 => body = child,
+            _ => break,
+        }
+    }
+    let mut cursor = body.walk();
+    body.named_children(&mut cursor)
+        .map(|child| child.start_position().row.saturating_sub(base_row))
+        .collect()
+}
+
+impl CodeChunk {
+    /// Stable identifier shared by the vector store, the BM25 index and the manifest.
+    ///
+    /// The hex SHA-256 of the file path, the symbol ID (empty if none) and the
+    /// [normalized](normalize_code) code, joined by NUL bytes. A nonzero
+    /// `occurrence` is appended as a fourth NUL-separated decimal field. The
+    /// line numbers are not hashed, so moving a declaration within its file
+    /// keeps its ID.
+    pub fn id(&self) -> String {
+        let mut hasher = Sha256::new();
+        hasher.update(self.filename.as_bytes());
+        hasher.update([0]);
+        hasher.update(self.symbol.as_deref().unwrap_or("").as_bytes());
+        hasher.update([0]);
+        hasher.update(normalize_code(&self.code).as_bytes());
+        if self.occurrence > 0 {
+            hasher.update([0]);
+            hasher.update(self.occurrence.to_string().as_bytes());
+        }
+        format!("{:x}", hasher.finalize())
+    }
+}
+
+/// Code as hashed by [`CodeChunk::id`]: lines joined by `\n` (so CRLF and LF
+/// files agree), trailing whitespace stripped from each line, and leading and
+/// trailing blank lines dropped.
+pub fn normalize_code(code: &str) -> String {
+    let lines: Vec<&str> = code.lines().map(str::trim_end).collect();
+    let start = lines
+        .iter()
+        .position(|l| !l.is_empty())
+        .unwrap_or(lines.len());
+    let end = lines
+        .iter()
+        .rposition(|l| !l.is_empty())
+        .map_or(start, |i| i + 1);
+    lines[start..end].join("\n")
+}
+
+/// Numbers the chunks of one file that share a symbol and normalized code, in
+/// file order, so their IDs stay distinct.
+pub fn assign_occurrences(chunks: &mut [CodeChunk]) {
+    let mut seen: HashMap<(Option<String>, String), u32> = HashMap::new();
+    for chunk in chunks {
+        let count = seen
+            .entry((chunk.symbol.clone(), normalize_code(&chunk.code)))
+            .or_insert(0);
+        chunk.occurrence = *count;
+        *count += 1;
+    }
+}
+
+/// Per-file state shared while walking a syntax tree.
+struct FileContext<'a> {
+    filename: &'a str,
+    ext: &'a str,
+    /// File stem, used as the first segment of symbol IDs
+    module: &'a str,
+    mtime: i64,
+    /// Byte offset of the first syntax error; nothing past it is chunked
+    error_byte: Option<usize>,
 }
 
 /// Handles the semantic chunking of source code files using Tree-sitter.
@@ -29,8 +314,23 @@ pub struct CodeChunker {
     pub max_chunk_size: usize,
     /// Number of bytes to overlap between adjacent chunks when splitting large blocks
     pub chunk_overlap: usize,
+    /// Number of lines adjacent line-based chunks share, see [`CodeChunker::chunk_lines`]
+    pub overlap_lines: usize,
+    /// Token limit enforced in addition to `max_chunk_size`
+    pub token_limit: Option<TokenLimit>,
+    /// Sets [`CodeChunk::is_test`] on the chunks of every file
+    pub tests: TestClassifier,
+    /// Set as [`CodeChunk::collection`] on the chunks of every file
+    pub collection: Option<String>,
+    /// Sets [`CodeChunk::tags`] on the chunks of every file
+    pub tags: TagRules,
+    /// Files chunked by lines because their chunker failed
+    fallbacks: AtomicUsize,
 }
 
+/// Default `chunk_overlap_lines`.
+pub const DEFAULT_OVERLAP_LINES: usize = 3;
+
 impl Default for CodeChunker {
     fn default() -> Self {
         Self::new(1024, 128)
@@ -42,9 +342,66 @@ impl CodeChunker {
         Self {
             max_chunk_size,
             chunk_overlap,
+            overlap_lines: DEFAULT_OVERLAP_LINES,
+            token_limit: None,
+            tests: TestClassifier::default(),
+            collection: None,
+            tags: TagRules::default(),
+            fallbacks: AtomicUsize::new(0),
         }
     }
 
+    /// Chunker with the `chunk_size`, `chunk_overlap`, `chunk_overlap_lines`,
+    /// `max_chunk_tokens` and `test_patterns` settings of `config`.
+    ///
+    /// Fails if one of the test patterns isn't a valid glob.
+    pub fn from_config(config: &AppConfig) -> anyhow::Result<Self> {
+        Ok(Self::new(config.chunk_size, config.chunk_overlap)
+            .with_overlap_lines(config.chunk_overlap_lines)
+            .with_token_limit(
+                config
+                    .max_chunk_tokens
+                    .map(|max| TokenLimit::new(max, default_counter())),
+            )
+            .with_test_classifier(TestClassifier::from_config(config)?))
+    }
+
+    pub fn with_overlap_lines(mut self, overlap_lines: usize) -> Self {
+        self.overlap_lines = overlap_lines;
+        self
+    }
+
+    /// Also keeps every chunk within `token_limit` tokens, splitting
+    /// declarations that exceed it like those above `max_chunk_size`.
+    pub fn with_token_limit(mut self, token_limit: Option<TokenLimit>) -> Self {
+        self.token_limit = token_limit;
+        self
+    }
+
+    /// Recognizes test files with `tests` instead of the built-in patterns.
+    pub fn with_test_classifier(mut self, tests: TestClassifier) -> Self {
+        self.tests = tests;
+        self
+    }
+
+    /// Tags the chunks of every file with `collection`.
+    pub fn with_collection(mut self, collection: Option<String>) -> Self {
+        self.collection = collection;
+        self
+    }
+
+    /// Attaches user tags to chunks by `tags`, e.g. the `.ragtags` of the
+    /// index root, besides those of `rag:tag` comments.
+    pub fn with_tags(mut self, tags: TagRules) -> Self {
+        self.tags = tags;
+        self
+    }
+
+    /// Whether `text` fits in one chunk.
+    pub fn fits(&self, text: &str) -> bool {
+        fits(text, self.max_chunk_size, self.token_limit.as_ref())
+    }
+
     pub fn get_language(extension: &str) -> Option<Language> {
         match extension {
             "rs" => Some(tree_sitter_rust::LANGUAGE.into()),
@@ -73,29 +430,129 @@ impl CodeChunker {
         }
     }
 
+    /// Returns the language name for a file extension (e.g. `"py"` -> `"python"`).
+    ///
+    /// These names are recorded on every chunk and accepted by `index --languages`.
+    pub fn language_name(extension: &str) -> Option<&'static str> {
+        match extension {
+            "rs" => Some("rust"),
+            "py" => Some("python"),
+            "go" => Some("go"),
+            "c" | "h" => Some("c"),
+            "cpp" | "hpp" | "cc" | "cxx" => Some("cpp"),
+            "js" | "jsx" => Some("javascript"),
+            "ts" | "tsx" => Some("typescript"),
+            "java" => Some("java"),
+            "cs" => Some("csharp"),
+            "rb" => Some("ruby"),
+            "php" => Some("php"),
+            "html" => Some("html"),
+            "css" => Some("css"),
+            "sh" | "bash" => Some("bash"),
+            "ps1" => Some("powershell"),
+            "yaml" | "yml" => Some("yaml"),
+            "json" => Some("json"),
+            "zig" => Some("zig"),
+            "ex" | "exs" => Some("elixir"),
+            "hs" => Some("haskell"),
+            "sol" => Some("solidity"),
+            "md" | "markdown" => Some("markdown"),
+            "txt" | "text" | "rst" => Some("text"),
+            _ => None,
+        }
+    }
+
+    /// Returns the grammar for a language name recorded on chunks, the
+    /// inverse of [`language_name`](Self::language_name).
+    pub fn get_language_by_name(name: &str) -> Option<Language> {
+        let extension = match name {
+            "rust" => "rs",
+            "python" => "py",
+            "javascript" => "js",
+            "typescript" => "ts",
+            "csharp" => "cs",
+            "ruby" => "rb",
+            "bash" => "sh",
+            "powershell" => "ps1",
+            "elixir" => "ex",
+            "haskell" => "hs",
+            "solidity" => "sol",
+            other => other,
+        };
+        Self::get_language(extension)
+    }
+
+    /// Whether files with `extension` are indexed: source code with a
+    /// tree-sitter grammar, Markdown, plain text, or an extension with a
+    /// [registered](register_chunker) chunker.
+    pub fn is_supported(extension: &str) -> bool {
+        registry::lookup(extension).is_some()
+    }
+
+    /// Chunks the file `filename` read from `reader`, with the chunker
+    /// [registered](register_chunker) for its extension or else the built-in
+    /// one: symbol chunks for Go, tree-sitter declarations for other languages
+    /// with a grammar, sections for Markdown, paragraphs for plain text and
+    /// lines for files of any other extension. Test code is flagged by
+    /// [`tests`](Self::tests), and chunks are tagged with
+    /// [`collection`](Self::collection) and the user [`tags`](Self::tags),
+    /// whichever chunker ran.
+    ///
+    /// A file its chunker fails on, because a registered chunker returns an
+    /// error or tree-sitter can't make out a single declaration, is chunked
+    /// by lines instead with a warning; see [`fallbacks`](Self::fallbacks).
+    /// Errors are left for failures to read `reader`.
     pub fn chunk_file<R: Read + Seek>(
         &self,
         filename: &str,
         reader: &mut R,
         mtime: i64,
+    ) -> std::io::Result<Vec<CodeChunk>> {
+        let normalized_filename = filename.replace("\\", "/");
+        let ext = Path::new(&normalized_filename)
+            .extension()
+            .and_then(|s| s.to_str())
+            .unwrap_or("");
+        let mut chunks = match registry::lookup(ext) {
+            Some(Registered::Custom(chunker)) => {
+                self.chunk_registered(chunker.as_ref(), &normalized_filename, reader, mtime)?
+            }
+            _ => self.chunk_builtin(&normalized_filename, reader, mtime)?,
+        };
+        self.tests.classify(&mut chunks);
+        if let Some(collection) = &self.collection {
+            for chunk in chunks.iter_mut() {
+                chunk.collection = Some(collection.clone());
+            }
+        }
+        if !chunks.is_empty() {
+            let mut source = Vec::new();
+            reader.seek(SeekFrom::Start(0))?;
+            reader.read_to_end(&mut source)?;
+            self.tags
+                .apply(&mut chunks, &String::from_utf8_lossy(&source));
+        }
+        Ok(chunks)
+    }
+
+    /// [`chunk_file`](Self::chunk_file) with the built-in chunkers only.
+    fn chunk_builtin<R: Read + Seek>(
+        &self,
+        filename: &str,
+        reader: &mut R,
+        mtime: i64,
     ) -> std::io::Result<Vec<CodeChunk>> {
         let normalized_filename = filename.replace("\\", "/");
         let path = Path::new(&normalized_filename);
         let ext = path.extension().and_then(|s| s.to_str()).unwrap_or("");
 
-        let language = match Self::get_language(ext) {
-            Some(l) => l,
-            None => return Ok(vec![]),
-        };
-
-        let mut parser = Parser::new();
-        if parser.set_language(&language).is_err() {
-            tracing::error!("Could not set language for extension: {}", ext);
-            return Ok(vec![]);
+        let doc_type = DocType::of_file(&normalized_filename);
+        if doc_type != DocType::Code {
+            return self.chunk_document(&normalized_filename, reader, mtime, doc_type);
         }
 
         // Check for binary content
-        let mut check_buf = [0u8; 1024];
+        let mut check_buf = [0u8; BINARY_SNIFF_BYTES];
         let bytes_read = reader.read(&mut check_buf)?;
         reader.seek(SeekFrom::Start(0))?;
 
@@ -104,6 +561,35 @@ impl CodeChunker {
             return Ok(vec![]);
         }
 
+        let Some(language) = Self::get_language(ext) else {
+            let mut source = Vec::new();
+            reader.read_to_end(&mut source)?;
+            let mut chunks = self.chunk_lines(
+                &normalized_filename,
+                &String::from_utf8_lossy(&source),
+                mtime,
+            );
+            assign_occurrences(&mut chunks);
+            return Ok(chunks);
+        };
+
+        let mut parser = Parser::new();
+        if let Err(e) = parser.set_language(&language) {
+            return self.chunk_unparsed(&normalized_filename, reader, mtime, &e.to_string());
+        }
+
+        if ext == "go" {
+            let mut source = Vec::new();
+            reader.read_to_end(&mut source)?;
+            let source = String::from_utf8_lossy(&source);
+            let mut chunks = GoSymbolChunker::new(self.max_chunk_size, self.chunk_overlap)
+                .with_overlap_lines(self.overlap_lines)
+                .with_token_limit(self.token_limit.clone())
+                .chunk(&normalized_filename, &source, mtime);
+            assign_occurrences(&mut chunks);
+            return Ok(chunks);
+        }
+
         let mut chunks = Vec::new();
 
         // Use a buffer for tree-sitter callback
@@ -131,36 +617,173 @@ impl CodeChunker {
 
         let tree = match tree {
             Some(t) => t,
-            None => return Ok(vec![]),
+            None => {
+                return self.chunk_unparsed(
+                    &normalized_filename,
+                    reader,
+                    mtime,
+                    "tree-sitter returned no syntax tree",
+                )
+            }
         };
 
         let root = tree.root_node();
 
-        self.traverse(
-            &root,
-            reader,
-            &normalized_filename,
-            &mut chunks,
+        // Best effort for broken files: keep the chunks that precede the first error
+        let error_node = Self::first_error(&root);
+
+        let ctx = FileContext {
+            filename: &normalized_filename,
             ext,
+            module: path.file_stem().and_then(|s| s.to_str()).unwrap_or(""),
             mtime,
-            0,
-        )?;
+            error_byte: error_node.map(|n| n.start_byte()),
+        };
+        self.traverse(&root, reader, &ctx, &mut chunks, 0, &[])?;
+        if let Some(err) = error_node {
+            let line = err.start_position().row + 1;
+            if chunks.is_empty() {
+                let reason = format!("syntax error at line {}", line);
+                return self.chunk_unparsed(&normalized_filename, reader, mtime, &reason);
+            }
+            tracing::warn!(
+                "Syntax error in {} at line {}; only code before it is indexed",
+                normalized_filename,
+                line
+            );
+        }
+        assign_occurrences(&mut chunks);
+
+        Ok(chunks)
+    }
+
+    /// Chunks a file with a [registered](register_chunker) chunker, behind the
+    /// guards of the built-in ones: binary files are skipped, and chunks that
+    /// don't [fit](Self::fits) are split into parts like oversized declarations.
+    fn chunk_registered<R: Read + Seek>(
+        &self,
+        chunker: &dyn Chunker,
+        filename: &str,
+        reader: &mut R,
+        mtime: i64,
+    ) -> std::io::Result<Vec<CodeChunk>> {
+        let mut content = Vec::new();
+        reader.read_to_end(&mut content)?;
+        if content[..content.len().min(BINARY_SNIFF_BYTES)].contains(&0) {
+            tracing::debug!("Skipping binary file: {}", filename);
+            return Ok(vec![]);
+        }
+        let returned = match chunker.chunk(filename, &content) {
+            Ok(chunks) => chunks,
+            Err(e) => return self.chunk_unparsed(filename, reader, mtime, &format!("{:#}", e)),
+        };
+
+        let mut chunks = Vec::with_capacity(returned.len());
+        for chunk in returned {
+            if self.fits(&chunk.code) {
+                chunks.push(chunk);
+                continue;
+            }
+            let mut parts: Vec<CodeChunk> = self
+                .split_declaration(&chunk.code, &[])
+                .into_iter()
+                .map(|(code, first, last)| CodeChunk {
+                    code,
+                    line_start: chunk.line_start + first,
+                    line_end: chunk.line_start + last,
+                    ..chunk.clone()
+                })
+                .collect();
+            ChunkPart::label(&mut parts);
+            chunks.extend(parts);
+        }
+        for chunk in chunks.iter_mut() {
+            chunk.filename = filename.to_string();
+            chunk.last_modified = mtime;
+        }
+        assign_occurrences(&mut chunks);
+        Ok(chunks)
+    }
 
+    /// Chunks a file its chunker failed on by lines, so that it is still
+    /// searchable, and counts it in [`fallbacks`](Self::fallbacks).
+    fn chunk_unparsed<R: Read + Seek>(
+        &self,
+        filename: &str,
+        reader: &mut R,
+        mtime: i64,
+        reason: &str,
+    ) -> std::io::Result<Vec<CodeChunk>> {
+        tracing::warn!(
+            "Failed to parse {} ({}); indexing it by lines",
+            filename,
+            reason
+        );
+        self.fallbacks.fetch_add(1, Ordering::Relaxed);
+        reader.seek(SeekFrom::Start(0))?;
+        let mut source = Vec::new();
+        reader.read_to_end(&mut source)?;
+        let mut chunks = self.chunk_lines(filename, &String::from_utf8_lossy(&source), mtime);
+        assign_occurrences(&mut chunks);
+        Ok(chunks)
+    }
+
+    /// Number of files chunked by lines so far because their chunker failed
+    /// on them, see [`chunk_file`](Self::chunk_file).
+    pub fn fallbacks(&self) -> usize {
+        self.fallbacks.load(Ordering::Relaxed)
+    }
+
+    /// Chunks a Markdown or plain-text file, see [`MarkdownChunker`] and [`TextChunker`].
+    fn chunk_document<R: Read>(
+        &self,
+        filename: &str,
+        reader: &mut R,
+        mtime: i64,
+        doc_type: DocType,
+    ) -> std::io::Result<Vec<CodeChunk>> {
+        let mut source = Vec::new();
+        reader.read_to_end(&mut source)?;
+        if source[..source.len().min(BINARY_SNIFF_BYTES)].contains(&0) {
+            tracing::debug!("Skipping binary file: {}", filename);
+            return Ok(vec![]);
+        }
+        let source = String::from_utf8_lossy(&source);
+
+        let mut chunks = match doc_type {
+            DocType::Markdown => MarkdownChunker::new(self.max_chunk_size)
+                .with_overlap_lines(self.overlap_lines)
+                .with_token_limit(self.token_limit.clone())
+                .chunk(filename, &source, mtime),
+            _ => TextChunker::new(self.max_chunk_size)
+                .with_overlap_lines(self.overlap_lines)
+                .with_token_limit(self.token_limit.clone())
+                .chunk(filename, &source, mtime),
+        };
+        assign_occurrences(&mut chunks);
         Ok(chunks)
     }
 
-    #[allow(clippy::too_many_arguments)]
     fn traverse<R: Read + Seek>(
         &self,
         node: &Node,
         reader: &mut R,
-        filename: &str,
+        ctx: &FileContext,
         chunks: &mut Vec<CodeChunk>,
-        ext: &str,
-        mtime: i64,
         depth: usize,
+        scope: &[String],
     ) -> std::io::Result<()> {
         let kind = node.kind();
+        let (filename, ext, mtime) = (ctx.filename, ctx.ext, ctx.mtime);
+
+        if ctx
+            .error_byte
+            .is_some_and(|limit| node.start_byte() >= limit)
+        {
+            return Ok(());
+        }
+        // Nodes that contain the error are not chunked, but their children may be
+        let before_error = ctx.error_byte.is_none_or(|limit| node.end_byte() <= limit);
 
         let is_script_lang = matches!(
             ext,
@@ -224,7 +847,8 @@ impl CodeChunker {
                     | "for_expression" // Bash/PS1 extras
             );
 
-        let is_chunkable = is_semantic_chunk || is_ruby_module || is_script_chunk;
+        let is_chunkable = (is_semantic_chunk || is_ruby_module || is_script_chunk) && before_error;
+        let mut child_scope = scope.to_vec();
 
         if is_chunkable {
             // Restore debug printing for S-expressions
@@ -263,18 +887,47 @@ impl CodeChunker {
                 // Extract calls
                 let calls = self.find_calls(node, reader)?;
 
-                if chunk_content.len() > self.max_chunk_size {
-                    let sub_chunks = self.split_text(&chunk_content);
-                    for sub_code in sub_chunks {
-                        chunks.push(CodeChunk {
+                let name = self.symbol_name(node, reader, ext)?;
+                let symbol = name.as_ref().map(|n| {
+                    let mut parts = vec![ctx.module.to_string()];
+                    parts.extend(scope.iter().cloned());
+                    parts.push(n.clone());
+                    parts.join(".")
+                });
+                let language = Self::language_name(ext).map(|l| l.to_string());
+
+                if !self.fits(&chunk_content) {
+                    let first_row = start_position.row;
+                    let boundaries = statement_rows(*node, first_row);
+                    let mut parts: Vec<CodeChunk> = self
+                        .split_declaration(&chunk_content, &boundaries)
+                        .into_iter()
+                        .map(|(code, first, last)| CodeChunk {
                             filename: filename.to_string(),
-                            code: sub_code,
-                            line_start: start_position.row + 1,
-                            line_end: end_position.row + 1,
+                            code,
+                            line_start: first_row + first + 1,
+                            line_end: first_row + last + 1,
                             last_modified: mtime,
                             calls: calls.clone(),
-                        });
-                    }
+                            symbol: symbol.clone(),
+                            language: language.clone(),
+                            redacted: false,
+                            occurrence: 0,
+                            overlap_lines: 0,
+                            summary: None,
+                            doc: None,
+                            package: None,
+                            imports: Vec::new(),
+                            part: None,
+                            changed_at: None,
+                            is_test: false,
+                            collection: None,
+                            tags: Vec::new(),
+                            duplicates: Vec::new(),
+                        })
+                        .collect();
+                    ChunkPart::label(&mut parts);
+                    chunks.extend(parts);
                 } else {
                     chunks.push(CodeChunk {
                         filename: filename.to_string(),
@@ -283,6 +936,21 @@ impl CodeChunker {
                         line_end: end_position.row + 1,
                         last_modified: mtime,
                         calls,
+                        symbol,
+                        language,
+                        redacted: false,
+                        occurrence: 0,
+                        overlap_lines: 0,
+                        summary: None,
+                        doc: None,
+                        package: None,
+                        imports: Vec::new(),
+                        part: None,
+                        changed_at: None,
+                        is_test: false,
+                        collection: None,
+                        tags: Vec::new(),
+                        duplicates: Vec::new(),
                     });
                 }
 
@@ -294,17 +962,81 @@ impl CodeChunker {
                 if !is_container {
                     return Ok(());
                 }
+                // Members of a class are qualified by its name
+                child_scope.extend(name);
             }
         }
 
         let mut cursor = node.walk();
         for child in node.children(&mut cursor) {
-            self.traverse(&child, reader, filename, chunks, ext, mtime, depth + 1)?;
+            self.traverse(&child, reader, ctx, chunks, depth + 1, &child_scope)?;
         }
 
         Ok(())
     }
 
+    /// Returns the first ERROR or MISSING node in document order.
+    fn first_error<'t>(node: &Node<'t>) -> Option<Node<'t>> {
+        if !node.has_error() {
+            return None;
+        }
+        if node.is_error() || node.is_missing() {
+            return Some(*node);
+        }
+        let mut cursor = node.walk();
+        let children: Vec<Node<'t>> = node.children(&mut cursor).collect();
+        children.iter().find_map(Self::first_error).or(Some(*node))
+    }
+
+    /// Extracts the declared name of a Python, JavaScript or TypeScript definition.
+    fn symbol_name<R: Read + Seek>(
+        &self,
+        node: &Node,
+        reader: &mut R,
+        ext: &str,
+    ) -> std::io::Result<Option<String>> {
+        if !matches!(ext, "py" | "js" | "jsx" | "ts" | "tsx") {
+            return Ok(None);
+        }
+
+        let name_node = match node.kind() {
+            // `const handler = () => {}`
+            "arrow_function" => node
+                .parent()
+                .filter(|p| p.kind() == "variable_declarator")
+                .and_then(|p| p.child_by_field_name("name")),
+            "lexical_declaration" | "variable_declaration" => {
+                let mut cursor = node.walk();
+                let declarator = node
+                    .named_children(&mut cursor)
+                    .find(|c| c.kind() == "variable_declarator");
+                declarator.and_then(|d| d.child_by_field_name("name"))
+            }
+            _ => node.child_by_field_name("name"),
+        };
+
+        match name_node {
+            Some(n)
+                if matches!(
+                    n.kind(),
+                    "identifier" | "property_identifier" | "type_identifier"
+                ) =>
+            {
+                Ok(Some(Self::read_text(&n, reader)?))
+            }
+            _ => Ok(None),
+        }
+    }
+
+    fn read_text<R: Read + Seek>(node: &Node, reader: &mut R) -> std::io::Result<String> {
+        let start = node.start_byte();
+        let len = node.end_byte().saturating_sub(start);
+        reader.seek(SeekFrom::Start(start as u64))?;
+        let mut buf = vec![0u8; len];
+        reader.read_exact(&mut buf)?;
+        Ok(String::from_utf8_lossy(&buf).to_string())
+    }
+
     fn find_calls<R: Read + Seek>(
         &self,
         node: &Node,
@@ -352,6 +1084,217 @@ impl CodeChunker {
         Ok(None)
     }
 
+    /// Splits `source` into chunks of whole lines of at most `max_chunk_size` bytes.
+    ///
+    /// Used when a file cannot be parsed. Each chunk starts with the last
+    /// `overlap_lines` lines of the previous one, recorded in
+    /// [`CodeChunk::overlap_lines`]. The overlap is capped at half the previous
+    /// chunk so every chunk is mostly new lines, and a source that fits in one
+    /// chunk is never split. A line too large for a chunk on its own, as in
+    /// minified code, is cut within the line into pieces that each fit.
+    pub fn chunk_lines(&self, filename: &str, source: &str, mtime: i64) -> Vec<CodeChunk> {
+        let lines: Vec<&str> = source.lines().collect();
+        let mut chunks = Vec::new();
+        let mut start = 0;
+        let mut overlap = 0;
+
+        while start < lines.len() {
+            if !self.fits(lines[start]) {
+                for piece in self.split_line(lines[start]) {
+                    chunks.push(Self::line_chunk(
+                        filename,
+                        piece,
+                        start + 1,
+                        start + 1,
+                        mtime,
+                        0,
+                    ));
+                }
+                start += 1;
+                overlap = 0;
+                continue;
+            }
+
+            let mut end = start;
+            let mut size = 0;
+            while end < lines.len()
+                && (end == start
+                    || (size + lines[end].len() < self.max_chunk_size
+                        && self
+                            .token_limit
+                            .as_ref()
+                            .is_none_or(|limit| limit.allows(&lines[start..=end].join("\n")))))
+            {
+                size += lines[end].len() + 1;
+                end += 1;
+            }
+
+            let code = lines[start..end].join("\n");
+            let emitted = !code.trim().is_empty();
+            if emitted {
+                chunks.push(Self::line_chunk(
+                    filename,
+                    code,
+                    start + 1,
+                    end,
+                    mtime,
+                    overlap,
+                ));
+            }
+
+            if end == lines.len() {
+                break;
+            }
+
+            // Step back to repeat the tail, but always make progress
+            overlap = if emitted {
+                self.overlap_lines.min((end - start) / 2)
+            } else {
+                0
+            };
+            start = end - overlap;
+        }
+
+        chunks
+    }
+
+    /// A chunk of [`chunk_lines`](Self::chunk_lines), without symbol or language.
+    fn line_chunk(
+        filename: &str,
+        code: String,
+        line_start: usize,
+        line_end: usize,
+        mtime: i64,
+        overlap_lines: usize,
+    ) -> CodeChunk {
+        CodeChunk {
+            filename: filename.to_string(),
+            code,
+            line_start,
+            line_end,
+            last_modified: mtime,
+            calls: Vec::new(),
+            symbol: None,
+            language: None,
+            redacted: false,
+            occurrence: 0,
+            overlap_lines,
+            summary: None,
+            doc: None,
+            package: None,
+            imports: Vec::new(),
+            part: None,
+            changed_at: None,
+            is_test: false,
+            collection: None,
+            tags: Vec::new(),
+            duplicates: Vec::new(),
+        }
+    }
+
+    /// Splits an oversized declaration into parts that each [fit](Self::fits).
+    ///
+    /// Parts are cut before one of the `boundaries` (rows relative to `code`,
+    /// typically where the statements of the body start) where possible,
+    /// otherwise between lines, and a single line that is too large on its own
+    /// (minified code) is cut within the line. Returns each part with its
+    /// first and last row relative to `code`.
+    pub fn split_declaration(
+        &self,
+        code: &str,
+        boundaries: &[usize],
+    ) -> Vec<(String, usize, usize)> {
+        let lines: Vec<&str> = code.lines().collect();
+        let mut cuts: Vec<usize> = boundaries
+            .iter()
+            .copied()
+            .filter(|&row| row > 0 && row < lines.len())
+            .collect();
+        cuts.sort_unstable();
+        cuts.dedup();
+
+        let mut segments = Vec::with_capacity(cuts.len() + 1);
+        let mut start = 0;
+        for cut in cuts {
+            segments.push((start, cut));
+            start = cut;
+        }
+        segments.push((start, lines.len()));
+
+        let mut parts = Vec::new();
+        // Rows of the part being grown from consecutive segments
+        let mut current: Option<(usize, usize)> = None;
+        for (start, end) in segments {
+            if let Some((part_start, part_end)) = current {
+                if self.fits(&lines[part_start..end].join("\n")) {
+                    current = Some((part_start, end));
+                    continue;
+                }
+                parts.push((
+                    lines[part_start..part_end].join("\n"),
+                    part_start,
+                    part_end - 1,
+                ));
+                current = None;
+            }
+            if self.fits(&lines[start..end].join("\n")) {
+                current = Some((start, end));
+            } else {
+                parts.extend(self.split_rows(&lines, start, end));
+            }
+        }
+        if let Some((part_start, part_end)) = current {
+            parts.push((
+                lines[part_start..part_end].join("\n"),
+                part_start,
+                part_end - 1,
+            ));
+        }
+        parts.retain(|(code, _, _)| !code.trim().is_empty());
+        parts
+    }
+
+    /// Packs `lines[start..end]` into parts of whole lines, cutting lines that
+    /// don't fit on their own.
+    fn split_rows(&self, lines: &[&str], start: usize, end: usize) -> Vec<(String, usize, usize)> {
+        let mut parts = Vec::new();
+        let mut row = start;
+        while row < end {
+            if !self.fits(lines[row]) {
+                for piece in self.split_line(lines[row]) {
+                    parts.push((piece, row, row));
+                }
+                row += 1;
+                continue;
+            }
+            let mut last = row + 1;
+            while last < end && self.fits(&lines[row..=last].join("\n")) {
+                last += 1;
+            }
+            parts.push((lines[row..last].join("\n"), row, last - 1));
+            row = last;
+        }
+        parts
+    }
+
+    /// Cuts a single line into pieces that fit, halving pieces above the token limit.
+    fn split_line(&self, line: &str) -> Vec<String> {
+        let mut pieces = Vec::new();
+        let mut pending = self.split_text(line);
+        pending.reverse();
+        while let Some(piece) = pending.pop() {
+            let chars: Vec<char> = piece.chars().collect();
+            if self.fits(&piece) || chars.len() < 2 {
+                pieces.push(piece);
+                continue;
+            }
+            let (head, tail) = chars.split_at(chars.len() / 2);
+            pending.push(tail.iter().collect());
+            pending.push(head.iter().collect());
+        }
+        pieces
+    }
+
     fn split_text(&self, text: &str) -> Vec<String> {
         if text.len() <= self.max_chunk_size {
             return vec![text.to_string()];
@@ -413,6 +1356,34 @@ mod tests {
         assert!(chunks.iter().any(|c| c.code.contains("fn main")));
     }
 
+    #[test]
+    fn test_chunk_file_docs() {
+        let chunker = CodeChunker::default();
+        let mut cursor = Cursor::new("# Design\n\n## Auth\n\nSessions use JWTs.\n");
+        let chunks = chunker
+            .chunk_file("docs/design.md", &mut cursor, 0)
+            .unwrap();
+        assert_eq!(chunks.len(), 2);
+        assert_eq!(chunks[1].symbol.as_deref(), Some("Design > Auth"));
+        assert_eq!(DocType::of_file(&chunks[1].filename), DocType::Markdown);
+
+        let mut cursor = Cursor::new("Release notes.\n\nNothing else.");
+        let chunks = chunker.chunk_file("NOTES.txt", &mut cursor, 0).unwrap();
+        assert_eq!(chunks.len(), 1);
+        assert_eq!(chunks[0].language.as_deref(), Some("text"));
+
+        assert!(CodeChunker::is_supported("md"));
+        assert!(!CodeChunker::is_supported("pdf"));
+        // Indexing skips unsupported files, chunk_file falls back to lines
+        let mut cursor = Cursor::new("all:\n\tgo build ./...\n");
+        let chunks = chunker.chunk_file("build.mk", &mut cursor, 0).unwrap();
+        assert_eq!(chunks.len(), 1);
+        assert_eq!((chunks[0].line_start, chunks[0].line_end), (1, 2));
+        assert_eq!(DocType::of_file("src/main.rs"), DocType::Code);
+        assert_eq!("MD".parse::<DocType>(), Ok(DocType::Markdown));
+        assert!("pdf".parse::<DocType>().is_err());
+    }
+
     #[test]
     fn test_exact_size_limit() {
         let chunker = CodeChunker::new(5, 0);
@@ -432,6 +1403,182 @@ mod tests {
         assert_eq!(chunks[0], "Short text");
     }
 
+    #[test]
+    fn test_chunk_lines() {
+        let chunker = CodeChunker::new(12, 6);
+        let source = "line1\nline2\nline3\nline4";
+        let chunks = chunker.chunk_lines("a.txt", source, 0);
+
+        assert_eq!(chunks.len(), 3);
+        assert_eq!(chunks[0].code, "line1\nline2");
+        assert_eq!((chunks[0].line_start, chunks[0].line_end), (1, 2));
+        // Overlap repeats the last line of the previous chunk
+        assert_eq!((chunks[1].line_start, chunks[1].line_end), (2, 3));
+        assert_eq!((chunks[2].line_start, chunks[2].line_end), (3, 4));
+        assert_eq!(chunks[0].overlap_lines, 0);
+        assert_eq!(chunks[1].overlap_lines, 1);
+    }
+
+    #[test]
+    fn test_chunk_lines_overlap() {
+        let source: String = (1..=20).map(|i| format!("line{:02}\n", i)).collect();
+        // 7 bytes per line, so a chunk holds 10 lines
+        let chunker = CodeChunker::new(76, 0).with_overlap_lines(3);
+        let chunks = chunker.chunk_lines("a.txt", &source, 0);
+        let ranges: Vec<(usize, usize, usize)> = chunks
+            .iter()
+            .map(|c| (c.line_start, c.line_end, c.overlap_lines))
+            .collect();
+        assert_eq!(ranges, vec![(1, 10, 0), (8, 17, 3), (15, 20, 3)]);
+        assert!(chunks[1].code.starts_with("line08\nline09\nline10\nline11"));
+
+        // A file that fits in one chunk is never overlapped with itself
+        let tiny = chunker.chunk_lines("tiny.txt", "a\nb\nc", 0);
+        assert_eq!(tiny.len(), 1);
+        assert_eq!(tiny[0].overlap_lines, 0);
+
+        // The overlap never exceeds half of the previous chunk
+        let wide = CodeChunker::new(12, 0).with_overlap_lines(10);
+        let chunks = wide.chunk_lines("b.txt", "l1\nl2\nl3\nl4\nl5\nl6", 0);
+        let ranges: Vec<(usize, usize, usize)> = chunks
+            .iter()
+            .map(|c| (c.line_start, c.line_end, c.overlap_lines))
+            .collect();
+        assert_eq!(ranges, vec![(1, 4, 0), (3, 6, 2)]);
+    }
+
+    #[test]
+    fn test_chunk_lines_cuts_long_lines() {
+        // A minified bundle: one line far over the chunk size
+        let chunker = CodeChunker::new(10, 0);
+        let source = format!("short\n{}\nend", "y".repeat(25));
+        let chunks = chunker.chunk_lines("app.min.js", &source, 0);
+        let ranges: Vec<(usize, usize, usize)> = chunks
+            .iter()
+            .map(|c| (c.line_start, c.line_end, c.code.len()))
+            .collect();
+        assert_eq!(
+            ranges,
+            vec![(1, 1, 5), (2, 2, 10), (2, 2, 10), (2, 2, 5), (3, 3, 3)]
+        );
+        assert!(chunks.iter().all(|c| c.overlap_lines == 0));
+    }
+
+    #[test]
+    fn test_token_limit_splits_at_statements() {
+        use crate::context::HeuristicCounter;
+
+        // About 4 characters per token, so a part holds at most 64 characters
+        let limit = TokenLimit::new(16, Arc::new(HeuristicCounter));
+        let chunker = CodeChunker::new(10_000, 0).with_token_limit(Some(limit));
+        let code = "fn handle(req: Request) {\n    let user = authenticate(&req);\n    let session = open_session(user);\n    respond(session);\n}\n\nfn ping() {}\n";
+        let mut cursor = Cursor::new(code);
+
+        let chunks = chunker.chunk_file("handler.rs", &mut cursor, 0).unwrap();
+        let parts: Vec<_> = chunks
+            .iter()
+            .filter(|c| c.symbol.as_deref() == Some("handler.handle"))
+            .collect();
+        let ranges: Vec<(usize, usize, String)> = parts
+            .iter()
+            .map(|c| (c.line_start, c.line_end, c.part.unwrap().to_string()))
+            .collect();
+        assert_eq!(
+            ranges,
+            vec![
+                (1, 2, "part 1/2".to_string()),
+                (3, 5, "part 2/2".to_string())
+            ]
+        );
+        assert!(parts[1].code.starts_with("    let session"));
+        assert_ne!(parts[0].id(), parts[1].id());
+
+        let ping = chunks
+            .iter()
+            .find(|c| c.symbol.as_deref() == Some("handler.ping"))
+            .unwrap();
+        assert_eq!(ping.part, None);
+    }
+
+    #[test]
+    fn test_token_limit_cuts_long_lines() {
+        use crate::context::HeuristicCounter;
+
+        let limit = TokenLimit::new(10, Arc::new(HeuristicCounter));
+        let chunker = CodeChunker::new(1000, 0).with_token_limit(Some(limit));
+        let minified = "x".repeat(100);
+        let parts = chunker.split_declaration(&minified, &[]);
+        assert_eq!(parts.len(), 4);
+        assert!(parts
+            .iter()
+            .all(|(code, first, last)| code.len() == 25 && (*first, *last) == (0, 0)));
+    }
+
+    #[test]
+    fn test_go_file_uses_symbol_chunker() {
+        let chunker = CodeChunker::default();
+        let code = "package main\n\nfunc main() {}\n";
+        let mut cursor = Cursor::new(code);
+
+        let chunks = chunker.chunk_file("main.go", &mut cursor, 0).unwrap();
+        assert_eq!(chunks.len(), 1);
+        assert_eq!(chunks[0].symbol.as_deref(), Some("main.main"));
+    }
+
+    #[test]
+    fn test_python_symbols() {
+        let chunker = CodeChunker::default();
+        let code = "class AuthService:\n    def login(self, user):\n        return check(user)\n\ndef helper():\n    pass\n";
+        let mut cursor = Cursor::new(code);
+
+        let chunks = chunker.chunk_file("auth.py", &mut cursor, 0).unwrap();
+        let symbols: Vec<_> = chunks.iter().filter_map(|c| c.symbol.as_deref()).collect();
+        assert!(symbols.contains(&"auth.AuthService"));
+        assert!(symbols.contains(&"auth.AuthService.login"));
+        assert!(symbols.contains(&"auth.helper"));
+        assert!(chunks
+            .iter()
+            .all(|c| c.language.as_deref() == Some("python")));
+    }
+
+    #[test]
+    fn test_typescript_symbols() {
+        let chunker = CodeChunker::default();
+        let code = "export class Store {\n  get(key: string) { return key; }\n}\nconst handler = () => 1;\n";
+        let mut cursor = Cursor::new(code);
+
+        let chunks = chunker.chunk_file("store.ts", &mut cursor, 0).unwrap();
+        let symbols: Vec<_> = chunks.iter().filter_map(|c| c.symbol.as_deref()).collect();
+        assert!(symbols.contains(&"store.Store"));
+        assert!(symbols.contains(&"store.Store.get"));
+        assert!(symbols.contains(&"store.handler"));
+    }
+
+    #[test]
+    fn test_syntax_error_keeps_preceding_chunks() {
+        let chunker = CodeChunker::default();
+        let code = "function ok() { return 1; }\n\nfunction broken( {\n";
+        let mut cursor = Cursor::new(code);
+
+        let chunks = chunker.chunk_file("app.js", &mut cursor, 0).unwrap();
+        assert!(chunks.iter().any(|c| c.symbol.as_deref() == Some("app.ok")));
+        assert!(chunks.iter().all(|c| !c.code.contains("broken")));
+        assert_eq!(chunker.fallbacks(), 0);
+    }
+
+    #[test]
+    fn test_unparseable_file_falls_back_to_lines() {
+        let chunker = CodeChunker::default();
+        let code = "function broken( {\n  return 1;\n";
+        let mut cursor = Cursor::new(code);
+
+        let chunks = chunker.chunk_file("app.js", &mut cursor, 7).unwrap();
+        assert_eq!(chunks.len(), 1);
+        assert_eq!((chunks[0].line_start, chunks[0].line_end), (1, 2));
+        assert_eq!(chunks[0].last_modified, 7);
+        assert_eq!(chunker.fallbacks(), 1);
+    }
+
     #[test]
     fn test_binary_file_skip() {
         let chunker = CodeChunker::default();
@@ -445,4 +1592,63 @@ mod tests {
             "Binary file should be skipped even if extension matches"
         );
     }
+
+    #[test]
+    fn test_chunk_id_is_content_hash() {
+        let chunk = CodeChunk {
+            filename: "auth.py".to_string(),
+            code: "\r\ndef login():  \r\n    return True\r\n\r\n".to_string(),
+            symbol: Some("auth.login".to_string()),
+            line_start: 10,
+            line_end: 11,
+            ..Default::default()
+        };
+        // sha256("auth.py\0auth.login\0def login():\n    return True")
+        assert_eq!(
+            chunk.id(),
+            "8c4ced1312844ff889d375309814c9bc347f83d1e28220a9d420ddbc918af17e"
+        );
+        let moved = CodeChunk {
+            line_start: 40,
+            line_end: 41,
+            ..chunk.clone()
+        };
+        assert_eq!(moved.id(), chunk.id());
+    }
+
+    #[test]
+    fn test_moving_a_function_keeps_ids() {
+        let chunker = CodeChunker::default();
+        let before = "def a():\n    return 1\n\ndef b():\n    return 2\n";
+        let after = "def b():\n    return 2\n\n\n\ndef a():\n    return 1\n";
+        let ids = |code: &str| {
+            let mut cursor = Cursor::new(code.to_string());
+            let mut ids: Vec<String> = chunker
+                .chunk_file("m.py", &mut cursor, 0)
+                .unwrap()
+                .iter()
+                .map(CodeChunk::id)
+                .collect();
+            ids.sort();
+            ids
+        };
+        assert_eq!(ids(before), ids(after));
+    }
+
+    #[test]
+    fn test_duplicate_chunks_get_distinct_ids() {
+        let mut chunks = vec![
+            CodeChunk {
+                filename: "dup.txt".to_string(),
+                code: "same".to_string(),
+                ..Default::default()
+            };
+            3
+        ];
+        assign_occurrences(&mut chunks);
+        let occurrences: Vec<u32> = chunks.iter().map(|c| c.occurrence).collect();
+        assert_eq!(occurrences, vec![0, 1, 2]);
+        let ids: std::collections::HashSet<String> = chunks.iter().map(CodeChunk::id).collect();
+        assert_eq!(ids.len(), 3);
+    }
 }
@@ -0,0 +1,151 @@
+use std::path::Path;
+use std::process::Command;
+
+use super::CodeChunk;
+
+/// Author time of each line of the file at `path` according to `git blame`,
+/// `None` for lines that aren't committed yet.
+///
+/// `None` altogether when git isn't installed, the file isn't in a git
+/// repository or isn't tracked.
+pub fn line_times(path: &Path) -> Option<Vec<Option<i64>>> {
+    let dir = path
+        .parent()
+        .filter(|p| !p.as_os_str().is_empty())
+        .unwrap_or(Path::new("."));
+    let output = Command::new("git")
+        .arg("blame")
+        .arg("--line-porcelain")
+        .arg("--")
+        .arg(path.file_name()?)
+        .current_dir(dir)
+        .output()
+        .ok()?;
+    if !output.status.success() {
+        return None;
+    }
+    Some(parse_line_porcelain(&String::from_utf8_lossy(
+        &output.stdout,
+    )))
+}
+
+/// Reads the author time of every line from `git blame --line-porcelain`
+/// output, which repeats the commit headers for each line.
+fn parse_line_porcelain(output: &str) -> Vec<Option<i64>> {
+    let mut times = Vec::new();
+    let mut uncommitted = false;
+    for line in output.lines() {
+        // The line's content, which may look like a header
+        if line.starts_with('\t') {
+            continue;
+        }
+        let (key, value) = line.split_once(' ').unwrap_or((line, ""));
+        if key.len() >= 40 && key.bytes().all(|b| b.is_ascii_hexdigit()) {
+            // Working tree changes are blamed on the all-zero commit
+            uncommitted = key.bytes().all(|b| b == b'0');
+        } else if key == "author-time" {
+            times.push(if uncommitted {
+                None
+            } else {
+                value.trim().parse().ok()
+            });
+        }
+    }
+    times
+}
+
+/// Newest of the times of lines `line_start..=line_end` (1-indexed); `None`
+/// if one of them is uncommitted or past the end of `times`.
+fn chunk_time(times: &[Option<i64>], line_start: usize, line_end: usize) -> Option<i64> {
+    let lines = times.get(line_start.checked_sub(1)?..line_end)?;
+    lines
+        .iter()
+        .try_fold(i64::MIN, |newest, time| Some(newest.max((*time)?)))
+}
+
+/// Sets `changed_at` of the chunks of the file at `path` to when their lines
+/// were last committed, so that recency weighting ranks an old function in a
+/// recently touched file by its own age.
+///
+/// Chunks with uncommitted changes, and all chunks of a file git can't blame,
+/// are left undated and weighted by the file's modification time instead.
+/// Returns whether the file could be blamed.
+pub fn blame_chunks(chunks: &mut [CodeChunk], path: &Path) -> bool {
+    let Some(times) = line_times(path) else {
+        return false;
+    };
+    for chunk in chunks {
+        chunk.changed_at = chunk_time(&times, chunk.line_start, chunk.line_end);
+    }
+    true
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const PORCELAIN: &str = "\
+4c1e2f0a6b7d8e9f00112233445566778899aabb 1 1 2
+author Ana
+author-time 1700000000
+author-tz +0100
+committer Ana
+committer-time 1700000500
+summary Add config loader
+filename config.go
+\tpackage config
+4c1e2f0a6b7d8e9f00112233445566778899aabb 2 2
+author Ana
+author-time 1700000000
+summary Add config loader
+filename config.go
+\tauthor-time 5
+9f8e7d6c5b4a39281706f5e4d3c2b1a098765432 3 3 1
+author Ben
+author-time 1710000000
+summary Load defaults
+filename config.go
+\tfunc Load() {}
+0000000000000000000000000000000000000000 4 4 1
+author Not Committed Yet
+author-time 1720000000
+summary Version of config.go from config.go
+filename config.go
+\t// TODO
+";
+
+    #[test]
+    fn test_parse_line_porcelain() {
+        assert_eq!(
+            parse_line_porcelain(PORCELAIN),
+            vec![Some(1700000000), Some(1700000000), Some(1710000000), None]
+        );
+        assert!(parse_line_porcelain("").is_empty());
+    }
+
+    #[test]
+    fn test_chunk_time() {
+        let times = parse_line_porcelain(PORCELAIN);
+        assert_eq!(chunk_time(&times, 1, 2), Some(1700000000));
+        assert_eq!(chunk_time(&times, 1, 3), Some(1710000000));
+        // Uncommitted lines and lines the blame doesn't cover
+        assert_eq!(chunk_time(&times, 3, 4), None);
+        assert_eq!(chunk_time(&times, 3, 9), None);
+        assert_eq!(chunk_time(&times, 0, 1), None);
+    }
+
+    #[test]
+    fn test_unblamed_file() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let path = dir.path().join("untracked.rs");
+        std::fs::write(&path, "fn main() {}\n").unwrap();
+        let mut chunks = vec![CodeChunk {
+            line_start: 1,
+            line_end: 1,
+            ..Default::default()
+        }];
+        // Not tracked, or not in a repository, or no git at all
+        assert!(!blame_chunks(&mut chunks, &path));
+        assert_eq!(chunks[0].changed_at, None);
+    }
+}
@@ -0,0 +1,53 @@
+/// Leading bytes searched for a NUL byte to tell binary files from text, the
+/// same heuristic and length git uses.
+pub const BINARY_SNIFF_BYTES: usize = 8000;
+
+/// Why the contents of a file aren't indexed.
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum NonText {
+    /// A NUL byte within the first [`BINARY_SNIFF_BYTES`]
+    Binary,
+    /// Text in an encoding other than UTF-8 (Latin-1, Shift JIS, ...), which
+    /// would be indexed with replacement characters
+    NotUtf8,
+}
+
+impl NonText {
+    /// Checks the full contents of a file; `None` for UTF-8 text.
+    ///
+    /// UTF-16 text has NUL bytes in it and is reported as binary.
+    pub fn detect(bytes: &[u8]) -> Option<Self> {
+        if bytes[..bytes.len().min(BINARY_SNIFF_BYTES)].contains(&0) {
+            Some(Self::Binary)
+        } else if std::str::from_utf8(bytes).is_err() {
+            Some(Self::NotUtf8)
+        } else {
+            None
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_detect() {
+        assert_eq!(NonText::detect(b"fn main() {}\n"), None);
+        assert_eq!(NonText::detect("// café ☕\n".as_bytes()), None);
+        assert_eq!(NonText::detect(b""), None);
+        assert_eq!(
+            NonText::detect(b"\x7fELF\x02\x01\x01\x00"),
+            Some(NonText::Binary)
+        );
+        // "hé" in UTF-16LE
+        assert_eq!(NonText::detect(b"h\x00\xe9\x00"), Some(NonText::Binary));
+        // "café" in Latin-1
+        assert_eq!(NonText::detect(b"caf\xe9\n"), Some(NonText::NotUtf8));
+
+        // A NUL past the sniffed prefix doesn't make a file binary
+        let mut long = vec![b'a'; BINARY_SNIFF_BYTES];
+        long.push(0);
+        assert_eq!(NonText::detect(&long), None);
+    }
+}
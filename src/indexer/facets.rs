@@ -0,0 +1,170 @@
+use serde::{Deserialize, Serialize};
+use std::fmt;
+use std::str::FromStr;
+
+use super::CodeChunk;
+use crate::summary::Heading;
+
+/// A part of a declaration embedded on its own besides the whole chunk, with
+/// `multi_vector` (see [`MultiVectorStore`](crate::storage::MultiVectorStore)).
+///
+/// A query phrased like documentation is closer to the doc comment alone than
+/// to the code it sits on, and one naming a function to its signature.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Facet {
+    /// The doc comment or docstring, without comment markers
+    Doc,
+    /// The lines of the declaration up to its body
+    Signature,
+}
+
+impl Facet {
+    pub fn as_str(self) -> &'static str {
+        match self {
+            Facet::Doc => "doc",
+            Facet::Signature => "signature",
+        }
+    }
+
+    /// The text of this facet of `chunk`, or `None` if it has none.
+    ///
+    /// Only declarations have facets, and a declaration split into parts
+    /// has them on its first part, which holds its doc comment and signature.
+    pub fn text(self, chunk: &CodeChunk) -> Option<String> {
+        if chunk.symbol.is_none() || chunk.part.is_some_and(|part| part.index > 1) {
+            return None;
+        }
+        let lines: Vec<&str> = chunk.code.lines().collect();
+        let heading = Heading::of(&lines);
+        let text = match self {
+            Facet::Doc => match chunk.doc.as_deref() {
+                Some(doc) if !doc.trim().is_empty() => doc.trim().to_string(),
+                _ => heading
+                    .doc
+                    .iter()
+                    .chain(&heading.docstring)
+                    .map(|line| strip_comment_marker(line))
+                    .filter(|line| !line.is_empty())
+                    .collect::<Vec<_>>()
+                    .join("\n"),
+            },
+            Facet::Signature => heading
+                .signature
+                .iter()
+                .map(|line| line.trim())
+                .collect::<Vec<_>>()
+                .join("\n"),
+        };
+        (!text.is_empty()).then_some(text)
+    }
+}
+
+/// A comment or docstring line without its markers: `// x`, `/** x */`,
+/// `# x`, `""" x """` and the like are all `x`.
+fn strip_comment_marker(line: &str) -> &str {
+    let line = line.trim();
+    let line = [
+        "///", "//!", "//", "/**", "/*", "*/", "*", "#", "--", "\"\"\"", "'''",
+    ]
+    .iter()
+    .find_map(|marker| line.strip_prefix(marker))
+    .unwrap_or(line);
+    let line = ["*/", "\"\"\"", "'''"]
+        .iter()
+        .find_map(|marker| line.strip_suffix(marker))
+        .unwrap_or(line);
+    line.trim()
+}
+
+impl fmt::Display for Facet {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(self.as_str())
+    }
+}
+
+impl FromStr for Facet {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.trim().to_ascii_lowercase().as_str() {
+            "doc" => Ok(Facet::Doc),
+            "signature" => Ok(Facet::Signature),
+            other => Err(format!(
+                "Unknown vector facet '{}'. Expected one of: doc, signature",
+                other
+            )),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::indexer::ChunkPart;
+
+    fn declaration(code: &str) -> CodeChunk {
+        CodeChunk {
+            code: code.to_string(),
+            symbol: Some("auth.Login".to_string()),
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_facet_texts() {
+        let rust = declaration(
+            "/// Checks the credentials of user.\n\
+             /// Returns a session.\n\
+             pub fn login(user: &str,\n    password: &str) -> Session {\n    check(user)\n}",
+        );
+        assert_eq!(
+            Facet::Doc.text(&rust).unwrap(),
+            "Checks the credentials of user.\nReturns a session."
+        );
+        assert_eq!(
+            Facet::Signature.text(&rust).unwrap(),
+            "pub fn login(user: &str,\npassword: &str) -> Session {"
+        );
+
+        let python =
+            declaration("def login(user):\n    \"\"\"Log user in.\"\"\"\n    return check(user)");
+        assert_eq!(Facet::Doc.text(&python).unwrap(), "Log user in.");
+        assert_eq!(Facet::Signature.text(&python).unwrap(), "def login(user):");
+
+        let go = CodeChunk {
+            doc: Some("Login checks the credentials of user.".to_string()),
+            ..declaration("// Login checks the credentials of user.\nfunc Login(user string) {\n}")
+        };
+        assert_eq!(
+            Facet::Doc.text(&go).unwrap(),
+            "Login checks the credentials of user."
+        );
+
+        let undocumented = declaration("func Logout() {\n}");
+        assert_eq!(Facet::Doc.text(&undocumented), None);
+        assert_eq!(
+            Facet::Signature.text(&undocumented).unwrap(),
+            "func Logout() {"
+        );
+    }
+
+    #[test]
+    fn test_only_declarations_have_facets() {
+        let prose = CodeChunk {
+            code: "# Setup\nRun make.".to_string(),
+            ..Default::default()
+        };
+        assert_eq!(Facet::Doc.text(&prose), None);
+        assert_eq!(Facet::Signature.text(&prose), None);
+
+        let second = CodeChunk {
+            part: Some(ChunkPart { index: 2, count: 2 }),
+            ..declaration("// More\n    check(user)\n}")
+        };
+        assert_eq!(Facet::Signature.text(&second), None);
+
+        assert_eq!("Signature".parse::<Facet>().unwrap(), Facet::Signature);
+        assert!("code".parse::<Facet>().is_err());
+    }
+}
@@ -0,0 +1,444 @@
+use tree_sitter::{Language, Node, Parser};
+
+use super::{statement_rows, ChunkPart, CodeChunk, CodeChunker, TokenLimit, DEFAULT_OVERLAP_LINES};
+
+/// Splits Go source files into one chunk per top-level declaration.
+///
+/// Every function, method, type and const/var block becomes its own chunk,
+/// including the doc comment directly above it. Chunks carry a symbol ID such
+/// as `main.AuthService.Authenticate` so search results can be cited precisely,
+/// the doc comment text in `doc` so it can be matched on its own, and the
+/// package name and the file's import paths in `package` and `imports`.
+/// Closures stay inside the function that declares them. Files that fail to
+/// parse are chunked by lines instead.
+///
+/// # Examples
+///
+/// ```no_run
+/// use code_rag::indexer::GoSymbolChunker;
+///
+/// let source = "package main\n\n// Hello greets\nfunc Hello() {}\n";
+/// let chunks = GoSymbolChunker::new(1024, 128).chunk("hello.go", source, 0);
+/// assert_eq!(chunks[0].symbol.as_deref(), Some("main.Hello"));
+/// ```
+pub struct GoSymbolChunker {
+    max_chunk_size: usize,
+    chunk_overlap: usize,
+    overlap_lines: usize,
+    token_limit: Option<TokenLimit>,
+}
+
+impl GoSymbolChunker {
+    pub fn new(max_chunk_size: usize, chunk_overlap: usize) -> Self {
+        Self {
+            max_chunk_size,
+            chunk_overlap,
+            overlap_lines: DEFAULT_OVERLAP_LINES,
+            token_limit: None,
+        }
+    }
+
+    /// Lines shared by the line-based chunks of oversized declarations and unparsable files.
+    pub fn with_overlap_lines(mut self, overlap_lines: usize) -> Self {
+        self.overlap_lines = overlap_lines;
+        self
+    }
+
+    /// Also splits declarations above `token_limit`, see [`CodeChunker::with_token_limit`].
+    pub fn with_token_limit(mut self, token_limit: Option<TokenLimit>) -> Self {
+        self.token_limit = token_limit;
+        self
+    }
+
+    pub fn chunk(&self, filename: &str, source: &str, mtime: i64) -> Vec<CodeChunk> {
+        let mut chunks = self.chunk_symbols(filename, source, mtime);
+        for chunk in chunks.iter_mut() {
+            chunk.language = Some("go".to_string());
+        }
+        chunks
+    }
+
+    fn chunk_symbols(&self, filename: &str, source: &str, mtime: i64) -> Vec<CodeChunk> {
+        let line_chunker = CodeChunker::new(self.max_chunk_size, self.chunk_overlap)
+            .with_overlap_lines(self.overlap_lines)
+            .with_token_limit(self.token_limit.clone());
+
+        let mut parser = Parser::new();
+        let language: Language = tree_sitter_go::LANGUAGE.into();
+        if parser.set_language(&language).is_err() {
+            tracing::error!("Could not set Go language for {}", filename);
+            return line_chunker.chunk_lines(filename, source, mtime);
+        }
+
+        let tree = match parser.parse(source, None) {
+            Some(t) if !t.root_node().has_error() => t,
+            _ => {
+                tracing::debug!(
+                    "Failed to parse {}, falling back to line-based chunking",
+                    filename
+                );
+                return line_chunker.chunk_lines(filename, source, mtime);
+            }
+        };
+
+        let bytes = source.as_bytes();
+        let root = tree.root_node();
+        let declarations = named_children(root);
+
+        let package = declarations
+            .iter()
+            .find(|n| n.kind() == "package_clause")
+            .and_then(|n| find_descendant(*n, "package_identifier"))
+            .and_then(|n| text(n, bytes));
+        let imports = import_paths(&declarations, bytes);
+
+        let mut chunks = Vec::new();
+        for node in declarations {
+            let name = match symbol_name(node, bytes) {
+                Some(name) => name,
+                None => continue,
+            };
+            let symbol = match &package {
+                Some(pkg) => format!("{}.{}", pkg, name),
+                None => name,
+            };
+
+            let start = doc_comment_start(node);
+            let doc = doc_comment_text(start, node, bytes);
+            let code = &source[start.start_byte()..node.end_byte()];
+            let line_start = start.start_position().row + 1;
+            let line_end = node.end_position().row + 1;
+
+            let mut calls = Vec::new();
+            collect_calls(node, bytes, &mut calls);
+
+            if !line_chunker.fits(code) {
+                // Oversized declarations are split at statement boundaries where possible;
+                // every part keeps the symbol. The doc comment goes with the first part,
+                // which contains it.
+                let boundaries = statement_rows(node, line_start - 1);
+                let mut parts: Vec<CodeChunk> = line_chunker
+                    .split_declaration(code, &boundaries)
+                    .into_iter()
+                    .map(|(part, first, last)| CodeChunk {
+                        filename: filename.to_string(),
+                        code: part,
+                        line_start: line_start + first,
+                        line_end: line_start + last,
+                        last_modified: mtime,
+                        calls: calls.clone(),
+                        symbol: Some(symbol.clone()),
+                        package: package.clone(),
+                        imports: imports.clone(),
+                        ..Default::default()
+                    })
+                    .collect();
+                if let Some(first) = parts.first_mut() {
+                    first.doc = doc.clone();
+                }
+                ChunkPart::label(&mut parts);
+                chunks.extend(parts);
+            } else {
+                chunks.push(CodeChunk {
+                    filename: filename.to_string(),
+                    code: code.to_string(),
+                    line_start,
+                    line_end,
+                    last_modified: mtime,
+                    calls,
+                    symbol: Some(symbol),
+                    language: None,
+                    redacted: false,
+                    occurrence: 0,
+                    overlap_lines: 0,
+                    summary: None,
+                    doc,
+                    package: package.clone(),
+                    imports: imports.clone(),
+                    part: None,
+                    changed_at: None,
+                    is_test: false,
+                    collection: None,
+                    tags: Vec::new(),
+                    duplicates: Vec::new(),
+                });
+            }
+        }
+
+        chunks
+    }
+}
+
+/// Returns the symbol name of a top-level declaration, relative to its package.
+///
+/// Grouped declarations (`const ( ... )`, `type ( ... )`) are named after their
+/// first spec.
+fn symbol_name(node: Node, source: &[u8]) -> Option<String> {
+    match node.kind() {
+        "function_declaration" => node
+            .child_by_field_name("name")
+            .and_then(|n| text(n, source)),
+        "method_declaration" => {
+            let name = node
+                .child_by_field_name("name")
+                .and_then(|n| text(n, source))?;
+            let receiver = node
+                .child_by_field_name("receiver")
+                .and_then(|r| find_descendant(r, "type_identifier"))
+                .and_then(|n| text(n, source));
+            Some(match receiver {
+                Some(recv) => format!("{}.{}", recv, name),
+                None => name,
+            })
+        }
+        "type_declaration" => named_children(node)
+            .into_iter()
+            .find(|n| matches!(n.kind(), "type_spec" | "type_alias"))
+            .and_then(|spec| spec.child_by_field_name("name"))
+            .and_then(|n| text(n, source)),
+        "const_declaration" | "var_declaration" => {
+            let spec_kind = if node.kind() == "const_declaration" {
+                "const_spec"
+            } else {
+                "var_spec"
+            };
+            find_descendant(node, spec_kind)
+                .and_then(|spec| spec.child_by_field_name("name"))
+                .and_then(|n| text(n, source))
+        }
+        _ => None,
+    }
+}
+
+/// Import paths of all `import` declarations among `declarations`, in source
+/// order, without quotes. Aliases and blank/dot imports keep only the path.
+fn import_paths(declarations: &[Node], source: &[u8]) -> Vec<String> {
+    let mut imports = Vec::new();
+    for node in declarations
+        .iter()
+        .filter(|n| n.kind() == "import_declaration")
+    {
+        let mut specs = Vec::new();
+        collect_kind(*node, "import_spec", &mut specs);
+        for spec in specs {
+            if let Some(path) = spec
+                .child_by_field_name("path")
+                .and_then(|p| text(p, source))
+            {
+                let path = path.trim_matches(|c| c == '"' || c == '`').to_string();
+                if !imports.contains(&path) {
+                    imports.push(path);
+                }
+            }
+        }
+    }
+    imports
+}
+
+/// Finds the first line of the comment block directly above `node`, if any.
+fn doc_comment_start(node: Node) -> Node {
+    let mut start = node;
+    while let Some(prev) = start.prev_named_sibling() {
+        if prev.kind() != "comment" || prev.end_position().row + 1 < start.start_position().row {
+            break;
+        }
+        start = prev;
+    }
+    start
+}
+
+/// Joins the comments from `start` up to `node` without their markers.
+///
+/// Directives such as `//go:generate` or `//nolint:errcheck` are not part of
+/// the doc and are skipped. Returns `None` if no text is left.
+fn doc_comment_text(start: Node, node: Node, source: &[u8]) -> Option<String> {
+    let mut lines = Vec::new();
+    let mut current = Some(start);
+    while let Some(comment) = current.filter(|c| c.id() != node.id()) {
+        let raw = text(comment, source).unwrap_or_default();
+        if let Some(body) = raw.strip_prefix("//") {
+            if !is_directive(body) {
+                lines.push(
+                    body.strip_prefix(' ')
+                        .unwrap_or(body)
+                        .trim_end()
+                        .to_string(),
+                );
+            }
+        } else {
+            let body = raw.trim_start_matches("/*").trim_end_matches("*/");
+            for line in body.lines() {
+                let line = line.trim();
+                lines.push(line.strip_prefix('*').unwrap_or(line).trim().to_string());
+            }
+        }
+        current = comment.next_named_sibling();
+    }
+    let doc = lines.join("\n").trim().to_string();
+    (!doc.is_empty()).then_some(doc)
+}
+
+/// `//go:embed`, `//nolint:...`, `//export Foo` style comments.
+fn is_directive(body: &str) -> bool {
+    let word: String = body
+        .chars()
+        .take_while(|c| !c.is_whitespace() && *c != ':')
+        .collect();
+    !word.is_empty()
+        && word
+            .chars()
+            .all(|c| c.is_ascii_lowercase() || c.is_ascii_digit())
+        && (body[word.len()..].starts_with(':') || word == "export" || word == "line")
+}
+
+fn collect_calls(node: Node, source: &[u8], calls: &mut Vec<String>) {
+    for child in named_children(node) {
+        if child.kind() == "call_expression" {
+            if let Some(name) = child
+                .child_by_field_name("function")
+                .and_then(|f| text(f, source))
+            {
+                if !calls.contains(&name) {
+                    calls.push(name);
+                }
+            }
+        }
+        collect_calls(child, source, calls);
+    }
+}
+
+fn collect_kind<'t>(node: Node<'t>, kind: &str, found: &mut Vec<Node<'t>>) {
+    for child in named_children(node) {
+        if child.kind() == kind {
+            found.push(child);
+        } else {
+            collect_kind(child, kind, found);
+        }
+    }
+}
+
+fn find_descendant<'t>(node: Node<'t>, kind: &str) -> Option<Node<'t>> {
+    for child in named_children(node) {
+        if child.kind() == kind {
+            return Some(child);
+        }
+        if let Some(found) = find_descendant(child, kind) {
+            return Some(found);
+        }
+    }
+    None
+}
+
+fn named_children(node: Node) -> Vec<Node> {
+    let mut cursor = node.walk();
+    node.named_children(&mut cursor).collect()
+}
+
+fn text(node: Node, source: &[u8]) -> Option<String> {
+    node.utf8_text(source).ok().map(|s| s.to_string())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const SOURCE: &str = include_str!("../../test_assets/test.go");
+
+    fn symbols(chunks: &[CodeChunk]) -> Vec<&str> {
+        chunks.iter().filter_map(|c| c.symbol.as_deref()).collect()
+    }
+
+    #[test]
+    fn test_symbol_chunks() {
+        let chunks = GoSymbolChunker::new(4096, 0).chunk("test.go", SOURCE, 0);
+        assert_eq!(
+            symbols(&chunks),
+            vec![
+                "main.User",
+                "main.AuthService",
+                "main.NewAuthService",
+                "main.AuthService.Authenticate",
+                "main.AuthService.RegisterUser",
+                "main.HandleLogin",
+                "main.main",
+            ]
+        );
+    }
+
+    #[test]
+    fn test_doc_comment_and_lines() {
+        let chunks = GoSymbolChunker::new(4096, 0).chunk("test.go", SOURCE, 0);
+        let auth = chunks
+            .iter()
+            .find(|c| c.symbol.as_deref() == Some("main.AuthService.Authenticate"))
+            .unwrap();
+        assert!(auth
+            .code
+            .starts_with("// Authenticate verifies user credentials"));
+        assert_eq!(auth.line_start, 27);
+        assert_eq!(auth.line_end, 36);
+        assert!(auth.calls.contains(&"fmt.Errorf".to_string()));
+        assert_eq!(auth.language.as_deref(), Some("go"));
+    }
+
+    #[test]
+    fn test_doc_field() {
+        let chunks = GoSymbolChunker::new(4096, 0).chunk("test.go", SOURCE, 0);
+        let doc = |symbol: &str| {
+            chunks
+                .iter()
+                .find(|c| c.symbol.as_deref() == Some(symbol))
+                .and_then(|c| c.doc.clone())
+        };
+        assert_eq!(
+            doc("main.AuthService").as_deref(),
+            Some("AuthService handles authentication")
+        );
+        assert_eq!(doc("main.main"), None);
+
+        let source = "package p\n\n// Run starts the worker.\n//\n// It blocks.\n//go:noinline\nfunc Run() {}\n\n/*\n * Stop halts it.\n */\nfunc Stop() {}\n";
+        let chunks = GoSymbolChunker::new(4096, 0).chunk("p.go", source, 0);
+        assert_eq!(
+            chunks[0].doc.as_deref(),
+            Some("Run starts the worker.\n\nIt blocks.")
+        );
+        assert_eq!(chunks[1].doc.as_deref(), Some("Stop halts it."));
+        assert!(is_directive("nolint:errcheck"));
+        assert!(!is_directive(" Run starts"));
+        assert!(!is_directive("TODO: later"));
+    }
+
+    #[test]
+    fn test_package_and_imports() {
+        let chunks = GoSymbolChunker::new(4096, 0).chunk("test.go", SOURCE, 0);
+        for chunk in &chunks {
+            assert_eq!(chunk.package.as_deref(), Some("main"));
+            assert_eq!(chunk.imports, vec!["fmt", "net/http"]);
+        }
+
+        let source = "package auth\n\nimport \"errors\"\nimport (\n\tlog \"github.com/sirupsen/logrus\"\n\t_ \"embed\"\n)\n\nfunc Check() error { return errors.New(\"x\") }\n";
+        let chunks = GoSymbolChunker::new(4096, 0).chunk("auth.go", source, 0);
+        assert_eq!(chunks[0].package.as_deref(), Some("auth"));
+        assert_eq!(
+            chunks[0].imports,
+            vec!["errors", "github.com/sirupsen/logrus", "embed"]
+        );
+    }
+
+    #[test]
+    fn test_closures_and_const_blocks() {
+        let source = "package util\n\nconst (\n\tA = 1\n\tB = 2\n)\n\nvar Debug = false\n\nfunc Run() {\n\tf := func() { helper() }\n\tf()\n}\n";
+        let chunks = GoSymbolChunker::new(4096, 0).chunk("util.go", source, 0);
+        assert_eq!(symbols(&chunks), vec!["util.A", "util.Debug", "util.Run"]);
+        assert!(chunks[2].code.contains("helper()"));
+    }
+
+    #[test]
+    fn test_parse_failure_falls_back_to_lines() {
+        let source = "package broken\n\nfunc Broken( {\n";
+        let chunks = GoSymbolChunker::new(4096, 0).chunk("broken.go", source, 0);
+        assert_eq!(chunks.len(), 1);
+        assert!(chunks[0].symbol.is_none());
+        assert_eq!(chunks[0].line_start, 1);
+    }
+}
@@ -0,0 +1,436 @@
+use super::{fits, ChunkPart, CodeChunk, CodeChunker, TokenLimit, DEFAULT_OVERLAP_LINES};
+
+/// Splits Markdown files at H1, H2 and H3 headings.
+///
+/// Each section runs from its heading to the next heading of level 3 or
+/// higher, so H4-H6 stay inside their section. The titles of the enclosing
+/// headings become the chunk's symbol, e.g. `Design > Authentication > Tokens`,
+/// which is how results cite a section. Text before the first heading is a
+/// section without a symbol. ATX (`## Title`) and setext (`Title` over `===`
+/// or `---`) headings are recognized; `#` lines inside fenced code blocks are
+/// not headings. Sections larger than the chunk size are split at paragraphs
+/// like plain text into labeled parts that keep the section's heading path.
+///
+/// # Examples
+///
+/// ```no_run
+/// use code_rag::indexer::MarkdownChunker;
+///
+/// let source = "# Design\n\n## Authentication\n\nTokens expire after an hour.\n";
+/// let chunks = MarkdownChunker::new(1024).chunk("docs/design.md", source, 0);
+/// assert_eq!(chunks[1].symbol.as_deref(), Some("Design > Authentication"));
+/// ```
+pub struct MarkdownChunker {
+    max_chunk_size: usize,
+    overlap_lines: usize,
+    token_limit: Option<TokenLimit>,
+}
+
+impl MarkdownChunker {
+    pub fn new(max_chunk_size: usize) -> Self {
+        Self {
+            max_chunk_size,
+            overlap_lines: DEFAULT_OVERLAP_LINES,
+            token_limit: None,
+        }
+    }
+
+    /// Limits the paragraph repeated between the parts of an oversized section.
+    pub fn with_overlap_lines(mut self, overlap_lines: usize) -> Self {
+        self.overlap_lines = overlap_lines;
+        self
+    }
+
+    /// Keeps every chunk within this many tokens as well, see [`CodeChunker::with_token_limit`].
+    pub fn with_token_limit(mut self, token_limit: Option<TokenLimit>) -> Self {
+        self.token_limit = token_limit;
+        self
+    }
+
+    pub fn chunk(&self, filename: &str, source: &str, mtime: i64) -> Vec<CodeChunk> {
+        let lines: Vec<&str> = source.lines().collect();
+        let text = TextChunker::new(self.max_chunk_size)
+            .with_overlap_lines(self.overlap_lines)
+            .with_token_limit(self.token_limit.clone())
+            .with_fences(true);
+
+        let mut chunks = Vec::new();
+        for section in sections(&lines) {
+            let body = &lines[section.start..section.end];
+            let code = body.join("\n");
+            if code.trim().is_empty() {
+                continue;
+            }
+            let mut parts = if fits(&code, self.max_chunk_size, self.token_limit.as_ref()) {
+                vec![CodeChunk {
+                    filename: filename.to_string(),
+                    code,
+                    line_start: section.start + 1,
+                    line_end: section.end,
+                    last_modified: mtime,
+                    ..Default::default()
+                }]
+            } else {
+                text.chunk_lines(filename, body, section.start, mtime)
+            };
+            ChunkPart::label(&mut parts);
+            for mut part in parts {
+                part.symbol = section.path.clone();
+                part.language = Some("markdown".to_string());
+                chunks.push(part);
+            }
+        }
+        chunks
+    }
+}
+
+/// Splits plain-text files at blank lines.
+///
+/// Consecutive paragraphs are packed into chunks of at most the chunk size.
+/// The next chunk starts with the last paragraph of the previous one when that
+/// paragraph has at most `overlap_lines` lines, recorded in
+/// [`CodeChunk::overlap_lines`] as for line-based code chunks. A paragraph
+/// larger than the chunk size is split by lines.
+pub struct TextChunker {
+    max_chunk_size: usize,
+    overlap_lines: usize,
+    token_limit: Option<TokenLimit>,
+    /// Treat fenced code blocks as single paragraphs (Markdown)
+    fences: bool,
+}
+
+impl TextChunker {
+    pub fn new(max_chunk_size: usize) -> Self {
+        Self {
+            max_chunk_size,
+            overlap_lines: DEFAULT_OVERLAP_LINES,
+            token_limit: None,
+            fences: false,
+        }
+    }
+
+    pub fn with_overlap_lines(mut self, overlap_lines: usize) -> Self {
+        self.overlap_lines = overlap_lines;
+        self
+    }
+
+    pub fn with_token_limit(mut self, token_limit: Option<TokenLimit>) -> Self {
+        self.token_limit = token_limit;
+        self
+    }
+
+    fn with_fences(mut self, fences: bool) -> Self {
+        self.fences = fences;
+        self
+    }
+
+    pub fn chunk(&self, filename: &str, source: &str, mtime: i64) -> Vec<CodeChunk> {
+        let lines: Vec<&str> = source.lines().collect();
+        let mut chunks = self.chunk_lines(filename, &lines, 0, mtime);
+        for chunk in chunks.iter_mut() {
+            chunk.language = Some("text".to_string());
+        }
+        chunks
+    }
+
+    /// Chunks `lines`, the lines of a file starting after its first `offset` lines.
+    fn chunk_lines(
+        &self,
+        filename: &str,
+        lines: &[&str],
+        offset: usize,
+        mtime: i64,
+    ) -> Vec<CodeChunk> {
+        let paragraphs = paragraphs(lines, self.fences);
+        // Whether lines[start..end] joined by newlines fit in one chunk
+        let fit = |start: usize, end: usize| -> bool {
+            fits(
+                &lines[start..end].join("\n"),
+                self.max_chunk_size,
+                self.token_limit.as_ref(),
+            )
+        };
+        let chunk = |start: usize, end: usize, overlap: usize| CodeChunk {
+            filename: filename.to_string(),
+            code: lines[start..end].join("\n"),
+            line_start: offset + start + 1,
+            line_end: offset + end,
+            last_modified: mtime,
+            overlap_lines: overlap,
+            ..Default::default()
+        };
+
+        let mut chunks = Vec::new();
+        let mut next = 0;
+        // Paragraph repeated at the start of the next chunk
+        let mut repeat: Option<(usize, usize)> = None;
+        while next < paragraphs.len() {
+            let (first_start, first_end) = paragraphs[next];
+            if !fit(first_start, first_end) {
+                let splitter = CodeChunker::new(self.max_chunk_size, 0)
+                    .with_overlap_lines(self.overlap_lines)
+                    .with_token_limit(self.token_limit.clone());
+                let text = lines[first_start..first_end].join("\n");
+                for mut part in splitter.chunk_lines(filename, &text, mtime) {
+                    part.line_start += offset + first_start;
+                    part.line_end += offset + first_start;
+                    chunks.push(part);
+                }
+                next += 1;
+                repeat = None;
+                continue;
+            }
+
+            let start = match repeat {
+                Some((start, _)) if fit(start, first_end) => start,
+                _ => first_start,
+            };
+            let mut end = first_end;
+            let mut last = next;
+            while last + 1 < paragraphs.len() && fit(start, paragraphs[last + 1].1) {
+                last += 1;
+                end = paragraphs[last].1;
+            }
+            chunks.push(chunk(start, end, first_start - start));
+
+            let (last_start, last_end) = paragraphs[last];
+            // Never repeat a paragraph that was the whole chunk
+            let several = last > next || start < first_start;
+            repeat = (several && last_end - last_start <= self.overlap_lines)
+                .then_some((last_start, last_end));
+            next = last + 1;
+        }
+        chunks
+    }
+}
+
+/// A run of lines belonging to one heading.
+struct Section {
+    start: usize,
+    end: usize,
+    /// Titles of the enclosing H1-H3 headings joined by ` > `
+    path: Option<String>,
+}
+
+/// Cuts `lines` into sections at H1-H3 headings.
+fn sections(lines: &[&str]) -> Vec<Section> {
+    let mut sections = Vec::new();
+    let mut titles: Vec<(usize, String)> = Vec::new();
+    let mut start = 0;
+    let mut path = None;
+    let mut fence: Option<char> = None;
+
+    let mut i = 0;
+    while i < lines.len() {
+        let line = lines[i];
+        if let Some(marker) = fence_marker(line) {
+            match fence {
+                None => fence = Some(marker),
+                Some(open) if open == marker => fence = None,
+                Some(_) => {}
+            }
+            i += 1;
+            continue;
+        }
+        if fence.is_some() {
+            i += 1;
+            continue;
+        }
+
+        let heading = atx_heading(line)
+            .map(|(level, title)| (level, title, 1))
+            .or_else(|| {
+                let previous_blank = i == 0 || lines[i - 1].trim().is_empty();
+                let level = lines.get(i + 1).and_then(|next| setext_level(next))?;
+                (previous_blank && !line.trim().is_empty())
+                    .then(|| (level, line.trim().to_string(), 2))
+            });
+        let Some((level, title, height)) = heading else {
+            i += 1;
+            continue;
+        };
+        if level > 3 {
+            i += height;
+            continue;
+        }
+
+        if i > start {
+            sections.push(Section {
+                start,
+                end: i,
+                path: path.take(),
+            });
+        }
+        titles.retain(|(l, _)| *l < level);
+        titles.push((level, title));
+        let names: Vec<&str> = titles.iter().map(|(_, t)| t.as_str()).collect();
+        path = Some(names.join(" > "));
+        start = i;
+        i += height;
+    }
+    if start < lines.len() {
+        sections.push(Section {
+            start,
+            end: lines.len(),
+            path,
+        });
+    }
+    sections
+}
+
+/// Level and title of an ATX heading such as `## Title ##`.
+fn atx_heading(line: &str) -> Option<(usize, String)> {
+    let trimmed = line.trim_start();
+    if line.len() - trimmed.len() > 3 {
+        return None;
+    }
+    let level = trimmed.len() - trimmed.trim_start_matches('#').len();
+    if !(1..=6).contains(&level) {
+        return None;
+    }
+    let rest = &trimmed[level..];
+    if !rest.is_empty() && !rest.starts_with([' ', '\t']) {
+        return None;
+    }
+    let title = rest.trim().trim_end_matches('#').trim_end();
+    Some((level, title.to_string()))
+}
+
+/// Level of a setext underline: 1 for `===`, 2 for `---`.
+fn setext_level(line: &str) -> Option<usize> {
+    let trimmed = line.trim();
+    if line.len() - line.trim_start().len() > 3 || trimmed.is_empty() {
+        return None;
+    }
+    if trimmed.chars().all(|c| c == '=') {
+        Some(1)
+    } else if trimmed.chars().all(|c| c == '-') {
+        Some(2)
+    } else {
+        None
+    }
+}
+
+/// The fence character if `line` opens or closes a fenced code block.
+fn fence_marker(line: &str) -> Option<char> {
+    let trimmed = line.trim_start();
+    ['`', '~']
+        .into_iter()
+        .find(|&c| trimmed.starts_with(&String::from(c).repeat(3)))
+}
+
+/// `(start, end)` line ranges of the blank-line separated paragraphs of
+/// `lines`. With `fences`, blank lines inside fenced code blocks don't end a paragraph.
+fn paragraphs(lines: &[&str], fences: bool) -> Vec<(usize, usize)> {
+    let mut paragraphs = Vec::new();
+    let mut start = None;
+    let mut fence: Option<char> = None;
+    for (i, line) in lines.iter().enumerate() {
+        if fences {
+            if let Some(marker) = fence_marker(line) {
+                match fence {
+                    None => fence = Some(marker),
+                    Some(open) if open == marker => fence = None,
+                    Some(_) => {}
+                }
+            }
+        }
+        if line.trim().is_empty() && fence.is_none() {
+            if let Some(s) = start.take() {
+                paragraphs.push((s, i));
+            }
+        } else if start.is_none() {
+            start = Some(i);
+        }
+    }
+    if let Some(s) = start {
+        paragraphs.push((s, lines.len()));
+    }
+    paragraphs
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_markdown_sections_keep_heading_path() {
+        let source = "Intro line.\n\
+                      \n\
+                      # Design\n\
+                      \n\
+                      Overview.\n\
+                      \n\
+                      ## Authentication\n\
+                      \n\
+                      Tokens expire after an hour.\n\
+                      \n\
+                      ```sh\n\
+                      # not a heading\n\
+                      ```\n\
+                      \n\
+                      #### Details\n\
+                      \n\
+                      Still part of Authentication.\n\
+                      \n\
+                      Storage\n\
+                      -------\n\
+                      \n\
+                      SQLite.\n";
+        let chunks = MarkdownChunker::new(1024).chunk("docs/design.md", source, 0);
+        let sections: Vec<(Option<&str>, usize, usize)> = chunks
+            .iter()
+            .map(|c| (c.symbol.as_deref(), c.line_start, c.line_end))
+            .collect();
+        assert_eq!(
+            sections,
+            vec![
+                (None, 1, 2),
+                (Some("Design"), 3, 6),
+                (Some("Design > Authentication"), 7, 18),
+                (Some("Design > Storage"), 19, 22),
+            ]
+        );
+        assert!(chunks[2].code.contains("# not a heading"));
+        assert!(chunks[2].code.contains("Still part of Authentication."));
+        assert!(chunks
+            .iter()
+            .all(|c| c.language.as_deref() == Some("markdown")));
+    }
+
+    #[test]
+    fn test_oversized_section_splits_at_paragraphs() {
+        let source = "## Auth\n\nfirst paragraph\n\nsecond paragraph\n\nthird paragraph\n";
+        let chunks = MarkdownChunker::new(40).chunk("auth.md", source, 0);
+        assert!(chunks.len() > 1);
+        assert!(chunks
+            .iter()
+            .all(|c| c.symbol.as_deref() == Some("Auth") && c.code.len() <= 40));
+        assert_eq!(
+            chunks[1].part.map(|p| p.to_string()),
+            Some(format!("part 2/{}", chunks.len()))
+        );
+        // Each part after the first repeats the last paragraph of the previous one
+        assert_eq!(chunks[1].line_start, 3);
+        assert_eq!(chunks[1].overlap_lines, 2);
+    }
+
+    #[test]
+    fn test_text_paragraphs_with_overlap() {
+        let source = "one\n\ntwo\n\nthree\n\nfour";
+        let chunks = TextChunker::new(12).chunk("notes.txt", source, 0);
+        let ranges: Vec<(usize, usize, usize)> = chunks
+            .iter()
+            .map(|c| (c.line_start, c.line_end, c.overlap_lines))
+            .collect();
+        // "one\n\ntwo" fits; the next chunk repeats "two"
+        assert_eq!(ranges, vec![(1, 3, 0), (3, 5, 2), (5, 7, 2)]);
+        assert_eq!(chunks[1].code, "two\n\nthree");
+        assert!(chunks.iter().all(|c| c.language.as_deref() == Some("text")));
+
+        let long = "x".repeat(30);
+        let chunks = TextChunker::new(12).chunk("notes.txt", &long, 0);
+        assert_eq!(chunks.len(), 1);
+        assert_eq!((chunks[0].line_start, chunks[0].line_end), (1, 1));
+    }
+}
@@ -0,0 +1,308 @@
+use anyhow::Result;
+use std::collections::HashMap;
+use std::io::Cursor;
+use std::sync::{Arc, OnceLock, RwLock};
+
+use super::{CodeChunk, CodeChunker, GoSymbolChunker, MarkdownChunker, TextChunker};
+
+/// Splits the content of one kind of file into chunks.
+///
+/// Implement it to index a format code-rag doesn't know, or to chunk a known
+/// one differently, and register it with [`register_chunker`]. The built-in
+/// chunkers implement it too and are registered for their extensions, so a
+/// custom chunker can delegate to one of them, e.g. to chunk a template by
+/// the language it embeds.
+///
+/// `path` is the file's normalized path and `content` its raw bytes. The
+/// returned chunks need `code` and their 1-indexed `line_start` and
+/// `line_end`; `symbol`, `language` and `calls` are optional. Their
+/// `filename`, `last_modified`, `is_test` and `collection` are set by
+/// [`CodeChunker::chunk_file`],
+/// which also tells duplicates apart, see [`assign_occurrences`](super::assign_occurrences).
+/// On an error the file is chunked by lines instead, with a warning.
+///
+/// The guards of the built-in chunkers apply: binary files never reach a
+/// chunker, and a chunk over the chunk size or token limit is split into
+/// labeled parts, like an oversized declaration.
+pub trait Chunker: Send + Sync {
+    fn chunk(&self, path: &str, content: &[u8]) -> Result<Vec<CodeChunk>>;
+}
+
+/// Extensions of the built-in chunkers, registered before any other: the
+/// tree-sitter languages (symbol chunks for Go), Markdown and plain text.
+const BUILTIN_EXTENSIONS: &[&str] = &[
+    "rs", "py", "go", "c", "h", "cpp", "hpp", "cc", "cxx", "js", "jsx", "ts", "tsx", "java", "cs",
+    "rb", "php", "html", "css", "sh", "bash", "ps1", "yaml", "yml", "json", "zig", "ex", "exs",
+    "hs", "sol", "md", "markdown", "txt", "text", "rst",
+];
+
+/// What is registered for an extension.
+#[derive(Clone)]
+pub(super) enum Registered {
+    /// The built-in chunkers, run with the settings of the [`CodeChunker`]
+    /// chunking the file
+    Builtin,
+    Custom(Arc<dyn Chunker>),
+}
+
+type Registry = RwLock<HashMap<String, Registered>>;
+
+fn registry() -> &'static Registry {
+    static REGISTRY: OnceLock<Registry> = OnceLock::new();
+    REGISTRY.get_or_init(|| {
+        let builtins = BUILTIN_EXTENSIONS
+            .iter()
+            .map(|extension| (extension.to_string(), Registered::Builtin));
+        RwLock::new(builtins.collect())
+    })
+}
+
+/// What is registered for `extension`; `None` for files chunked by lines.
+pub(super) fn lookup(extension: &str) -> Option<Registered> {
+    registry()
+        .read()
+        .ok()?
+        .get(extension.trim_start_matches('.'))
+        .cloned()
+}
+
+/// Uses `chunker` for every file with `extension` (e.g. `"tmpl"`, a leading
+/// dot is ignored) chunked in this process, from then on.
+///
+/// Registered extensions are indexed like the built-in ones, and a chunker
+/// registered for an extension code-rag already handles replaces the
+/// built-in chunker, as a later registration replaces an earlier one.
+///
+/// # Examples
+///
+/// ```no_run
+/// use code_rag::indexer::{register_chunker, Chunker, CodeChunk};
+///
+/// /// Indexes each template as one chunk.
+/// struct TemplateChunker;
+///
+/// impl Chunker for TemplateChunker {
+///     fn chunk(&self, _path: &str, content: &[u8]) -> anyhow::Result<Vec<CodeChunk>> {
+///         let text = String::from_utf8(content.to_vec())?;
+///         Ok(vec![CodeChunk {
+///             code: text.clone(),
+///             line_start: 1,
+///             line_end: text.lines().count(),
+///             ..Default::default()
+///         }])
+///     }
+/// }
+///
+/// register_chunker("tmpl", TemplateChunker);
+/// ```
+pub fn register_chunker(extension: &str, chunker: impl Chunker + 'static) {
+    let extension = extension.trim_start_matches('.').to_string();
+    match registry().write() {
+        Ok(mut chunkers) => {
+            chunkers.insert(extension, Registered::Custom(Arc::new(chunker)));
+        }
+        Err(_) => tracing::error!(
+            "Chunker registry lock poisoned; {} not registered",
+            extension
+        ),
+    }
+}
+
+/// The chunker registered for `extension`: one given to [`register_chunker`],
+/// or the built-in one with default settings. `None` for extensions nothing
+/// handles, whose files are chunked by lines.
+pub fn registered_chunker(extension: &str) -> Option<Arc<dyn Chunker>> {
+    match lookup(extension)? {
+        Registered::Builtin => Some(Arc::new(CodeChunker::default())),
+        Registered::Custom(chunker) => Some(chunker),
+    }
+}
+
+/// Chunks with the built-in chunker for the file's extension, ignoring
+/// registered chunkers, so a registered chunker can delegate to it.
+impl Chunker for CodeChunker {
+    fn chunk(&self, path: &str, content: &[u8]) -> Result<Vec<CodeChunk>> {
+        Ok(self.chunk_builtin(path, &mut Cursor::new(content), 0)?)
+    }
+}
+
+impl Chunker for GoSymbolChunker {
+    fn chunk(&self, path: &str, content: &[u8]) -> Result<Vec<CodeChunk>> {
+        Ok(GoSymbolChunker::chunk(
+            self,
+            path,
+            &String::from_utf8_lossy(content),
+            0,
+        ))
+    }
+}
+
+impl Chunker for MarkdownChunker {
+    fn chunk(&self, path: &str, content: &[u8]) -> Result<Vec<CodeChunk>> {
+        Ok(MarkdownChunker::chunk(
+            self,
+            path,
+            &String::from_utf8_lossy(content),
+            0,
+        ))
+    }
+}
+
+impl Chunker for TextChunker {
+    fn chunk(&self, path: &str, content: &[u8]) -> Result<Vec<CodeChunk>> {
+        Ok(TextChunker::chunk(
+            self,
+            path,
+            &String::from_utf8_lossy(content),
+            0,
+        ))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use anyhow::bail;
+
+    /// Chunks a made-up template language: one chunk per `@block name` ...
+    /// `@end` section, with the embedded Go code chunked by the Go chunker.
+    struct BlockChunker;
+
+    impl Chunker for BlockChunker {
+        fn chunk(&self, path: &str, content: &[u8]) -> Result<Vec<CodeChunk>> {
+            let text = std::str::from_utf8(content)?;
+            let mut chunks = Vec::new();
+            let mut open: Option<(String, usize)> = None;
+            for (row, line) in text.lines().enumerate() {
+                if let Some(name) = line.strip_prefix("@block ") {
+                    open = Some((name.trim().to_string(), row));
+                } else if line == "@end" {
+                    let Some((name, start)) = open.take() else {
+                        bail!("@end without @block at line {}", row + 1);
+                    };
+                    let body: Vec<&str> =
+                        text.lines().skip(start + 1).take(row - start - 1).collect();
+                    chunks.push(CodeChunk {
+                        code: body.join("\n"),
+                        line_start: start + 2,
+                        line_end: row,
+                        symbol: Some(format!("{}.{}", path, name)),
+                        language: Some("blocks".to_string()),
+                        ..Default::default()
+                    });
+                }
+            }
+            if text.contains("@go") {
+                let go = GoSymbolChunker::new(1024, 0);
+                let source = text.replace("@go", "package tmpl");
+                chunks.extend(Chunker::chunk(&go, path, source.as_bytes())?);
+            }
+            Ok(chunks)
+        }
+    }
+
+    #[test]
+    fn test_registered_chunker_is_used() {
+        assert!(!CodeChunker::is_supported("blocks"));
+        register_chunker(".blocks", BlockChunker);
+        assert!(CodeChunker::is_supported("blocks"));
+        assert!(registered_chunker("blocks").is_some());
+
+        let source = "@block header\n<h1>Title</h1>\n@end\n@block footer\n<p>Bye</p>\n@end\n";
+        let chunks = CodeChunker::default()
+            .chunk_file("web\\page.blocks", &mut Cursor::new(source), 42)
+            .unwrap();
+        assert_eq!(chunks.len(), 2);
+        assert_eq!(chunks[0].code, "<h1>Title</h1>");
+        assert_eq!((chunks[0].line_start, chunks[0].line_end), (2, 2));
+        assert_eq!(chunks[1].symbol.as_deref(), Some("web/page.blocks.footer"));
+        // Set for the chunker whatever it returned
+        assert!(chunks
+            .iter()
+            .all(|c| c.filename == "web/page.blocks" && c.last_modified == 42));
+
+        // A chunker error falls back to line chunks
+        let chunker = CodeChunker::default();
+        let chunks = chunker
+            .chunk_file("bad.blocks", &mut Cursor::new("@end\n"), 0)
+            .unwrap();
+        assert_eq!(chunks.len(), 1);
+        assert_eq!(chunks[0].code, "@end");
+        assert_eq!(chunker.fallbacks(), 1);
+    }
+
+    /// Returns the whole file as one chunk, however large.
+    struct WholeFileChunker;
+
+    impl Chunker for WholeFileChunker {
+        fn chunk(&self, _path: &str, content: &[u8]) -> Result<Vec<CodeChunk>> {
+            let text = String::from_utf8_lossy(content).to_string();
+            Ok(vec![CodeChunk {
+                line_start: 1,
+                line_end: text.lines().count(),
+                code: text,
+                symbol: Some("whole".to_string()),
+                ..Default::default()
+            }])
+        }
+    }
+
+    #[test]
+    fn test_registered_chunker_guards() {
+        register_chunker("whole", WholeFileChunker);
+        let chunker = CodeChunker::new(40, 0);
+
+        let source: String = (1..=6).map(|i| format!("line number {}\n", i)).collect();
+        let chunks = chunker
+            .chunk_file("big.whole", &mut Cursor::new(source), 0)
+            .unwrap();
+        assert!(chunks.len() > 1);
+        assert!(chunks.iter().all(|c| c.code.len() <= 40));
+        assert_eq!(chunks[0].line_start, 1);
+        assert_eq!(chunks.last().unwrap().line_end, 6);
+        assert!(chunks
+            .iter()
+            .all(|c| c.symbol.as_deref() == Some("whole") && c.part.is_some()));
+
+        let binary = b"\x7fELF\x02\x01\x01\x00".to_vec();
+        let chunks = chunker
+            .chunk_file("lib.whole", &mut Cursor::new(binary), 0)
+            .unwrap();
+        assert!(chunks.is_empty());
+    }
+
+    #[test]
+    fn test_builtins_are_registered() {
+        for extension in BUILTIN_EXTENSIONS {
+            assert!(
+                CodeChunker::language_name(extension).is_some(),
+                "{}",
+                extension
+            );
+            assert!(CodeChunker::is_supported(extension));
+        }
+        let go = registered_chunker("go").unwrap();
+        let chunks = go
+            .chunk("main.go", b"package main\n\nfunc Run() {}\n")
+            .unwrap();
+        assert_eq!(chunks[0].symbol.as_deref(), Some("main.Run"));
+        assert!(registered_chunker("unknownext").is_none());
+    }
+
+    #[test]
+    fn test_registered_chunker_can_delegate() {
+        register_chunker("goblocks", BlockChunker);
+        let source = "@go\n\nfunc Render() {}\n";
+        let chunks = CodeChunker::default()
+            .chunk_file("view.goblocks", &mut Cursor::new(source), 0)
+            .unwrap();
+        assert_eq!(chunks.len(), 1);
+        assert_eq!(chunks[0].symbol.as_deref(), Some("tmpl.Render"));
+        assert_eq!(chunks[0].language.as_deref(), Some("go"));
+
+        // The built-in chunkers through the trait
+        let chunker = CodeChunker::default();
+        let chunks = Chunker::chunk(&chunker, "notes.md", b"# Notes\n\nHello.\n").unwrap();
+        assert_eq!(chunks[0].symbol.as_deref(), Some("Notes"));
+    }
+}
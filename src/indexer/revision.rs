@@ -0,0 +1,127 @@
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+use std::process::Command;
+use std::sync::{Mutex, OnceLock};
+
+/// Splits a file name that looks like `<revision>:<path>` into its two
+/// parts, without asking git whether the revision exists. Only good for
+/// matching globs against the in-tree path too; `revision_path` is the check.
+pub(crate) fn split_revision(filename: &str) -> Option<(&str, &str)> {
+    let (revision, path) = filename.split_once(':')?;
+    // A single letter is a Windows drive, and a leading '-' would be read as
+    // an option by git
+    if revision.len() < 2 || revision.starts_with('-') || path.is_empty() {
+        return None;
+    }
+    Some((revision, path))
+}
+
+/// Splits a file name `index --rev` gave a file of a git revision,
+/// `<revision>:<path>`, into its two parts; `None` for working tree files,
+/// including ones with a ':' in their name whose prefix git doesn't resolve
+/// to a commit.
+///
+/// ```
+/// use code_rag::indexer::revision_path;
+///
+/// assert_eq!(revision_path("src/auth.rs"), None);
+/// assert_eq!(revision_path(r"C:\src\auth.rs"), None);
+/// assert_eq!(revision_path("meeting notes:todo.md"), None);
+/// ```
+pub fn revision_path(filename: &str) -> Option<(&str, &str)> {
+    let (revision, path) = split_revision(filename)?;
+    resolves(&git_dir(Path::new(path)), revision).then_some((revision, path))
+}
+
+/// Directory git runs in for `path`: its parent, or the working directory.
+fn git_dir(path: &Path) -> PathBuf {
+    path.parent()
+        .filter(|p| !p.as_os_str().is_empty())
+        .unwrap_or(Path::new("."))
+        .to_path_buf()
+}
+
+/// Whether `revision` names a commit in the repository containing `dir`.
+/// Remembered, since filters and tags ask for every chunk of a file.
+fn resolves(dir: &Path, revision: &str) -> bool {
+    static RESOLVED: OnceLock<Mutex<HashMap<(PathBuf, String), bool>>> = OnceLock::new();
+    let key = (dir.to_path_buf(), revision.to_string());
+    let cache = RESOLVED.get_or_init(Default::default);
+    if let Some(&known) = cache.lock().unwrap().get(&key) {
+        return known;
+    }
+    let known = Command::new("git")
+        .args(["rev-parse", "--verify", "--quiet"])
+        .arg(format!("{}^{{commit}}", revision))
+        .current_dir(dir)
+        .output()
+        .is_ok_and(|output| output.status.success());
+    cache.lock().unwrap().insert(key, known);
+    known
+}
+
+/// Contents of a `<revision>:<path>` file, read with `git show`; `None` when
+/// git can't find it. The path is resolved like the names of files read from
+/// disk, relative to the working directory unless absolute.
+pub fn read_revision_file(filename: &str) -> Option<Vec<u8>> {
+    let (revision, path) = revision_path(filename)?;
+    let path = Path::new(path);
+    let dir = git_dir(path);
+    // `<revision>:./<name>` is relative to git's working directory rather
+    // than the repository root
+    let output = Command::new("git")
+        .arg("show")
+        .arg(format!(
+            "{}:./{}",
+            revision,
+            path.file_name()?.to_string_lossy()
+        ))
+        .current_dir(dir)
+        .output()
+        .ok()?;
+    output.status.success().then_some(output.stdout)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+
+    fn run_git(dir: &Path, args: &[&str]) {
+        let status = Command::new("git")
+            .args(["-c", "user.name=Test", "-c", "user.email=test@example.com"])
+            .args(args)
+            .current_dir(dir)
+            .output()
+            .unwrap()
+            .status;
+        assert!(status.success(), "git {:?}", args);
+    }
+
+    #[test]
+    fn test_revision_path_needs_a_commit() {
+        if Command::new("git").arg("--version").output().is_err() {
+            return;
+        }
+        let repo = tempfile::tempdir().unwrap();
+        let root = repo.path();
+        fs::create_dir_all(root.join("src")).unwrap();
+        fs::write(root.join("src/auth.rs"), "fn login() {}\n").unwrap();
+        run_git(root, &["init", "-q"]);
+        run_git(root, &["add", "-A"]);
+        run_git(root, &["commit", "-q", "-m", "First"]);
+        run_git(root, &["tag", "v1.2"]);
+
+        let tagged = format!("v1.2:{}", root.join("src/auth.rs").display());
+        let (revision, path) = revision_path(&tagged).unwrap();
+        assert_eq!(revision, "v1.2");
+        assert_eq!(read_revision_file(&tagged).unwrap(), b"fn login() {}\n");
+        assert_eq!(Path::new(path), root.join("src/auth.rs"));
+
+        // Looks like a revision but isn't one
+        let notes = format!("notes:{}", root.join("src/auth.rs").display());
+        assert_eq!(revision_path(&notes), None);
+        assert_eq!(split_revision(&notes).unwrap().0, "notes");
+        assert_eq!(read_revision_file(&notes), None);
+    }
+}
@@ -0,0 +1,254 @@
+use anyhow::{bail, Context, Result};
+use globset::{GlobBuilder, GlobSet, GlobSetBuilder};
+use regex::Regex;
+use std::collections::BTreeSet;
+use std::path::Path;
+use std::sync::OnceLock;
+
+use super::{split_revision, CodeChunk};
+
+/// File at the index root assigning tags to the files matching a glob, one
+/// rule per line: `internal/auth/** security-sensitive`.
+pub const RAGTAGS_FILE: &str = ".ragtags";
+
+/// Whether `tag` can be attached to chunks: letters, digits, `_`, `-` and
+/// `.`, already lowercase.
+pub fn is_valid_tag(tag: &str) -> bool {
+    !tag.is_empty()
+        && tag
+            .chars()
+            .all(|c| c.is_ascii_lowercase() || c.is_ascii_digit() || matches!(c, '_' | '-' | '.'))
+}
+
+/// The tags of a list like `security, legacy` or `security legacy`, lowercased.
+fn split_tags(text: &str) -> impl Iterator<Item = String> + '_ {
+    text.split(|c: char| c == ',' || c.is_whitespace())
+        .filter(|t| !t.is_empty())
+        .map(str::to_lowercase)
+}
+
+/// `rag:tag` after a comment marker, with the tags up to the end of the line
+/// or of the comment.
+fn marker() -> &'static Regex {
+    static MARKER: OnceLock<Regex> = OnceLock::new();
+    MARKER.get_or_init(|| {
+        Regex::new(r"^\s*(?://+|#+|--|/\*+|\*|;+|<!--)\s*rag:tags?\s+(.*?)\s*(?:\*/|-->)?\s*$")
+            .expect("tag marker pattern is valid")
+    })
+}
+
+/// Tags of the `rag:tag` comments in `source`, by 1-based line: `// rag:tag
+/// security`, `# rag:tag legacy, billing`, `/* rag:tag payments */`. Words that
+/// aren't valid tags are left out.
+pub fn inline_tags(source: &str) -> Vec<(usize, Vec<String>)> {
+    source
+        .lines()
+        .enumerate()
+        .filter(|(_, line)| line.contains("rag:tag"))
+        .filter_map(|(i, line)| {
+            let list = marker().captures(line)?.get(1)?.as_str();
+            let tags: Vec<String> = split_tags(list).filter(|t| is_valid_tag(t)).collect();
+            (!tags.is_empty()).then_some((i + 1, tags))
+        })
+        .collect()
+}
+
+/// User tags for chunks, from `.ragtags` globs and `rag:tag` comments, so
+/// searches can be narrowed to tagged code or favor it (see
+/// [`CandidateFilter::with_tags`](crate::search::CandidateFilter::with_tags)).
+///
+/// A glob follows the conventions of `test_patterns`: it may match from any
+/// path component, so `auth/**` also covers `services/auth/login.go`. Its
+/// tags go to every chunk of the matching files.
+///
+/// A `rag:tag` comment tags the chunk holding it, or, outside every chunk as
+/// above a declaration the chunker left its comments out of, the chunk that
+/// starts next.
+#[derive(Debug, Clone, Default)]
+pub struct TagRules {
+    globs: GlobSet,
+    /// Tags of each glob of `globs`, by index
+    tags: Vec<Vec<String>>,
+}
+
+impl TagRules {
+    /// Rules of `.ragtags` under `root`; none if there is no such file.
+    pub fn load(root: &Path) -> Result<Self> {
+        let path = root.join(RAGTAGS_FILE);
+        if !path.is_file() {
+            return Ok(Self::default());
+        }
+        let text = std::fs::read_to_string(&path)
+            .with_context(|| format!("Failed to read {}", path.display()))?;
+        Self::parse(&text).with_context(|| format!("Invalid {}", path.display()))
+    }
+
+    /// Rules in `.ragtags` syntax: a glob and its tags per line, separated by
+    /// spaces or commas. Blank lines and lines starting with `#` are skipped.
+    pub fn parse(text: &str) -> Result<Self> {
+        let mut builder = GlobSetBuilder::new();
+        let mut tags = Vec::new();
+        for (i, line) in text.lines().enumerate() {
+            let line = line.trim();
+            if line.is_empty() || line.starts_with('#') {
+                continue;
+            }
+            let (pattern, list) = line.split_once(char::is_whitespace).unwrap_or((line, ""));
+            let line_tags: Vec<String> = split_tags(list).collect();
+            if line_tags.is_empty() {
+                bail!("line {}: '{}' has no tags", i + 1, pattern);
+            }
+            if let Some(bad) = line_tags.iter().find(|t| !is_valid_tag(t)) {
+                bail!(
+                    "line {}: invalid tag '{}' (use letters, digits, '_', '-' and '.')",
+                    i + 1,
+                    bad
+                );
+            }
+            builder.add(
+                GlobBuilder::new(pattern.trim_start_matches("./"))
+                    .literal_separator(true)
+                    .build()
+                    .with_context(|| format!("line {}: invalid glob '{}'", i + 1, pattern))?,
+            );
+            tags.push(line_tags);
+        }
+        Ok(Self {
+            globs: builder.build()?,
+            tags,
+        })
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.tags.is_empty()
+    }
+
+    /// Tags the globs give the file `path`, sorted.
+    pub fn path_tags(&self, path: &str) -> Vec<String> {
+        if self.is_empty() {
+            return Vec::new();
+        }
+        let path = path.replace('\\', "/");
+        // A name from `index --rev` matches by its in-tree path, and the
+        // whole name is tried too in case the ':' is part of a file name
+        let paths = std::iter::once(path.as_str())
+            .chain(split_revision(&path).map(|(_, in_tree)| in_tree))
+            .map(|path| path.strip_prefix("./").unwrap_or(path));
+        let matched: BTreeSet<&String> = paths
+            .flat_map(|path| {
+                std::iter::once(path).chain(path.match_indices('/').map(|(i, _)| &path[i + 1..]))
+            })
+            .flat_map(|suffix| self.globs.matches(suffix))
+            .flat_map(|rule| &self.tags[rule])
+            .collect();
+        matched.into_iter().cloned().collect()
+    }
+
+    /// Sets `tags` on the chunks of one file, read from `source`.
+    pub fn apply(&self, chunks: &mut [CodeChunk], source: &str) {
+        let Some(first) = chunks.first() else {
+            return;
+        };
+        let path_tags = self.path_tags(&first.filename);
+        let mut tags: Vec<BTreeSet<String>> = vec![path_tags.into_iter().collect(); chunks.len()];
+        for (line, marked) in inline_tags(source) {
+            let holding: Vec<usize> = (0..chunks.len())
+                .filter(|&i| chunks[i].line_start <= line && line <= chunks[i].line_end)
+                .collect();
+            let targets = if holding.is_empty() {
+                let next = chunks
+                    .iter()
+                    .map(|c| c.line_start)
+                    .filter(|&start| start > line)
+                    .min();
+                (0..chunks.len())
+                    .filter(|&i| Some(chunks[i].line_start) == next)
+                    .collect()
+            } else {
+                holding
+            };
+            for i in targets {
+                tags[i].extend(marked.iter().cloned());
+            }
+        }
+        for (chunk, tags) in chunks.iter_mut().zip(tags) {
+            chunk.tags = tags.into_iter().collect();
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn chunk(line_start: usize, line_end: usize) -> CodeChunk {
+        CodeChunk {
+            filename: "./repo/internal/auth/login.go".to_string(),
+            line_start,
+            line_end,
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_parse_ragtags() {
+        let rules = TagRules::parse(
+            "# Teams\n\
+             internal/auth/** security-sensitive\n\
+             \n\
+             *.go  Go, backend\n\
+             legacy/**\tlegacy deprecated\n",
+        )
+        .unwrap();
+        assert_eq!(
+            rules.path_tags("./repo/internal/auth/login.go"),
+            vec!["backend", "go", "security-sensitive"]
+        );
+        assert_eq!(
+            rules.path_tags("v1.2:legacy/billing.py"),
+            vec!["deprecated", "legacy"]
+        );
+        assert!(rules.path_tags("web/app.ts").is_empty());
+        assert!(TagRules::default().path_tags("a.go").is_empty());
+
+        assert!(TagRules::parse("internal/**\n").is_err());
+        assert!(TagRules::parse("internal/** has'quote\n").is_err());
+        assert!(TagRules::parse("a/[b legacy\n").is_err());
+    }
+
+    #[test]
+    fn test_inline_tags() {
+        let source = "package auth\n\
+                      // rag:tag security\n\
+                      func Login() {}\n\
+                      x := \"rag:tag nope\"\n\
+                      # rag:tag legacy, billing\n\
+                      /* rag:tags payments */\n\
+                      -- rag:tag Fr@ud ok\n";
+        assert_eq!(
+            inline_tags(source),
+            vec![
+                (2, vec!["security".to_string()]),
+                (5, vec!["legacy".to_string(), "billing".to_string()]),
+                (6, vec!["payments".to_string()]),
+                (7, vec!["ok".to_string()]),
+            ]
+        );
+    }
+
+    #[test]
+    fn test_apply() {
+        let rules = TagRules::parse("auth/** security\n").unwrap();
+        let source = "package auth\n\
+                      \n\
+                      // rag:tag legacy\n\
+                      func Old() {\n\
+                      \t// rag:tag hot-path\n\
+                      }\n\
+                      func New() {}\n";
+        let mut chunks = vec![chunk(4, 6), chunk(7, 7)];
+        rules.apply(&mut chunks, source);
+        assert_eq!(chunks[0].tags, vec!["hot-path", "legacy", "security"]);
+        assert_eq!(chunks[1].tags, vec!["security"]);
+    }
+}
@@ -0,0 +1,202 @@
+use anyhow::{Context, Result};
+use globset::{GlobBuilder, GlobSet, GlobSetBuilder};
+
+use super::CodeChunk;
+
+/// Globs of test files per language convention, used unless `test_patterns`
+/// is set. Like search path globs they may match from any path component, so
+/// `tests/**` covers `crates/core/tests/parse.rs`.
+pub const DEFAULT_TEST_PATTERNS: &[&str] = &[
+    // Go
+    "*_test.go",
+    "testdata/**",
+    // Python
+    "test_*.py",
+    "*_test.py",
+    "conftest.py",
+    // JavaScript and TypeScript
+    "*.test.*",
+    "*.spec.*",
+    "__tests__/**",
+    // Java, Kotlin, C# and PHP
+    "*Test.java",
+    "*Tests.java",
+    "*Test.kt",
+    "*Tests.cs",
+    "*Test.php",
+    // Ruby and Elixir
+    "*_spec.rb",
+    "*_test.rb",
+    "*_test.exs",
+    // C and C++
+    "*_test.c",
+    "*_test.cc",
+    "*_test.cpp",
+    "*_unittest.cc",
+    // Test directories of any language, e.g. Rust integration tests or src/test/java
+    "test/**",
+    "tests/**",
+    "spec/**",
+];
+
+/// Tells test code from the code under test, so searches can leave tests out
+/// or look at nothing else (see [`CandidateFilter::with_tests`](crate::search::CandidateFilter::with_tests)).
+///
+/// A chunk is a test when its file matches one of the patterns, or when it is
+/// a Go function named like the `go test` entry points (`TestXxx`,
+/// `BenchmarkXxx`, `FuzzXxx`, `ExampleXxx`) wherever it is declared.
+#[derive(Debug, Clone)]
+pub struct TestClassifier {
+    patterns: GlobSet,
+}
+
+impl Default for TestClassifier {
+    fn default() -> Self {
+        Self::new(DEFAULT_TEST_PATTERNS).expect("built-in test patterns are valid")
+    }
+}
+
+impl TestClassifier {
+    /// Classifier recognizing test files by `patterns` instead of
+    /// [`DEFAULT_TEST_PATTERNS`].
+    pub fn new<S: AsRef<str>>(patterns: &[S]) -> Result<Self> {
+        let mut builder = GlobSetBuilder::new();
+        for pattern in patterns {
+            let pattern = pattern.as_ref();
+            builder.add(
+                GlobBuilder::new(pattern.trim_start_matches("./"))
+                    .literal_separator(true)
+                    .build()
+                    .with_context(|| format!("Invalid test pattern '{}'", pattern))?,
+            );
+        }
+        Ok(Self {
+            patterns: builder.build()?,
+        })
+    }
+
+    /// Classifier with the `test_patterns` of `config`, the built-in ones if unset.
+    pub fn from_config(config: &crate::config::AppConfig) -> Result<Self> {
+        if config.test_patterns.is_empty() {
+            Ok(Self::default())
+        } else {
+            Self::new(&config.test_patterns)
+        }
+    }
+
+    /// Whether `path` is a test file.
+    pub fn is_test_file(&self, path: &str) -> bool {
+        let path = path.replace('\\', "/");
+        let path = path.strip_prefix("./").unwrap_or(&path);
+        std::iter::once(path)
+            .chain(path.match_indices('/').map(|(i, _)| &path[i + 1..]))
+            .any(|suffix| self.patterns.is_match(suffix))
+    }
+
+    /// Whether a chunk of `path` declaring `symbol` in `language` is a test.
+    pub fn is_test(&self, path: &str, symbol: Option<&str>, language: Option<&str>) -> bool {
+        self.is_test_file(path)
+            || (language == Some("go") && symbol.is_some_and(is_go_test_function))
+    }
+
+    /// Sets `is_test` on chunks of one file.
+    pub fn classify(&self, chunks: &mut [CodeChunk]) {
+        for chunk in chunks {
+            chunk.is_test = self.is_test(
+                &chunk.filename,
+                chunk.symbol.as_deref(),
+                chunk.language.as_deref(),
+            );
+        }
+    }
+}
+
+/// Whether the Go symbol ID `symbol` is a function `go test` would run:
+/// `pkg.TestXxx` and its `Benchmark`, `Fuzz` and `Example` siblings, where
+/// `Xxx` doesn't start with a lowercase letter. Methods (`pkg.Type.Method`)
+/// never are.
+fn is_go_test_function(symbol: &str) -> bool {
+    let Some((_, name)) = symbol.split_once('.') else {
+        return false;
+    };
+    if name.contains('.') {
+        return false;
+    }
+    ["Test", "Benchmark", "Fuzz", "Example"]
+        .iter()
+        .any(|prefix| {
+            name.strip_prefix(prefix)
+                .is_some_and(|rest| !rest.starts_with(|c: char| c.is_lowercase()))
+        })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_default_patterns() {
+        let classifier = TestClassifier::default();
+        for path in [
+            "./internal/auth/service_test.go",
+            "src\\app\\login.test.tsx",
+            "web/__tests__/cart.js",
+            "pkg/api/test_handlers.py",
+            "crates/core/tests/parse.rs",
+            "src/test/java/com/acme/ServiceTest.java",
+            "spec/models/user_spec.rb",
+        ] {
+            assert!(classifier.is_test_file(path), "{}", path);
+        }
+        for path in [
+            "internal/auth/service.go",
+            "src/attestation.py",
+            "contest/main.go",
+            "src/latest/index.ts",
+        ] {
+            assert!(!classifier.is_test_file(path), "{}", path);
+        }
+    }
+
+    #[test]
+    fn test_go_test_functions() {
+        let classifier = TestClassifier::default();
+        let go = Some("go");
+        assert!(classifier.is_test("auth/service.go", Some("auth.TestLogin"), go));
+        assert!(classifier.is_test("auth/service.go", Some("auth.BenchmarkHash"), go));
+        assert!(classifier.is_test("auth/service.go", Some("auth.Example"), go));
+        assert!(classifier.is_test("auth/service.go", Some("auth.Test_parse"), go));
+        assert!(!classifier.is_test("auth/service.go", Some("auth.Testify"), go));
+        assert!(!classifier.is_test("auth/service.go", Some("auth.DB.TestConn"), go));
+        assert!(!classifier.is_test("auth/service.py", Some("auth.TestLogin"), Some("python")));
+    }
+
+    #[test]
+    fn test_custom_patterns() {
+        let classifier = TestClassifier::new(&["qa/**", "*.check.go"]).unwrap();
+        assert!(classifier.is_test_file("services/qa/smoke.go"));
+        assert!(classifier.is_test_file("auth/login.check.go"));
+        // The custom patterns replace the built-in ones
+        assert!(!classifier.is_test_file("auth/login_test.go"));
+        assert!(TestClassifier::new(&["a/[b"]).is_err());
+
+        let mut chunks = vec![
+            CodeChunk {
+                filename: "auth/login.go".to_string(),
+                symbol: Some("auth.TestLogin".to_string()),
+                language: Some("go".to_string()),
+                ..Default::default()
+            },
+            CodeChunk {
+                filename: "auth/login.go".to_string(),
+                symbol: Some("auth.Login".to_string()),
+                language: Some("go".to_string()),
+                is_test: true,
+                ..Default::default()
+            },
+        ];
+        classifier.classify(&mut chunks);
+        assert!(chunks[0].is_test);
+        assert!(!chunks[1].is_test);
+    }
+}
@@ -1,16 +1,23 @@
 pub mod bm25;
+pub mod callgraph;
 pub mod commands;
 pub mod config;
 pub mod context;
 pub mod core;
 pub mod embedding;
+pub mod eval;
+pub mod highlight;
 pub mod indexer;
 pub mod llm;
+pub mod manifest;
 pub mod ops;
+pub mod redact;
 pub mod reporting;
+pub mod rerank;
 pub mod search;
 pub mod server;
 pub mod storage;
+pub mod summary;
 
 pub mod telemetry;
 pub mod watcher;
@@ -2,7 +2,10 @@ use crate::llm::LlmClient;
 use anyhow::Result;
 use std::sync::Arc;
 
-/// Service for expanding user queries into multiple related search terms.
+/// Alternative phrasings kept from the LLM's answer.
+pub const MAX_PHRASINGS: usize = 3;
+
+/// Service for expanding user queries into alternative phrasings.
 pub struct QueryExpander {
     llm_client: Arc<dyn LlmClient>,
 }
@@ -13,44 +16,75 @@ impl QueryExpander {
         Self { llm_client }
     }
 
-    /// Expands a single query into a list of related search terms.
+    /// Asks the LLM for 2-3 alternative phrasings of `query`.
     ///
-    /// The original query is included in the returned list.
+    /// Returns the original query first, followed by at most
+    /// [`MAX_PHRASINGS`] distinct phrasings.
     pub async fn expand(&self, query: &str) -> Result<Vec<String>> {
         let prompt = format!(
-            "You are a coding assistant. Generate 3-5 short technical synonyms or related terms for the following search query to improve code search recall.
-            
+            "You are a coding assistant helping to search a codebase. Rewrite the following search query in 2-3 different ways that could match the relevant code: use other words for the same concept, the names identifiers would likely have, or a more specific description.
+
             Query: '{}'
-            
-            Return ONLY a comma-separated list of terms. Do not include the original query in the output. Do not add numbering or explanations.
+
+            Return ONLY the rewritten queries, one per line. Do not repeat the original query. Do not add numbering or explanations.
             Example:
-            Query: auth
-            Output: authentication, login, credentials, identity, oauth",
+            Query: where do we check the user's password
+            Output:
+            password verification during login
+            authenticate user credentials
+            compare password hash",
             query
         );
 
         let response = self.llm_client.generate(&prompt).await?;
+        Ok(parse_phrasings(query, &response))
+    }
+}
 
-        // Parse comma-separated response
-        let mut terms: Vec<String> = response
-            .split(',')
-            .map(|s| s.trim().to_string())
-            .filter(|s| !s.is_empty())
-            .collect();
-
-        // Ensure original query is always present (and first)
-        terms.insert(0, query.to_string());
-
-        // Deduplicate in case LLM repeats original
-        terms.sort();
-        terms.dedup();
+/// Extracts phrasings from an LLM reply: one per line, without list markers
+/// or quotes, skipping repeats of the query. A single comma-separated line,
+/// as returned by models that ignore the format, is split into terms.
+fn parse_phrasings(query: &str, response: &str) -> Vec<String> {
+    let lines: Vec<&str> = response
+        .lines()
+        .map(str::trim)
+        .filter(|l| !l.is_empty() && !l.starts_with("```"))
+        .collect();
+    let candidates: Vec<&str> = match lines.as_slice() {
+        [line] => line.split(',').collect(),
+        _ => lines,
+    };
 
-        // Re-insert original at front if lost during sort (though dedup shouldn't lose it if we just inserted it)
-        // Actually simpler: just collect, filter, then add original.
-        // Let's rely on HashSet for dedup then convert to Vec.
+    let mut queries = vec![query.to_string()];
+    for candidate in candidates {
+        if queries.len() > MAX_PHRASINGS {
+            break;
+        }
+        let phrasing = strip_marker(candidate);
+        let duplicate = queries.iter().any(|q| q.eq_ignore_ascii_case(phrasing));
+        if !phrasing.is_empty() && !duplicate {
+            queries.push(phrasing.to_string());
+        }
+    }
+    queries
+}
 
-        Ok(terms)
+/// Strips a leading `-`, `*` or `1.`/`1)` marker and surrounding quotes.
+fn strip_marker(line: &str) -> &str {
+    let mut line = line.trim();
+    if let Some(rest) = line.strip_prefix(['-', '*', '•']) {
+        line = rest;
+    } else {
+        let digits = line.len() - line.trim_start_matches(|c: char| c.is_ascii_digit()).len();
+        if digits > 0 {
+            if let Some(rest) = line[digits..].strip_prefix(['.', ')']) {
+                line = rest;
+            }
+        }
     }
+    line.trim()
+        .trim_matches(|c| c == '"' || c == '\'' || c == '`')
+        .trim()
 }
 
 #[cfg(test)]
@@ -71,4 +105,23 @@ mod tests {
         assert!(terms.contains(&"authentication".to_string()));
         assert!(terms.contains(&"login".to_string()));
     }
+
+    #[test]
+    fn test_parses_phrasings_per_line() {
+        let response = "1. \"password verification during login\"\n\
+                        2) authenticate user credentials\n\n\
+                        - Where do we check the user's password\n\
+                        * compare password hash\n\
+                        hash the password with bcrypt";
+        assert_eq!(
+            parse_phrasings("where do we check the user's password", response),
+            vec![
+                "where do we check the user's password",
+                "password verification during login",
+                "authenticate user credentials",
+                "compare password hash",
+            ]
+        );
+        assert_eq!(parse_phrasings("auth", "  \n"), vec!["auth"]);
+    }
 }
@@ -1,8 +1,10 @@
 pub mod client;
 pub mod expander;
+pub mod reranker;
 
 #[cfg(test)]
 mod tests;
 
 pub use client::{LlmClient, OllamaClient};
 pub use expander::QueryExpander;
+pub use reranker::LlmReranker;
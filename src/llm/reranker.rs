@@ -0,0 +1,158 @@
+use crate::llm::LlmClient;
+use crate::rerank::Reranker;
+use crate::search::SearchResult;
+use anyhow::Result;
+use async_trait::async_trait;
+use std::sync::Arc;
+
+/// Maximum characters of each candidate included in the scoring prompt.
+const MAX_SNIPPET_CHARS: usize = 1500;
+
+/// Reranker that asks an LLM to rate each candidate's relevance from 0 to 10.
+pub struct LlmReranker {
+    llm_client: Arc<dyn LlmClient>,
+    /// Model the client talks to, for [`Reranker::name`]
+    model: String,
+}
+
+impl LlmReranker {
+    /// Creates a new LlmReranker with the given LLM client.
+    pub fn new(llm_client: Arc<dyn LlmClient>) -> Self {
+        Self {
+            llm_client,
+            model: String::new(),
+        }
+    }
+
+    /// Names the model `llm_client` talks to.
+    pub fn with_model(mut self, model: &str) -> Self {
+        self.model = model.to_string();
+        self
+    }
+
+    fn build_prompt(query: &str, candidates: &[SearchResult]) -> String {
+        let mut prompt = format!(
+            "You are a code search assistant. Rate how relevant each code snippet is to the search query on a scale from 0 (irrelevant) to 10 (exactly what was asked for).
+
+            Query: '{}'
+
+            Return ONLY one line per snippet in the form `<number>: <score>`. Do not add explanations.
+            Example:
+            1: 8
+            2: 0
+            ",
+            query
+        );
+
+        for (i, candidate) in candidates.iter().enumerate() {
+            let snippet: String = candidate.code.chars().take(MAX_SNIPPET_CHARS).collect();
+            prompt.push_str(&format!(
+                "\n[{}] {}:{}-{}\n{}\n",
+                i + 1,
+                candidate.filename,
+                candidate.line_start,
+                candidate.line_end,
+                snippet
+            ));
+        }
+
+        prompt
+    }
+
+    /// Parses `<number>: <score>` lines into `(candidate_index, score)` pairs.
+    ///
+    /// Lines that don't match, refer to unknown candidates or carry scores
+    /// outside 0-10 are ignored.
+    fn parse_scores(response: &str, candidate_count: usize) -> Vec<(usize, f32)> {
+        let mut scores: Vec<(usize, f32)> = Vec::new();
+        for line in response.lines() {
+            let Some((number, score)) = line.split_once(':') else {
+                continue;
+            };
+            let number = number.trim().trim_matches(|c| c == '[' || c == ']');
+            let (Ok(number), Ok(score)) = (number.parse::<usize>(), score.trim().parse::<f32>())
+            else {
+                continue;
+            };
+            if number == 0 || number > candidate_count || !(0.0..=10.0).contains(&score) {
+                continue;
+            }
+            let index = number - 1;
+            if !scores.iter().any(|(i, _)| *i == index) {
+                scores.push((index, score));
+            }
+        }
+        scores
+    }
+}
+
+#[async_trait]
+impl Reranker for LlmReranker {
+    async fn rerank(&self, query: &str, candidates: &[SearchResult]) -> Result<Vec<(usize, f32)>> {
+        if candidates.is_empty() {
+            return Ok(Vec::new());
+        }
+
+        let prompt = Self::build_prompt(query, candidates);
+        let response = self.llm_client.generate(&prompt).await?;
+
+        let mut scores = Self::parse_scores(&response, candidates.len());
+        if scores.is_empty() {
+            anyhow::bail!("LLM reranker returned no usable scores");
+        }
+
+        // Candidates the model skipped rank below every scored one.
+        for index in 0..candidates.len() {
+            if !scores.iter().any(|(i, _)| *i == index) {
+                scores.push((index, 0.0));
+            }
+        }
+        Ok(scores)
+    }
+
+    fn name(&self) -> String {
+        format!("llm:{}", self.model)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::llm::client::mocks::MockLlmClient;
+
+    fn candidate(filename: &str) -> SearchResult {
+        SearchResult {
+            filename: filename.to_string(),
+            code: "fn main() {}".to_string(),
+            line_start: 1,
+            line_end: 1,
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_parse_scores() {
+        let scores = LlmReranker::parse_scores("1: 8\n[2]: 3.5\n3: 42\nnoise\n1: 2\n9: 5", 3);
+        assert_eq!(scores, vec![(0, 8.0), (1, 3.5)]);
+    }
+
+    #[tokio::test]
+    async fn test_rerank_scores_all_candidates() {
+        let mock_client = Arc::new(MockLlmClient::new("2: 9\n1: 4"));
+        let reranker = LlmReranker::new(mock_client as Arc<dyn LlmClient>);
+
+        let candidates = vec![candidate("a.rs"), candidate("b.rs"), candidate("c.rs")];
+        let scores = reranker.rerank("query", &candidates).await.unwrap();
+
+        assert_eq!(scores, vec![(1, 9.0), (0, 4.0), (2, 0.0)]);
+    }
+
+    #[tokio::test]
+    async fn test_rerank_unparseable_response_fails() {
+        let mock_client = Arc::new(MockLlmClient::new("I cannot help with that."));
+        let reranker = LlmReranker::new(mock_client as Arc<dyn LlmClient>);
+
+        let result = reranker.rerank("query", &[candidate("a.rs")]).await;
+        assert!(result.is_err());
+    }
+}
@@ -1,9 +1,14 @@
 use anyhow::Context;
 use clap::{Parser, Subcommand};
 
-use code_rag::commands::{index, search, serve, watch};
+use code_rag::commands::{
+    config as config_cmd, delete, export, import, index, search, serve, stats, verify, watch,
+};
 use code_rag::config::AppConfig;
-use code_rag::telemetry::{init_telemetry, AppMode};
+use code_rag::core::{CancelToken, CodeRagError};
+use code_rag::indexer::DocType;
+use code_rag::telemetry::{init_telemetry, verbose_level, AppMode};
+use std::io::IsTerminal;
 
 #[cfg(windows)]
 use std::os::windows::process::CommandExt;
@@ -34,6 +39,45 @@ struct Args {
     /// Path to configuration file (must be specified BEFORE subcommand)
     #[arg(short, long, global = true)]
     config: Option<String>,
+
+    /// Override the database location (takes precedence over `db_path` in config)
+    #[arg(long, global = true)]
+    db_path: Option<String>,
+
+    /// Log pipeline events with timings to stderr (-v for debug, -vv for trace)
+    #[arg(short, long, global = true, action = clap::ArgAction::Count)]
+    verbose: u8,
+
+    /// Log level: error, warn, info, debug or trace (takes precedence over --verbose and `log_level`)
+    #[arg(long, global = true)]
+    log_level: Option<String>,
+
+    /// Log format: text or json (takes precedence over `log_format`)
+    #[arg(long, global = true)]
+    log_format: Option<String>,
+
+    /// Disable colored output (also off when stdout is not a terminal or NO_COLOR is set)
+    #[arg(long, global = true)]
+    no_color: bool,
+
+    /// Base URL of the remote embedding API, e.g. an OpenAI-compatible server
+    /// (takes precedence over `embedding_host`)
+    #[arg(long, global = true, value_name = "URL")]
+    embed_base_url: Option<String>,
+
+    /// HTTP header sent with every remote embedding request, as 'Name: value'
+    /// (repeatable, added to `embedding_headers`)
+    #[arg(long = "embed-header", global = true, value_name = "HEADER", value_parser = parse_embed_header)]
+    embed_headers: Vec<(String, String)>,
+
+    /// Reuse embeddings of unchanged chunk texts from this cache file, shared
+    /// across indexes (takes precedence over `embedding_cache`)
+    #[arg(long, global = true, value_name = "PATH")]
+    embed_cache: Option<String>,
+}
+
+fn parse_embed_header(header: &str) -> Result<(String, String), String> {
+    code_rag::embedding::parse_header(header).map_err(|e| e.to_string())
 }
 
 #[derive(Subcommand, Debug)]
@@ -52,6 +96,10 @@ enum Commands {
         #[arg(short, long)]
         force: bool,
 
+        /// Continue an interrupted run from its checkpoint, skipping files it completed
+        #[arg(long, conflicts_with = "force")]
+        resume: bool,
+
         /// Workspace name (if not provided, indexes all workspaces in config)
         #[arg(short, long)]
         workspace: Option<String>,
@@ -68,15 +116,100 @@ enum Commands {
         #[arg(long)]
         threads: Option<usize>,
 
+        /// Embedding batches processed concurrently (default: number of CPUs).
+        /// Only remote providers run batches in parallel
+        #[arg(long)]
+        concurrency: Option<usize>,
+
         /// Process priority (low, normal, high)
         #[arg(long)]
         priority: Option<String>,
+
+        /// Only index these languages (comma-separated, e.g. python,typescript)
+        #[arg(long, value_delimiter = ',')]
+        languages: Vec<String>,
+
+        /// Only index paths matching this glob (repeatable, e.g. 'src/**')
+        #[arg(long)]
+        include: Vec<String>,
+
+        /// Skip paths matching this glob (repeatable, e.g. '**/*_test.go')
+        #[arg(long)]
+        exclude: Vec<String>,
+
+        /// Tag the chunks with this collection; other collections in the index are kept
+        #[arg(long)]
+        collection: Option<String>,
+
+        /// Index the files of this git tag, branch or commit instead of the working tree,
+        /// into a collection named after it unless --collection is given
+        #[arg(long, value_name = "REF", conflicts_with = "dry_run")]
+        rev: Option<String>,
+
+        /// Only index files modified since this time (2h, 7d, 2024-05-01, ...),
+        /// keeping the rest of the index as it is; implies --update
+        #[arg(
+            long,
+            value_name = "WHEN",
+            value_parser = index::parse_since,
+            conflicts_with_all = ["force", "resume", "rev", "dry_run"]
+        )]
+        since: Option<i64>,
+
+        /// Only index files git reports changed since this ref, committed or not,
+        /// keeping the rest of the index as it is; implies --update
+        #[arg(
+            long,
+            value_name = "REF",
+            conflicts_with_all = ["force", "resume", "rev", "dry_run"]
+        )]
+        since_ref: Option<String>,
+
+        /// Index chunk text as-is, without redacting secrets
+        #[arg(long)]
+        no_redact: bool,
+
+        /// Lines shared by adjacent line-based chunks (default: 3)
+        #[arg(long, value_name = "LINES")]
+        overlap: Option<usize>,
+
+        /// Split declarations above this many tokens into labeled parts
+        #[arg(long, value_name = "TOKENS")]
+        max_chunk_tokens: Option<usize>,
+
+        /// Skip files larger than this, e.g. 512KB or 2MB (default: 1MB)
+        #[arg(long, value_name = "SIZE", value_parser = code_rag::config::parse_size)]
+        max_file_size: Option<usize>,
+
+        /// Index files of any size, ignoring --max-file-size and max_file_size_bytes
+        #[arg(long, conflicts_with = "max_file_size")]
+        index_large: bool,
+
+        /// Summarize chunks above summary_threshold_tokens: none, signature or llm
+        #[arg(long, value_name = "MODE")]
+        summarize: Option<String>,
+
+        /// List the chunks that would be embedded, without embedding or storing them
+        #[arg(long, conflicts_with_all = ["force", "resume"])]
+        dry_run: bool,
+
+        /// Print the dry-run chunk plan as JSON
+        #[arg(long, requires = "dry_run")]
+        json: bool,
+
+        /// Don't show indexing progress (bar on a terminal, periodic log lines otherwise)
+        #[arg(short, long)]
+        quiet: bool,
     },
     /// Search the indexed codebase semantically
     Search {
-        /// The search query
+        /// The search query; with --code a code snippet, or - to read it from stdin
         query: String,
 
+        /// Search for code like the snippet given as query, instead of answering a question
+        #[arg(long, conflicts_with = "expand")]
+        code: bool,
+
         /// Limit the number of results
         #[arg(short, long)]
         limit: Option<usize>,
@@ -97,10 +230,50 @@ enum Commands {
         #[arg(long)]
         dir: Option<String>,
 
+        /// Only return files matching these globs (comma-separated, e.g. "internal/auth/**")
+        #[arg(long, value_delimiter = ',')]
+        path_glob: Vec<String>,
+
+        /// Only return these languages (comma-separated, e.g. go,python)
+        #[arg(long, value_delimiter = ',')]
+        languages: Vec<String>,
+
+        /// Only return Go declarations in these packages (comma-separated, e.g. auth)
+        #[arg(long = "package", value_name = "PACKAGE", value_delimiter = ',')]
+        packages: Vec<String>,
+
+        /// Only return these doc types (comma-separated: code, markdown, text)
+        #[arg(long = "doc-type", value_name = "TYPE", value_delimiter = ',')]
+        doc_types: Vec<DocType>,
+
+        /// Leave out test code (_test.go, tests/, test_patterns, ...)
+        #[arg(long, conflicts_with = "only_tests")]
+        exclude_tests: bool,
+
+        /// Only return test code
+        #[arg(long)]
+        only_tests: bool,
+
+        /// Only return chunks indexed into these collections (comma-separated, e.g. backend,shared)
+        #[arg(long = "collection", value_name = "COLLECTION", value_delimiter = ',')]
+        collections: Vec<String>,
+
+        /// Only return chunks carrying one of these user tags (comma-separated, e.g. security,billing)
+        #[arg(long = "tag", value_name = "TAG", value_delimiter = ',')]
+        tags: Vec<String>,
+
+        /// Rank chunks carrying this user tag higher, by WEIGHT (default 0.5, negative to demote); repeatable
+        #[arg(long = "boost-tag", value_name = "TAG[=WEIGHT]", value_parser = code_rag::search::parse_tag_boost)]
+        boost_tags: Vec<(String, f32)>,
+
         /// Disable reranking (faster)
         #[arg(long)]
         no_rerank: bool,
 
+        /// Show what each result's score is made of: vector and BM25 ranks, boosts, rerank score and recency
+        #[arg(long)]
+        explain: bool,
+
         /// Workspace name (default: "default")
         #[arg(short, long, default_value = "default")]
         workspace: String,
@@ -113,9 +286,146 @@ enum Commands {
         #[arg(long)]
         device: Option<String>,
 
-        /// Expand query using local LLM
+        /// Also search with 2-3 LLM rephrasings of the query (needs llm_enabled)
         #[arg(long)]
         expand: bool,
+
+        /// Add callers and callees within N call-graph hops of each result
+        #[arg(long, default_value_t = 0)]
+        expand_graph: usize,
+
+        /// Blend between semantic (1.0) and keyword (0.0) ranking, overriding the configured weights
+        #[arg(long)]
+        hybrid_alpha: Option<f32>,
+
+        /// Diversify results by maximal marginal relevance (1.0 = pure relevance, lower = more diverse)
+        #[arg(long)]
+        mmr_lambda: Option<f32>,
+
+        /// Return at most N results from any one file, filling up with other files
+        #[arg(long, value_name = "N")]
+        max_per_file: Option<usize>,
+
+        /// Return the whole function or type when a match is one part of a declaration split at index time
+        #[arg(long)]
+        expand_to_symbol: bool,
+
+        /// Drop results whose cosine similarity to the query is below this (e.g. 0.5)
+        #[arg(long)]
+        min_score: Option<f32>,
+
+        /// Favor recently changed code: halve a result's similarity for every DAYS since it changed
+        #[arg(long, value_name = "DAYS")]
+        recency_half_life: Option<f64>,
+
+        /// Show N lines of the current file before and after each result
+        #[arg(short = 'C', long, value_name = "N", default_value_t = 0)]
+        context_lines: usize,
+
+        /// Search this index (or every index in this directory) and merge the results; repeatable
+        #[arg(long = "index", value_name = "PATH")]
+        indexes: Vec<String>,
+
+        /// Search without reading or updating the query cache
+        #[arg(long)]
+        no_cache: bool,
+
+        /// Queries kept in the query cache of each index (default: query_cache_size, 128)
+        #[arg(long, value_name = "N", conflicts_with = "no_cache")]
+        cache_size: Option<usize>,
+    },
+    /// Find code similar to an indexed symbol or line range
+    Similar {
+        /// Target as FILE:SYMBOL (e.g. auth/service.go:Authenticate) or FILE:START-END
+        target: String,
+
+        /// Limit the number of results
+        #[arg(short, long)]
+        limit: Option<usize>,
+
+        /// Output results as JSON
+        #[arg(long)]
+        json: bool,
+
+        /// Only return files matching these globs (comma-separated, e.g. "internal/**")
+        #[arg(long, value_delimiter = ',')]
+        path_glob: Vec<String>,
+
+        /// Only return these languages (comma-separated, e.g. go,python)
+        #[arg(long, value_delimiter = ',')]
+        languages: Vec<String>,
+
+        /// Workspace name (default: "default")
+        #[arg(short, long, default_value = "default")]
+        workspace: String,
+    },
+    /// Run many queries against one loaded index, printing a JSON array of results
+    Batch {
+        /// File with one query per line (default: standard input)
+        #[arg(short, long, value_name = "FILE")]
+        input: Option<std::path::PathBuf>,
+
+        /// Limit the number of results per query
+        #[arg(short, long)]
+        limit: Option<usize>,
+
+        /// Queries searched in parallel
+        #[arg(long, value_name = "N", default_value_t = search::DEFAULT_BATCH_CONCURRENCY,
+            value_parser = clap::value_parser!(usize).range(1..))]
+        concurrency: usize,
+
+        /// Disable reranking (faster)
+        #[arg(long)]
+        no_rerank: bool,
+
+        /// Workspace name (default: "default")
+        #[arg(short, long, default_value = "default")]
+        workspace: String,
+    },
+    /// Measure retrieval quality on a labeled dataset: recall@k, precision@k and MRR
+    Eval {
+        /// JSON Lines file of {"query": ..., "expected": [...]} cases (default: standard input)
+        #[arg(short, long, value_name = "FILE")]
+        dataset: Option<std::path::PathBuf>,
+
+        /// Cutoff: only the top K results of each query are scored (default: default_limit)
+        #[arg(short, value_name = "K", value_parser = clap::value_parser!(usize).range(1..))]
+        k: Option<usize>,
+
+        /// Queries searched in parallel
+        #[arg(long, value_name = "N", default_value_t = search::DEFAULT_BATCH_CONCURRENCY,
+            value_parser = clap::value_parser!(usize).range(1..))]
+        concurrency: usize,
+
+        /// Disable reranking (faster)
+        #[arg(long)]
+        no_rerank: bool,
+
+        /// Workspace name (default: "default")
+        #[arg(short, long, default_value = "default")]
+        workspace: String,
+
+        /// Output the summary and per-query breakdown as JSON
+        #[arg(long)]
+        json: bool,
+    },
+    /// Search one loaded index interactively, with a prompt, history and inline settings
+    Repl {
+        /// Limit the number of results per query
+        #[arg(short, long)]
+        limit: Option<usize>,
+
+        /// Disable reranking (faster)
+        #[arg(long)]
+        no_rerank: bool,
+
+        /// Workspace name (default: "default")
+        #[arg(short, long, default_value = "default")]
+        workspace: String,
+
+        /// Start with JSON output (toggle with :json)
+        #[arg(long)]
+        json: bool,
     },
     /// Fast regex-based text search (no embeddings)
     Grep {
@@ -126,9 +436,87 @@ enum Commands {
         #[arg(long)]
         json: bool,
     },
+    /// Remove indexed files matching a glob, or one symbol's chunks, without re-indexing
+    Delete {
+        /// Glob of the files to remove (e.g. "internal/legacy/**" or "auth/service.go")
+        #[arg(required_unless_present = "collection")]
+        pattern: Option<String>,
+
+        /// Remove the chunks indexed into this collection (only those matching the pattern, if given)
+        #[arg(long)]
+        collection: Option<String>,
+
+        /// Only remove the chunks of this symbol (e.g. Authenticate or auth.Service.Authenticate)
+        #[arg(long)]
+        symbol: Option<String>,
+
+        /// Workspace name (default: "default")
+        #[arg(short, long, default_value = "default")]
+        workspace: String,
+
+        /// Output the removed files as JSON
+        #[arg(long)]
+        json: bool,
+    },
+    /// Summarize what is indexed: files, chunks, languages, model and size
+    Stats {
+        /// Workspace name (default: "default")
+        #[arg(short, long, default_value = "default")]
+        workspace: String,
+
+        /// Output as JSON
+        #[arg(long)]
+        json: bool,
+    },
+    /// Check an index for broken vectors, duplicate chunks and manifest mismatches
+    Verify {
+        /// Workspace name (default: "default")
+        #[arg(short, long, default_value = "default")]
+        workspace: String,
+
+        /// Drop the broken chunks and manifest entries; 'index --update' re-indexes them
+        #[arg(long)]
+        repair: bool,
+
+        /// Output as JSON
+        #[arg(long)]
+        json: bool,
+    },
+    /// Write the chunks and embeddings of an index to a portable file
+    Export {
+        /// Output format
+        #[arg(long, default_value = "jsonl", value_parser = ["jsonl"])]
+        format: String,
+
+        /// File to write (standard output if omitted or '-')
+        #[arg(short, long, value_name = "FILE")]
+        output: Option<std::path::PathBuf>,
+
+        /// Workspace name (default: "default")
+        #[arg(short, long, default_value = "default")]
+        workspace: String,
+    },
+    /// Build an index from an export without re-embedding
+    Import {
+        /// Export to read (standard input if omitted or '-')
+        #[arg(short, long, value_name = "FILE")]
+        input: Option<std::path::PathBuf>,
+
+        /// Workspace to create (default: the one the export was taken from)
+        #[arg(short, long)]
+        workspace: Option<String>,
+
+        /// Replace the workspace's index if it already has one
+        #[arg(long)]
+        force: bool,
+    },
     /// Start the REST API server only
     Serve {
-        /// Port to listen on (default: 8000)
+        /// Address to listen on, e.g. ':7777' or '0.0.0.0:7777' (replaces --host/--port)
+        #[arg(long, conflicts_with_all = ["port", "host"])]
+        addr: Option<String>,
+
+        /// Port to listen on (default: 3000)
         #[arg(long)]
         port: Option<u16>,
 
@@ -138,27 +526,97 @@ enum Commands {
     },
     /// Watch codebase for changes and auto-reindex
     Watch {
-        /// Path to watch
+        /// Directory to watch
+        #[arg(conflicts_with = "path")]
+        dir: Option<String>,
+
+        /// Path to watch (same as DIR)
         #[arg(short, long)]
         path: Option<String>,
 
         /// Workspace name (default: "default")
         #[arg(short, long, default_value = "default")]
         workspace: String,
+
+        /// Collection to tag re-indexed chunks with, as for index --collection
+        #[arg(long)]
+        collection: Option<String>,
     },
     /// Start the Model Context Protocol (MCP) server for AI assistants
     Mcp,
+    /// Inspect the resolved configuration
+    Config {
+        #[command(subcommand)]
+        action: ConfigAction,
+    },
     /// Start unified services (Server + MCP + Watch) based on config flags\n    ///\n    /// Starts all enabled services concurrently based on your configuration:\n    ///   - enable_server = true  → HTTP API on configured port\n    ///   - enable_mcp = true     → MCP server via stdio\n    ///   - enable_watch = true   → File watcher for auto-indexing\n    ///\n    /// EXAMPLE:\n    ///   code-rag --config code-rag.toml start
     Start,
 }
 
+#[derive(Subcommand, Debug)]
+enum ConfigAction {
+    /// Print the effective configuration and where each value comes from
+    Print {
+        /// Output as JSON
+        #[arg(long)]
+        json: bool,
+    },
+}
+
 #[tokio::main]
-async fn main() -> anyhow::Result<()> {
+async fn main() {
+    if let Err(err) = run().await {
+        // Same report anyhow prints when main returns the error
+        eprintln!("Error: {:?}", err);
+        let code = err
+            .downcast_ref::<CodeRagError>()
+            .map_or(1, CodeRagError::exit_code);
+        std::process::exit(code);
+    }
+}
+
+async fn run() -> anyhow::Result<()> {
     // 1. Parse Arguments First
     let args = Args::parse();
+    if args.no_color || !std::io::stdout().is_terminal() {
+        colored::control::set_override(false);
+    }
 
     // 2. Load Configuration (with optional custom path from --config)
-    let config = AppConfig::from_path(args.config).context("Failed to load configuration")?;
+    let mut config = AppConfig::from_path(args.config).context("Failed to load configuration")?;
+    if let Some(db_path) = args.db_path {
+        config.db_path = db_path;
+        config.provenance.set_by_flag("db_path", "--db-path");
+    }
+    if let Some(level) = args.log_level {
+        config.log_level = level;
+        config.provenance.set_by_flag("log_level", "--log-level");
+    } else if let Some(level) = verbose_level(args.verbose) {
+        config.log_level = level.to_string();
+        config.provenance.set_by_flag("log_level", "--verbose");
+    }
+    if let Some(format) = args.log_format {
+        config.log_format = format;
+        config.provenance.set_by_flag("log_format", "--log-format");
+    }
+    if let Some(url) = args.embed_base_url {
+        config.embedding_host = Some(url);
+        config
+            .provenance
+            .set_by_flag("embedding_host", "--embed-base-url");
+    }
+    if !args.embed_headers.is_empty() {
+        config.embedding_headers.extend(args.embed_headers);
+        config
+            .provenance
+            .set_by_flag("embedding_headers", "--embed-header");
+    }
+    if let Some(path) = args.embed_cache {
+        config.embedding_cache = Some(path);
+        config
+            .provenance
+            .set_by_flag("embedding_cache", "--embed-cache");
+    }
 
     // 3. Setup Telemetry
     // If command is Serve or Start, we use Server mode (OTLP), otherwise CLI mode (Chrome/Local)
@@ -171,18 +629,51 @@ async fn main() -> anyhow::Result<()> {
     // Note: init_telemetry internally handles logging initialization for now,
     // replacing the old init_logging function.
     let _guard = init_telemetry(app_mode, &config).context("Failed to initialize telemetry")?;
+    for key in &config.provenance.unknown_keys {
+        tracing::warn!("Ignoring unknown configuration key '{}'", key);
+    }
 
     // 4. Execute Command
+    // Ctrl-C stops indexing, watching and searches cleanly; the other commands
+    // keep the default behaviour or handle it themselves
+    let cancel = CancelToken::new();
+    if matches!(
+        args.command,
+        Commands::Index { .. }
+            | Commands::Search { .. }
+            | Commands::Batch { .. }
+            | Commands::Watch { .. }
+    ) {
+        cancel.cancel_on_interrupt();
+    }
     match args.command {
         Commands::Index {
             path,
             update,
             force,
+            resume,
             workspace,
             device,
             batch_size,
             threads,
+            concurrency,
             priority,
+            languages,
+            include,
+            exclude,
+            collection,
+            rev,
+            since,
+            since_ref,
+            no_redact,
+            overlap,
+            max_chunk_tokens,
+            max_file_size,
+            index_large,
+            summarize,
+            dry_run,
+            json,
+            quiet,
         } => {
             let mut config = config.clone();
             if let Some(d) = device {
@@ -201,6 +692,24 @@ async fn main() -> anyhow::Result<()> {
             if let Some(bs) = batch_size {
                 config.batch_size = bs;
             }
+            if no_redact {
+                config.redact_secrets = false;
+            }
+            if let Some(lines) = overlap {
+                config.chunk_overlap_lines = lines;
+            }
+            if let Some(tokens) = max_chunk_tokens {
+                config.max_chunk_tokens = Some(tokens);
+            }
+            if let Some(size) = max_file_size {
+                config.max_file_size_bytes = size;
+            }
+            if index_large {
+                config.max_file_size_bytes = 0;
+            }
+            if let Some(mode) = summarize {
+                config.summarize_chunks = mode;
+            }
 
             // Apply process priority
             // NOTE: `apply_process_priority` is not defined in the provided context.
@@ -232,9 +741,22 @@ async fn main() -> anyhow::Result<()> {
                         db_path: None,
                         update,
                         force,
+                        resume,
                         workspace: ws_name,
                         batch_size: Some(config.batch_size),
                         threads: config.threads,
+                        concurrency,
+                        languages: languages.clone(),
+                        include: include.clone(),
+                        exclude: exclude.clone(),
+                        collection: collection.clone(),
+                        rev: rev.clone(),
+                        since,
+                        since_ref: since_ref.clone(),
+                        dry_run,
+                        json,
+                        progress: index::ProgressMode::detect(quiet),
+                        cancel: cancel.clone(),
                     },
                     &config,
                 )
@@ -243,21 +765,48 @@ async fn main() -> anyhow::Result<()> {
         }
         Commands::Search {
             query,
+            code,
             limit,
             json,
             html,
             ext,
             dir,
+            path_glob,
+            languages,
+            packages,
+            doc_types,
+            exclude_tests,
+            only_tests,
+            collections,
+            tags,
+            boost_tags,
             no_rerank,
+            explain,
             workspace,
             max_tokens,
             device,
             expand,
+            expand_graph,
+            hybrid_alpha,
+            mmr_lambda,
+            max_per_file,
+            expand_to_symbol,
+            min_score,
+            recency_half_life,
+            context_lines,
+            indexes,
+            no_cache,
+            cache_size,
         } => {
             let mut config = config.clone();
             if let Some(d) = device {
                 config.device = d;
             }
+            if no_cache {
+                config.query_cache_size = 0;
+            } else if let Some(size) = cache_size {
+                config.query_cache_size = size;
+            }
             let options = search::SearchOptions {
                 limit,
                 db_path: None,
@@ -265,22 +814,216 @@ async fn main() -> anyhow::Result<()> {
                 json,
                 ext,
                 dir,
+                path_globs: path_glob,
+                languages,
+                packages,
+                doc_types,
+                tests: code_rag::search::TestFilter::from_flags(exclude_tests, only_tests),
+                collections,
+                tags,
+                tag_boosts: boost_tags,
                 no_rerank,
                 workspace: Some(workspace),
 
                 max_tokens,
                 expand,
+                expand_graph,
+                hybrid_alpha,
+                mmr_lambda,
+                max_per_file,
+                expand_to_symbol,
+                min_score,
+                recency_half_life: recency_half_life.and_then(code_rag::search::half_life_days),
+                context_lines,
+                indexes,
+                code,
+                explain,
+                cancel: cancel.clone(),
+            };
+            let searched = cancel
+                .run(search::search_codebase(query, options, &config))
+                .await
+                .and_then(|result| result);
+            if let Err(e) = searched {
+                if json {
+                    // Scripts read errors from stderr in the same format as results
+                    let output = search::JsonErrorOutput::from(&e);
+                    eprintln!("{}", serde_json::to_string(&output)?);
+                    std::process::exit(e.exit_code());
+                }
+                return Err(e.into());
+            }
+        }
+        Commands::Similar {
+            target,
+            limit,
+            json,
+            path_glob,
+            languages,
+            workspace,
+        } => {
+            let options = search::SimilarOptions {
+                limit,
+                json,
+                workspace,
+                path_globs: path_glob,
+                languages,
+            };
+            if let Err(e) = search::find_similar(target, options, &config).await {
+                if json {
+                    let output = search::JsonErrorOutput::from(&e);
+                    eprintln!("{}", serde_json::to_string(&output)?);
+                    std::process::exit(e.exit_code());
+                }
+                return Err(e.into());
+            }
+        }
+        Commands::Batch {
+            input,
+            limit,
+            concurrency,
+            no_rerank,
+            workspace,
+        } => {
+            let options = search::BatchOptions {
+                input,
+                limit,
+                workspace,
+                concurrency,
+                no_rerank,
+                cancel: cancel.clone(),
+            };
+            let ran = cancel
+                .run(search::run_batch(options, &config))
+                .await
+                .and_then(|result| result);
+            if let Err(e) = ran {
+                let output = search::JsonErrorOutput::from(&e);
+                eprintln!("{}", serde_json::to_string(&output)?);
+                std::process::exit(e.exit_code());
+            }
+        }
+        Commands::Eval {
+            dataset,
+            k,
+            concurrency,
+            no_rerank,
+            workspace,
+            json,
+        } => {
+            let options = search::EvalOptions {
+                dataset,
+                k,
+                workspace,
+                concurrency,
+                no_rerank,
+                json,
+            };
+            search::run_eval(options, &config).await?;
+        }
+        Commands::Repl {
+            limit,
+            no_rerank,
+            workspace,
+            json,
+        } => {
+            let options = search::ReplOptions {
+                limit,
+                workspace,
+                no_rerank,
+                json,
             };
-            search::search_codebase(query, options, &config).await?;
+            search::run_repl(options, &config).await?;
         }
         Commands::Grep { pattern, json } => {
             search::grep_codebase(pattern, json, &config)?;
         }
-        Commands::Serve { port, host } => {
+        Commands::Delete {
+            pattern,
+            collection,
+            symbol,
+            workspace,
+            json,
+        } => {
+            delete::delete_chunks(
+                delete::DeleteOptions {
+                    pattern,
+                    collection,
+                    symbol,
+                    workspace,
+                    json,
+                },
+                &config,
+            )
+            .await?;
+        }
+        Commands::Stats { workspace, json } => {
+            stats::show_stats(
+                stats::StatsOptions {
+                    workspace,
+                    db_path: None,
+                    json,
+                },
+                &config,
+            )
+            .await?;
+        }
+        Commands::Verify {
+            workspace,
+            repair,
+            json,
+        } => {
+            verify::verify_index(
+                verify::VerifyOptions {
+                    workspace,
+                    repair,
+                    json,
+                },
+                &config,
+            )
+            .await?;
+        }
+        Commands::Export {
+            format: _,
+            output,
+            workspace,
+        } => {
+            export::export_index(export::ExportOptions { output, workspace }, &config).await?;
+        }
+        Commands::Import {
+            input,
+            workspace,
+            force,
+        } => {
+            import::import_index(
+                import::ImportOptions {
+                    input,
+                    workspace,
+                    force,
+                },
+                &config,
+            )
+            .await?;
+        }
+        Commands::Serve { addr, port, host } => {
+            let (host, port) = match addr {
+                Some(addr) => {
+                    let (host, port) = serve::parse_addr(&addr)?;
+                    (host, Some(port))
+                }
+                None => (host, port),
+            };
+            serve::require_served_index(None, &config).await?;
             serve::serve_api(port, host, None, &config).await?;
         }
-        Commands::Watch { path, workspace } => {
-            watch::watch_codebase(path, None, workspace, &config).await?;
+        Commands::Watch {
+            dir,
+            path,
+            workspace,
+            collection,
+        } => {
+            watch::watch_codebase(path.or(dir), None, workspace, collection, cancel, &config)
+                .await?;
         }
         Commands::Mcp => {
             code_rag::commands::mcp::run(&config).await?;
@@ -288,6 +1031,11 @@ async fn main() -> anyhow::Result<()> {
         Commands::Start => {
             code_rag::commands::start::run(&config).await?;
         }
+        Commands::Config {
+            action: ConfigAction::Print { json },
+        } => {
+            config_cmd::print_config(&config, json)?;
+        }
     }
 
     Ok(())
@@ -0,0 +1,517 @@
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use sha2::{Digest, Sha256};
+use std::collections::BTreeMap;
+use std::fs;
+use std::io::Read;
+use std::path::{Path, PathBuf};
+
+use crate::core::CodeRagError;
+
+/// File name of the manifest stored next to the LanceDB tables.
+pub const MANIFEST_FILE: &str = "manifest.json";
+
+/// Current on-disk format version of the manifest.
+pub const MANIFEST_VERSION: u32 = 1;
+
+/// Marker file present while an indexing run is writing to the database.
+pub const IN_PROGRESS_FILE: &str = "indexing.lock";
+
+/// Manifest of the files an unfinished indexing run has fully stored.
+pub const CHECKPOINT_FILE: &str = "checkpoint.json";
+
+/// Token that changes whenever the index is written, see [`index_version`].
+pub const INDEX_VERSION_FILE: &str = "index_version";
+
+/// Indexing state recorded for a single source file.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct FileEntry {
+    /// Hex-encoded SHA-256 of the file contents at index time
+    pub hash: String,
+    /// Last modified timestamp observed at index time
+    pub mtime: i64,
+    /// IDs of the chunks produced from this file
+    pub chunk_ids: Vec<String>,
+    /// Collection the file was indexed into with `index --collection`
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub collection: Option<String>,
+    /// Chunks of the file that `dedup_chunks` left out of `chunk_ids`, by the
+    /// file storing the copy that lists them
+    #[serde(default, skip_serializing_if = "BTreeMap::is_empty")]
+    pub merged: BTreeMap<String, usize>,
+    /// Tags `.ragtags` gave the file, so `index --update` re-indexes it when
+    /// they change
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub tags: Vec<String>,
+}
+
+/// Persistent record of which files are indexed and what they contained.
+///
+/// The manifest lets `code-rag index --update` skip files whose content did not
+/// change, detect renames (same hash, new path) and purge chunks of files that
+/// were removed since the previous run.
+///
+/// # Examples
+///
+/// ```no_run
+/// use code_rag::manifest::IndexManifest;
+///
+/// # fn main() -> anyhow::Result<()> {
+/// let manifest = IndexManifest::load("./.lancedb")?.unwrap_or_default();
+/// println!("{} files indexed", manifest.files.len());
+/// # Ok(())
+/// # }
+/// ```
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct IndexManifest {
+    pub version: u32,
+    /// Embedding model that produced the stored vectors
+    #[serde(default)]
+    pub embedding_model: Option<String>,
+    /// Dimension of the stored vectors
+    #[serde(default)]
+    pub embedding_dim: Option<usize>,
+    pub files: BTreeMap<String, FileEntry>,
+}
+
+impl Default for IndexManifest {
+    fn default() -> Self {
+        Self {
+            version: MANIFEST_VERSION,
+            embedding_model: None,
+            embedding_dim: None,
+            files: BTreeMap::new(),
+        }
+    }
+}
+
+impl IndexManifest {
+    /// Returns the manifest location for a database directory.
+    pub fn path(db_path: &str) -> PathBuf {
+        Path::new(db_path).join(MANIFEST_FILE)
+    }
+
+    /// Loads the manifest stored in `db_path`.
+    ///
+    /// Returns `Ok(None)` when no manifest has been written yet (e.g. an index
+    /// created by an older version of code-rag).
+    pub fn load(db_path: &str) -> Result<Option<Self>> {
+        Self::read(&Self::path(db_path))
+    }
+
+    /// Returns the checkpoint location for a database directory.
+    pub fn checkpoint_path(db_path: &str) -> PathBuf {
+        Path::new(db_path).join(CHECKPOINT_FILE)
+    }
+
+    /// Loads the checkpoint of an interrupted indexing run in `db_path`, if any.
+    ///
+    /// A checkpoint has the manifest format but only lists the files whose
+    /// chunks had all been stored, see [`save_checkpoint`](Self::save_checkpoint).
+    pub fn load_checkpoint(db_path: &str) -> Result<Option<Self>> {
+        Self::read(&Self::checkpoint_path(db_path))
+    }
+
+    fn read(path: &Path) -> Result<Option<Self>> {
+        if !path.exists() {
+            return Ok(None);
+        }
+        let content = fs::read_to_string(path)
+            .with_context(|| format!("Failed to read manifest {}", path.display()))?;
+        let manifest: Self = serde_json::from_str(&content)
+            .with_context(|| format!("Failed to parse manifest {}", path.display()))?;
+        if manifest.version > MANIFEST_VERSION {
+            anyhow::bail!(
+                "Manifest {} has format version {} but this build only understands version {}. \
+                Upgrade code-rag or re-index with --force.",
+                path.display(),
+                manifest.version,
+                MANIFEST_VERSION
+            );
+        }
+        Ok(Some(manifest))
+    }
+
+    /// Writes the manifest to `db_path`.
+    ///
+    /// The file is written to a temporary sibling first and then renamed so a
+    /// crash mid-write never leaves a truncated manifest behind.
+    pub fn save(&self, db_path: &str) -> Result<()> {
+        self.write(db_path, &Self::path(db_path))
+    }
+
+    /// Records the files stored so far by a running indexing run; `index
+    /// --resume` skips them. Written like [`save`](Self::save), so a hard kill
+    /// leaves either the previous or the new checkpoint.
+    pub fn save_checkpoint(&self, db_path: &str) -> Result<()> {
+        self.write(db_path, &Self::checkpoint_path(db_path))
+    }
+
+    /// Removes the checkpoint once a run finished; a missing file is not an error.
+    pub fn clear_checkpoint(db_path: &str) -> Result<()> {
+        let path = Self::checkpoint_path(db_path);
+        match fs::remove_file(&path) {
+            Ok(()) => Ok(()),
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(()),
+            Err(e) => Err(e).with_context(|| format!("Failed to remove {}", path.display())),
+        }
+    }
+
+    fn write(&self, db_path: &str, path: &Path) -> Result<()> {
+        fs::create_dir_all(db_path)
+            .with_context(|| format!("Failed to create database directory {}", db_path))?;
+        let tmp_path = path.with_extension("json.tmp");
+        let content = serde_json::to_string_pretty(self)?;
+        fs::write(&tmp_path, content)
+            .with_context(|| format!("Failed to write manifest {}", tmp_path.display()))?;
+        fs::rename(&tmp_path, path)
+            .with_context(|| format!("Failed to replace manifest {}", path.display()))?;
+        Ok(())
+    }
+
+    /// Fails with [`CodeRagError::DimensionMismatch`] when the index was built
+    /// by a different embedding model or dimension.
+    ///
+    /// Comparing vectors from two different models yields meaningless
+    /// similarities, so this is checked before indexing into or searching an
+    /// existing database.
+    pub fn check_embedder(&self, model: &str, dim: usize) -> Result<(), CodeRagError> {
+        let model_matches = self.embedding_model.as_deref().is_none_or(|m| m == model);
+        let dim_matches = self.embedding_dim.is_none_or(|d| d == dim);
+        if !model_matches || !dim_matches {
+            return Err(CodeRagError::DimensionMismatch(format!(
+                "Index was built with embedding model '{}' ({} dimensions) but the configured embedder is '{}' ({} dimensions). \
+                Switch back to the original model or re-index with --force.",
+                self.embedding_model.as_deref().unwrap_or("unknown"),
+                self.embedding_dim
+                    .map(|d| d.to_string())
+                    .unwrap_or_else(|| "unknown".to_string()),
+                model,
+                dim
+            )));
+        }
+        Ok(())
+    }
+
+    pub fn get(&self, filename: &str) -> Option<&FileEntry> {
+        self.files.get(filename)
+    }
+
+    pub fn insert(&mut self, filename: String, entry: FileEntry) {
+        self.files.insert(filename, entry);
+    }
+
+    pub fn remove(&mut self, filename: &str) -> Option<FileEntry> {
+        self.files.remove(filename)
+    }
+
+    /// Removes and returns the files indexed into a collection other than
+    /// `collection` (`None` being the untagged files).
+    ///
+    /// An indexing run only updates the files of its own collection; the
+    /// others are put back into the new manifest as they were.
+    pub fn take_other_collections(
+        &mut self,
+        collection: Option<&str>,
+    ) -> BTreeMap<String, FileEntry> {
+        let (own, others) = std::mem::take(&mut self.files)
+            .into_iter()
+            .partition(|(_, entry)| entry.collection.as_deref() == collection);
+        self.files = own;
+        others
+    }
+
+    /// Chunks stored only as another location of a chunk, see [`FileEntry::merged`].
+    pub fn merged_chunks(&self) -> usize {
+        self.files
+            .values()
+            .flat_map(|entry| entry.merged.values())
+            .sum()
+    }
+
+    /// Maps content hashes to the files that carried them.
+    ///
+    /// Used to recognise renames: a new path whose hash matches a file that
+    /// disappeared can reuse the stored vectors instead of being re-embedded.
+    pub fn files_by_hash(&self) -> BTreeMap<&str, Vec<&str>> {
+        let mut by_hash: BTreeMap<&str, Vec<&str>> = BTreeMap::new();
+        for (filename, entry) in &self.files {
+            by_hash
+                .entry(entry.hash.as_str())
+                .or_default()
+                .push(filename.as_str());
+        }
+        by_hash
+    }
+}
+
+/// Verifies that the index in `db_path` was built with the given embedder.
+///
+/// Indexes without a manifest (or without recorded model information) are
+/// accepted as-is.
+pub fn ensure_compatible_embedder(
+    db_path: &str,
+    model: &str,
+    dim: usize,
+) -> Result<(), CodeRagError> {
+    let manifest =
+        IndexManifest::load(db_path).map_err(|e| CodeRagError::Database(format!("{:#}", e)))?;
+    match manifest {
+        Some(manifest) => manifest.check_embedder(model, dim),
+        None => Ok(()),
+    }
+}
+
+/// Records that an indexing run started writing to `db_path`.
+///
+/// The marker is removed by [`clear_in_progress`] once the run finished. A
+/// marker left behind means the run was interrupted and the index may be
+/// partially written.
+pub fn mark_in_progress(db_path: &str) -> Result<()> {
+    fs::create_dir_all(db_path)
+        .with_context(|| format!("Failed to create database directory {}", db_path))?;
+    let path = Path::new(db_path).join(IN_PROGRESS_FILE);
+    fs::write(&path, std::process::id().to_string())
+        .with_context(|| format!("Failed to write {}", path.display()))?;
+    Ok(())
+}
+
+/// Removes the marker written by [`mark_in_progress`].
+pub fn clear_in_progress(db_path: &str) -> Result<()> {
+    let path = Path::new(db_path).join(IN_PROGRESS_FILE);
+    match fs::remove_file(&path) {
+        Ok(()) => Ok(()),
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(()),
+        Err(e) => Err(e).with_context(|| format!("Failed to remove {}", path.display())),
+    }
+}
+
+/// Returns true if an indexing run is writing to `db_path` or was interrupted.
+pub fn is_in_progress(db_path: &str) -> bool {
+    Path::new(db_path).join(IN_PROGRESS_FILE).exists()
+}
+
+/// Records that the index in `db_path` changed by writing a new version token.
+///
+/// Called by every writer (`index`, `watch`) so query caches keyed by
+/// [`index_version`] stop serving results of the previous contents.
+pub fn bump_index_version(db_path: &str) -> Result<()> {
+    fs::create_dir_all(db_path)
+        .with_context(|| format!("Failed to create database directory {}", db_path))?;
+    let path = Path::new(db_path).join(INDEX_VERSION_FILE);
+    let previous = fs::read_to_string(&path).unwrap_or_default();
+    let nanos = std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)
+        .map(|d| d.as_nanos())
+        .unwrap_or_default();
+    let token = hash_bytes(format!("{}:{}:{}", previous, std::process::id(), nanos).as_bytes());
+    fs::write(&path, token).with_context(|| format!("Failed to write {}", path.display()))?;
+    Ok(())
+}
+
+/// Identifies the current contents of the index in `db_path`.
+///
+/// The token written by [`bump_index_version`], or for indexes built before
+/// it existed the hash of the manifest. `None` if neither is present.
+pub fn index_version(db_path: &str) -> Option<String> {
+    match fs::read_to_string(Path::new(db_path).join(INDEX_VERSION_FILE)) {
+        Ok(token) => Some(token.trim().to_string()),
+        Err(_) => hash_file(&IndexManifest::path(db_path)).ok(),
+    }
+}
+
+/// Computes the hex-encoded SHA-256 of a file without loading it fully into memory.
+pub fn hash_file(path: &Path) -> std::io::Result<String> {
+    let mut file = fs::File::open(path)?;
+    let mut hasher = Sha256::new();
+    let mut buf = [0u8; 8192];
+    loop {
+        let n = file.read(&mut buf)?;
+        if n == 0 {
+            break;
+        }
+        hasher.update(&buf[..n]);
+    }
+    Ok(format!("{:x}", hasher.finalize()))
+}
+
+/// Computes the hex-encoded SHA-256 of an in-memory buffer.
+pub fn hash_bytes(bytes: &[u8]) -> String {
+    format!("{:x}", Sha256::digest(bytes))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn entry(hash: &str) -> FileEntry {
+        FileEntry {
+            hash: hash.to_string(),
+            mtime: 1,
+            chunk_ids: vec!["a.rs-1-2".to_string()],
+            collection: None,
+            merged: BTreeMap::new(),
+            tags: Vec::new(),
+        }
+    }
+
+    #[test]
+    fn test_load_missing_manifest() {
+        let dir = TempDir::new().unwrap();
+        let loaded = IndexManifest::load(dir.path().to_str().unwrap()).unwrap();
+        assert!(loaded.is_none());
+    }
+
+    #[test]
+    fn test_save_and_load_roundtrip() {
+        let dir = TempDir::new().unwrap();
+        let db_path = dir.path().to_str().unwrap();
+
+        let mut manifest = IndexManifest::default();
+        manifest.insert("a.rs".to_string(), entry("abc"));
+        manifest.save(db_path).unwrap();
+
+        let loaded = IndexManifest::load(db_path).unwrap().unwrap();
+        assert_eq!(loaded.version, MANIFEST_VERSION);
+        assert_eq!(loaded.get("a.rs"), Some(&entry("abc")));
+        assert!(!IndexManifest::path(db_path)
+            .with_extension("json.tmp")
+            .exists());
+    }
+
+    #[test]
+    fn test_load_rejects_newer_version() {
+        let dir = TempDir::new().unwrap();
+        let db_path = dir.path().to_str().unwrap();
+
+        let manifest = IndexManifest {
+            version: MANIFEST_VERSION + 1,
+            ..Default::default()
+        };
+        manifest.save(db_path).unwrap();
+
+        assert!(IndexManifest::load(db_path).is_err());
+    }
+
+    #[test]
+    fn test_files_by_hash() {
+        let mut manifest = IndexManifest::default();
+        manifest.insert("a.rs".to_string(), entry("same"));
+        manifest.insert("b.rs".to_string(), entry("same"));
+        manifest.insert("c.rs".to_string(), entry("other"));
+
+        let by_hash = manifest.files_by_hash();
+        assert_eq!(by_hash["same"], vec!["a.rs", "b.rs"]);
+        assert_eq!(by_hash["other"], vec!["c.rs"]);
+    }
+
+    #[test]
+    fn test_take_other_collections() {
+        let mut manifest = IndexManifest::default();
+        manifest.insert("a.rs".to_string(), entry("a"));
+        for (filename, collection) in [("api.go", "backend"), ("app.ts", "frontend")] {
+            let mut tagged = entry(filename);
+            tagged.collection = Some(collection.to_string());
+            manifest.insert(filename.to_string(), tagged);
+        }
+
+        let others = manifest.take_other_collections(Some("backend"));
+        assert_eq!(manifest.files.keys().collect::<Vec<_>>(), vec!["api.go"]);
+        assert_eq!(others.keys().collect::<Vec<_>>(), vec!["a.rs", "app.ts"]);
+
+        let mut untagged = IndexManifest {
+            files: others,
+            ..Default::default()
+        };
+        let others = untagged.take_other_collections(None);
+        assert_eq!(untagged.files.keys().collect::<Vec<_>>(), vec!["a.rs"]);
+        assert_eq!(others.keys().collect::<Vec<_>>(), vec!["app.ts"]);
+    }
+
+    #[test]
+    fn test_check_embedder() {
+        let manifest = IndexManifest {
+            embedding_model: Some("nomic-embed-text-v1.5".to_string()),
+            embedding_dim: Some(768),
+            ..Default::default()
+        };
+        assert!(manifest
+            .check_embedder("nomic-embed-text-v1.5", 768)
+            .is_ok());
+        assert!(matches!(
+            manifest.check_embedder("text-embedding-3-small", 1536),
+            Err(CodeRagError::DimensionMismatch(_))
+        ));
+        assert!(matches!(
+            manifest.check_embedder("nomic-embed-text-v1.5", 512),
+            Err(CodeRagError::DimensionMismatch(_))
+        ));
+
+        // Manifests written before model tracking accept any embedder
+        assert!(IndexManifest::default().check_embedder("any", 3).is_ok());
+    }
+
+    #[test]
+    fn test_in_progress_marker() {
+        let dir = TempDir::new().unwrap();
+        let db_path = dir.path().join("db");
+        let db_path = db_path.to_str().unwrap();
+
+        assert!(!is_in_progress(db_path));
+        mark_in_progress(db_path).unwrap();
+        assert!(is_in_progress(db_path));
+        clear_in_progress(db_path).unwrap();
+        assert!(!is_in_progress(db_path));
+        // Clearing twice is not an error
+        clear_in_progress(db_path).unwrap();
+    }
+
+    #[test]
+    fn test_index_version_changes_on_bump() {
+        let dir = TempDir::new().unwrap();
+        let db_path = dir.path().to_str().unwrap();
+
+        assert_eq!(index_version(db_path), None);
+        // Indexes without a version token fall back to the manifest hash
+        IndexManifest::default().save(db_path).unwrap();
+        let legacy = index_version(db_path).unwrap();
+
+        bump_index_version(db_path).unwrap();
+        let first = index_version(db_path).unwrap();
+        assert_ne!(first, legacy);
+        bump_index_version(db_path).unwrap();
+        assert_ne!(index_version(db_path).unwrap(), first);
+    }
+
+    #[test]
+    fn test_checkpoint_is_separate_from_manifest() {
+        let dir = TempDir::new().unwrap();
+        let db_path = dir.path().to_str().unwrap();
+
+        let mut done = IndexManifest::default();
+        done.insert("a.rs".to_string(), entry("abc"));
+        done.save_checkpoint(db_path).unwrap();
+
+        assert!(IndexManifest::load(db_path).unwrap().is_none());
+        let loaded = IndexManifest::load_checkpoint(db_path).unwrap().unwrap();
+        assert_eq!(loaded.get("a.rs"), Some(&entry("abc")));
+
+        IndexManifest::clear_checkpoint(db_path).unwrap();
+        assert!(IndexManifest::load_checkpoint(db_path).unwrap().is_none());
+        IndexManifest::clear_checkpoint(db_path).unwrap();
+    }
+
+    #[test]
+    fn test_hash_file_matches_hash_bytes() {
+        let dir = TempDir::new().unwrap();
+        let path = dir.path().join("f.txt");
+        fs::write(&path, b"hello world").unwrap();
+
+        assert_eq!(hash_file(&path).unwrap(), hash_bytes(b"hello world"));
+        assert_eq!(
+            hash_bytes(b"hello world"),
+            "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"
+        );
+    }
+}
@@ -1,22 +1,30 @@
 use crate::bm25::BM25Index;
-use crate::embedding::Embedder;
-use crate::indexer::CodeChunker;
-use crate::storage::Storage;
+use crate::embedding::{Embedder, EmbeddingCache};
+use crate::indexer::{blame_chunks, CodeChunk, CodeChunker, Facet, NonText};
+use crate::redact::Redactor;
+use crate::storage::{FacetVectors, VectorStore};
+use crate::summary::Summarizer;
 use std::fs;
 use std::path::Path;
-use tracing::{error, info, warn};
+use std::time::Instant;
+use tracing::{debug, error, info, warn};
 
 pub struct CodeIndexer<'a> {
-    storage: &'a Storage,
+    storage: &'a dyn VectorStore,
     embedder: &'a mut Embedder,
     bm25: &'a mut BM25Index,
     chunker: &'a CodeChunker,
+    redactor: Option<&'a Redactor>,
+    summarizer: Option<&'a Summarizer>,
+    embedding_cache: Option<&'a EmbeddingCache>,
+    blame: bool,
+    max_file_size: Option<u64>,
     workspace: String,
 }
 
 impl<'a> CodeIndexer<'a> {
     pub fn new(
-        storage: &'a Storage,
+        storage: &'a dyn VectorStore,
         embedder: &'a mut Embedder,
         bm25: &'a mut BM25Index,
         chunker: &'a CodeChunker,
@@ -27,102 +35,226 @@ impl<'a> CodeIndexer<'a> {
             embedder,
             bm25,
             chunker,
+            redactor: None,
+            summarizer: None,
+            embedding_cache: None,
+            blame: false,
+            max_file_size: None,
             workspace,
         }
     }
 
+    /// Redacts secrets from chunks before they are embedded and stored.
+    pub fn with_redactor(mut self, redactor: Option<&'a Redactor>) -> Self {
+        self.redactor = redactor;
+        self
+    }
+
+    /// Summarizes oversized chunks before they are stored.
+    pub fn with_summarizer(mut self, summarizer: Option<&'a Summarizer>) -> Self {
+        self.summarizer = summarizer;
+        self
+    }
+
+    /// Looks up chunk texts in `cache` first and only embeds the others.
+    pub fn with_embedding_cache(mut self, cache: Option<&'a EmbeddingCache>) -> Self {
+        self.embedding_cache = cache;
+        self
+    }
+
+    /// Dates chunks by `git blame` of their lines, see [`blame_chunks`].
+    pub fn with_blame(mut self, blame: bool) -> Self {
+        self.blame = blame;
+        self
+    }
+
+    /// Skips files larger than `max_file_size` bytes; `None` indexes any size.
+    pub fn with_max_file_size(mut self, max_file_size: Option<u64>) -> Self {
+        self.max_file_size = max_file_size;
+        self
+    }
+
     /// Indexes a single file.
-    /// 1. Checks if it's a supported code file.
+    /// 1. Checks if it's a supported code or documentation file within the
+    ///    size limit, and UTF-8 text.
     /// 2. Checks modification time (deltas) if needed.
-    /// 3. Chunks the file.
+    /// 3. Chunks the file, dates the chunks with `git blame` if enabled,
+    ///    redacts secrets and summarizes oversized chunks.
     /// 4. Generates embeddings.
-    /// 5. Stores chunks in LanceDB and BM25.
-    pub async fn index_file(&mut self, path: &Path, mtime: i64) -> anyhow::Result<()> {
+    /// 5. Stores chunks in LanceDB and BM25, in place of the file's old ones.
+    ///
+    /// The old chunks are swapped for the new in one
+    /// [`replace_files`](VectorStore::replace_files), so a server searching
+    /// the index meanwhile finds one version of the file or the other. A file
+    /// that can no longer be indexed is removed.
+    ///
+    /// Returns the stored chunks (empty if the file was skipped). BM25 changes
+    /// become visible after [`commit`](Self::commit).
+    pub async fn index_file(&mut self, path: &Path, mtime: i64) -> anyhow::Result<Vec<CodeChunk>> {
         let path_lossy = path.to_string_lossy();
         let fname_str = path_lossy.to_string();
 
         let ext = path.extension().and_then(|s| s.to_str()).unwrap_or("");
-        if CodeChunker::get_language(ext).is_none() {
-            return Ok(()); // Skip unsupported files silently
+        if !CodeChunker::is_supported(ext) {
+            return Ok(Vec::new()); // Skip unsupported files silently
         }
 
-        // Clean up old entries first
+        let (chunks, embeddings, facet_vectors) = self
+            .prepare_file(path, &fname_str, mtime)
+            .await
+            .unwrap_or_default();
+
         if let Err(e) = self
             .storage
-            .delete_file_chunks(&fname_str, &self.workspace)
+            .replace_files_with_facets(
+                &self.workspace,
+                std::slice::from_ref(&fname_str),
+                &chunks,
+                embeddings,
+                facet_vectors,
+            )
             .await
         {
-            warn!("Error deleting old chunks for {}: {}", fname_str, e);
+            error!("Error storing chunks for {}: {}", fname_str, e);
         }
+
         if let Err(e) = self.bm25.delete_file(&fname_str, &self.workspace) {
             warn!("Error deleting old BM25 docs for {}: {}", fname_str, e);
         }
+        if let Err(e) = self.bm25.add_chunks(&chunks, &self.workspace) {
+            error!("Error adding to BM25 for {}: {}", fname_str, e);
+        }
+        Ok(chunks)
+    }
 
-        let file = match fs::File::open(path) {
-            Ok(f) => f,
+    /// Reads, chunks and embeds a file, together with the facets the store
+    /// keeps, or `None` if it is skipped.
+    async fn prepare_file(
+        &self,
+        path: &Path,
+        fname_str: &str,
+        mtime: i64,
+    ) -> Option<(Vec<CodeChunk>, Vec<Vec<f32>>, Vec<FacetVectors>)> {
+        if let Some(limit) = self.max_file_size {
+            if fs::metadata(path).is_ok_and(|m| m.len() > limit) {
+                warn!(
+                    "Skipping file {} - exceeds limit of {} bytes",
+                    fname_str, limit
+                );
+                return None;
+            }
+        }
+        let content = match fs::read(path) {
+            Ok(content) => content,
             Err(e) => {
                 warn!("Failed to read file {}: {}", fname_str, e);
-                return Ok(());
+                return None;
             }
         };
-        let mut reader = std::io::BufReader::new(file);
+        match NonText::detect(&content) {
+            Some(NonText::Binary) => {
+                debug!("Skipping binary file {}", fname_str);
+                return None;
+            }
+            Some(NonText::NotUtf8) => {
+                warn!("Skipping file {} - not valid UTF-8", fname_str);
+                return None;
+            }
+            None => {}
+        }
+        let mut reader = std::io::Cursor::new(content);
 
-        let chunks = match self.chunker.chunk_file(&fname_str, &mut reader, mtime) {
+        let mut chunks = match self.chunker.chunk_file(fname_str, &mut reader, mtime) {
             Ok(c) => c,
             Err(e) => {
                 warn!("Failed to chunk file {}: {}", fname_str, e);
-                return Ok(());
+                return None;
             }
         };
 
         if chunks.is_empty() {
-            return Ok(());
+            return None;
+        }
+        if self.blame {
+            blame_chunks(&mut chunks, path);
+        }
+        if let Some(redactor) = self.redactor {
+            redactor.redact_chunks(&mut chunks);
+        }
+        if let Some(summarizer) = self.summarizer {
+            summarizer.summarize_chunks(&mut chunks).await;
         }
 
-        let texts: Vec<String> = chunks.iter().map(|c| c.code.clone()).collect();
-        let embeddings = match self.embedder.embed(texts, Some(256)) {
+        let started = Instant::now();
+        let embeddings = match self.embed_chunks(&chunks) {
             Ok(e) => e,
             Err(e) => {
                 error!("Error generating embeddings for {}: {}", fname_str, e);
-                return Ok(());
+                return None;
             }
         };
-
-        let ids: Vec<String> = chunks
-            .iter()
-            .map(|c| format!("{}-{}-{}", c.filename, c.line_start, c.line_end))
-            .collect();
-        let filenames: Vec<String> = chunks.iter().map(|c| c.filename.clone()).collect();
-        let codes: Vec<String> = chunks.iter().map(|c| c.code.clone()).collect();
-        let starts: Vec<i32> = chunks.iter().map(|c| c.line_start as i32).collect();
-        let ends: Vec<i32> = chunks.iter().map(|c| c.line_end as i32).collect();
-        let mtimes: Vec<i64> = chunks.iter().map(|c| c.last_modified).collect();
-        let calls: Vec<Vec<String>> = chunks.iter().map(|c| c.calls.clone()).collect();
-
-        if let Err(e) = self
-            .storage
-            .add_chunks(
-                &self.workspace,
-                ids,
-                filenames,
-                codes,
-                starts,
-                ends,
-                mtimes,
-                calls,
-                embeddings,
-            )
-            .await
+        let facet_vectors = match embed_facets(
+            &chunks,
+            self.storage.facets(),
+            self.embedding_cache,
+            |texts| async move { self.embedder.embed(texts, Some(256)) },
+        )
+        .await
         {
-            error!("Error storing chunks for {}: {}", fname_str, e);
-        }
+            Ok(v) => v,
+            Err(e) => {
+                // The chunks are still searchable by their own vectors
+                warn!(
+                    "Error embedding facets of {}, storing it without them: {}",
+                    fname_str, e
+                );
+                Vec::new()
+            }
+        };
+        info!(
+            "Indexed {}: {} chunks, embedded in {} ms",
+            fname_str,
+            chunks.len(),
+            started.elapsed().as_millis()
+        );
+        Some((chunks, embeddings, facet_vectors))
+    }
 
-        if let Err(e) = self.bm25.add_chunks(&chunks, &self.workspace) {
-            error!("Error adding to BM25 for {}: {}", fname_str, e);
+    /// Embeds the text of `chunks`, reusing the vectors the embedding cache
+    /// has for unchanged texts. Cache failures only cost a re-embedding.
+    fn embed_chunks(&self, chunks: &[CodeChunk]) -> anyhow::Result<Vec<Vec<f32>>> {
+        let texts: Vec<&str> = chunks.iter().map(|c| c.code.as_str()).collect();
+        let mut vectors: Vec<Option<Vec<f32>>> = match self.embedding_cache {
+            Some(cache) => cache.get_many(&texts).unwrap_or_else(|e| {
+                warn!("Embedding cache lookup failed: {:#}", e);
+                vec![None; texts.len()]
+            }),
+            None => vec![None; texts.len()],
+        };
+        let missing: Vec<usize> = (0..texts.len()).filter(|&i| vectors[i].is_none()).collect();
+        if !missing.is_empty() {
+            let embedded = self.embedder.embed(
+                missing.iter().map(|&i| texts[i].to_string()).collect(),
+                Some(256),
+            )?;
+            if let Some(cache) = self.embedding_cache {
+                let fresh: Vec<(&str, &[f32])> = missing
+                    .iter()
+                    .zip(&embedded)
+                    .map(|(&i, vector)| (texts[i], vector.as_slice()))
+                    .collect();
+                if let Err(e) = cache.insert_many(&fresh) {
+                    warn!("Failed to update embedding cache: {:#}", e);
+                }
+            }
+            for (&i, vector) in missing.iter().zip(embedded) {
+                vectors[i] = Some(vector);
+            }
         }
-
-        info!("Indexed: {}", fname_str);
-        Ok(())
+        vectors
+            .into_iter()
+            .map(|v| v.ok_or_else(|| anyhow::anyhow!("Embedder returned too few vectors")))
+            .collect()
     }
 
     /// Removes a file from the index.
@@ -137,4 +269,78 @@ impl<'a> CodeIndexer<'a> {
         info!("Removed: {}", fname_str);
         Ok(())
     }
+
+    /// Commits pending BM25 changes to disk.
+    pub fn commit(&self) -> anyhow::Result<()> {
+        self.bm25.commit()
+    }
+}
+
+/// Embeds the `facets` of `chunks` (see [`Facet::text`]) for
+/// [`replace_files_with_facets`](VectorStore::replace_files_with_facets),
+/// reusing the vectors `cache` has for their texts and calling `embed` for the
+/// others. Nothing is embedded without facets.
+pub async fn embed_facets<F>(
+    chunks: &[CodeChunk],
+    facets: &[Facet],
+    cache: Option<&EmbeddingCache>,
+    embed: impl FnOnce(Vec<String>) -> F,
+) -> anyhow::Result<Vec<FacetVectors>>
+where
+    F: std::future::Future<Output = anyhow::Result<Vec<Vec<f32>>>>,
+{
+    let mut output: Vec<FacetVectors> = facets
+        .iter()
+        .map(|&facet| FacetVectors {
+            facet,
+            vectors: vec![None; chunks.len()],
+        })
+        .collect();
+    // (facet, chunk, text) of every facet text to embed
+    let wanted: Vec<(usize, usize, String)> = facets
+        .iter()
+        .enumerate()
+        .flat_map(|(f, facet)| {
+            chunks
+                .iter()
+                .enumerate()
+                .filter_map(move |(i, chunk)| Some((f, i, facet.text(chunk)?)))
+        })
+        .collect();
+    if wanted.is_empty() {
+        return Ok(output);
+    }
+
+    let texts: Vec<&str> = wanted.iter().map(|(_, _, text)| text.as_str()).collect();
+    let mut vectors: Vec<Option<Vec<f32>>> = match cache {
+        Some(cache) => cache.get_many(&texts).unwrap_or_else(|e| {
+            warn!("Embedding cache lookup failed: {:#}", e);
+            vec![None; texts.len()]
+        }),
+        None => vec![None; texts.len()],
+    };
+    let missing: Vec<usize> = (0..texts.len()).filter(|&i| vectors[i].is_none()).collect();
+    if !missing.is_empty() {
+        let embedded = embed(missing.iter().map(|&i| texts[i].to_string()).collect()).await?;
+        if embedded.len() != missing.len() {
+            anyhow::bail!("Embedder returned too few vectors");
+        }
+        if let Some(cache) = cache {
+            let fresh: Vec<(&str, &[f32])> = missing
+                .iter()
+                .zip(&embedded)
+                .map(|(&i, vector)| (texts[i], vector.as_slice()))
+                .collect();
+            if let Err(e) = cache.insert_many(&fresh) {
+                warn!("Failed to update embedding cache: {:#}", e);
+            }
+        }
+        for (&i, vector) in missing.iter().zip(embedded) {
+            vectors[i] = Some(vector);
+        }
+    }
+    for ((f, i, _), vector) in wanted.iter().zip(vectors) {
+        output[*f].vectors[*i] = vector;
+    }
+    Ok(output)
 }
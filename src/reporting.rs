@@ -18,6 +18,7 @@ pub fn generate_html_report(query: &str, results: &[SearchResult]) -> Result<Str
         .meta { display: flex; justify-content: space-between; color: #666; font-size: 0.9em; margin-bottom: 10px; }
         .score { font-weight: bold; color: #2ecc71; }
         .filename { color: #3498db; font-weight: bold; }
+        .symbol { color: #8e44ad; font-family: monospace; }
         .calls { font-size: 0.85em; color: #d35400; margin-top: 10px; border-top: 1px solid #eee; padding-top: 5px; }
         .call-tag { background: #fae5d3; padding: 2px 6px; border-radius: 4px; margin-right: 5px; display: inline-block; }
         pre { background: #f8f8f8; padding: 15px; border-radius: 4px; overflow-x: auto; font-size: 0.9em; border: 1px solid #eee; }
@@ -34,6 +35,7 @@ pub fn generate_html_report(query: &str, results: &[SearchResult]) -> Result<Str
         <div class="meta">
             <span class="rank">#{{ result.rank }}</span>
             <span class="filename">{{ result.filename }}:{{ result.line_start }}-{{ result.line_end }}</span>
+            {% if result.symbol %}<span class="symbol">{{ result.symbol }}</span>{% endif %}
             <span class="score">Score: {{ "%.4f"|format(result.score) }}</span>
         </div>
         <pre><code>{{ result.code }}</code></pre>
@@ -0,0 +1,169 @@
+use crate::core::CancelToken;
+use crate::embedding::Embedder;
+use crate::llm::{LlmReranker, OllamaClient};
+use crate::search::SearchResult;
+use anyhow::{anyhow, Result};
+use async_trait::async_trait;
+use std::path::Path;
+use std::sync::Arc;
+use tracing::warn;
+
+mod onnx;
+
+pub use onnx::{OnnxReranker, OnnxRerankerOptions, DEFAULT_RERANK_BATCH_SIZE};
+
+/// Number of fused candidates handed to the reranker when not configured.
+pub const DEFAULT_RERANK_TOP_K: usize = 30;
+
+/// Second-stage scorer applied to the top candidates of a search.
+///
+/// Implementations receive the query and the candidates in their first-stage
+/// order and return `(candidate_index, score)` pairs, higher meaning more
+/// relevant. Candidates missing from the output are dropped.
+#[async_trait]
+pub trait Reranker: Send + Sync {
+    async fn rerank(&self, query: &str, candidates: &[SearchResult]) -> Result<Vec<(usize, f32)>>;
+
+    /// Like [`rerank`](Self::rerank), failing with
+    /// [`CodeRagError::Cancelled`](crate::core::CodeRagError::Cancelled) once
+    /// `cancel` is cancelled. By default the pending call is dropped; rerankers
+    /// scoring on a blocking thread also stop there between batches.
+    async fn rerank_cancellable(
+        &self,
+        query: &str,
+        candidates: &[SearchResult],
+        cancel: &CancelToken,
+    ) -> Result<Vec<(usize, f32)>> {
+        cancel.run(self.rerank(query, candidates)).await?
+    }
+
+    /// Names the reranker and its model, e.g. `onnx:/models/ms-marco`. Cached
+    /// query results are keyed by it, so switching models re-ranks.
+    fn name(&self) -> String {
+        std::any::type_name::<Self>().to_string()
+    }
+}
+
+/// Reranker backed by the local cross-encoder model of an [`Embedder`].
+pub struct CrossEncoderReranker {
+    embedder: Arc<Embedder>,
+}
+
+impl CrossEncoderReranker {
+    pub fn new(embedder: Arc<Embedder>) -> Self {
+        Self { embedder }
+    }
+}
+
+#[async_trait]
+impl Reranker for CrossEncoderReranker {
+    async fn rerank(&self, query: &str, candidates: &[SearchResult]) -> Result<Vec<(usize, f32)>> {
+        let embedder = self.embedder.clone();
+        let query = query.to_string();
+        let texts: Vec<String> = candidates.iter().map(|c| c.code.clone()).collect();
+        let top_k = texts.len();
+
+        tokio::task::spawn_blocking(move || embedder.rerank(&query, texts, top_k))
+            .await
+            .map_err(|e| anyhow!("Reranker task failed: {}", e))?
+    }
+
+    fn name(&self) -> String {
+        format!("cross-encoder:{}", self.embedder.reranker_model_name())
+    }
+}
+
+/// Builds the reranker named by the `reranker` config key.
+///
+/// * `"cross-encoder"` - the embedder's local cross-encoder (default).
+/// * `"onnx"` - the cross-encoder exported to ONNX in `onnx.model_path`.
+/// * `"llm"` - asks the Ollama model `llm_model` at `llm_host` to score each candidate.
+/// * `"none"` - no second stage; results keep their first-stage order.
+///
+/// An `onnx` model that fails to load, e.g. because the ONNX Runtime is
+/// missing, disables reranking with a warning saying how to fix it, rather
+/// than failing every search.
+pub fn create_reranker(
+    kind: &str,
+    embedder: Option<Arc<Embedder>>,
+    llm_host: &str,
+    llm_model: &str,
+    onnx: &OnnxRerankerOptions,
+) -> Result<Option<Arc<dyn Reranker>>> {
+    match kind {
+        "cross-encoder" | "" => {
+            Ok(embedder.map(|e| Arc::new(CrossEncoderReranker::new(e)) as Arc<dyn Reranker>))
+        }
+        "onnx" => {
+            let dir = onnx.model_path.as_deref().ok_or_else(|| {
+                anyhow!(
+                    "reranker = \"onnx\" needs reranker_onnx_path, the directory of a cross-encoder exported to ONNX"
+                )
+            })?;
+            match OnnxReranker::load(Path::new(dir), onnx.batch_size) {
+                Ok(reranker) => Ok(Some(Arc::new(reranker) as Arc<dyn Reranker>)),
+                Err(e) => {
+                    warn!(
+                        "{:#}. Reranking is disabled; fix reranker_onnx_path or set reranker = \"cross-encoder\" to use the built-in model.",
+                        e
+                    );
+                    Ok(None)
+                }
+            }
+        }
+        "llm" => {
+            let client = OllamaClient::new(llm_host, llm_model);
+            Ok(Some(Arc::new(
+                LlmReranker::new(Arc::new(client)).with_model(llm_model),
+            )))
+        }
+        "none" => Ok(None),
+        other => anyhow::bail!(
+            "Unknown reranker '{}'. Expected one of: cross-encoder, onnx, llm, none",
+            other
+        ),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const HOST: &str = "http://localhost:11434";
+
+    #[test]
+    fn test_create_reranker_selection() {
+        let onnx = OnnxRerankerOptions::default();
+        // Cross-encoder needs an embedder; without one reranking is skipped.
+        assert!(
+            create_reranker("cross-encoder", None, HOST, "mistral", &onnx)
+                .unwrap()
+                .is_none()
+        );
+        assert!(create_reranker("llm", None, HOST, "mistral", &onnx)
+            .unwrap()
+            .is_some());
+        assert!(create_reranker("none", None, HOST, "mistral", &onnx)
+            .unwrap()
+            .is_none());
+        assert!(create_reranker("bogus", None, HOST, "mistral", &onnx).is_err());
+    }
+
+    #[test]
+    fn test_create_onnx_reranker() {
+        let err = create_reranker("onnx", None, HOST, "mistral", &Default::default())
+            .err()
+            .unwrap();
+        assert!(err.to_string().contains("reranker_onnx_path"), "{}", err);
+
+        // A model that can't be loaded disables reranking instead of failing
+        let dir = tempfile::TempDir::new().unwrap();
+        let onnx = OnnxRerankerOptions {
+            model_path: Some(dir.path().to_string_lossy().to_string()),
+            batch_size: 8,
+        };
+        assert!(create_reranker("onnx", None, HOST, "mistral", &onnx)
+            .unwrap()
+            .is_none());
+    }
+}
@@ -0,0 +1,177 @@
+use super::Reranker;
+use crate::config::{expand_home, AppConfig};
+use crate::core::CancelToken;
+use crate::embedding::load_tokenizer_files;
+use crate::search::SearchResult;
+use anyhow::{anyhow, Context, Result};
+use async_trait::async_trait;
+use fastembed::{RerankInitOptionsUserDefined, TextRerank, UserDefinedRerankingModel};
+use std::any::Any;
+use std::fs;
+use std::panic::{self, AssertUnwindSafe};
+use std::path::Path;
+use std::sync::{Arc, Mutex};
+
+/// Default `rerank_batch_size`.
+pub const DEFAULT_RERANK_BATCH_SIZE: usize = 16;
+
+/// Model directory and batching of the `onnx` reranker.
+#[derive(Debug, Clone, Default)]
+pub struct OnnxRerankerOptions {
+    /// Directory holding `model.onnx` and the tokenizer files
+    pub model_path: Option<String>,
+    /// (query, chunk) pairs scored per inference call; 0 for the default
+    pub batch_size: usize,
+}
+
+impl OnnxRerankerOptions {
+    /// Reads `reranker_onnx_path`, expanding a leading `~`, and
+    /// `rerank_batch_size`.
+    pub fn from_config(config: &AppConfig) -> Self {
+        Self {
+            model_path: config.reranker_onnx_path.as_deref().map(expand_home),
+            batch_size: config.rerank_batch_size,
+        }
+    }
+}
+
+/// Message of a panic raised while the ONNX Runtime was being loaded.
+fn panic_message(payload: &(dyn Any + Send)) -> &str {
+    payload
+        .downcast_ref::<String>()
+        .map(String::as_str)
+        .or_else(|| payload.downcast_ref::<&str>().copied())
+        .unwrap_or("unknown error")
+}
+
+/// Reranker that scores (query, chunk) pairs with a cross-encoder exported to
+/// ONNX, such as `cross-encoder/ms-marco-MiniLM-L-6-v2`, loaded from a local
+/// directory instead of the models fastembed downloads.
+pub struct OnnxReranker {
+    model: Arc<Mutex<TextRerank>>,
+    batch_size: usize,
+    /// Directory the model was loaded from
+    dir: String,
+}
+
+impl OnnxReranker {
+    /// Loads the cross-encoder in `dir`, which must hold `model.onnx`,
+    /// `tokenizer.json`, `config.json`, `special_tokens_map.json` and
+    /// `tokenizer_config.json`.
+    ///
+    /// Fails if a file is missing or the ONNX Runtime can't create a session.
+    /// A runtime library that can't be loaded at all panics inside `ort`; the
+    /// panic is caught and returned as an error too.
+    pub fn load(dir: &Path, batch_size: usize) -> Result<Self> {
+        let onnx_path = dir.join("model.onnx");
+        let onnx_file = fs::read(&onnx_path)
+            .with_context(|| format!("Failed to read {}", onnx_path.display()))?;
+        let tokenizer_files = load_tokenizer_files(dir)
+            .with_context(|| format!("Failed to read the tokenizer files in {}", dir.display()))?;
+        let model = UserDefinedRerankingModel::new(onnx_file, tokenizer_files);
+
+        let session = panic::catch_unwind(AssertUnwindSafe(|| {
+            TextRerank::try_new_from_user_defined(model, RerankInitOptionsUserDefined::default())
+        }))
+        .map_err(|payload| {
+            anyhow!(
+                "The ONNX Runtime library could not be loaded ({}). Install ONNX Runtime and put \
+                libonnxruntime on the library path, or point ORT_DYLIB_PATH at it",
+                panic_message(payload.as_ref())
+            )
+        })?
+        .with_context(|| format!("Failed to load the cross-encoder in {}", dir.display()))?;
+
+        Ok(Self {
+            model: Arc::new(Mutex::new(session)),
+            dir: dir.to_string_lossy().to_string(),
+            batch_size: if batch_size == 0 {
+                DEFAULT_RERANK_BATCH_SIZE
+            } else {
+                batch_size
+            },
+        })
+    }
+}
+
+#[async_trait]
+impl Reranker for OnnxReranker {
+    async fn rerank(&self, query: &str, candidates: &[SearchResult]) -> Result<Vec<(usize, f32)>> {
+        self.rerank_cancellable(query, candidates, &CancelToken::default())
+            .await
+    }
+
+    async fn rerank_cancellable(
+        &self,
+        query: &str,
+        candidates: &[SearchResult],
+        cancel: &CancelToken,
+    ) -> Result<Vec<(usize, f32)>> {
+        if candidates.is_empty() {
+            return Ok(Vec::new());
+        }
+        let model = self.model.clone();
+        let query = query.to_string();
+        let texts: Vec<String> = candidates.iter().map(|c| c.code.clone()).collect();
+        let batch_size = self.batch_size;
+        let token = cancel.clone();
+
+        let scoring = tokio::task::spawn_blocking(move || {
+            let mut scored = Vec::with_capacity(texts.len());
+            // One inference call per batch, so a cancelled search stops in between
+            for (i, batch) in texts.chunks(batch_size).enumerate() {
+                token.check()?;
+                let documents: Vec<&str> = batch.iter().map(String::as_str).collect();
+                let results = model
+                    .lock()
+                    .map_err(|e| anyhow!("Reranker lock poisoned: {}", e))?
+                    .rerank(query.as_str(), documents, false, Some(batch_size))?;
+                let offset = i * batch_size;
+                scored.extend(results.into_iter().map(|r| (offset + r.index, r.score)));
+            }
+            Ok(scored)
+        });
+        cancel
+            .run(scoring)
+            .await?
+            .map_err(|e| anyhow!("Reranker task failed: {}", e))?
+    }
+
+    fn name(&self) -> String {
+        format!("onnx:{}", self.dir)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_load_reports_missing_files() {
+        let dir = TempDir::new().unwrap();
+        let err = OnnxReranker::load(dir.path(), 0).err().unwrap();
+        assert!(format!("{:#}", err).contains("model.onnx"), "{:#}", err);
+
+        fs::write(dir.path().join("model.onnx"), b"not a model").unwrap();
+        let err = OnnxReranker::load(dir.path(), 0).err().unwrap();
+        assert!(
+            format!("{:#}", err).contains("tokenizer files"),
+            "{:#}",
+            err
+        );
+    }
+
+    #[test]
+    fn test_panic_message() {
+        let payload: Box<dyn Any + Send> = Box::new("libonnxruntime.so not found");
+        assert_eq!(
+            panic_message(payload.as_ref()),
+            "libonnxruntime.so not found"
+        );
+        let payload: Box<dyn Any + Send> = Box::new(format!("version {}", 17));
+        assert_eq!(panic_message(payload.as_ref()), "version 17");
+        let payload: Box<dyn Any + Send> = Box::new(17);
+        assert_eq!(panic_message(payload.as_ref()), "unknown error");
+    }
+}
@@ -1,22 +1,63 @@
 use crate::bm25::BM25Index;
+use crate::callgraph::CallGraph;
+use crate::core::CancelToken;
 use crate::embedding::Embedder;
+use crate::indexer::{ChunkLocation, ChunkPart, CodeChunk, DocType};
 use crate::llm::QueryExpander;
-use crate::storage::Storage;
+use crate::rerank::{CrossEncoderReranker, Reranker, DEFAULT_RERANK_TOP_K};
+use crate::storage::VectorStore;
 use anyhow::{anyhow, Context, Result};
-use arrow_array::{Array, Int32Array, Int64Array, ListArray, StringArray};
 use grep_regex::RegexMatcher;
 use grep_searcher::sinks::UTF8;
 use grep_searcher::Searcher;
 use ignore::WalkBuilder;
 use serde::Serialize;
+use std::collections::BTreeMap;
 use std::error::Error;
 use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+mod cache;
+mod code;
+mod explain;
+mod filter;
+mod graph;
+mod merge;
+mod mmr;
+mod names;
+mod query;
+mod refine;
+mod similar;
+mod source;
+mod symbol;
+mod tags;
+
+pub use cache::{CachedHit, QueryCache, QUERY_CACHE_FILE};
+pub use code::code_query_terms;
+pub use explain::ScoreExplanation;
+pub use filter::{CandidateFilter, Filterable, TestFilter};
+pub use merge::interleave_sources;
+pub use mmr::{mmr_select, MMR_POOL_FACTOR};
+pub use names::DEFAULT_SYMBOL_WEIGHT;
+pub use query::{Citation, QueryOptions, QueryResult};
+pub use refine::RefineOptions;
+pub(crate) use similar::normalize_path;
+pub use similar::{symbol_matches, SimilarTarget};
+pub use source::attach_source_context;
+pub use tags::{parse_tag_boost, DEFAULT_TAG_BOOST};
+
+/// Weight of the original query's vector ranking relative to each phrasing
+/// added by query expansion, so expansion augments the results instead of
+/// outvoting them.
+pub const ORIGINAL_QUERY_BOOST: f64 = 1.2;
 
 /// A single search result from code search.
 ///
 /// Contains the matched code chunk with metadata and relevance score.
-#[derive(Serialize, Clone, Debug)]
+#[derive(Serialize, Clone, Debug, Default)]
 pub struct SearchResult {
+    /// Stable chunk ID, see [`CodeChunk::id`](crate::indexer::CodeChunk::id)
+    pub id: String,
     pub rank: usize,
     pub score: f32,
     pub filename: String,
@@ -25,9 +66,233 @@ pub struct SearchResult {
     pub line_end: i32,
     pub last_modified: i64,
     pub calls: Vec<String>,
+    /// Symbol ID of the matched declaration, when the chunker provided one
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub symbol: Option<String>,
+    /// Language of the source file
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub language: Option<String>,
+    /// Similarity between the query and the chunk by the store's metric, see
+    /// [`Metric::similarity`](crate::storage::Metric::similarity) (best over
+    /// expanded queries); `None` for keyword-only hits
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub vector_score: Option<f32>,
+    /// Score assigned by the reranker, when reranking ran
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub rerank_score: Option<f32>,
+    /// Symbol of the hit this chunk was pulled in for by call-graph expansion
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub expanded_from: Option<String>,
+    /// Whether secrets were redacted from `code` at index time
+    #[serde(skip_serializing_if = "std::ops::Not::not")]
+    pub redacted: bool,
+    /// Label of the index the result came from, when several were searched
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub source: Option<String>,
+    /// Leading lines of `code` repeated from the previous chunk of the file
+    #[serde(skip)]
+    pub overlap_lines: usize,
+    /// Summary stored for an oversized chunk, substituted when the chunk
+    /// doesn't fit a context budget
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub summary: Option<String>,
+    /// Go package of the matched declaration
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub package: Option<String>,
+    /// Import paths of the file the chunk comes from
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub imports: Vec<String>,
+    /// Whether the chunk is code or a section of a Markdown or plain-text doc
+    pub doc_type: DocType,
+    /// Position among the parts of a declaration that was split at index time
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub part: Option<ChunkPart>,
+    /// Lines just before `line_start` as currently on disk, see [`attach_source_context`]
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub context_before: Vec<String>,
+    /// Lines just after `line_end` as currently on disk
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub context_after: Vec<String>,
+    /// Whether the file was gone or shorter than the chunk when the context was read
+    #[serde(skip_serializing_if = "std::ops::Not::not")]
+    pub source_changed: bool,
+    /// When the chunk's lines were last committed, if `git blame` dated them at index time
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub changed_at: Option<i64>,
+    /// Whether the chunk is test code, see [`TestClassifier`](crate::indexer::TestClassifier)
+    #[serde(skip_serializing_if = "std::ops::Not::not")]
+    pub is_test: bool,
+    /// Collection the chunk was indexed into, see [`CodeChunk::collection`]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub collection: Option<String>,
+    /// User tags of the chunk, see [`CodeChunk::tags`]
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub tags: Vec<String>,
+    /// Factor recency weighting multiplied the score by, see [`apply_recency`]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub recency: Option<f32>,
+    /// Other places the same code was found, when the index was deduplicated
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub duplicates: Vec<ChunkLocation>,
+    /// How `score` came about, when searched with [`CodeSearcher::with_explain`]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub explanation: Option<ScoreExplanation>,
+}
+
+impl SearchResult {
+    /// Result for a stored chunk, before ranking.
+    pub fn from_chunk(id: String, chunk: CodeChunk) -> Self {
+        Self {
+            id,
+            doc_type: DocType::of_file(&chunk.filename),
+            filename: chunk.filename,
+            code: chunk.code,
+            line_start: chunk.line_start as i32,
+            line_end: chunk.line_end as i32,
+            last_modified: chunk.last_modified,
+            calls: chunk.calls,
+            symbol: chunk.symbol,
+            language: chunk.language,
+            redacted: chunk.redacted,
+            overlap_lines: chunk.overlap_lines,
+            summary: chunk.summary,
+            package: chunk.package,
+            imports: chunk.imports,
+            part: chunk.part,
+            changed_at: chunk.changed_at,
+            is_test: chunk.is_test,
+            collection: chunk.collection,
+            tags: chunk.tags,
+            duplicates: chunk.duplicates,
+            ..Default::default()
+        }
+    }
+
+    /// Unix time the chunk last changed: `changed_at`, or the file's
+    /// modification time for chunks `git blame` didn't date.
+    pub fn last_changed(&self) -> i64 {
+        self.changed_at.unwrap_or(self.last_modified)
+    }
+
+    /// Whether the chunk's vector similarity to the query reaches `min_score`.
+    /// Keyword-only hits have no similarity and never do.
+    pub fn meets_min_score(&self, min_score: f32) -> bool {
+        self.vector_score.is_some_and(|score| score >= min_score)
+    }
+}
+
+/// Orders results by descending `score`, breaking ties by chunk ID so equal
+/// scores always come back in the same order.
+pub fn sort_by_score(results: &mut [SearchResult]) {
+    results.sort_by(|a, b| b.score.total_cmp(&a.score).then_with(|| a.id.cmp(&b.id)));
+}
+
+/// Drops results below the `min_score` vector similarity, if set, and
+/// renumbers the remaining ones. May leave fewer results than requested, or none.
+pub fn retain_min_score(results: &mut Vec<SearchResult>, min_score: Option<f32>) {
+    let Some(min_score) = min_score else {
+        return;
+    };
+    results.retain(|r| r.meets_min_score(min_score));
+    for (i, res) in results.iter_mut().enumerate() {
+        res.rank = i + 1;
+    }
+}
+
+/// Keeps at most `max_per_file` results of each file, in ranked order, and
+/// renumbers them. Unlike MMR this is a hard cap: the rest of a file's chunks
+/// are dropped however relevant. `None` or 0 keeps every result.
+pub fn cap_per_file(results: &mut Vec<SearchResult>, max_per_file: Option<usize>) {
+    let Some(max_per_file) = max_per_file.filter(|n| *n > 0) else {
+        return;
+    };
+    let mut counts: std::collections::HashMap<String, usize> = std::collections::HashMap::new();
+    results.retain(|r| {
+        let count = counts.entry(r.filename.clone()).or_default();
+        *count += 1;
+        *count <= max_per_file
+    });
+    for (i, res) in results.iter_mut().enumerate() {
+        res.rank = i + 1;
+    }
+}
+
+/// A recency half-life of `days` days; `None` unless it is positive and finite.
+pub fn half_life_days(days: f64) -> Option<Duration> {
+    Duration::try_from_secs_f64(days * 86_400.0)
+        .ok()
+        .filter(|half_life| !half_life.is_zero())
+}
+
+/// Weight of a chunk last changed `age_secs` ago under recency weighting:
+/// 1 for a change right now, halving with every `half_life` of age. Changes
+/// dated in the future (clock skew) count as now.
+pub fn recency_factor(age_secs: i64, half_life: Duration) -> f32 {
+    let half_life = half_life.as_secs_f64();
+    if half_life <= 0.0 {
+        return 1.0;
+    }
+    0.5f64.powf(age_secs.max(0) as f64 / half_life) as f32
+}
+
+/// Weights the scores of results by [`recency_factor`] when a `half_life`
+/// is set and re-sorts them, so that of two equally relevant chunks the more
+/// recently changed one comes first. Ages run from
+/// [`SearchResult::last_changed`] to now.
+///
+/// The factor multiplies the ranking score, fused or reranked, so relevance
+/// still decides between chunks of the same age. Scores are first scaled into
+/// [0, 1] by [`unit_scores`]: reranker scores can be negative, and a negative
+/// score multiplied by a factor below 1 would rise. Only the order of the
+/// results found changes, none are added or dropped.
+pub fn apply_recency(results: &mut [SearchResult], half_life: Option<Duration>) {
+    let now = std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)
+        .map(|d| d.as_secs() as i64)
+        .unwrap_or(0);
+    apply_recency_at(results, half_life, now);
 }
 
-impl SearchResult {}
+/// [`apply_recency`] at `now` (Unix seconds).
+fn apply_recency_at(results: &mut [SearchResult], half_life: Option<Duration>, now: i64) {
+    let Some(half_life) = half_life else {
+        return;
+    };
+    let scaled = unit_scores(results);
+    for (res, scaled) in results.iter_mut().zip(scaled) {
+        let factor = recency_factor(now - res.last_changed(), half_life);
+        res.recency = Some(factor);
+        res.score = scaled * factor;
+        if let Some(explanation) = res.explanation.as_mut() {
+            explanation.scaled_score = Some(scaled);
+        }
+    }
+    sort_by_score(results);
+    for (i, res) in results.iter_mut().enumerate() {
+        res.rank = i + 1;
+    }
+}
+
+/// Scores of `results` min-max scaled into [0, 1], in order: the best becomes
+/// 1 and the worst 0. When all scores are equal, they all become 1.
+pub(crate) fn unit_scores(results: &[SearchResult]) -> Vec<f32> {
+    let (low, high) = results
+        .iter()
+        .fold((f32::INFINITY, f32::NEG_INFINITY), |(low, high), r| {
+            (low.min(r.score), high.max(r.score))
+        });
+    let span = high - low;
+    results
+        .iter()
+        .map(|r| {
+            if span > 0.0 {
+                (r.score - low) / span
+            } else {
+                1.0
+            }
+        })
+        .collect()
+}
 
 /// Hybrid code search engine combining BM25 and vector search.
 ///
@@ -50,19 +315,68 @@ impl SearchResult {}
 /// This approach ensures that documents appearing near the top of both lists
 /// receive the highest combined scores, making the system robust to outliers
 /// in either individual method.
+///
+/// # Symbol Matches
+///
+/// A query that names a symbol should find it even when its body embeds
+/// poorly, so each candidate also gains `symbol_weight` times a match score
+/// between 0 and 1 for how well the query's words name its symbol or path
+/// (`Authenticate` fully matches `AuthService.Authenticate`):
+///
+/// `Score = ... + symbol_weight * match * RRF(1)`
+///
+/// A full match is worth as much as topping a ranking of that weight.
+///
+/// # Tag Boosts
+///
+/// [`with_tag_boosts`](Self::with_tag_boosts) favors chunks by their user
+/// tags in the same units: each candidate gains the summed weights of its
+/// boosted tags times `RRF(1)`, so a tag of weight 0.5 is worth half a top
+/// hit, and a negative weight pushes the tagged chunks down.
+///
+/// # Reranking
+///
+/// Unless disabled per query, the top `rerank_top_k` fused candidates are
+/// passed to a [`Reranker`] and the final order follows its scores. Results
+/// keep both the vector similarity (`vector_score`) and the reranker's
+/// verdict (`rerank_score`). Without a reranker the fused order is kept.
+/// The symbol match and tag boosts are added to reranker scores too, in
+/// units of their spread across the candidates: at weight 1.0 a full match
+/// is worth the gap between the worst and the best reranked candidate.
+///
+/// # Caching
+///
+/// With a [`QueryCache`], the ranked IDs of each query are remembered and a
+/// repeated query on an unchanged index is answered from the store by ID,
+/// without embedding, searching or reranking.
+///
+/// # Cancellation
+///
+/// Searches stop with [`CodeRagError::Cancelled`](crate::core::CodeRagError::Cancelled)
+/// once the token given to [`with_cancel`](Self::with_cancel) is cancelled:
+/// the query embedding, store lookups, LLM calls and reranking are abandoned
+/// where they wait, and work on blocking threads stops at its next batch.
 pub struct CodeSearcher {
-    storage: Option<Arc<Storage>>,
+    storage: Option<Arc<dyn VectorStore>>,
     embedder: Option<Arc<Embedder>>,
     bm25: Option<Arc<BM25Index>>,
     expander: Option<Arc<QueryExpander>>,
+    reranker: Option<Arc<dyn Reranker>>,
+    call_graph: Option<Arc<CallGraph>>,
+    query_cache: Option<Arc<QueryCache>>,
     vector_weight: f32,
     bm25_weight: f32,
     rrf_k: f64,
+    rerank_top_k: usize,
+    symbol_weight: f32,
+    tag_boosts: BTreeMap<String, f32>,
+    explain: bool,
+    cancel: CancelToken,
 }
 
 impl CodeSearcher {
     pub fn new(
-        storage: Option<Arc<Storage>>,
+        storage: Option<Arc<dyn VectorStore>>,
         embedder: Option<Arc<Embedder>>,
         bm25: Option<Arc<BM25Index>>,
         expander: Option<Arc<QueryExpander>>,
@@ -70,17 +384,94 @@ impl CodeSearcher {
         bm25_weight: f32,
         rrf_k: f64,
     ) -> Self {
+        let reranker = embedder
+            .clone()
+            .map(|e| Arc::new(CrossEncoderReranker::new(e)) as Arc<dyn Reranker>);
         Self {
             storage,
             embedder,
             bm25,
             expander,
+            reranker,
+            call_graph: None,
+            query_cache: None,
             vector_weight,
             bm25_weight,
             rrf_k,
+            rerank_top_k: DEFAULT_RERANK_TOP_K,
+            symbol_weight: DEFAULT_SYMBOL_WEIGHT,
+            tag_boosts: BTreeMap::new(),
+            explain: false,
+            cancel: CancelToken::default(),
         }
     }
 
+    /// Replaces the second-stage reranker (defaults to the embedder's cross-encoder).
+    ///
+    /// Passing `None` disables reranking for every query.
+    pub fn with_reranker(mut self, reranker: Option<Arc<dyn Reranker>>) -> Self {
+        self.reranker = reranker;
+        self
+    }
+
+    /// Sets the call graph used by [`expand_with_call_graph`](Self::expand_with_call_graph).
+    pub fn with_call_graph(mut self, call_graph: Option<Arc<CallGraph>>) -> Self {
+        self.call_graph = call_graph;
+        self
+    }
+
+    /// Answers repeated queries from `query_cache`; `None` disables caching.
+    pub fn with_query_cache(mut self, query_cache: Option<Arc<QueryCache>>) -> Self {
+        self.query_cache = query_cache;
+        self
+    }
+
+    /// Sets how many fused candidates are passed to the reranker.
+    pub fn with_rerank_top_k(mut self, rerank_top_k: usize) -> Self {
+        self.rerank_top_k = rerank_top_k.max(1);
+        self
+    }
+
+    /// Sets how much a query naming a candidate's symbol or path raises it,
+    /// see [Symbol Matches](Self#symbol-matches); 0.0 turns the boost off.
+    pub fn with_symbol_weight(mut self, symbol_weight: f32) -> Self {
+        self.symbol_weight = symbol_weight.max(0.0);
+        self
+    }
+
+    /// Raises candidates carrying these user tags by the tag's weight, on the
+    /// scale of [`with_symbol_weight`](Self::with_symbol_weight): 1.0 is worth
+    /// a top hit. Negative weights lower them; see [Tag Boosts](Self#tag-boosts).
+    pub fn with_tag_boosts(mut self, tag_boosts: impl IntoIterator<Item = (String, f32)>) -> Self {
+        self.tag_boosts = tag_boosts
+            .into_iter()
+            .map(|(tag, weight)| (tag.to_lowercase(), weight))
+            .collect();
+        self
+    }
+
+    /// Records a [`ScoreExplanation`] in every result of a hybrid search.
+    /// Such searches bypass the query cache, which keeps only final scores.
+    pub fn with_explain(mut self, explain: bool) -> Self {
+        self.explain = explain;
+        self
+    }
+
+    /// Stops searches once `cancel` is cancelled, see [Cancellation](Self#cancellation).
+    pub fn with_cancel(mut self, cancel: CancelToken) -> Self {
+        self.cancel = cancel;
+        self
+    }
+
+    /// Embeds `texts` on a blocking thread, giving up once the search is cancelled.
+    async fn embed_texts(&self, texts: Vec<String>) -> Result<Vec<Vec<f32>>> {
+        let embedder = self.embedder.clone().context("Embedder not initialized")?;
+        let cancel = self.cancel.clone();
+        let embedding =
+            tokio::task::spawn_blocking(move || embedder.embed_cancellable(texts, None, &cancel));
+        self.cancel.run(embedding).await??
+    }
+
     /// Performs semantic search using a hybrid approach (Vector + BM25).
     ///
     /// This method executes both vector search (using embeddings) and keyword search
@@ -92,14 +483,17 @@ impl CodeSearcher {
     /// * `limit` - Maximum number of results to return.
     /// * `ext` - Optional file extension filter.
     /// * `dir` - Optional directory filter.
-    /// * `no_rerank` - If true, skips the LLM-based reranking step.
+    /// * `no_rerank` - If true, skips the reranking stage.
     /// * `workspace` - The workspace to search in.
     /// * `max_tokens` - Optional token limit for the result.
-    /// * `enable_expansion` - If true, expands the query using an LLM before searching.
+    /// * `enable_expansion` - If true, an LLM adds up to three rephrasings of the
+    ///   query. Each is embedded and searched; hits are merged by chunk ID
+    ///   before reranking, with the original query weighted by [`ORIGINAL_QUERY_BOOST`].
     ///
     /// # Returns
     ///
-    /// Returns a list of `SearchResult`s, ranked by their combined RRF score.
+    /// Returns a list of `SearchResult`s, ranked by their reranker score or, when
+    /// reranking is skipped, by their combined RRF score.
     #[allow(clippy::too_many_arguments)]
     pub async fn semantic_search(
         &self,
@@ -111,153 +505,259 @@ impl CodeSearcher {
         workspace: Option<String>,
         max_tokens: Option<usize>,
         enable_expansion: bool,
+    ) -> Result<Vec<SearchResult>> {
+        let filter = CandidateFilter::new(ext, dir, Vec::new(), Vec::new())?;
+        self.filtered_search(
+            query,
+            limit,
+            &filter,
+            no_rerank,
+            workspace,
+            max_tokens,
+            enable_expansion,
+            None,
+            None,
+            None,
+            None,
+            false,
+        )
+        .await
+    }
+
+    /// Like [`semantic_search`](Self::semantic_search), restricted to candidates
+    /// accepted by `filter`.
+    ///
+    /// `hybrid_alpha` (0.0 to 1.0) overrides the configured weights for this
+    /// query: the vector ranking is weighted by `alpha` and the BM25 ranking by
+    /// `1 - alpha`, so 1.0 is purely semantic and 0.0 purely lexical.
+    ///
+    /// `mmr_lambda` (0.0 to 1.0) enables maximal marginal relevance: a pool of
+    /// [`MMR_POOL_FACTOR`] times `limit` candidates is fetched and results are
+    /// picked greedily by relevance minus cosine similarity to the results
+    /// already picked, see [`mmr_select`]. `None` keeps the plain top-K.
+    ///
+    /// `max_per_file` caps the chunks of any one file among the results, see
+    /// [`cap_per_file`]. The cap applies to the reranked candidates, before
+    /// MMR, so the places it frees go to the next-best chunks of other files.
+    ///
+    /// `recency_half_life` weights the scores by how recently the candidates
+    /// changed, see [`apply_recency`], before the per-file cap, MMR and the
+    /// limit; the pool is widened like for MMR so newer chunks can move up.
+    ///
+    /// `expand_to_symbol` replaces results that are parts of a split
+    /// declaration with the whole declaration, see
+    /// [`expand_to_symbols`](Self::expand_to_symbols), before `max_tokens`
+    /// is applied.
+    ///
+    /// Returns an empty list when the filter excludes every chunk.
+    #[allow(clippy::too_many_arguments)]
+    pub async fn filtered_search(
+        &self,
+        query: &str,
+        limit: usize,
+        filter: &CandidateFilter,
+        no_rerank: bool,
+        workspace: Option<String>,
+        max_tokens: Option<usize>,
+        enable_expansion: bool,
+        hybrid_alpha: Option<f32>,
+        mmr_lambda: Option<f32>,
+        max_per_file: Option<usize>,
+        recency_half_life: Option<Duration>,
+        expand_to_symbol: bool,
+    ) -> Result<Vec<SearchResult>> {
+        self.hybrid_search(
+            query,
+            None,
+            limit,
+            filter,
+            no_rerank,
+            workspace,
+            max_tokens,
+            enable_expansion,
+            hybrid_alpha,
+            mmr_lambda,
+            max_per_file,
+            recency_half_life,
+            expand_to_symbol,
+        )
+        .await
+    }
+
+    /// [`filtered_search`](Self::filtered_search), with BM25 searching for
+    /// `keyword_query` instead of `query` if given.
+    #[allow(clippy::too_many_arguments)]
+    async fn hybrid_search(
+        &self,
+        query: &str,
+        keyword_query: Option<&str>,
+        limit: usize,
+        filter: &CandidateFilter,
+        no_rerank: bool,
+        workspace: Option<String>,
+        max_tokens: Option<usize>,
+        enable_expansion: bool,
+        hybrid_alpha: Option<f32>,
+        mmr_lambda: Option<f32>,
+        max_per_file: Option<usize>,
+        recency_half_life: Option<Duration>,
+        expand_to_symbol: bool,
     ) -> Result<Vec<SearchResult>> {
         let storage = self.storage.as_ref().context("Storage not initialized")?;
-        let embedder = self.embedder.as_ref().context("Embedder not initialized")?;
+        let (vector_weight, bm25_weight) = self.fusion_weights(hybrid_alpha)?;
+        let max_per_file = max_per_file.filter(|n| *n > 0);
+        let query_cache = self.query_cache.as_ref().filter(|_| !self.explain);
+
+        let cache_key = query_cache.map(|_| {
+            let mut params = format!(
+                "limit={};no_rerank={};workspace={:?};{};expand={};alpha={:?};mmr={:?};per_file={:?};recency={:?};symbol_weight={};tag_boosts={:?};weights={}/{};rrf_k={};rerank_top_k={};reranker={:?};model={:?}",
+                limit,
+                no_rerank,
+                workspace,
+                filter.cache_key(),
+                enable_expansion,
+                hybrid_alpha,
+                mmr_lambda,
+                max_per_file,
+                recency_half_life,
+                self.symbol_weight,
+                self.tag_boosts,
+                self.vector_weight,
+                self.bm25_weight,
+                self.rrf_k,
+                self.rerank_top_k,
+                self.reranker.as_ref().map(|r| r.name()),
+                self.embedder.as_ref().map(|e| e.model_name()),
+            );
+            if let Some(keywords) = keyword_query {
+                params.push_str(&format!(";keywords={}", keywords));
+            }
+            QueryCache::key(query, &params)
+        });
+        if let Some((cache, key)) = query_cache.zip(cache_key.as_ref()) {
+            if let Some(results) = self
+                .cached_results(cache, key, workspace.as_deref())
+                .await?
+            {
+                tracing::debug!(query = %query, results = results.len(), "Query cache hit");
+                let results = if expand_to_symbol {
+                    self.expand_to_symbols(results, workspace.as_deref())
+                        .await?
+                } else {
+                    results
+                };
+                return Self::fit_to_budget(results, max_tokens);
+            }
+        }
+
+        self.embedder.as_ref().context("Embedder not initialized")?;
+        self.cancel.check()?;
 
         // 1. Expand Query if enabled
         let mut search_queries = vec![query.to_string()];
         if enable_expansion {
-            if let Some(expander) = &self.expander {
-                match expander.expand(query).await {
+            match &self.expander {
+                Some(expander) => match self.cancel.run(expander.expand(query)).await? {
                     Ok(expanded) => {
-                        // expander returns original query too, so we can just use that
+                        // The original query comes first
                         search_queries = expanded;
                         tracing::info!("Expanded query '{}' to: {:?}", query, search_queries);
                     }
                     Err(e) => {
                         tracing::warn!("Query expansion failed: {}. Using original query.", e);
                     }
-                }
+                },
+                None => tracing::warn!(
+                    "Query expansion needs an LLM; set llm_enabled = true. Using original query."
+                ),
             }
         }
 
+        let rerank = !no_rerank && self.reranker.is_some();
+        // MMR and the per-file cap need room to skip chunks, and recency to
+        // move newer ones up
+        let pool_limit =
+            if mmr_lambda.is_some() || max_per_file.is_some() || recency_half_life.is_some() {
+                limit.saturating_mul(MMR_POOL_FACTOR)
+            } else {
+                limit
+            };
+        let fetch_limit = if rerank {
+            std::cmp::max(self.rerank_top_k, pool_limit)
+        } else {
+            pool_limit
+        };
+
         // 2. Vector Search for all queries (Standard + Expanded)
         // We accumulate RRF scores from all vector searches
         let mut vector_rrf_scores: std::collections::HashMap<String, f64> =
             std::collections::HashMap::new();
+        // Best similarity per ID across all query vectors
+        let metric = storage.metric();
+        let mut vector_scores: std::collections::HashMap<String, f32> =
+            std::collections::HashMap::new();
+        // Best rank per ID across all query vectors, for explanations
+        let mut vector_ranks: std::collections::HashMap<String, usize> =
+            std::collections::HashMap::new();
         // Also map ID to SearchResult to reconstruct later.
         let mut all_vector_results: std::collections::HashMap<String, SearchResult> =
             std::collections::HashMap::with_capacity(std::cmp::max(50, limit * 2));
+        // Stored embeddings of the hits, used for MMR redundancy
+        let mut hit_vectors: std::collections::HashMap<String, Vec<f32>> =
+            std::collections::HashMap::new();
 
         // Batched Embedding Generation
-        let embedder_handle = embedder.clone();
-        let query_batch = search_queries.clone();
-        let all_query_vectors = tokio::task::spawn_blocking(move || {
-            embedder_handle
-                .embed(query_batch, None)
-                .map_err(|e| anyhow!(e.to_string()))
-        })
-        .await??;
-
-        for vector in all_query_vectors {
-            // Construct Filters
-            let mut filters = Vec::with_capacity(2);
-            if let Some(ext_val) = &ext {
-                let clean_ext = if let Some(stripped) = ext_val.strip_prefix('.') {
-                    stripped
-                } else {
-                    ext_val
-                };
-                filters.push(format!("filename LIKE '%.{}'", clean_ext));
-            }
-            if let Some(dir_val) = &dir {
-                let clean_dir = dir_val.replace("\\", "/");
-                filters.push(format!("filename LIKE '%{}%'", clean_dir));
-            }
-            let filter_str = if filters.is_empty() {
-                None
-            } else {
-                Some(filters.join(" AND "))
-            };
+        let all_query_vectors = self.embed_texts(search_queries.clone()).await?;
 
-            let fetch_limit = if no_rerank {
-                limit
-            } else {
-                std::cmp::max(50, limit * 5)
-            };
+        // Hits of several queries are merged by chunk ID, summing their RRF components
+        let query_count = all_query_vectors.len();
+        let missing_columns = storage.missing_columns().await?;
+        for (query_index, vector) in all_query_vectors.into_iter().enumerate() {
+            let filter_str = filter.sql_without(&missing_columns);
+            let query_weight = Self::query_weight(query_index, query_count);
 
-            let results = storage
-                .search(vector, fetch_limit, filter_str, workspace.as_deref())
-                .await
+            let vector_started = Instant::now();
+            let hits = self
+                .cancel
+                .run(storage.search_chunks(vector, fetch_limit, filter_str, workspace.as_deref()))
+                .await?
                 .map_err(|e| anyhow!(e.to_string()))?;
+            tracing::debug!(
+                query = %search_queries[query_index],
+                hits = hits.len(),
+                elapsed_ms = vector_started.elapsed().as_millis() as u64,
+                "Vector search"
+            );
 
-            // Process batch
-            for batch in results {
-                let ids: &StringArray = batch
-                    .column_by_name("id")
-                    .ok_or_else(|| anyhow!("id missing"))?
-                    .as_any()
-                    .downcast_ref()
-                    .ok_or_else(|| anyhow!("id wrong type"))?;
-                let filenames: &StringArray = batch
-                    .column_by_name("filename")
-                    .ok_or_else(|| anyhow!("filename missing"))?
-                    .as_any()
-                    .downcast_ref()
-                    .ok_or_else(|| anyhow!("filename wrong type"))?;
-                let codes: &StringArray = batch
-                    .column_by_name("code")
-                    .ok_or_else(|| anyhow!("code missing"))?
-                    .as_any()
-                    .downcast_ref()
-                    .ok_or_else(|| anyhow!("code wrong type"))?;
-                let line_starts: &Int32Array = batch
-                    .column_by_name("line_start")
-                    .ok_or_else(|| anyhow!("line_start missing"))?
-                    .as_any()
-                    .downcast_ref()
-                    .ok_or_else(|| anyhow!("line_start wrong type"))?;
-                let line_ends: &Int32Array = batch
-                    .column_by_name("line_end")
-                    .ok_or_else(|| anyhow!("line_end missing"))?
-                    .as_any()
-                    .downcast_ref()
-                    .ok_or_else(|| anyhow!("line_end wrong type"))?;
-                let last_modifieds: &Int64Array = batch
-                    .column_by_name("last_modified")
-                    .ok_or_else(|| anyhow!("last_modified missing"))?
-                    .as_any()
-                    .downcast_ref()
-                    .ok_or_else(|| anyhow!("last_modified wrong type"))?;
-                let calls_col: Option<&ListArray> = batch
-                    .column_by_name("calls")
-                    .and_then(|c| c.as_any().downcast_ref());
-
-                for i in 0..batch.num_rows() {
-                    let id = ids.value(i).to_string();
-                    let rank = i + 1; // Rank in this specific query result list
-
-                    // Accumulate RRF score
-                    *vector_rrf_scores.entry(id.clone()).or_insert(0.0) +=
-                        Self::compute_rrf_component(rank, self.rrf_k);
-
-                    // Store Result Data if not present
-                    all_vector_results.entry(id.clone()).or_insert_with(|| {
-                        let mut calls_vec = Vec::new();
-                        if let Some(calls_arr) = calls_col {
-                            if !calls_arr.is_null(i) {
-                                if let Some(str_arr) =
-                                    calls_arr.value(i).as_any().downcast_ref::<StringArray>()
-                                {
-                                    for s in str_arr.iter().flatten() {
-                                        calls_vec.push(s.to_string());
-                                    }
-                                }
-                            }
-                        }
-                        SearchResult {
-                            rank: 0,
-                            score: 0.0,
-                            filename: filenames.value(i).to_string(),
-                            code: codes.value(i).to_string(),
-                            line_start: line_starts.value(i),
-                            line_end: line_ends.value(i),
-                            last_modified: last_modifieds.value(i),
-                            calls: calls_vec,
-                        }
-                    });
+            for (i, hit) in hits.into_iter().enumerate() {
+                // The SQL prefilter over-approximates globs; apply the exact match
+                let chunk = hit.chunk;
+                if !filter.accepts(&chunk) {
+                    continue;
+                }
+
+                let id = hit.id;
+                let rank = i + 1; // Rank in this specific query result list
+                if mmr_lambda.is_some() {
+                    hit_vectors.entry(id.clone()).or_insert(hit.vector);
+                }
+
+                // Accumulate RRF score
+                *vector_rrf_scores.entry(id.clone()).or_insert(0.0) +=
+                    Self::compute_rrf_component(rank, self.rrf_k) * query_weight;
+                let best_rank = vector_ranks.entry(id.clone()).or_insert(rank);
+                *best_rank = (*best_rank).min(rank);
+
+                if let Some(distance) = hit.distance {
+                    let similarity = metric.similarity(distance);
+                    let best = vector_scores.entry(id.clone()).or_insert(similarity);
+                    *best = best.max(similarity);
                 }
+
+                // Store Result Data if not present
+                all_vector_results
+                    .entry(id.clone())
+                    .or_insert_with(|| SearchResult::from_chunk(id, chunk));
             }
         } // End of vector search loop
 
@@ -265,24 +765,28 @@ impl CodeSearcher {
         let mut candidates: Vec<SearchResult> = all_vector_results.into_values().collect();
 
         // --- 2. Process BM25 Results ---
+        self.cancel.check()?;
         if let Some(bm25) = &self.bm25 {
-            let fetch_limit = if no_rerank {
-                limit
-            } else {
-                std::cmp::max(50, limit * 5)
-            };
-            match bm25.search(query, fetch_limit, workspace.as_deref()) {
+            let bm25_started = Instant::now();
+            match bm25.search(
+                keyword_query.unwrap_or(query),
+                fetch_limit,
+                workspace.as_deref(),
+            ) {
                 Ok(bm25_results) => {
+                    tracing::debug!(
+                        hits = bm25_results.len(),
+                        elapsed_ms = bm25_started.elapsed().as_millis() as u64,
+                        "BM25 search"
+                    );
                     let bm25_ranks: std::collections::HashMap<String, usize> = bm25_results
                         .iter()
                         .enumerate()
                         .map(|(rank, res)| (res.id.clone(), rank + 1))
                         .collect();
 
-                    let mut existing_ids: std::collections::HashSet<String> = candidates
-                        .iter()
-                        .map(|c| format!("{}-{}-{}", c.filename, c.line_start, c.line_end))
-                        .collect();
+                    let mut existing_ids: std::collections::HashSet<String> =
+                        candidates.iter().map(|c| c.id.clone()).collect();
 
                     // Add unique BM25 hits
                     for res in &bm25_results {
@@ -290,58 +794,55 @@ impl CodeSearcher {
                             continue;
                         }
 
-                        // Manual Filter
-                        if let Some(ext_val) = &ext {
-                            let clean_ext = if let Some(stripped) = ext_val.strip_prefix('.') {
-                                stripped
-                            } else {
-                                ext_val
-                            };
-                            let suffix = format!(".{}", clean_ext);
-                            if !res.filename.ends_with(&suffix) {
-                                continue;
-                            }
-                        }
-
-                        if let Some(dir_val) = &dir {
-                            let clean_dir = dir_val.replace("\\", "/");
-                            if !res.filename.replace("\\", "/").contains(&clean_dir) {
-                                continue;
-                            }
+                        if !filter.accepts(res) {
+                            continue;
                         }
 
                         candidates.push(SearchResult {
+                            id: res.id.clone(),
                             rank: 0,
                             score: 0.0,
                             filename: res.filename.clone(),
+                            doc_type: DocType::of_file(&res.filename),
                             code: res.code.clone(),
                             line_start: res.line_start as i32,
                             line_end: res.line_end as i32,
                             last_modified: 0, // BM25 doesn't track this currently, might need update
                             calls: Vec::new(),
+                            package: res.package.clone(),
+                            is_test: res.is_test,
+                            collection: res.collection.clone(),
+                            tags: res.tags.clone(),
+                            ..Default::default()
                         });
                         existing_ids.insert(res.id.clone());
                     }
 
                     for candidate in candidates.iter_mut() {
-                        let id = format!(
-                            "{}-{}-{}",
-                            candidate.filename, candidate.line_start, candidate.line_end
-                        );
+                        let id = &candidate.id;
 
                         // Get accumulated vector score
-                        let vec_rrf_sum = vector_rrf_scores.get(&id).copied().unwrap_or(0.0);
+                        let vec_rrf_sum = vector_rrf_scores.get(id).copied().unwrap_or(0.0);
 
-                        let bm25_rank = bm25_ranks.get(&id).copied();
+                        let bm25_rank = bm25_ranks.get(id).copied();
 
-                        let vec_score = vec_rrf_sum as f32 * self.vector_weight;
+                        let vec_score = vec_rrf_sum as f32 * vector_weight;
 
                         let bm25_score = bm25_rank
                             .map(|r| Self::compute_rrf_component(r, self.rrf_k))
                             .unwrap_or(0.0) as f32
-                            * self.bm25_weight;
+                            * bm25_weight;
 
                         candidate.score = vec_score + bm25_score;
+                        if self.explain {
+                            candidate.explanation = Some(ScoreExplanation {
+                                vector_rank: vector_ranks.get(id).copied(),
+                                vector_rrf: vec_score,
+                                bm25_rank,
+                                bm25_rrf: bm25_score,
+                                ..Default::default()
+                            });
+                        }
                     }
                 }
                 Err(e) => tracing::error!("BM25 search failed: {}", e),
@@ -349,54 +850,159 @@ impl CodeSearcher {
         } else {
             // No BM25, just set score from vectors
             for candidate in candidates.iter_mut() {
-                let id = format!(
-                    "{}-{}-{}",
-                    candidate.filename, candidate.line_start, candidate.line_end
-                );
-                let vec_rrf_sum = vector_rrf_scores.get(&id).copied().unwrap_or(0.0);
-                candidate.score = vec_rrf_sum as f32 * self.vector_weight;
+                let vec_rrf_sum = vector_rrf_scores.get(&candidate.id).copied().unwrap_or(0.0);
+                candidate.score = vec_rrf_sum as f32 * vector_weight;
+                if self.explain {
+                    candidate.explanation = Some(ScoreExplanation {
+                        vector_rank: vector_ranks.get(&candidate.id).copied(),
+                        vector_rrf: candidate.score,
+                        ..Default::default()
+                    });
+                }
             }
         }
 
-        if !no_rerank && !candidates.is_empty() {
-            // Re-rank
-            let texts: Vec<String> = candidates.iter().map(|c| c.code.clone()).collect();
-            let embedder_handle = embedder.clone();
-            let query_str = query.to_string();
-            let rerank_texts = texts.clone();
-            let rerank_count = texts.len();
+        for candidate in candidates.iter_mut() {
+            candidate.vector_score = vector_scores.get(&candidate.id).copied();
+        }
+        // A code snippet (with its own keyword query) names whatever it calls
+        let symbol_weight = if keyword_query.is_none() {
+            self.symbol_weight
+        } else {
+            0.0
+        };
+        let top_hit = Self::compute_rrf_component(1, self.rrf_k) as f32;
+        names::boost_symbol_matches(&mut candidates, query, symbol_weight * top_hit);
+        tags::boost_tagged(&mut candidates, &self.tag_boosts, top_hit);
+        explain::finish_fused(&mut candidates, query, &self.tag_boosts);
+        // Candidates come from a map, so only the tie-break makes the order reproducible
+        sort_by_score(&mut candidates);
+        tracing::debug!(
+            candidates = candidates.len(),
+            top_score = candidates.first().map(|c| c.score),
+            "Fused candidates"
+        );
 
-            match tokio::task::spawn_blocking(move || {
-                embedder_handle.rerank(&query_str, rerank_texts, rerank_count)
-            })
-            .await?
-            {
-                Ok(rerank_results) => {
-                    // Update scores
-                    for (original_idx, new_score) in rerank_results {
-                        if let Some(candidate) = candidates.get_mut(original_idx) {
-                            candidate.score = new_score;
+        if let Some(reranker) = self.reranker.as_ref().filter(|_| rerank) {
+            candidates.truncate(self.rerank_top_k.max(pool_limit));
+            if !candidates.is_empty() {
+                let rerank_started = Instant::now();
+                match reranker
+                    .rerank_cancellable(query, &candidates, &self.cancel)
+                    .await
+                {
+                    Ok(rerank_results) => {
+                        tracing::debug!(
+                            candidates = candidates.len(),
+                            elapsed_ms = rerank_started.elapsed().as_millis() as u64,
+                            "Reranked candidates"
+                        );
+                        let mut reranked = Vec::with_capacity(rerank_results.len());
+                        for (original_idx, new_score) in rerank_results {
+                            if let Some(candidate) = candidates.get(original_idx) {
+                                let mut candidate = candidate.clone();
+                                candidate.score = new_score;
+                                candidate.rerank_score = Some(new_score);
+                                reranked.push(candidate);
+                            }
                         }
+                        let (low, high) = reranked
+                            .iter()
+                            .fold((f32::INFINITY, f32::NEG_INFINITY), |(low, high), c| {
+                                (low.min(c.score), high.max(c.score))
+                            });
+                        let spread = if high > low { high - low } else { 1.0 };
+                        names::boost_symbol_matches(&mut reranked, query, symbol_weight * spread);
+                        tags::boost_tagged(&mut reranked, &self.tag_boosts, spread);
+                        sort_by_score(&mut reranked);
+                        candidates = reranked;
+                    }
+                    Err(e) if self.cancel.is_cancelled() => return Err(e),
+                    Err(e) => {
+                        tracing::warn!("Reranking failed/skipped: {}. Using fused scores.", e);
                     }
-                    // Sort by new score (descending)
-                    candidates.sort_by(|a, b| {
-                        b.score
-                            .partial_cmp(&a.score)
-                            .unwrap_or(std::cmp::Ordering::Equal)
-                    });
-                }
-                Err(e) => {
-                    tracing::warn!("Reranking failed/skipped: {}. Using vector scores.", e);
                 }
             }
         }
 
+        apply_recency(&mut candidates, recency_half_life);
+        cap_per_file(&mut candidates, max_per_file);
+        if let Some(lambda) = mmr_lambda {
+            candidates = self
+                .diversify(candidates, &hit_vectors, lambda, limit)
+                .await?;
+        }
+
         // Truncate and assign ranks
         let mut final_results = candidates.into_iter().take(limit).collect::<Vec<_>>();
         for (i, res) in final_results.iter_mut().enumerate() {
             res.rank = i + 1;
         }
 
+        if let Some((cache, key)) = query_cache.zip(cache_key) {
+            let hits = final_results
+                .iter()
+                .map(|res| CachedHit {
+                    id: res.id.clone(),
+                    score: res.score,
+                    vector_score: res.vector_score,
+                    rerank_score: res.rerank_score,
+                })
+                .collect();
+            cache.insert(key, hits);
+        }
+
+        if expand_to_symbol {
+            final_results = self
+                .expand_to_symbols(final_results, workspace.as_deref())
+                .await?;
+        }
+        Self::fit_to_budget(final_results, max_tokens)
+    }
+
+    /// Rebuilds the results cached for `key` from the store, in their cached
+    /// order. `None` on a miss, or if a cached chunk is no longer stored.
+    async fn cached_results(
+        &self,
+        cache: &QueryCache,
+        key: &str,
+        workspace: Option<&str>,
+    ) -> Result<Option<Vec<SearchResult>>> {
+        let Some(hits) = cache.get(key) else {
+            return Ok(None);
+        };
+        let storage = self.storage.as_ref().context("Storage not initialized")?;
+        let ids: Vec<String> = hits.iter().map(|hit| hit.id.clone()).collect();
+        let mut chunks: std::collections::HashMap<String, CodeChunk> = storage
+            .get_chunks_by_ids(&ids, workspace)
+            .await
+            .map_err(|e| anyhow!(e.to_string()))?
+            .into_iter()
+            .map(|chunk| (chunk.id(), chunk))
+            .collect();
+
+        let mut results = Vec::with_capacity(hits.len());
+        for (i, hit) in hits.into_iter().enumerate() {
+            let Some(chunk) = chunks.remove(&hit.id) else {
+                tracing::debug!(id = %hit.id, "Cached chunk no longer stored; searching again");
+                cache.remove(key);
+                return Ok(None);
+            };
+            let mut result = SearchResult::from_chunk(hit.id, chunk);
+            result.rank = i + 1;
+            result.score = hit.score;
+            result.vector_score = hit.vector_score;
+            result.rerank_score = hit.rerank_score;
+            results.push(result);
+        }
+        Ok(Some(results))
+    }
+
+    /// Merges `final_results` into a context of at most `max_tokens`, if set.
+    fn fit_to_budget(
+        final_results: Vec<SearchResult>,
+        max_tokens: Option<usize>,
+    ) -> Result<Vec<SearchResult>> {
         if let Some(tokens) = max_tokens {
             use crate::context::ContextOptimizer;
             let optimizer = ContextOptimizer::new(tokens);
@@ -406,14 +1012,38 @@ impl CodeSearcher {
             let mut mapped_results = Vec::new();
             for (i, chunk) in merged_chunks.into_iter().enumerate() {
                 mapped_results.push(SearchResult {
+                    id: chunk.id,
                     rank: i + 1,
                     score: chunk.max_score, // Use max score of the group
+                    doc_type: DocType::of_file(&chunk.filename),
                     filename: chunk.filename,
                     code: chunk.code,
                     line_start: chunk.start_line,
                     line_end: chunk.end_line,
                     last_modified: chunk.last_modified,
                     calls: chunk.calls,
+                    symbol: chunk.symbol,
+                    language: chunk.language,
+                    vector_score: chunk.vector_score,
+                    rerank_score: chunk.rerank_score,
+                    expanded_from: None,
+                    redacted: chunk.redacted,
+                    source: None,
+                    overlap_lines: 0,
+                    summary: None,
+                    package: None,
+                    imports: Vec::new(),
+                    part: None,
+                    context_before: Vec::new(),
+                    context_after: Vec::new(),
+                    source_changed: false,
+                    changed_at: None,
+                    is_test: chunk.is_test,
+                    collection: chunk.collection,
+                    tags: chunk.tags,
+                    recency: None,
+                    duplicates: chunk.duplicates,
+                    explanation: None,
                 });
             }
             Ok(mapped_results)
@@ -460,12 +1090,39 @@ impl CodeSearcher {
         Ok(matches)
     }
 
+    /// Vector and BM25 weights for a query, derived from `hybrid_alpha` if given.
+    /// Fails if `hybrid_alpha` is NaN or infinite.
+    fn fusion_weights(&self, hybrid_alpha: Option<f32>) -> Result<(f32, f32)> {
+        match hybrid_alpha {
+            Some(alpha) if !alpha.is_finite() => Err(anyhow!(
+                "hybrid_alpha must be a number from 0.0 to 1.0, got {}",
+                alpha
+            )),
+            Some(alpha) => {
+                let alpha = alpha.clamp(0.0, 1.0);
+                Ok((alpha, 1.0 - alpha))
+            }
+            None => Ok((self.vector_weight, self.bm25_weight)),
+        }
+    }
+
     /// Helper to compute RRF score component.
     ///
     /// Formula: `1.0 / (k + rank)`
     fn compute_rrf_component(rank: usize, k: f64) -> f64 {
         1.0 / (k + rank as f64)
     }
+
+    /// Weight of the vector ranking of the `index`-th of `count` search
+    /// queries; the original query (index 0) gets [`ORIGINAL_QUERY_BOOST`]
+    /// when expansion added others.
+    fn query_weight(index: usize, count: usize) -> f64 {
+        if index == 0 && count > 1 {
+            ORIGINAL_QUERY_BOOST
+        } else {
+            1.0
+        }
+    }
 }
 
 #[cfg(test)]
@@ -484,6 +1141,193 @@ mod tests {
         assert!((score_10 - (1.0 / 70.0)).abs() < f64::EPSILON);
     }
 
+    #[test]
+    fn test_original_query_boost() {
+        assert_eq!(CodeSearcher::query_weight(0, 1), 1.0);
+        assert_eq!(CodeSearcher::query_weight(0, 4), ORIGINAL_QUERY_BOOST);
+        assert_eq!(CodeSearcher::query_weight(2, 4), 1.0);
+
+        // A chunk found by the original query at rank 2 outranks one found
+        // by an expanded phrasing at rank 1
+        let k = 60.0;
+        let original = CodeSearcher::compute_rrf_component(2, k) * CodeSearcher::query_weight(0, 2);
+        let expanded = CodeSearcher::compute_rrf_component(1, k) * CodeSearcher::query_weight(1, 2);
+        assert!(original > expanded);
+    }
+
+    #[test]
+    fn test_hybrid_alpha_overrides_weights() {
+        let searcher = CodeSearcher::new(None, None, None, None, 1.0, 0.5, 60.0);
+        assert_eq!(searcher.fusion_weights(None).unwrap(), (1.0, 0.5));
+        assert_eq!(searcher.fusion_weights(Some(0.75)).unwrap(), (0.75, 0.25));
+        assert_eq!(searcher.fusion_weights(Some(0.0)).unwrap(), (0.0, 1.0));
+        assert_eq!(searcher.fusion_weights(Some(1.5)).unwrap(), (1.0, 0.0));
+        assert!(searcher.fusion_weights(Some(f32::NAN)).is_err());
+        assert!(searcher.fusion_weights(Some(f32::INFINITY)).is_err());
+    }
+
+    #[test]
+    fn test_retain_min_score() {
+        let hit = |filename: &str, vector_score: Option<f32>| SearchResult {
+            filename: filename.into(),
+            vector_score,
+            ..Default::default()
+        };
+        let mut results = vec![
+            hit("a.rs", Some(0.72)),
+            hit("b.rs", None),
+            hit("c.rs", Some(0.41)),
+            hit("d.rs", Some(0.55)),
+        ];
+
+        retain_min_score(&mut results, None);
+        assert_eq!(results.len(), 4);
+
+        retain_min_score(&mut results, Some(0.5));
+        let kept: Vec<_> = results
+            .iter()
+            .map(|r| (r.filename.as_str(), r.rank))
+            .collect();
+        assert_eq!(kept, vec![("a.rs", 1), ("d.rs", 2)]);
+
+        retain_min_score(&mut results, Some(0.9));
+        assert!(results.is_empty());
+    }
+
+    #[test]
+    fn test_cap_per_file() {
+        let hit = |id: &str, filename: &str| SearchResult {
+            id: id.into(),
+            filename: filename.into(),
+            ..Default::default()
+        };
+        let ranked = vec![
+            hit("1", "big.go"),
+            hit("2", "big.go"),
+            hit("3", "big.go"),
+            hit("4", "util.go"),
+            hit("5", "big.go"),
+            hit("6", "api.go"),
+        ];
+
+        let mut results = ranked.clone();
+        cap_per_file(&mut results, None);
+        assert_eq!(results.len(), 6);
+        cap_per_file(&mut results, Some(0));
+        assert_eq!(results.len(), 6);
+
+        cap_per_file(&mut results, Some(2));
+        let kept: Vec<_> = results.iter().map(|r| (r.id.as_str(), r.rank)).collect();
+        assert_eq!(kept, vec![("1", 1), ("2", 2), ("4", 3), ("6", 4)]);
+
+        let mut results = ranked;
+        cap_per_file(&mut results, Some(1));
+        let files: Vec<_> = results.iter().map(|r| r.filename.as_str()).collect();
+        assert_eq!(files, vec!["big.go", "util.go", "api.go"]);
+    }
+
+    #[test]
+    fn test_recency_factor() {
+        let week = Duration::from_secs(7 * 86_400);
+        assert_eq!(recency_factor(0, week), 1.0);
+        assert_eq!(recency_factor(7 * 86_400, week), 0.5);
+        assert_eq!(recency_factor(14 * 86_400, week), 0.25);
+        // Clock skew
+        assert_eq!(recency_factor(-3_600, week), 1.0);
+
+        assert_eq!(half_life_days(30.0), Some(Duration::from_secs(30 * 86_400)));
+        assert_eq!(half_life_days(0.0), None);
+        assert_eq!(half_life_days(-1.0), None);
+        assert_eq!(half_life_days(f64::NAN), None);
+    }
+
+    #[test]
+    fn test_apply_recency() {
+        let day = 86_400;
+        let now = 1_000 * day;
+        let hit = |filename: &str, score: f32, age_days: i64, blamed: bool| {
+            let changed = now - age_days * day;
+            SearchResult {
+                id: filename.into(),
+                filename: filename.into(),
+                score,
+                // The file was touched today; blame dates the chunk itself
+                last_modified: if blamed { now } else { changed },
+                changed_at: blamed.then_some(changed),
+                ..Default::default()
+            }
+        };
+        let mut results = vec![
+            hit("old.rs", 0.5, 60, true),
+            hit("keyword.rs", 0.0, 0, false),
+            hit("new.rs", 0.75, 0, false),
+            hit("month.rs", 1.0, 30, false),
+        ];
+
+        apply_recency_at(&mut results, None, now);
+        assert!(results.iter().all(|r| r.recency.is_none()));
+
+        apply_recency_at(
+            &mut results,
+            Some(Duration::from_secs(30 * day as u64)),
+            now,
+        );
+        let ranked: Vec<_> = results
+            .iter()
+            .map(|r| (r.filename.as_str(), r.rank, r.score))
+            .collect();
+        assert_eq!(
+            ranked,
+            vec![
+                ("new.rs", 1, 0.75),
+                ("month.rs", 2, 0.5),
+                ("old.rs", 3, 0.125),
+                ("keyword.rs", 4, 0.0),
+            ]
+        );
+        assert_eq!(results[2].recency, Some(0.25));
+    }
+
+    #[test]
+    fn test_apply_recency_to_negative_scores() {
+        let day = 86_400;
+        let now = 1_000 * day;
+        // Reranker logits, mostly below 0
+        let hit = |filename: &str, score: f32, age_days: i64| SearchResult {
+            id: filename.into(),
+            filename: filename.into(),
+            score,
+            last_modified: now - age_days * day,
+            ..Default::default()
+        };
+        let mut results = vec![
+            hit("best.rs", 1.0, 60),
+            hit("new.rs", -1.0, 0),
+            hit("old.rs", -1.0, 60),
+            hit("worst.rs", -3.0, 0),
+        ];
+
+        apply_recency_at(
+            &mut results,
+            Some(Duration::from_secs(30 * day as u64)),
+            now,
+        );
+        let ranked: Vec<_> = results
+            .iter()
+            .map(|r| (r.filename.as_str(), r.score))
+            .collect();
+        // Of the two equally relevant chunks, the newer one ranks higher
+        assert_eq!(
+            ranked,
+            vec![
+                ("new.rs", 0.5),
+                ("best.rs", 0.25),
+                ("old.rs", 0.125),
+                ("worst.rs", 0.0),
+            ]
+        );
+    }
+
     #[test]
     fn test_sorting_logic() {
         let mut results = [
@@ -491,38 +1335,214 @@ mod tests {
                 rank: 0,
                 score: 0.1,
                 filename: "A".into(),
-                code: "".into(),
-                line_start: 0,
-                line_end: 0,
-                last_modified: 0,
-                calls: Vec::new(),
+                ..Default::default()
             },
             SearchResult {
                 rank: 0,
                 score: 0.9,
                 filename: "B".into(),
-                code: "".into(),
-                line_start: 0,
-                line_end: 0,
-                last_modified: 0,
-                calls: Vec::new(),
+                ..Default::default()
             },
             SearchResult {
                 rank: 0,
                 score: 0.5,
                 filename: "C".into(),
-                code: "".into(),
-                line_start: 0,
-                line_end: 0,
-                last_modified: 0,
-                calls: Vec::new(),
+                ..Default::default()
             },
         ];
 
-        results.sort_by(|a, b| b.score.total_cmp(&a.score));
+        sort_by_score(&mut results);
 
         assert_eq!(results[0].filename, "B"); // 0.9
         assert_eq!(results[1].filename, "C"); // 0.5
         assert_eq!(results[2].filename, "A"); // 0.1
     }
+
+    #[test]
+    fn test_equal_scores_sort_by_id() {
+        let result = |id: &str, score: f32| SearchResult {
+            id: id.to_string(),
+            score,
+            ..Default::default()
+        };
+        let orders = [
+            vec![
+                result("c", 0.5),
+                result("a", 0.5),
+                result("x", 0.9),
+                result("b", 0.5),
+            ],
+            vec![
+                result("b", 0.5),
+                result("x", 0.9),
+                result("a", 0.5),
+                result("c", 0.5),
+            ],
+            vec![
+                result("a", 0.5),
+                result("b", 0.5),
+                result("c", 0.5),
+                result("x", 0.9),
+            ],
+        ];
+        for mut results in orders {
+            sort_by_score(&mut results);
+            let ids: Vec<&str> = results.iter().map(|r| r.id.as_str()).collect();
+            assert_eq!(ids, ["x", "a", "b", "c"]);
+        }
+    }
+
+    #[tokio::test]
+    async fn test_equal_vectors_rank_deterministically() {
+        use crate::indexer::CodeChunk;
+        use crate::storage::{SqliteStore, VectorStore};
+
+        let chunks: Vec<CodeChunk> = ["d.go", "a.go", "c.go", "b.go", "target.go"]
+            .iter()
+            .map(|filename| CodeChunk {
+                filename: filename.to_string(),
+                code: format!("func F() {{ /* {} */ }}", filename),
+                line_start: 1,
+                line_end: 3,
+                ..Default::default()
+            })
+            .collect();
+        let target = SimilarTarget::parse("target.go:1").unwrap();
+        let filter = CandidateFilter::new(None, None, Vec::new(), Vec::new()).unwrap();
+
+        let mut orders = Vec::new();
+        // Insert the same equal-score vectors in different orders
+        for rotation in 0..4 {
+            let mut inserted = chunks[..4].to_vec();
+            inserted.rotate_left(rotation);
+            inserted.push(chunks[4].clone());
+            let store = SqliteStore::open_in_memory().unwrap();
+            store.init(2).await.unwrap();
+            store
+                .add_code_chunks("default", &inserted, vec![vec![1.0, 0.0]; inserted.len()])
+                .await
+                .unwrap();
+            let searcher =
+                CodeSearcher::new(Some(Arc::new(store)), None, None, None, 1.0, 1.0, 60.0);
+            let results = searcher.similar(&target, 4, &filter, None).await.unwrap();
+            assert!(results.iter().all(|r| r.score == results[0].score));
+            orders.push(results.into_iter().map(|r| r.id).collect::<Vec<_>>());
+        }
+        let mut expected = orders[0].clone();
+        expected.sort();
+        assert!(
+            orders.iter().all(|order| *order == expected),
+            "{:?}",
+            orders
+        );
+    }
+
+    #[tokio::test(flavor = "multi_thread", worker_threads = 4)]
+    async fn test_concurrent_queries_during_reindex() {
+        use crate::indexer::CodeChunk;
+        use crate::storage::{HnswParams, HnswStore, SqliteStore, VectorStore};
+
+        // Data races don't compile; what's left to check is that readers
+        // never see a file half re-indexed
+        fn assert_shareable<T: Send + Sync>() {}
+        assert_shareable::<CodeSearcher>();
+        assert_shareable::<HnswStore>();
+
+        let chunk = |filename: &str, line_start: usize| CodeChunk {
+            filename: filename.to_string(),
+            code: format!("func F{}() {{}}", line_start),
+            line_start,
+            line_end: line_start + 2,
+            ..Default::default()
+        };
+        let versions = [
+            vec![chunk("live.go", 1), chunk("live.go", 10)],
+            vec![
+                chunk("live.go", 5),
+                chunk("live.go", 15),
+                chunk("live.go", 25),
+            ],
+        ];
+        let dir = tempfile::TempDir::new().unwrap();
+        let inner = SqliteStore::open_in_memory().unwrap();
+        inner.init(2).await.unwrap();
+        let store = Arc::new(
+            HnswStore::open(
+                Arc::new(inner),
+                dir.path().join("code_chunks.hnsw"),
+                HnswParams::default(),
+            )
+            .await
+            .unwrap(),
+        );
+        store
+            .add_code_chunks(
+                "default",
+                &[chunk("target.go", 1), chunk("other.go", 1)],
+                vec![vec![1.0, 0.0], vec![0.0, 1.0]],
+            )
+            .await
+            .unwrap();
+        store
+            .add_code_chunks("default", &versions[0], vec![vec![0.9, 0.1]; 2])
+            .await
+            .unwrap();
+
+        let writer = {
+            let store = store.clone();
+            tokio::spawn(async move {
+                for round in 1..=40 {
+                    let chunks = &versions[round % 2];
+                    store
+                        .replace_files(
+                            "default",
+                            &["live.go".to_string()],
+                            chunks,
+                            vec![vec![0.9, 0.1]; chunks.len()],
+                        )
+                        .await
+                        .unwrap();
+                }
+            })
+        };
+
+        let searcher = Arc::new(CodeSearcher::new(
+            Some(store.clone() as Arc<dyn VectorStore>),
+            None,
+            None,
+            None,
+            1.0,
+            1.0,
+            60.0,
+        ));
+        let readers: Vec<_> = (0..8)
+            .map(|_| {
+                let searcher = searcher.clone();
+                tokio::spawn(async move {
+                    let target = SimilarTarget::parse("target.go:1").unwrap();
+                    let filter = CandidateFilter::new(None, None, Vec::new(), Vec::new()).unwrap();
+                    for _ in 0..40 {
+                        let results = searcher.similar(&target, 10, &filter, None).await.unwrap();
+                        let mut live: Vec<i32> = results
+                            .iter()
+                            .filter(|r| r.filename == "live.go")
+                            .map(|r| r.line_start)
+                            .collect();
+                        live.sort();
+                        assert!(
+                            live == [1, 10] || live == [5, 15, 25],
+                            "saw live.go as {:?}",
+                            live
+                        );
+                        assert!(results.iter().any(|r| r.filename == "other.go"));
+                    }
+                })
+            })
+            .collect();
+
+        writer.await.unwrap();
+        for reader in readers {
+            reader.await.unwrap();
+        }
+    }
 }
@@ -0,0 +1,259 @@
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::collections::VecDeque;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+
+use crate::manifest::index_version;
+
+/// File the CLI keeps its query cache in, next to the index.
+pub const QUERY_CACHE_FILE: &str = "query_cache.json";
+
+/// A ranked result remembered by the [`QueryCache`].
+///
+/// Only the chunk ID and scores are kept; the chunk itself is read from the
+/// store on a hit, so results always show the stored text.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct CachedHit {
+    pub id: String,
+    pub score: f32,
+    #[serde(default)]
+    pub vector_score: Option<f32>,
+    #[serde(default)]
+    pub rerank_score: Option<f32>,
+}
+
+/// LRU cache of ranked chunk IDs per query, for one index.
+///
+/// Entries are keyed by the normalized query plus the search parameters, see
+/// [`key`](Self::key), and belong to the index version they were computed on
+/// (see [`index_version`]). A re-index or a watch update changes the version,
+/// which empties the cache on the next lookup. A hit lets
+/// [`CodeSearcher`](super::CodeSearcher) skip query expansion, embedding, the
+/// vector and BM25 searches and reranking.
+pub struct QueryCache {
+    db_path: String,
+    capacity: usize,
+    /// Where [`save`](Self::save) writes the entries; `None` keeps them in memory
+    path: Option<PathBuf>,
+    state: Mutex<CacheState>,
+}
+
+#[derive(Default, Serialize, Deserialize)]
+struct CacheState {
+    index_version: Option<String>,
+    /// Least recently used first
+    entries: VecDeque<(String, Vec<CachedHit>)>,
+    #[serde(skip)]
+    dirty: bool,
+}
+
+impl QueryCache {
+    /// In-memory cache of up to `capacity` queries on the index in `db_path`.
+    pub fn new(db_path: &str, capacity: usize) -> Self {
+        Self {
+            db_path: db_path.to_string(),
+            capacity,
+            path: None,
+            state: Mutex::new(CacheState::default()),
+        }
+    }
+
+    /// Cache persisted in `db_path` across runs, starting with the entries a
+    /// previous run [saved](Self::save). An unreadable cache file starts empty.
+    pub fn load(db_path: &str, capacity: usize) -> Self {
+        let path = Path::new(db_path).join(QUERY_CACHE_FILE);
+        let mut state: CacheState = match fs::read_to_string(&path) {
+            Ok(content) => serde_json::from_str(&content).unwrap_or_else(|e| {
+                tracing::warn!("Ignoring unreadable query cache {}: {}", path.display(), e);
+                CacheState::default()
+            }),
+            Err(_) => CacheState::default(),
+        };
+        while state.entries.len() > capacity {
+            state.entries.pop_front();
+        }
+        Self {
+            db_path: db_path.to_string(),
+            capacity,
+            path: Some(path),
+            state: Mutex::new(state),
+        }
+    }
+
+    /// Cache key of `query` searched with `params`, a rendering of every
+    /// parameter that affects the ranking (limit, filters, weights, ...).
+    ///
+    /// The query is lowercased and its whitespace collapsed, so `Parse  Config`
+    /// and `parse config` share an entry.
+    pub fn key(query: &str, params: &str) -> String {
+        let normalized = query
+            .split_whitespace()
+            .collect::<Vec<_>>()
+            .join(" ")
+            .to_lowercase();
+        format!("{}\0{}", normalized, params)
+    }
+
+    /// The hits cached for `key` on the current index version, if any.
+    pub fn get(&self, key: &str) -> Option<Vec<CachedHit>> {
+        let version = index_version(&self.db_path)?;
+        let mut state = self.state.lock().ok()?;
+        state.sync(&version);
+        let position = state.entries.iter().position(|(k, _)| k == key)?;
+        let entry = state.entries.remove(position)?;
+        let hits = entry.1.clone();
+        state.entries.push_back(entry);
+        state.dirty = true;
+        Some(hits)
+    }
+
+    /// Remembers `hits` for `key`, evicting the least recently used entry when full.
+    pub fn insert(&self, key: String, hits: Vec<CachedHit>) {
+        if self.capacity == 0 {
+            return;
+        }
+        let Some(version) = index_version(&self.db_path) else {
+            return;
+        };
+        let Ok(mut state) = self.state.lock() else {
+            return;
+        };
+        state.sync(&version);
+        state.entries.retain(|(k, _)| *k != key);
+        state.entries.push_back((key, hits));
+        while state.entries.len() > self.capacity {
+            state.entries.pop_front();
+        }
+        state.dirty = true;
+    }
+
+    /// Drops the entry for `key`, e.g. when its chunks are gone from the store.
+    pub fn remove(&self, key: &str) {
+        if let Ok(mut state) = self.state.lock() {
+            state.entries.retain(|(k, _)| k != key);
+            state.dirty = true;
+        }
+    }
+
+    pub fn len(&self) -> usize {
+        self.state.lock().map(|s| s.entries.len()).unwrap_or(0)
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.len() == 0
+    }
+
+    /// Writes the entries to the cache file if this cache was [loaded](Self::load)
+    /// and changed since. Written to a temporary sibling and renamed, like the manifest.
+    pub fn save(&self) -> Result<()> {
+        let Some(path) = &self.path else {
+            return Ok(());
+        };
+        let mut state = self
+            .state
+            .lock()
+            .map_err(|_| anyhow::anyhow!("Query cache lock poisoned"))?;
+        if !state.dirty {
+            return Ok(());
+        }
+        let tmp_path = path.with_extension("json.tmp");
+        fs::write(&tmp_path, serde_json::to_string(&*state)?)
+            .with_context(|| format!("Failed to write query cache {}", tmp_path.display()))?;
+        fs::rename(&tmp_path, path)
+            .with_context(|| format!("Failed to replace query cache {}", path.display()))?;
+        state.dirty = false;
+        Ok(())
+    }
+}
+
+impl CacheState {
+    /// Empties the cache if the index changed since the entries were stored.
+    fn sync(&mut self, version: &str) {
+        if self.index_version.as_deref() != Some(version) {
+            if !self.entries.is_empty() {
+                tracing::debug!(
+                    entries = self.entries.len(),
+                    "Index version changed; clearing query cache"
+                );
+            }
+            self.entries.clear();
+            self.index_version = Some(version.to_string());
+            self.dirty = true;
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::manifest::bump_index_version;
+    use tempfile::TempDir;
+
+    fn hits(ids: &[&str]) -> Vec<CachedHit> {
+        ids.iter()
+            .map(|id| CachedHit {
+                id: id.to_string(),
+                score: 0.5,
+                vector_score: Some(0.7),
+                rerank_score: None,
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_lru_eviction_and_normalized_keys() {
+        let dir = TempDir::new().unwrap();
+        let db_path = dir.path().to_str().unwrap();
+        bump_index_version(db_path).unwrap();
+        let cache = QueryCache::new(db_path, 2);
+
+        let parse = QueryCache::key("Parse   config", "limit=5");
+        assert_eq!(parse, QueryCache::key(" parse config ", "limit=5"));
+        assert_ne!(parse, QueryCache::key("parse config", "limit=10"));
+
+        cache.insert(parse.clone(), hits(&["a"]));
+        cache.insert("b".to_string(), hits(&["b"]));
+        // Using the first entry makes the second the least recently used
+        assert_eq!(cache.get(&parse), Some(hits(&["a"])));
+        cache.insert("c".to_string(), hits(&["c"]));
+        assert_eq!(cache.len(), 2);
+        assert!(cache.get("b").is_none());
+        assert!(cache.get(&parse).is_some());
+    }
+
+    #[test]
+    fn test_reindex_invalidates_entries() {
+        let dir = TempDir::new().unwrap();
+        let db_path = dir.path().to_str().unwrap();
+        bump_index_version(db_path).unwrap();
+        let cache = QueryCache::new(db_path, 8);
+        cache.insert("q".to_string(), hits(&["a", "b"]));
+        assert!(cache.get("q").is_some());
+
+        bump_index_version(db_path).unwrap();
+        assert!(cache.get("q").is_none());
+        assert!(cache.is_empty());
+    }
+
+    #[test]
+    fn test_save_and_load() {
+        let dir = TempDir::new().unwrap();
+        let db_path = dir.path().to_str().unwrap();
+        bump_index_version(db_path).unwrap();
+
+        let cache = QueryCache::load(db_path, 8);
+        cache.insert("q".to_string(), hits(&["a"]));
+        cache.save().unwrap();
+
+        let reloaded = QueryCache::load(db_path, 8);
+        assert_eq!(reloaded.get("q"), Some(hits(&["a"])));
+
+        // Without an index version nothing is cached
+        let empty = TempDir::new().unwrap();
+        let cache = QueryCache::new(empty.path().to_str().unwrap(), 8);
+        cache.insert("q".to_string(), hits(&["a"]));
+        assert!(cache.get("q").is_none());
+    }
+}
@@ -0,0 +1,124 @@
+use super::{CandidateFilter, CodeSearcher, SearchResult};
+use crate::indexer::normalize_code;
+use anyhow::{bail, Result};
+use std::collections::HashSet;
+use std::time::Duration;
+
+/// Most identifiers of a snippet that go into its BM25 query.
+const MAX_KEYWORDS: usize = 64;
+
+/// BM25 query for a code snippet: each identifier in `code` once, in order of
+/// first appearance.
+///
+/// Code isn't valid query syntax (`:`, parentheses and quotes mean something
+/// to the query parser), while its identifiers joined by spaces are, and they
+/// are what a lexical match on code should be about. The terms are OR-ed and
+/// split by the code tokenizer like the indexed code, so `parseConfig` also
+/// matches `parse_config`. Numbers, single characters and the operator words
+/// `AND`, `OR`, `NOT` and `IN` are left out.
+pub fn code_query_terms(code: &str) -> String {
+    let mut seen = HashSet::new();
+    let mut terms = Vec::new();
+    for word in code.split(|c: char| !(c.is_alphanumeric() || c == '_')) {
+        let starts_with_digit = word.chars().next().is_some_and(|c| c.is_numeric());
+        if word.chars().count() < 2
+            || starts_with_digit
+            || matches!(word, "AND" | "OR" | "NOT" | "IN")
+        {
+            continue;
+        }
+        if seen.insert(word) {
+            terms.push(word);
+            if terms.len() == MAX_KEYWORDS {
+                break;
+            }
+        }
+    }
+    terms.join(" ")
+}
+
+impl CodeSearcher {
+    /// Finds chunks like the code snippet `code`: copies, near-duplicates and
+    /// other implementations of the same pattern.
+    ///
+    /// Unlike [`similar`](crate::commands::search::find_similar), the snippet
+    /// doesn't have to be indexed. Unlike [`filtered_search`](Self::filtered_search),
+    /// it is searched as code rather than as a question:
+    ///
+    /// - It is embedded the way chunks are at index time, as the code itself,
+    ///   comments included, after [`normalize_code`] evens out line endings,
+    ///   trailing whitespace and surrounding blank lines.
+    /// - BM25 matches its identifiers, see [`code_query_terms`].
+    /// - Query expansion and reranking are skipped. Both are meant for
+    ///   natural-language questions; results are ranked by fused score and
+    ///   their `vector_score` is the cosine similarity to the snippet.
+    #[allow(clippy::too_many_arguments)]
+    pub async fn code_search(
+        &self,
+        code: &str,
+        limit: usize,
+        filter: &CandidateFilter,
+        workspace: Option<String>,
+        max_tokens: Option<usize>,
+        hybrid_alpha: Option<f32>,
+        mmr_lambda: Option<f32>,
+        max_per_file: Option<usize>,
+        recency_half_life: Option<Duration>,
+        expand_to_symbol: bool,
+    ) -> Result<Vec<SearchResult>> {
+        let snippet = normalize_code(code);
+        if snippet.is_empty() {
+            bail!("The code snippet is empty");
+        }
+        let keywords = code_query_terms(&snippet);
+        tracing::debug!(lines = snippet.lines().count(), keywords = %keywords, "Code search");
+        self.hybrid_search(
+            &snippet,
+            Some(&keywords),
+            limit,
+            filter,
+            true,
+            workspace,
+            max_tokens,
+            false,
+            hybrid_alpha,
+            mmr_lambda,
+            max_per_file,
+            recency_half_life,
+            expand_to_symbol,
+        )
+        .await
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_code_query_terms() {
+        let code = "func (s *Server) Handle(w http.ResponseWriter, r *http.Request) {\n\
+                    \tif err := s.auth(r); err != nil && retries > 3 {\n\
+                    \t\thttp.Error(w, \"denied: \" + err.Error(), 403)\n\
+                    \t}\n}";
+        assert_eq!(
+            code_query_terms(code),
+            "func Server Handle http ResponseWriter Request if err auth nil retries Error \
+             denied"
+        );
+        assert_eq!(code_query_terms("a OR b AND 42 ();"), "");
+    }
+
+    #[tokio::test]
+    async fn test_empty_snippet_is_an_error() {
+        let searcher = CodeSearcher::new(None, None, None, None, 1.0, 1.0, 60.0);
+        let filter = CandidateFilter::new(None, None, Vec::new(), Vec::new()).unwrap();
+        let err = searcher
+            .code_search(
+                " \n\t\n", 5, &filter, None, None, None, None, None, None, false,
+            )
+            .await
+            .unwrap_err();
+        assert!(err.to_string().contains("empty"), "{}", err);
+    }
+}
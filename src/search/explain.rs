@@ -0,0 +1,127 @@
+use super::{names, SearchResult};
+use serde::Serialize;
+use std::collections::BTreeMap;
+
+/// What a result's score is made of, recorded when searching with
+/// [`with_explain`](super::CodeSearcher::with_explain).
+///
+/// The parts add up to the scores the candidates were ranked by. Fusion gives
+/// `fused_score = vector_rrf + bm25_rrf + symbol_boost + tag_boost`. After
+/// reranking, the score is the reranker's plus `rerank_symbol_boost` and
+/// `rerank_tag_boost`. Recency weighting then scales it into [0, 1] among the
+/// candidates, `scaled_score`, and multiplies that by the recency factor. MMR and the per-file cap only choose
+/// among the candidates and change no score.
+#[derive(Serialize, Clone, Debug, Default, PartialEq)]
+pub struct ScoreExplanation {
+    /// Best 1-based rank among the vector hits of the query and its
+    /// expansions; `None` for keyword-only hits
+    pub vector_rank: Option<usize>,
+    /// Weighted RRF share of the vector rankings
+    pub vector_rrf: f32,
+    /// 1-based rank among the BM25 hits; `None` if BM25 didn't find the chunk
+    pub bm25_rank: Option<usize>,
+    /// Weighted RRF share of the BM25 ranking
+    pub bm25_rrf: f32,
+    /// Added to the fused score for the query naming the symbol or path
+    pub symbol_boost: f32,
+    /// Added to the fused score for the chunk's boosted tags
+    pub tag_boost: f32,
+    /// Score after fusion and boosts, the one the reranker's candidates are
+    /// picked by
+    pub fused_score: f32,
+    /// Added to the reranker's score for the query naming the symbol or path
+    pub rerank_symbol_boost: f32,
+    /// Added to the reranker's score for the chunk's boosted tags
+    pub rerank_tag_boost: f32,
+    /// Words of the query found in the chunk's symbol
+    pub symbol_terms: Vec<String>,
+    /// Words of the query found in the chunk's path
+    pub path_terms: Vec<String>,
+    /// Boosted tags the chunk carries
+    pub boosted_tags: Vec<String>,
+    /// Ranking score scaled into [0, 1], which recency weighting multiplied
+    /// by the factor; `None` without recency weighting
+    pub scaled_score: Option<f32>,
+}
+
+impl ScoreExplanation {
+    pub(super) fn add_symbol_boost(&mut self, boost: f32, reranked: bool) {
+        if reranked {
+            self.rerank_symbol_boost += boost;
+        } else {
+            self.symbol_boost += boost;
+        }
+    }
+
+    pub(super) fn add_tag_boost(&mut self, boost: f32, reranked: bool) {
+        if reranked {
+            self.rerank_tag_boost += boost;
+        } else {
+            self.tag_boost += boost;
+        }
+    }
+}
+
+/// Completes the explanations of fused `candidates`: their fused score, and
+/// what of `query` and `tag_boosts` they matched.
+pub(super) fn finish_fused(
+    candidates: &mut [SearchResult],
+    query: &str,
+    tag_boosts: &BTreeMap<String, f32>,
+) {
+    for candidate in candidates.iter_mut() {
+        let Some(explanation) = candidate.explanation.as_mut() else {
+            continue;
+        };
+        explanation.fused_score = candidate.score;
+        (explanation.symbol_terms, explanation.path_terms) =
+            names::matched_words(query, candidate.symbol.as_deref(), &candidate.filename);
+        explanation.boosted_tags = candidate
+            .tags
+            .iter()
+            .filter(|tag| tag_boosts.contains_key(*tag))
+            .cloned()
+            .collect();
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_boosts_add_up() {
+        let mut candidate = SearchResult {
+            symbol: Some("main.AuthService.Authenticate".to_string()),
+            filename: "internal/auth/service.go".to_string(),
+            tags: vec!["legacy".to_string(), "security".to_string()],
+            score: 0.02,
+            explanation: Some(ScoreExplanation {
+                vector_rank: Some(1),
+                vector_rrf: 0.02,
+                ..Default::default()
+            }),
+            ..Default::default()
+        };
+        let candidates = std::slice::from_mut(&mut candidate);
+        names::boost_symbol_matches(candidates, "Authenticate", 0.01);
+        let boosts = BTreeMap::from([("security".to_string(), 0.5)]);
+        crate::search::tags::boost_tagged(candidates, &boosts, 0.01);
+        finish_fused(candidates, "Authenticate", &boosts);
+
+        let explanation = candidates[0].explanation.clone().unwrap();
+        assert!((explanation.symbol_boost - 0.01).abs() < 1e-6);
+        assert!((explanation.tag_boost - 0.005).abs() < 1e-6);
+        assert!((explanation.fused_score - 0.035).abs() < 1e-6);
+        assert_eq!(explanation.symbol_terms, vec!["authenticate"]);
+        assert!(explanation.path_terms.is_empty());
+        assert_eq!(explanation.boosted_tags, vec!["security"]);
+
+        // Boosts of the reranked stage are kept apart
+        candidates[0].rerank_score = Some(0.8);
+        names::boost_symbol_matches(candidates, "Authenticate", 0.1);
+        let explanation = candidates[0].explanation.clone().unwrap();
+        assert!((explanation.rerank_symbol_boost - 0.1).abs() < 1e-6);
+        assert!((explanation.symbol_boost - 0.01).abs() < 1e-6);
+    }
+}
@@ -0,0 +1,657 @@
+use super::SearchResult;
+use crate::bm25::BM25Result;
+use crate::indexer::{split_revision, CodeChunk, CodeChunker, DocType};
+use anyhow::{Context, Result};
+use globset::{GlobBuilder, GlobSet, GlobSetBuilder};
+use serde::{Deserialize, Serialize};
+
+/// Which chunks to keep by whether they are test code, as flagged at index
+/// time by [`TestClassifier`](crate::indexer::TestClassifier).
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Default, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum TestFilter {
+    #[default]
+    All,
+    /// Leave test code out
+    Exclude,
+    /// Only test code
+    Only,
+}
+
+impl TestFilter {
+    /// Filter for the `--exclude-tests` and `--only-tests` flags, which
+    /// can't both be set.
+    pub fn from_flags(exclude_tests: bool, only_tests: bool) -> Self {
+        match (exclude_tests, only_tests) {
+            (true, _) => Self::Exclude,
+            (false, true) => Self::Only,
+            (false, false) => Self::All,
+        }
+    }
+}
+
+/// Metadata constraints applied to search candidates.
+///
+/// The constraints are pushed into the vector query as a SQL prefilter and
+/// checked exactly against every candidate afterwards, so keyword-only hits
+/// are held to the same rules.
+///
+/// Path globs follow gitignore conventions: `*` stays within one path
+/// component, `**` crosses directories, and a glob may match from any component
+/// boundary, so `internal/auth/**` also matches `./repo/internal/auth/login.go`.
+/// The `<revision>:` prefix of files indexed from git history is such a
+/// boundary too.
+#[derive(Debug, Clone, Default)]
+pub struct CandidateFilter {
+    ext: Option<String>,
+    dir: Option<String>,
+    path_globs: Vec<String>,
+    path_set: Option<GlobSet>,
+    languages: Vec<String>,
+    packages: Vec<String>,
+    doc_types: Vec<DocType>,
+    tests: TestFilter,
+    collections: Vec<String>,
+    tags: Vec<String>,
+}
+
+impl CandidateFilter {
+    pub fn new(
+        ext: Option<String>,
+        dir: Option<String>,
+        path_globs: Vec<String>,
+        languages: Vec<String>,
+    ) -> Result<Self> {
+        let ext = ext.map(|e| e.strip_prefix('.').unwrap_or(&e).to_string());
+        let dir = dir.map(|d| d.replace('\\', "/"));
+
+        let path_set = if path_globs.is_empty() {
+            None
+        } else {
+            let mut builder = GlobSetBuilder::new();
+            for glob in &path_globs {
+                let glob = GlobBuilder::new(&normalize_path(glob))
+                    .literal_separator(true)
+                    .build()
+                    .with_context(|| format!("Invalid path glob '{}'", glob))?;
+                builder.add(glob);
+            }
+            Some(builder.build()?)
+        };
+
+        let languages = languages.iter().map(|l| l.to_lowercase()).collect();
+
+        Ok(Self {
+            ext,
+            dir,
+            path_globs,
+            path_set,
+            languages,
+            packages: Vec::new(),
+            doc_types: Vec::new(),
+            tests: TestFilter::All,
+            collections: Vec::new(),
+            tags: Vec::new(),
+        })
+    }
+
+    /// Only accept chunks declared in one of these Go packages (e.g. `auth`).
+    pub fn with_packages(mut self, packages: Vec<String>) -> Self {
+        self.packages = packages;
+        self
+    }
+
+    /// Only accept chunks of these doc types, e.g. `[DocType::Code]` to leave
+    /// out Markdown and plain-text docs.
+    pub fn with_doc_types(mut self, doc_types: Vec<DocType>) -> Self {
+        self.doc_types = doc_types;
+        self
+    }
+
+    /// Leave out test code, or keep nothing else.
+    pub fn with_tests(mut self, tests: TestFilter) -> Self {
+        self.tests = tests;
+        self
+    }
+
+    /// Only accept chunks indexed into one of these collections (`index
+    /// --collection`).
+    pub fn with_collections(mut self, collections: Vec<String>) -> Self {
+        self.collections = collections;
+        self
+    }
+
+    /// Only accept chunks carrying at least one of these user tags (see
+    /// [`TagRules`](crate::indexer::TagRules)), compared in lowercase.
+    pub fn with_tags(mut self, tags: Vec<String>) -> Self {
+        self.tags = tags.iter().map(|t| t.to_lowercase()).collect();
+        self
+    }
+
+    /// SQL predicate narrowing the vector search, or `None` if unconstrained.
+    ///
+    /// Globs are widened to `LIKE` patterns here; [`matches`](Self::matches)
+    /// applies the exact semantics.
+    pub fn sql(&self) -> Option<String> {
+        self.sql_without(&[])
+    }
+
+    /// [`sql`](Self::sql) for a table lacking the `missing` columns (see
+    /// [`VectorStore::missing_columns`](crate::storage::VectorStore::missing_columns)).
+    /// Constraints on them are left to the exact checks run on every
+    /// candidate, as a predicate naming a missing column fails the query.
+    pub fn sql_without(&self, missing: &[String]) -> Option<String> {
+        let has = |column: &str| !missing.iter().any(|m| m == column);
+        let mut filters = Vec::new();
+        if let Some(ext) = &self.ext {
+            filters.push(format!("filename LIKE '%.{}'", escape(ext)));
+        }
+        if let Some(dir) = &self.dir {
+            filters.push(format!("filename LIKE '%{}%'", escape(dir)));
+        }
+        if !self.path_globs.is_empty() {
+            let likes: Vec<String> = self
+                .path_globs
+                .iter()
+                .map(|g| format!("filename LIKE '{}'", escape(&glob_to_like(g))))
+                .collect();
+            filters.push(format!("({})", likes.join(" OR ")));
+        }
+        if !self.languages.is_empty() && has("language") {
+            let names: Vec<String> = self
+                .languages
+                .iter()
+                .map(|l| format!("'{}'", escape(l)))
+                .collect();
+            // Chunks indexed before languages were recorded are checked by extension
+            filters.push(format!(
+                "(language IN ({}) OR language IS NULL)",
+                names.join(", ")
+            ));
+        }
+        if !self.packages.is_empty() && has("package") {
+            let names: Vec<String> = self
+                .packages
+                .iter()
+                .map(|p| format!("'{}'", escape(p)))
+                .collect();
+            filters.push(format!("package IN ({})", names.join(", ")));
+        }
+        if !self.doc_types.is_empty() && has("language") {
+            let types: Vec<&str> = self
+                .doc_types
+                .iter()
+                .map(|t| match t {
+                    DocType::Code => "(language IS NULL OR language NOT IN ('markdown', 'text'))",
+                    DocType::Markdown => "language = 'markdown'",
+                    DocType::Text => "language = 'text'",
+                })
+                .collect();
+            filters.push(format!("({})", types.join(" OR ")));
+        }
+        match self.tests {
+            _ if !has("is_test") => {}
+            TestFilter::All => {}
+            // Chunks indexed before tests were flagged count as non-test code
+            TestFilter::Exclude => filters.push("(is_test IS NULL OR is_test = false)".to_string()),
+            TestFilter::Only => filters.push("is_test = true".to_string()),
+        }
+        if !self.collections.is_empty() && has("collection") {
+            let names: Vec<String> = self
+                .collections
+                .iter()
+                .map(|c| format!("'{}'", escape(c)))
+                .collect();
+            filters.push(format!("collection IN ({})", names.join(", ")));
+        }
+        if !self.tags.is_empty() && has("tags") {
+            // Both stores keep tags as a JSON list of strings
+            let likes: Vec<String> = self
+                .tags
+                .iter()
+                .map(|t| format!("tags LIKE '%\"{}\"%'", escape(t)))
+                .collect();
+            filters.push(format!("({})", likes.join(" OR ")));
+        }
+
+        if filters.is_empty() {
+            None
+        } else {
+            Some(filters.join(" AND "))
+        }
+    }
+
+    /// Returns true if a chunk from `filename` satisfies every constraint.
+    ///
+    /// `language` is the stored language of the chunk; when missing it is
+    /// derived from the file extension.
+    pub fn matches(&self, filename: &str, language: Option<&str>) -> bool {
+        let path = normalize_path(filename);
+
+        if let Some(ext) = &self.ext {
+            if !path.ends_with(&format!(".{}", ext)) {
+                return false;
+            }
+        }
+        if let Some(dir) = &self.dir {
+            if !path.contains(dir.as_str()) {
+                return false;
+            }
+        }
+        if let Some(set) = &self.path_set {
+            let matched = std::iter::once(path.as_str())
+                .chain(split_revision(&path).map(|(_, in_tree)| in_tree))
+                .chain(path.match_indices('/').map(|(i, _)| &path[i + 1..]))
+                .any(|suffix| set.is_match(suffix));
+            if !matched {
+                return false;
+            }
+        }
+        if !self.languages.is_empty() {
+            let language = language.or_else(|| {
+                std::path::Path::new(&path)
+                    .extension()
+                    .and_then(|e| e.to_str())
+                    .and_then(CodeChunker::language_name)
+            });
+            match language {
+                Some(l) if self.languages.iter().any(|wanted| wanted == l) => {}
+                _ => return false,
+            }
+        }
+        if !self.doc_types.is_empty() && !self.doc_types.contains(&DocType::of_file(&path)) {
+            return false;
+        }
+        true
+    }
+
+    /// Returns true if a chunk of `package` passes the package constraint.
+    /// Chunks without a recorded package only pass when no package is required.
+    pub fn matches_package(&self, package: Option<&str>) -> bool {
+        self.packages.is_empty()
+            || package.is_some_and(|p| self.packages.iter().any(|wanted| wanted == p))
+    }
+
+    /// Returns true if a chunk flagged `is_test` passes the test code constraint.
+    pub fn matches_tests(&self, is_test: bool) -> bool {
+        match self.tests {
+            TestFilter::All => true,
+            TestFilter::Exclude => !is_test,
+            TestFilter::Only => is_test,
+        }
+    }
+
+    /// Returns true if a chunk of `collection` passes the collection
+    /// constraint. Untagged chunks only pass when no collection is required.
+    pub fn matches_collection(&self, collection: Option<&str>) -> bool {
+        self.collections.is_empty()
+            || collection.is_some_and(|c| self.collections.iter().any(|wanted| wanted == c))
+    }
+
+    /// Returns true if a chunk with `tags` passes the tag constraint.
+    pub fn matches_tags(&self, tags: &[String]) -> bool {
+        self.tags.is_empty() || tags.iter().any(|t| self.tags.contains(t))
+    }
+
+    /// Returns true if `candidate` satisfies every constraint. Hits of the
+    /// store, BM25 and the call graph all go through here, as the SQL
+    /// prefilter only over-approximates some constraints and BM25 and the graph
+    /// have none.
+    pub fn accepts(&self, candidate: &impl Filterable) -> bool {
+        self.matches(candidate.filename(), candidate.language())
+            && self.matches_package(candidate.package())
+            && self.matches_tests(candidate.is_test())
+            && self.matches_collection(candidate.collection())
+            && self.matches_tags(candidate.tags())
+    }
+
+    /// Stable rendering of the constraints, part of a [`QueryCache`](super::QueryCache) key.
+    pub fn cache_key(&self) -> String {
+        format!(
+            "ext={:?};dir={:?};globs={:?};languages={:?};packages={:?};doc_types={:?};tests={:?};\
+            collections={:?};tags={:?}",
+            self.ext,
+            self.dir,
+            self.path_globs,
+            self.languages,
+            self.packages,
+            self.doc_types,
+            self.tests,
+            self.collections,
+            self.tags
+        )
+    }
+}
+
+fn normalize_path(path: &str) -> String {
+    let path = path.replace('\\', "/");
+    path.strip_prefix("./").unwrap_or(&path).to_string()
+}
+
+fn escape(value: &str) -> String {
+    value.replace('\'', "''")
+}
+
+/// Widens a glob into a `LIKE` pattern matching at least the same paths.
+fn glob_to_like(glob: &str) -> String {
+    let glob = normalize_path(glob);
+    let mut pattern = String::from("%");
+    let mut chars = glob.chars();
+    while let Some(c) = chars.next() {
+        match c {
+            '*' => pattern.push('%'),
+            '?' => pattern.push('_'),
+            '[' => {
+                // A character class matches exactly one character
+                for c in chars.by_ref() {
+                    if c == ']' {
+                        break;
+                    }
+                }
+                pattern.push('_');
+            }
+            '{' => {
+                for c in chars.by_ref() {
+                    if c == '}' {
+                        break;
+                    }
+                }
+                pattern.push('%');
+            }
+            '\\' => {
+                if let Some(next) = chars.next() {
+                    pattern.push(next);
+                }
+            }
+            c => pattern.push(c),
+        }
+    }
+    while pattern.contains("%%") {
+        pattern = pattern.replace("%%", "%");
+    }
+    pattern
+}
+
+/// The fields of a search hit that [`CandidateFilter::accepts`] checks.
+pub trait Filterable {
+    fn filename(&self) -> &str;
+    /// Stored language, `None` to derive it from the file extension
+    fn language(&self) -> Option<&str>;
+    fn package(&self) -> Option<&str>;
+    fn is_test(&self) -> bool;
+    fn collection(&self) -> Option<&str>;
+    fn tags(&self) -> &[String];
+}
+
+impl Filterable for CodeChunk {
+    fn filename(&self) -> &str {
+        &self.filename
+    }
+    fn language(&self) -> Option<&str> {
+        self.language.as_deref()
+    }
+    fn package(&self) -> Option<&str> {
+        self.package.as_deref()
+    }
+    fn is_test(&self) -> bool {
+        self.is_test
+    }
+    fn collection(&self) -> Option<&str> {
+        self.collection.as_deref()
+    }
+    fn tags(&self) -> &[String] {
+        &self.tags
+    }
+}
+
+impl Filterable for BM25Result {
+    fn filename(&self) -> &str {
+        &self.filename
+    }
+    fn language(&self) -> Option<&str> {
+        None
+    }
+    fn package(&self) -> Option<&str> {
+        self.package.as_deref()
+    }
+    fn is_test(&self) -> bool {
+        self.is_test
+    }
+    fn collection(&self) -> Option<&str> {
+        self.collection.as_deref()
+    }
+    fn tags(&self) -> &[String] {
+        &self.tags
+    }
+}
+
+impl Filterable for SearchResult {
+    fn filename(&self) -> &str {
+        &self.filename
+    }
+    fn language(&self) -> Option<&str> {
+        self.language.as_deref()
+    }
+    fn package(&self) -> Option<&str> {
+        self.package.as_deref()
+    }
+    fn is_test(&self) -> bool {
+        self.is_test
+    }
+    fn collection(&self) -> Option<&str> {
+        self.collection.as_deref()
+    }
+    fn tags(&self) -> &[String] {
+        &self.tags
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn globs(globs: &[&str]) -> CandidateFilter {
+        CandidateFilter::new(
+            None,
+            None,
+            globs.iter().map(|g| g.to_string()).collect(),
+            Vec::new(),
+        )
+        .unwrap()
+    }
+
+    #[test]
+    fn test_recursive_glob() {
+        let filter = globs(&["internal/auth/**"]);
+        assert!(filter.matches("internal/auth/login.go", None));
+        assert!(filter.matches("./repo/internal/auth/session/store.go", None));
+        assert!(filter.matches("C:\\repo\\internal\\auth\\login.go", None));
+        assert!(filter.matches("v1.2:internal/auth/login.go", None));
+        assert!(!filter.matches("internal/billing/auth/login.go", None));
+    }
+
+    #[test]
+    fn test_single_star_stays_in_component() {
+        let filter = globs(&["src/*.rs"]);
+        assert!(filter.matches("src/main.rs", None));
+        assert!(!filter.matches("src/server/mod.rs", None));
+    }
+
+    #[test]
+    fn test_any_glob_may_match() {
+        let filter = globs(&["cmd/**", "*.md"]);
+        assert!(filter.matches("cmd/tool/main.go", None));
+        assert!(filter.matches("docs/README.md", None));
+        assert!(!filter.matches("internal/a.go", None));
+    }
+
+    #[test]
+    fn test_invalid_glob_is_an_error() {
+        assert!(CandidateFilter::new(None, None, vec!["a/[b".to_string()], Vec::new()).is_err());
+    }
+
+    #[test]
+    fn test_languages_use_stored_value_then_extension() {
+        let filter = CandidateFilter::new(None, None, Vec::new(), vec!["Go".to_string()]).unwrap();
+        assert!(filter.matches("a.txt", Some("go")));
+        assert!(!filter.matches("a.go", Some("python")));
+        assert!(filter.matches("a.go", None));
+        assert!(!filter.matches("a.py", None));
+        assert!(!filter.matches("Makefile", None));
+    }
+
+    #[test]
+    fn test_ext_and_dir() {
+        let filter = CandidateFilter::new(
+            Some(".rs".to_string()),
+            Some("src\\server".to_string()),
+            Vec::new(),
+            Vec::new(),
+        )
+        .unwrap();
+        assert!(filter.matches("src/server/mod.rs", None));
+        assert!(!filter.matches("src/server/mod.py", None));
+        assert!(!filter.matches("src/main.rs", None));
+    }
+
+    #[test]
+    fn test_packages() {
+        let filter = CandidateFilter::default();
+        assert!(filter.matches_package(None));
+
+        let filter = filter.with_packages(vec!["auth".to_string(), "o'k".to_string()]);
+        assert!(filter.matches_package(Some("auth")));
+        assert!(!filter.matches_package(Some("main")));
+        assert!(!filter.matches_package(None));
+        assert_eq!(filter.sql().unwrap(), "package IN ('auth', 'o''k')");
+    }
+
+    #[test]
+    fn test_doc_types() {
+        let filter = CandidateFilter::default().with_doc_types(vec![DocType::Markdown]);
+        assert!(filter.matches("docs/design.md", None));
+        assert!(!filter.matches("src/auth.go", None));
+        assert!(!filter.matches("notes.txt", None));
+        assert_eq!(filter.sql().unwrap(), "(language = 'markdown')");
+
+        let filter = CandidateFilter::default().with_doc_types(vec![DocType::Code]);
+        assert!(filter.matches("src/auth.go", None));
+        assert!(!filter.matches("README.md", None));
+        assert_eq!(
+            filter.sql().unwrap(),
+            "((language IS NULL OR language NOT IN ('markdown', 'text')))"
+        );
+    }
+
+    #[test]
+    fn test_tests() {
+        let filter = CandidateFilter::default();
+        assert!(filter.matches_tests(true) && filter.matches_tests(false));
+
+        let filter = CandidateFilter::default().with_tests(TestFilter::Exclude);
+        assert!(filter.matches_tests(false));
+        assert!(!filter.matches_tests(true));
+        assert_eq!(
+            filter.sql().unwrap(),
+            "(is_test IS NULL OR is_test = false)"
+        );
+
+        let filter = CandidateFilter::default().with_tests(TestFilter::Only);
+        assert!(filter.matches_tests(true));
+        assert!(!filter.matches_tests(false));
+        assert_eq!(filter.sql().unwrap(), "is_test = true");
+
+        assert_eq!(TestFilter::from_flags(false, true), TestFilter::Only);
+        assert_eq!(TestFilter::from_flags(false, false), TestFilter::All);
+    }
+
+    #[test]
+    fn test_collections() {
+        let filter = CandidateFilter::default();
+        assert!(filter.matches_collection(None));
+
+        let filter = CandidateFilter::default()
+            .with_collections(vec!["backend".to_string(), "o'k".to_string()]);
+        assert!(filter.matches_collection(Some("backend")));
+        assert!(!filter.matches_collection(Some("frontend")));
+        assert!(!filter.matches_collection(None));
+        assert_eq!(filter.sql().unwrap(), "collection IN ('backend', 'o''k')");
+        assert_ne!(filter.cache_key(), CandidateFilter::default().cache_key());
+    }
+
+    #[test]
+    fn test_tags() {
+        let filter = CandidateFilter::default();
+        assert!(filter.matches_tags(&[]));
+
+        let filter = CandidateFilter::default().with_tags(vec!["Security".to_string()]);
+        assert!(filter.matches_tags(&["legacy".to_string(), "security".to_string()]));
+        assert!(!filter.matches_tags(&["security-sensitive".to_string()]));
+        assert!(!filter.matches_tags(&[]));
+        assert_eq!(filter.sql().unwrap(), "(tags LIKE '%\"security\"%')");
+        assert_ne!(filter.cache_key(), CandidateFilter::default().cache_key());
+    }
+
+    #[test]
+    fn test_accepts() {
+        let filter = globs(&["src/**"])
+            .with_tests(TestFilter::Exclude)
+            .with_tags(vec!["security".to_string()]);
+        let result = SearchResult {
+            filename: "src/auth.rs".to_string(),
+            tags: vec!["security".to_string()],
+            ..Default::default()
+        };
+        assert!(filter.accepts(&result));
+        assert!(!filter.accepts(&SearchResult {
+            filename: "docs/auth.md".to_string(),
+            ..result.clone()
+        }));
+        assert!(!filter.accepts(&SearchResult {
+            is_test: true,
+            ..result.clone()
+        }));
+        assert!(!filter.accepts(&SearchResult {
+            tags: Vec::new(),
+            ..result
+        }));
+    }
+
+    #[test]
+    fn test_sql() {
+        assert_eq!(CandidateFilter::default().sql(), None);
+
+        let filter = CandidateFilter::new(
+            Some("go".to_string()),
+            None,
+            vec!["internal/auth/**".to_string(), "pkg/*_test.go".to_string()],
+            vec!["go".to_string(), "o'caml".to_string()],
+        )
+        .unwrap();
+        assert_eq!(
+            filter.sql().unwrap(),
+            "filename LIKE '%.go' AND (filename LIKE '%internal/auth/%' OR filename LIKE '%pkg/%_test.go') \
+            AND (language IN ('go', 'o''caml') OR language IS NULL)"
+        );
+    }
+
+    #[test]
+    fn test_sql_without_missing_columns() {
+        let filter = CandidateFilter::new(Some("go".to_string()), None, Vec::new(), Vec::new())
+            .unwrap()
+            .with_tests(TestFilter::Exclude)
+            .with_collections(vec!["main".to_string()])
+            .with_tags(vec!["security".to_string()]);
+        let missing = ["is_test", "collection", "tags"].map(String::from);
+        assert_eq!(
+            filter.sql_without(&missing).unwrap(),
+            "filename LIKE '%.go'"
+        );
+        let tests_only = CandidateFilter::default().with_tests(TestFilter::Only);
+        assert_eq!(tests_only.sql_without(&missing), None);
+        assert_eq!(
+            tests_only.sql_without(&["tags".to_string()]).unwrap(),
+            "is_test = true"
+        );
+    }
+}
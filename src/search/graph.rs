@@ -0,0 +1,101 @@
+use super::{CandidateFilter, CodeSearcher, SearchResult};
+use anyhow::{Context, Result};
+use std::collections::HashSet;
+
+impl CodeSearcher {
+    /// Appends the call-graph neighbors of `results` to the list.
+    ///
+    /// For every hit with a symbol, symbols within `hops` caller/callee edges
+    /// are looked up in the call graph and their chunks appended after the
+    /// original hits, best hits first. Neighbors are deduplicated across hits,
+    /// neighbors that fail `filter` are left out, and at most `max_added`
+    /// chunks are added. Each added result names the hit that pulled it in via
+    /// `expanded_from`.
+    ///
+    /// Does nothing when `hops` is 0 or no call graph is loaded.
+    pub async fn expand_with_call_graph(
+        &self,
+        mut results: Vec<SearchResult>,
+        hops: usize,
+        max_added: usize,
+        filter: &CandidateFilter,
+        workspace: Option<&str>,
+    ) -> Result<Vec<SearchResult>> {
+        let Some(graph) = self
+            .call_graph
+            .as_ref()
+            .filter(|_| hops > 0 && max_added > 0)
+        else {
+            return Ok(results);
+        };
+        let storage = self.storage.as_ref().context("Storage not initialized")?;
+
+        let mut seen: HashSet<String> = results.iter().filter_map(|r| r.symbol.clone()).collect();
+        // (chunk_id, neighbor symbol, hit symbol)
+        let mut wanted: Vec<(String, String, String)> = Vec::new();
+        for hit in &results {
+            let Some(symbol) = &hit.symbol else {
+                continue;
+            };
+            for neighbor in graph.neighbors(symbol, hops) {
+                if !seen.insert(neighbor.clone()) {
+                    continue;
+                }
+                if let Some((_, chunk_id)) = graph.location(&neighbor) {
+                    wanted.push((chunk_id, neighbor, symbol.clone()));
+                }
+            }
+        }
+        if wanted.is_empty() {
+            return Ok(results);
+        }
+
+        let ids: Vec<String> = wanted.iter().map(|(id, _, _)| id.clone()).collect();
+        let chunks = storage
+            .get_chunks_by_ids(&ids, workspace)
+            .await
+            .map_err(|e| anyhow::anyhow!(e.to_string()))?;
+
+        let mut added = 0;
+        for (chunk_id, _, from) in wanted {
+            if added >= max_added {
+                break;
+            }
+            // Chunks can be missing if the graph is older than the table
+            let Some(chunk) = chunks.iter().find(|c| c.id() == chunk_id) else {
+                continue;
+            };
+            let neighbor = SearchResult {
+                id: chunk_id,
+                rank: results.len() + 1,
+                score: 0.0,
+                filename: chunk.filename.clone(),
+                code: chunk.code.clone(),
+                line_start: chunk.line_start as i32,
+                line_end: chunk.line_end as i32,
+                last_modified: chunk.last_modified,
+                calls: chunk.calls.clone(),
+                symbol: chunk.symbol.clone(),
+                language: chunk.language.clone(),
+                expanded_from: Some(from),
+                redacted: chunk.redacted,
+                overlap_lines: chunk.overlap_lines,
+                summary: chunk.summary.clone(),
+                package: chunk.package.clone(),
+                imports: chunk.imports.clone(),
+                part: chunk.part,
+                changed_at: chunk.changed_at,
+                is_test: chunk.is_test,
+                collection: chunk.collection.clone(),
+                tags: chunk.tags.clone(),
+                duplicates: chunk.duplicates.clone(),
+                ..Default::default()
+            };
+            if filter.accepts(&neighbor) {
+                results.push(neighbor);
+                added += 1;
+            }
+        }
+        Ok(results)
+    }
+}
@@ -0,0 +1,137 @@
+use super::{unit_scores, SearchResult};
+
+/// Merges the rankings of several indexes into one list of at most `limit` results.
+///
+/// Scores are only comparable within one index, so each index's scores are
+/// first min-max scaled by [`unit_scores`]: its best result scores 1 and its
+/// worst 0, whatever the sign of the raw scores. Results are then taken in
+/// rounds: every round adds the next result of each index, ordered by
+/// normalized score. An index with many strong hits therefore cannot push the
+/// others out of the top `limit`. `score` holds the normalized score and
+/// `source` the label of the index afterwards; ranks are reassigned.
+pub fn interleave_sources(
+    sources: Vec<(String, Vec<SearchResult>)>,
+    limit: usize,
+) -> Vec<SearchResult> {
+    let mut queues: Vec<std::vec::IntoIter<SearchResult>> = sources
+        .into_iter()
+        .map(|(label, mut results)| {
+            let scaled = unit_scores(&results);
+            for (result, score) in results.iter_mut().zip(scaled) {
+                result.score = score;
+                result.source = Some(label.clone());
+            }
+            results.into_iter()
+        })
+        .collect();
+
+    let mut merged = Vec::with_capacity(limit);
+    while merged.len() < limit {
+        let mut round: Vec<SearchResult> = queues.iter_mut().filter_map(Iterator::next).collect();
+        if round.is_empty() {
+            break;
+        }
+        // Stable sort keeps index order on ties
+        round.sort_by(|a, b| b.score.total_cmp(&a.score));
+        merged.extend(round.into_iter().take(limit - merged.len()));
+    }
+    for (i, result) in merged.iter_mut().enumerate() {
+        result.rank = i + 1;
+    }
+    merged
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn ranked(filename: &str, scores: &[f32]) -> Vec<SearchResult> {
+        scores
+            .iter()
+            .map(|&score| SearchResult {
+                filename: filename.to_string(),
+                score,
+                ..Default::default()
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_large_index_does_not_dominate() {
+        let merged = interleave_sources(
+            vec![
+                ("big".to_string(), ranked("big.rs", &[0.9, 0.8, 0.7, 0.6])),
+                ("small".to_string(), ranked("small.rs", &[0.05, 0.01])),
+            ],
+            4,
+        );
+        let sources: Vec<&str> = merged.iter().filter_map(|r| r.source.as_deref()).collect();
+        assert_eq!(sources, vec!["big", "small", "big", "small"]);
+        assert_eq!(merged[1].score, 1.0);
+        assert_eq!(
+            merged.iter().map(|r| r.rank).collect::<Vec<_>>(),
+            vec![1, 2, 3, 4]
+        );
+    }
+
+    #[test]
+    fn test_round_order_follows_normalized_score() {
+        let merged = interleave_sources(
+            vec![
+                ("a".to_string(), ranked("a.rs", &[1.0, 0.5, 0.0])),
+                ("b".to_string(), ranked("b.rs", &[0.5, 0.375, 0.0])),
+            ],
+            10,
+        );
+        let files: Vec<(&str, f32)> = merged
+            .iter()
+            .map(|r| (r.source.as_deref().unwrap(), r.score))
+            .collect();
+        assert_eq!(
+            files,
+            vec![
+                ("a", 1.0),
+                ("b", 1.0),
+                ("b", 0.75),
+                ("a", 0.5),
+                ("a", 0.0),
+                ("b", 0.0)
+            ]
+        );
+    }
+
+    #[test]
+    fn test_negative_and_mixed_scores() {
+        // Reranker logits: all below 0 in one index, of both signs in the other
+        let merged = interleave_sources(
+            vec![
+                ("a".to_string(), ranked("a.rs", &[-1.0, -2.0, -5.0])),
+                ("b".to_string(), ranked("b.rs", &[2.0, -2.0])),
+            ],
+            10,
+        );
+        let files: Vec<(&str, f32)> = merged
+            .iter()
+            .map(|r| (r.source.as_deref().unwrap(), r.score))
+            .collect();
+        assert_eq!(
+            files,
+            vec![("a", 1.0), ("b", 1.0), ("a", 0.75), ("b", 0.0), ("a", 0.0)]
+        );
+    }
+
+    #[test]
+    fn test_empty_and_zero_scores() {
+        assert!(interleave_sources(Vec::new(), 5).is_empty());
+        let merged = interleave_sources(
+            vec![
+                ("a".to_string(), Vec::new()),
+                ("b".to_string(), ranked("b.rs", &[0.0])),
+            ],
+            5,
+        );
+        // A lone result is its index's best
+        assert_eq!(merged.len(), 1);
+        assert_eq!(merged[0].score, 1.0);
+    }
+}
@@ -0,0 +1,145 @@
+use super::{CodeSearcher, SearchResult};
+use crate::storage::similarity::cosine_distance;
+use anyhow::Result;
+use std::collections::HashMap;
+
+/// Candidates considered per requested result when MMR or a per-file cap is
+/// enabled.
+pub const MMR_POOL_FACTOR: usize = 4;
+
+/// Picks up to `k` candidates by maximal marginal relevance.
+///
+/// Each step takes the candidate maximizing
+/// `lambda * relevance - (1 - lambda) * max_cosine(candidate, picked)`, with
+/// `relevance` min-max normalized so it is comparable to cosine similarity.
+/// `lambda = 1.0` keeps the relevance order; lower values favor candidates
+/// unlike those already picked. Candidates without an embedding count as
+/// unrelated to everything. Returns indices into `relevance` in pick order.
+pub fn mmr_select(
+    relevance: &[f32],
+    embeddings: &[Option<Vec<f32>>],
+    lambda: f32,
+    k: usize,
+) -> Vec<usize> {
+    let lambda = lambda.clamp(0.0, 1.0);
+    let (min, max) = relevance
+        .iter()
+        .fold((f32::INFINITY, f32::NEG_INFINITY), |(lo, hi), &r| {
+            (lo.min(r), hi.max(r))
+        });
+    let span = max - min;
+    let normalized: Vec<f32> = relevance
+        .iter()
+        .map(|&r| if span > 0.0 { (r - min) / span } else { 1.0 })
+        .collect();
+
+    // Highest similarity of each candidate to any picked one
+    let mut redundancy = vec![0.0f32; relevance.len()];
+    let mut remaining: Vec<usize> = (0..relevance.len()).collect();
+    let mut picked = Vec::with_capacity(k.min(relevance.len()));
+
+    while picked.len() < k {
+        let score = |i: usize| lambda * normalized[i] - (1.0 - lambda) * redundancy[i];
+        // Ties go to the earlier (more relevant) candidate
+        let Some((pos, &best)) = remaining
+            .iter()
+            .enumerate()
+            .max_by(|(_, &a), (_, &b)| score(a).total_cmp(&score(b)).then(b.cmp(&a)))
+        else {
+            break;
+        };
+        remaining.swap_remove(pos);
+        picked.push(best);
+
+        if let Some(chosen) = embeddings.get(best).and_then(Option::as_ref) {
+            for &i in &remaining {
+                if let Some(other) = embeddings.get(i).and_then(Option::as_ref) {
+                    redundancy[i] = redundancy[i].max(1.0 - cosine_distance(chosen, other));
+                }
+            }
+        }
+    }
+    picked
+}
+
+impl CodeSearcher {
+    /// Reorders fused candidates by [`mmr_select`] and keeps `limit` of them.
+    ///
+    /// `vectors` holds the stored embeddings of vector hits by chunk ID;
+    /// keyword-only hits are embedded here. If that fails they are treated as
+    /// unrelated to the other candidates.
+    pub(super) async fn diversify(
+        &self,
+        candidates: Vec<SearchResult>,
+        vectors: &HashMap<String, Vec<f32>>,
+        lambda: f32,
+        limit: usize,
+    ) -> Result<Vec<SearchResult>> {
+        let mut embeddings: Vec<Option<Vec<f32>>> = candidates
+            .iter()
+            .map(|c| vectors.get(&c.id).cloned())
+            .collect();
+
+        let missing: Vec<usize> = (0..candidates.len())
+            .filter(|&i| embeddings[i].is_none())
+            .collect();
+        if self.embedder.is_some() && !missing.is_empty() {
+            let texts: Vec<String> = missing
+                .iter()
+                .map(|&i| candidates[i].code.clone())
+                .collect();
+            match self.embed_texts(texts).await {
+                Ok(vectors) => {
+                    for (i, vector) in missing.into_iter().zip(vectors) {
+                        embeddings[i] = Some(vector);
+                    }
+                }
+                Err(e) if self.cancel.is_cancelled() => return Err(e),
+                Err(e) => tracing::warn!("Embedding keyword-only hits for MMR failed: {}", e),
+            }
+        }
+
+        let relevance: Vec<f32> = candidates.iter().map(|c| c.score).collect();
+        let order = mmr_select(&relevance, &embeddings, lambda, limit);
+        let mut slots: Vec<Option<SearchResult>> = candidates.into_iter().map(Some).collect();
+        Ok(order.into_iter().filter_map(|i| slots[i].take()).collect())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_lambda_one_keeps_relevance_order() {
+        let relevance = [0.9, 0.8, 0.7];
+        let embeddings = vec![Some(vec![1.0, 0.0]); 3];
+        assert_eq!(mmr_select(&relevance, &embeddings, 1.0, 3), vec![0, 1, 2]);
+    }
+
+    #[test]
+    fn test_skips_near_duplicates() {
+        // 0 and 1 are near-identical; 2 is less relevant but different
+        let relevance = [0.9, 0.89, 0.6];
+        let embeddings = vec![
+            Some(vec![1.0, 0.0]),
+            Some(vec![0.99, 0.05]),
+            Some(vec![0.0, 1.0]),
+        ];
+        assert_eq!(mmr_select(&relevance, &embeddings, 0.5, 2), vec![0, 2]);
+        // Pure top-K would pick the duplicate
+        assert_eq!(mmr_select(&relevance, &embeddings, 1.0, 2), vec![0, 1]);
+    }
+
+    #[test]
+    fn test_missing_embeddings_and_limits() {
+        let relevance = [0.5, 0.5];
+        let embeddings = vec![None, Some(vec![1.0])];
+        assert_eq!(mmr_select(&relevance, &embeddings, 0.3, 5), vec![0, 1]);
+        assert!(mmr_select(&[], &[], 0.5, 3).is_empty());
+        assert_eq!(
+            mmr_select(&relevance, &embeddings, 0.5, 0),
+            Vec::<usize>::new()
+        );
+    }
+}
@@ -0,0 +1,228 @@
+use super::SearchResult;
+use crate::bm25::identifier_words;
+use std::collections::{BTreeSet, HashSet};
+
+/// Default `symbol_weight`.
+pub const DEFAULT_SYMBOL_WEIGHT: f32 = 1.0;
+
+/// Share of the boost given when every word of the query is a word of the
+/// symbol, without the query naming it exactly.
+const SYMBOL_WORDS_SHARE: f32 = 0.5;
+
+/// Share of the boost given when every word of the query is a word of the
+/// file's path.
+const PATH_WORDS_SHARE: f32 = 0.25;
+
+/// Length from which a plain lowercase or capitalized word can name a symbol
+/// exactly; shorter names need to be spelled as identifiers.
+const MIN_NAME_LEN: usize = 4;
+
+/// Words common enough in code and questions alike that they name no symbol
+/// in particular.
+const GENERIC_WORDS: &[&str] = &[
+    "main", "init", "new", "run", "get", "set", "add", "test", "tests", "data", "value", "file",
+    "name", "type", "list", "item", "error", "result", "self", "this", "that", "with", "from",
+    "into", "what", "where", "which", "when", "does", "code", "function", "method", "call",
+    "handle", "update", "create", "delete", "start", "stop", "close", "open", "read", "write",
+];
+
+/// Name a symbol ID ends with: `Authenticate` for `main.AuthService.Authenticate`
+/// or `auth::Service::authenticate`.
+fn symbol_name(symbol: &str) -> &str {
+    symbol
+        .rsplit(['.', ':'])
+        .find(|part| !part.is_empty())
+        .unwrap_or(symbol)
+}
+
+/// How well `query` names a chunk of `filename` declaring `symbol`, from 0.0
+/// to 1.0.
+///
+/// A query term spelled like the symbol's name, ignoring case, scores 1.0, so
+/// `Authenticate` picks out `AuthService.Authenticate`, as long as the term
+/// reads as an identifier: spelled in camel or snake case, or at least
+/// [`MIN_NAME_LEN`] characters long and not one of [`GENERIC_WORDS`], so
+/// `run` or `main` don't pull every `Run` and `main` to the top. Otherwise the
+/// query's words, split at case changes and `_` like BM25 splits code, are
+/// looked up in the symbol and in the path: `user registration` finds
+/// `RegisterUser` half way, as does `auth` for `internal/auth/service.go` a
+/// quarter of the way, and the two add up. Generic words count for neither.
+pub(super) fn symbol_match(query: &str, symbol: Option<&str>, filename: &str) -> f32 {
+    let terms = query_terms(query);
+    if let Some(name) = symbol.map(symbol_name) {
+        if terms
+            .iter()
+            .any(|term| is_identifier_like(term) && term.eq_ignore_ascii_case(name))
+        {
+            return 1.0;
+        }
+    }
+
+    let words = query_words(&terms);
+    if words.is_empty() {
+        return 0.0;
+    }
+    let coverage = |text: &str| {
+        let found: HashSet<String> = identifier_words(text).into_iter().collect();
+        words.iter().filter(|w| found.contains(*w)).count() as f32 / words.len() as f32
+    };
+    let symbol_coverage = symbol.map(coverage).unwrap_or(0.0);
+    (SYMBOL_WORDS_SHARE * symbol_coverage + PATH_WORDS_SHARE * coverage(filename)).min(1.0)
+}
+
+/// Words of a query that can name code: runs of letters, digits and `_` of
+/// two characters or more.
+fn query_terms(query: &str) -> Vec<&str> {
+    query
+        .split(|c: char| !(c.is_alphanumeric() || c == '_'))
+        .filter(|term| term.chars().count() > 1)
+        .collect()
+}
+
+fn is_generic(word: &str) -> bool {
+    GENERIC_WORDS.iter().any(|g| g.eq_ignore_ascii_case(word))
+}
+
+/// Whether `term` is specific enough to be taken for a symbol's name: written
+/// in snake or camel case, or a long enough word that isn't generic.
+fn is_identifier_like(term: &str) -> bool {
+    let snake = term.trim_matches('_').contains('_');
+    let camel = term
+        .chars()
+        .zip(term.chars().skip(1))
+        .any(|(a, b)| a.is_lowercase() && b.is_uppercase());
+    snake || camel || (term.chars().count() >= MIN_NAME_LEN && !is_generic(term))
+}
+
+/// The terms split into words as BM25 splits code, without generic words.
+fn query_words(terms: &[&str]) -> HashSet<String> {
+    terms
+        .iter()
+        .flat_map(|t| identifier_words(t))
+        .filter(|word| !is_generic(word))
+        .collect()
+}
+
+/// Words of `query` found in `symbol` and in `filename`, sorted, as
+/// [`symbol_match`] looks them up.
+pub(super) fn matched_words(
+    query: &str,
+    symbol: Option<&str>,
+    filename: &str,
+) -> (Vec<String>, Vec<String>) {
+    let words = query_words(&query_terms(query));
+    let found = |text: &str| -> Vec<String> {
+        identifier_words(text)
+            .into_iter()
+            .filter(|w| words.contains(w))
+            .collect::<BTreeSet<String>>()
+            .into_iter()
+            .collect()
+    };
+    (symbol.map(found).unwrap_or_default(), found(filename))
+}
+
+/// Adds `unit` times [`symbol_match`] to the score of each candidate; a full
+/// match gains the whole `unit`.
+pub(super) fn boost_symbol_matches(candidates: &mut [SearchResult], query: &str, unit: f32) {
+    if unit <= 0.0 {
+        return;
+    }
+    for candidate in candidates.iter_mut() {
+        let matched = symbol_match(query, candidate.symbol.as_deref(), &candidate.filename);
+        candidate.score += unit * matched;
+        if let Some(explanation) = candidate.explanation.as_mut() {
+            explanation.add_symbol_boost(unit * matched, candidate.rerank_score.is_some());
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_exact_name() {
+        let symbol = Some("main.AuthService.Authenticate");
+        assert_eq!(symbol_match("Authenticate", symbol, "auth.go"), 1.0);
+        assert_eq!(symbol_match("where is authenticate?", symbol, "a.go"), 1.0);
+        assert_eq!(
+            symbol_match("authenticate", Some("auth::Service::authenticate"), "a.rs"),
+            1.0
+        );
+        // The enclosing type's name is a word of the symbol, not its name
+        assert_eq!(symbol_match("AuthService", symbol, "a.go"), 0.5);
+    }
+
+    #[test]
+    fn test_partial_matches() {
+        let symbol = Some("main.RegisterUser");
+        assert_eq!(symbol_match("register user", symbol, "a.go"), 0.5);
+        assert_eq!(symbol_match("register_user", symbol, "a.go"), 0.5);
+        assert_eq!(symbol_match("user login", symbol, "a.go"), 0.25);
+        assert_eq!(
+            symbol_match("user service", symbol, "internal/user/service.go"),
+            0.25 + 0.25
+        );
+        assert_eq!(symbol_match("auth", None, "internal/auth/token.go"), 0.25);
+        assert_eq!(symbol_match("config", symbol, "a.go"), 0.0);
+        assert_eq!(symbol_match("? !", symbol, "a.go"), 0.0);
+    }
+
+    #[test]
+    fn test_generic_words() {
+        assert_eq!(symbol_match("run", Some("server.Run"), "a.go"), 0.0);
+        assert_eq!(symbol_match("main", Some("main"), "main.go"), 0.0);
+        assert_eq!(
+            symbol_match("how to get it", Some("cache.Get"), "a.go"),
+            0.0
+        );
+        // Short names still match when spelled as identifiers
+        assert_eq!(symbol_match("get_id", Some("user.get_id"), "a.rs"), 1.0);
+        assert_eq!(symbol_match("getId", Some("User.getId"), "a.ts"), 1.0);
+        // A generic word leaves the rest of the query to match
+        assert_eq!(
+            symbol_match("run server", Some("main.RunServer"), "a.go"),
+            0.5
+        );
+    }
+
+    #[test]
+    fn test_boost() {
+        let result = |symbol: &str, score: f32| SearchResult {
+            symbol: Some(symbol.to_string()),
+            filename: "auth.go".to_string(),
+            score,
+            ..Default::default()
+        };
+        let mut results = vec![
+            result("main.RegisterUser", 0.03),
+            result("main.AuthService.Authenticate", 0.01),
+        ];
+        boost_symbol_matches(&mut results, "Authenticate", 0.05);
+        assert_eq!(results[0].score, 0.03);
+        assert!((results[1].score - 0.06).abs() < 1e-6);
+
+        boost_symbol_matches(&mut results, "Authenticate", 0.0);
+        assert!((results[1].score - 0.06).abs() < 1e-6);
+    }
+
+    #[test]
+    fn test_matched_words() {
+        assert_eq!(
+            matched_words(
+                "register user service",
+                Some("main.RegisterUser"),
+                "internal/user/service.go"
+            ),
+            (
+                vec!["register".to_string(), "user".to_string()],
+                vec!["service".to_string(), "user".to_string()]
+            )
+        );
+        assert_eq!(
+            matched_words("config", None, "a.go"),
+            (Vec::new(), Vec::new())
+        );
+    }
+}
@@ -0,0 +1,306 @@
+use super::{
+    attach_source_context, retain_min_score, CandidateFilter, CodeSearcher, SearchResult,
+    TestFilter,
+};
+use crate::context::{ContextBuilder, PromptTemplate};
+use crate::indexer::DocType;
+use anyhow::Result;
+use serde::Serialize;
+use std::time::Duration;
+
+/// Options for [`CodeSearcher::query`].
+#[derive(Debug, Clone)]
+pub struct QueryOptions {
+    /// Maximum number of chunks to return.
+    pub max_chunks: usize,
+    /// Token budget for the returned chunks (including their headers), if any.
+    pub max_tokens: Option<usize>,
+    /// If true, [`QueryResult::prompt`] holds the assembled LLM context.
+    pub include_prompt: bool,
+    /// Layout of [`QueryResult::prompt`]; the default lists the chunks under
+    /// file headers, followed by the question.
+    pub prompt_template: PromptTemplate,
+    /// Optional file extension filter.
+    pub ext: Option<String>,
+    /// Optional directory filter.
+    pub dir: Option<String>,
+    /// Only return chunks whose path matches one of these globs (`**` recurses).
+    pub path_globs: Vec<String>,
+    /// Only return chunks in these languages (e.g. `go`, `python`).
+    pub languages: Vec<String>,
+    /// Only return Go declarations in these packages (e.g. `auth`).
+    pub packages: Vec<String>,
+    /// Only return chunks of these doc types, e.g. only Markdown docs; empty means all.
+    pub doc_types: Vec<DocType>,
+    /// Leaves out test code, or returns nothing else; see [`TestFilter`].
+    pub tests: TestFilter,
+    /// Only return chunks indexed into these collections; empty means all.
+    pub collections: Vec<String>,
+    /// Only return chunks carrying one of these user tags; empty means all.
+    pub tags: Vec<String>,
+    /// Workspace to search in.
+    pub workspace: Option<String>,
+    /// If true, skips the reranking stage.
+    pub no_rerank: bool,
+    /// If true, expands the question using an LLM before searching.
+    pub expand: bool,
+    /// Blend between semantic (1.0) and keyword (0.0) ranking; `None` uses the configured weights.
+    pub hybrid_alpha: Option<f32>,
+    /// Diversifies the chunks by maximal marginal relevance: 1.0 is pure relevance,
+    /// lower values penalize chunks similar to ones already picked. `None` disables it.
+    pub mmr_lambda: Option<f32>,
+    /// Returns at most this many chunks of any one file, filling the other
+    /// places with the next-best chunks of other files. `None` disables it.
+    pub max_per_file: Option<usize>,
+    /// Returns the whole declaration for a chunk that is one part of a split
+    /// one, see [`CodeSearcher::expand_to_symbols`].
+    pub expand_to_symbol: bool,
+    /// Adds symbols within this many call-graph hops of each hit (0 disables).
+    pub expand_graph: usize,
+    /// Maximum number of chunks added by call-graph expansion.
+    pub max_graph_chunks: usize,
+    /// Drops hits whose vector similarity to the question is below this, so
+    /// weak matches aren't returned just to fill `max_chunks`. `None` keeps all.
+    pub min_score: Option<f32>,
+    /// Favors recently changed code: each candidate's score is halved for
+    /// every `recency_half_life` since its lines last changed, before the best
+    /// are picked. `None` ranks by relevance alone. See [`apply_recency`](super::apply_recency).
+    pub recency_half_life: Option<Duration>,
+    /// Adds this many lines before and after each chunk, read from the file
+    /// on disk (0 disables). See [`attach_source_context`].
+    pub context_lines: usize,
+}
+
+impl Default for QueryOptions {
+    fn default() -> Self {
+        Self {
+            max_chunks: 5,
+            max_tokens: None,
+            include_prompt: false,
+            prompt_template: PromptTemplate::default(),
+            ext: None,
+            dir: None,
+            path_globs: Vec::new(),
+            languages: Vec::new(),
+            packages: Vec::new(),
+            doc_types: Vec::new(),
+            tests: TestFilter::All,
+            collections: Vec::new(),
+            tags: Vec::new(),
+            workspace: None,
+            no_rerank: false,
+            expand: false,
+            hybrid_alpha: None,
+            mmr_lambda: None,
+            max_per_file: None,
+            expand_to_symbol: false,
+            expand_graph: 0,
+            max_graph_chunks: 10,
+            min_score: None,
+            recency_half_life: None,
+            context_lines: 0,
+        }
+    }
+}
+
+impl QueryOptions {
+    /// The candidate filter made of the path, language, package, doc type,
+    /// test, collection and tag options. Fails on an invalid glob.
+    pub fn filter(&self) -> Result<CandidateFilter> {
+        Ok(CandidateFilter::new(
+            self.ext.clone(),
+            self.dir.clone(),
+            self.path_globs.clone(),
+            self.languages.clone(),
+        )?
+        .with_packages(self.packages.clone())
+        .with_doc_types(self.doc_types.clone())
+        .with_tests(self.tests)
+        .with_collections(self.collections.clone())
+        .with_tags(self.tags.clone()))
+    }
+}
+
+/// Where a returned chunk came from and how well it matched.
+#[derive(Serialize, Clone, Debug, PartialEq)]
+pub struct Citation {
+    pub filename: String,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub symbol: Option<String>,
+    pub line_start: i32,
+    pub line_end: i32,
+    /// Cosine similarity to the question, or the ranking score for keyword-only hits
+    pub score: f32,
+}
+
+impl From<&SearchResult> for Citation {
+    fn from(result: &SearchResult) -> Self {
+        Self {
+            filename: result.filename.clone(),
+            symbol: result.symbol.clone(),
+            line_start: result.line_start,
+            line_end: result.line_end,
+            score: result.vector_score.unwrap_or(result.score),
+        }
+    }
+}
+
+/// Answer to [`CodeSearcher::query`]: matched chunks with one citation each.
+#[derive(Serialize, Clone, Debug)]
+pub struct QueryResult {
+    pub question: String,
+    pub chunks: Vec<SearchResult>,
+    /// `citations[i]` describes `chunks[i]`
+    pub citations: Vec<Citation>,
+    /// The question and chunks laid out by [`QueryOptions::prompt_template`]
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub prompt: Option<String>,
+    /// Tokens occupied by the chunks and their headers
+    pub tokens_used: usize,
+    /// True when no chunk matched, e.g. all fell below `min_score`
+    pub no_relevant_matches: bool,
+}
+
+impl CodeSearcher {
+    /// Answers a question with ranked chunks, citations and optionally an LLM prompt.
+    ///
+    /// This is the high-level entry point for library users: it runs
+    /// [`filtered_search`](Self::filtered_search), optionally adds call-graph
+    /// neighbors of the hits and packs the best chunks into
+    /// `options.max_tokens` with a [`ContextBuilder`], trimming the last one if
+    /// needed.
+    ///
+    /// Hits below `options.min_score` are dropped before call-graph expansion;
+    /// when none remain, [`QueryResult::no_relevant_matches`] is set and the
+    /// default prompt says so instead of carrying an empty context.
+    ///
+    /// The prompt is rendered with `options.prompt_template`, which was
+    /// checked when it was [parsed](PromptTemplate::parse), before any search.
+    ///
+    /// # Examples
+    ///
+    /// ```no_run
+    /// use code_rag::context::PromptTemplate;
+    /// use code_rag::search::{CodeSearcher, QueryOptions};
+    ///
+    /// # async fn example(searcher: CodeSearcher) -> anyhow::Result<()> {
+    /// let options = QueryOptions {
+    ///     max_tokens: Some(2000),
+    ///     include_prompt: true,
+    ///     prompt_template: PromptTemplate::parse(
+    ///         "{% for chunk in chunks %}<code file=\"{{ chunk.file }}\">\n{{ chunk.text }}\n</code>\n{% endfor %}{{ query }}\n",
+    ///     )?,
+    ///     ..Default::default()
+    /// };
+    /// let result = searcher.query("where are sessions created?", &options).await?;
+    /// for citation in &result.citations {
+    ///     println!("{}:{}-{}", citation.filename, citation.line_start, citation.line_end);
+    /// }
+    /// # Ok(())
+    /// # }
+    /// ```
+    pub async fn query(&self, question: &str, options: &QueryOptions) -> Result<QueryResult> {
+        let filter = options.filter()?;
+        let results = self.ranked_search(question, options, &filter).await?;
+
+        let mut results = self
+            .expand_with_call_graph(
+                results,
+                options.expand_graph,
+                options.max_graph_chunks,
+                &filter,
+                options.workspace.as_deref(),
+            )
+            .await?;
+
+        let mut context =
+            ContextBuilder::new(options.max_tokens.unwrap_or(usize::MAX)).build(&results);
+        attach_source_context(&mut context.chunks, options.context_lines);
+        let citations = context.chunks.iter().map(Citation::from).collect();
+        let no_relevant_matches = context.chunks.is_empty();
+        let prompt = if options.include_prompt {
+            Some(options.prompt_template.render(question, &context.chunks)?)
+        } else {
+            None
+        };
+
+        Ok(QueryResult {
+            question: question.to_string(),
+            chunks: context.chunks,
+            citations,
+            prompt,
+            tokens_used: context.tokens_used,
+            no_relevant_matches,
+        })
+    }
+
+    /// The ranked hits [`query`](Self::query) starts from: up to
+    /// `options.max_chunks` results of
+    /// [`filtered_search`](Self::filtered_search) at or above
+    /// `options.min_score`, without call-graph neighbors, token budget or
+    /// source context.
+    pub async fn search_with_options(
+        &self,
+        question: &str,
+        options: &QueryOptions,
+    ) -> Result<Vec<SearchResult>> {
+        self.ranked_search(question, options, &options.filter()?)
+            .await
+    }
+
+    async fn ranked_search(
+        &self,
+        question: &str,
+        options: &QueryOptions,
+        filter: &CandidateFilter,
+    ) -> Result<Vec<SearchResult>> {
+        let mut results = self
+            .filtered_search(
+                question,
+                options.max_chunks,
+                filter,
+                options.no_rerank,
+                options.workspace.clone(),
+                None,
+                options.expand,
+                options.hybrid_alpha,
+                options.mmr_lambda,
+                options.max_per_file,
+                options.recency_half_life,
+                options.expand_to_symbol,
+            )
+            .await?;
+        retain_min_score(&mut results, options.min_score);
+        Ok(results)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn result(filename: &str, code: &str, symbol: Option<&str>) -> SearchResult {
+        SearchResult {
+            filename: filename.to_string(),
+            code: code.to_string(),
+            line_start: 1,
+            line_end: 3,
+            score: 0.5,
+            symbol: symbol.map(str::to_string),
+            language: Some("rust".to_string()),
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_citation_prefers_vector_score() {
+        let mut res = result("a.rs", "fn a() {}", Some("a.a"));
+        assert_eq!(Citation::from(&res).score, 0.5);
+
+        res.vector_score = Some(0.83);
+        let citation = Citation::from(&res);
+        assert_eq!(citation.score, 0.83);
+        assert_eq!(citation.symbol.as_deref(), Some("a.a"));
+        assert_eq!((citation.line_start, citation.line_end), (1, 3));
+    }
+}
@@ -0,0 +1,319 @@
+use super::{CandidateFilter, CodeSearcher, SearchResult};
+use crate::storage::Metric;
+use anyhow::{bail, Context, Result};
+use std::collections::{HashMap, HashSet};
+
+/// Options for [`CodeSearcher::refine_query`].
+///
+/// The weights are those of Rocchio's relevance feedback: the refined query
+/// vector is `query_weight * q + positive_weight * mean(relevant) -
+/// negative_weight * mean(non-relevant)`, brought to the form the store's
+/// [`Metric`] compares (unit length under cosine).
+#[derive(Debug, Clone, PartialEq)]
+pub struct RefineOptions {
+    /// Maximum number of results.
+    pub limit: usize,
+    /// Weight of the original query's embedding (α).
+    pub query_weight: f32,
+    /// Weight of the centroid of the chunks marked relevant (β).
+    pub positive_weight: f32,
+    /// Weight of the centroid of the chunks marked not relevant (γ), subtracted.
+    pub negative_weight: f32,
+    /// If true, the feedback chunks may be returned again; by default they
+    /// are left out so each round shows new code.
+    pub include_feedback: bool,
+}
+
+impl Default for RefineOptions {
+    fn default() -> Self {
+        Self {
+            limit: 5,
+            query_weight: 1.0,
+            positive_weight: 0.75,
+            negative_weight: 0.15,
+            include_feedback: false,
+        }
+    }
+}
+
+/// Mean of `vectors`, each [prepared](Metric::prepare) for `metric` first,
+/// so under cosine long and short chunks count the same; `None` if there are
+/// none.
+fn centroid(vectors: &[Vec<f32>], metric: Metric) -> Option<Vec<f32>> {
+    let dim = vectors.first()?.len();
+    let mut sum = vec![0.0f32; dim];
+    for vector in vectors {
+        let mut prepared = vector.clone();
+        metric.prepare(&mut prepared);
+        for (s, v) in sum.iter_mut().zip(&prepared) {
+            *s += v;
+        }
+    }
+    let count = vectors.len() as f32;
+    sum.iter_mut().for_each(|s| *s /= count);
+    Some(sum)
+}
+
+/// Adds `weight * vector` to `target`.
+fn add_scaled(target: &mut [f32], vector: &[f32], weight: f32) {
+    for (t, v) in target.iter_mut().zip(vector) {
+        *t += weight * v;
+    }
+}
+
+impl CodeSearcher {
+    /// Searches again after the caller marked earlier results as relevant
+    /// (`positive_ids`) or not (`negative_ids`).
+    ///
+    /// The query vector is moved towards the stored embeddings of the
+    /// relevant chunks and away from the others, see [`RefineOptions`]; the
+    /// feedback is pure vector arithmetic, nothing is trained or re-embedded
+    /// except `original` itself. An empty `original` searches by the feedback
+    /// alone ("more like these"), which needs no embedder. Results are ranked
+    /// by vector similarity to the refined vector, reported as both `score`
+    /// and `vector_score`.
+    ///
+    /// IDs are the `id` of earlier [`SearchResult`]s; an ID that isn't stored
+    /// in `workspace` is an error, since it usually means the index changed.
+    pub async fn refine_query(
+        &self,
+        original: &str,
+        positive_ids: &[String],
+        negative_ids: &[String],
+        options: &RefineOptions,
+        filter: &CandidateFilter,
+        workspace: Option<&str>,
+    ) -> Result<Vec<SearchResult>> {
+        let storage = self.storage.as_ref().context("Storage not initialized")?;
+        let ws = workspace.unwrap_or("default");
+        let original = original.trim();
+        if original.is_empty() && positive_ids.is_empty() {
+            bail!("Refining needs the original query or at least one relevant chunk");
+        }
+
+        let feedback: Vec<String> = positive_ids.iter().chain(negative_ids).cloned().collect();
+        let mut stored: HashMap<String, Vec<f32>> = storage
+            .get_vectors_by_ids(&feedback, ws)
+            .await?
+            .into_iter()
+            .collect();
+        let missing: Vec<&str> = feedback
+            .iter()
+            .filter(|id| !stored.contains_key(*id))
+            .map(String::as_str)
+            .collect();
+        if !missing.is_empty() {
+            bail!(
+                "Unknown chunk ID(s) in workspace '{}': {}. Search again to get current IDs.",
+                ws,
+                missing.join(", ")
+            );
+        }
+        let mut take = |ids: &[String]| -> Vec<Vec<f32>> {
+            ids.iter().filter_map(|id| stored.remove(id)).collect()
+        };
+        let positives = take(positive_ids);
+        let negatives = take(negative_ids);
+        let metric = storage.metric();
+
+        let mut query = if original.is_empty() {
+            Vec::new()
+        } else {
+            let mut vectors = self.embed_texts(vec![original.to_string()]).await?;
+            let mut vector = vectors.pop().context("Embedder returned no query vector")?;
+            metric.prepare(&mut vector);
+            vector.iter_mut().for_each(|v| *v *= options.query_weight);
+            vector
+        };
+        if let Some(centroid) = centroid(&positives, metric) {
+            query.resize(centroid.len(), 0.0);
+            add_scaled(&mut query, &centroid, options.positive_weight);
+        }
+        if let Some(centroid) = centroid(&negatives, metric) {
+            query.resize(centroid.len(), 0.0);
+            add_scaled(&mut query, &centroid, -options.negative_weight);
+        }
+        metric.prepare(&mut query);
+
+        let excluded: HashSet<&str> = if options.include_feedback {
+            HashSet::new()
+        } else {
+            feedback.iter().map(String::as_str).collect()
+        };
+        let missing_columns = storage.missing_columns().await?;
+        let hits = self
+            .cancel
+            .run(storage.search_chunks(
+                query,
+                options.limit + excluded.len(),
+                filter.sql_without(&missing_columns),
+                workspace,
+            ))
+            .await??;
+        tracing::debug!(
+            positives = positives.len(),
+            negatives = negatives.len(),
+            hits = hits.len(),
+            "Refined query search"
+        );
+
+        let mut results = Vec::with_capacity(options.limit);
+        for hit in hits {
+            if excluded.contains(hit.id.as_str()) || !filter.accepts(&hit.chunk) {
+                continue;
+            }
+            let similarity = hit.distance.map(|d| metric.similarity(d));
+            let mut result = SearchResult::from_chunk(hit.id, hit.chunk);
+            result.rank = results.len() + 1;
+            result.score = similarity.unwrap_or(0.0);
+            result.vector_score = similarity;
+            results.push(result);
+            if results.len() == options.limit {
+                break;
+            }
+        }
+        Ok(results)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::indexer::CodeChunk;
+    use crate::storage::{SqliteStore, VectorStore};
+    use std::sync::Arc;
+
+    fn chunk(filename: &str, symbol: &str) -> CodeChunk {
+        CodeChunk {
+            filename: filename.to_string(),
+            code: format!("func {}() {{}}", symbol),
+            line_start: 1,
+            line_end: 3,
+            symbol: Some(symbol.to_string()),
+            language: Some("go".to_string()),
+            ..Default::default()
+        }
+    }
+
+    async fn searcher() -> (CodeSearcher, Vec<String>) {
+        let chunks = vec![
+            chunk("auth/login.go", "auth.Login"),
+            chunk("auth/token.go", "auth.Refresh"),
+            chunk("db/pool.go", "db.Open"),
+            chunk("db/query.go", "db.Query"),
+            chunk("http/routes.go", "http.Routes"),
+            chunk("http/serve.go", "http.Serve"),
+        ];
+        let ids = chunks.iter().map(CodeChunk::id).collect();
+        let store = SqliteStore::open_in_memory().unwrap();
+        store.init(3).await.unwrap();
+        store
+            .add_code_chunks(
+                "default",
+                &chunks,
+                vec![
+                    vec![1.0, 0.0, 0.0],
+                    vec![0.9, 0.0, 0.1],
+                    vec![0.0, 1.0, 0.0],
+                    vec![0.1, 0.9, 0.0],
+                    vec![0.6, 0.0, 0.8],
+                    vec![0.5, 0.0, 0.85],
+                ],
+            )
+            .await
+            .unwrap();
+        let searcher = CodeSearcher::new(Some(Arc::new(store)), None, None, None, 1.0, 1.0, 60.0);
+        (searcher, ids)
+    }
+
+    fn no_filter() -> CandidateFilter {
+        CandidateFilter::new(None, None, Vec::new(), Vec::new()).unwrap()
+    }
+
+    #[test]
+    fn test_centroid_prepares_members() {
+        let members = [vec![2.0, 0.0], vec![0.0, 1.0]];
+        assert_eq!(centroid(&members, Metric::Cosine).unwrap(), vec![0.5, 0.5]);
+        // Dot and L2 compare vectors as stored, lengths included
+        assert_eq!(centroid(&members, Metric::Dot).unwrap(), vec![1.0, 0.5]);
+        assert_eq!(centroid(&members, Metric::L2).unwrap(), vec![1.0, 0.5]);
+        assert!(centroid(&[], Metric::Cosine).is_none());
+    }
+
+    #[tokio::test]
+    async fn test_more_like_this_moves_towards_feedback() {
+        let (searcher, ids) = searcher().await;
+        let results = searcher
+            .refine_query(
+                "",
+                &[ids[2].clone()],
+                &[],
+                &RefineOptions::default(),
+                &no_filter(),
+                None,
+            )
+            .await
+            .unwrap();
+
+        // The feedback chunk itself is left out
+        assert!(results.iter().all(|r| r.id != ids[2]));
+        assert_eq!(results[0].symbol.as_deref(), Some("db.Query"));
+        assert_eq!(results[0].rank, 1);
+        assert_eq!(results[0].vector_score, Some(results[0].score));
+    }
+
+    #[tokio::test]
+    async fn test_negative_feedback_pushes_away() {
+        let (searcher, ids) = searcher().await;
+        let symbols = |results: Vec<SearchResult>| -> Vec<String> {
+            results.into_iter().filter_map(|r| r.symbol).collect()
+        };
+        let login = [ids[0].clone()];
+
+        let plain = searcher
+            .refine_query(
+                "",
+                &login,
+                &[],
+                &RefineOptions::default(),
+                &no_filter(),
+                None,
+            )
+            .await
+            .unwrap();
+        assert_eq!(
+            symbols(plain)[..3],
+            ["auth.Refresh", "http.Routes", "http.Serve"]
+        );
+
+        // Marking http.Routes as not relevant also demotes its neighbor http.Serve
+        let options = RefineOptions {
+            negative_weight: 1.0,
+            ..Default::default()
+        };
+        let refined = searcher
+            .refine_query("", &login, &[ids[4].clone()], &options, &no_filter(), None)
+            .await
+            .unwrap();
+        assert_eq!(
+            symbols(refined),
+            ["auth.Refresh", "db.Query", "db.Open", "http.Serve"]
+        );
+    }
+
+    #[tokio::test]
+    async fn test_refine_errors() {
+        let (searcher, _) = searcher().await;
+        let options = RefineOptions::default();
+        assert!(searcher
+            .refine_query("", &[], &[], &options, &no_filter(), None)
+            .await
+            .is_err());
+        let err = searcher
+            .refine_query("", &["nope".to_string()], &[], &options, &no_filter(), None)
+            .await
+            .unwrap_err()
+            .to_string();
+        assert!(err.contains("nope"), "{}", err);
+    }
+}
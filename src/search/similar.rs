@@ -0,0 +1,413 @@
+use super::{CandidateFilter, CodeSearcher, SearchResult};
+use crate::indexer::{CodeChunk, DocType};
+use crate::storage::similarity::normalize;
+use anyhow::{anyhow, bail, Context, Result};
+use std::collections::{BTreeSet, HashSet};
+
+/// The code `code-rag similar` looks for neighbors of.
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum SimilarTarget {
+    /// `file:symbol`; the symbol matches a whole symbol ID or its trailing
+    /// `.`-separated parts, so `Authenticate` finds `main.AuthService.Authenticate`
+    Symbol { file: String, symbol: String },
+    /// `file:start-end` or `file:line`, 1-indexed and inclusive
+    Lines {
+        file: String,
+        start: usize,
+        end: usize,
+    },
+}
+
+impl SimilarTarget {
+    /// Parses `file:symbol`, `file:start-end` or `file:line`.
+    ///
+    /// Splits at the last `:`, so Windows paths such as `C:\src\auth.go:Login` work.
+    pub fn parse(spec: &str) -> Result<Self> {
+        let (file, target) = spec
+            .rsplit_once(':')
+            .filter(|(file, target)| !file.is_empty() && !target.is_empty())
+            .ok_or_else(|| {
+                anyhow!(
+                    "Expected <file>:<symbol> or <file>:<start>-<end>, got '{}'",
+                    spec
+                )
+            })?;
+        let file = file.to_string();
+
+        let is_lines = target.chars().all(|c| c.is_ascii_digit() || c == '-');
+        if !is_lines {
+            return Ok(Self::Symbol {
+                file,
+                symbol: target.to_string(),
+            });
+        }
+        let (start, end) = target.split_once('-').unwrap_or((target, target));
+        let (start, end): (usize, usize) = match (start.parse(), end.parse()) {
+            (Ok(start), Ok(end)) if start >= 1 && start <= end => (start, end),
+            _ => bail!("Invalid line range '{}' in '{}'", target, spec),
+        };
+        Ok(Self::Lines { file, start, end })
+    }
+
+    pub fn file(&self) -> &str {
+        match self {
+            Self::Symbol { file, .. } | Self::Lines { file, .. } => file,
+        }
+    }
+
+    fn matches(&self, chunk: &CodeChunk) -> bool {
+        match self {
+            Self::Symbol { symbol, .. } => chunk
+                .symbol
+                .as_deref()
+                .is_some_and(|s| symbol_matches(s, symbol)),
+            Self::Lines { start, end, .. } => chunk.line_start <= *end && chunk.line_end >= *start,
+        }
+    }
+}
+
+/// True if `wanted` is `symbol` or its last `.`-separated parts.
+pub fn symbol_matches(symbol: &str, wanted: &str) -> bool {
+    symbol == wanted
+        || symbol
+            .strip_suffix(wanted)
+            .is_some_and(|prefix| prefix.ends_with('.'))
+}
+
+/// Path as written by the user or the walker, comparable across the two.
+pub(crate) fn normalize_path(path: &str) -> String {
+    let path = path.replace('\\', "/");
+    path.trim_start_matches("./").to_string()
+}
+
+/// Error for a target that matches no chunk of `filename`, listing the
+/// symbols that do exist.
+fn no_match(
+    target: &SimilarTarget,
+    filename: &str,
+    chunks: &[(CodeChunk, Vec<f32>)],
+) -> anyhow::Error {
+    match target {
+        SimilarTarget::Symbol { symbol, .. } => {
+            let symbols: BTreeSet<&str> = chunks
+                .iter()
+                .filter_map(|(c, _)| c.symbol.as_deref())
+                .collect();
+            let listed = if symbols.is_empty() {
+                "none".to_string()
+            } else {
+                symbols.into_iter().collect::<Vec<_>>().join(", ")
+            };
+            anyhow!(
+                "No symbol '{}' in {}. Indexed symbols: {}",
+                symbol,
+                filename,
+                listed
+            )
+        }
+        SimilarTarget::Lines { start, end, .. } => anyhow!(
+            "No indexed chunk of {} covers lines {}-{}",
+            filename,
+            start,
+            end
+        ),
+    }
+}
+
+impl CodeSearcher {
+    /// Finds the chunks most similar to an indexed symbol or line range.
+    ///
+    /// The stored embeddings of the target's chunks are averaged into the
+    /// query vector, so no model is loaded and the text is not embedded again.
+    /// Every chunk of the target symbol is left out of the results, as are the
+    /// target chunks of a line range. Results are ranked by vector similarity,
+    /// reported as both `score` and `vector_score`.
+    ///
+    /// `target`'s file may be given relative to where it was indexed from
+    /// (`auth/service.go` for a chunk stored as `./repo/auth/service.go`) as
+    /// long as that names a single indexed file.
+    pub async fn similar(
+        &self,
+        target: &SimilarTarget,
+        limit: usize,
+        filter: &CandidateFilter,
+        workspace: Option<&str>,
+    ) -> Result<Vec<SearchResult>> {
+        let storage = self.storage.as_ref().context("Storage not initialized")?;
+        let ws = workspace.unwrap_or("default");
+
+        let filename = self.resolve_filename(target.file(), ws).await?;
+        let rows = storage.get_file_chunks(&filename, ws).await?;
+        let file_chunks = rows.len();
+        let (targets, others): (Vec<_>, Vec<_>) =
+            rows.into_iter().partition(|(c, _)| target.matches(c));
+        if targets.is_empty() {
+            return Err(no_match(target, &filename, &others));
+        }
+        if let SimilarTarget::Symbol { symbol, .. } = target {
+            let matched: BTreeSet<&str> = targets
+                .iter()
+                .filter_map(|(c, _)| c.symbol.as_deref())
+                .collect();
+            if matched.len() > 1 {
+                bail!(
+                    "'{}' matches several symbols in {}: {}. Give more of the symbol ID.",
+                    symbol,
+                    filename,
+                    matched.into_iter().collect::<Vec<_>>().join(", ")
+                );
+            }
+        }
+
+        let excluded_ids: HashSet<String> = targets.iter().map(|(c, _)| c.id()).collect();
+        let excluded_symbols: HashSet<String> = targets
+            .iter()
+            .filter_map(|(c, _)| c.symbol.clone())
+            .collect();
+        let dim = targets[0].1.len();
+        let mut query = vec![0.0f32; dim];
+        for (_, vector) in &targets {
+            for (q, v) in query.iter_mut().zip(vector) {
+                *q += v;
+            }
+        }
+        // The mean keeps the targets' scale where the metric doesn't ignore it
+        let metric = storage.metric();
+        if metric.normalizes() {
+            normalize(&mut query);
+        } else {
+            let count = targets.len() as f32;
+            query.iter_mut().for_each(|q| *q /= count);
+        }
+
+        let missing_columns = storage.missing_columns().await?;
+        let hits = self
+            .cancel
+            .run(storage.search_chunks(
+                query,
+                limit + file_chunks,
+                filter.sql_without(&missing_columns),
+                workspace,
+            ))
+            .await??;
+
+        let mut results = Vec::with_capacity(limit);
+        for hit in hits {
+            let chunk = hit.chunk;
+            let same_symbol = chunk.filename == filename
+                && chunk
+                    .symbol
+                    .as_ref()
+                    .is_some_and(|s| excluded_symbols.contains(s));
+            if excluded_ids.contains(&hit.id) || same_symbol || !filter.accepts(&chunk) {
+                continue;
+            }
+            let similarity = hit.distance.map(|d| metric.similarity(d));
+            results.push(SearchResult {
+                id: hit.id,
+                rank: results.len() + 1,
+                score: similarity.unwrap_or(0.0),
+                doc_type: DocType::of_file(&chunk.filename),
+                filename: chunk.filename,
+                code: chunk.code,
+                line_start: chunk.line_start as i32,
+                line_end: chunk.line_end as i32,
+                last_modified: chunk.last_modified,
+                calls: chunk.calls,
+                symbol: chunk.symbol,
+                language: chunk.language,
+                vector_score: similarity,
+                redacted: chunk.redacted,
+                overlap_lines: chunk.overlap_lines,
+                summary: chunk.summary,
+                package: chunk.package,
+                imports: chunk.imports,
+                part: chunk.part,
+                changed_at: chunk.changed_at,
+                is_test: chunk.is_test,
+                collection: chunk.collection,
+                tags: chunk.tags,
+                duplicates: chunk.duplicates,
+                ..Default::default()
+            });
+            if results.len() == limit {
+                break;
+            }
+        }
+        Ok(results)
+    }
+
+    /// Maps a user-supplied path to the filename it was indexed under.
+    async fn resolve_filename(&self, file: &str, workspace: &str) -> Result<String> {
+        let storage = self.storage.as_ref().context("Storage not initialized")?;
+        let infos = storage.list_chunk_info(workspace).await?;
+        let filenames: BTreeSet<&str> = infos.iter().map(|i| i.filename.as_str()).collect();
+        if filenames.contains(file) {
+            return Ok(file.to_string());
+        }
+
+        let wanted = normalize_path(file);
+        let suffix = format!("/{}", wanted);
+        let matches: Vec<&str> = filenames
+            .into_iter()
+            .filter(|f| {
+                let f = normalize_path(f);
+                f == wanted || f.ends_with(&suffix)
+            })
+            .collect();
+        match matches.as_slice() {
+            [filename] => Ok(filename.to_string()),
+            [] => bail!(
+                "File '{}' is not indexed in workspace '{}'",
+                file,
+                workspace
+            ),
+            _ => bail!(
+                "'{}' matches several indexed files: {}. Give a longer path.",
+                file,
+                matches.join(", ")
+            ),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::storage::{SqliteStore, VectorStore};
+    use std::sync::Arc;
+
+    fn chunk(filename: &str, symbol: &str, line_start: usize) -> CodeChunk {
+        CodeChunk {
+            filename: filename.to_string(),
+            code: format!("func {}() {{ /* {} */ }}", symbol, line_start),
+            line_start,
+            line_end: line_start + 9,
+            symbol: Some(symbol.to_string()),
+            language: Some("go".to_string()),
+            ..Default::default()
+        }
+    }
+
+    async fn searcher() -> CodeSearcher {
+        let store = SqliteStore::open_in_memory().unwrap();
+        store.init(3).await.unwrap();
+        store
+            .add_code_chunks(
+                "default",
+                &[
+                    // A symbol split into two chunks
+                    chunk("./repo/auth/service.go", "auth.Service.Authenticate", 10),
+                    chunk("./repo/auth/service.go", "auth.Service.Authenticate", 20),
+                    chunk("./repo/auth/service.go", "auth.Service.Logout", 40),
+                    chunk("./repo/admin/login.go", "admin.Login", 1),
+                    chunk("./repo/db/pool.go", "db.Open", 1),
+                ],
+                vec![
+                    vec![1.0, 0.0, 0.0],
+                    vec![0.9, 0.1, 0.0],
+                    vec![0.5, 0.5, 0.0],
+                    vec![0.95, 0.05, 0.0],
+                    vec![0.0, 0.0, 1.0],
+                ],
+            )
+            .await
+            .unwrap();
+        CodeSearcher::new(Some(Arc::new(store)), None, None, None, 1.0, 1.0, 60.0)
+    }
+
+    fn no_filter() -> CandidateFilter {
+        CandidateFilter::new(None, None, Vec::new(), Vec::new()).unwrap()
+    }
+
+    #[test]
+    fn test_parse_target() {
+        assert_eq!(
+            SimilarTarget::parse("auth/service.go:Authenticate").unwrap(),
+            SimilarTarget::Symbol {
+                file: "auth/service.go".to_string(),
+                symbol: "Authenticate".to_string(),
+            }
+        );
+        assert_eq!(
+            SimilarTarget::parse(r"C:\repo\db.go:12-30").unwrap(),
+            SimilarTarget::Lines {
+                file: r"C:\repo\db.go".to_string(),
+                start: 12,
+                end: 30,
+            }
+        );
+        assert_eq!(
+            SimilarTarget::parse("db.go:7").unwrap(),
+            SimilarTarget::Lines {
+                file: "db.go".to_string(),
+                start: 7,
+                end: 7,
+            }
+        );
+        assert!(SimilarTarget::parse("db.go").is_err());
+        assert!(SimilarTarget::parse("db.go:30-12").is_err());
+        assert!(SimilarTarget::parse(":Open").is_err());
+    }
+
+    #[test]
+    fn test_symbol_matches_trailing_parts() {
+        assert!(symbol_matches("auth.Service.Authenticate", "Authenticate"));
+        assert!(symbol_matches(
+            "auth.Service.Authenticate",
+            "Service.Authenticate"
+        ));
+        assert!(symbol_matches(
+            "auth.Service.Authenticate",
+            "auth.Service.Authenticate"
+        ));
+        assert!(!symbol_matches("auth.Service.Authenticate", "enticate"));
+    }
+
+    #[tokio::test]
+    async fn test_similar_excludes_target_symbol() {
+        let searcher = searcher().await;
+        let target = SimilarTarget::parse("auth/service.go:Authenticate").unwrap();
+        let results = searcher
+            .similar(&target, 3, &no_filter(), None)
+            .await
+            .unwrap();
+
+        let symbols: Vec<&str> = results.iter().filter_map(|r| r.symbol.as_deref()).collect();
+        assert_eq!(
+            symbols,
+            vec!["admin.Login", "auth.Service.Logout", "db.Open"]
+        );
+        assert_eq!(results[0].rank, 1);
+        assert!(results[0].score > results[1].score);
+        assert_eq!(results[0].vector_score, Some(results[0].score));
+    }
+
+    #[tokio::test]
+    async fn test_similar_line_range_and_errors() {
+        let searcher = searcher().await;
+        let target = SimilarTarget::parse("./repo/admin/login.go:3-4").unwrap();
+        let results = searcher
+            .similar(&target, 1, &no_filter(), None)
+            .await
+            .unwrap();
+        assert_eq!(
+            results[0].symbol.as_deref(),
+            Some("auth.Service.Authenticate")
+        );
+
+        let missing = SimilarTarget::parse("auth/service.go:Refresh").unwrap();
+        let err = searcher
+            .similar(&missing, 3, &no_filter(), None)
+            .await
+            .unwrap_err()
+            .to_string();
+        assert!(err.contains("auth.Service.Logout"), "{}", err);
+
+        let unknown = SimilarTarget::parse("nope.go:Open").unwrap();
+        assert!(searcher
+            .similar(&unknown, 3, &no_filter(), None)
+            .await
+            .is_err());
+    }
+}
@@ -0,0 +1,132 @@
+use super::SearchResult;
+use crate::indexer::read_revision_file;
+use std::collections::HashMap;
+use std::fs;
+
+/// Lines of a file as read from disk, `None` if it can't be read.
+type FileLines = Option<Vec<String>>;
+
+/// Reads the lines of `filename`; invalid UTF-8 is replaced rather than
+/// failing, the preview doesn't need to be exact bytes.
+pub(super) fn read_lines(filename: &str) -> FileLines {
+    let bytes = fs::read(filename)
+        .ok()
+        .or_else(|| read_revision_file(filename))?;
+    Some(
+        String::from_utf8_lossy(&bytes)
+            .lines()
+            .map(str::to_string)
+            .collect(),
+    )
+}
+
+/// Fills in `context_before` and `context_after` of each result with up to
+/// `lines` lines around the chunk, read fresh from the file on disk.
+///
+/// The context reflects the file as it is now, not as it was indexed. When
+/// the file is gone or no longer reaches the chunk's last line, the result is
+/// flagged `source_changed` and keeps whatever context still fits (possibly
+/// none). Each file is read once however many results it has; paths are
+/// resolved like the indexed filenames, relative to the working directory.
+/// Files indexed from a git revision are read from that revision.
+/// `lines == 0` leaves the results untouched.
+pub fn attach_source_context(results: &mut [SearchResult], lines: usize) {
+    if lines == 0 {
+        return;
+    }
+    let mut files: HashMap<String, FileLines> = HashMap::new();
+    for result in results.iter_mut() {
+        let content = files
+            .entry(result.filename.clone())
+            .or_insert_with(|| read_lines(&result.filename));
+        let Some(content) = content else {
+            result.source_changed = true;
+            continue;
+        };
+
+        let start = (result.line_start.max(1) as usize) - 1;
+        let end = result.line_end.max(0) as usize;
+        let len = content.len();
+        if end > len {
+            result.source_changed = true;
+        }
+        // Lines that moved past the end of the file are left out, so the
+        // context stays numbered from `line_start`
+        result.context_before =
+            content[start.saturating_sub(lines).min(len)..start.min(len)].to_vec();
+        if !result.source_changed {
+            result.context_after = content[end..end.saturating_add(lines).min(len)].to_vec();
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn result(filename: &str, line_start: i32, line_end: i32) -> SearchResult {
+        SearchResult {
+            filename: filename.to_string(),
+            line_start,
+            line_end,
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_context_lines_around_chunk() {
+        let dir = TempDir::new().unwrap();
+        let path = dir.path().join("main.go");
+        let text: Vec<String> = (1..=10).map(|i| format!("line {}", i)).collect();
+        fs::write(&path, text.join("\n")).unwrap();
+        let file = path.to_str().unwrap();
+
+        let mut results = vec![result(file, 4, 6), result(file, 1, 2), result(file, 9, 10)];
+        attach_source_context(&mut results, 2);
+
+        assert_eq!(results[0].context_before, ["line 2", "line 3"]);
+        assert_eq!(results[0].context_after, ["line 7", "line 8"]);
+        assert!(!results[0].source_changed);
+        // Clipped at the start and end of the file
+        assert!(results[1].context_before.is_empty());
+        assert_eq!(results[1].context_after, ["line 3", "line 4"]);
+        assert_eq!(results[2].context_before, ["line 7", "line 8"]);
+        assert!(results[2].context_after.is_empty());
+        assert!(!results[2].source_changed);
+
+        let mut whole = vec![result(file, 4, 6)];
+        attach_source_context(&mut whole, usize::MAX);
+        assert_eq!(whole[0].context_before.len(), 3);
+        assert_eq!(whole[0].context_after.len(), 4);
+    }
+
+    #[test]
+    fn test_changed_source_is_flagged() {
+        let dir = TempDir::new().unwrap();
+        let path = dir.path().join("short.go");
+        fs::write(&path, "a\nb\nc\n").unwrap();
+        let file = path.to_str().unwrap();
+        let missing = dir.path().join("gone.go");
+
+        let mut results = vec![
+            result(file, 3, 8),
+            result(file, 6, 8),
+            result(missing.to_str().unwrap(), 1, 2),
+        ];
+        attach_source_context(&mut results, 2);
+
+        // The file shrank below the chunk's end: keep what still exists
+        assert!(results[0].source_changed);
+        assert_eq!(results[0].context_before, ["a", "b"]);
+        assert!(results[0].context_after.is_empty());
+        assert!(results[1].source_changed);
+        assert!(results[1].context_before.is_empty());
+        assert!(results[2].source_changed);
+        assert!(results[2].context_before.is_empty());
+
+        let mut untouched = vec![result(missing.to_str().unwrap(), 1, 2)];
+        attach_source_context(&mut untouched, 0);
+        assert!(!untouched[0].source_changed);
+    }
+}
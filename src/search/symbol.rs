@@ -0,0 +1,214 @@
+use super::source::read_lines;
+use super::{CodeSearcher, SearchResult};
+use crate::indexer::CodeChunk;
+use anyhow::{Context, Result};
+use std::collections::{HashMap, HashSet};
+
+/// Text and line range of a declaration put back together from its stored
+/// parts, or `None` unless all of them are present and can be joined.
+///
+/// Parts follow each other line by line. Lines a part repeats from the
+/// previous one ([`CodeChunk::overlap_lines`]) are kept once, and blank lines
+/// between parts, which aren't stored, are restored. Parts that cut a single
+/// line into pieces can't be joined exactly and give `None`.
+fn join_parts(mut parts: Vec<CodeChunk>) -> Option<(String, usize, usize)> {
+    parts.sort_by_key(|c| c.part.map(|p| p.index));
+    let count = parts.first()?.part?.count;
+    let complete = parts.len() == count
+        && parts
+            .iter()
+            .enumerate()
+            .all(|(i, c)| c.part.is_some_and(|p| p.index == i + 1 && p.count == count));
+    if !complete {
+        return None;
+    }
+
+    let first_line = parts[0].line_start;
+    let mut lines: Vec<&str> = Vec::new();
+    let mut last_line = first_line.saturating_sub(1);
+    for part in &parts {
+        let repeated = (last_line + 1).saturating_sub(part.line_start);
+        if repeated > 0 && repeated != part.overlap_lines {
+            return None;
+        }
+        // Padding to the part's range also restores trailing blank lines,
+        // which `lines()` doesn't yield
+        lines.resize(part.line_start + repeated - first_line, "");
+        lines.extend(part.code.lines().skip(repeated));
+        lines.resize(part.line_end + 1 - first_line, "");
+        last_line = part.line_end;
+    }
+    Some((lines.join("\n"), first_line, last_line))
+}
+
+/// Lines `line_start..=line_end` (1-indexed) of `filename` as on disk, if it
+/// still has that many.
+fn read_range(filename: &str, line_start: usize, line_end: usize) -> Option<String> {
+    let lines = read_lines(filename)?;
+    let range = lines.get(line_start.checked_sub(1)?..line_end)?;
+    Some(range.join("\n"))
+}
+
+impl CodeSearcher {
+    /// Replaces each result that is a part of a split declaration (see
+    /// [`ChunkPart`](crate::indexer::ChunkPart)) with the whole declaration,
+    /// and drops the other parts of the same symbol further down, so the
+    /// best-ranked part stands for all of them.
+    ///
+    /// The declaration is reassembled from the parts stored for the symbol in
+    /// the result's file, see [`join_parts`]. If they can't be joined, its
+    /// lines are re-read from disk, and if the file no longer has them the
+    /// fragment is kept. The whole declaration keeps the score and ID of the
+    /// part that matched. Results that aren't parts are left as they are.
+    pub async fn expand_to_symbols(
+        &self,
+        results: Vec<SearchResult>,
+        workspace: Option<&str>,
+    ) -> Result<Vec<SearchResult>> {
+        if results
+            .iter()
+            .all(|r| r.part.is_none() || r.symbol.is_none())
+        {
+            return Ok(results);
+        }
+        let storage = self.storage.as_ref().context("Storage not initialized")?;
+        let ws = workspace.unwrap_or("default");
+
+        let mut file_chunks: HashMap<String, Vec<CodeChunk>> = HashMap::new();
+        let mut seen: HashSet<(String, String)> = HashSet::new();
+        let mut expanded = Vec::with_capacity(results.len());
+        for mut result in results {
+            let Some(symbol) = result.symbol.clone().filter(|_| result.part.is_some()) else {
+                expanded.push(result);
+                continue;
+            };
+            if !seen.insert((result.filename.clone(), symbol.clone())) {
+                continue;
+            }
+
+            if !file_chunks.contains_key(&result.filename) {
+                let chunks = match storage.get_file_chunks(&result.filename, ws).await {
+                    Ok(rows) => rows.into_iter().map(|(chunk, _)| chunk).collect(),
+                    Err(e) => {
+                        tracing::warn!(
+                            "Failed to read the parts of {} in {}: {}",
+                            symbol,
+                            result.filename,
+                            e
+                        );
+                        Vec::new()
+                    }
+                };
+                file_chunks.insert(result.filename.clone(), chunks);
+            }
+            let parts: Vec<CodeChunk> = file_chunks[&result.filename]
+                .iter()
+                .filter(|c| c.part.is_some() && c.symbol.as_deref() == Some(symbol.as_str()))
+                .cloned()
+                .collect();
+            let calls: Vec<String> = parts.iter().flat_map(|c| c.calls.clone()).collect();
+
+            let (line_start, line_end) = parts.iter().fold(
+                (result.line_start as usize, result.line_end as usize),
+                |(start, end), c| (start.min(c.line_start), end.max(c.line_end)),
+            );
+            let code = join_parts(parts).map(|(code, _, _)| code).or_else(|| {
+                tracing::debug!(
+                    symbol = %symbol,
+                    file = %result.filename,
+                    "Parts can't be joined; reading the declaration from disk"
+                );
+                read_range(&result.filename, line_start, line_end)
+            });
+            let Some(code) = code else {
+                tracing::debug!(symbol = %symbol, "Keeping the matched part");
+                expanded.push(result);
+                continue;
+            };
+
+            result.code = code;
+            result.line_start = line_start as i32;
+            result.line_end = line_end as i32;
+            result.part = None;
+            result.overlap_lines = 0;
+            for call in calls {
+                if !result.calls.contains(&call) {
+                    result.calls.push(call);
+                }
+            }
+            expanded.push(result);
+        }
+        for (i, res) in expanded.iter_mut().enumerate() {
+            res.rank = i + 1;
+        }
+        Ok(expanded)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::indexer::ChunkPart;
+    use tempfile::TempDir;
+
+    fn part(code: &str, lines: (usize, usize), index: usize, count: usize) -> CodeChunk {
+        CodeChunk {
+            filename: "big.go".to_string(),
+            symbol: Some("main.Handle".to_string()),
+            code: code.to_string(),
+            line_start: lines.0,
+            line_end: lines.1,
+            part: Some(ChunkPart { index, count }),
+            ..Default::default()
+        }
+    }
+
+    #[test]
+    fn test_join_parts() {
+        let parts = vec![
+            part("\tb := 2\n}", (12, 13), 2, 2),
+            part("func Handle() {\n\ta := 1", (10, 11), 1, 2),
+        ];
+        assert_eq!(
+            join_parts(parts),
+            Some(("func Handle() {\n\ta := 1\n\tb := 2\n}".to_string(), 10, 13))
+        );
+
+        // A blank line between parts, and a part repeating the last line
+        let mut overlapping = part("\ta := 1\n\tb := 2\n}", (11, 13), 2, 2);
+        overlapping.overlap_lines = 1;
+        let parts = vec![
+            part("func Handle() {\n\ta := 1", (10, 11), 1, 2),
+            overlapping,
+        ];
+        assert_eq!(
+            join_parts(parts).map(|(code, _, _)| code),
+            Some("func Handle() {\n\ta := 1\n\tb := 2\n}".to_string())
+        );
+        let parts = vec![part("x := 1", (1, 1), 1, 2), part("y := 2", (3, 3), 2, 2)];
+        assert_eq!(join_parts(parts).unwrap().0, "x := 1\n\ny := 2");
+
+        // A missing part, and a line cut into pieces
+        assert_eq!(join_parts(vec![part("a", (1, 1), 1, 2)]), None);
+        let pieces = vec![
+            part("var x = [1,", (1, 1), 1, 2),
+            part("2,3]", (1, 1), 2, 2),
+        ];
+        assert_eq!(join_parts(pieces), None);
+    }
+
+    #[test]
+    fn test_read_range() {
+        let dir = TempDir::new().unwrap();
+        let path = dir.path().join("min.js");
+        std::fs::write(&path, "a\nvar x = [1,2,3]\nb\n").unwrap();
+        let file = path.to_str().unwrap();
+        assert_eq!(read_range(file, 2, 2).as_deref(), Some("var x = [1,2,3]"));
+        assert_eq!(
+            read_range(file, 1, 3).as_deref(),
+            Some("a\nvar x = [1,2,3]\nb")
+        );
+        assert_eq!(read_range(file, 2, 9), None);
+        assert_eq!(read_range(file, 0, 1), None);
+    }
+}
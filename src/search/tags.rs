@@ -0,0 +1,95 @@
+use super::SearchResult;
+use std::collections::BTreeMap;
+
+/// Weight of a tag passed to `--boost-tag` without one.
+pub const DEFAULT_TAG_BOOST: f32 = 0.5;
+
+/// Parses a `--boost-tag` argument, `security` or `security=0.8`, into the
+/// tag and its weight; the tag is lowercased. A negative weight demotes the
+/// chunks carrying the tag.
+pub fn parse_tag_boost(text: &str) -> Result<(String, f32), String> {
+    let (tag, weight) = match text.split_once('=') {
+        Some((tag, weight)) => {
+            let weight: f32 = weight
+                .trim()
+                .parse()
+                .map_err(|_| format!("Invalid weight in '{}' (use TAG or TAG=WEIGHT)", text))?;
+            if !weight.is_finite() {
+                return Err(format!("Invalid weight in '{}'", text));
+            }
+            (tag, weight)
+        }
+        None => (text, DEFAULT_TAG_BOOST),
+    };
+    let tag = tag.trim().to_lowercase();
+    if !crate::indexer::is_valid_tag(&tag) {
+        return Err(format!(
+            "Invalid tag '{}' (use letters, digits, '_', '-' and '.')",
+            tag
+        ));
+    }
+    Ok((tag, weight))
+}
+
+/// Adds `unit` times the summed weights of its boosted tags to the score of
+/// each candidate; a candidate with one tag of weight 1.0 gains the whole `unit`.
+pub(super) fn boost_tagged(
+    candidates: &mut [SearchResult],
+    boosts: &BTreeMap<String, f32>,
+    unit: f32,
+) {
+    if boosts.is_empty() {
+        return;
+    }
+    for candidate in candidates.iter_mut() {
+        let weight: f32 = candidate
+            .tags
+            .iter()
+            .filter_map(|tag| boosts.get(tag))
+            .sum();
+        candidate.score += unit * weight;
+        if let Some(explanation) = candidate.explanation.as_mut() {
+            explanation.add_tag_boost(unit * weight, candidate.rerank_score.is_some());
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_tag_boost() {
+        assert_eq!(
+            parse_tag_boost("Security").unwrap(),
+            ("security".to_string(), DEFAULT_TAG_BOOST)
+        );
+        assert_eq!(
+            parse_tag_boost("legacy=-0.25").unwrap(),
+            ("legacy".to_string(), -0.25)
+        );
+        assert!(parse_tag_boost("legacy=lots").is_err());
+        assert!(parse_tag_boost("legacy=inf").is_err());
+        assert!(parse_tag_boost("=1").is_err());
+        assert!(parse_tag_boost("it's=1").is_err());
+    }
+
+    #[test]
+    fn test_boost_tagged() {
+        let result = |tags: &[&str], score: f32| SearchResult {
+            tags: tags.iter().map(|t| t.to_string()).collect(),
+            score,
+            ..Default::default()
+        };
+        let mut results = vec![
+            result(&[], 0.03),
+            result(&["security"], 0.01),
+            result(&["legacy", "security"], 0.02),
+        ];
+        let boosts = BTreeMap::from([("security".to_string(), 1.0), ("legacy".to_string(), -0.5)]);
+        boost_tagged(&mut results, &boosts, 0.02);
+        assert_eq!(results[0].score, 0.03);
+        assert!((results[1].score - 0.03).abs() < 1e-6);
+        assert!((results[2].score - 0.03).abs() < 1e-6);
+    }
+}
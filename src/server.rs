@@ -1,13 +1,23 @@
-use crate::embedding::Embedder;
+use crate::context::PromptTemplate;
+use crate::core::CancelToken;
+use crate::embedding::{create_remote_provider, Embedder, RemoteOptions};
+use crate::indexer::DocType;
 use crate::llm::client::OllamaClient;
 use crate::llm::expander::QueryExpander;
-use crate::search::{CodeSearcher, SearchResult};
+use crate::rerank::OnnxRerankerOptions;
+use crate::search::{
+    attach_source_context, half_life_days, retain_min_score, CandidateFilter, CodeSearcher,
+    QueryOptions, RefineOptions, SearchResult, TestFilter,
+};
+use crate::storage::{HnswParams, Metric, MultiVectorParams};
+mod layers;
 pub mod workspace_manager;
-use crate::server::workspace_manager::WorkspaceManager;
+use crate::server::workspace_manager::{WorkspaceManager, WorkspaceSearchContext};
 use anyhow::Result;
 use axum::{
     extract::{Json, Path, State},
     http::StatusCode,
+    middleware,
     response::IntoResponse,
     routing::{get, post},
     Router,
@@ -15,17 +25,26 @@ use axum::{
 use opentelemetry::{global, KeyValue};
 use prometheus::{Encoder, TextEncoder};
 use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
 use std::net::SocketAddr;
 use std::sync::Arc;
 use std::time::Instant;
 use tower_http::cors::CorsLayer;
 use tower_http::trace::TraceLayer;
-use tracing::{error, info};
+use tracing::{error, info, warn};
+
+/// Environment variable holding the bearer token required by `serve`.
+pub const API_TOKEN_ENV: &str = "CODE_RAG_API_TOKEN";
+
+/// Most source lines a request gets around each result with `context_lines`.
+pub const MAX_CONTEXT_LINES: usize = 200;
 
 // Shared state holding the workspace manager
 #[derive(Clone)]
 pub struct AppState {
     pub workspace_manager: Arc<WorkspaceManager>,
+    /// Bearer token required on every route except the health and readiness checks
+    pub auth_token: Option<Arc<str>>,
 }
 
 // Request payload
@@ -37,11 +56,54 @@ pub struct SearchRequest {
     pub ext: Option<String>,
     pub dir: Option<String>,
     #[serde(default)]
+    pub path_globs: Vec<String>,
+    #[serde(default)]
+    pub languages: Vec<String>,
+    /// Only return Go declarations in these packages
+    #[serde(default)]
+    pub packages: Vec<String>,
+    /// Only return chunks of these doc types (`code`, `markdown`, `text`)
+    #[serde(default)]
+    pub doc_types: Vec<DocType>,
+    /// `exclude` leaves out test code, `only` returns nothing else (default: `all`)
+    #[serde(default)]
+    pub tests: TestFilter,
+    /// Only return chunks indexed into these collections
+    #[serde(default)]
+    pub collections: Vec<String>,
+    /// Only return chunks carrying one of these user tags
+    #[serde(default)]
+    pub tags: Vec<String>,
+    /// Score added to chunks carrying these user tags, as `--boost-tag`
+    #[serde(default)]
+    pub boost_tags: BTreeMap<String, f32>,
+    #[serde(default)]
     pub no_rerank: bool,
 
     pub max_tokens: Option<usize>,
     #[serde(default)]
     pub expand: bool,
+    /// Blend between semantic (1.0) and keyword (0.0) ranking
+    pub hybrid_alpha: Option<f32>,
+    /// Enables MMR diversification (1.0 = pure relevance)
+    pub mmr_lambda: Option<f32>,
+    /// At most this many results from any one file
+    pub max_per_file: Option<usize>,
+    /// Whole declarations instead of the matched parts of split ones
+    #[serde(default)]
+    pub expand_to_symbol: bool,
+    /// Drops results below this cosine similarity; defaults to `min_score`
+    /// of the server's config
+    pub min_score: Option<f32>,
+    /// Weights result scores by recency, halving them per this many days
+    /// since a chunk last changed
+    pub recency_half_life_days: Option<f64>,
+    /// Lines of surrounding source to add to each result, read from disk
+    #[serde(default)]
+    pub context_lines: usize,
+    /// Adds the parts of each result's score as `explanation`
+    #[serde(default)]
+    pub explain: bool,
 }
 
 fn default_limit() -> usize {
@@ -54,18 +116,126 @@ pub struct SearchResponse {
     pub results: Vec<SearchResult>,
 }
 
+/// Body of `POST /query`, the HTTP form of [`CodeSearcher::query`].
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct QueryRequest {
+    pub query: String,
+    #[serde(default = "default_limit")]
+    pub max_chunks: usize,
+    /// Only return chunks whose path matches this glob
+    pub path_glob: Option<String>,
+    /// Only return Go declarations in this package
+    pub package: Option<String>,
+    /// Only return chunks of these doc types (`code`, `markdown`, `text`)
+    #[serde(default)]
+    pub doc_types: Vec<DocType>,
+    /// `exclude` leaves out test code, `only` returns nothing else (default: `all`)
+    #[serde(default)]
+    pub tests: TestFilter,
+    /// Only return chunks indexed into these collections
+    #[serde(default)]
+    pub collections: Vec<String>,
+    /// Only return chunks carrying one of these user tags
+    #[serde(default)]
+    pub tags: Vec<String>,
+    /// Score added to chunks carrying these user tags, as `--boost-tag`
+    #[serde(default)]
+    pub boost_tags: BTreeMap<String, f32>,
+    pub max_tokens: Option<usize>,
+    /// Workspace to search (default: `default`)
+    pub workspace: Option<String>,
+    /// Enables MMR diversification (1.0 = pure relevance)
+    pub mmr_lambda: Option<f32>,
+    /// At most this many chunks from any one file
+    pub max_per_file: Option<usize>,
+    /// Whole declarations instead of the matched parts of split ones
+    #[serde(default)]
+    pub expand_to_symbol: bool,
+    /// Drops chunks below this cosine similarity; defaults to `min_score`
+    /// of the server's config
+    pub min_score: Option<f32>,
+    /// Favors recently changed chunks, see [`QueryOptions::recency_half_life`]
+    pub recency_half_life_days: Option<f64>,
+    /// Lines of surrounding source to add to each chunk, read from disk
+    #[serde(default)]
+    pub context_lines: usize,
+    /// Also return the assembled LLM prompt
+    #[serde(default)]
+    pub include_prompt: bool,
+    /// Layout of the prompt, see [`PromptTemplate`]; implies `include_prompt`
+    pub prompt_template: Option<String>,
+}
+
+/// Body of `POST /refine`, the HTTP form of [`CodeSearcher::refine_query`].
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "camelCase")]
+pub struct RefineRequest {
+    /// The original query; may be empty to search by the feedback alone
+    #[serde(default)]
+    pub query: String,
+    /// IDs of earlier results marked "more like this"
+    #[serde(default)]
+    pub positive_ids: Vec<String>,
+    /// IDs of earlier results marked "not relevant"
+    #[serde(default)]
+    pub negative_ids: Vec<String>,
+    #[serde(default = "default_limit")]
+    pub limit: usize,
+    /// Workspace to search (default: `default`)
+    pub workspace: Option<String>,
+    /// Only return chunks whose path matches one of these globs
+    #[serde(default)]
+    pub path_globs: Vec<String>,
+    /// Weight of the original query (Rocchio α, default 1.0)
+    pub query_weight: Option<f32>,
+    /// Weight of the relevant chunks (β, default 0.75)
+    pub positive_weight: Option<f32>,
+    /// Weight of the non-relevant chunks (γ, default 0.15)
+    pub negative_weight: Option<f32>,
+    /// Also return the chunks given as feedback
+    #[serde(default)]
+    pub include_feedback: bool,
+}
+
 pub struct ServerStartConfig {
     pub host: String,
     pub port: u16,
     pub db_path: String,
+    /// `lancedb` or `sqlite`, see [`open_store`](crate::storage::open_store)
+    pub storage_backend: String,
+    /// HNSW parameters when `vector_index` is `hnsw`, `None` for exact search
+    pub vector_index: Option<HnswParams>,
+    /// Facets embedded besides each chunk, see `multi_vector`; `None` for one vector per chunk
+    pub multi_vector: Option<MultiVectorParams>,
+    /// Distance the stores rank by, see `distance_metric`
+    pub distance_metric: Metric,
+    /// Weight of doc comment matches in BM25, see `bm25_doc_boost`
+    pub bm25_doc_boost: f32,
+    /// Queries cached per workspace, 0 to disable
+    pub query_cache_size: usize,
+    pub embedding_provider: String,
+    /// Host, headers and retry policy of the remote embedding backends
+    pub embedding_remote: RemoteOptions,
     pub embedding_model: String,
     pub reranker_model: String,
+    pub reranker: String,
+    pub rerank_top_k: usize,
+    /// Boost for results whose symbol the query names, see `symbol_weight`
+    pub symbol_weight: f32,
+    /// Similarity below which results are dropped when a request doesn't
+    /// set its own, see `min_score`
+    pub min_score: Option<f32>,
     pub embedding_model_path: Option<String>,
     pub reranker_model_path: Option<String>,
+    /// Model directory and batching of `reranker = "onnx"`
+    pub onnx_reranker: OnnxRerankerOptions,
     pub device: String,
     pub llm_enabled: bool,
     pub llm_host: String,
     pub llm_model: String,
+    /// Bearer token clients must send; `None` leaves the API open
+    pub auth_token: Option<String>,
 }
 
 pub async fn start_server(config: ServerStartConfig) -> Result<()> {
@@ -74,15 +244,28 @@ pub async fn start_server(config: ServerStartConfig) -> Result<()> {
     // Extract connection info before moving config
     let host = config.host.clone();
     let port = config.port;
+    let auth_token = config.auth_token.clone().map(Arc::<str>::from);
 
     // 1. Init Embedder (with re-ranker) - Shared across workspaces
-    let embedder = Embedder::new(
-        config.embedding_model.clone(),
-        config.reranker_model.clone(),
-        config.embedding_model_path.clone(),
-        config.reranker_model_path.clone(),
-        config.device.clone(),
-    )?;
+    let embedder = match create_remote_provider(
+        &config.embedding_provider,
+        &config.embedding_model,
+        &config.embedding_remote,
+    )? {
+        Some(provider) => Embedder::with_provider(
+            false,
+            provider,
+            config.reranker_model.clone(),
+            config.reranker_model_path.clone(),
+        )?,
+        None => Embedder::new(
+            config.embedding_model.clone(),
+            config.reranker_model.clone(),
+            config.embedding_model_path.clone(),
+            config.reranker_model_path.clone(),
+            config.device.clone(),
+        )?,
+    };
     embedder.init_reranker()?; // Pre-load re-ranker
     let embedder = Arc::new(embedder);
 
@@ -97,17 +280,17 @@ pub async fn start_server(config: ServerStartConfig) -> Result<()> {
     };
 
     // 3. Init WorkspaceManager
-    let manager = WorkspaceManager::new(config, embedder, expander);
+    let manager = Arc::new(WorkspaceManager::new(config, embedder, expander));
 
-    // Pre-load default workspace if exists
-    if let Err(e) = manager.get_searcher("default").await {
-        info!("Note: Default workspace could not be pre-loaded: {}", e);
-    } else {
-        info!("Default workspace pre-loaded successfully.");
+    if auth_token.is_none() {
+        warn!(
+            "{} is not set; the API accepts unauthenticated requests.",
+            API_TOKEN_ENV
+        );
     }
-
     let state = AppState {
-        workspace_manager: Arc::new(manager),
+        workspace_manager: manager.clone(),
+        auth_token,
     };
 
     // 4. Build Router
@@ -120,19 +303,79 @@ pub async fn start_server(config: ServerStartConfig) -> Result<()> {
     let listener = tokio::net::TcpListener::bind(addr).await?;
     info!("✓ HTTP Server started successfully at http://{}", addr);
 
-    axum::serve(listener, router).await?;
+    // 6. Warm up while already answering /healthz; /readyz waits for it
+    tokio::spawn(warm_up(manager));
+
+    // The index is read-only here, so there is nothing to flush: stop accepting
+    // connections and let in-flight requests finish.
+    axum::serve(listener, router)
+        .with_graceful_shutdown(shutdown_signal())
+        .await?;
+    info!("Server stopped.");
 
     Ok(())
 }
 
+/// Runs [`WorkspaceManager::warm_up`] until it succeeds, so a model endpoint
+/// still starting up doesn't leave the server unready for good.
+async fn warm_up(manager: Arc<WorkspaceManager>) {
+    const RETRY_DELAY: std::time::Duration = std::time::Duration::from_secs(5);
+    while let Err(e) = manager.warm_up().await {
+        warn!("Warm-up failed: {:#}. Retrying in {:?}.", e, RETRY_DELAY);
+        tokio::time::sleep(RETRY_DELAY).await;
+    }
+}
+
+/// Resolves on Ctrl+C or SIGTERM.
+async fn shutdown_signal() {
+    let ctrl_c = async {
+        if let Err(e) = tokio::signal::ctrl_c().await {
+            error!("Failed to listen for Ctrl+C: {}", e);
+            std::future::pending::<()>().await;
+        }
+    };
+
+    #[cfg(unix)]
+    let terminate = async {
+        use tokio::signal::unix::{signal, SignalKind};
+        match signal(SignalKind::terminate()) {
+            Ok(mut sigterm) => {
+                sigterm.recv().await;
+            }
+            Err(e) => {
+                error!("Failed to listen for SIGTERM: {}", e);
+                std::future::pending::<()>().await;
+            }
+        }
+    };
+    #[cfg(not(unix))]
+    let terminate = std::future::pending::<()>();
+
+    tokio::select! {
+        _ = ctrl_c => {},
+        _ = terminate => {},
+    }
+    info!("Shutdown signal received, closing connections...");
+}
+
 /// Create router with routes and middleware
 pub fn create_router(state: AppState) -> Router {
     Router::new()
-        .route("/health", get(health_check))
         .route("/status", get(status_handler))
         .route("/metrics", get(metrics_handler))
         .route("/search", post(search_handler_default))
         .route("/v1/{workspace}/search", post(search_handler_workspace))
+        .route("/query", post(query_handler))
+        .route("/refine", post(refine_handler))
+        // Health and readiness checks stay reachable without a token
+        .route_layer(middleware::from_fn_with_state(
+            state.clone(),
+            layers::require_token,
+        ))
+        .route("/health", get(health_check))
+        .route("/healthz", get(health_check))
+        .route("/readyz", get(readiness_check))
+        .layer(middleware::from_fn(layers::log_requests))
         .layer(
             TraceLayer::new_for_http()
                 .make_span_with(|request: &axum::http::Request<_>| {
@@ -148,6 +391,15 @@ async fn health_check() -> impl IntoResponse {
     StatusCode::OK
 }
 
+/// Readiness endpoint: `503` until the warm-up has finished, then `200`.
+async fn readiness_check(State(state): State<AppState>) -> impl IntoResponse {
+    if state.workspace_manager.is_ready() {
+        (StatusCode::OK, "ready")
+    } else {
+        (StatusCode::SERVICE_UNAVAILABLE, "warming up")
+    }
+}
+
 /// Prometheus metrics endpoint
 async fn metrics_handler() -> impl IntoResponse {
     let encoder = TextEncoder::new();
@@ -220,28 +472,45 @@ async fn process_search(
         }
     };
 
-    // 2. Create per-request searcher from context (cheap - just Arc clones)
-    let searcher = CodeSearcher::new(
-        Some(context.storage.clone()),
-        Some(context.embedder.clone()),
-        context.bm25.clone(),
-        context.expander.clone(),
-        context.vector_weight,
-        context.bm25_weight,
-        context.rrf_k,
-    );
+    // 2. Create per-request searcher from context. Axum drops this future
+    // when the client disconnects, which stops the search.
+    let cancel = CancelToken::new();
+    let _cancel_on_drop = cancel.cancel_on_drop();
+    let searcher = searcher_for(&context)
+        .with_tag_boosts(payload.boost_tags)
+        .with_explain(payload.explain)
+        .with_cancel(cancel);
+
+    let filter = match CandidateFilter::new(
+        payload.ext,
+        payload.dir,
+        payload.path_globs,
+        payload.languages,
+    ) {
+        Ok(f) => f
+            .with_packages(payload.packages)
+            .with_doc_types(payload.doc_types)
+            .with_tests(payload.tests)
+            .with_collections(payload.collections)
+            .with_tags(payload.tags),
+        Err(e) => return (StatusCode::BAD_REQUEST, e.to_string()).into_response(),
+    };
 
     // 3. Execute Search (concurrent-safe, no Mutex needed)
-    let results = match searcher
-        .semantic_search(
+    let mut results = match searcher
+        .filtered_search(
             &payload.query,
             payload.limit,
-            payload.ext,
-            payload.dir,
+            &filter,
             payload.no_rerank,
             Some(workspace.clone()),
             payload.max_tokens,
             payload.expand,
+            payload.hybrid_alpha,
+            payload.mmr_lambda,
+            payload.max_per_file,
+            payload.recency_half_life_days.and_then(half_life_days),
+            payload.expand_to_symbol,
         )
         .await
     {
@@ -251,6 +520,8 @@ async fn process_search(
             return (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response();
         }
     };
+    retain_min_score(&mut results, payload.min_score.or(context.min_score));
+    attach_source_context(&mut results, payload.context_lines.min(MAX_CONTEXT_LINES));
 
     // 4. Return Results
     let latency_sec = start_time.elapsed().as_secs_f64();
@@ -262,3 +533,146 @@ async fn process_search(
 
     (StatusCode::OK, Json(SearchResponse { results })).into_response()
 }
+
+/// Handler for `POST /query`: chunks with citations, as returned by [`CodeSearcher::query`]
+#[tracing::instrument(skip(state, payload))]
+async fn query_handler(
+    State(state): State<AppState>,
+    Json(payload): Json<QueryRequest>,
+) -> impl IntoResponse {
+    let workspace = payload.workspace.unwrap_or_else(|| "default".to_string());
+    let prompt_template = match payload
+        .prompt_template
+        .as_deref()
+        .map(PromptTemplate::parse)
+    {
+        Some(Ok(template)) => template,
+        Some(Err(e)) => return (StatusCode::BAD_REQUEST, e.to_string()).into_response(),
+        None => PromptTemplate::default(),
+    };
+    let mut options = QueryOptions {
+        max_chunks: payload.max_chunks,
+        include_prompt: payload.include_prompt || payload.prompt_template.is_some(),
+        prompt_template,
+        max_tokens: payload.max_tokens,
+        path_globs: payload.path_glob.into_iter().collect(),
+        packages: payload.package.into_iter().collect(),
+        doc_types: payload.doc_types,
+        tests: payload.tests,
+        collections: payload.collections,
+        tags: payload.tags,
+        workspace: Some(workspace.clone()),
+        mmr_lambda: payload.mmr_lambda,
+        max_per_file: payload.max_per_file,
+        expand_to_symbol: payload.expand_to_symbol,
+        min_score: payload.min_score,
+        recency_half_life: payload.recency_half_life_days.and_then(half_life_days),
+        context_lines: payload.context_lines.min(MAX_CONTEXT_LINES),
+        ..Default::default()
+    };
+    // Reject bad globs as a client error before touching the index
+    if let Err(e) = CandidateFilter::new(None, None, options.path_globs.clone(), Vec::new()) {
+        return (StatusCode::BAD_REQUEST, e.to_string()).into_response();
+    }
+
+    let context = match state.workspace_manager.get_search_context(&workspace).await {
+        Ok(ctx) => ctx,
+        Err(e) => {
+            let error_msg = format!("Failed to access workspace '{}': {}", workspace, e);
+            return (StatusCode::NOT_FOUND, error_msg).into_response();
+        }
+    };
+
+    options.min_score = options.min_score.or(context.min_score);
+
+    // Stops the search once the client disconnects and this future is dropped
+    let cancel = CancelToken::new();
+    let _cancel_on_drop = cancel.cancel_on_drop();
+    match searcher_for(&context)
+        .with_tag_boosts(payload.boost_tags)
+        .with_cancel(cancel)
+        .query(&payload.query, &options)
+        .await
+    {
+        Ok(result) => (StatusCode::OK, Json(result)).into_response(),
+        Err(e) => {
+            error!("Query error in workspace '{}': {}", workspace, e);
+            (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response()
+        }
+    }
+}
+
+/// Handler for `POST /refine`: re-searches with relevance feedback, see [`CodeSearcher::refine_query`]
+#[tracing::instrument(skip(state, payload))]
+async fn refine_handler(
+    State(state): State<AppState>,
+    Json(payload): Json<RefineRequest>,
+) -> impl IntoResponse {
+    let workspace = payload.workspace.unwrap_or_else(|| "default".to_string());
+    let defaults = RefineOptions::default();
+    let options = RefineOptions {
+        limit: payload.limit,
+        query_weight: payload.query_weight.unwrap_or(defaults.query_weight),
+        positive_weight: payload.positive_weight.unwrap_or(defaults.positive_weight),
+        negative_weight: payload.negative_weight.unwrap_or(defaults.negative_weight),
+        include_feedback: payload.include_feedback,
+    };
+    if payload.query.trim().is_empty() && payload.positive_ids.is_empty() {
+        return (
+            StatusCode::BAD_REQUEST,
+            "Give the original query or at least one positive ID".to_string(),
+        )
+            .into_response();
+    }
+    let filter = match CandidateFilter::new(None, None, payload.path_globs, Vec::new()) {
+        Ok(f) => f,
+        Err(e) => return (StatusCode::BAD_REQUEST, e.to_string()).into_response(),
+    };
+
+    let context = match state.workspace_manager.get_search_context(&workspace).await {
+        Ok(ctx) => ctx,
+        Err(e) => {
+            let error_msg = format!("Failed to access workspace '{}': {}", workspace, e);
+            return (StatusCode::NOT_FOUND, error_msg).into_response();
+        }
+    };
+
+    // Stops the search once the client disconnects and this future is dropped
+    let cancel = CancelToken::new();
+    let _cancel_on_drop = cancel.cancel_on_drop();
+    match searcher_for(&context)
+        .with_cancel(cancel)
+        .refine_query(
+            &payload.query,
+            &payload.positive_ids,
+            &payload.negative_ids,
+            &options,
+            &filter,
+            Some(&workspace),
+        )
+        .await
+    {
+        Ok(results) => (StatusCode::OK, Json(SearchResponse { results })).into_response(),
+        Err(e) => {
+            error!("Refine error in workspace '{}': {}", workspace, e);
+            (StatusCode::INTERNAL_SERVER_ERROR, e.to_string()).into_response()
+        }
+    }
+}
+
+/// Builds a per-request searcher from a workspace context (cheap - just Arc clones)
+pub(crate) fn searcher_for(context: &WorkspaceSearchContext) -> CodeSearcher {
+    CodeSearcher::new(
+        Some(context.storage.clone()),
+        Some(context.embedder.clone()),
+        context.bm25.clone(),
+        context.expander.clone(),
+        context.vector_weight,
+        context.bm25_weight,
+        context.rrf_k,
+    )
+    .with_reranker(context.reranker.clone())
+    .with_rerank_top_k(context.rerank_top_k)
+    .with_symbol_weight(context.symbol_weight)
+    .with_query_cache(context.query_cache.clone())
+}
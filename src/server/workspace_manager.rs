@@ -1,26 +1,41 @@
 use crate::bm25::BM25Index;
+use crate::context::default_counter;
 use crate::embedding::Embedder;
 use crate::llm::expander::QueryExpander;
-use crate::search::CodeSearcher;
-use crate::server::ServerStartConfig;
-use crate::storage::Storage;
-use anyhow::{anyhow, Result};
+use crate::manifest::ensure_compatible_embedder;
+use crate::rerank::{create_reranker, Reranker};
+use crate::search::{CodeSearcher, QueryCache, SearchResult};
+use crate::server::{searcher_for, ServerStartConfig};
+use crate::storage::{index_status, open_indexed_store, VectorStore};
+use anyhow::Result;
 use dashmap::DashMap;
 use std::path::PathBuf;
+use std::sync::atomic::{AtomicBool, Ordering};
 use std::sync::Arc;
+use std::time::Instant;
 use tracing::{info, warn};
 
+/// Query of the throwaway search run by [`WorkspaceManager::warm_up`].
+const WARM_UP_QUERY: &str = "warm up";
+
 /// Thread-safe search context for a single workspace.
 ///
 /// All components are wrapped in Arc for concurrent access without locks.
 pub struct WorkspaceSearchContext {
-    pub storage: Arc<Storage>,
+    pub storage: Arc<dyn VectorStore>,
     pub embedder: Arc<Embedder>,
     pub bm25: Option<Arc<BM25Index>>,
     pub expander: Option<Arc<QueryExpander>>,
+    pub reranker: Option<Arc<dyn Reranker>>,
+    pub rerank_top_k: usize,
+    pub symbol_weight: f32,
+    /// Default `min_score` of requests, from the config
+    pub min_score: Option<f32>,
     pub vector_weight: f32,
     pub bm25_weight: f32,
     pub rrf_k: f64,
+    /// Ranked results of recent queries, shared by all requests
+    pub query_cache: Option<Arc<QueryCache>>,
 }
 
 pub struct WorkspaceManager {
@@ -29,6 +44,9 @@ pub struct WorkspaceManager {
     config: Arc<ServerStartConfig>,
     embedder: Arc<Embedder>,
     expander: Option<Arc<QueryExpander>>,
+    reranker: Option<Arc<dyn Reranker>>,
+    /// Set once [`warm_up`](Self::warm_up) has finished
+    ready: AtomicBool,
 }
 
 impl WorkspaceManager {
@@ -37,15 +55,96 @@ impl WorkspaceManager {
         embedder: Arc<Embedder>,
         expander: Option<Arc<QueryExpander>>,
     ) -> Self {
+        let reranker = match create_reranker(
+            &config.reranker,
+            Some(embedder.clone()),
+            &config.llm_host,
+            &config.llm_model,
+            &config.onnx_reranker,
+        ) {
+            Ok(reranker) => reranker,
+            Err(e) => {
+                warn!("{}. Reranking disabled.", e);
+                None
+            }
+        };
         Self {
             workspaces: DashMap::new(),
             loading_locks: DashMap::new(),
             config: Arc::new(config),
             embedder,
             expander,
+            reranker,
+            ready: AtomicBool::new(false),
         }
     }
 
+    /// Whether [`warm_up`](Self::warm_up) has finished; `/readyz` reports it.
+    pub fn is_ready(&self) -> bool {
+        self.ready.load(Ordering::Acquire)
+    }
+
+    /// Loads up front what the first queries would otherwise pay for, then
+    /// marks the manager ready.
+    ///
+    /// The tokenizer is built and the default workspace is loaded: its
+    /// store, vector graph and BM25 index, and every stored vector is read
+    /// once, so an exact LanceDB search finds its files in memory too. A
+    /// throwaway search then runs through query embedding and vector and
+    /// keyword search. Without a default index, the embedder gets one
+    /// throwaway embedding instead. Either way the reranker scores one
+    /// throwaway candidate, since an empty index gives the search none.
+    pub async fn warm_up(&self) -> Result<()> {
+        let started = Instant::now();
+        default_counter();
+
+        let reranker = match self.get_search_context("default").await {
+            Ok(context) => {
+                let vectors = context.storage.list_vectors().await?;
+                info!("Preloaded {} vectors of the default index", vectors.len());
+                drop(vectors);
+                // Bypasses the query cache, which would keep the throwaway results
+                searcher_for(&context)
+                    .with_query_cache(None)
+                    .semantic_search(
+                        WARM_UP_QUERY,
+                        1,
+                        None,
+                        None,
+                        true,
+                        Some("default".to_string()),
+                        None,
+                        false,
+                    )
+                    .await?;
+                context.reranker.clone()
+            }
+            Err(e) => {
+                info!("Default workspace not loaded during warm-up: {}", e);
+                let embedder = self.embedder.clone();
+                tokio::task::spawn_blocking(move || {
+                    embedder.embed(vec![WARM_UP_QUERY.to_string()], None)
+                })
+                .await??;
+                self.reranker.clone()
+            }
+        };
+        if let Some(reranker) = reranker {
+            let candidate = SearchResult {
+                code: WARM_UP_QUERY.to_string(),
+                ..Default::default()
+            };
+            // Searches keep their first-stage order when reranking fails
+            if let Err(e) = reranker.rerank(WARM_UP_QUERY, &[candidate]).await {
+                warn!("Reranker warm-up failed: {}", e);
+            }
+        }
+
+        self.ready.store(true, Ordering::Release);
+        info!("Warm-up finished in {:.2?}", started.elapsed());
+        Ok(())
+    }
+
     /// Retrieves search context for the given workspace ID.
     ///
     /// Returns Arc<WorkspaceSearchContext> which can be shared across
@@ -102,18 +201,7 @@ impl WorkspaceManager {
     ) -> Result<Arc<tokio::sync::Mutex<CodeSearcher>>> {
         // For backward compatibility with existing code
         let context = self.get_search_context(workspace_id).await?;
-
-        let searcher = CodeSearcher::new(
-            Some(context.storage.clone()),
-            Some(context.embedder.clone()),
-            context.bm25.clone(),
-            context.expander.clone(),
-            context.vector_weight,
-            context.bm25_weight,
-            context.rrf_k,
-        );
-
-        Ok(Arc::new(tokio::sync::Mutex::new(searcher)))
+        Ok(Arc::new(tokio::sync::Mutex::new(searcher_for(&context))))
     }
 
     pub fn get_stats(&self) -> WorkspaceStats {
@@ -133,10 +221,6 @@ impl WorkspaceManager {
         // Isolation is handled by "workspace" column in LanceDB and field in BM25.
         let db_path = PathBuf::from(&self.config.db_path);
 
-        if !db_path.exists() {
-            return Err(anyhow!("Database root not found at {:?}", db_path));
-        }
-
         info!(
             "Loading workspace '{}' context from {:?}",
             workspace_id, db_path
@@ -147,19 +231,28 @@ impl WorkspaceManager {
         } else {
             db_path.join(workspace_id).to_string_lossy().to_string()
         };
-        let storage = Storage::new(&storage_path, "code_chunks").await?;
-
-        // Ensure valid index (and check if we have data for this workspace?)
-        if storage.get_indexed_metadata(workspace_id).await.is_err() {
-            warn!(
-                "Could not fetch metadata for workspace '{}'. It might be empty.",
-                workspace_id
-            );
-        }
+        // Before opening the store, which would create a missing one
+        let status =
+            index_status(&self.config.storage_backend, &storage_path, "code_chunks").await?;
+        status.ready(&storage_path, workspace_id)?;
+        ensure_compatible_embedder(
+            &storage_path,
+            self.embedder.model_name(),
+            self.embedder.dim(),
+        )?;
+        let storage = open_indexed_store(
+            &self.config.storage_backend,
+            self.config.distance_metric,
+            self.config.vector_index,
+            self.config.multi_vector.as_ref(),
+            &storage_path,
+            "code_chunks",
+        )
+        .await?;
 
         // Resilient BM25 Loading
         let bm25_index = match BM25Index::new(&storage_path, true, "log") {
-            Ok(idx) => Some(Arc::new(idx)),
+            Ok(idx) => Some(Arc::new(idx.with_doc_boost(self.config.bm25_doc_boost))),
             Err(e) => {
                 warn!(
                     "BM25 index load failed for '{}': {}. Proceeding with Vector-only search.",
@@ -169,14 +262,22 @@ impl WorkspaceManager {
             }
         };
 
+        let query_cache = (self.config.query_cache_size > 0)
+            .then(|| Arc::new(QueryCache::new(&storage_path, self.config.query_cache_size)));
+
         Ok(WorkspaceSearchContext {
-            storage: Arc::new(storage),
+            storage,
             embedder: self.embedder.clone(),
             bm25: bm25_index,
             expander: self.expander.clone(),
+            reranker: self.reranker.clone(),
+            rerank_top_k: self.config.rerank_top_k,
+            symbol_weight: self.config.symbol_weight,
+            min_score: self.config.min_score,
             vector_weight: 1.0,
             bm25_weight: 1.0,
             rrf_k: 60.0,
+            query_cache,
         })
     }
 }
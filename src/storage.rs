@@ -1,26 +1,482 @@
+use crate::config::AppConfig;
+use crate::core::CodeRagError;
+use crate::indexer::{ChunkLocation, ChunkPart, CodeChunk, Facet};
 use anyhow::{anyhow, Result};
 use arrow_array::builder::{ListBuilder, StringBuilder};
 use arrow_array::{
-    Array, FixedSizeListArray, Float32Array, Int32Array, Int64Array, RecordBatch,
-    RecordBatchIterator, StringArray,
+    Array, ArrayRef, BooleanArray, FixedSizeListArray, Float32Array, Int32Array, Int64Array,
+    ListArray, RecordBatch, RecordBatchIterator, StringArray,
 };
 use arrow_schema::{DataType, Field, Schema};
+use async_trait::async_trait;
 use futures_util::stream::TryStreamExt;
 use lancedb::connect;
 use lancedb::connection::Connection;
 use lancedb::index::scalar::BTreeIndexBuilder;
 use lancedb::query::{ExecutableQuery, QueryBase};
 use lancedb::table::Table;
+use lancedb::DistanceType;
+use std::collections::{BTreeSet, HashMap, HashSet};
+use std::path::Path;
 use std::sync::Arc;
 use tokio::sync::OnceCell;
 
+pub mod hnsw;
+pub mod multivector;
+pub mod similarity;
+mod sqlite;
+pub use hnsw::{HnswParams, HnswStore};
+pub use multivector::{FacetScoring, FacetVectors, MultiVectorParams, MultiVectorStore};
+pub use similarity::Metric;
+pub use sqlite::{SqliteStore, SQLITE_SCHEMA_VERSION};
+
+/// Default `storage_backend`: LanceDB tables next to the BM25 index.
+pub const LANCEDB_BACKEND: &str = "lancedb";
+/// `storage_backend` keeping chunks and vectors in a single SQLite file.
+pub const SQLITE_BACKEND: &str = "sqlite";
+
+/// A chunk returned by a nearest-neighbor query.
+#[derive(Debug, Clone)]
+pub struct ScoredChunk {
+    /// Stored chunk ID (see [`CodeChunk::id`])
+    pub id: String,
+    pub chunk: CodeChunk,
+    /// Distance to the query vector by the store's [`Metric`], lower being
+    /// closer, if reported
+    pub distance: Option<f32>,
+    /// Stored embedding of the chunk, at unit length under [`Metric::Cosine`]
+    pub vector: Vec<f32>,
+}
+
+/// Metadata of a stored chunk, without its code or embedding.
+#[derive(Debug, Clone, PartialEq)]
+pub struct ChunkInfo {
+    pub filename: String,
+    pub language: Option<String>,
+    pub last_modified: i64,
+    /// See [`CodeChunk::collection`]
+    pub collection: Option<String>,
+}
+
+/// An embedding with the keys needed to index it, see [`VectorStore::list_vectors`].
+#[derive(Debug, Clone, PartialEq)]
+pub struct StoredVector {
+    pub workspace: String,
+    pub filename: String,
+    pub id: String,
+    pub vector: Vec<f32>,
+}
+
+/// Persistent store for chunks and their embeddings.
+///
+/// Implemented by [`Storage`] (LanceDB) and [`SqliteStore`]; use
+/// [`open_store`] to pick one by the `storage_backend` config key.
+/// [`HnswStore`] wraps either with an approximate nearest-neighbor index,
+/// and [`MultiVectorStore`] with a vector per [`Facet`] of a chunk. Filters are
+/// SQL predicates over the `filename`, `language` and `symbol` columns, as
+/// produced by [`CandidateFilter::sql`](crate::search::CandidateFilter::sql).
+#[async_trait]
+pub trait VectorStore: Send + Sync {
+    /// Creates the chunk table for `dim`-dimensional vectors if it doesn't exist.
+    async fn init(&self, dim: usize) -> Result<()>;
+
+    /// Inserts chunks together with their embeddings, which are stored at
+    /// unit length under [`Metric::Cosine`] and as given otherwise.
+    async fn add_code_chunks(
+        &self,
+        workspace: &str,
+        chunks: &[CodeChunk],
+        vectors: Vec<Vec<f32>>,
+    ) -> Result<()>;
+
+    /// Returns up to `limit` chunks nearest to `query_vector` by the store's
+    /// [`metric`](Self::metric), closest first.
+    ///
+    /// Fails if the store was created for another metric.
+    async fn search_chunks(
+        &self,
+        query_vector: Vec<f32>,
+        limit: usize,
+        filter: Option<String>,
+        workspace: Option<&str>,
+    ) -> Result<Vec<ScoredChunk>>;
+
+    /// Distance the store was opened to rank by.
+    fn metric(&self) -> Metric;
+
+    /// Distance recorded when the store was created, `None` before
+    /// [`init`](Self::init). Searches fail unless it is [`metric`](Self::metric).
+    async fn stored_metric(&self) -> Result<Option<Metric>>;
+
+    /// Columns a table created by an older version lacks. A search `filter`
+    /// must not refer to them, see
+    /// [`CandidateFilter::sql_without`](crate::search::CandidateFilter::sql_without).
+    async fn missing_columns(&self) -> Result<Vec<String>> {
+        Ok(Vec::new())
+    }
+
+    /// Facets of chunks the store keeps vectors of besides the chunk's own,
+    /// see [`replace_files_with_facets`](Self::replace_files_with_facets).
+    fn facets(&self) -> &[Facet] {
+        &[]
+    }
+
+    /// Maps each indexed filename of `workspace` to its stored mtime.
+    async fn get_indexed_metadata(&self, workspace: &str) -> Result<HashMap<String, i64>>;
+
+    /// Lists the metadata of every stored chunk of `workspace`.
+    async fn list_chunk_info(&self, workspace: &str) -> Result<Vec<ChunkInfo>>;
+
+    /// Counts the stored chunks of every workspace.
+    async fn count_chunks(&self) -> Result<usize>;
+
+    /// Lists the embedding of every stored chunk of every workspace.
+    async fn list_vectors(&self) -> Result<Vec<StoredVector>>;
+
+    /// Fetches every stored chunk of `filename` together with its embedding.
+    async fn get_file_chunks(
+        &self,
+        filename: &str,
+        workspace: &str,
+    ) -> Result<Vec<(CodeChunk, Vec<f32>)>>;
+
+    /// Fetches the stored chunks with the given IDs, in no particular order.
+    async fn get_chunks_by_ids(
+        &self,
+        ids: &[String],
+        workspace: Option<&str>,
+    ) -> Result<Vec<CodeChunk>>;
+
+    /// Fetches the stored embeddings of the chunks with the given IDs, as
+    /// `(id, vector)` pairs in no particular order. Unknown IDs are skipped.
+    ///
+    /// Reads the files holding those chunks, which every backend can do
+    /// without a dedicated query.
+    async fn get_vectors_by_ids(
+        &self,
+        ids: &[String],
+        workspace: &str,
+    ) -> Result<Vec<(String, Vec<f32>)>> {
+        let wanted: HashSet<&str> = ids.iter().map(String::as_str).collect();
+        let filenames: BTreeSet<String> = self
+            .get_chunks_by_ids(ids, Some(workspace))
+            .await?
+            .into_iter()
+            .map(|chunk| chunk.filename)
+            .collect();
+        let mut vectors = Vec::with_capacity(wanted.len());
+        for filename in filenames {
+            for (chunk, vector) in self.get_file_chunks(&filename, workspace).await? {
+                let id = chunk.id();
+                if wanted.contains(id.as_str()) {
+                    vectors.push((id, vector));
+                }
+            }
+        }
+        Ok(vectors)
+    }
+
+    /// Moves the chunks of `old_filename` to `new_filename` without re-embedding them.
+    ///
+    /// Returns the relocated chunks so callers can update secondary indexes (BM25).
+    /// An empty result means nothing was stored under the old name.
+    async fn rename_file(
+        &self,
+        old_filename: &str,
+        new_filename: &str,
+        workspace: &str,
+        mtime: i64,
+    ) -> Result<Vec<CodeChunk>> {
+        let rows = self.get_file_chunks(old_filename, workspace).await?;
+        if rows.is_empty() {
+            return Ok(Vec::new());
+        }
+
+        let (mut chunks, vectors): (Vec<CodeChunk>, Vec<Vec<f32>>) = rows.into_iter().unzip();
+        for chunk in chunks.iter_mut() {
+            chunk.filename = new_filename.to_string();
+            chunk.last_modified = mtime;
+        }
+
+        self.replace_files(workspace, &[old_filename.to_string()], &chunks, vectors)
+            .await?;
+        Ok(chunks)
+    }
+
+    async fn delete_file_chunks(&self, filename: &str, workspace: &str) -> Result<()>;
+
+    async fn batch_delete_files(&self, filenames: &[String], workspace: &str) -> Result<()>;
+
+    /// Replaces every stored chunk of `filenames` with `chunks`, which may
+    /// also belong to files not stored yet; a listed file without chunks is
+    /// removed.
+    ///
+    /// This is how re-indexing writes: a search running at the same time
+    /// sees each file either as it was or as it is now, never half-written or
+    /// missing. The default deletes and then inserts, which a reader can
+    /// catch in between; the backends override it.
+    async fn replace_files(
+        &self,
+        workspace: &str,
+        filenames: &[String],
+        chunks: &[CodeChunk],
+        vectors: Vec<Vec<f32>>,
+    ) -> Result<()> {
+        self.batch_delete_files(filenames, workspace).await?;
+        if chunks.is_empty() {
+            return Ok(());
+        }
+        self.add_code_chunks(workspace, chunks, vectors).await
+    }
+
+    /// [`replace_files`](Self::replace_files), also storing the vectors of
+    /// the chunks' [`facets`](Self::facets), by default ignored.
+    async fn replace_files_with_facets(
+        &self,
+        workspace: &str,
+        filenames: &[String],
+        chunks: &[CodeChunk],
+        vectors: Vec<Vec<f32>>,
+        _facet_vectors: Vec<FacetVectors>,
+    ) -> Result<()> {
+        self.replace_files(workspace, filenames, chunks, vectors)
+            .await
+    }
+
+    /// Builds secondary indexes after a bulk load; a no-op where not needed.
+    async fn create_filename_index(&self) -> Result<()> {
+        Ok(())
+    }
+
+    /// Saves state kept in memory between writes; a no-op where every write is durable.
+    async fn flush(&self) -> Result<()> {
+        Ok(())
+    }
+}
+
+/// Opens the store selected by `backend` (`lancedb` or `sqlite`) in `db_path`,
+/// ranking by `metric`.
+pub async fn open_store(
+    backend: &str,
+    metric: Metric,
+    db_path: &str,
+    table_name: &str,
+) -> Result<Arc<dyn VectorStore>> {
+    match backend {
+        LANCEDB_BACKEND | "" => Ok(Arc::new(
+            Storage::new(db_path, table_name).await?.with_metric(metric),
+        )),
+        SQLITE_BACKEND => {
+            std::fs::create_dir_all(db_path)?;
+            let path = SqliteStore::path(db_path, table_name);
+            Ok(Arc::new(SqliteStore::open(&path)?.with_metric(metric)))
+        }
+        other => anyhow::bail!(
+            "Unknown storage backend '{}'. Expected one of: lancedb, sqlite",
+            other
+        ),
+    }
+}
+
+/// Opens the store configured by `storage_backend` and `distance_metric` in
+/// `db_path`, wrapped in an [`HnswStore`] when `vector_index` is `hnsw` and
+/// in a [`MultiVectorStore`] when `multi_vector` lists facets.
+pub async fn open_configured_store(
+    config: &AppConfig,
+    db_path: &str,
+    table_name: &str,
+) -> Result<Arc<dyn VectorStore>> {
+    open_indexed_store(
+        &config.storage_backend,
+        config.metric()?,
+        HnswParams::from_config(config)?,
+        MultiVectorParams::from_config(config)?.as_ref(),
+        db_path,
+        table_name,
+    )
+    .await
+}
+
+/// Opens the `backend` store in `db_path`, wrapped in an [`HnswStore`] if
+/// `hnsw` is set and in a [`MultiVectorStore`] if `multi_vector` is; each
+/// facet table gets the same index.
+pub async fn open_indexed_store(
+    backend: &str,
+    metric: Metric,
+    hnsw: Option<HnswParams>,
+    multi_vector: Option<&MultiVectorParams>,
+    db_path: &str,
+    table_name: &str,
+) -> Result<Arc<dyn VectorStore>> {
+    let store = open_table_index(backend, metric, hnsw, db_path, table_name).await?;
+    let Some(params) = multi_vector else {
+        return Ok(store);
+    };
+    let mut facets = Vec::with_capacity(params.facets.len());
+    for &facet in &params.facets {
+        let table = MultiVectorStore::table(table_name, facet);
+        facets.push((
+            facet,
+            open_table_index(backend, metric, hnsw, db_path, &table).await?,
+        ));
+    }
+    Ok(Arc::new(MultiVectorStore::new(
+        store,
+        facets,
+        params.clone(),
+    )))
+}
+
+/// Opens one table of the `backend` store, wrapped in an [`HnswStore`] if `hnsw` is set.
+async fn open_table_index(
+    backend: &str,
+    metric: Metric,
+    hnsw: Option<HnswParams>,
+    db_path: &str,
+    table_name: &str,
+) -> Result<Arc<dyn VectorStore>> {
+    let store = open_store(backend, metric, db_path, table_name).await?;
+    match hnsw {
+        Some(params) => {
+            let path = HnswStore::path(db_path, table_name);
+            Ok(Arc::new(HnswStore::open(store, path, params).await?))
+        }
+        None => Ok(store),
+    }
+}
+
+/// Returns true if `db_path` holds a chunk table for `backend`.
+pub fn store_exists(backend: &str, db_path: &str, table_name: &str) -> bool {
+    match backend {
+        SQLITE_BACKEND => SqliteStore::path(db_path, table_name).exists(),
+        _ => Path::new(db_path)
+            .join(format!("{}.lance", table_name))
+            .exists(),
+    }
+}
+
+/// Whether a store has anything to search, see [`index_status`].
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum IndexStatus {
+    /// Nothing has been indexed into `db_path`
+    Missing,
+    /// The store exists but holds no chunks, e.g. after indexing a directory
+    /// without supported source files
+    Empty,
+    /// Holds this many chunks
+    Ready(usize),
+}
+
+impl IndexStatus {
+    /// What to tell someone searching the `workspace` index in `db_path`, or
+    /// `None` if it is ready.
+    pub fn problem(self, db_path: &str, workspace: &str) -> Option<String> {
+        let index = if workspace == "default" {
+            "code-rag index --path <dir>".to_string()
+        } else {
+            format!("code-rag index --path <dir> --workspace {}", workspace)
+        };
+        match self {
+            Self::Missing => Some(format!(
+                "No index found at {}; run `{}` first.",
+                db_path, index
+            )),
+            Self::Empty => Some(format!(
+                "Index at {} is empty; run `{}` on a directory with supported source files.",
+                db_path, index
+            )),
+            Self::Ready(_) => None,
+        }
+    }
+
+    /// The number of chunks, or the [`problem`](Self::problem) as a
+    /// [`CodeRagError::IndexNotFound`] or [`CodeRagError::EmptyIndex`].
+    pub fn ready(self, db_path: &str, workspace: &str) -> Result<usize, CodeRagError> {
+        let problem = self.problem(db_path, workspace).unwrap_or_default();
+        match self {
+            Self::Missing => Err(CodeRagError::IndexNotFound(problem)),
+            Self::Empty => Err(CodeRagError::EmptyIndex(problem)),
+            Self::Ready(chunks) => Ok(chunks),
+        }
+    }
+}
+
+/// Tells a missing store from an empty one before anything is searched.
+///
+/// Checking doesn't create the store; a store that exists but can't be read
+/// is an error, not [`IndexStatus::Empty`].
+pub async fn index_status(backend: &str, db_path: &str, table_name: &str) -> Result<IndexStatus> {
+    if !store_exists(backend, db_path, table_name) {
+        return Ok(IndexStatus::Missing);
+    }
+    // Counting doesn't depend on the metric
+    let store = open_store(backend, Metric::default(), db_path, table_name).await?;
+    Ok(match store.count_chunks().await? {
+        0 => IndexStatus::Empty,
+        n => IndexStatus::Ready(n),
+    })
+}
+
+/// Key of the chunk table's schema metadata present when the table was
+/// created to hold unit-length vectors only.
+const NORMALIZED_METADATA_KEY: &str = "vectors_normalized";
+
+/// Key of the chunk table's schema metadata naming the [`Metric`] it was
+/// created for; tables without it are cosine.
+const METRIC_METADATA_KEY: &str = "distance_metric";
+
 /// Vector storage backend using LanceDB.
 ///
 /// Provides persistent storage for code embeddings with workspace isolation.
+/// Under [`Metric::Cosine`], vectors are normalized when they are written and
+/// tables created that way carry [`NORMALIZED_METADATA_KEY`], so queries rank
+/// by dot product. Tables from older versions may hold vectors of any length
+/// and are still ranked by cosine distance; their vectors are normalized as
+/// they are read. Tables for other metrics record it under
+/// [`METRIC_METADATA_KEY`] and keep vectors as the embedder produced them.
 pub struct Storage {
     conn: Connection,
     table_name: String,
     table: OnceCell<Table>,
+    metric: Metric,
+}
+
+/// Metric a chunk table was created for, from its schema metadata.
+fn recorded_metric(metadata: &HashMap<String, String>) -> Result<Metric> {
+    match metadata.get(METRIC_METADATA_KEY) {
+        Some(name) => name.parse().map_err(|e: String| anyhow!(e)),
+        None => Ok(Metric::Cosine),
+    }
+}
+
+/// Fails with [`CodeRagError::DimensionMismatch`] if `what` stores vectors of
+/// another dimension than the embedder's `dim`.
+pub(crate) fn check_dim(what: &str, stored: usize, dim: usize) -> Result<()> {
+    if stored != dim {
+        return Err(CodeRagError::DimensionMismatch(format!(
+            "{} stores {}-dimensional vectors but the embedding model produces {}. \
+            Re-index with --force after changing models.",
+            what, stored, dim
+        ))
+        .into());
+    }
+    Ok(())
+}
+
+/// Fails unless the store `what` names, created for `recorded`, is opened
+/// for the same metric.
+pub(crate) fn check_metric(what: &str, recorded: Metric, configured: Metric) -> Result<()> {
+    if recorded != configured {
+        anyhow::bail!(
+            "{} was indexed with the {} distance metric, but distance_metric is {}. \
+            Set distance_metric = \"{}\" or re-index with --force.",
+            what,
+            recorded,
+            configured,
+            recorded
+        );
+    }
+    Ok(())
 }
 
 impl Storage {
@@ -30,9 +486,20 @@ impl Storage {
             conn,
             table_name: table_name.to_string(),
             table: OnceCell::new(),
+            metric: Metric::default(),
         })
     }
 
+    /// Ranks by `metric`, which a new table records and an existing one must match.
+    pub fn with_metric(mut self, metric: Metric) -> Self {
+        self.metric = metric;
+        self
+    }
+
+    fn describe(&self) -> String {
+        format!("Table '{}'", self.table_name)
+    }
+
     async fn get_table(&self) -> Result<Table> {
         self.table
             .get_or_try_init(|| async {
@@ -46,8 +513,26 @@ impl Storage {
             .cloned()
     }
 
-    pub async fn init(&self, dim: usize) -> Result<()> {
-        let schema = Arc::new(Schema::new(vec![
+    /// The chunk table, or `None` if it hasn't been created; unlike
+    /// [`get_table`](Self::get_table), failing to read a table that exists is
+    /// an error rather than an empty index.
+    async fn existing_table(&self) -> Result<Option<Table>> {
+        match self.get_table().await {
+            Ok(table) => Ok(Some(table)),
+            Err(e) => {
+                let names = self.conn.table_names().execute().await?;
+                if names.contains(&self.table_name) {
+                    Err(e)
+                } else {
+                    Ok(None)
+                }
+            }
+        }
+    }
+
+    /// Columns of a chunk table for `dim`-dimensional vectors.
+    fn fields(dim: usize) -> Vec<Field> {
+        vec![
             Field::new("id", DataType::Utf8, false),
             Field::new("workspace", DataType::Utf8, false),
             Field::new("filename", DataType::Utf8, false),
@@ -60,6 +545,28 @@ impl Storage {
                 DataType::List(Arc::new(Field::new("item", DataType::Utf8, true))),
                 true,
             ),
+            Field::new("symbol", DataType::Utf8, true),
+            Field::new("language", DataType::Utf8, true),
+            Field::new("redacted", DataType::Boolean, true),
+            Field::new("occurrence", DataType::Int32, true),
+            Field::new("overlap_lines", DataType::Int32, true),
+            Field::new("summary", DataType::Utf8, true),
+            Field::new("doc", DataType::Utf8, true),
+            Field::new("package", DataType::Utf8, true),
+            Field::new(
+                "imports",
+                DataType::List(Arc::new(Field::new("item", DataType::Utf8, true))),
+                true,
+            ),
+            Field::new("part", DataType::Int32, true),
+            Field::new("part_count", DataType::Int32, true),
+            Field::new("changed_at", DataType::Int64, true),
+            Field::new("is_test", DataType::Boolean, true),
+            Field::new("collection", DataType::Utf8, true),
+            // JSON list of ChunkLocation, set when the index is deduplicated
+            Field::new("duplicates", DataType::Utf8, true),
+            // JSON list of user tags, matched with LIKE by the search prefilter
+            Field::new("tags", DataType::Utf8, true),
             Field::new(
                 "vector",
                 DataType::FixedSizeList(
@@ -68,19 +575,66 @@ impl Storage {
                 ),
                 false,
             ),
-        ]));
+        ]
+    }
 
-        if self
-            .conn
-            .open_table(&self.table_name)
-            .execute()
-            .await
-            .is_err()
-        {
-            self.conn
-                .create_empty_table(&self.table_name, schema)
-                .execute()
-                .await?;
+    /// Names of the [`fields`](Self::fields) the chunk table lacks; none if
+    /// there is no table yet.
+    pub async fn missing_columns(&self) -> Result<Vec<String>> {
+        let Some(table) = self.existing_table().await? else {
+            return Ok(Vec::new());
+        };
+        let existing = table.schema().await?;
+        Ok(Self::fields(0)
+            .iter()
+            .map(|f| f.name().to_string())
+            .filter(|name| existing.field_with_name(name).is_err())
+            .collect())
+    }
+
+    pub async fn init(&self, dim: usize) -> Result<()> {
+        let fields = Self::fields(dim);
+        let mut metadata =
+            HashMap::from([(METRIC_METADATA_KEY.to_string(), self.metric.to_string())]);
+        if self.metric.normalizes() {
+            metadata.insert(NORMALIZED_METADATA_KEY.to_string(), "1".to_string());
+        }
+        let schema = Arc::new(Schema::new_with_metadata(fields, metadata));
+
+        match self.conn.open_table(&self.table_name).execute().await {
+            Ok(table) => {
+                let existing = table.schema().await?;
+                let recorded = recorded_metric(&existing.metadata)?;
+                check_metric(&self.describe(), recorded, self.metric)?;
+                if let Ok(field) = existing.field_with_name("vector") {
+                    if let DataType::FixedSizeList(_, stored) = field.data_type() {
+                        check_dim(&self.describe(), *stored as usize, dim)?;
+                    }
+                }
+                let missing = self.missing_columns().await?;
+                if !missing.is_empty() {
+                    tracing::warn!(
+                        "Table '{}' was created by an older version of code-rag and lacks columns {:?}. \
+                        Re-index with --force to store this metadata.",
+                        self.table_name,
+                        missing
+                    );
+                }
+                if recorded.normalizes() && !existing.metadata.contains_key(NORMALIZED_METADATA_KEY)
+                {
+                    tracing::info!(
+                        "Table '{}' may hold vectors that aren't unit length and is searched by \
+                        cosine distance. Re-index with --force to rank by dot product.",
+                        self.table_name
+                    );
+                }
+            }
+            Err(_) => {
+                self.conn
+                    .create_empty_table(&self.table_name, schema)
+                    .execute()
+                    .await?;
+            }
         }
 
         // Force initialization of the cached table handle
@@ -100,6 +654,83 @@ impl Storage {
         last_modified: Vec<i64>,
         calls: Vec<Vec<String>>,
         vectors: Vec<Vec<f32>>,
+    ) -> Result<()> {
+        let symbols = vec![None; ids.len()];
+        let languages = vec![None; ids.len()];
+        let redacted = vec![false; ids.len()];
+        let occurrences = vec![0; ids.len()];
+        let overlaps = vec![0; ids.len()];
+        let summaries = vec![None; ids.len()];
+        let docs = vec![None; ids.len()];
+        let packages = vec![None; ids.len()];
+        let imports = vec![Vec::new(); ids.len()];
+        let parts = vec![None; ids.len()];
+        let changed_at = vec![None; ids.len()];
+        let is_test = vec![false; ids.len()];
+        let collections = vec![None; ids.len()];
+        let duplicates = vec![Vec::new(); ids.len()];
+        let tags = vec![Vec::new(); ids.len()];
+        self.insert_rows(
+            None,
+            workspace,
+            ids,
+            filenames,
+            code,
+            line_starts,
+            line_ends,
+            last_modified,
+            calls,
+            symbols,
+            languages,
+            redacted,
+            occurrences,
+            overlaps,
+            summaries,
+            docs,
+            packages,
+            imports,
+            parts,
+            changed_at,
+            is_test,
+            collections,
+            duplicates,
+            tags,
+            vectors,
+        )
+        .await
+    }
+
+    /// Writes one row per chunk. With `replacing`, rows matching that predicate
+    /// which aren't rewritten are deleted in the same commit, and rows with the
+    /// same workspace and ID are updated.
+    #[allow(clippy::too_many_arguments)]
+    async fn insert_rows(
+        &self,
+        replacing: Option<String>,
+        workspace: &str,
+        ids: Vec<String>,
+        filenames: Vec<String>,
+        code: Vec<String>,
+        line_starts: Vec<i32>,
+        line_ends: Vec<i32>,
+        last_modified: Vec<i64>,
+        calls: Vec<Vec<String>>,
+        symbols: Vec<Option<String>>,
+        languages: Vec<Option<String>>,
+        redacted: Vec<bool>,
+        occurrences: Vec<i32>,
+        overlaps: Vec<i32>,
+        summaries: Vec<Option<String>>,
+        docs: Vec<Option<String>>,
+        packages: Vec<Option<String>>,
+        imports: Vec<Vec<String>>,
+        parts: Vec<Option<ChunkPart>>,
+        changed_at: Vec<Option<i64>>,
+        is_test: Vec<bool>,
+        collections: Vec<Option<String>>,
+        duplicates: Vec<Vec<ChunkLocation>>,
+        tags: Vec<Vec<String>>,
+        vectors: Vec<Vec<f32>>,
     ) -> Result<()> {
         let table = self.get_table().await?;
         let table_schema = table.schema().await?;
@@ -122,44 +753,196 @@ impl Storage {
         let line_starts_array = Int32Array::from(line_starts);
         let line_ends_array = Int32Array::from(line_ends);
         let last_modified_array = Int64Array::from(last_modified);
+        let symbol_array = StringArray::from(symbols);
+        let language_array = StringArray::from(languages);
+        let redacted_array = BooleanArray::from(redacted);
+        let occurrence_array = Int32Array::from(occurrences);
+        let overlap_array = Int32Array::from(overlaps);
+        let summary_array = StringArray::from(summaries);
+        let doc_array = StringArray::from(docs);
+        let package_array = StringArray::from(packages);
+        let calls_array = string_lists(calls);
+        let imports_array = string_lists(imports);
+        let part_array = Int32Array::from_iter(parts.iter().map(|p| p.map(|p| p.index as i32)));
+        let part_count_array =
+            Int32Array::from_iter(parts.iter().map(|p| p.map(|p| p.count as i32)));
+        let changed_at_array = Int64Array::from(changed_at);
+        let is_test_array = BooleanArray::from(is_test);
+        let collection_array = StringArray::from(collections);
+        let duplicates_array = json_lists(&duplicates)?;
+        let tags_array = json_lists(&tags)?;
 
-        // Build ListArray for calls
-        let mut builder = ListBuilder::new(StringBuilder::new());
-        for call_list in calls {
-            for call in call_list {
-                builder.values().append_value(call);
-            }
-            builder.append(true);
-        }
-        let calls_array = builder.finish();
-
-        // Flatten vectors
-        let flat_vectors: Vec<f32> = vectors.into_iter().flatten().collect();
+        let flat_vectors: Vec<f32> = vectors
+            .into_iter()
+            .flat_map(|mut vector| {
+                self.metric.prepare(&mut vector);
+                vector
+            })
+            .collect();
         let values = Float32Array::from(flat_vectors);
         let field = Arc::new(Field::new("item", DataType::Float32, true));
         let vector_array = FixedSizeListArray::try_new(field, dim_val, Arc::new(values), None)?;
 
-        let batch = RecordBatch::try_new(
-            schema.clone(),
-            vec![
-                Arc::new(id_array),
-                Arc::new(workspace_array),
-                Arc::new(filename_array),
-                Arc::new(code_array),
-                Arc::new(line_starts_array),
-                Arc::new(line_ends_array),
-                Arc::new(last_modified_array),
-                Arc::new(calls_array),
-                Arc::new(vector_array),
-            ],
-        )?;
+        let mut arrays: HashMap<&str, ArrayRef> = HashMap::from([
+            ("id", Arc::new(id_array) as ArrayRef),
+            ("workspace", Arc::new(workspace_array) as ArrayRef),
+            ("filename", Arc::new(filename_array) as ArrayRef),
+            ("code", Arc::new(code_array) as ArrayRef),
+            ("line_start", Arc::new(line_starts_array) as ArrayRef),
+            ("line_end", Arc::new(line_ends_array) as ArrayRef),
+            ("last_modified", Arc::new(last_modified_array) as ArrayRef),
+            ("calls", Arc::new(calls_array) as ArrayRef),
+            ("symbol", Arc::new(symbol_array) as ArrayRef),
+            ("language", Arc::new(language_array) as ArrayRef),
+            ("redacted", Arc::new(redacted_array) as ArrayRef),
+            ("occurrence", Arc::new(occurrence_array) as ArrayRef),
+            ("overlap_lines", Arc::new(overlap_array) as ArrayRef),
+            ("summary", Arc::new(summary_array) as ArrayRef),
+            ("doc", Arc::new(doc_array) as ArrayRef),
+            ("package", Arc::new(package_array) as ArrayRef),
+            ("imports", Arc::new(imports_array) as ArrayRef),
+            ("part", Arc::new(part_array) as ArrayRef),
+            ("part_count", Arc::new(part_count_array) as ArrayRef),
+            ("changed_at", Arc::new(changed_at_array) as ArrayRef),
+            ("is_test", Arc::new(is_test_array) as ArrayRef),
+            ("collection", Arc::new(collection_array) as ArrayRef),
+            ("duplicates", Arc::new(duplicates_array) as ArrayRef),
+            ("tags", Arc::new(tags_array) as ArrayRef),
+            ("vector", Arc::new(vector_array) as ArrayRef),
+        ]);
+
+        // Follow the table's column order; tables created by older versions lack
+        // newer optional columns, which are simply not written.
+        let columns = schema
+            .fields()
+            .iter()
+            .map(|f| {
+                arrays
+                    .remove(f.name().as_str())
+                    .ok_or_else(|| anyhow!("Unsupported column '{}' in table schema", f.name()))
+            })
+            .collect::<Result<Vec<_>>>()?;
+
+        let batch = RecordBatch::try_new(schema.clone(), columns)?;
 
         let reader = Box::new(RecordBatchIterator::new(vec![Ok(batch)], schema));
-        table.add(reader).execute().await?;
+        match replacing {
+            None => {
+                table.add(reader).execute().await?;
+            }
+            Some(predicate) => {
+                let mut merge = table.merge_insert(&["workspace", "id"]);
+                merge
+                    .when_matched_update_all(None)
+                    .when_not_matched_insert_all()
+                    .when_not_matched_by_source_delete(Some(predicate));
+                merge.execute(reader).await?;
+            }
+        }
 
         Ok(())
     }
 
+    /// Inserts chunks produced by [`CodeChunker`](crate::indexer::CodeChunker) together
+    /// with their embeddings.
+    pub async fn add_code_chunks(
+        &self,
+        workspace: &str,
+        chunks: &[CodeChunk],
+        vectors: Vec<Vec<f32>>,
+    ) -> Result<()> {
+        self.write_code_chunks(None, workspace, chunks, vectors)
+            .await
+    }
+
+    /// Replaces the chunks of `filenames` with `chunks`, see
+    /// [`VectorStore::replace_files`].
+    ///
+    /// Each commit, a LanceDB table version, deletes and writes the chunks of
+    /// up to [`FILES_PER_STATEMENT`] files, so a reader sees every file either
+    /// before or after.
+    pub async fn replace_files(
+        &self,
+        workspace: &str,
+        filenames: &[String],
+        chunks: &[CodeChunk],
+        vectors: Vec<Vec<f32>>,
+    ) -> Result<()> {
+        if chunks.len() != vectors.len() {
+            anyhow::bail!("Got {} vectors for {} chunks", vectors.len(), chunks.len());
+        }
+        let listed: HashSet<&str> = filenames.iter().map(String::as_str).collect();
+        let (mut rows, added): (Vec<_>, Vec<_>) = chunks
+            .iter()
+            .cloned()
+            .zip(vectors)
+            .partition(|(chunk, _)| listed.contains(chunk.filename.as_str()));
+        // Chunks of files that weren't stored before go first, so a renamed
+        // file is briefly stored twice rather than not at all
+        if !added.is_empty() {
+            let (chunks, vectors): (Vec<CodeChunk>, Vec<Vec<f32>>) = added.into_iter().unzip();
+            self.add_code_chunks(workspace, &chunks, vectors).await?;
+        }
+        for group in filenames.chunks(FILES_PER_STATEMENT) {
+            let names: HashSet<&str> = group.iter().map(String::as_str).collect();
+            let (replaced, rest): (Vec<_>, Vec<_>) = rows
+                .into_iter()
+                .partition(|(chunk, _)| names.contains(chunk.filename.as_str()));
+            rows = rest;
+            if replaced.is_empty() {
+                // Nothing to write, the files are gone
+                self.batch_delete_files(group, workspace).await?;
+                continue;
+            }
+            let (chunks, vectors): (Vec<CodeChunk>, Vec<Vec<f32>>) = replaced.into_iter().unzip();
+            self.write_code_chunks(
+                Some(files_predicate(workspace, group)),
+                workspace,
+                &chunks,
+                vectors,
+            )
+            .await?;
+        }
+        Ok(())
+    }
+
+    async fn write_code_chunks(
+        &self,
+        replacing: Option<String>,
+        workspace: &str,
+        chunks: &[CodeChunk],
+        vectors: Vec<Vec<f32>>,
+    ) -> Result<()> {
+        self.insert_rows(
+            replacing,
+            workspace,
+            chunks.iter().map(|c| c.id()).collect(),
+            chunks.iter().map(|c| c.filename.clone()).collect(),
+            chunks.iter().map(|c| c.code.clone()).collect(),
+            chunks.iter().map(|c| c.line_start as i32).collect(),
+            chunks.iter().map(|c| c.line_end as i32).collect(),
+            chunks.iter().map(|c| c.last_modified).collect(),
+            chunks.iter().map(|c| c.calls.clone()).collect(),
+            chunks.iter().map(|c| c.symbol.clone()).collect(),
+            chunks.iter().map(|c| c.language.clone()).collect(),
+            chunks.iter().map(|c| c.redacted).collect(),
+            chunks.iter().map(|c| c.occurrence as i32).collect(),
+            chunks.iter().map(|c| c.overlap_lines as i32).collect(),
+            chunks.iter().map(|c| c.summary.clone()).collect(),
+            chunks.iter().map(|c| c.doc.clone()).collect(),
+            chunks.iter().map(|c| c.package.clone()).collect(),
+            chunks.iter().map(|c| c.imports.clone()).collect(),
+            chunks.iter().map(|c| c.part).collect(),
+            chunks.iter().map(|c| c.changed_at).collect(),
+            chunks.iter().map(|c| c.is_test).collect(),
+            chunks.iter().map(|c| c.collection.clone()).collect(),
+            chunks.iter().map(|c| c.duplicates.clone()).collect(),
+            chunks.iter().map(|c| c.tags.clone()).collect(),
+            vectors,
+        )
+        .await
+    }
+
     pub async fn search(
         &self,
         query_vector: Vec<f32>,
@@ -168,7 +951,22 @@ impl Storage {
         workspace: Option<&str>,
     ) -> Result<Vec<RecordBatch>> {
         let table = self.get_table().await?;
-        let mut query = table.query().nearest_to(query_vector)?;
+        let metadata = table.schema().await?.metadata.clone();
+        check_metric(&self.describe(), recorded_metric(&metadata)?, self.metric)?;
+        // Cosine distances are `1 - similarity` either way, the dot product
+        // of unit vectors being their cosine similarity
+        let distance_type = match self.metric {
+            Metric::Cosine if metadata.contains_key(NORMALIZED_METADATA_KEY) => DistanceType::Dot,
+            Metric::Cosine => DistanceType::Cosine,
+            Metric::Dot => DistanceType::Dot,
+            Metric::L2 => DistanceType::L2,
+        };
+        let mut query_vector = query_vector;
+        self.metric.prepare(&mut query_vector);
+        let mut query = table
+            .query()
+            .nearest_to(query_vector)?
+            .distance_type(distance_type);
 
         let mut conditions: Vec<String> = Vec::new();
         if let Some(f) = filter {
@@ -196,9 +994,8 @@ impl Storage {
         &self,
         workspace: &str,
     ) -> Result<std::collections::HashMap<String, i64>> {
-        let table = match self.get_table().await {
-            Ok(t) => t,
-            Err(_) => return Ok(std::collections::HashMap::new()),
+        let Some(table) = self.existing_table().await? else {
+            return Ok(std::collections::HashMap::new());
         };
 
         let safe_ws = workspace.replace("'", "''");
@@ -238,6 +1035,289 @@ impl Storage {
         Ok(metadata)
     }
 
+    /// Lists the filename, language, mtime and collection of every chunk of `workspace`.
+    pub async fn list_chunk_info(&self, workspace: &str) -> Result<Vec<ChunkInfo>> {
+        let Some(table) = self.existing_table().await? else {
+            return Ok(Vec::new());
+        };
+
+        let mut columns = vec!["filename".to_string(), "last_modified".to_string()];
+        // Tables created before languages or collections were recorded lack the columns
+        let schema = table.schema().await?;
+        for optional in ["language", "collection"] {
+            if schema.field_with_name(optional).is_ok() {
+                columns.push(optional.to_string());
+            }
+        }
+        let mut stream = table
+            .query()
+            .only_if(format!("workspace = '{}'", workspace.replace("'", "''")))
+            .select(lancedb::query::Select::Columns(columns))
+            .execute()
+            .await?;
+
+        let mut infos = Vec::new();
+        while let Some(batch) = stream.try_next().await? {
+            let filenames: &StringArray = column(&batch, "filename")?;
+            let mtimes: &Int64Array = column(&batch, "last_modified")?;
+            let languages: Option<&StringArray> = batch
+                .column_by_name("language")
+                .and_then(|c| c.as_any().downcast_ref());
+            let collections: Option<&StringArray> = batch
+                .column_by_name("collection")
+                .and_then(|c| c.as_any().downcast_ref());
+            for i in 0..batch.num_rows() {
+                infos.push(ChunkInfo {
+                    filename: filenames.value(i).to_string(),
+                    language: languages
+                        .filter(|l| !l.is_null(i))
+                        .map(|l| l.value(i).to_string()),
+                    last_modified: mtimes.value(i),
+                    collection: collections
+                        .filter(|c| !c.is_null(i))
+                        .map(|c| c.value(i).to_string()),
+                });
+            }
+        }
+        Ok(infos)
+    }
+
+    /// Counts the rows of the chunk table; 0 if it doesn't exist.
+    pub async fn count_chunks(&self) -> Result<usize> {
+        match self.existing_table().await? {
+            Some(table) => Ok(table.count_rows(None).await?),
+            None => Ok(0),
+        }
+    }
+
+    /// Lists the workspace, filename, ID and embedding of every row.
+    pub async fn list_vectors(&self) -> Result<Vec<StoredVector>> {
+        let Some(table) = self.existing_table().await? else {
+            return Ok(Vec::new());
+        };
+        let columns = ["workspace", "filename", "id", "vector"].map(str::to_string);
+        let mut stream = table
+            .query()
+            .select(lancedb::query::Select::Columns(columns.to_vec()))
+            .execute()
+            .await?;
+
+        let mut rows = Vec::new();
+        while let Some(batch) = stream.try_next().await? {
+            let workspaces: &StringArray = column(&batch, "workspace")?;
+            let filenames: &StringArray = column(&batch, "filename")?;
+            let ids: &StringArray = column(&batch, "id")?;
+            let vectors: &FixedSizeListArray = column(&batch, "vector")?;
+            for i in 0..batch.num_rows() {
+                let vector_ref = vectors.value(i);
+                let mut vector = vector_ref
+                    .as_any()
+                    .downcast_ref::<Float32Array>()
+                    .ok_or_else(|| anyhow!("Unexpected type for 'vector' column"))?
+                    .values()
+                    .to_vec();
+                self.metric.prepare(&mut vector);
+                rows.push(StoredVector {
+                    workspace: workspaces.value(i).to_string(),
+                    filename: filenames.value(i).to_string(),
+                    id: ids.value(i).to_string(),
+                    vector,
+                });
+            }
+        }
+        Ok(rows)
+    }
+
+    /// Fetches every stored chunk of `filename` together with its embedding.
+    pub async fn get_file_chunks(
+        &self,
+        filename: &str,
+        workspace: &str,
+    ) -> Result<Vec<(CodeChunk, Vec<f32>)>> {
+        let table = self.get_table().await?;
+        let condition = format!(
+            "filename = '{}' AND workspace = '{}'",
+            filename.replace("'", "''"),
+            workspace.replace("'", "''")
+        );
+        let batches = table
+            .query()
+            .only_if(condition)
+            .execute()
+            .await?
+            .try_collect::<Vec<_>>()
+            .await?;
+
+        let mut rows = Vec::new();
+        for batch in &batches {
+            rows.extend(self.batch_to_chunks(batch)?);
+        }
+        Ok(rows)
+    }
+
+    /// Fetches the stored chunks with the given IDs, in no particular order.
+    pub async fn get_chunks_by_ids(
+        &self,
+        ids: &[String],
+        workspace: Option<&str>,
+    ) -> Result<Vec<CodeChunk>> {
+        if ids.is_empty() {
+            return Ok(Vec::new());
+        }
+        let table = self.get_table().await?;
+        let quoted: Vec<String> = ids
+            .iter()
+            .map(|id| format!("'{}'", id.replace("'", "''")))
+            .collect();
+        let mut condition = format!("id IN ({})", quoted.join(", "));
+        if let Some(ws) = workspace {
+            condition.push_str(&format!(" AND workspace = '{}'", ws.replace("'", "''")));
+        }
+        let batches = table
+            .query()
+            .only_if(condition)
+            .execute()
+            .await?
+            .try_collect::<Vec<_>>()
+            .await?;
+
+        let mut chunks = Vec::new();
+        for batch in &batches {
+            chunks.extend(self.batch_to_chunks(batch)?.into_iter().map(|(c, _)| c));
+        }
+        Ok(chunks)
+    }
+
+    fn batch_to_chunks(&self, batch: &RecordBatch) -> Result<Vec<(CodeChunk, Vec<f32>)>> {
+        let filenames: &StringArray = column(batch, "filename")?;
+        let codes: &StringArray = column(batch, "code")?;
+        let line_starts: &Int32Array = column(batch, "line_start")?;
+        let line_ends: &Int32Array = column(batch, "line_end")?;
+        let mtimes: &Int64Array = column(batch, "last_modified")?;
+        let vectors: &FixedSizeListArray = column(batch, "vector")?;
+        let calls_col: Option<&ListArray> = batch
+            .column_by_name("calls")
+            .and_then(|c| c.as_any().downcast_ref());
+        let symbols: Option<&StringArray> = batch
+            .column_by_name("symbol")
+            .and_then(|c| c.as_any().downcast_ref());
+        let languages: Option<&StringArray> = batch
+            .column_by_name("language")
+            .and_then(|c| c.as_any().downcast_ref());
+        let redacted: Option<&BooleanArray> = batch
+            .column_by_name("redacted")
+            .and_then(|c| c.as_any().downcast_ref());
+        let occurrences: Option<&Int32Array> = batch
+            .column_by_name("occurrence")
+            .and_then(|c| c.as_any().downcast_ref());
+        let overlaps: Option<&Int32Array> = batch
+            .column_by_name("overlap_lines")
+            .and_then(|c| c.as_any().downcast_ref());
+        let summaries: Option<&StringArray> = batch
+            .column_by_name("summary")
+            .and_then(|c| c.as_any().downcast_ref());
+        let docs: Option<&StringArray> = batch
+            .column_by_name("doc")
+            .and_then(|c| c.as_any().downcast_ref());
+        let packages: Option<&StringArray> = batch
+            .column_by_name("package")
+            .and_then(|c| c.as_any().downcast_ref());
+        let imports_col: Option<&ListArray> = batch
+            .column_by_name("imports")
+            .and_then(|c| c.as_any().downcast_ref());
+        let part_indexes: Option<&Int32Array> = batch
+            .column_by_name("part")
+            .and_then(|c| c.as_any().downcast_ref());
+        let part_counts: Option<&Int32Array> = batch
+            .column_by_name("part_count")
+            .and_then(|c| c.as_any().downcast_ref());
+        let changed_at: Option<&Int64Array> = batch
+            .column_by_name("changed_at")
+            .and_then(|c| c.as_any().downcast_ref());
+        let is_test: Option<&BooleanArray> = batch
+            .column_by_name("is_test")
+            .and_then(|c| c.as_any().downcast_ref());
+        let collections: Option<&StringArray> = batch
+            .column_by_name("collection")
+            .and_then(|c| c.as_any().downcast_ref());
+        let duplicates: Option<&StringArray> = batch
+            .column_by_name("duplicates")
+            .and_then(|c| c.as_any().downcast_ref());
+        let tags: Option<&StringArray> = batch
+            .column_by_name("tags")
+            .and_then(|c| c.as_any().downcast_ref());
+
+        let mut rows = Vec::with_capacity(batch.num_rows());
+        for i in 0..batch.num_rows() {
+            let vector_ref = vectors.value(i);
+            let mut vector = vector_ref
+                .as_any()
+                .downcast_ref::<Float32Array>()
+                .ok_or_else(|| anyhow!("Unexpected type for 'vector' column"))?
+                .values()
+                .to_vec();
+            self.metric.prepare(&mut vector);
+
+            rows.push((
+                CodeChunk {
+                    filename: filenames.value(i).to_string(),
+                    code: codes.value(i).to_string(),
+                    line_start: line_starts.value(i) as usize,
+                    line_end: line_ends.value(i) as usize,
+                    last_modified: mtimes.value(i),
+                    calls: string_list(calls_col, i),
+                    symbol: symbols
+                        .filter(|s| !s.is_null(i))
+                        .map(|s| s.value(i).to_string()),
+                    language: languages
+                        .filter(|l| !l.is_null(i))
+                        .map(|l| l.value(i).to_string()),
+                    redacted: redacted.is_some_and(|r| !r.is_null(i) && r.value(i)),
+                    occurrence: occurrences
+                        .filter(|o| !o.is_null(i))
+                        .map_or(0, |o| o.value(i) as u32),
+                    overlap_lines: overlaps
+                        .filter(|o| !o.is_null(i))
+                        .map_or(0, |o| o.value(i) as usize),
+                    summary: summaries
+                        .filter(|s| !s.is_null(i))
+                        .map(|s| s.value(i).to_string()),
+                    doc: docs
+                        .filter(|d| !d.is_null(i))
+                        .map(|d| d.value(i).to_string()),
+                    package: packages
+                        .filter(|p| !p.is_null(i))
+                        .map(|p| p.value(i).to_string()),
+                    imports: string_list(imports_col, i),
+                    part: part_indexes
+                        .zip(part_counts)
+                        .filter(|(p, c)| !p.is_null(i) && !c.is_null(i))
+                        .map(|(p, c)| ChunkPart {
+                            index: p.value(i) as usize,
+                            count: c.value(i) as usize,
+                        }),
+                    changed_at: changed_at.filter(|t| !t.is_null(i)).map(|t| t.value(i)),
+                    is_test: is_test.is_some_and(|t| !t.is_null(i) && t.value(i)),
+                    collection: collections
+                        .filter(|c| !c.is_null(i))
+                        .map(|c| c.value(i).to_string()),
+                    duplicates: duplicates
+                        .filter(|d| !d.is_null(i))
+                        .map(|d| serde_json::from_str(d.value(i)))
+                        .transpose()?
+                        .unwrap_or_default(),
+                    tags: tags
+                        .filter(|t| !t.is_null(i))
+                        .map(|t| serde_json::from_str(t.value(i)))
+                        .transpose()?
+                        .unwrap_or_default(),
+                },
+                vector,
+            ));
+        }
+        Ok(rows)
+    }
+
     pub async fn delete_file_chunks(&self, filename: &str, workspace: &str) -> Result<()> {
         if let Ok(table) = self.get_table().await {
             let safe_filename = filename.replace("'", "''");
@@ -257,20 +1337,8 @@ impl Storage {
         }
         if let Ok(table) = self.get_table().await {
             // Chunk deletions to avoid hitting SQL/AST limits if filenames list is huge
-            // A safer chunk size for IN clause might be around 50-100 depending on path lengths.
-            // Let's use 50.
-            for chunk in filenames.chunks(50) {
-                let filename_list = chunk
-                    .iter()
-                    .map(|f| format!("'{}'", f.replace("'", "''")))
-                    .collect::<Vec<_>>()
-                    .join(", ");
-
-                let condition = format!(
-                    "workspace = '{}' AND filename IN ({})",
-                    workspace.replace("'", "''"),
-                    filename_list
-                );
+            for chunk in filenames.chunks(FILES_PER_STATEMENT) {
+                let condition = files_predicate(workspace, chunk);
 
                 if let Err(e) = table.delete(&condition).await {
                     // Log but don't stop? Or stop?
@@ -297,3 +1365,202 @@ impl Storage {
         Ok(())
     }
 }
+
+/// Most files named in one LanceDB predicate, to stay clear of SQL/AST
+/// limits; a safe size depends on path lengths.
+const FILES_PER_STATEMENT: usize = 50;
+
+/// Rows fetched past the limit of a LanceDB vector query, which cuts equal
+/// distances in scan order; the tie-break by ID then decides the last places.
+const TIE_MARGIN: usize = 16;
+
+/// Predicate selecting the chunks of `filenames` in `workspace`.
+fn files_predicate(workspace: &str, filenames: &[String]) -> String {
+    let filename_list = filenames
+        .iter()
+        .map(|f| format!("'{}'", f.replace("'", "''")))
+        .collect::<Vec<_>>()
+        .join(", ");
+    format!(
+        "workspace = '{}' AND filename IN ({})",
+        workspace.replace("'", "''"),
+        filename_list
+    )
+}
+
+/// Downcasts a named column of a record batch to its concrete Arrow array type.
+fn column<'a, T: 'static>(batch: &'a RecordBatch, name: &str) -> Result<&'a T> {
+    batch
+        .column_by_name(name)
+        .ok_or_else(|| anyhow!("Missing '{}' column", name))?
+        .as_any()
+        .downcast_ref::<T>()
+        .ok_or_else(|| anyhow!("Unexpected type for '{}' column", name))
+}
+
+/// Builds a list column holding one list of strings per row.
+fn string_lists(lists: Vec<Vec<String>>) -> ListArray {
+    let mut builder = ListBuilder::new(StringBuilder::new());
+    for list in lists {
+        for item in list {
+            builder.values().append_value(item);
+        }
+        builder.append(true);
+    }
+    builder.finish()
+}
+
+/// A column of JSON lists, null where a list is empty.
+fn json_lists<T: serde::Serialize>(lists: &[Vec<T>]) -> serde_json::Result<StringArray> {
+    let values = lists
+        .iter()
+        .map(|list| {
+            (!list.is_empty())
+                .then(|| serde_json::to_string(list))
+                .transpose()
+        })
+        .collect::<serde_json::Result<Vec<_>>>()?;
+    Ok(StringArray::from(values))
+}
+
+/// Reads row `i` of a list-of-strings column; empty if the column or row is missing.
+fn string_list(col: Option<&ListArray>, i: usize) -> Vec<String> {
+    col.filter(|list| !list.is_null(i))
+        .and_then(|list| {
+            let values = list.value(i);
+            values
+                .as_any()
+                .downcast_ref::<StringArray>()
+                .map(|strings| strings.iter().flatten().map(str::to_string).collect())
+        })
+        .unwrap_or_default()
+}
+
+#[async_trait]
+impl VectorStore for Storage {
+    async fn init(&self, dim: usize) -> Result<()> {
+        Storage::init(self, dim).await
+    }
+
+    async fn add_code_chunks(
+        &self,
+        workspace: &str,
+        chunks: &[CodeChunk],
+        vectors: Vec<Vec<f32>>,
+    ) -> Result<()> {
+        Storage::add_code_chunks(self, workspace, chunks, vectors).await
+    }
+
+    async fn search_chunks(
+        &self,
+        query_vector: Vec<f32>,
+        limit: usize,
+        filter: Option<String>,
+        workspace: Option<&str>,
+    ) -> Result<Vec<ScoredChunk>> {
+        let started = std::time::Instant::now();
+        let fetched = limit.saturating_add(TIE_MARGIN);
+        let batches = self
+            .search(query_vector, fetched, filter, workspace)
+            .await?;
+        let mut hits = Vec::new();
+        for batch in &batches {
+            let ids: &StringArray = column(batch, "id")?;
+            let distances: Option<&Float32Array> = batch
+                .column_by_name("_distance")
+                .and_then(|c| c.as_any().downcast_ref());
+            for (i, (chunk, vector)) in self.batch_to_chunks(batch)?.into_iter().enumerate() {
+                hits.push(ScoredChunk {
+                    id: ids.value(i).to_string(),
+                    chunk,
+                    distance: distances.map(|d| d.value(i)),
+                    vector,
+                });
+            }
+        }
+        // LanceDB returns equal distances in no fixed order; break ties by ID
+        hits.sort_by(|a, b| {
+            let (da, db) = (
+                a.distance.unwrap_or(f32::MAX),
+                b.distance.unwrap_or(f32::MAX),
+            );
+            da.total_cmp(&db).then_with(|| a.id.cmp(&b.id))
+        });
+        hits.truncate(limit);
+        tracing::debug!(
+            hits = hits.len(),
+            elapsed_ms = started.elapsed().as_millis() as u64,
+            "Searched LanceDB"
+        );
+        Ok(hits)
+    }
+
+    fn metric(&self) -> Metric {
+        self.metric
+    }
+
+    async fn stored_metric(&self) -> Result<Option<Metric>> {
+        match self.existing_table().await? {
+            Some(table) => Ok(Some(recorded_metric(&table.schema().await?.metadata)?)),
+            None => Ok(None),
+        }
+    }
+
+    async fn missing_columns(&self) -> Result<Vec<String>> {
+        Storage::missing_columns(self).await
+    }
+
+    async fn get_indexed_metadata(&self, workspace: &str) -> Result<HashMap<String, i64>> {
+        Storage::get_indexed_metadata(self, workspace).await
+    }
+
+    async fn list_chunk_info(&self, workspace: &str) -> Result<Vec<ChunkInfo>> {
+        Storage::list_chunk_info(self, workspace).await
+    }
+
+    async fn count_chunks(&self) -> Result<usize> {
+        Storage::count_chunks(self).await
+    }
+
+    async fn list_vectors(&self) -> Result<Vec<StoredVector>> {
+        Storage::list_vectors(self).await
+    }
+
+    async fn get_file_chunks(
+        &self,
+        filename: &str,
+        workspace: &str,
+    ) -> Result<Vec<(CodeChunk, Vec<f32>)>> {
+        Storage::get_file_chunks(self, filename, workspace).await
+    }
+
+    async fn get_chunks_by_ids(
+        &self,
+        ids: &[String],
+        workspace: Option<&str>,
+    ) -> Result<Vec<CodeChunk>> {
+        Storage::get_chunks_by_ids(self, ids, workspace).await
+    }
+
+    async fn delete_file_chunks(&self, filename: &str, workspace: &str) -> Result<()> {
+        Storage::delete_file_chunks(self, filename, workspace).await
+    }
+
+    async fn batch_delete_files(&self, filenames: &[String], workspace: &str) -> Result<()> {
+        Storage::batch_delete_files(self, filenames, workspace).await
+    }
+
+    async fn replace_files(
+        &self,
+        workspace: &str,
+        filenames: &[String],
+        chunks: &[CodeChunk],
+        vectors: Vec<Vec<f32>>,
+    ) -> Result<()> {
+        Storage::replace_files(self, workspace, filenames, chunks, vectors).await
+    }
+
+    async fn create_filename_index(&self) -> Result<()> {
+        Storage::create_filename_index(self).await
+    }
+}
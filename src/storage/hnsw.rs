@@ -0,0 +1,1426 @@
+//! Approximate nearest-neighbor search over a Hierarchical Navigable Small World graph.
+//!
+//! [`HnswStore`] wraps another [`VectorStore`], which stays the source of
+//! truth for chunks and vectors, and answers unfiltered nearest-neighbor
+//! queries from an in-memory [`HnswGraph`] instead of a full scan. The graph
+//! is saved next to the table on [`VectorStore::flush`], along with the
+//! [index version](crate::manifest::index_version) it matches, and rebuilt
+//! from the wrapped store whenever the saved copy is missing or out of date.
+//!
+//! Queries with a metadata filter are delegated to the wrapped store, which
+//! applies the filter before ranking; the graph can only filter after the
+//! fact and would return too few matches for selective filters.
+
+use super::{check_metric, ChunkInfo, Metric, ScoredChunk, StoredVector, VectorStore};
+use crate::config::AppConfig;
+use crate::indexer::CodeChunk;
+use crate::manifest::index_version;
+use anyhow::{bail, Context, Result};
+use async_trait::async_trait;
+use std::cmp::{Ordering, Reverse};
+use std::collections::{BinaryHeap, HashMap, HashSet};
+use std::fs::File;
+use std::io::{BufReader, BufWriter, Read, Write};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicBool, Ordering as AtomicOrdering};
+use std::sync::{Arc, RwLock};
+use tracing::{info, warn};
+
+/// First bytes of a saved graph; the last byte is the format version.
+const MAGIC: &[u8; 8] = b"CRHNSW\x00\x02";
+/// Format version 1, written before graphs recorded their metric; they are cosine.
+const MAGIC_V1: &[u8; 8] = b"CRHNSW\x00\x01";
+/// Marks a graph without an entry point in the saved file.
+const NO_ENTRY: u32 = u32::MAX;
+/// Workspaces with at most this many vectors are searched exactly: filtering
+/// a beam search down to a small share of the graph misses too many of them.
+const EXACT_SEARCH_MAX: usize = 10_000;
+
+/// Tuning knobs of an [`HnswGraph`].
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct HnswParams {
+    /// Links per node on the upper layers; layer 0 keeps up to `2 * m`.
+    /// Higher values raise recall and memory use.
+    pub m: usize,
+    /// Candidates considered when linking a new node. Higher values build a
+    /// better graph, more slowly.
+    pub ef_construction: usize,
+    /// Candidates considered per query (at least the requested limit).
+    /// Higher values raise recall and query time.
+    pub ef_search: usize,
+}
+
+impl Default for HnswParams {
+    fn default() -> Self {
+        Self {
+            m: 16,
+            ef_construction: 200,
+            ef_search: 64,
+        }
+    }
+}
+
+impl HnswParams {
+    /// Reads `vector_index` (`exact` or `hnsw`) and the `hnsw_*` keys, or
+    /// returns `None` for exact search.
+    pub fn from_config(config: &AppConfig) -> Result<Option<Self>> {
+        match config.vector_index.as_str() {
+            "exact" => Ok(None),
+            "hnsw" => {
+                if config.hnsw_m < 2 {
+                    bail!("hnsw_m must be at least 2, got {}", config.hnsw_m);
+                }
+                if config.hnsw_ef_construction == 0 || config.hnsw_ef_search == 0 {
+                    bail!("hnsw_ef_construction and hnsw_ef_search must be positive");
+                }
+                Ok(Some(Self {
+                    m: config.hnsw_m,
+                    ef_construction: config.hnsw_ef_construction,
+                    ef_search: config.hnsw_ef_search,
+                }))
+            }
+            other => bail!("Unknown vector_index '{}'; expected exact or hnsw", other),
+        }
+    }
+}
+
+/// A result of [`HnswGraph::search`].
+#[derive(Debug, Clone, PartialEq)]
+pub struct Neighbor {
+    pub workspace: String,
+    pub id: String,
+    /// Distance to the query by the graph's [`Metric`]
+    pub distance: f32,
+}
+
+struct Node {
+    workspace: String,
+    filename: String,
+    id: String,
+    /// [Prepared](Metric::prepare) for the graph's metric
+    vector: Vec<f32>,
+    /// `neighbors[layer]` for every layer up to the node's level
+    neighbors: Vec<Vec<u32>>,
+    /// Removed nodes stay in the graph as waypoints until [`HnswGraph::compact`]
+    deleted: bool,
+}
+
+/// Distance of a node to the current query, ordered by distance.
+#[derive(Clone, Copy, PartialEq)]
+struct Candidate {
+    distance: f32,
+    node: u32,
+}
+
+impl Eq for Candidate {}
+
+impl Ord for Candidate {
+    fn cmp(&self, other: &Self) -> Ordering {
+        self.distance
+            .total_cmp(&other.distance)
+            .then(self.node.cmp(&other.node))
+    }
+}
+
+impl PartialOrd for Candidate {
+    fn partial_cmp(&self, other: &Self) -> Option<Ordering> {
+        Some(self.cmp(other))
+    }
+}
+
+/// Navigable small world graph over the vectors of a store, keyed by
+/// workspace and chunk ID and compared by the store's [`Metric`].
+///
+/// Follows Malkov & Yashunin (2016): every node is placed on a random number
+/// of layers, linked to its nearest neighbors on each by the distance
+/// heuristic, and queries descend greedily from the sparse top layer before
+/// a beam search of width `ef` on layer 0. Removing a node only marks it, so
+/// the graph stays connected; [`compact`](Self::compact) drops removed nodes.
+pub struct HnswGraph {
+    dim: usize,
+    metric: Metric,
+    m: usize,
+    ef_construction: usize,
+    nodes: Vec<Node>,
+    /// Live node of each `(workspace, id)`
+    index: HashMap<(String, String), u32>,
+    /// Number of live nodes of each workspace
+    workspace_sizes: HashMap<String, usize>,
+    entry: Option<u32>,
+    /// State of the level generator, saved so rebuilt graphs are reproducible
+    rng: u64,
+}
+
+impl HnswGraph {
+    /// Creates an empty graph; the dimension is fixed by the first insert.
+    pub fn new(params: HnswParams) -> Self {
+        Self {
+            dim: 0,
+            metric: Metric::default(),
+            m: params.m.max(2),
+            ef_construction: params.ef_construction.max(1),
+            nodes: Vec::new(),
+            index: HashMap::new(),
+            workspace_sizes: HashMap::new(),
+            entry: None,
+            rng: 0x853c_49e6_748f_ea9b,
+        }
+    }
+
+    /// Compares vectors by `metric`; set before the first insert.
+    pub fn with_metric(mut self, metric: Metric) -> Self {
+        self.metric = metric;
+        self
+    }
+
+    pub fn metric(&self) -> Metric {
+        self.metric
+    }
+
+    /// Number of live vectors.
+    pub fn len(&self) -> usize {
+        self.index.len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.index.is_empty()
+    }
+
+    /// Returns true if the graph was built with the `m` and `ef_construction` of `params`.
+    pub fn built_with(&self, params: &HnswParams) -> bool {
+        self.m == params.m.max(2) && self.ef_construction == params.ef_construction.max(1)
+    }
+
+    /// Stored vector of a live node, unit length under [`Metric::Cosine`].
+    pub fn vector(&self, workspace: &str, id: &str) -> Option<&[f32]> {
+        self.index
+            .get(&(workspace.to_string(), id.to_string()))
+            .map(|&n| self.nodes[n as usize].vector.as_slice())
+    }
+
+    /// Adds a vector, replacing the one stored under the same workspace and ID.
+    pub fn insert(
+        &mut self,
+        workspace: &str,
+        filename: &str,
+        id: &str,
+        mut vector: Vec<f32>,
+    ) -> Result<()> {
+        if self.dim == 0 {
+            self.dim = vector.len();
+        } else if vector.len() != self.dim {
+            bail!(
+                "Vector for {} has {} dimensions, expected {}",
+                id,
+                vector.len(),
+                self.dim
+            );
+        }
+        self.metric.prepare(&mut vector);
+
+        let key = (workspace.to_string(), id.to_string());
+        match self.index.remove(&key) {
+            Some(old) => self.nodes[old as usize].deleted = true,
+            None => *self.workspace_sizes.entry(key.0.clone()).or_default() += 1,
+        }
+
+        let level = self.random_level();
+        let node = self.nodes.len() as u32;
+        self.nodes.push(Node {
+            workspace: key.0.clone(),
+            filename: filename.to_string(),
+            id: key.1.clone(),
+            vector,
+            neighbors: vec![Vec::new(); level + 1],
+            deleted: false,
+        });
+        self.index.insert(key, node);
+
+        let Some(entry) = self.entry else {
+            self.entry = Some(node);
+            return Ok(());
+        };
+        let query = self.nodes[node as usize].vector.clone();
+        let top = self.level(entry);
+
+        let mut entry_point = entry;
+        for layer in (level + 1..=top).rev() {
+            entry_point = self.greedy_closest(&query, entry_point, layer);
+        }
+
+        let mut entry_points = vec![entry_point];
+        for layer in (0..=level.min(top)).rev() {
+            let candidates =
+                self.search_layer(&query, &entry_points, self.ef_construction, layer, |n| {
+                    n != node && !self.nodes[n as usize].deleted
+                });
+            let selected = self.select_neighbors(&candidates, self.m);
+            for &neighbor in &selected {
+                self.link(neighbor, node, layer);
+            }
+            self.nodes[node as usize].neighbors[layer] = selected;
+            if !candidates.is_empty() {
+                entry_points = candidates.iter().map(|c| c.node).collect();
+            }
+        }
+
+        if level > top {
+            self.entry = Some(node);
+        }
+        Ok(())
+    }
+
+    /// Removes every vector of `filenames` in `workspace`; returns how many.
+    pub fn remove_files(&mut self, workspace: &str, filenames: &[String]) -> usize {
+        let filenames: HashSet<&str> = filenames.iter().map(String::as_str).collect();
+        let mut removed = 0;
+        for node in &mut self.nodes {
+            if !node.deleted
+                && node.workspace == workspace
+                && filenames.contains(node.filename.as_str())
+            {
+                node.deleted = true;
+                self.index
+                    .remove(&(node.workspace.clone(), node.id.clone()));
+                removed += 1;
+            }
+        }
+        if let Some(size) = self.workspace_sizes.get_mut(workspace) {
+            *size -= removed;
+            if *size == 0 {
+                self.workspace_sizes.remove(workspace);
+            }
+        }
+        removed
+    }
+
+    /// Returns up to `k` live vectors nearest to `query`, closest first.
+    ///
+    /// `ef` is the beam width on layer 0 and is raised to `k` if smaller.
+    /// With a `workspace` only its vectors are returned. Others are still
+    /// traversed, so the beam is widened by the share of the graph they take
+    /// up, and a workspace of at most [`EXACT_SEARCH_MAX`] vectors is
+    /// searched exactly instead.
+    pub fn search(
+        &self,
+        query: &[f32],
+        k: usize,
+        ef: usize,
+        workspace: Option<&str>,
+    ) -> Vec<Neighbor> {
+        let Some(entry) = self.entry else {
+            return Vec::new();
+        };
+        if k == 0 || query.len() != self.dim {
+            return Vec::new();
+        }
+        let mut query = query.to_vec();
+        self.metric.prepare(&mut query);
+
+        let mut ef = ef.max(k);
+        if let Some(ws) = workspace {
+            let size = self.workspace_sizes.get(ws).copied().unwrap_or(0);
+            if size == 0 {
+                return Vec::new();
+            }
+            if size <= EXACT_SEARCH_MAX && size < self.len() {
+                return self.exact_search(&query, k, ws);
+            }
+            ef = (ef * self.len()).div_ceil(size).min(self.len());
+        }
+
+        let mut entry_point = entry;
+        for layer in (1..=self.level(entry)).rev() {
+            entry_point = self.greedy_closest(&query, entry_point, layer);
+        }
+        let found = self.search_layer(&query, &[entry_point], ef, 0, |n| {
+            let node = &self.nodes[n as usize];
+            !node.deleted && workspace.is_none_or(|ws| node.workspace == ws)
+        });
+        self.neighbors(found, k)
+    }
+
+    /// Compares `query`, already prepared, with every live vector of `workspace`.
+    fn exact_search(&self, query: &[f32], k: usize, workspace: &str) -> Vec<Neighbor> {
+        let found: Vec<Candidate> = self
+            .nodes
+            .iter()
+            .enumerate()
+            .filter(|(_, node)| !node.deleted && node.workspace == workspace)
+            .map(|(n, _)| Candidate {
+                distance: self.distance(query, n as u32),
+                node: n as u32,
+            })
+            .collect();
+        self.neighbors(found, k)
+    }
+
+    /// The first `k` of `found`, closest first and equal distances by ID, so
+    /// ties at the cut don't depend on insertion order.
+    fn neighbors(&self, mut found: Vec<Candidate>, k: usize) -> Vec<Neighbor> {
+        found.sort_by(|a, b| {
+            a.distance.total_cmp(&b.distance).then_with(|| {
+                self.nodes[a.node as usize]
+                    .id
+                    .cmp(&self.nodes[b.node as usize].id)
+            })
+        });
+        found
+            .into_iter()
+            .take(k)
+            .map(|c| {
+                let node = &self.nodes[c.node as usize];
+                Neighbor {
+                    workspace: node.workspace.clone(),
+                    id: node.id.clone(),
+                    distance: c.distance,
+                }
+            })
+            .collect()
+    }
+
+    /// Rebuilds the graph without removed nodes.
+    pub fn compact(&mut self) {
+        let nodes = std::mem::take(&mut self.nodes);
+        self.index.clear();
+        self.workspace_sizes.clear();
+        self.entry = None;
+        for node in nodes.into_iter().filter(|n| !n.deleted) {
+            // Same dimension as before, so this cannot fail
+            let _ = self.insert(&node.workspace, &node.filename, &node.id, node.vector);
+        }
+    }
+
+    /// Writes the graph to `path`, through a temporary file so a crash never
+    /// leaves a truncated graph behind. Compacts first if most nodes are removed.
+    pub fn save(&mut self, path: &Path) -> Result<()> {
+        if self.nodes.len() > 2 * self.len() {
+            self.compact();
+        }
+        let tmp = path.with_extension("hnsw.tmp");
+        {
+            let mut out = BufWriter::new(
+                File::create(&tmp)
+                    .with_context(|| format!("Failed to create {}", tmp.display()))?,
+            );
+            out.write_all(MAGIC)?;
+            write_str(&mut out, self.metric.as_str())?;
+            write_u32(&mut out, self.dim)?;
+            write_u32(&mut out, self.m)?;
+            write_u32(&mut out, self.ef_construction)?;
+            out.write_all(&self.entry.unwrap_or(NO_ENTRY).to_le_bytes())?;
+            out.write_all(&self.rng.to_le_bytes())?;
+            write_u32(&mut out, self.nodes.len())?;
+            for node in &self.nodes {
+                out.write_all(&[node.deleted as u8])?;
+                write_str(&mut out, &node.workspace)?;
+                write_str(&mut out, &node.filename)?;
+                write_str(&mut out, &node.id)?;
+                for v in &node.vector {
+                    out.write_all(&v.to_le_bytes())?;
+                }
+                write_u32(&mut out, node.neighbors.len())?;
+                for links in &node.neighbors {
+                    write_u32(&mut out, links.len())?;
+                    for link in links {
+                        out.write_all(&link.to_le_bytes())?;
+                    }
+                }
+            }
+            out.flush()?;
+        }
+        std::fs::rename(&tmp, path)
+            .with_context(|| format!("Failed to write HNSW graph {}", path.display()))?;
+        Ok(())
+    }
+
+    /// Reads a graph written by [`save`](Self::save).
+    pub fn load(path: &Path) -> Result<Self> {
+        let mut input = BufReader::new(
+            File::open(path).with_context(|| format!("Failed to open {}", path.display()))?,
+        );
+        Self::read(&mut input).with_context(|| format!("Corrupt HNSW graph {}", path.display()))
+    }
+
+    fn read(input: &mut impl Read) -> Result<Self> {
+        let mut magic = [0u8; 8];
+        input.read_exact(&mut magic)?;
+        let metric = if &magic == MAGIC {
+            read_str(input)?.parse().map_err(anyhow::Error::msg)?
+        } else if &magic == MAGIC_V1 {
+            Metric::Cosine
+        } else {
+            bail!("unknown file format");
+        };
+        let dim = read_u32(input)? as usize;
+        let m = read_u32(input)? as usize;
+        let ef_construction = read_u32(input)? as usize;
+        let entry = read_u32(input)?;
+        let rng = read_u64(input)?;
+        let count = read_u32(input)? as usize;
+
+        let mut nodes = Vec::with_capacity(count);
+        let mut index = HashMap::with_capacity(count);
+        let mut workspace_sizes: HashMap<String, usize> = HashMap::new();
+        for n in 0..count {
+            let mut deleted = [0u8; 1];
+            input.read_exact(&mut deleted)?;
+            let workspace = read_str(input)?;
+            let filename = read_str(input)?;
+            let id = read_str(input)?;
+            let mut vector = Vec::with_capacity(dim);
+            for _ in 0..dim {
+                vector.push(f32::from_le_bytes(read_bytes(input)?));
+            }
+            let layers = read_u32(input)? as usize;
+            let mut neighbors = Vec::with_capacity(layers);
+            for _ in 0..layers {
+                let links = read_u32(input)? as usize;
+                let mut layer = Vec::with_capacity(links);
+                for _ in 0..links {
+                    let link = read_u32(input)?;
+                    if link as usize >= count {
+                        bail!("link to missing node {}", link);
+                    }
+                    layer.push(link);
+                }
+                neighbors.push(layer);
+            }
+            if deleted[0] == 0 {
+                index.insert((workspace.clone(), id.clone()), n as u32);
+                *workspace_sizes.entry(workspace.clone()).or_default() += 1;
+            }
+            nodes.push(Node {
+                workspace,
+                filename,
+                id,
+                vector,
+                neighbors,
+                deleted: deleted[0] != 0,
+            });
+        }
+        if entry != NO_ENTRY && entry as usize >= count {
+            bail!("entry point {} out of range", entry);
+        }
+
+        Ok(Self {
+            dim,
+            metric,
+            m,
+            ef_construction,
+            nodes,
+            index,
+            workspace_sizes,
+            entry: (entry != NO_ENTRY).then_some(entry),
+            rng,
+        })
+    }
+
+    fn level(&self, node: u32) -> usize {
+        self.nodes[node as usize].neighbors.len() - 1
+    }
+
+    fn distance(&self, query: &[f32], node: u32) -> f32 {
+        self.metric
+            .distance(query, &self.nodes[node as usize].vector)
+    }
+
+    /// Draws a level with `P(level >= l) = m^-l`.
+    fn random_level(&mut self) -> usize {
+        // xorshift64*
+        self.rng ^= self.rng >> 12;
+        self.rng ^= self.rng << 25;
+        self.rng ^= self.rng >> 27;
+        let bits = self.rng.wrapping_mul(0x2545_f491_4f6c_dd1d) >> 11;
+        let uniform = (bits as f64 + 1.0) / (1u64 << 53) as f64;
+        (-uniform.ln() / (self.m as f64).ln()) as usize
+    }
+
+    /// Follows links on `layer` while they lead closer to `query`.
+    fn greedy_closest(&self, query: &[f32], start: u32, layer: usize) -> u32 {
+        let mut best = Candidate {
+            distance: self.distance(query, start),
+            node: start,
+        };
+        loop {
+            let mut improved = false;
+            for &neighbor in &self.nodes[best.node as usize].neighbors[layer] {
+                let distance = self.distance(query, neighbor);
+                if distance < best.distance {
+                    best = Candidate {
+                        distance,
+                        node: neighbor,
+                    };
+                    improved = true;
+                }
+            }
+            if !improved {
+                return best.node;
+            }
+        }
+    }
+
+    /// Beam search of width `ef` on `layer`, closest first.
+    ///
+    /// Every node is traversed but only those passing `accept` are returned.
+    fn search_layer(
+        &self,
+        query: &[f32],
+        entry_points: &[u32],
+        ef: usize,
+        layer: usize,
+        accept: impl Fn(u32) -> bool,
+    ) -> Vec<Candidate> {
+        let mut visited: HashSet<u32> = HashSet::with_capacity(ef * 4);
+        let mut candidates = BinaryHeap::new();
+        let mut results: BinaryHeap<Candidate> = BinaryHeap::new();
+        for &node in entry_points {
+            if !visited.insert(node) {
+                continue;
+            }
+            let candidate = Candidate {
+                distance: self.distance(query, node),
+                node,
+            };
+            candidates.push(Reverse(candidate));
+            if accept(node) {
+                results.push(candidate);
+            }
+        }
+        while results.len() > ef {
+            results.pop();
+        }
+
+        while let Some(Reverse(current)) = candidates.pop() {
+            if results.len() >= ef
+                && results
+                    .peek()
+                    .is_some_and(|w| current.distance > w.distance)
+            {
+                break;
+            }
+            for &neighbor in &self.nodes[current.node as usize].neighbors[layer] {
+                if !visited.insert(neighbor) {
+                    continue;
+                }
+                let distance = self.distance(query, neighbor);
+                let worst = results.peek().map_or(f32::INFINITY, |w| w.distance);
+                if results.len() < ef || distance < worst {
+                    let candidate = Candidate {
+                        distance,
+                        node: neighbor,
+                    };
+                    candidates.push(Reverse(candidate));
+                    if accept(neighbor) {
+                        results.push(candidate);
+                        if results.len() > ef {
+                            results.pop();
+                        }
+                    }
+                }
+            }
+        }
+        results.into_sorted_vec()
+    }
+
+    /// Picks up to `m` of `candidates` (closest first) that are closer to the
+    /// new node than to any neighbor picked before them, so links spread in
+    /// different directions. Remaining slots are filled with the closest of
+    /// the rest.
+    fn select_neighbors(&self, candidates: &[Candidate], m: usize) -> Vec<u32> {
+        let mut selected: Vec<u32> = Vec::with_capacity(m);
+        let mut skipped = Vec::new();
+        for candidate in candidates {
+            if selected.len() >= m {
+                break;
+            }
+            let vector = &self.nodes[candidate.node as usize].vector;
+            let diverse = selected
+                .iter()
+                .all(|&s| candidate.distance < self.distance(vector, s));
+            if diverse {
+                selected.push(candidate.node);
+            } else {
+                skipped.push(candidate.node);
+            }
+        }
+        for node in skipped {
+            if selected.len() >= m {
+                break;
+            }
+            selected.push(node);
+        }
+        selected
+    }
+
+    /// Adds a link from `from` to `to`, pruning `from` back to its link limit.
+    fn link(&mut self, from: u32, to: u32, layer: usize) {
+        let max_links = if layer == 0 { 2 * self.m } else { self.m };
+        let links = &mut self.nodes[from as usize].neighbors[layer];
+        links.push(to);
+        if links.len() <= max_links {
+            return;
+        }
+
+        let vector = self.nodes[from as usize].vector.clone();
+        // Removed nodes are dropped first: on equal distances pruning keeps
+        // older nodes, so a file re-indexed again and again would otherwise
+        // end up linked only through its removed copies and not be found
+        let mut candidates: Vec<Candidate> = self.nodes[from as usize].neighbors[layer]
+            .iter()
+            .filter(|&&n| !self.nodes[n as usize].deleted)
+            .map(|&n| Candidate {
+                distance: self.distance(&vector, n),
+                node: n,
+            })
+            .collect();
+        candidates.sort();
+        let pruned = self.select_neighbors(&candidates, max_links);
+        self.nodes[from as usize].neighbors[layer] = pruned;
+    }
+}
+
+fn write_u32(out: &mut impl Write, value: usize) -> Result<()> {
+    let value = u32::try_from(value).context("value too large for the HNSW graph format")?;
+    out.write_all(&value.to_le_bytes())?;
+    Ok(())
+}
+
+fn write_str(out: &mut impl Write, value: &str) -> Result<()> {
+    write_u32(out, value.len())?;
+    out.write_all(value.as_bytes())?;
+    Ok(())
+}
+
+fn read_bytes<const N: usize>(input: &mut impl Read) -> Result<[u8; N]> {
+    let mut bytes = [0u8; N];
+    input.read_exact(&mut bytes)?;
+    Ok(bytes)
+}
+
+fn read_u32(input: &mut impl Read) -> Result<u32> {
+    Ok(u32::from_le_bytes(read_bytes(input)?))
+}
+
+fn read_u64(input: &mut impl Read) -> Result<u64> {
+    Ok(u64::from_le_bytes(read_bytes(input)?))
+}
+
+fn read_str(input: &mut impl Read) -> Result<String> {
+    let len = read_u32(input)? as usize;
+    let mut bytes = vec![0u8; len];
+    input.read_exact(&mut bytes)?;
+    Ok(String::from_utf8(bytes)?)
+}
+
+/// [`VectorStore`] answering unfiltered queries from an [`HnswGraph`].
+///
+/// Writes go to the wrapped store first and then to the graph. The saved
+/// graph is deleted on the first write after it was loaded and written again
+/// by [`flush`](VectorStore::flush), so a crash in between leads to a rebuild
+/// rather than a stale graph.
+///
+/// `flush` also records the [index version](index_version) the graph
+/// matches, which writers bump before flushing. A graph saved at another
+/// version is rebuilt on open: the table was written without it, e.g. by an
+/// `index` run with `vector_index = "none"`.
+///
+/// Graph searches hold `writes` for reading until their chunks are fetched,
+/// and writes hold it for writing across both updates, so a search never
+/// pairs neighbors from the graph with chunks the store has since replaced.
+pub struct HnswStore {
+    inner: Arc<dyn VectorStore>,
+    graph: Arc<RwLock<HnswGraph>>,
+    writes: tokio::sync::RwLock<()>,
+    path: PathBuf,
+    ef_search: usize,
+    /// The graph has changes that are not saved
+    dirty: AtomicBool,
+}
+
+impl HnswStore {
+    /// Returns the graph file used for `table_name` in `db_path`.
+    pub fn path(db_path: &str, table_name: &str) -> PathBuf {
+        Path::new(db_path).join(format!("{}.hnsw", table_name))
+    }
+
+    /// File next to the graph at `path` holding the index version it matches.
+    fn version_path(path: &Path) -> PathBuf {
+        path.with_extension("hnsw.version")
+    }
+
+    /// Current index version of the database holding the graph at `path`;
+    /// empty for an index that has none.
+    fn current_version(path: &Path) -> String {
+        let db_path = path.parent().unwrap_or(Path::new("."));
+        index_version(&db_path.to_string_lossy()).unwrap_or_default()
+    }
+
+    /// Wraps `inner`, loading the graph at `path` or rebuilding it from the
+    /// stored vectors if it is missing, unreadable, built with other
+    /// parameters or metric, saved at another index version or holds a
+    /// different number of vectors.
+    ///
+    /// Fails if `inner` was created for another metric than it was opened for,
+    /// as the graph answers most queries without asking it.
+    pub async fn open(
+        inner: Arc<dyn VectorStore>,
+        path: PathBuf,
+        params: HnswParams,
+    ) -> Result<Self> {
+        let metric = inner.metric();
+        if let Some(recorded) = inner.stored_metric().await? {
+            check_metric("Vector store", recorded, metric)?;
+        }
+        let stored = inner.count_chunks().await?;
+        let saved_version = std::fs::read_to_string(Self::version_path(&path)).ok();
+        let current = saved_version.is_some_and(|v| v == Self::current_version(&path));
+        let loaded = if path.exists() {
+            let file = path.clone();
+            match tokio::task::spawn_blocking(move || HnswGraph::load(&file)).await? {
+                Ok(graph)
+                    if current
+                        && graph.built_with(&params)
+                        && graph.metric() == metric
+                        && graph.len() == stored =>
+                {
+                    Some(graph)
+                }
+                Ok(_) => {
+                    info!(
+                        "HNSW graph {} is out of date; rebuilding it.",
+                        path.display()
+                    );
+                    None
+                }
+                Err(e) => {
+                    warn!("{:#}; rebuilding it.", e);
+                    None
+                }
+            }
+        } else {
+            None
+        };
+
+        let rebuilt = loaded.is_none();
+        let graph = match loaded {
+            Some(graph) => graph,
+            None => {
+                let vectors = inner.list_vectors().await?;
+                if !vectors.is_empty() {
+                    info!("Building HNSW graph over {} vectors...", vectors.len());
+                }
+                tokio::task::spawn_blocking(move || -> Result<HnswGraph> {
+                    let mut graph = HnswGraph::new(params).with_metric(metric);
+                    for v in vectors {
+                        graph.insert(&v.workspace, &v.filename, &v.id, v.vector)?;
+                    }
+                    Ok(graph)
+                })
+                .await??
+            }
+        };
+
+        let store = Self {
+            inner,
+            graph: Arc::new(RwLock::new(graph)),
+            writes: tokio::sync::RwLock::new(()),
+            path,
+            ef_search: params.ef_search,
+            dirty: AtomicBool::new(rebuilt),
+        };
+        // Searching a read-only index still works, it just rebuilds every time
+        if rebuilt {
+            if let Err(e) = store.flush().await {
+                warn!("Failed to save HNSW graph: {:#}", e);
+            }
+        }
+        Ok(store)
+    }
+
+    /// Flags unsaved changes, deleting the saved graph they invalidate.
+    fn mark_dirty(&self) -> Result<()> {
+        if !self.dirty.swap(true, AtomicOrdering::SeqCst) {
+            for path in [Self::version_path(&self.path), self.path.clone()] {
+                match std::fs::remove_file(&path) {
+                    Err(e) if e.kind() != std::io::ErrorKind::NotFound => {
+                        return Err(e)
+                            .with_context(|| format!("Failed to remove {}", path.display()))
+                    }
+                    _ => {}
+                }
+            }
+        }
+        Ok(())
+    }
+
+    /// Records that the saved graph matches the current index version.
+    fn save_version(&self) -> Result<()> {
+        let path = Self::version_path(&self.path);
+        std::fs::write(&path, Self::current_version(&self.path))
+            .with_context(|| format!("Failed to write {}", path.display()))
+    }
+
+    /// Runs `f` with the graph locked for writing on the blocking thread pool.
+    async fn with_graph_mut<T, F>(&self, f: F) -> Result<T>
+    where
+        T: Send + 'static,
+        F: FnOnce(&mut HnswGraph) -> Result<T> + Send + 'static,
+    {
+        let graph = self.graph.clone();
+        tokio::task::spawn_blocking(move || {
+            let mut graph = graph
+                .write()
+                .map_err(|_| anyhow::anyhow!("HNSW graph lock poisoned"))?;
+            f(&mut graph)
+        })
+        .await?
+    }
+}
+
+#[async_trait]
+impl VectorStore for HnswStore {
+    async fn init(&self, dim: usize) -> Result<()> {
+        self.inner.init(dim).await
+    }
+
+    async fn add_code_chunks(
+        &self,
+        workspace: &str,
+        chunks: &[CodeChunk],
+        vectors: Vec<Vec<f32>>,
+    ) -> Result<()> {
+        let _writing = self.writes.write().await;
+        self.inner
+            .add_code_chunks(workspace, chunks, vectors.clone())
+            .await?;
+        self.mark_dirty()?;
+        let workspace = workspace.to_string();
+        let rows: Vec<(String, String)> = chunks
+            .iter()
+            .map(|c| (c.filename.clone(), c.id()))
+            .collect();
+        self.with_graph_mut(move |graph| {
+            for ((filename, id), vector) in rows.into_iter().zip(vectors) {
+                graph.insert(&workspace, &filename, &id, vector)?;
+            }
+            Ok(())
+        })
+        .await
+    }
+
+    async fn search_chunks(
+        &self,
+        query_vector: Vec<f32>,
+        limit: usize,
+        filter: Option<String>,
+        workspace: Option<&str>,
+    ) -> Result<Vec<ScoredChunk>> {
+        if filter.is_some() {
+            return self
+                .inner
+                .search_chunks(query_vector, limit, filter, workspace)
+                .await;
+        }
+
+        let started = std::time::Instant::now();
+        let _reading = self.writes.read().await;
+        let graph = self.graph.clone();
+        let ef = self.ef_search;
+        let ws = workspace.map(str::to_string);
+        let neighbors =
+            tokio::task::spawn_blocking(move || -> Result<Vec<(Neighbor, Vec<f32>)>> {
+                let graph = graph
+                    .read()
+                    .map_err(|_| anyhow::anyhow!("HNSW graph lock poisoned"))?;
+                Ok(graph
+                    .search(&query_vector, limit, ef, ws.as_deref())
+                    .into_iter()
+                    .map(|n| {
+                        let vector = graph
+                            .vector(&n.workspace, &n.id)
+                            .unwrap_or_default()
+                            .to_vec();
+                        (n, vector)
+                    })
+                    .collect())
+            })
+            .await??;
+        tracing::debug!(
+            neighbors = neighbors.len(),
+            ef,
+            elapsed_ms = started.elapsed().as_millis() as u64,
+            "Searched HNSW graph"
+        );
+
+        let ids: Vec<String> = neighbors.iter().map(|(n, _)| n.id.clone()).collect();
+        let mut chunks: HashMap<String, CodeChunk> = self
+            .inner
+            .get_chunks_by_ids(&ids, workspace)
+            .await?
+            .into_iter()
+            .map(|c| (c.id(), c))
+            .collect();
+        Ok(neighbors
+            .into_iter()
+            .filter_map(|(neighbor, vector)| {
+                chunks.remove(&neighbor.id).map(|chunk| ScoredChunk {
+                    id: neighbor.id,
+                    chunk,
+                    distance: Some(neighbor.distance),
+                    vector,
+                })
+            })
+            .collect())
+    }
+
+    fn metric(&self) -> Metric {
+        self.inner.metric()
+    }
+
+    async fn stored_metric(&self) -> Result<Option<Metric>> {
+        self.inner.stored_metric().await
+    }
+
+    async fn missing_columns(&self) -> Result<Vec<String>> {
+        self.inner.missing_columns().await
+    }
+
+    async fn get_indexed_metadata(&self, workspace: &str) -> Result<HashMap<String, i64>> {
+        self.inner.get_indexed_metadata(workspace).await
+    }
+
+    async fn list_chunk_info(&self, workspace: &str) -> Result<Vec<ChunkInfo>> {
+        self.inner.list_chunk_info(workspace).await
+    }
+
+    async fn count_chunks(&self) -> Result<usize> {
+        self.inner.count_chunks().await
+    }
+
+    async fn list_vectors(&self) -> Result<Vec<StoredVector>> {
+        self.inner.list_vectors().await
+    }
+
+    async fn get_file_chunks(
+        &self,
+        filename: &str,
+        workspace: &str,
+    ) -> Result<Vec<(CodeChunk, Vec<f32>)>> {
+        self.inner.get_file_chunks(filename, workspace).await
+    }
+
+    async fn get_chunks_by_ids(
+        &self,
+        ids: &[String],
+        workspace: Option<&str>,
+    ) -> Result<Vec<CodeChunk>> {
+        self.inner.get_chunks_by_ids(ids, workspace).await
+    }
+
+    async fn delete_file_chunks(&self, filename: &str, workspace: &str) -> Result<()> {
+        self.batch_delete_files(&[filename.to_string()], workspace)
+            .await
+    }
+
+    async fn batch_delete_files(&self, filenames: &[String], workspace: &str) -> Result<()> {
+        let _writing = self.writes.write().await;
+        self.inner.batch_delete_files(filenames, workspace).await?;
+        self.mark_dirty()?;
+        let filenames = filenames.to_vec();
+        let workspace = workspace.to_string();
+        self.with_graph_mut(move |graph| {
+            graph.remove_files(&workspace, &filenames);
+            Ok(())
+        })
+        .await
+    }
+
+    async fn replace_files(
+        &self,
+        workspace: &str,
+        filenames: &[String],
+        chunks: &[CodeChunk],
+        vectors: Vec<Vec<f32>>,
+    ) -> Result<()> {
+        let _writing = self.writes.write().await;
+        self.inner
+            .replace_files(workspace, filenames, chunks, vectors.clone())
+            .await?;
+        self.mark_dirty()?;
+        let workspace = workspace.to_string();
+        let filenames = filenames.to_vec();
+        let rows: Vec<(String, String)> = chunks
+            .iter()
+            .map(|c| (c.filename.clone(), c.id()))
+            .collect();
+        self.with_graph_mut(move |graph| {
+            graph.remove_files(&workspace, &filenames);
+            for ((filename, id), vector) in rows.into_iter().zip(vectors) {
+                graph.insert(&workspace, &filename, &id, vector)?;
+            }
+            Ok(())
+        })
+        .await
+    }
+
+    async fn create_filename_index(&self) -> Result<()> {
+        self.inner.create_filename_index().await
+    }
+
+    async fn flush(&self) -> Result<()> {
+        self.inner.flush().await?;
+        // Every write since the graph was opened went through it, so an
+        // unchanged graph still matches a version bumped in the meantime
+        if !self.dirty.swap(false, AtomicOrdering::SeqCst) {
+            return self.save_version();
+        }
+        let path = self.path.clone();
+        let saved = self.with_graph_mut(move |graph| graph.save(&path)).await;
+        if saved.is_err() {
+            self.dirty.store(true, AtomicOrdering::SeqCst);
+        }
+        saved?;
+        self.save_version()
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::manifest::bump_index_version;
+    use crate::storage::SqliteStore;
+    use tempfile::TempDir;
+
+    /// Deterministic values in `[-1, 1)`.
+    fn pseudo_random(seed: u64, len: usize) -> Vec<f32> {
+        let mut state = seed.wrapping_mul(6364136223846793005).wrapping_add(1);
+        (0..len)
+            .map(|_| {
+                state = state
+                    .wrapping_mul(6364136223846793005)
+                    .wrapping_add(1442695040888963407);
+                ((state >> 40) as f32 / (1u64 << 24) as f32) * 2.0 - 1.0
+            })
+            .collect()
+    }
+
+    fn exact_top(metric: Metric, vectors: &[Vec<f32>], query: &[f32], k: usize) -> Vec<String> {
+        let mut query = query.to_vec();
+        metric.prepare(&mut query);
+        let mut ranked: Vec<(f32, usize)> = vectors
+            .iter()
+            .enumerate()
+            .map(|(i, v)| {
+                let mut v = v.clone();
+                metric.prepare(&mut v);
+                (metric.distance(&query, &v), i)
+            })
+            .collect();
+        ranked.sort_by(|a, b| a.0.total_cmp(&b.0));
+        ranked.iter().take(k).map(|(_, i)| i.to_string()).collect()
+    }
+
+    fn build(vectors: &[Vec<f32>], params: HnswParams, metric: Metric) -> HnswGraph {
+        let mut graph = HnswGraph::new(params).with_metric(metric);
+        for (i, v) in vectors.iter().enumerate() {
+            let filename = format!("file_{}.rs", i % 50);
+            graph
+                .insert("default", &filename, &i.to_string(), v.clone())
+                .unwrap();
+        }
+        graph
+    }
+
+    #[test]
+    fn test_recall_against_exact_search() {
+        // Scaled so vector length matters to the metrics that don't normalize
+        let vectors: Vec<Vec<f32>> = (0..2000)
+            .map(|i| {
+                let scale = 0.5 + (i % 7) as f32 / 4.0;
+                pseudo_random(i, 32).iter().map(|v| v * scale).collect()
+            })
+            .collect();
+        for metric in [Metric::Cosine, Metric::Dot, Metric::L2] {
+            let graph = build(&vectors, HnswParams::default(), metric);
+            assert_eq!(graph.len(), 2000);
+
+            let mut found = 0;
+            for q in 0..50 {
+                let query = pseudo_random(10_000 + q, 32);
+                let expected = exact_top(metric, &vectors, &query, 10);
+                let hits = graph.search(&query, 10, 64, None);
+                assert!(hits.windows(2).all(|w| w[0].distance <= w[1].distance));
+                found += hits.iter().filter(|h| expected.contains(&h.id)).count();
+            }
+            let recall = found as f64 / 500.0;
+            assert!(recall > 0.9, "{} recall@10 {}", metric, recall);
+        }
+    }
+
+    #[test]
+    fn test_remove_replace_and_workspaces() {
+        let vectors: Vec<Vec<f32>> = (0..300).map(|i| pseudo_random(i, 16)).collect();
+        let mut graph = build(&vectors, HnswParams::default(), Metric::Cosine);
+        graph
+            .insert("other", "x.rs", "0", vectors[0].clone())
+            .unwrap();
+
+        let hits = graph.search(&vectors[0], 1, 32, Some("default"));
+        assert_eq!(
+            (hits[0].workspace.as_str(), hits[0].id.as_str()),
+            ("default", "0")
+        );
+        assert!(hits[0].distance.abs() < 1e-5);
+
+        // Vector 0 lives in file_0.rs along with every 50th vector
+        assert_eq!(graph.remove_files("default", &["file_0.rs".to_string()]), 6);
+        assert_eq!(graph.len(), 295);
+        let hits = graph.search(&vectors[0], 300, 300, Some("default"));
+        assert_eq!(hits.len(), 294);
+        assert!(hits.iter().all(|h| h.id != "0" && h.id != "50"));
+        let other = graph.search(&vectors[0], 1, 32, Some("other"));
+        assert_eq!(other[0].id, "0");
+
+        // A beam narrower than a small workspace still finds all of it
+        for i in 0..20 {
+            graph
+                .insert(
+                    "small",
+                    "s.rs",
+                    &format!("s{}", i),
+                    pseudo_random(1000 + i, 16),
+                )
+                .unwrap();
+        }
+        assert_eq!(graph.search(&vectors[0], 20, 4, Some("small")).len(), 20);
+        graph.remove_files("small", &["s.rs".to_string()]);
+        assert!(graph.search(&vectors[0], 5, 4, Some("small")).is_empty());
+
+        // Re-inserting a key replaces it
+        graph
+            .insert("default", "file_1.rs", "1", vectors[2].clone())
+            .unwrap();
+        assert_eq!(graph.len(), 295);
+        let hits = graph.search(&vectors[2], 2, 32, Some("default"));
+        let ids: Vec<&str> = hits.iter().map(|h| h.id.as_str()).collect();
+        assert!(ids.contains(&"1") && ids.contains(&"2"));
+
+        graph.compact();
+        assert_eq!(graph.len(), 295);
+        assert!(graph.insert("default", "a.rs", "x", vec![1.0; 3]).is_err());
+    }
+
+    #[test]
+    fn test_equal_distances_cut_by_id() {
+        for order in [["c", "a", "d", "b"], ["d", "b", "a", "c"]] {
+            let mut graph = HnswGraph::new(HnswParams::default());
+            graph
+                .insert("default", "far.rs", "far", vec![0.0, 1.0])
+                .unwrap();
+            for id in order {
+                graph.insert("default", "x.rs", id, vec![1.0, 0.0]).unwrap();
+            }
+            let hits = graph.search(&[1.0, 0.0], 2, 32, None);
+            let ids: Vec<&str> = hits.iter().map(|n| n.id.as_str()).collect();
+            assert_eq!(ids, ["a", "b"]);
+        }
+    }
+
+    #[test]
+    fn test_reindexed_file_stays_reachable() {
+        let mut graph = HnswGraph::new(HnswParams::default());
+        graph
+            .insert("default", "a.rs", "a", vec![1.0, 0.0])
+            .unwrap();
+        graph
+            .insert("default", "b.rs", "b", vec![0.0, 1.0])
+            .unwrap();
+        // Re-indexing an unchanged file stores the same vectors under new IDs
+        for round in 0..100 {
+            graph.remove_files("default", &["live.rs".to_string()]);
+            for i in 0..3 {
+                let id = format!("{}-{}", round, i);
+                graph
+                    .insert("default", "live.rs", &id, vec![0.9, 0.1])
+                    .unwrap();
+            }
+            assert_eq!(
+                graph.search(&[1.0, 0.0], 10, 64, None).len(),
+                5,
+                "round {}",
+                round
+            );
+        }
+    }
+
+    #[test]
+    fn test_save_and_load() {
+        let dir = TempDir::new().unwrap();
+        let path = dir.path().join("code_chunks.hnsw");
+        let vectors: Vec<Vec<f32>> = (0..500).map(|i| pseudo_random(i, 24)).collect();
+        let mut graph = build(&vectors, HnswParams::default(), Metric::L2);
+        graph.remove_files("default", &["file_3.rs".to_string()]);
+        graph.save(&path).unwrap();
+
+        let loaded = HnswGraph::load(&path).unwrap();
+        assert_eq!(loaded.len(), graph.len());
+        assert_eq!(loaded.metric(), Metric::L2);
+        assert!(loaded.built_with(&HnswParams::default()));
+        assert!(!loaded.built_with(&HnswParams {
+            m: 8,
+            ..Default::default()
+        }));
+        let query = pseudo_random(99, 24);
+        assert_eq!(
+            loaded.search(&query, 10, 64, None),
+            graph.search(&query, 10, 64, None)
+        );
+
+        std::fs::write(&path, b"not a graph").unwrap();
+        assert!(HnswGraph::load(&path).is_err());
+
+        // Graphs saved before the metric was recorded are cosine
+        let mut graph = build(&vectors[..10], HnswParams::default(), Metric::Cosine);
+        graph.save(&path).unwrap();
+        let mut bytes = std::fs::read(&path).unwrap();
+        bytes.splice(..MAGIC.len() + 4 + "cosine".len(), MAGIC_V1.iter().copied());
+        std::fs::write(&path, bytes).unwrap();
+        let legacy = HnswGraph::load(&path).unwrap();
+        assert_eq!(legacy.metric(), Metric::Cosine);
+        assert_eq!(legacy.len(), 10);
+    }
+
+    fn chunk(filename: &str, line_start: usize) -> CodeChunk {
+        CodeChunk {
+            filename: filename.to_string(),
+            code: format!("fn at_{}() {{}}", line_start),
+            line_start,
+            line_end: line_start + 2,
+            language: Some("rust".to_string()),
+            ..Default::default()
+        }
+    }
+
+    #[tokio::test]
+    async fn test_store_persists_and_rebuilds_graph() {
+        let dir = TempDir::new().unwrap();
+        let db = dir.path().join("index.sqlite");
+        let graph_path = dir.path().join("code_chunks.hnsw");
+        let inner: Arc<dyn VectorStore> = Arc::new(SqliteStore::open(&db).unwrap());
+        inner.init(2).await.unwrap();
+
+        let store = HnswStore::open(inner.clone(), graph_path.clone(), HnswParams::default())
+            .await
+            .unwrap();
+        store
+            .add_code_chunks(
+                "default",
+                &[
+                    chunk("src/a.rs", 1),
+                    chunk("src/b.rs", 1),
+                    chunk("src/c.rs", 1),
+                ],
+                vec![vec![1.0, 0.0], vec![0.9, 0.1], vec![0.0, 1.0]],
+            )
+            .await
+            .unwrap();
+        assert!(!graph_path.exists());
+        store.flush().await.unwrap();
+        assert!(graph_path.exists());
+
+        let hits = store
+            .search_chunks(vec![1.0, 0.0], 2, None, Some("default"))
+            .await
+            .unwrap();
+        let files: Vec<&str> = hits.iter().map(|h| h.chunk.filename.as_str()).collect();
+        assert_eq!(files, vec!["src/a.rs", "src/b.rs"]);
+        assert_eq!(hits[0].id, chunk("src/a.rs", 1).id());
+
+        // Filtered queries go to the wrapped store
+        let filtered = store
+            .search_chunks(
+                vec![1.0, 0.0],
+                5,
+                Some("filename LIKE '%c.rs'".to_string()),
+                Some("default"),
+            )
+            .await
+            .unwrap();
+        assert_eq!(filtered.len(), 1);
+
+        store
+            .delete_file_chunks("src/a.rs", "default")
+            .await
+            .unwrap();
+        store.flush().await.unwrap();
+        drop(store);
+
+        let reopened = HnswStore::open(inner.clone(), graph_path.clone(), HnswParams::default())
+            .await
+            .unwrap();
+        let hits = reopened
+            .search_chunks(vec![1.0, 0.0], 5, None, None)
+            .await
+            .unwrap();
+        assert_eq!(hits[0].chunk.filename, "src/b.rs");
+        assert_eq!(hits.len(), 2);
+        drop(reopened);
+
+        // Writes that bypass the graph make it stale, even if they keep the
+        // number of chunks
+        inner
+            .replace_files(
+                "default",
+                &["src/c.rs".to_string()],
+                &[chunk("src/d.rs", 1)],
+                vec![vec![1.0, 0.0]],
+            )
+            .await
+            .unwrap();
+        bump_index_version(&dir.path().to_string_lossy()).unwrap();
+        let rebuilt = HnswStore::open(inner, graph_path, HnswParams::default())
+            .await
+            .unwrap();
+        let hits = rebuilt
+            .search_chunks(vec![1.0, 0.0], 1, None, None)
+            .await
+            .unwrap();
+        assert_eq!(hits[0].chunk.filename, "src/d.rs");
+    }
+
+    #[tokio::test]
+    async fn test_store_rejects_other_metric() {
+        let dir = TempDir::new().unwrap();
+        let db = dir.path().join("index.sqlite");
+        let graph_path = dir.path().join("code_chunks.hnsw");
+        let l2 = SqliteStore::open(&db).unwrap().with_metric(Metric::L2);
+        l2.init(2).await.unwrap();
+        l2.add_code_chunks(
+            "default",
+            &[chunk("src/far.rs", 1), chunk("src/near.rs", 1)],
+            vec![vec![4.0, 0.0], vec![1.5, 0.0]],
+        )
+        .await
+        .unwrap();
+
+        let store = HnswStore::open(Arc::new(l2), graph_path.clone(), HnswParams::default())
+            .await
+            .unwrap();
+        assert_eq!(store.metric(), Metric::L2);
+        let hits = store
+            .search_chunks(vec![1.0, 0.0], 2, None, None)
+            .await
+            .unwrap();
+        assert_eq!(hits[0].chunk.filename, "src/near.rs");
+        assert!((hits[0].distance.unwrap() - 0.25).abs() < 1e-6);
+        drop(store);
+
+        let cosine: Arc<dyn VectorStore> = Arc::new(SqliteStore::open(&db).unwrap());
+        let err = HnswStore::open(cosine, graph_path, HnswParams::default())
+            .await
+            .err()
+            .unwrap();
+        assert!(err.to_string().contains("l2 distance metric"), "{}", err);
+    }
+}
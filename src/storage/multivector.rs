@@ -0,0 +1,712 @@
+//! Several vectors per chunk, for queries phrased unlike the code they look for.
+//!
+//! [`MultiVectorStore`] wraps the chunk table together with one more table
+//! per [`Facet`], opened with the same backend and metric. A facet table
+//! holds a copy of each chunk that has the facet, stored with the embedding
+//! of the facet's text instead of the whole chunk's. Readers only see the
+//! chunk table; writers replace the files' rows in every table.
+//!
+//! A search asks every table for its nearest chunks and scores each chunk
+//! found by its vectors' weighted similarities, their maximum or their
+//! average (see [`FacetScoring`]). The combined score is reported back as a
+//! distance, so callers rank and filter multi-vector hits like any others.
+
+use super::{ChunkInfo, Metric, ScoredChunk, StoredVector, VectorStore};
+use crate::config::AppConfig;
+use crate::indexer::{CodeChunk, Facet};
+use anyhow::{anyhow, bail, Result};
+use async_trait::async_trait;
+use futures_util::future::try_join_all;
+use std::collections::{BTreeMap, HashMap};
+use std::sync::Arc;
+
+/// How the similarities of a chunk's vectors combine into its score.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum FacetScoring {
+    /// The highest weighted similarity: a chunk is as close as its closest
+    /// vector. Weights above 1 can't lift it past the metric's highest
+    /// similarity, 1 under cosine and L2.
+    #[default]
+    Max,
+    /// The weighted average of the similarities of the vectors the chunk has;
+    /// an average rather than a sum, so chunks with more facets don't score
+    /// higher for it
+    Weighted,
+}
+
+/// Which facets are embedded and how a search weighs them, from the
+/// `multi_vector*` config keys.
+#[derive(Debug, Clone, PartialEq)]
+pub struct MultiVectorParams {
+    pub facets: Vec<Facet>,
+    pub scoring: FacetScoring,
+    /// Weight of the vector of the whole chunk
+    pub code_weight: f32,
+    /// Weight of each facet's vector; 1.0 if missing
+    pub weights: BTreeMap<Facet, f32>,
+}
+
+impl MultiVectorParams {
+    /// Reads `multi_vector`, `multi_vector_scoring` and
+    /// `multi_vector_weights`, or returns `None` when `multi_vector` lists no
+    /// facet.
+    pub fn from_config(config: &AppConfig) -> Result<Option<Self>> {
+        let mut facets: Vec<Facet> = config
+            .multi_vector
+            .iter()
+            .map(|name| name.parse().map_err(|e: String| anyhow!(e)))
+            .collect::<Result<_>>()?;
+        facets.sort();
+        facets.dedup();
+        if facets.is_empty() {
+            return Ok(None);
+        }
+        let scoring = match config.multi_vector_scoring.as_str() {
+            "max" => FacetScoring::Max,
+            "weighted" => FacetScoring::Weighted,
+            other => bail!(
+                "Unknown multi_vector_scoring '{}'; expected max or weighted",
+                other
+            ),
+        };
+        let mut code_weight = 1.0;
+        let mut weights = BTreeMap::new();
+        for (name, &weight) in &config.multi_vector_weights {
+            if !weight.is_finite() || weight < 0.0 {
+                bail!(
+                    "multi_vector_weights.{} must be zero or positive, got {}",
+                    name,
+                    weight
+                );
+            }
+            if name == "code" {
+                code_weight = weight;
+            } else {
+                let facet: Facet = name.parse().map_err(|e: String| anyhow!(e))?;
+                weights.insert(facet, weight);
+            }
+        }
+        Ok(Some(Self {
+            facets,
+            scoring,
+            code_weight,
+            weights,
+        }))
+    }
+
+    /// Weight of the vector of `facet`, or of the whole chunk for `None`.
+    pub fn weight(&self, facet: Option<Facet>) -> f32 {
+        match facet {
+            None => self.code_weight,
+            Some(facet) => self.weights.get(&facet).copied().unwrap_or(1.0),
+        }
+    }
+
+    /// The score of a chunk whose vectors, by facet (`None` for the whole
+    /// chunk), have these similarities under `metric` to the query; `None` if
+    /// every vector it has weighs 0.
+    pub fn combine(
+        &self,
+        similarities: &BTreeMap<Option<Facet>, f32>,
+        metric: Metric,
+    ) -> Option<f32> {
+        let weighted = similarities
+            .iter()
+            .map(|(&facet, &similarity)| (self.weight(facet), similarity))
+            .filter(|(weight, _)| *weight > 0.0);
+        match self.scoring {
+            FacetScoring::Max => weighted
+                .map(|(w, s)| w * s)
+                .reduce(f32::max)
+                .map(|score| score.min(highest_similarity(metric))),
+            FacetScoring::Weighted => {
+                let (total, weights) = weighted.fold((0.0, 0.0), |(total, weights), (w, s)| {
+                    (total + w * s, weights + w)
+                });
+                (weights > 0.0).then(|| total / weights)
+            }
+        }
+    }
+}
+
+/// Similarity of a vector to itself under `metric`; dot products have no
+/// upper bound.
+fn highest_similarity(metric: Metric) -> f32 {
+    match metric {
+        Metric::Cosine | Metric::L2 => 1.0,
+        Metric::Dot => f32::INFINITY,
+    }
+}
+
+/// The vectors of one facet of a batch of chunks, in chunk order; `None` for
+/// the chunks without the facet.
+#[derive(Debug, Clone, PartialEq)]
+pub struct FacetVectors {
+    pub facet: Facet,
+    pub vectors: Vec<Option<Vec<f32>>>,
+}
+
+/// A chunk found by a multi-vector search, while its score is worked out.
+struct Candidate {
+    chunk: CodeChunk,
+    /// Vector of the whole chunk, once known
+    vector: Option<Vec<f32>>,
+    /// Vector of the facet it was found by, standing in for `vector`
+    facet_vector: Vec<f32>,
+    similarities: BTreeMap<Option<Facet>, f32>,
+}
+
+/// [`VectorStore`] keeping a vector of each [`Facet`] of a chunk besides the
+/// chunk's own, see the [module docs](self).
+pub struct MultiVectorStore {
+    inner: Arc<dyn VectorStore>,
+    facets: Vec<(Facet, Arc<dyn VectorStore>)>,
+    /// The facets of `facets`, for [`VectorStore::facets`]
+    facet_list: Vec<Facet>,
+    params: MultiVectorParams,
+}
+
+impl MultiVectorStore {
+    /// Name of the table holding the `facet` vectors of the chunks of `table_name`.
+    pub fn table(table_name: &str, facet: Facet) -> String {
+        format!("{}_{}", table_name, facet)
+    }
+
+    /// Wraps `inner`, the chunk table, with a store for each facet of `params`.
+    pub fn new(
+        inner: Arc<dyn VectorStore>,
+        facets: Vec<(Facet, Arc<dyn VectorStore>)>,
+        params: MultiVectorParams,
+    ) -> Self {
+        let facet_list = facets.iter().map(|(facet, _)| *facet).collect();
+        Self {
+            inner,
+            facets,
+            facet_list,
+            params,
+        }
+    }
+
+    /// Similarity of `query`, prepared for the metric, to a stored vector.
+    fn similarity(&self, query: &[f32], vector: &[f32]) -> f32 {
+        let metric = self.metric();
+        metric.similarity(metric.distance(query, vector))
+    }
+
+    /// Similarity of a hit to the query, from its distance if reported.
+    fn hit_similarity(&self, query: &[f32], hit: &ScoredChunk) -> f32 {
+        match hit.distance {
+            Some(distance) => self.metric().similarity(distance),
+            None => self.similarity(query, &hit.vector),
+        }
+    }
+
+    /// Records the similarities of stored vectors to the candidates without one
+    /// yet for `facet`; a candidate missing from the store lacks the facet.
+    async fn fill_similarities(
+        &self,
+        candidates: &mut HashMap<String, Candidate>,
+        facet: Option<Facet>,
+        query: &[f32],
+        workspace: &str,
+    ) -> Result<()> {
+        let missing: Vec<String> = candidates
+            .iter()
+            .filter(|(_, candidate)| !candidate.similarities.contains_key(&facet))
+            .map(|(id, _)| id.clone())
+            .collect();
+        if missing.is_empty() {
+            return Ok(());
+        }
+        let store = match facet {
+            None => &self.inner,
+            Some(facet) => match self.facets.iter().find(|(f, _)| *f == facet) {
+                Some((_, store)) => store,
+                None => return Ok(()),
+            },
+        };
+        for (id, vector) in store.get_vectors_by_ids(&missing, workspace).await? {
+            if let Some(candidate) = candidates.get_mut(&id) {
+                candidate
+                    .similarities
+                    .insert(facet, self.similarity(query, &vector));
+                if facet.is_none() {
+                    candidate.vector = Some(vector);
+                }
+            }
+        }
+        Ok(())
+    }
+}
+
+/// The facet vectors `store` holds for the chunks of `filenames` that are
+/// among `chunks`, paired with their new version.
+async fn kept_facets(
+    store: &dyn VectorStore,
+    workspace: &str,
+    filenames: &[String],
+    chunks: &[CodeChunk],
+) -> Result<(Vec<CodeChunk>, Vec<Vec<f32>>)> {
+    let by_id: HashMap<String, &CodeChunk> = chunks.iter().map(|c| (c.id(), c)).collect();
+    let mut kept = (Vec::new(), Vec::new());
+    for filename in filenames {
+        for (stored, vector) in store.get_file_chunks(filename, workspace).await? {
+            if let Some(chunk) = by_id.get(&stored.id()) {
+                kept.0.push((*chunk).clone());
+                kept.1.push(vector);
+            }
+        }
+    }
+    Ok(kept)
+}
+
+#[async_trait]
+impl VectorStore for MultiVectorStore {
+    async fn init(&self, dim: usize) -> Result<()> {
+        self.inner.init(dim).await?;
+        for (_, store) in &self.facets {
+            store.init(dim).await?;
+        }
+        Ok(())
+    }
+
+    /// Stores the chunks without facet vectors, see
+    /// [`replace_files_with_facets`](VectorStore::replace_files_with_facets).
+    async fn add_code_chunks(
+        &self,
+        workspace: &str,
+        chunks: &[CodeChunk],
+        vectors: Vec<Vec<f32>>,
+    ) -> Result<()> {
+        self.inner.add_code_chunks(workspace, chunks, vectors).await
+    }
+
+    async fn search_chunks(
+        &self,
+        query_vector: Vec<f32>,
+        limit: usize,
+        filter: Option<String>,
+        workspace: Option<&str>,
+    ) -> Result<Vec<ScoredChunk>> {
+        let mut query = query_vector.clone();
+        self.metric().prepare(&mut query);
+
+        let code_hits = self
+            .inner
+            .search_chunks(query_vector.clone(), limit, filter.clone(), workspace)
+            .await?;
+        // Indexes written before `multi_vector` was set have no facet tables
+        let mut searched = Vec::new();
+        for (facet, store) in &self.facets {
+            if store.stored_metric().await?.is_some() {
+                searched.push((*facet, store));
+            }
+        }
+        let facet_hits = try_join_all(searched.iter().map(|(_, store)| {
+            store.search_chunks(query_vector.clone(), limit, filter.clone(), workspace)
+        }))
+        .await?;
+
+        let mut candidates: HashMap<String, Candidate> = HashMap::new();
+        for hit in code_hits {
+            let similarity = self.hit_similarity(&query, &hit);
+            candidates.insert(
+                hit.id,
+                Candidate {
+                    chunk: hit.chunk,
+                    vector: Some(hit.vector),
+                    facet_vector: Vec::new(),
+                    similarities: BTreeMap::from([(None, similarity)]),
+                },
+            );
+        }
+        for ((facet, _), hits) in searched.iter().zip(facet_hits) {
+            for hit in hits {
+                let similarity = self.hit_similarity(&query, &hit);
+                candidates
+                    .entry(hit.id)
+                    .or_insert_with(|| Candidate {
+                        chunk: hit.chunk,
+                        vector: None,
+                        facet_vector: hit.vector,
+                        similarities: BTreeMap::new(),
+                    })
+                    .similarities
+                    .insert(Some(*facet), similarity);
+            }
+        }
+
+        // Chunks found by a facet need their own vector; a weighted average
+        // also needs the facets that weren't among the nearest
+        if let Some(workspace) = workspace {
+            self.fill_similarities(&mut candidates, None, &query, workspace)
+                .await?;
+            if self.params.scoring == FacetScoring::Weighted {
+                for (facet, _) in &searched {
+                    self.fill_similarities(&mut candidates, Some(*facet), &query, workspace)
+                        .await?;
+                }
+            }
+        }
+
+        let metric = self.metric();
+        let mut hits: Vec<ScoredChunk> = candidates
+            .into_iter()
+            .filter_map(|(id, candidate)| {
+                let score = self.params.combine(&candidate.similarities, metric)?;
+                Some(ScoredChunk {
+                    id,
+                    chunk: candidate.chunk,
+                    distance: Some(metric.distance_for(score)),
+                    vector: candidate.vector.unwrap_or(candidate.facet_vector),
+                })
+            })
+            .collect();
+        hits.sort_by(|a, b| {
+            a.distance
+                .unwrap_or(f32::INFINITY)
+                .total_cmp(&b.distance.unwrap_or(f32::INFINITY))
+                .then_with(|| a.id.cmp(&b.id))
+        });
+        hits.truncate(limit);
+        Ok(hits)
+    }
+
+    fn metric(&self) -> Metric {
+        self.inner.metric()
+    }
+
+    async fn stored_metric(&self) -> Result<Option<Metric>> {
+        self.inner.stored_metric().await
+    }
+
+    async fn missing_columns(&self) -> Result<Vec<String>> {
+        self.inner.missing_columns().await
+    }
+
+    fn facets(&self) -> &[Facet] {
+        &self.facet_list
+    }
+
+    async fn get_indexed_metadata(&self, workspace: &str) -> Result<HashMap<String, i64>> {
+        self.inner.get_indexed_metadata(workspace).await
+    }
+
+    async fn list_chunk_info(&self, workspace: &str) -> Result<Vec<ChunkInfo>> {
+        self.inner.list_chunk_info(workspace).await
+    }
+
+    async fn count_chunks(&self) -> Result<usize> {
+        self.inner.count_chunks().await
+    }
+
+    async fn list_vectors(&self) -> Result<Vec<StoredVector>> {
+        self.inner.list_vectors().await
+    }
+
+    async fn get_file_chunks(
+        &self,
+        filename: &str,
+        workspace: &str,
+    ) -> Result<Vec<(CodeChunk, Vec<f32>)>> {
+        self.inner.get_file_chunks(filename, workspace).await
+    }
+
+    async fn get_chunks_by_ids(
+        &self,
+        ids: &[String],
+        workspace: Option<&str>,
+    ) -> Result<Vec<CodeChunk>> {
+        self.inner.get_chunks_by_ids(ids, workspace).await
+    }
+
+    async fn get_vectors_by_ids(
+        &self,
+        ids: &[String],
+        workspace: &str,
+    ) -> Result<Vec<(String, Vec<f32>)>> {
+        self.inner.get_vectors_by_ids(ids, workspace).await
+    }
+
+    async fn rename_file(
+        &self,
+        old_filename: &str,
+        new_filename: &str,
+        workspace: &str,
+        mtime: i64,
+    ) -> Result<Vec<CodeChunk>> {
+        let moved = self
+            .inner
+            .rename_file(old_filename, new_filename, workspace, mtime)
+            .await?;
+        for (_, store) in &self.facets {
+            store
+                .rename_file(old_filename, new_filename, workspace, mtime)
+                .await?;
+        }
+        Ok(moved)
+    }
+
+    async fn delete_file_chunks(&self, filename: &str, workspace: &str) -> Result<()> {
+        self.batch_delete_files(&[filename.to_string()], workspace)
+            .await
+    }
+
+    async fn batch_delete_files(&self, filenames: &[String], workspace: &str) -> Result<()> {
+        self.inner.batch_delete_files(filenames, workspace).await?;
+        for (_, store) in &self.facets {
+            store.batch_delete_files(filenames, workspace).await?;
+        }
+        Ok(())
+    }
+
+    /// Replaces the files' chunks, keeping the facet vectors of the chunks
+    /// that were already stored, as when only their metadata changes.
+    async fn replace_files(
+        &self,
+        workspace: &str,
+        filenames: &[String],
+        chunks: &[CodeChunk],
+        vectors: Vec<Vec<f32>>,
+    ) -> Result<()> {
+        self.replace_files_with_facets(workspace, filenames, chunks, vectors, Vec::new())
+            .await
+    }
+
+    async fn replace_files_with_facets(
+        &self,
+        workspace: &str,
+        filenames: &[String],
+        chunks: &[CodeChunk],
+        vectors: Vec<Vec<f32>>,
+        facet_vectors: Vec<FacetVectors>,
+    ) -> Result<()> {
+        self.inner
+            .replace_files(workspace, filenames, chunks, vectors)
+            .await?;
+        let mut by_facet: HashMap<Facet, Vec<Option<Vec<f32>>>> = facet_vectors
+            .into_iter()
+            .map(|f| (f.facet, f.vectors))
+            .collect();
+        for (facet, store) in &self.facets {
+            let (facet_chunks, facet_vectors): (Vec<CodeChunk>, Vec<Vec<f32>>) =
+                match by_facet.remove(facet) {
+                    Some(vectors) => vectors
+                        .into_iter()
+                        .zip(chunks)
+                        .filter_map(|(vector, chunk)| Some((chunk.clone(), vector?)))
+                        .unzip(),
+                    None => kept_facets(store.as_ref(), workspace, filenames, chunks).await?,
+                };
+            if !facet_chunks.is_empty() && store.stored_metric().await?.is_none() {
+                store.init(facet_vectors[0].len()).await?;
+            }
+            store
+                .replace_files(workspace, filenames, &facet_chunks, facet_vectors)
+                .await?;
+        }
+        Ok(())
+    }
+
+    async fn create_filename_index(&self) -> Result<()> {
+        self.inner.create_filename_index().await?;
+        for (_, store) in &self.facets {
+            store.create_filename_index().await?;
+        }
+        Ok(())
+    }
+
+    async fn flush(&self) -> Result<()> {
+        self.inner.flush().await?;
+        for (_, store) in &self.facets {
+            store.flush().await?;
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::storage::SqliteStore;
+    use tempfile::TempDir;
+
+    fn chunk(filename: &str, symbol: &str) -> CodeChunk {
+        CodeChunk {
+            filename: filename.to_string(),
+            code: format!("// Docs of {}\nfn {}() {{}}", symbol, symbol),
+            line_start: 1,
+            line_end: 2,
+            symbol: Some(symbol.to_string()),
+            language: Some("rust".to_string()),
+            ..Default::default()
+        }
+    }
+
+    fn params(scoring: FacetScoring) -> MultiVectorParams {
+        MultiVectorParams {
+            facets: vec![Facet::Doc],
+            scoring,
+            code_weight: 1.0,
+            weights: BTreeMap::new(),
+        }
+    }
+
+    fn store(dir: &TempDir, scoring: FacetScoring) -> MultiVectorStore {
+        let open = |table: &str| -> Arc<dyn VectorStore> {
+            Arc::new(
+                SqliteStore::open(&SqliteStore::path(dir.path().to_str().unwrap(), table)).unwrap(),
+            )
+        };
+        MultiVectorStore::new(
+            open("code_chunks"),
+            vec![(
+                Facet::Doc,
+                open(&MultiVectorStore::table("code_chunks", Facet::Doc)),
+            )],
+            params(scoring),
+        )
+    }
+
+    /// Distance of the nearest hit to `query`.
+    async fn nearest(store: &MultiVectorStore, query: Vec<f32>) -> f32 {
+        let hits = store
+            .search_chunks(query, 1, None, Some("default"))
+            .await
+            .unwrap();
+        hits[0].distance.unwrap()
+    }
+
+    #[test]
+    fn test_combine() {
+        let similarities = BTreeMap::from([(None, 0.2), (Some(Facet::Doc), 0.8)]);
+        let cosine = Metric::Cosine;
+        assert_eq!(
+            params(FacetScoring::Max).combine(&similarities, cosine),
+            Some(0.8)
+        );
+        assert!(
+            (params(FacetScoring::Weighted)
+                .combine(&similarities, cosine)
+                .unwrap()
+                - 0.5)
+                .abs()
+                < 1e-6
+        );
+
+        let mut weighted = params(FacetScoring::Weighted);
+        weighted.weights.insert(Facet::Doc, 3.0);
+        assert!((weighted.combine(&similarities, cosine).unwrap() - 0.65).abs() < 1e-6);
+        weighted.code_weight = 0.0;
+        weighted.weights.insert(Facet::Doc, 0.0);
+        assert_eq!(weighted.combine(&similarities, cosine), None);
+    }
+
+    #[test]
+    fn test_combine_max_stays_in_range() {
+        let mut max = params(FacetScoring::Max);
+        max.weights.insert(Facet::Doc, 3.0);
+        let similarities = BTreeMap::from([(None, 0.2), (Some(Facet::Doc), 0.8)]);
+        assert_eq!(max.combine(&similarities, Metric::Cosine), Some(1.0));
+        assert_eq!(max.combine(&similarities, Metric::L2), Some(1.0));
+        assert!((max.combine(&similarities, Metric::Dot).unwrap() - 2.4).abs() < 1e-6);
+    }
+
+    #[tokio::test]
+    async fn test_search_scores_facets() {
+        let dir = TempDir::new().unwrap();
+        let store = store(&dir, FacetScoring::Max);
+        store.init(2).await.unwrap();
+        assert_eq!(store.facets(), &[Facet::Doc]);
+
+        let chunks = vec![chunk("src/a.rs", "a"), chunk("src/b.rs", "b")];
+        store
+            .replace_files_with_facets(
+                "default",
+                &[],
+                &chunks,
+                vec![vec![1.0, 0.0], vec![0.8, 0.6]],
+                vec![FacetVectors {
+                    facet: Facet::Doc,
+                    vectors: vec![None, Some(vec![0.0, 1.0])],
+                }],
+            )
+            .await
+            .unwrap();
+        assert_eq!(store.count_chunks().await.unwrap(), 2);
+
+        // b's doc comment is the closest vector to a doc-like query
+        let hits = store
+            .search_chunks(vec![0.0, 1.0], 2, None, Some("default"))
+            .await
+            .unwrap();
+        assert_eq!(hits[0].chunk.filename, "src/b.rs");
+        assert!(hits[0].distance.unwrap().abs() < 1e-6);
+        // with its own vector, not the doc's
+        assert!((hits[0].vector[0] - 0.8).abs() < 1e-6);
+        assert!((hits[1].distance.unwrap() - 1.0).abs() < 1e-6);
+
+        // Rewriting a file keeps the facets of the chunks it still has
+        let b = vec!["src/b.rs".to_string()];
+        store
+            .replace_files("default", &b, &chunks[1..], vec![vec![0.8, 0.6]])
+            .await
+            .unwrap();
+        assert!(nearest(&store, vec![0.0, 1.0]).await.abs() < 1e-6);
+
+        let changed = CodeChunk {
+            code: "fn b() { changed() }".to_string(),
+            ..chunks[1].clone()
+        };
+        store
+            .replace_files("default", &b, &[changed], vec![vec![0.8, 0.6]])
+            .await
+            .unwrap();
+        assert!((nearest(&store, vec![0.0, 1.0]).await - 0.4).abs() < 1e-6);
+    }
+
+    #[tokio::test]
+    async fn test_weighted_search_averages_vectors() {
+        let dir = TempDir::new().unwrap();
+        let store = store(&dir, FacetScoring::Weighted);
+        store.init(2).await.unwrap();
+        let chunks = vec![chunk("src/a.rs", "a"), chunk("src/b.rs", "b")];
+        store
+            .replace_files_with_facets(
+                "default",
+                &[],
+                &chunks,
+                vec![vec![1.0, 0.0], vec![0.0, 1.0]],
+                vec![FacetVectors {
+                    facet: Facet::Doc,
+                    vectors: vec![Some(vec![0.0, 1.0]), Some(vec![0.6, 0.8])],
+                }],
+            )
+            .await
+            .unwrap();
+
+        // Each table's nearest is another chunk, a by its code and b by its
+        // doc; the vectors not found are looked up for the average
+        let hits = store
+            .search_chunks(vec![1.0, 0.0], 1, None, Some("default"))
+            .await
+            .unwrap();
+        assert_eq!(hits[0].chunk.filename, "src/a.rs");
+        assert!((hits[0].distance.unwrap() - 0.5).abs() < 1e-6);
+        let hits = store
+            .search_chunks(vec![1.0, 0.0], 2, None, Some("default"))
+            .await
+            .unwrap();
+        assert!((hits[1].distance.unwrap() - 0.7).abs() < 1e-6);
+
+        store
+            .delete_file_chunks("src/a.rs", "default")
+            .await
+            .unwrap();
+        let hits = store
+            .search_chunks(vec![1.0, 0.0], 5, None, Some("default"))
+            .await
+            .unwrap();
+        assert_eq!(hits.len(), 1);
+    }
+}
@@ -0,0 +1,390 @@
+//! Vector similarity kernels for stores that rank candidates themselves.
+//!
+//! [`SqliteStore`](super::SqliteStore) keeps vectors at unit length, so the
+//! cosine similarity of a query and a stored vector is a single [`dot`]
+//! product. `dot` accumulates in [`LANES`] independent sums, which lets the
+//! compiler keep them in one SIMD register (SSE/AVX on x86-64, NEON on arm64)
+//! without target-specific code. [`dot_scalar`] is the plain loop it must
+//! agree with and the reference in tests and benchmarks.
+//!
+//! [`Metric`] is the distance a store ranks by, chosen with the
+//! `distance_metric` config key when the store is created.
+
+use serde::{Deserialize, Serialize};
+use std::fmt;
+use std::str::FromStr;
+
+/// Independent partial sums in [`dot`]; eight `f32` fill a 256-bit register.
+pub const LANES: usize = 8;
+
+/// Dot product of `a` and `b`, vectorized. Extra elements of the longer slice are ignored.
+pub fn dot(a: &[f32], b: &[f32]) -> f32 {
+    let len = a.len().min(b.len());
+    let (a, b) = (&a[..len], &b[..len]);
+
+    let mut sums = [0.0f32; LANES];
+    let mut a_chunks = a.chunks_exact(LANES);
+    let mut b_chunks = b.chunks_exact(LANES);
+    for (x, y) in (&mut a_chunks).zip(&mut b_chunks) {
+        for ((sum, x), y) in sums.iter_mut().zip(x).zip(y) {
+            *sum += x * y;
+        }
+    }
+
+    let mut total = dot_scalar(a_chunks.remainder(), b_chunks.remainder());
+    for sum in sums {
+        total += sum;
+    }
+    total
+}
+
+/// Dot product of `a` and `b` summed in order, one element at a time.
+pub fn dot_scalar(a: &[f32], b: &[f32]) -> f32 {
+    a.iter().zip(b).map(|(x, y)| x * y).sum()
+}
+
+/// Scales `vector` to unit length in place; zero vectors are left as they are.
+pub fn normalize(vector: &mut [f32]) {
+    let norm = dot(vector, vector).sqrt();
+    if norm > 0.0 {
+        for v in vector.iter_mut() {
+            *v /= norm;
+        }
+    }
+}
+
+/// Cosine distance (`1 - cos(a, b)`) of two unit-length vectors.
+///
+/// A zero vector is at distance 1 from everything, as in [`cosine_distance`].
+pub fn unit_cosine_distance(a: &[f32], b: &[f32]) -> f32 {
+    1.0 - dot(a, b)
+}
+
+/// Cosine distance as reported by LanceDB: `1 - cos(a, b)`, or 1 for zero vectors.
+///
+/// Computes both norms on every call; prefer normalizing once and
+/// [`unit_cosine_distance`] when comparing many vectors.
+pub fn cosine_distance(a: &[f32], b: &[f32]) -> f32 {
+    let (mut dot, mut norm_a, mut norm_b) = (0.0f32, 0.0f32, 0.0f32);
+    for (x, y) in a.iter().zip(b) {
+        dot += x * y;
+        norm_a += x * x;
+        norm_b += y * y;
+    }
+    if norm_a == 0.0 || norm_b == 0.0 {
+        return 1.0;
+    }
+    1.0 - dot / (norm_a.sqrt() * norm_b.sqrt())
+}
+
+/// Squared Euclidean distance of `a` and `b`, vectorized like [`dot`].
+pub fn l2_squared(a: &[f32], b: &[f32]) -> f32 {
+    let len = a.len().min(b.len());
+    let (a, b) = (&a[..len], &b[..len]);
+
+    let mut sums = [0.0f32; LANES];
+    let mut a_chunks = a.chunks_exact(LANES);
+    let mut b_chunks = b.chunks_exact(LANES);
+    for (x, y) in (&mut a_chunks).zip(&mut b_chunks) {
+        for ((sum, x), y) in sums.iter_mut().zip(x).zip(y) {
+            let d = x - y;
+            *sum += d * d;
+        }
+    }
+
+    let mut total: f32 = a_chunks
+        .remainder()
+        .iter()
+        .zip(b_chunks.remainder())
+        .map(|(x, y)| (x - y) * (x - y))
+        .sum();
+    for sum in sums {
+        total += sum;
+    }
+    total
+}
+
+/// How a store measures the distance between a query and a stored vector.
+///
+/// Distances are as LanceDB reports them, lower being closer for every
+/// metric. [`similarity`](Self::similarity) turns one into the score that
+/// `min_score` and hybrid fusion compare, higher being closer.
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Metric {
+    /// `1 - cos(a, b)`; vectors are stored at unit length
+    #[default]
+    Cosine,
+    /// `1 - a·b`, for models trained for inner-product search; vectors are
+    /// stored as the embedder produced them
+    Dot,
+    /// Squared Euclidean distance `|a - b|²`, also on vectors as produced
+    L2,
+}
+
+impl Metric {
+    pub fn as_str(self) -> &'static str {
+        match self {
+            Metric::Cosine => "cosine",
+            Metric::Dot => "dot",
+            Metric::L2 => "l2",
+        }
+    }
+
+    /// Whether vectors are scaled to unit length before they are stored or
+    /// compared; only cosine ignores their length.
+    pub fn normalizes(self) -> bool {
+        self == Metric::Cosine
+    }
+
+    /// Brings a vector to the form it is stored and compared in.
+    pub fn prepare(self, vector: &mut [f32]) {
+        if self.normalizes() {
+            normalize(vector);
+        }
+    }
+
+    /// Distance of `query` to `stored`, both [prepared](Self::prepare).
+    pub fn distance(self, query: &[f32], stored: &[f32]) -> f32 {
+        match self {
+            Metric::Cosine | Metric::Dot => unit_cosine_distance(query, stored),
+            Metric::L2 => l2_squared(query, stored),
+        }
+    }
+
+    /// Score of a [`distance`](Self::distance), higher being closer.
+    ///
+    /// Cosine scores are the cosine similarity, from -1 to 1, and dot
+    /// scores the dot product itself. An L2 distance `d²` scores
+    /// `1 / (1 + d)`, from 1 for the same vector towards 0, so `min_score`
+    /// keeps meaning "at least this similar" whatever the metric.
+    pub fn similarity(self, distance: f32) -> f32 {
+        match self {
+            Metric::Cosine | Metric::Dot => 1.0 - distance,
+            Metric::L2 => 1.0 / (1.0 + distance.max(0.0).sqrt()),
+        }
+    }
+
+    /// The distance whose [`similarity`](Self::similarity) is `similarity`,
+    /// for scores combined from several distances. L2 similarities above 1
+    /// map to distance 0 and those at or below 0 to infinity.
+    pub fn distance_for(self, similarity: f32) -> f32 {
+        match self {
+            Metric::Cosine | Metric::Dot => 1.0 - similarity,
+            Metric::L2 if similarity <= 0.0 => f32::INFINITY,
+            Metric::L2 => (1.0 / similarity - 1.0).max(0.0).powi(2),
+        }
+    }
+}
+
+impl fmt::Display for Metric {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.write_str(self.as_str())
+    }
+}
+
+impl FromStr for Metric {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s.trim().to_ascii_lowercase().as_str() {
+            "cosine" | "" => Ok(Metric::Cosine),
+            "dot" => Ok(Metric::Dot),
+            "l2" | "euclidean" => Ok(Metric::L2),
+            other => Err(format!(
+                "Unknown distance metric '{}'. Expected one of: cosine, dot, l2",
+                other
+            )),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Deterministic values in `[-1, 1)`.
+    fn pseudo_random(seed: u64, len: usize) -> Vec<f32> {
+        let mut state = seed.wrapping_mul(6364136223846793005).wrapping_add(1);
+        (0..len)
+            .map(|_| {
+                state = state
+                    .wrapping_mul(6364136223846793005)
+                    .wrapping_add(1442695040888963407);
+                ((state >> 40) as f32 / (1u64 << 24) as f32) * 2.0 - 1.0
+            })
+            .collect()
+    }
+
+    #[test]
+    fn test_dot_matches_scalar() {
+        for len in [0, 1, 7, 8, 9, 31, 384, 768, 1000] {
+            let a = pseudo_random(len as u64, len);
+            let b = pseudo_random(len as u64 + 1000, len);
+            let (fast, scalar) = (dot(&a, &b), dot_scalar(&a, &b));
+            assert!(
+                (fast - scalar).abs() <= 1e-4 * (1.0 + scalar.abs()),
+                "len {}: {} vs {}",
+                len,
+                fast,
+                scalar
+            );
+        }
+        assert_eq!(dot(&[1.0, 2.0, 3.0], &[4.0, 5.0]), 14.0);
+    }
+
+    #[test]
+    fn test_unit_distance_matches_cosine_distance() {
+        for seed in 0..20 {
+            let a = pseudo_random(seed, 384);
+            let b = pseudo_random(seed + 100, 384);
+            let expected = cosine_distance(&a, &b);
+
+            let (mut unit_a, mut unit_b) = (a.clone(), b.clone());
+            normalize(&mut unit_a);
+            normalize(&mut unit_b);
+            assert!((unit_cosine_distance(&unit_a, &unit_b) - expected).abs() < 1e-5);
+            assert!((dot(&unit_a, &unit_a) - 1.0).abs() < 1e-5);
+        }
+    }
+
+    #[test]
+    fn test_normalizing_preserves_cosine_ranking() {
+        let query = pseudo_random(7, 384);
+        // Candidates of very different lengths, as unnormalized embedders produce
+        let candidates: Vec<Vec<f32>> = (0..50)
+            .map(|seed| {
+                let scale = 0.01 + seed as f32 * 3.7;
+                pseudo_random(seed + 200, 384)
+                    .into_iter()
+                    .map(|v| v * scale)
+                    .collect()
+            })
+            .collect();
+        let by_cosine = |a: &usize, b: &usize| {
+            cosine_distance(&query, &candidates[*a])
+                .total_cmp(&cosine_distance(&query, &candidates[*b]))
+        };
+        let mut expected: Vec<usize> = (0..candidates.len()).collect();
+        expected.sort_by(by_cosine);
+
+        let mut unit_query = query.clone();
+        normalize(&mut unit_query);
+        let unit: Vec<Vec<f32>> = candidates
+            .iter()
+            .map(|c| {
+                let mut c = c.clone();
+                normalize(&mut c);
+                c
+            })
+            .collect();
+        let mut ranked: Vec<usize> = (0..unit.len()).collect();
+        ranked.sort_by(|a, b| dot(&unit_query, &unit[*b]).total_cmp(&dot(&unit_query, &unit[*a])));
+        assert_eq!(ranked, expected);
+    }
+
+    #[test]
+    fn test_zero_vectors() {
+        let mut zero = vec![0.0f32; 16];
+        normalize(&mut zero);
+        assert!(zero.iter().all(|v| *v == 0.0));
+
+        let mut other = pseudo_random(1, 16);
+        normalize(&mut other);
+        assert_eq!(unit_cosine_distance(&zero, &other), 1.0);
+        assert_eq!(cosine_distance(&zero, &other), 1.0);
+    }
+
+    #[test]
+    fn test_l2_matches_scalar() {
+        for len in [0, 1, 9, 384] {
+            let a = pseudo_random(len as u64, len);
+            let b = pseudo_random(len as u64 + 1000, len);
+            let scalar: f32 = a.iter().zip(&b).map(|(x, y)| (x - y) * (x - y)).sum();
+            let fast = l2_squared(&a, &b);
+            assert!(
+                (fast - scalar).abs() <= 1e-4 * (1.0 + scalar),
+                "len {}",
+                len
+            );
+        }
+    }
+
+    /// Ranks `stored` by `metric` the way the stores do.
+    fn rank(metric: Metric, query: &[f32], stored: &[Vec<f32>]) -> Vec<usize> {
+        let mut query = query.to_vec();
+        metric.prepare(&mut query);
+        let prepared: Vec<Vec<f32>> = stored
+            .iter()
+            .map(|v| {
+                let mut v = v.clone();
+                metric.prepare(&mut v);
+                v
+            })
+            .collect();
+        let mut ranked: Vec<usize> = (0..stored.len()).collect();
+        ranked.sort_by(|a, b| {
+            metric
+                .distance(&query, &prepared[*a])
+                .total_cmp(&metric.distance(&query, &prepared[*b]))
+        });
+        ranked
+    }
+
+    #[test]
+    fn test_metrics_rank_known_vectors() {
+        let query = [1.0, 0.0];
+        let stored = vec![
+            // Same direction, but long
+            vec![10.0, 0.0],
+            // Close to the query, slightly off its direction
+            vec![0.9, 0.1],
+            // Perpendicular
+            vec![0.0, 1.0],
+            // Half as long, same direction
+            vec![0.5, 0.0],
+        ];
+        // Direction only: both aligned vectors tie, ahead of the rest
+        let cosine = rank(Metric::Cosine, &query, &stored);
+        assert_eq!(&cosine[2..], &[1, 2]);
+        // Length counts: the long vector has the largest product
+        assert_eq!(rank(Metric::Dot, &query, &stored), vec![0, 1, 3, 2]);
+        // Lower is closer: the long vector is the farthest point
+        assert_eq!(rank(Metric::L2, &query, &stored), vec![1, 3, 2, 0]);
+    }
+
+    #[test]
+    fn test_similarity_is_higher_when_closer() {
+        for metric in [Metric::Cosine, Metric::Dot, Metric::L2] {
+            assert!(
+                metric.similarity(0.1) > metric.similarity(0.5),
+                "{}",
+                metric
+            );
+        }
+        assert_eq!(Metric::Cosine.similarity(0.25), 0.75);
+        assert_eq!(Metric::L2.similarity(0.0), 1.0);
+        assert_eq!(Metric::L2.similarity(4.0), 1.0 / 3.0);
+    }
+
+    #[test]
+    fn test_distance_for_inverts_similarity() {
+        for metric in [Metric::Cosine, Metric::Dot, Metric::L2] {
+            for distance in [0.0, 0.25, 0.5, 4.0] {
+                let back = metric.distance_for(metric.similarity(distance));
+                assert!((back - distance).abs() < 1e-4, "{}: {}", metric, distance);
+            }
+        }
+        assert_eq!(Metric::L2.distance_for(1.5), 0.0);
+        assert_eq!(Metric::L2.distance_for(0.0), f32::INFINITY);
+    }
+
+    #[test]
+    fn test_parse_metric() {
+        assert_eq!("cosine".parse(), Ok(Metric::Cosine));
+        assert_eq!("Dot".parse(), Ok(Metric::Dot));
+        assert_eq!("euclidean".parse(), Ok(Metric::L2));
+        assert_eq!("l2".parse::<Metric>().unwrap().to_string(), "l2");
+        assert!("manhattan".parse::<Metric>().is_err());
+    }
+}
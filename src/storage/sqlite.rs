@@ -0,0 +1,1087 @@
+use super::similarity::normalize;
+use super::{check_dim, check_metric, ChunkInfo, Metric, ScoredChunk, StoredVector, VectorStore};
+use crate::indexer::{ChunkPart, CodeChunk};
+use anyhow::{Context, Result};
+use async_trait::async_trait;
+use rusqlite::{params, params_from_iter, Connection, OptionalExtension, Row, Transaction};
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex, OnceLock};
+
+/// Schema migrations; `MIGRATIONS[i]` upgrades a database from version `i` to `i + 1`.
+///
+/// The applied version is kept in `PRAGMA user_version`. Never edit a released
+/// entry, append a new one instead.
+const MIGRATIONS: &[&str] = &[
+    r#"
+    CREATE TABLE meta (
+        key TEXT PRIMARY KEY,
+        value TEXT NOT NULL
+    );
+    CREATE TABLE chunks (
+        id TEXT NOT NULL,
+        workspace TEXT NOT NULL,
+        filename TEXT NOT NULL,
+        code TEXT NOT NULL,
+        line_start INTEGER NOT NULL,
+        line_end INTEGER NOT NULL,
+        last_modified INTEGER NOT NULL,
+        calls TEXT NOT NULL DEFAULT '[]',
+        symbol TEXT,
+        language TEXT,
+        vector BLOB NOT NULL,
+        PRIMARY KEY (workspace, id)
+    );
+    CREATE INDEX chunks_workspace_filename ON chunks (workspace, filename);
+"#,
+    "ALTER TABLE chunks ADD COLUMN redacted INTEGER NOT NULL DEFAULT 0;",
+    "ALTER TABLE chunks ADD COLUMN occurrence INTEGER NOT NULL DEFAULT 0;",
+    "ALTER TABLE chunks ADD COLUMN overlap_lines INTEGER NOT NULL DEFAULT 0;",
+    "ALTER TABLE chunks ADD COLUMN summary TEXT;",
+    "ALTER TABLE chunks ADD COLUMN doc TEXT;",
+    "ALTER TABLE chunks ADD COLUMN package TEXT; \
+    ALTER TABLE chunks ADD COLUMN imports TEXT NOT NULL DEFAULT '[]';",
+    "ALTER TABLE chunks ADD COLUMN part INTEGER; \
+    ALTER TABLE chunks ADD COLUMN part_count INTEGER;",
+    "ALTER TABLE chunks ADD COLUMN changed_at INTEGER;",
+    "ALTER TABLE chunks ADD COLUMN is_test INTEGER;",
+    "ALTER TABLE chunks ADD COLUMN collection TEXT;",
+    "ALTER TABLE chunks ADD COLUMN duplicates TEXT NOT NULL DEFAULT '[]';",
+    "ALTER TABLE chunks ADD COLUMN tags TEXT NOT NULL DEFAULT '[]';",
+];
+
+/// Schema version written by this build.
+pub const SQLITE_SCHEMA_VERSION: u32 = MIGRATIONS.len() as u32;
+
+const DIM_KEY: &str = "embedding_dim";
+/// Present once vectors written by versions that didn't normalize them have
+/// been rescaled to unit length.
+const NORMALIZED_KEY: &str = "vectors_normalized";
+/// [`Metric`] the database was initialized for, written along with
+/// [`DIM_KEY`]; databases initialized without it are cosine.
+const METRIC_KEY: &str = "distance_metric";
+
+const CHUNK_COLUMNS: &str = "id, filename, code, line_start, line_end, last_modified, calls, \
+    symbol, language, vector, redacted, occurrence, overlap_lines, summary, doc, package, imports, \
+    part, part_count, changed_at, is_test, collection, duplicates, tags";
+
+/// Vector store keeping chunks and embeddings in a single SQLite file.
+///
+/// Meant for small and medium repositories, or wherever a single portable file
+/// is preferable to a LanceDB directory. Nearest-neighbor queries scan the
+/// candidate rows and rank them by the exact distance of its [`Metric`].
+/// Under cosine, vectors are normalized when they are written, so each
+/// comparison is a single vectorized dot product (see
+/// [`similarity`](super::similarity)) and the vectors of returned chunks have
+/// unit length.
+#[derive(Clone)]
+pub struct SqliteStore {
+    conn: Arc<Mutex<Connection>>,
+    metric: Metric,
+    /// Metric the database was initialized for, once known
+    recorded_metric: Arc<OnceLock<Metric>>,
+}
+
+impl SqliteStore {
+    /// Returns the database file used for `table_name` in `db_path`.
+    pub fn path(db_path: &str, table_name: &str) -> PathBuf {
+        Path::new(db_path).join(format!("{}.sqlite", table_name))
+    }
+
+    /// Opens (or creates) the database at `path` and applies pending migrations.
+    pub fn open(path: &Path) -> Result<Self> {
+        let conn = Connection::open(path)
+            .with_context(|| format!("Failed to open SQLite database {}", path.display()))?;
+        Self::from_connection(conn)
+            .with_context(|| format!("Failed to migrate SQLite database {}", path.display()))
+    }
+
+    /// Opens a throwaway in-memory database.
+    pub fn open_in_memory() -> Result<Self> {
+        Self::from_connection(Connection::open_in_memory()?)
+    }
+
+    fn from_connection(mut conn: Connection) -> Result<Self> {
+        migrate(&mut conn)?;
+        normalize_stored_vectors(&mut conn)?;
+        let recorded_metric = OnceLock::new();
+        if let Some(metric) = stored_metric(&conn)? {
+            let _ = recorded_metric.set(metric);
+        }
+        Ok(Self {
+            conn: Arc::new(Mutex::new(conn)),
+            metric: Metric::default(),
+            recorded_metric: Arc::new(recorded_metric),
+        })
+    }
+
+    /// Ranks by `metric`, which [`init`](VectorStore::init) records and later
+    /// opens must match.
+    pub fn with_metric(mut self, metric: Metric) -> Self {
+        self.metric = metric;
+        self
+    }
+
+    /// Runs `f` with the connection on the blocking thread pool.
+    async fn with_conn<T, F>(&self, f: F) -> Result<T>
+    where
+        T: Send + 'static,
+        F: FnOnce(&mut Connection) -> Result<T> + Send + 'static,
+    {
+        let conn = self.conn.clone();
+        tokio::task::spawn_blocking(move || {
+            let mut conn = conn
+                .lock()
+                .map_err(|_| anyhow::anyhow!("SQLite connection lock poisoned"))?;
+            f(&mut conn)
+        })
+        .await?
+    }
+}
+
+/// Brings `conn` up to [`SQLITE_SCHEMA_VERSION`], one transaction per step.
+fn migrate(conn: &mut Connection) -> Result<()> {
+    let version: u32 = conn.pragma_query_value(None, "user_version", |row| row.get(0))?;
+    if version > SQLITE_SCHEMA_VERSION {
+        anyhow::bail!(
+            "Database has schema version {} but this build only understands version {}. \
+            Upgrade code-rag or re-index with --force.",
+            version,
+            SQLITE_SCHEMA_VERSION
+        );
+    }
+    for (i, migration) in MIGRATIONS.iter().enumerate().skip(version as usize) {
+        let tx = conn.transaction()?;
+        tx.execute_batch(migration)?;
+        tx.pragma_update(None, "user_version", (i + 1) as u32)?;
+        tx.commit()?;
+    }
+    Ok(())
+}
+
+fn encode_vector(vector: &[f32]) -> Vec<u8> {
+    vector.iter().flat_map(|v| v.to_le_bytes()).collect()
+}
+
+fn decode_vector(bytes: &[u8]) -> Vec<f32> {
+    bytes
+        .chunks_exact(4)
+        .map(|b| f32::from_le_bytes([b[0], b[1], b[2], b[3]]))
+        .collect()
+}
+
+/// Rescales vectors written before they were stored at unit length; a no-op
+/// once [`NORMALIZED_KEY`] is set.
+fn normalize_stored_vectors(conn: &mut Connection) -> Result<()> {
+    let done: Option<String> = conn
+        .query_row(
+            "SELECT value FROM meta WHERE key = ?1",
+            [NORMALIZED_KEY],
+            |row| row.get(0),
+        )
+        .optional()?;
+    if done.is_some() {
+        return Ok(());
+    }
+
+    let tx = conn.transaction()?;
+    {
+        let mut select = tx.prepare("SELECT rowid, vector FROM chunks")?;
+        let rows = select
+            .query_map([], |row| {
+                Ok((row.get::<_, i64>(0)?, row.get::<_, Vec<u8>>(1)?))
+            })?
+            .collect::<rusqlite::Result<Vec<_>>>()?;
+        let mut update = tx.prepare("UPDATE chunks SET vector = ?1 WHERE rowid = ?2")?;
+        for (rowid, bytes) in rows {
+            let mut vector = decode_vector(&bytes);
+            normalize(&mut vector);
+            update.execute(params![encode_vector(&vector), rowid])?;
+        }
+    }
+    tx.execute(
+        "INSERT INTO meta (key, value) VALUES (?1, '1')",
+        [NORMALIZED_KEY],
+    )?;
+    tx.commit()?;
+    Ok(())
+}
+
+/// Reads a row selected with [`CHUNK_COLUMNS`] into `(id, chunk, vector)`.
+fn row_to_chunk(row: &Row<'_>) -> rusqlite::Result<(String, CodeChunk, Vec<f32>)> {
+    let calls: String = row.get(6)?;
+    let vector: Vec<u8> = row.get(9)?;
+    let imports: String = row.get(16)?;
+    let part: Option<i64> = row.get(17)?;
+    let part_count: Option<i64> = row.get(18)?;
+    let duplicates: String = row.get(22)?;
+    let tags: String = row.get(23)?;
+    Ok((
+        row.get(0)?,
+        CodeChunk {
+            filename: row.get(1)?,
+            code: row.get(2)?,
+            line_start: row.get::<_, i64>(3)? as usize,
+            line_end: row.get::<_, i64>(4)? as usize,
+            last_modified: row.get(5)?,
+            calls: serde_json::from_str(&calls).unwrap_or_default(),
+            symbol: row.get(7)?,
+            language: row.get(8)?,
+            redacted: row.get(10)?,
+            occurrence: row.get(11)?,
+            overlap_lines: row.get::<_, i64>(12)? as usize,
+            summary: row.get(13)?,
+            doc: row.get(14)?,
+            package: row.get(15)?,
+            imports: serde_json::from_str(&imports).unwrap_or_default(),
+            part: part.zip(part_count).map(|(index, count)| ChunkPart {
+                index: index as usize,
+                count: count as usize,
+            }),
+            changed_at: row.get(19)?,
+            is_test: row.get::<_, Option<bool>>(20)?.unwrap_or(false),
+            collection: row.get(21)?,
+            duplicates: serde_json::from_str(&duplicates).unwrap_or_default(),
+            tags: serde_json::from_str(&tags).unwrap_or_default(),
+        },
+        decode_vector(&vector),
+    ))
+}
+
+fn stored_dim(conn: &Connection) -> Result<Option<usize>> {
+    let value: Option<String> = conn
+        .query_row("SELECT value FROM meta WHERE key = ?1", [DIM_KEY], |row| {
+            row.get(0)
+        })
+        .optional()?;
+    Ok(value.and_then(|v| v.parse().ok()))
+}
+
+/// Metric of an initialized database; `None` until [`VectorStore::init`].
+fn stored_metric(conn: &Connection) -> Result<Option<Metric>> {
+    let value: Option<String> = conn
+        .query_row(
+            "SELECT value FROM meta WHERE key = ?1",
+            [METRIC_KEY],
+            |row| row.get(0),
+        )
+        .optional()?;
+    match value {
+        Some(name) => Ok(Some(name.parse().map_err(anyhow::Error::msg)?)),
+        None => Ok(stored_dim(conn)?.map(|_| Metric::Cosine)),
+    }
+}
+
+/// [`stored_metric`], looked up in the database only until it is known.
+fn cached_metric(cache: &OnceLock<Metric>, conn: &Connection) -> Result<Option<Metric>> {
+    if let Some(metric) = cache.get() {
+        return Ok(Some(*metric));
+    }
+    let metric = stored_metric(conn)?;
+    if let Some(metric) = metric {
+        let _ = cache.set(metric);
+    }
+    Ok(metric)
+}
+
+/// Inserts `chunks` of `workspace` with their vectors, prepared for `metric`,
+/// replacing stored chunks with the same IDs.
+fn insert_chunks(
+    tx: &Transaction<'_>,
+    workspace: &str,
+    chunks: &[CodeChunk],
+    vectors: Vec<Vec<f32>>,
+    metric: Metric,
+) -> Result<()> {
+    let dim = stored_dim(tx)?;
+    let mut stmt = tx.prepare(
+        "INSERT OR REPLACE INTO chunks (workspace, id, filename, code, line_start, \
+        line_end, last_modified, calls, symbol, language, vector, redacted, \
+        occurrence, overlap_lines, summary, doc, package, imports, part, part_count, \
+        changed_at, is_test, collection, duplicates, tags) \
+        VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13, ?14, ?15, ?16, \
+        ?17, ?18, ?19, ?20, ?21, ?22, ?23, ?24, ?25)",
+    )?;
+    for (chunk, mut vector) in chunks.iter().zip(vectors) {
+        if dim.is_some_and(|d| d != vector.len()) {
+            anyhow::bail!(
+                "Vector for {} has {} dimensions, expected {}",
+                chunk.id(),
+                vector.len(),
+                dim.unwrap_or_default()
+            );
+        }
+        metric.prepare(&mut vector);
+        stmt.execute(params![
+            workspace,
+            chunk.id(),
+            chunk.filename,
+            chunk.code,
+            chunk.line_start as i64,
+            chunk.line_end as i64,
+            chunk.last_modified,
+            serde_json::to_string(&chunk.calls)?,
+            chunk.symbol,
+            chunk.language,
+            encode_vector(&vector),
+            chunk.redacted,
+            chunk.occurrence,
+            chunk.overlap_lines as i64,
+            chunk.summary,
+            chunk.doc,
+            chunk.package,
+            serde_json::to_string(&chunk.imports)?,
+            chunk.part.map(|p| p.index as i64),
+            chunk.part.map(|p| p.count as i64),
+            chunk.changed_at,
+            chunk.is_test,
+            chunk.collection,
+            serde_json::to_string(&chunk.duplicates)?,
+            serde_json::to_string(&chunk.tags)?,
+        ])?;
+    }
+    Ok(())
+}
+
+/// Deletes every chunk of `filenames` in `workspace`.
+fn delete_files(tx: &Transaction<'_>, workspace: &str, filenames: &[String]) -> Result<()> {
+    let mut stmt = tx.prepare("DELETE FROM chunks WHERE workspace = ?1 AND filename = ?2")?;
+    for filename in filenames {
+        stmt.execute(params![workspace, filename])?;
+    }
+    Ok(())
+}
+
+#[async_trait]
+impl VectorStore for SqliteStore {
+    async fn init(&self, dim: usize) -> Result<()> {
+        let metric = self.metric;
+        let recorded_metric = self.recorded_metric.clone();
+        self.with_conn(move |conn| {
+            if let Some(recorded) = cached_metric(&recorded_metric, conn)? {
+                check_metric("Database", recorded, metric)?;
+            }
+            match stored_dim(conn)? {
+                Some(existing) => check_dim("Database", existing, dim)?,
+                None => {
+                    let tx = conn.transaction()?;
+                    tx.execute(
+                        "INSERT INTO meta (key, value) VALUES (?1, ?2)",
+                        params![DIM_KEY, dim.to_string()],
+                    )?;
+                    tx.execute(
+                        "INSERT OR REPLACE INTO meta (key, value) VALUES (?1, ?2)",
+                        params![METRIC_KEY, metric.as_str()],
+                    )?;
+                    tx.commit()?;
+                }
+            }
+            Ok(())
+        })
+        .await
+    }
+
+    async fn add_code_chunks(
+        &self,
+        workspace: &str,
+        chunks: &[CodeChunk],
+        vectors: Vec<Vec<f32>>,
+    ) -> Result<()> {
+        if chunks.len() != vectors.len() {
+            anyhow::bail!("Got {} vectors for {} chunks", vectors.len(), chunks.len());
+        }
+        let workspace = workspace.to_string();
+        let chunks = chunks.to_vec();
+        let metric = self.metric;
+        self.with_conn(move |conn| {
+            let tx = conn.transaction()?;
+            insert_chunks(&tx, &workspace, &chunks, vectors, metric)?;
+            tx.commit()?;
+            Ok(())
+        })
+        .await
+    }
+
+    async fn search_chunks(
+        &self,
+        mut query_vector: Vec<f32>,
+        limit: usize,
+        filter: Option<String>,
+        workspace: Option<&str>,
+    ) -> Result<Vec<ScoredChunk>> {
+        let metric = self.metric;
+        metric.prepare(&mut query_vector);
+        let workspace = workspace.map(str::to_string);
+        let recorded_metric = self.recorded_metric.clone();
+        self.with_conn(move |conn| {
+            if let Some(recorded) = cached_metric(&recorded_metric, conn)? {
+                check_metric("Database", recorded, metric)?;
+            }
+            let started = std::time::Instant::now();
+            let mut conditions: Vec<String> = Vec::new();
+            if let Some(f) = &filter {
+                conditions.push(format!("({})", f));
+            }
+            if workspace.is_some() {
+                conditions.push("workspace = ?1".to_string());
+            }
+            let mut sql = format!("SELECT {} FROM chunks", CHUNK_COLUMNS);
+            if !conditions.is_empty() {
+                sql.push_str(" WHERE ");
+                sql.push_str(&conditions.join(" AND "));
+            }
+
+            let mut stmt = conn.prepare(&sql)?;
+            let rows = stmt.query_map(params_from_iter(workspace.iter()), row_to_chunk)?;
+            let mut hits = Vec::new();
+            for row in rows {
+                let (id, chunk, vector) = row?;
+                hits.push(ScoredChunk {
+                    id,
+                    chunk,
+                    distance: Some(metric.distance(&query_vector, &vector)),
+                    vector,
+                });
+            }
+
+            let scanned = hits.len();
+            hits.sort_by(|a, b| {
+                a.distance
+                    .partial_cmp(&b.distance)
+                    .unwrap_or(std::cmp::Ordering::Equal)
+                    .then_with(|| a.id.cmp(&b.id))
+            });
+            hits.truncate(limit);
+            tracing::debug!(
+                scanned,
+                hits = hits.len(),
+                elapsed_ms = started.elapsed().as_millis() as u64,
+                "Scanned SQLite vectors"
+            );
+            Ok(hits)
+        })
+        .await
+    }
+
+    fn metric(&self) -> Metric {
+        self.metric
+    }
+
+    async fn stored_metric(&self) -> Result<Option<Metric>> {
+        let recorded_metric = self.recorded_metric.clone();
+        self.with_conn(move |conn| cached_metric(&recorded_metric, conn))
+            .await
+    }
+
+    async fn get_indexed_metadata(&self, workspace: &str) -> Result<HashMap<String, i64>> {
+        let workspace = workspace.to_string();
+        self.with_conn(move |conn| {
+            let mut stmt = conn.prepare(
+                "SELECT filename, MAX(last_modified) FROM chunks \
+                WHERE workspace = ?1 GROUP BY filename",
+            )?;
+            let rows = stmt.query_map([workspace], |row| Ok((row.get(0)?, row.get(1)?)))?;
+            Ok(rows.collect::<rusqlite::Result<HashMap<String, i64>>>()?)
+        })
+        .await
+    }
+
+    async fn list_chunk_info(&self, workspace: &str) -> Result<Vec<ChunkInfo>> {
+        let workspace = workspace.to_string();
+        self.with_conn(move |conn| {
+            let mut stmt = conn.prepare(
+                "SELECT filename, language, last_modified, collection FROM chunks \
+                WHERE workspace = ?1",
+            )?;
+            let rows = stmt.query_map([workspace], |row| {
+                Ok(ChunkInfo {
+                    filename: row.get(0)?,
+                    language: row.get(1)?,
+                    last_modified: row.get(2)?,
+                    collection: row.get(3)?,
+                })
+            })?;
+            Ok(rows.collect::<rusqlite::Result<Vec<_>>>()?)
+        })
+        .await
+    }
+
+    async fn count_chunks(&self) -> Result<usize> {
+        self.with_conn(|conn| {
+            let count: i64 = conn.query_row("SELECT COUNT(*) FROM chunks", [], |row| row.get(0))?;
+            Ok(count as usize)
+        })
+        .await
+    }
+
+    async fn list_vectors(&self) -> Result<Vec<StoredVector>> {
+        self.with_conn(|conn| {
+            let mut stmt = conn.prepare("SELECT workspace, filename, id, vector FROM chunks")?;
+            let rows = stmt.query_map([], |row| {
+                let vector: Vec<u8> = row.get(3)?;
+                Ok(StoredVector {
+                    workspace: row.get(0)?,
+                    filename: row.get(1)?,
+                    id: row.get(2)?,
+                    vector: decode_vector(&vector),
+                })
+            })?;
+            Ok(rows.collect::<rusqlite::Result<Vec<_>>>()?)
+        })
+        .await
+    }
+
+    async fn get_file_chunks(
+        &self,
+        filename: &str,
+        workspace: &str,
+    ) -> Result<Vec<(CodeChunk, Vec<f32>)>> {
+        let filename = filename.to_string();
+        let workspace = workspace.to_string();
+        self.with_conn(move |conn| {
+            let sql = format!(
+                "SELECT {} FROM chunks WHERE workspace = ?1 AND filename = ?2 ORDER BY line_start",
+                CHUNK_COLUMNS
+            );
+            let mut stmt = conn.prepare(&sql)?;
+            let rows = stmt.query_map(params![workspace, filename], row_to_chunk)?;
+            let mut chunks = Vec::new();
+            for row in rows {
+                let (_, chunk, vector) = row?;
+                chunks.push((chunk, vector));
+            }
+            Ok(chunks)
+        })
+        .await
+    }
+
+    async fn get_chunks_by_ids(
+        &self,
+        ids: &[String],
+        workspace: Option<&str>,
+    ) -> Result<Vec<CodeChunk>> {
+        if ids.is_empty() {
+            return Ok(Vec::new());
+        }
+        let ids = ids.to_vec();
+        let workspace = workspace.map(str::to_string);
+        self.with_conn(move |conn| {
+            let placeholders = vec!["?"; ids.len()].join(", ");
+            let mut sql = format!(
+                "SELECT {} FROM chunks WHERE id IN ({})",
+                CHUNK_COLUMNS, placeholders
+            );
+            if workspace.is_some() {
+                sql.push_str(" AND workspace = ?");
+            }
+            let mut stmt = conn.prepare(&sql)?;
+            let rows = stmt.query_map(
+                params_from_iter(ids.iter().chain(workspace.iter())),
+                row_to_chunk,
+            )?;
+            let mut chunks = Vec::new();
+            for row in rows {
+                chunks.push(row?.1);
+            }
+            Ok(chunks)
+        })
+        .await
+    }
+
+    async fn delete_file_chunks(&self, filename: &str, workspace: &str) -> Result<()> {
+        self.batch_delete_files(&[filename.to_string()], workspace)
+            .await
+    }
+
+    async fn batch_delete_files(&self, filenames: &[String], workspace: &str) -> Result<()> {
+        if filenames.is_empty() {
+            return Ok(());
+        }
+        let filenames = filenames.to_vec();
+        let workspace = workspace.to_string();
+        self.with_conn(move |conn| {
+            let tx = conn.transaction()?;
+            delete_files(&tx, &workspace, &filenames)?;
+            tx.commit()?;
+            Ok(())
+        })
+        .await
+    }
+
+    async fn replace_files(
+        &self,
+        workspace: &str,
+        filenames: &[String],
+        chunks: &[CodeChunk],
+        vectors: Vec<Vec<f32>>,
+    ) -> Result<()> {
+        if chunks.len() != vectors.len() {
+            anyhow::bail!("Got {} vectors for {} chunks", vectors.len(), chunks.len());
+        }
+        let workspace = workspace.to_string();
+        let filenames = filenames.to_vec();
+        let chunks = chunks.to_vec();
+        let metric = self.metric;
+        self.with_conn(move |conn| {
+            let tx = conn.transaction()?;
+            delete_files(&tx, &workspace, &filenames)?;
+            insert_chunks(&tx, &workspace, &chunks, vectors, metric)?;
+            tx.commit()?;
+            Ok(())
+        })
+        .await
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::search::{CandidateFilter, TestFilter};
+    use tempfile::TempDir;
+
+    fn chunk(filename: &str, line_start: usize, language: &str) -> CodeChunk {
+        CodeChunk {
+            filename: filename.to_string(),
+            code: format!("fn at_{}() {{}}", line_start),
+            line_start,
+            line_end: line_start + 2,
+            last_modified: 42,
+            calls: vec!["helper".to_string()],
+            symbol: Some(format!("at_{}", line_start)),
+            language: Some(language.to_string()),
+            redacted: false,
+            occurrence: 0,
+            overlap_lines: 0,
+            summary: None,
+            doc: None,
+            package: None,
+            imports: Vec::new(),
+            part: None,
+            changed_at: None,
+            is_test: false,
+            collection: None,
+            tags: Vec::new(),
+            duplicates: Vec::new(),
+        }
+    }
+
+    async fn seeded_store() -> SqliteStore {
+        let store = SqliteStore::open_in_memory().unwrap();
+        store.init(2).await.unwrap();
+        store
+            .add_code_chunks(
+                "default",
+                &[
+                    chunk("src/a.rs", 1, "rust"),
+                    chunk("src/b.py", 1, "python"),
+                    chunk("src/c.rs", 1, "rust"),
+                ],
+                vec![vec![1.0, 0.0], vec![0.9, 0.1], vec![0.0, 1.0]],
+            )
+            .await
+            .unwrap();
+        store
+            .add_code_chunks(
+                "other",
+                &[chunk("src/a.rs", 1, "rust")],
+                vec![vec![1.0, 0.0]],
+            )
+            .await
+            .unwrap();
+        store
+    }
+
+    #[tokio::test]
+    async fn test_search_ranks_by_cosine_distance() {
+        let store = seeded_store().await;
+        let hits = store
+            .search_chunks(vec![1.0, 0.0], 10, None, Some("default"))
+            .await
+            .unwrap();
+        let files: Vec<&str> = hits.iter().map(|h| h.chunk.filename.as_str()).collect();
+        assert_eq!(files, vec!["src/a.rs", "src/b.py", "src/c.rs"]);
+        assert!(hits[0].distance.unwrap().abs() < 1e-6);
+        assert_eq!(hits[0].id, chunk("src/a.rs", 1, "rust").id());
+        assert_eq!(hits[0].chunk.calls, vec!["helper"]);
+        assert_eq!(hits[0].chunk.symbol.as_deref(), Some("at_1"));
+
+        let hits = store
+            .search_chunks(vec![1.0, 0.0], 1, None, None)
+            .await
+            .unwrap();
+        assert_eq!(hits.len(), 1);
+    }
+
+    #[tokio::test]
+    async fn test_search_applies_candidate_filter() {
+        let store = seeded_store().await;
+        let filter = CandidateFilter::new(None, None, Vec::new(), vec!["rust".to_string()])
+            .unwrap()
+            .sql();
+        let hits = store
+            .search_chunks(vec![1.0, 0.0], 10, filter, Some("default"))
+            .await
+            .unwrap();
+        let files: Vec<&str> = hits.iter().map(|h| h.chunk.filename.as_str()).collect();
+        assert_eq!(files, vec!["src/a.rs", "src/c.rs"]);
+    }
+
+    #[tokio::test]
+    async fn test_package_and_imports_round_trip() {
+        let store = SqliteStore::open_in_memory().unwrap();
+        store.init(2).await.unwrap();
+        let mut go = chunk("cmd/main.go", 1, "go");
+        go.package = Some("main".to_string());
+        go.imports = vec!["fmt".to_string(), "net/http".to_string()];
+        store
+            .add_code_chunks(
+                "default",
+                &[go, chunk("src/a.rs", 1, "rust")],
+                vec![vec![1.0, 0.0], vec![1.0, 0.0]],
+            )
+            .await
+            .unwrap();
+
+        let rows = store
+            .get_file_chunks("cmd/main.go", "default")
+            .await
+            .unwrap();
+        assert_eq!(rows[0].0.package.as_deref(), Some("main"));
+        assert_eq!(rows[0].0.imports, vec!["fmt", "net/http"]);
+
+        let filter = CandidateFilter::default()
+            .with_packages(vec!["main".to_string()])
+            .sql();
+        let hits = store
+            .search_chunks(vec![1.0, 0.0], 10, filter, Some("default"))
+            .await
+            .unwrap();
+        let files: Vec<&str> = hits.iter().map(|h| h.chunk.filename.as_str()).collect();
+        assert_eq!(files, vec!["cmd/main.go"]);
+        assert!(hits[0].chunk.imports.contains(&"net/http".to_string()));
+    }
+
+    #[tokio::test]
+    async fn test_test_code_filter() {
+        let store = SqliteStore::open_in_memory().unwrap();
+        store.init(2).await.unwrap();
+        let mut test = chunk("auth/login_test.go", 1, "go");
+        test.is_test = true;
+        store
+            .add_code_chunks(
+                "default",
+                &[test, chunk("auth/login.go", 1, "go")],
+                vec![vec![1.0, 0.0], vec![1.0, 0.0]],
+            )
+            .await
+            .unwrap();
+
+        for (tests, expected) in [
+            (TestFilter::Only, "auth/login_test.go"),
+            (TestFilter::Exclude, "auth/login.go"),
+        ] {
+            let filter = CandidateFilter::default().with_tests(tests).sql();
+            let hits = store
+                .search_chunks(vec![1.0, 0.0], 10, filter, Some("default"))
+                .await
+                .unwrap();
+            let files: Vec<&str> = hits.iter().map(|h| h.chunk.filename.as_str()).collect();
+            assert_eq!(files, vec![expected]);
+            assert_eq!(hits[0].chunk.is_test, tests == TestFilter::Only);
+        }
+    }
+
+    #[tokio::test]
+    async fn test_collection_filter() {
+        let store = SqliteStore::open_in_memory().unwrap();
+        store.init(2).await.unwrap();
+        let mut backend = chunk("api/server.go", 1, "go");
+        backend.collection = Some("backend".to_string());
+        store
+            .add_code_chunks(
+                "default",
+                &[backend, chunk("web/app.ts", 1, "typescript")],
+                vec![vec![1.0, 0.0], vec![1.0, 0.0]],
+            )
+            .await
+            .unwrap();
+
+        let filter = CandidateFilter::default()
+            .with_collections(vec!["backend".to_string()])
+            .sql();
+        let hits = store
+            .search_chunks(vec![1.0, 0.0], 10, filter, Some("default"))
+            .await
+            .unwrap();
+        assert_eq!(hits.len(), 1);
+        assert_eq!(hits[0].chunk.collection.as_deref(), Some("backend"));
+
+        let mut infos = store.list_chunk_info("default").await.unwrap();
+        infos.sort_by(|a, b| a.filename.cmp(&b.filename));
+        assert_eq!(infos[0].collection.as_deref(), Some("backend"));
+        assert_eq!(infos[1].collection, None);
+    }
+
+    #[tokio::test]
+    async fn test_list_chunk_info() {
+        let store = seeded_store().await;
+        let mut infos = store.list_chunk_info("default").await.unwrap();
+        infos.sort_by(|a, b| a.filename.cmp(&b.filename));
+        assert_eq!(infos.len(), 3);
+        assert_eq!(infos[1].filename, "src/b.py");
+        assert_eq!(infos[1].language.as_deref(), Some("python"));
+        assert_eq!(infos[1].last_modified, 42);
+        assert_eq!(store.list_chunk_info("other").await.unwrap().len(), 1);
+        assert!(store.list_chunk_info("missing").await.unwrap().is_empty());
+
+        assert_eq!(store.count_chunks().await.unwrap(), 4);
+        let vectors = store.list_vectors().await.unwrap();
+        assert_eq!(vectors.len(), 4);
+        let other = vectors.iter().find(|v| v.workspace == "other").unwrap();
+        assert_eq!(other.filename, "src/a.rs");
+        assert_eq!(other.id, chunk("src/a.rs", 1, "rust").id());
+        assert_eq!(other.vector, vec![1.0, 0.0]);
+    }
+
+    #[tokio::test]
+    async fn test_metadata_rename_and_delete() {
+        let store = seeded_store().await;
+        let metadata = store.get_indexed_metadata("default").await.unwrap();
+        assert_eq!(metadata.len(), 3);
+        assert_eq!(metadata["src/a.rs"], 42);
+
+        let moved = store
+            .rename_file("src/a.rs", "src/moved.rs", "default", 99)
+            .await
+            .unwrap();
+        assert_eq!(moved.len(), 1);
+        let metadata = store.get_indexed_metadata("default").await.unwrap();
+        assert!(!metadata.contains_key("src/a.rs"));
+        assert_eq!(metadata["src/moved.rs"], 99);
+        let rows = store
+            .get_file_chunks("src/moved.rs", "default")
+            .await
+            .unwrap();
+        assert_eq!(rows[0].1, vec![1.0, 0.0]);
+
+        let by_id = store
+            .get_chunks_by_ids(&[chunk("src/b.py", 1, "python").id()], Some("default"))
+            .await
+            .unwrap();
+        assert_eq!(by_id[0].filename, "src/b.py");
+
+        store
+            .batch_delete_files(&["src/b.py".to_string(), "src/c.rs".to_string()], "default")
+            .await
+            .unwrap();
+        let metadata = store.get_indexed_metadata("default").await.unwrap();
+        assert_eq!(metadata.keys().collect::<Vec<_>>(), vec!["src/moved.rs"]);
+        // Other workspaces are untouched
+        assert_eq!(store.get_indexed_metadata("other").await.unwrap().len(), 1);
+    }
+
+    #[tokio::test]
+    async fn test_persists_and_checks_dimension() {
+        let dir = TempDir::new().unwrap();
+        let path = SqliteStore::path(dir.path().to_str().unwrap(), "code_chunks");
+        {
+            let store = SqliteStore::open(&path).unwrap();
+            store.init(2).await.unwrap();
+            store
+                .add_code_chunks(
+                    "default",
+                    &[chunk("src/a.rs", 1, "rust")],
+                    vec![vec![1.0, 0.0]],
+                )
+                .await
+                .unwrap();
+        }
+
+        let store = SqliteStore::open(&path).unwrap();
+        store.init(2).await.unwrap();
+        assert_eq!(
+            store.get_indexed_metadata("default").await.unwrap().len(),
+            1
+        );
+        assert!(store.init(3).await.is_err());
+        assert!(store
+            .add_code_chunks("default", &[chunk("src/b.rs", 1, "rust")], vec![vec![1.0]])
+            .await
+            .is_err());
+    }
+
+    #[tokio::test]
+    async fn test_stores_unit_vectors() {
+        let store = SqliteStore::open_in_memory().unwrap();
+        store.init(2).await.unwrap();
+        store
+            .add_code_chunks(
+                "default",
+                &[chunk("src/a.rs", 1, "rust")],
+                vec![vec![3.0, 4.0]],
+            )
+            .await
+            .unwrap();
+        let hits = store
+            .search_chunks(vec![6.0, 8.0], 1, None, None)
+            .await
+            .unwrap();
+        assert_eq!(hits[0].vector, vec![0.6, 0.8]);
+        assert!(hits[0].distance.unwrap().abs() < 1e-6);
+    }
+
+    #[test]
+    fn test_normalizes_legacy_vectors_once() {
+        let mut conn = Connection::open_in_memory().unwrap();
+        migrate(&mut conn).unwrap();
+        conn.execute(
+            "INSERT INTO chunks (workspace, id, filename, code, line_start, line_end, \
+            last_modified, vector) VALUES ('default', 'x', 'a.rs', '', 1, 1, 0, ?1)",
+            [encode_vector(&[0.0, 2.0])],
+        )
+        .unwrap();
+
+        normalize_stored_vectors(&mut conn).unwrap();
+        let stored: Vec<u8> = conn
+            .query_row("SELECT vector FROM chunks", [], |row| row.get(0))
+            .unwrap();
+        assert_eq!(decode_vector(&stored), vec![0.0, 1.0]);
+
+        // Marked as done, later rows are left alone
+        conn.execute(
+            "UPDATE chunks SET vector = ?1",
+            [encode_vector(&[0.0, 2.0])],
+        )
+        .unwrap();
+        normalize_stored_vectors(&mut conn).unwrap();
+        let stored: Vec<u8> = conn
+            .query_row("SELECT vector FROM chunks", [], |row| row.get(0))
+            .unwrap();
+        assert_eq!(decode_vector(&stored), vec![0.0, 2.0]);
+    }
+
+    /// Filenames of the hits for `query`, closest first.
+    async fn ranked(store: &SqliteStore, query: Vec<f32>) -> Vec<String> {
+        store
+            .search_chunks(query, 10, None, Some("default"))
+            .await
+            .unwrap()
+            .into_iter()
+            .map(|hit| hit.chunk.filename)
+            .collect()
+    }
+
+    #[tokio::test]
+    async fn test_metrics_rank_known_vectors() {
+        let chunks = [
+            chunk("long.rs", 1, "rust"),
+            chunk("near.rs", 1, "rust"),
+            chunk("across.rs", 1, "rust"),
+            chunk("short.rs", 1, "rust"),
+        ];
+        let vectors = vec![
+            vec![10.0, 0.0],
+            vec![0.9, 0.1],
+            vec![0.0, 1.0],
+            vec![0.5, 0.0],
+        ];
+        let mut rankings = Vec::new();
+        for metric in [Metric::Cosine, Metric::Dot, Metric::L2] {
+            let store = SqliteStore::open_in_memory().unwrap().with_metric(metric);
+            store.init(2).await.unwrap();
+            store
+                .add_code_chunks("default", &chunks, vectors.clone())
+                .await
+                .unwrap();
+            rankings.push(ranked(&store, vec![1.0, 0.0]).await);
+
+            let stored = store.get_file_chunks("long.rs", "default").await.unwrap();
+            let expected = if metric.normalizes() { 1.0 } else { 10.0 };
+            assert_eq!(stored[0].1, vec![expected, 0.0], "{}", metric);
+        }
+        // Cosine ignores length, so the aligned vectors tie
+        let mut aligned = rankings[0][..2].to_vec();
+        aligned.sort();
+        assert_eq!(aligned, ["long.rs", "short.rs"]);
+        assert_eq!(rankings[0][2..], ["near.rs", "across.rs"]);
+        assert_eq!(rankings[1], ["long.rs", "near.rs", "short.rs", "across.rs"]);
+        assert_eq!(rankings[2], ["near.rs", "short.rs", "across.rs", "long.rs"]);
+    }
+
+    #[tokio::test]
+    async fn test_rejects_other_metric() {
+        let dir = TempDir::new().unwrap();
+        let path = dir.path().join("dot.sqlite");
+        let store = SqliteStore::open(&path).unwrap().with_metric(Metric::Dot);
+        store.init(2).await.unwrap();
+        drop(store);
+
+        let reopened = SqliteStore::open(&path).unwrap().with_metric(Metric::Dot);
+        assert!(reopened.init(2).await.is_ok());
+        assert!(reopened
+            .search_chunks(vec![1.0, 0.0], 5, None, None)
+            .await
+            .is_ok());
+
+        let cosine = SqliteStore::open(&path).unwrap();
+        let err = cosine
+            .search_chunks(vec![1.0, 0.0], 5, None, None)
+            .await
+            .unwrap_err();
+        assert!(err.to_string().contains("dot distance metric"), "{}", err);
+        assert!(cosine.init(2).await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_index_status() {
+        use crate::storage::{index_status, IndexStatus, SQLITE_BACKEND};
+
+        let dir = TempDir::new().unwrap();
+        let db = dir.path().join("index").to_string_lossy().to_string();
+        let status =
+            |db: String| async move { index_status(SQLITE_BACKEND, &db, "code_chunks").await };
+        assert_eq!(status(db.clone()).await.unwrap(), IndexStatus::Missing);
+        // Checking doesn't create the store
+        assert!(!SqliteStore::path(&db, "code_chunks").exists());
+        let problem = IndexStatus::Missing.problem(&db, "api").unwrap();
+        assert!(problem.starts_with("No index found at"), "{}", problem);
+        assert!(problem.contains("--workspace api"), "{}", problem);
+
+        std::fs::create_dir_all(&db).unwrap();
+        let store = SqliteStore::open(&SqliteStore::path(&db, "code_chunks")).unwrap();
+        store.init(2).await.unwrap();
+        assert_eq!(status(db.clone()).await.unwrap(), IndexStatus::Empty);
+        let problem = IndexStatus::Empty.problem(&db, "default").unwrap();
+        assert!(problem.contains("is empty"), "{}", problem);
+        assert!(!problem.contains("--workspace"), "{}", problem);
+
+        store
+            .add_code_chunks(
+                "default",
+                &[chunk("src/a.rs", 1, "rust")],
+                vec![vec![1.0, 0.0]],
+            )
+            .await
+            .unwrap();
+        assert_eq!(status(db.clone()).await.unwrap(), IndexStatus::Ready(1));
+        assert_eq!(IndexStatus::Ready(1).problem(&db, "default"), None);
+        drop(store);
+
+        // A store that can't be read isn't mistaken for an empty one
+        std::fs::write(SqliteStore::path(&db, "code_chunks"), [b'x'; 4096]).unwrap();
+        assert!(status(db).await.is_err());
+    }
+
+    #[test]
+    fn test_rejects_newer_schema() {
+        let dir = TempDir::new().unwrap();
+        let path = dir.path().join("future.sqlite");
+        {
+            let conn = Connection::open(&path).unwrap();
+            conn.pragma_update(None, "user_version", SQLITE_SCHEMA_VERSION + 1)
+                .unwrap();
+        }
+        let err = SqliteStore::open(&path).err().unwrap();
+        assert!(format!("{:#}", err).contains("only understands version"));
+    }
+}
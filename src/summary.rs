@@ -0,0 +1,344 @@
+use anyhow::{bail, Result};
+use std::sync::Arc;
+use tracing::warn;
+
+use crate::config::AppConfig;
+use crate::context::{default_counter, TokenCounter};
+use crate::indexer::CodeChunk;
+use crate::llm::{LlmClient, OllamaClient};
+
+/// Characters of an oversized chunk included in the summarization prompt.
+const MAX_PROMPT_CHARS: usize = 12_000;
+/// Doc comment lines kept by [`signature_summary`].
+const MAX_DOC_LINES: usize = 12;
+/// Signature lines kept by [`signature_summary`].
+const MAX_SIGNATURE_LINES: usize = 6;
+/// Calls listed by [`signature_summary`].
+const MAX_CALLS: usize = 15;
+
+/// Produces compact summaries of chunks too large for a context budget.
+///
+/// Chunks above `threshold` tokens get a summary holding their signature, doc
+/// comment and key calls next to the full code. [`ContextBuilder`] and
+/// `search --max-tokens` substitute it when the full chunk doesn't fit.
+/// Summaries come from an LLM if one is set, falling back to
+/// [`signature_summary`] when the call fails or returns nothing useful.
+///
+/// [`ContextBuilder`]: crate::context::ContextBuilder
+#[derive(Clone)]
+pub struct Summarizer {
+    threshold: usize,
+    counter: Arc<dyn TokenCounter>,
+    llm: Option<Arc<dyn LlmClient>>,
+}
+
+impl std::fmt::Debug for Summarizer {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("Summarizer")
+            .field("threshold", &self.threshold)
+            .field("llm", &self.llm.is_some())
+            .finish()
+    }
+}
+
+impl Summarizer {
+    /// Builds a summarizer using [`signature_summary`] only.
+    pub fn new(threshold: usize, counter: Arc<dyn TokenCounter>) -> Self {
+        Self {
+            threshold,
+            counter,
+            llm: None,
+        }
+    }
+
+    /// Asks `llm` for summaries instead of extracting them.
+    pub fn with_llm(mut self, llm: Arc<dyn LlmClient>) -> Self {
+        self.llm = Some(llm);
+        self
+    }
+
+    /// Builds the summarizer configured by `summarize_chunks` (`none`,
+    /// `signature` or `llm`) and `summary_threshold_tokens`, or `None` if
+    /// summarization is disabled.
+    pub fn from_config(config: &AppConfig) -> Result<Option<Self>> {
+        let summarizer = Self::new(config.summary_threshold_tokens, default_counter());
+        match config.summarize_chunks.as_str() {
+            "none" => Ok(None),
+            "signature" => Ok(Some(summarizer)),
+            "llm" => {
+                let client = OllamaClient::new(&config.llm_host, &config.llm_model);
+                Ok(Some(summarizer.with_llm(Arc::new(client))))
+            }
+            other => bail!(
+                "Unknown summarize_chunks mode '{}'; expected none, signature or llm",
+                other
+            ),
+        }
+    }
+
+    /// Stores a summary on each chunk above the threshold.
+    ///
+    /// Returns the number of summarized chunks.
+    pub async fn summarize_chunks(&self, chunks: &mut [CodeChunk]) -> usize {
+        let mut count = 0;
+        for chunk in chunks {
+            if self.counter.count(&chunk.code) <= self.threshold {
+                continue;
+            }
+            chunk.summary = Some(self.summarize(chunk).await);
+            count += 1;
+        }
+        count
+    }
+
+    async fn summarize(&self, chunk: &CodeChunk) -> String {
+        let Some(llm) = &self.llm else {
+            return signature_summary(chunk);
+        };
+        match llm.generate(&Self::build_prompt(chunk)).await {
+            Ok(response) => {
+                let summary = clean_response(&response);
+                if !summary.is_empty() && self.counter.count(&summary) <= self.threshold {
+                    return summary;
+                }
+                warn!(
+                    "LLM summary of {}:{} was empty or too long; using its signature.",
+                    chunk.filename, chunk.line_start
+                );
+            }
+            Err(e) => warn!(
+                "Summarizing {}:{} failed: {}; using its signature.",
+                chunk.filename, chunk.line_start, e
+            ),
+        }
+        signature_summary(chunk)
+    }
+
+    fn build_prompt(chunk: &CodeChunk) -> String {
+        let code: String = chunk.code.chars().take(MAX_PROMPT_CHARS).collect();
+        format!(
+            "You are a code documentation assistant. Summarize the following {} code so it can stand in for the full code in a search context.
+
+            Return ONLY plain text, at most 12 lines:
+            - the signature, exactly as written
+            - the doc comment, if there is one
+            - one line describing what the code does
+            - one line `calls: ...` listing the most important functions it calls
+
+            File: {} (lines {}-{})
+            {}
+            ",
+            chunk.language.as_deref().unwrap_or("source"),
+            chunk.filename,
+            chunk.line_start,
+            chunk.line_end,
+            code
+        )
+    }
+}
+
+/// Strips surrounding whitespace and Markdown code fences from an LLM reply.
+fn clean_response(response: &str) -> String {
+    response
+        .trim()
+        .lines()
+        .filter(|line| !line.trim_start().starts_with("```"))
+        .collect::<Vec<_>>()
+        .join("\n")
+        .trim()
+        .to_string()
+}
+
+/// The leading parts of a chunk that [`signature_summary`] keeps.
+pub(crate) struct Heading<'a> {
+    /// Comment lines before the signature, at most [`MAX_DOC_LINES`]
+    pub doc: Vec<&'a str>,
+    /// Lines up to the first one opening a body, at most [`MAX_SIGNATURE_LINES`]
+    pub signature: Vec<&'a str>,
+    /// Python docstring right after the signature
+    pub docstring: Vec<&'a str>,
+    /// Index of the first line after them
+    pub end: usize,
+}
+
+impl<'a> Heading<'a> {
+    /// Splits the heading off `lines`, the lines of a chunk.
+    pub(crate) fn of(lines: &[&'a str]) -> Self {
+        let mut pos = 0;
+        let mut doc = Vec::new();
+        while pos < lines.len() && is_comment(lines[pos]) {
+            if doc.len() < MAX_DOC_LINES {
+                doc.push(lines[pos]);
+            }
+            pos += 1;
+        }
+        while pos < lines.len() && lines[pos].trim().is_empty() {
+            pos += 1;
+        }
+
+        let mut signature = Vec::new();
+        while pos < lines.len() && signature.len() < MAX_SIGNATURE_LINES {
+            let line = lines[pos];
+            signature.push(line);
+            pos += 1;
+            let trimmed = line.trim_end();
+            if trimmed.ends_with('{') || trimmed.ends_with(':') || trimmed.ends_with("=>") {
+                break;
+            }
+        }
+
+        let mut docstring = Vec::new();
+        let quote = lines
+            .get(pos)
+            .map(|l| l.trim_start())
+            .and_then(|l| ["\"\"\"", "'''"].into_iter().find(|q| l.starts_with(q)));
+        if let Some(quote) = quote {
+            let start = pos;
+            while pos < lines.len() && pos - start < MAX_DOC_LINES {
+                docstring.push(lines[pos]);
+                let rest = lines[pos].trim();
+                let closes = if pos == start {
+                    rest.len() >= 6 && rest.ends_with(quote)
+                } else {
+                    rest.ends_with(quote)
+                };
+                pos += 1;
+                if closes {
+                    break;
+                }
+            }
+        }
+
+        Self {
+            doc,
+            signature,
+            docstring,
+            end: pos,
+        }
+    }
+}
+
+/// Deterministic summary of a chunk: its leading doc comment, signature and calls.
+///
+/// The signature runs up to the first line opening a body (`{`, a trailing
+/// `:` or `=>`); a Python docstring right after it is kept as the doc comment.
+pub fn signature_summary(chunk: &CodeChunk) -> String {
+    let lines: Vec<&str> = chunk.code.lines().collect();
+    let heading = Heading::of(&lines);
+
+    let mut text = [heading.doc, heading.signature, heading.docstring]
+        .concat()
+        .join("\n");
+    let omitted = lines.len().saturating_sub(heading.end);
+    if omitted > 0 {
+        let unit = if omitted == 1 { "line" } else { "lines" };
+        text.push_str(&format!("\n    ... ({} more {})", omitted, unit));
+    }
+    let mut calls: Vec<&str> = Vec::new();
+    for call in &chunk.calls {
+        if calls.len() < MAX_CALLS && !calls.contains(&call.as_str()) {
+            calls.push(call);
+        }
+    }
+    if !calls.is_empty() {
+        text.push_str(&format!("\ncalls: {}", calls.join(", ")));
+    }
+    text
+}
+
+fn is_comment(line: &str) -> bool {
+    let line = line.trim_start();
+    ["//", "#", "/*", "*", "--"]
+        .iter()
+        .any(|prefix| line.starts_with(prefix))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::context::HeuristicCounter;
+    use crate::llm::client::mocks::MockLlmClient;
+
+    fn large_chunk(code: &str, calls: &[&str]) -> CodeChunk {
+        CodeChunk {
+            filename: "auth.go".to_string(),
+            code: code.to_string(),
+            line_start: 10,
+            line_end: 10 + code.lines().count(),
+            calls: calls.iter().map(|c| c.to_string()).collect(),
+            language: Some("go".to_string()),
+            ..Default::default()
+        }
+    }
+
+    fn go_function() -> String {
+        let body = "    check(user)\n".repeat(40);
+        format!(
+            "// Authenticate checks the credentials of user.\n// It returns a session.\nfunc Authenticate(user string,\n    password string) (*Session, error) {{\n{}}}",
+            body
+        )
+    }
+
+    #[test]
+    fn test_signature_summary_go() {
+        let chunk = large_chunk(&go_function(), &["check", "db.Find", "check"]);
+        assert_eq!(
+            signature_summary(&chunk),
+            "// Authenticate checks the credentials of user.\n// It returns a session.\n\
+             func Authenticate(user string,\n    password string) (*Session, error) {\n    \
+             ... (41 more lines)\ncalls: check, db.Find"
+        );
+    }
+
+    #[test]
+    fn test_signature_summary_python_docstring() {
+        let code = "def login(user):\n    \"\"\"Log a user in.\n\n    Creates a session.\n    \"\"\"\n    return create(user)";
+        let summary = signature_summary(&large_chunk(code, &[]));
+        assert_eq!(
+            summary,
+            "def login(user):\n    \"\"\"Log a user in.\n\n    Creates a session.\n    \"\"\"\n    ... (1 more line)"
+        );
+        let one_line = "def f():\n    \"\"\"Short.\"\"\"\n    pass";
+        assert_eq!(
+            signature_summary(&large_chunk(one_line, &[])),
+            "def f():\n    \"\"\"Short.\"\"\"\n    ... (1 more line)"
+        );
+    }
+
+    #[tokio::test]
+    async fn test_summarizes_only_oversized_chunks() {
+        let summarizer = Summarizer::new(50, Arc::new(HeuristicCounter));
+        let mut chunks = vec![
+            large_chunk(&go_function(), &[]),
+            large_chunk("func Small() {}", &[]),
+        ];
+        assert_eq!(summarizer.summarize_chunks(&mut chunks).await, 1);
+        assert!(chunks[0]
+            .summary
+            .as_deref()
+            .unwrap()
+            .contains("func Authenticate("));
+        assert_eq!(chunks[1].summary, None);
+    }
+
+    #[tokio::test]
+    async fn test_llm_summary_and_fallback() {
+        let llm = Arc::new(MockLlmClient::new(
+            "```\nfunc Authenticate(user, password string)\ncalls: check\n```",
+        ));
+        let summarizer = Summarizer::new(50, Arc::new(HeuristicCounter)).with_llm(llm);
+        let mut chunks = vec![large_chunk(&go_function(), &[])];
+        summarizer.summarize_chunks(&mut chunks).await;
+        assert_eq!(
+            chunks[0].summary.as_deref(),
+            Some("func Authenticate(user, password string)\ncalls: check")
+        );
+
+        // An empty reply falls back to the extracted signature
+        let summarizer = Summarizer::new(50, Arc::new(HeuristicCounter))
+            .with_llm(Arc::new(MockLlmClient::new("  ")));
+        let mut chunks = vec![large_chunk(&go_function(), &[])];
+        summarizer.summarize_chunks(&mut chunks).await;
+        assert_eq!(chunks[0].summary, Some(signature_summary(&chunks[0])));
+    }
+}
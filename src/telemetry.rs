@@ -4,12 +4,20 @@ use opentelemetry_otlp::WithExportConfig;
 use opentelemetry_sdk::{metrics::SdkMeterProvider, trace as sdktrace, Resource};
 use std::sync::{Arc, Mutex};
 use sysinfo::{Pid, System};
-use tracing::info;
+use tracing::{info, Subscriber};
 use tracing_chrome::ChromeLayerBuilder;
-use tracing_subscriber::{layer::SubscriberExt, util::SubscriberInitExt, Registry};
+use tracing_subscriber::{
+    layer::SubscriberExt, registry::LookupSpan, util::SubscriberInitExt, Layer, Registry,
+};
 
 use crate::config::AppConfig;
 
+/// Accepted values of `log_level` and `--log-level`, quietest first.
+pub const LOG_LEVELS: &[&str] = &["error", "warn", "info", "debug", "trace"];
+
+/// Accepted values of `log_format` and `--log-format`.
+pub const LOG_FORMATS: &[&str] = &["text", "json"];
+
 pub enum AppMode {
     Cli,
     Server,
@@ -26,33 +34,72 @@ impl Drop for TelemetryGuard {
     }
 }
 
+/// Log level selected by repeating `--verbose`: `-v` is debug, `-vv` and more trace.
+pub fn verbose_level(count: u8) -> Option<&'static str> {
+    match count {
+        0 => None,
+        1 => Some("debug"),
+        _ => Some("trace"),
+    }
+}
+
+/// Filter directives for `level`: our own crate logs at `level`, noisy
+/// dependencies only at warn or above.
+pub fn filter_directives(level: &str) -> String {
+    format!(
+        "code_rag={},tokenizers=error,tantivy=warn,h2=error,tower=error,hyper=warn,reqwest=warn",
+        level
+    )
+}
+
+/// Fails on a `log_level` or `log_format` we do not know, rather than
+/// silently logging at the wrong level.
+fn validate_logging(level: &str, format: &str) -> Result<()> {
+    if !LOG_LEVELS.contains(&level) {
+        anyhow::bail!(
+            "Unknown log level '{}'. Expected one of: {}",
+            level,
+            LOG_LEVELS.join(", ")
+        );
+    }
+    if !LOG_FORMATS.contains(&format) {
+        anyhow::bail!(
+            "Unknown log format '{}'. Expected one of: {}",
+            format,
+            LOG_FORMATS.join(", ")
+        );
+    }
+    Ok(())
+}
+
+/// Formatting layer writing to stderr, as text or one JSON object per line.
+///
+/// Logs never go to stdout: it carries search results, `--json` output and
+/// the MCP JSON-RPC stream.
+fn fmt_layer<S>(config: &AppConfig) -> Box<dyn Layer<S> + Send + Sync>
+where
+    S: Subscriber + for<'a> LookupSpan<'a>,
+{
+    let layer = tracing_subscriber::fmt::layer().with_writer(std::io::stderr);
+    if config.log_format == "json" {
+        layer.json().with_current_span(false).boxed()
+    } else {
+        layer.boxed()
+    }
+}
+
 pub fn init_telemetry(mode: AppMode, config: &AppConfig) -> Result<TelemetryGuard> {
+    validate_logging(&config.log_level, &config.log_format)?;
+
     // Always apply log level from config, even if RUST_LOG is set
     // This ensures consistent behavior regardless of environment
-    let filter = format!(
-        "code_rag={},tokenizers=error,tantivy=warn,h2=error,tower=error,hyper=warn,reqwest=warn",
-        config.log_level
-    );
-    std::env::set_var("RUST_LOG", filter);
+    std::env::set_var("RUST_LOG", filter_directives(&config.log_level));
 
     if !config.telemetry_enabled {
         // Initialize basic logging with EnvFilter
         let env_filter = tracing_subscriber::EnvFilter::from_default_env();
-
-        // For MCP, we MUST NOT print logs to stdout as it corrupts the JSON-RPC stream
-        if config.enable_mcp {
-            // Redirect logs to stderr only
-            let subscriber = Registry::default()
-                .with(env_filter)
-                .with(tracing_subscriber::fmt::layer().with_writer(std::io::stderr));
-            let _ = subscriber.try_init();
-        } else {
-            // Normal CLI/Server mode - stdout is fine
-            let subscriber = Registry::default()
-                .with(env_filter)
-                .with(tracing_subscriber::fmt::layer());
-            let _ = subscriber.try_init();
-        }
+        let subscriber = Registry::default().with(env_filter).with(fmt_layer(config));
+        let _ = subscriber.try_init();
 
         return Ok(TelemetryGuard {
             _chrome_guard: None,
@@ -70,39 +117,24 @@ fn init_cli_telemetry(config: &AppConfig) -> Result<TelemetryGuard> {
 
     // Explicitly build the filter to ensure specific crate levels are respected
     // even in CLI mode (e.g., suppressing tokenizers trace logs)
-    let filter_str = format!(
-        "code_rag={},tokenizers=error,tantivy=warn,h2=error,tower=error,hyper=warn,reqwest=warn",
-        config.log_level
-    );
-    let filter_layer = tracing_subscriber::EnvFilter::try_new(&filter_str)
+    let filter_layer = tracing_subscriber::EnvFilter::try_new(filter_directives(&config.log_level))
         .unwrap_or_else(|_| tracing_subscriber::EnvFilter::new("warn"));
 
     // Redirect 'log' events to 'tracing' to capture dependencies using the log crate
     let _ = tracing_log::LogTracer::init();
 
-    // We must use specific types or branch entirely to avoid type mismatch
-    if config.enable_mcp {
-        // MCP Mode: Chrome Layer + Stderr Logging + Filter
-        let registry = Registry::default()
-            .with(filter_layer)
-            .with(chrome_layer)
-            .with(tracing_subscriber::fmt::layer().with_writer(std::io::stderr));
-        let _ = registry.try_init();
-    } else {
-        // Normal Mode: Chrome Layer + Default (Stdout) Logging + Filter
-        let registry = Registry::default()
-            .with(filter_layer)
-            .with(chrome_layer)
-            .with(tracing_subscriber::fmt::layer());
-        let _ = registry.try_init();
-    }
+    let registry = Registry::default()
+        .with(filter_layer)
+        .with(chrome_layer)
+        .with(fmt_layer(config));
+    let _ = registry.try_init();
 
     Ok(TelemetryGuard {
         _chrome_guard: Some(guard),
     })
 }
 
-fn init_server_telemetry(endpoint: &str, _config: &AppConfig) -> Result<TelemetryGuard> {
+fn init_server_telemetry(endpoint: &str, config: &AppConfig) -> Result<TelemetryGuard> {
     let resource = Resource::new(vec![KeyValue::new("service.name", "code-rag-server")]);
 
     // 1. OTLP Tracer (Jaeger)
@@ -171,11 +203,7 @@ fn init_server_telemetry(endpoint: &str, _config: &AppConfig) -> Result<Telemetr
 
     // Subscriber setup
     // Explicitly build the filter to ensure it's applied correctly
-    let filter_str = format!(
-        "code_rag={},tokenizers=error,tantivy=warn,h2=error,tower=error,hyper=warn,reqwest=warn",
-        _config.log_level
-    );
-    let filter_layer = tracing_subscriber::EnvFilter::try_new(&filter_str)
+    let filter_layer = tracing_subscriber::EnvFilter::try_new(filter_directives(&config.log_level))
         .unwrap_or_else(|_| tracing_subscriber::EnvFilter::new("warn"));
 
     // Redirect 'log' events to 'tracing'
@@ -184,7 +212,7 @@ fn init_server_telemetry(endpoint: &str, _config: &AppConfig) -> Result<Telemetr
     let subscriber = Registry::default()
         .with(filter_layer)
         .with(telemetry)
-        .with(tracing_subscriber::fmt::layer());
+        .with(fmt_layer(config));
 
     // Ignore error if already set
     let _ = subscriber.try_init();
@@ -193,3 +221,24 @@ fn init_server_telemetry(endpoint: &str, _config: &AppConfig) -> Result<Telemetr
         _chrome_guard: None,
     })
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_verbose_level() {
+        assert_eq!(verbose_level(0), None);
+        assert_eq!(verbose_level(1), Some("debug"));
+        assert_eq!(verbose_level(3), Some("trace"));
+    }
+
+    #[test]
+    fn test_validate_logging() {
+        assert!(validate_logging("debug", "json").is_ok());
+        assert!(validate_logging("warn", "text").is_ok());
+        assert!(validate_logging("verbose", "text").is_err());
+        assert!(validate_logging("warn", "xml").is_err());
+        assert!(filter_directives("debug").starts_with("code_rag=debug,"));
+    }
+}
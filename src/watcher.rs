@@ -1,31 +1,66 @@
 use crate::bm25::BM25Index;
-use crate::embedding::Embedder;
+use crate::callgraph::CallGraph;
+use crate::commands::index::RAGIGNORE_FILE;
+use crate::core::CancelToken;
+use crate::embedding::{Embedder, EmbeddingCache};
 use crate::indexer::CodeChunker;
+use crate::manifest::bump_index_version;
 use crate::ops::indexer::CodeIndexer;
-use crate::storage::Storage;
+use crate::redact::Redactor;
+use crate::storage::VectorStore;
+use crate::summary::Summarizer;
+use ignore::gitignore::{Gitignore, GitignoreBuilder};
 use notify_debouncer_mini::{new_debouncer, notify::RecursiveMode};
 use std::path::Path;
+use std::sync::Arc;
 use std::time::Duration;
-use tracing::{error, info};
+use tracing::{error, info, warn};
+
+/// Settings for [`start_watcher`].
+#[derive(Debug, Clone)]
+pub struct WatchOptions {
+    /// Database directory, used to persist the call graph and to ignore our own writes.
+    pub db_path: String,
+    /// Quiet period after the last event on a file before it is re-indexed.
+    pub debounce: Duration,
+    /// Path substrings that are never indexed (the `exclusions` config key).
+    pub exclusions: Vec<String>,
+    /// Redacts secrets from re-indexed chunks; `None` disables redaction.
+    pub redactor: Option<Redactor>,
+    /// Summarizes oversized re-indexed chunks; `None` disables summaries.
+    pub summarizer: Option<Summarizer>,
+    /// Reuses vectors of unchanged chunk texts; `None` embeds every chunk.
+    pub embedding_cache: Option<Arc<EmbeddingCache>>,
+    /// Dates re-indexed chunks with `git blame` (the `blame_timestamps` config key).
+    pub blame_timestamps: bool,
+    /// Files larger than this many bytes are not re-indexed; `None` for no limit.
+    pub max_file_size: Option<u64>,
+    /// Stops the watcher once cancelled, after flushing the index to disk.
+    pub cancel: CancelToken,
+}
 
 pub async fn start_watcher(
     path: &str,
-    storage: Storage,
+    storage: Arc<dyn VectorStore>,
     mut embedder: Embedder,
     mut bm25: BM25Index,
     chunker: CodeChunker,
     workspace: String,
+    options: WatchOptions,
 ) -> anyhow::Result<()> {
     info!("Starting watcher on: {}", path);
 
+    let root = Path::new(path);
+    let canonical_root = root.canonicalize()?;
+    let canonical_db = Path::new(&options.db_path).canonicalize().ok();
+    let gitignore = build_gitignore(root);
+
     let (tx, rx) = std::sync::mpsc::channel();
 
-    // Create a debouncer with 2 seconds timeout
-    let mut debouncer = new_debouncer(Duration::from_secs(2), tx)?;
+    // Rapid saves of the same file within the debounce window produce one event
+    let mut debouncer = new_debouncer(options.debounce, tx)?;
 
-    debouncer
-        .watcher()
-        .watch(Path::new(path), RecursiveMode::Recursive)?;
+    debouncer.watcher().watch(root, RecursiveMode::Recursive)?;
 
     // We need to keep the components alive and mutable.
     // Since notify runs in a separate thread (or system event loop) but communicates via channel,
@@ -38,16 +73,50 @@ pub async fn start_watcher(
     // Since we need to call async methods on storage/indexer, we can't easily be in a blocking loop unless we block_on.
     // Let's use a standard loop checking the channel.
 
-    let mut indexer = CodeIndexer::new(&storage, &mut embedder, &mut bm25, &chunker, workspace);
+    let mut indexer = CodeIndexer::new(
+        storage.as_ref(),
+        &mut embedder,
+        &mut bm25,
+        &chunker,
+        workspace,
+    )
+    .with_redactor(options.redactor.as_ref())
+    .with_summarizer(options.summarizer.as_ref())
+    .with_embedding_cache(options.embedding_cache.as_deref())
+    .with_blame(options.blame_timestamps)
+    .with_max_file_size(options.max_file_size);
+
+    // A call graph we can't read (e.g. written by a newer build) is left untouched
+    let mut call_graph = match CallGraph::load(&options.db_path) {
+        Ok(graph) => Some(graph.unwrap_or_default()),
+        Err(e) => {
+            warn!("Call graph will not be updated: {}", e);
+            None
+        }
+    };
 
     // Process events in a non-blocking way to allow graceful shutdown
     loop {
+        let mut changed = false;
+
         // Check for events
         while let Ok(result) = rx.try_recv() {
             match result {
                 Ok(events) => {
                     for event in events {
-                        let path = event.path;
+                        // Index under the same names as `code-rag index <path>` does
+                        let Some(relative) = event
+                            .path
+                            .strip_prefix(&canonical_root)
+                            .or_else(|_| event.path.strip_prefix(root))
+                            .ok()
+                        else {
+                            continue;
+                        };
+                        if relative.as_os_str().is_empty() {
+                            continue;
+                        }
+                        let path = root.join(relative);
                         let path_lossy = path.to_string_lossy();
 
                         // Simple exclusion for .git and target/lancedb
@@ -55,10 +124,25 @@ pub async fn start_watcher(
                             || path_lossy.contains("node_modules")
                             || path_lossy.contains("target")
                             || path_lossy.contains(".lancedb")
+                            || options.exclusions.iter().any(|ex| path_lossy.contains(ex))
+                        {
+                            continue;
+                        }
+                        if canonical_db
+                            .as_ref()
+                            .is_some_and(|db| event.path.starts_with(db))
+                        {
+                            continue;
+                        }
+                        if gitignore
+                            .matched_path_or_any_parents(relative, event.path.is_dir())
+                            .is_ignore()
                         {
                             continue;
                         }
 
+                        let filename = path_lossy.to_string();
+
                         // Check if file still exists (Modification vs Deletion)
                         if path.exists() {
                             // It's a Create or Write
@@ -72,8 +156,16 @@ pub async fn start_watcher(
                                         .as_secs()
                                         as i64;
 
-                                    if let Err(e) = indexer.index_file(&path, mtime).await {
-                                        error!("Failed to re-index {}: {}", path.display(), e);
+                                    match indexer.index_file(&path, mtime).await {
+                                        Ok(chunks) => {
+                                            if let Some(graph) = call_graph.as_mut() {
+                                                graph.insert_file(&filename, &chunks);
+                                            }
+                                            changed = true;
+                                        }
+                                        Err(e) => {
+                                            error!("Failed to re-index {}: {}", path.display(), e)
+                                        }
                                     }
                                 }
                                 Err(e) => {
@@ -85,6 +177,10 @@ pub async fn start_watcher(
                             if let Err(e) = indexer.remove_file(&path).await {
                                 error!("Failed to remove index for {}: {}", path.display(), e);
                             }
+                            if let Some(graph) = call_graph.as_mut() {
+                                graph.insert_file(&filename, &[]);
+                            }
+                            changed = true;
                         }
                     }
                 }
@@ -94,7 +190,65 @@ pub async fn start_watcher(
             }
         }
 
-        // Yield back to the executor to allow cancellation checks
-        tokio::time::sleep(Duration::from_millis(100)).await;
+        if changed {
+            flush(
+                &indexer,
+                storage.as_ref(),
+                call_graph.as_ref(),
+                &options.db_path,
+            )
+            .await;
+        }
+
+        tokio::select! {
+            _ = options.cancel.cancelled() => {
+                info!("Stopping watcher, flushing index to disk...");
+                flush(&indexer, storage.as_ref(), call_graph.as_ref(), &options.db_path).await;
+                return Ok(());
+            }
+            // Yield back to the executor to allow cancellation checks
+            _ = tokio::time::sleep(Duration::from_millis(100)) => {}
+        }
+    }
+}
+
+/// Persists BM25 changes, in-memory store state and the call graph, and
+/// invalidates cached query results.
+async fn flush(
+    indexer: &CodeIndexer<'_>,
+    storage: &dyn VectorStore,
+    call_graph: Option<&CallGraph>,
+    db_path: &str,
+) {
+    if let Err(e) = indexer.commit() {
+        error!("Failed to commit BM25 index: {}", e);
+    }
+    if let Err(e) = bump_index_version(db_path) {
+        error!("Failed to update index version: {}", e);
+    }
+    if let Err(e) = storage.flush().await {
+        error!("Failed to save vector index: {:#}", e);
+    }
+    if let Some(graph) = call_graph {
+        if let Err(e) = graph.save(db_path) {
+            error!("Failed to save call graph: {}", e);
+        }
+    }
+}
+
+/// Loads the `.gitignore` and `.ragignore` at the watch root.
+fn build_gitignore(root: &Path) -> Gitignore {
+    let mut builder = GitignoreBuilder::new(root);
+    for name in [".gitignore", RAGIGNORE_FILE] {
+        let file = root.join(name);
+        if file.is_file() {
+            if let Some(e) = builder.add(&file) {
+                warn!("Failed to parse {}: {}", file.display(), e);
+            }
+        }
     }
+    builder.build().unwrap_or_else(|e| {
+        warn!("Ignoring invalid ignore rules: {}", e);
+        Gitignore::empty()
+    })
 }
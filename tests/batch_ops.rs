@@ -20,6 +20,7 @@ fn test_bm25_batch_delete() -> Result<()> {
             line_end: 10,
             last_modified: 100,
             calls: vec![],
+            ..Default::default()
         },
         CodeChunk {
             filename: "file2.rs".to_string(),
@@ -28,6 +29,7 @@ fn test_bm25_batch_delete() -> Result<()> {
             line_end: 10,
             last_modified: 100,
             calls: vec![],
+            ..Default::default()
         },
         CodeChunk {
             filename: "file3.rs".to_string(),
@@ -36,6 +38,7 @@ fn test_bm25_batch_delete() -> Result<()> {
             line_end: 10,
             last_modified: 100,
             calls: vec![],
+            ..Default::default()
         },
     ];
 
@@ -77,14 +77,26 @@ telemetry_enabled = false
         )
     })?;
 
-    // Verify it's an array (empty array for non-existent query is expected)
-    assert!(parsed.is_array(), "Output should be a JSON array");
+    // Verify the versioned envelope (empty results for non-existent query are expected)
+    assert_eq!(
+        parsed["schemaVersion"], 1,
+        "Output should carry schemaVersion"
+    );
+    assert_eq!(parsed["query"], "nonexistent_unique_token_xyz");
+    assert!(
+        parsed["results"].is_array(),
+        "Output should have a results array"
+    );
+    assert!(
+        parsed["timing"]["totalMs"].is_u64(),
+        "Output should have timing"
+    );
 
-    // Verify stdout starts with '[' (pure JSON, no log pollution)
+    // Verify stdout starts with '{' (pure JSON, no log pollution)
     let trimmed_stdout = stdout.trim();
     assert!(
-        trimmed_stdout.starts_with('['),
-        "stdout should start with JSON array bracket, but starts with: '{}'",
+        trimmed_stdout.starts_with('{'),
+        "stdout should start with JSON object brace, but starts with: '{}'",
         trimmed_stdout.chars().take(50).collect::<String>()
     );
 
@@ -335,10 +335,10 @@ try {
     $jsonOutput = & cargo run --bin code-rag -- search "Rust function" --db-path $TestDbPath --json | Out-String
     
     # Try to parse as JSON
-    $results = $jsonOutput | ConvertFrom-Json
+    $parsed = $jsonOutput | ConvertFrom-Json
     Assert-Success "JSON search executes" ($LASTEXITCODE -eq 0)
-    Assert-Success "JSON search is valid JSON" ($results -is [array])
-    Assert-Success "JSON search contains filename" ($results[0].filename -match "test\.rs")
+    Assert-Success "JSON search has schemaVersion" ($parsed.schemaVersion -eq 1)
+    Assert-Success "JSON search contains file" ($parsed.results[0].file -match "test\.rs")
 }
 catch {
     Assert-Success "JSON search test" $false $_.Exception.Message
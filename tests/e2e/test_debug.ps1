@@ -97,7 +97,7 @@ try {
     $parsed = $strOutput | ConvertFrom-Json
     if ($parsed) {
         Write-Info "Successfully parsed JSON response."
-        Write-Info "Result count: $($parsed.Count)"
+        Write-Info "Result count: $($parsed.results.Count)"
     }
 } catch {
     Write-ErrorMsg "Failed to parse JSON output: $_"
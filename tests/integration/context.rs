@@ -13,6 +13,7 @@ fn test_context_optimizer_merging() {
             line_end: 11,
             last_modified: 0,
             calls: vec![],
+            ..Default::default()
         },
         // Lines 12-13
         SearchResult {
@@ -24,6 +25,7 @@ fn test_context_optimizer_merging() {
             line_end: 13,
             last_modified: 0,
             calls: vec![],
+            ..Default::default()
         },
         // Another file
         SearchResult {
@@ -35,6 +37,7 @@ fn test_context_optimizer_merging() {
             line_end: 101,
             last_modified: 0,
             calls: vec![],
+            ..Default::default()
         },
     ];
 
@@ -71,6 +74,7 @@ fn test_context_optimizer_budgeting() {
             line_end: 2,
             last_modified: 0,
             calls: vec![],
+            ..Default::default()
         });
     }
 
@@ -463,6 +463,64 @@ async fn test_multi_language_search() {
     cleanup_test_db(&db_path);
 }
 
+/// Scores every candidate alike, so only the symbol boost can order them.
+struct FlatReranker;
+
+#[async_trait::async_trait]
+impl code_rag::rerank::Reranker for FlatReranker {
+    async fn rerank(
+        &self,
+        _query: &str,
+        candidates: &[code_rag::search::SearchResult],
+    ) -> anyhow::Result<Vec<(usize, f32)>> {
+        Ok((0..candidates.len()).map(|i| (i, 0.0)).collect())
+    }
+}
+
+#[tokio::test]
+async fn test_search_symbol_name() {
+    let (storage, embedder, chunker, db_path) = setup_test_env("symbol_search").await;
+
+    let go_path = Path::new(TEST_ASSETS_PATH).join("test.go");
+    let code = fs::read_to_string(&go_path).expect("Failed to read Go file");
+    let mut reader = std::io::Cursor::new(code.as_bytes());
+    let chunks = chunker
+        .chunk_file(go_path.to_str().unwrap(), &mut reader, 0)
+        .unwrap();
+    let texts: Vec<String> = chunks.iter().map(|c| c.code.clone()).collect();
+    let embeddings = embedder.embed(texts, None).expect("Failed to embed");
+    // Unlike add_chunks, this keeps the symbols the boost matches on
+    storage
+        .add_code_chunks("default", &chunks, embeddings)
+        .await
+        .expect("Failed to add chunks");
+
+    let searcher = CodeSearcher::new(
+        Some(std::sync::Arc::new(storage)),
+        Some(std::sync::Arc::new(embedder)),
+        None,
+        None,
+        1.0,
+        1.0,
+        60.0,
+    )
+    .with_reranker(Some(std::sync::Arc::new(FlatReranker)));
+    for no_rerank in [true, false] {
+        let results = searcher
+            .semantic_search("Authenticate", 5, None, None, no_rerank, None, None, false)
+            .await
+            .expect("Search failed");
+        assert_eq!(
+            results.first().and_then(|r| r.symbol.as_deref()),
+            Some("main.AuthService.Authenticate"),
+            "Authenticate should rank first (no_rerank = {})",
+            no_rerank
+        );
+    }
+
+    cleanup_test_db(&db_path);
+}
+
 #[test]
 fn test_language_detection() {
     let _chunker = CodeChunker::default();
@@ -635,3 +693,213 @@ async fn test_lancedb_filename_index() {
 
     cleanup_test_db(&db_path);
 }
+
+#[tokio::test]
+async fn test_filters_on_table_without_newer_columns() {
+    use arrow_schema::{DataType, Field, Schema};
+    use code_rag::indexer::CodeChunk;
+    use code_rag::search::{CandidateFilter, TestFilter};
+    use code_rag::storage::{Storage, VectorStore};
+    use std::sync::Arc;
+
+    let db_path = format!(
+        "{}-legacy-columns-{}",
+        common::TEST_DB_BASE_PATH,
+        std::process::id()
+    );
+    cleanup_test_db(&db_path);
+
+    // The columns of a table written before tests, collections and tags were stored
+    let schema = Arc::new(Schema::new(vec![
+        Field::new("id", DataType::Utf8, false),
+        Field::new("workspace", DataType::Utf8, false),
+        Field::new("filename", DataType::Utf8, false),
+        Field::new("code", DataType::Utf8, false),
+        Field::new("line_start", DataType::Int32, false),
+        Field::new("line_end", DataType::Int32, false),
+        Field::new("last_modified", DataType::Int64, false),
+        Field::new(
+            "calls",
+            DataType::List(Arc::new(Field::new("item", DataType::Utf8, true))),
+            true,
+        ),
+        Field::new(
+            "vector",
+            DataType::FixedSizeList(Arc::new(Field::new("item", DataType::Float32, true)), 2),
+            false,
+        ),
+    ]));
+    let conn = lancedb::connect(&db_path).execute().await.unwrap();
+    conn.create_empty_table("code_chunks", schema)
+        .execute()
+        .await
+        .unwrap();
+
+    let storage = Storage::new(&db_path, "code_chunks").await.unwrap();
+    storage.init(2).await.unwrap();
+    let chunk = |filename: &str| CodeChunk {
+        filename: filename.to_string(),
+        code: format!("fn in_{}() {{}}", filename.len()),
+        line_start: 1,
+        line_end: 1,
+        ..Default::default()
+    };
+    storage
+        .add_code_chunks(
+            "default",
+            &[chunk("src/login.rs"), chunk("tests/login_test.rs")],
+            vec![vec![1.0, 0.0], vec![0.9, 0.1]],
+        )
+        .await
+        .unwrap();
+
+    let missing = VectorStore::missing_columns(&storage).await.unwrap();
+    for column in ["is_test", "collection", "tags"] {
+        assert!(missing.iter().any(|m| m == column), "{:?}", missing);
+    }
+
+    let filters = [
+        CandidateFilter::default().with_tests(TestFilter::Exclude),
+        CandidateFilter::default().with_collections(vec!["main".to_string()]),
+        CandidateFilter::default().with_tags(vec!["security".to_string()]),
+    ];
+    for filter in &filters {
+        // Naming the missing column fails the query...
+        assert!(storage
+            .search_chunks(vec![1.0, 0.0], 5, filter.sql(), Some("default"))
+            .await
+            .is_err());
+        // ...so it is left to the exact checks
+        let hits = storage
+            .search_chunks(
+                vec![1.0, 0.0],
+                5,
+                filter.sql_without(&missing),
+                Some("default"),
+            )
+            .await
+            .unwrap();
+        assert_eq!(hits.len(), 2);
+    }
+
+    cleanup_test_db(&db_path);
+}
+
+#[tokio::test]
+async fn test_lancedb_replace_files() {
+    use code_rag::indexer::CodeChunk;
+    use code_rag::storage::{Storage, VectorStore};
+    use std::sync::atomic::{AtomicBool, Ordering};
+    use std::sync::Arc;
+
+    let db_path = format!(
+        "{}-replace-files-{}",
+        common::TEST_DB_BASE_PATH,
+        std::process::id()
+    );
+    cleanup_test_db(&db_path);
+    let storage = Arc::new(Storage::new(&db_path, "code_chunks").await.unwrap());
+    storage.init(2).await.unwrap();
+
+    let chunk = |filename: &str, line: usize, version: usize| CodeChunk {
+        filename: filename.to_string(),
+        code: format!("fn v{}_{}() {{}}", version, line),
+        line_start: line,
+        line_end: line,
+        ..Default::default()
+    };
+    let files = |chunks: Vec<CodeChunk>| {
+        let vectors = vec![vec![1.0, 0.0]; chunks.len()];
+        (chunks, vectors)
+    };
+    let (chunks, vectors) = files(vec![
+        chunk("a.rs", 1, 0),
+        chunk("a.rs", 2, 0),
+        chunk("old.rs", 1, 0),
+        chunk("keep.rs", 1, 0),
+    ]);
+    storage
+        .add_code_chunks("default", &chunks, vectors)
+        .await
+        .unwrap();
+    let codes = |rows: Vec<(CodeChunk, Vec<f32>)>| -> Vec<String> {
+        let mut codes: Vec<String> = rows.into_iter().map(|(c, _)| c.code).collect();
+        codes.sort();
+        codes
+    };
+
+    // A reader never sees a.rs half-written or missing while it is rewritten
+    let done = Arc::new(AtomicBool::new(false));
+    let reader = tokio::spawn({
+        let (storage, done) = (storage.clone(), done.clone());
+        async move {
+            let mut reads = 0;
+            while !done.load(Ordering::Acquire) {
+                let rows = storage.get_file_chunks("a.rs", "default").await.unwrap();
+                assert_eq!(rows.len(), 2, "a.rs read with {} chunks", rows.len());
+                reads += 1;
+            }
+            reads
+        }
+    });
+    for version in 1..=5 {
+        let (chunks, vectors) = files(vec![chunk("a.rs", 1, version), chunk("a.rs", 2, version)]);
+        storage
+            .replace_files("default", &["a.rs".to_string()], &chunks, vectors)
+            .await
+            .unwrap();
+    }
+    done.store(true, Ordering::Release);
+    assert!(reader.await.unwrap() > 0);
+    assert_eq!(
+        codes(storage.get_file_chunks("a.rs", "default").await.unwrap()),
+        ["fn v5_1() {}", "fn v5_2() {}"]
+    );
+
+    // A rename lists both names, with chunks under the new one only
+    let (chunks, vectors) = files(vec![chunk("new.rs", 1, 1)]);
+    storage
+        .replace_files(
+            "default",
+            &["old.rs".to_string(), "new.rs".to_string()],
+            &chunks,
+            vectors,
+        )
+        .await
+        .unwrap();
+    assert!(storage
+        .get_file_chunks("old.rs", "default")
+        .await
+        .unwrap()
+        .is_empty());
+    assert_eq!(
+        codes(storage.get_file_chunks("new.rs", "default").await.unwrap()),
+        ["fn v1_1() {}"]
+    );
+
+    let moved = storage
+        .rename_file("new.rs", "moved.rs", "default", 7)
+        .await
+        .unwrap();
+    assert_eq!(moved.len(), 1);
+    assert!(storage
+        .get_file_chunks("new.rs", "default")
+        .await
+        .unwrap()
+        .is_empty());
+    let rows = storage
+        .get_file_chunks("moved.rs", "default")
+        .await
+        .unwrap();
+    assert_eq!(rows.len(), 1);
+    assert_eq!(rows[0].0.last_modified, 7);
+
+    // Unlisted files are left alone
+    assert_eq!(
+        codes(storage.get_file_chunks("keep.rs", "default").await.unwrap()),
+        ["fn v0_1() {}"]
+    );
+    assert_eq!(storage.count_chunks().await.unwrap(), 4);
+
+    cleanup_test_db(&db_path);
+}
@@ -1,4 +1,4 @@
-use crate::common::{cleanup_test_db, setup_test_env};
+use crate::common::{cleanup_test_db, prepare_chunks, setup_test_env, TEST_ASSETS_PATH};
 use std::fs::File;
 use std::io::Write;
 use std::path::Path;
@@ -129,3 +129,410 @@ async fn test_invalid_regex() {
     // Should return Err, not panic
     assert!(result.is_err(), "Invalid regex should return Error");
 }
+
+#[tokio::test]
+async fn test_cancel_mid_index() {
+    use code_rag::commands::index::{index_codebase, IndexOptions, ProgressMode};
+    use code_rag::config::AppConfig;
+    use code_rag::core::{CancelToken, CodeRagError};
+    use code_rag::manifest::{is_in_progress, IndexManifest};
+    use std::time::Duration;
+
+    let nanos = std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)
+        .unwrap()
+        .as_nanos();
+    let db_path = format!(
+        "{}-cancel-index-{}",
+        crate::common::TEST_DB_BASE_PATH,
+        nanos
+    );
+    let src_dir = std::env::temp_dir().join(format!("code-rag-cancel-{}", nanos));
+    std::fs::create_dir_all(&src_dir).unwrap();
+    for i in 0..200 {
+        let mut file = File::create(src_dir.join(format!("module_{}.rs", i))).unwrap();
+        writeln!(
+            file,
+            "pub fn handler_{i}(input: u32) -> u32 {{\n    input * {i}\n}}"
+        )
+        .unwrap();
+    }
+
+    let mut config = AppConfig::load(false).unwrap();
+    config.db_path = db_path.clone();
+    let cancel = CancelToken::new();
+    let options = IndexOptions {
+        path: Some(src_dir.to_string_lossy().to_string()),
+        db_path: Some(db_path.clone()),
+        update: false,
+        force: false,
+        resume: false,
+        workspace: "default".to_string(),
+        batch_size: Some(1),
+        threads: None,
+        concurrency: Some(1),
+        languages: Vec::new(),
+        include: Vec::new(),
+        exclude: Vec::new(),
+        collection: None,
+        rev: None,
+        since: None,
+        since_ref: None,
+        dry_run: false,
+        json: false,
+        progress: ProgressMode::detect(true),
+        cancel: cancel.clone(),
+    };
+
+    // Cancel as soon as files are being indexed, after the models have loaded
+    let marker_db = db_path.clone();
+    let canceller = tokio::spawn(async move {
+        while !is_in_progress(&marker_db) {
+            tokio::time::sleep(Duration::from_millis(10)).await;
+        }
+        tokio::time::sleep(Duration::from_millis(200)).await;
+        cancel.cancel();
+        Instant::now()
+    });
+    let result = index_codebase(options, &config).await;
+    let returned = Instant::now();
+    let cancelled_at = canceller.await.unwrap();
+
+    match result {
+        Err(CodeRagError::Cancelled(message)) => {
+            assert!(message.contains("--resume"), "{}", message)
+        }
+        other => panic!("expected a cancellation error, got {:?}", other),
+    }
+    assert!(
+        returned.duration_since(cancelled_at) < Duration::from_secs(3),
+        "indexing took {:?} to stop",
+        returned.duration_since(cancelled_at)
+    );
+    // The run stays resumable from what it completed
+    assert!(is_in_progress(&db_path));
+    let checkpoint = IndexManifest::load_checkpoint(&db_path).unwrap();
+    assert!(checkpoint.is_some_and(|manifest| manifest.files.len() < 200));
+
+    cleanup_test_db(&db_path);
+    let _ = std::fs::remove_dir_all(src_dir);
+}
+
+#[tokio::test]
+async fn test_resume_without_checkpoint() {
+    use code_rag::commands::index::{index_codebase, IndexOptions, ProgressMode};
+    use code_rag::config::AppConfig;
+    use code_rag::manifest::{is_in_progress, mark_in_progress, IndexManifest};
+
+    let nanos = std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)
+        .unwrap()
+        .as_nanos();
+    let db_path = format!(
+        "{}-resume-no-checkpoint-{}",
+        crate::common::TEST_DB_BASE_PATH,
+        nanos
+    );
+    let src_dir = std::env::temp_dir().join(format!("code-rag-resume-{}", nanos));
+    std::fs::create_dir_all(&src_dir).unwrap();
+    for i in 0..3 {
+        let mut file = File::create(src_dir.join(format!("module_{}.rs", i))).unwrap();
+        writeln!(file, "pub fn handler_{i}() -> u32 {{\n    {i}\n}}").unwrap();
+    }
+
+    let mut config = AppConfig::load(false).unwrap();
+    config.db_path = db_path.clone();
+    let options = |update: bool, resume: bool| IndexOptions {
+        path: Some(src_dir.to_string_lossy().to_string()),
+        db_path: Some(db_path.clone()),
+        update,
+        force: false,
+        resume,
+        workspace: "default".to_string(),
+        batch_size: None,
+        threads: None,
+        concurrency: None,
+        languages: Vec::new(),
+        include: Vec::new(),
+        exclude: Vec::new(),
+        collection: None,
+        rev: None,
+        since: None,
+        since_ref: None,
+        dry_run: false,
+        json: false,
+        progress: ProgressMode::detect(true),
+        cancel: Default::default(),
+    };
+    index_codebase(options(false, false), &config)
+        .await
+        .unwrap();
+
+    // A later run killed before it wrote a checkpoint
+    let mut file = File::create(src_dir.join("module_3.rs")).unwrap();
+    writeln!(file, "pub fn handler_3() -> u32 {{\n    3\n}}").unwrap();
+    mark_in_progress(&db_path).unwrap();
+    assert!(IndexManifest::load_checkpoint(&db_path).unwrap().is_none());
+
+    assert!(index_codebase(options(true, false), &config).await.is_err());
+    index_codebase(options(false, true), &config).await.unwrap();
+    assert!(!is_in_progress(&db_path));
+    let manifest = IndexManifest::load(&db_path).unwrap().unwrap();
+    assert_eq!(manifest.files.len(), 4);
+
+    cleanup_test_db(&db_path);
+    let _ = std::fs::remove_dir_all(src_dir);
+}
+
+/// Serves OpenAI-style `/embeddings` requests on a local port, answering
+/// `401` once `allowed` requests have been served. Returns the API root.
+fn spawn_embedding_server(allowed: std::sync::Arc<std::sync::atomic::AtomicUsize>) -> String {
+    use std::io::{BufRead, BufReader, Read};
+    use std::sync::atomic::Ordering;
+
+    let listener = std::net::TcpListener::bind("127.0.0.1:0").unwrap();
+    let port = listener.local_addr().unwrap().port();
+    std::thread::spawn(move || {
+        let served = std::sync::atomic::AtomicUsize::new(0);
+        for stream in listener.incoming() {
+            let Ok(mut stream) = stream else {
+                continue;
+            };
+            let mut reader = BufReader::new(stream.try_clone().unwrap());
+            let mut length = 0;
+            loop {
+                let mut line = String::new();
+                if reader.read_line(&mut line).unwrap_or(0) == 0 || line == "\r\n" {
+                    break;
+                }
+                if let Some((name, value)) = line.split_once(':') {
+                    if name.eq_ignore_ascii_case("content-length") {
+                        length = value.trim().parse().unwrap_or(0);
+                    }
+                }
+            }
+            let mut body = vec![0; length];
+            if reader.read_exact(&mut body).is_err() {
+                continue;
+            }
+            let (status, reply) =
+                if served.fetch_add(1, Ordering::SeqCst) < allowed.load(Ordering::SeqCst) {
+                    let request: serde_json::Value = serde_json::from_slice(&body).unwrap();
+                    let inputs = request["input"].as_array().map_or(0, |a| a.len());
+                    let data: Vec<serde_json::Value> = (0..inputs)
+                        .map(|i| {
+                            serde_json::json!({
+                                "index": i,
+                                "embedding": [1.0, 0.5, 0.25, (i + 1) as f32],
+                            })
+                        })
+                        .collect();
+                    ("200 OK", serde_json::json!({ "data": data }))
+                } else {
+                    (
+                        "401 Unauthorized",
+                        serde_json::json!({ "error": { "message": "Incorrect API key" } }),
+                    )
+                };
+            let reply = reply.to_string();
+            let _ = write!(
+                stream,
+                "HTTP/1.1 {}\r\nContent-Type: application/json\r\nContent-Length: {}\r\nConnection: close\r\n\r\n{}",
+                status,
+                reply.len(),
+                reply
+            );
+        }
+    });
+    format!("http://127.0.0.1:{}/v1", port)
+}
+
+#[tokio::test]
+async fn test_auth_failure_mid_index_resumes() {
+    use code_rag::commands::index::{index_codebase, IndexOptions, ProgressMode};
+    use code_rag::config::AppConfig;
+    use code_rag::core::CodeRagError;
+    use code_rag::manifest::{is_in_progress, IndexManifest};
+    use std::sync::atomic::{AtomicUsize, Ordering};
+    use std::sync::Arc;
+
+    let nanos = std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)
+        .unwrap()
+        .as_nanos();
+    let db_path = format!("{}-auth-index-{}", crate::common::TEST_DB_BASE_PATH, nanos);
+    let src_dir = std::env::temp_dir().join(format!("code-rag-auth-{}", nanos));
+    std::fs::create_dir_all(&src_dir).unwrap();
+    for i in 0..20 {
+        let mut file = File::create(src_dir.join(format!("module_{}.rs", i))).unwrap();
+        writeln!(
+            file,
+            "pub fn handler_{i}(input: u32) -> u32 {{\n    input * {i}\n}}"
+        )
+        .unwrap();
+    }
+
+    // The startup probe, the warmup and 6 one-chunk batches get through
+    let allowed = Arc::new(AtomicUsize::new(8));
+    let mut config = AppConfig::load(false).unwrap();
+    config.db_path = db_path.clone();
+    config.embedding_provider = "openai".to_string();
+    config.embedding_host = Some(spawn_embedding_server(Arc::clone(&allowed)));
+    config.embedding_model = "mock-embedding".to_string();
+    config.embedding_dim = None;
+    config.embedding_cache = None;
+    let options = |resume: bool| IndexOptions {
+        path: Some(src_dir.to_string_lossy().to_string()),
+        db_path: Some(db_path.clone()),
+        update: false,
+        force: false,
+        resume,
+        workspace: "default".to_string(),
+        batch_size: Some(1),
+        threads: None,
+        concurrency: Some(1),
+        languages: Vec::new(),
+        include: Vec::new(),
+        exclude: Vec::new(),
+        collection: None,
+        rev: None,
+        since: None,
+        since_ref: None,
+        dry_run: false,
+        json: false,
+        progress: ProgressMode::detect(true),
+        cancel: Default::default(),
+    };
+
+    match index_codebase(options(false), &config).await {
+        Err(CodeRagError::EmbedderAuth(message)) => {
+            assert!(message.contains("--resume"), "{}", message)
+        }
+        other => panic!("expected an embedder auth error, got {:?}", other),
+    }
+    assert!(is_in_progress(&db_path));
+    let checkpoint = IndexManifest::load_checkpoint(&db_path).unwrap().unwrap();
+    assert!(!checkpoint.files.is_empty() && checkpoint.files.len() < 20);
+
+    // With the credentials fixed, the run picks up where it stopped
+    allowed.store(usize::MAX, Ordering::SeqCst);
+    index_codebase(options(true), &config).await.unwrap();
+    assert!(!is_in_progress(&db_path));
+    assert!(IndexManifest::load_checkpoint(&db_path).unwrap().is_none());
+    let manifest = IndexManifest::load(&db_path).unwrap().unwrap();
+    assert_eq!(manifest.files.len(), 20);
+
+    cleanup_test_db(&db_path);
+    let _ = std::fs::remove_dir_all(src_dir);
+}
+
+/// Never finishes scoring, like a reranker stuck on a slow model.
+struct StuckReranker;
+
+#[async_trait::async_trait]
+impl code_rag::rerank::Reranker for StuckReranker {
+    async fn rerank(
+        &self,
+        _query: &str,
+        _candidates: &[code_rag::search::SearchResult],
+    ) -> anyhow::Result<Vec<(usize, f32)>> {
+        std::future::pending().await
+    }
+}
+
+#[tokio::test]
+async fn test_cancel_stops_search() {
+    use code_rag::core::{CancelToken, CodeRagError};
+    use code_rag::search::{CandidateFilter, CodeSearcher};
+    use std::sync::Arc;
+    use std::time::Duration;
+
+    let (storage, embedder, chunker, db_path) = setup_test_env("cancel_search").await;
+    let py_path = Path::new(TEST_ASSETS_PATH).join("test.py");
+    let code = std::fs::read_to_string(&py_path).unwrap();
+    let chunks = chunker
+        .chunk_file(
+            py_path.to_str().unwrap(),
+            &mut std::io::Cursor::new(code.as_bytes()),
+            0,
+        )
+        .unwrap();
+    let texts: Vec<String> = chunks.iter().map(|c| c.code.clone()).collect();
+    let embeddings = embedder.embed(texts, None).unwrap();
+    let (ids, filenames, codes, line_starts, line_ends, last_modified, calls) =
+        prepare_chunks(&chunks);
+    storage
+        .add_chunks(
+            "default",
+            ids,
+            filenames,
+            codes,
+            line_starts,
+            line_ends,
+            last_modified,
+            calls,
+            embeddings,
+        )
+        .await
+        .unwrap();
+
+    let cancel = CancelToken::new();
+    let searcher = CodeSearcher::new(
+        Some(Arc::new(storage)),
+        Some(Arc::new(embedder)),
+        None,
+        None,
+        1.0,
+        1.0,
+        60.0,
+    )
+    .with_reranker(Some(Arc::new(StuckReranker)))
+    .with_cancel(cancel.clone());
+    let filter = CandidateFilter::new(None, None, Vec::new(), Vec::new()).unwrap();
+
+    let canceller = tokio::spawn(async move {
+        tokio::time::sleep(Duration::from_millis(500)).await;
+        cancel.cancel();
+        Instant::now()
+    });
+    let result = searcher
+        .filtered_search(
+            "python function",
+            5,
+            &filter,
+            false,
+            None,
+            None,
+            false,
+            None,
+            None,
+            None,
+            None,
+            false,
+        )
+        .await;
+    let returned = Instant::now();
+    let cancelled_at = canceller.await.unwrap();
+
+    let err = result.expect_err("a stuck reranker must not answer");
+    assert!(
+        matches!(
+            err.downcast_ref::<CodeRagError>(),
+            Some(CodeRagError::Cancelled(_))
+        ),
+        "{:#}",
+        err
+    );
+    assert!(
+        returned.duration_since(cancelled_at) < Duration::from_secs(1),
+        "search took {:?} to stop",
+        returned.duration_since(cancelled_at)
+    );
+    // Cancelled before it starts, a search doesn't embed or touch the store
+    assert!(searcher
+        .semantic_search("python", 5, None, None, true, None, None, false)
+        .await
+        .is_err());
+
+    cleanup_test_db(&db_path);
+}
@@ -3,8 +3,10 @@ use axum::{
     body::Body,
     http::{Request, StatusCode},
 };
+use code_rag::embedding::RemoteOptions;
 use code_rag::server::workspace_manager::WorkspaceManager;
 use code_rag::server::{create_router, AppState, ServerStartConfig};
+use code_rag::storage::Metric;
 use common::{cleanup_test_db, prepare_chunks, setup_test_env, TEST_ASSETS_PATH};
 use std::fs;
 use std::path::Path;
@@ -17,14 +19,28 @@ fn create_test_config(db_path: &str) -> ServerStartConfig {
         host: "127.0.0.1".to_string(),
         port: 0,
         db_path: db_path.to_string(),
+        storage_backend: "lancedb".to_string(),
+        vector_index: None,
+        multi_vector: None,
+        distance_metric: Metric::Cosine,
+        bm25_doc_boost: 2.0,
+        query_cache_size: 0,
+        embedding_provider: "fastembed".to_string(),
+        embedding_remote: RemoteOptions::default(),
         embedding_model: "dummy".to_string(),
         reranker_model: "dummy".to_string(),
+        reranker: "cross-encoder".to_string(),
+        rerank_top_k: 30,
+        symbol_weight: 1.0,
+        min_score: None,
         embedding_model_path: None,
         reranker_model_path: None,
+        onnx_reranker: Default::default(),
         device: "cpu".to_string(),
         llm_enabled: false,
         llm_host: "".to_string(),
         llm_model: "".to_string(),
+        auth_token: None,
     }
 }
 
@@ -42,6 +58,7 @@ async fn test_health_check() {
 
     let state = AppState {
         workspace_manager: Arc::new(manager),
+        auth_token: None,
     };
 
     let app = create_router(state);
@@ -62,6 +79,38 @@ async fn test_health_check() {
     cleanup_test_db(&db_path);
 }
 
+#[tokio::test]
+async fn test_readiness_check() {
+    let (_storage, embedder, _, db_path) = setup_test_env("readiness_check").await;
+
+    let config = create_test_config(&db_path);
+    let manager = Arc::new(WorkspaceManager::new(config, Arc::new(embedder), None));
+    let state = AppState {
+        workspace_manager: manager.clone(),
+        auth_token: Some(Arc::from("s3cret")),
+    };
+    let app = create_router(state);
+
+    let readyz = || {
+        Request::builder()
+            .uri("/readyz")
+            .body(Body::empty())
+            .unwrap()
+    };
+
+    // Reachable without a token, and unavailable until the warm-up is done
+    let response = app.clone().oneshot(readyz()).await.unwrap();
+    assert_eq!(response.status(), StatusCode::SERVICE_UNAVAILABLE);
+
+    manager.warm_up().await.expect("Warm-up failed");
+    assert!(manager.is_ready());
+
+    let response = app.oneshot(readyz()).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+
+    cleanup_test_db(&db_path);
+}
+
 #[tokio::test]
 async fn test_search_endpoint() {
     // Setup environment
@@ -95,6 +144,7 @@ async fn test_search_endpoint() {
 
     let state = AppState {
         workspace_manager: Arc::new(manager),
+        auth_token: None,
     };
     let app = create_router(state);
 
@@ -162,6 +212,7 @@ async fn test_concurrent_searches() {
 
     let state = AppState {
         workspace_manager: Arc::new(manager),
+        auth_token: None,
     };
     let app = create_router(state);
 
@@ -199,3 +250,183 @@ async fn test_concurrent_searches() {
 
     cleanup_test_db(&db_path);
 }
+
+#[tokio::test]
+async fn test_query_endpoint() {
+    let (storage, embedder, chunker, db_path) = setup_test_env("server_query").await;
+
+    let path = Path::new(TEST_ASSETS_PATH).join("test.rs");
+    let code = fs::read_to_string(&path).expect("Failed to read test.rs");
+    let mut reader = std::io::Cursor::new(code.as_bytes());
+    let chunks = chunker.chunk_file("test.rs", &mut reader, 0).unwrap();
+    let texts: Vec<String> = chunks.iter().map(|c| c.code.clone()).collect();
+    let embeddings = embedder.embed(texts, None).expect("Embed failed");
+    let (ids, filenames, codes, starts, ends, mtimes, calls) = prepare_chunks(&chunks);
+    storage
+        .add_chunks(
+            "default", ids, filenames, codes, starts, ends, mtimes, calls, embeddings,
+        )
+        .await
+        .expect("Add failed");
+
+    let config = create_test_config(&db_path);
+    let manager = WorkspaceManager::new(config, Arc::new(embedder), None);
+    let state = AppState {
+        workspace_manager: Arc::new(manager),
+        auth_token: None,
+    };
+    let app = create_router(state);
+
+    let payload = serde_json::json!({
+        "query": "rust function",
+        "maxChunks": 2,
+        "pathGlob": "**/*.rs"
+    });
+    let req = Request::builder()
+        .method("POST")
+        .uri("/query")
+        .header("content-type", "application/json")
+        .body(Body::from(payload.to_string()))
+        .unwrap();
+    let response = app.clone().oneshot(req).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+
+    let body_bytes = http_body_util::BodyExt::collect(response.into_body())
+        .await
+        .unwrap()
+        .to_bytes();
+    let body: serde_json::Value = serde_json::from_slice(&body_bytes).unwrap();
+    let chunks = body["chunks"].as_array().unwrap();
+    assert!(!chunks.is_empty() && chunks.len() <= 2);
+    assert_eq!(chunks.len(), body["citations"].as_array().unwrap().len());
+
+    // An invalid glob is a client error
+    let payload = serde_json::json!({ "query": "rust", "pathGlob": "src/[" });
+    let req = Request::builder()
+        .method("POST")
+        .uri("/query")
+        .header("content-type", "application/json")
+        .body(Body::from(payload.to_string()))
+        .unwrap();
+    let response = app.clone().oneshot(req).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+
+    // A prompt template lays out the returned prompt
+    let payload = serde_json::json!({
+        "query": "rust function",
+        "maxChunks": 1,
+        "promptTemplate": "{% for chunk in chunks %}<file path=\"{{ chunk.file }}\">{% endfor %}\nQ: {{ query }}\n"
+    });
+    let req = Request::builder()
+        .method("POST")
+        .uri("/query")
+        .header("content-type", "application/json")
+        .body(Body::from(payload.to_string()))
+        .unwrap();
+    let response = app.clone().oneshot(req).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+    let body_bytes = http_body_util::BodyExt::collect(response.into_body())
+        .await
+        .unwrap()
+        .to_bytes();
+    let body: serde_json::Value = serde_json::from_slice(&body_bytes).unwrap();
+    let prompt = body["prompt"].as_str().unwrap();
+    assert!(prompt.starts_with("<file path=\""), "{}", prompt);
+    assert!(prompt.ends_with("\nQ: rust function\n"), "{}", prompt);
+
+    // and is rejected before searching when it doesn't parse
+    let payload = serde_json::json!({ "query": "rust", "promptTemplate": "{{ .Query }}" });
+    let req = Request::builder()
+        .method("POST")
+        .uri("/query")
+        .header("content-type", "application/json")
+        .body(Body::from(payload.to_string()))
+        .unwrap();
+    let response = app.oneshot(req).await.unwrap();
+    assert_eq!(response.status(), StatusCode::BAD_REQUEST);
+
+    cleanup_test_db(&db_path);
+}
+
+#[tokio::test]
+async fn test_bearer_token_auth() {
+    let (_storage, embedder, _, db_path) = setup_test_env("server_auth").await;
+
+    let config = create_test_config(&db_path);
+    let manager = WorkspaceManager::new(config, Arc::new(embedder), None);
+    let state = AppState {
+        workspace_manager: Arc::new(manager),
+        auth_token: Some(Arc::from("s3cret")),
+    };
+    let app = create_router(state);
+
+    let get = |uri: &str, token: Option<&str>| {
+        let mut builder = Request::builder().uri(uri);
+        if let Some(token) = token {
+            builder = builder.header("authorization", format!("Bearer {}", token));
+        }
+        builder.body(Body::empty()).unwrap()
+    };
+
+    let response = app.clone().oneshot(get("/healthz", None)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+
+    let response = app.clone().oneshot(get("/status", None)).await.unwrap();
+    assert_eq!(response.status(), StatusCode::UNAUTHORIZED);
+
+    let response = app
+        .clone()
+        .oneshot(get("/status", Some("wrong")))
+        .await
+        .unwrap();
+    assert_eq!(response.status(), StatusCode::UNAUTHORIZED);
+
+    let response = app.oneshot(get("/status", Some("s3cret"))).await.unwrap();
+    assert_eq!(response.status(), StatusCode::OK);
+
+    cleanup_test_db(&db_path);
+}
+
+#[tokio::test]
+async fn test_missing_or_empty_index_guidance() {
+    let (_storage, embedder, _, db_path) = setup_test_env("server_no_index").await;
+
+    let config = create_test_config(&db_path);
+    let manager = WorkspaceManager::new(config, Arc::new(embedder), None);
+    let state = AppState {
+        workspace_manager: Arc::new(manager),
+        auth_token: None,
+    };
+    let app = create_router(state);
+
+    let search = |uri: &str| {
+        Request::builder()
+            .method("POST")
+            .uri(uri)
+            .header("content-type", "application/json")
+            .body(Body::from(r#"{"query": "rust function"}"#))
+            .unwrap()
+    };
+    let text = |response: axum::response::Response| async move {
+        let bytes = http_body_util::BodyExt::collect(response.into_body())
+            .await
+            .unwrap()
+            .to_bytes();
+        String::from_utf8_lossy(&bytes).to_string()
+    };
+
+    // The default table was created but nothing was added to it
+    let response = app.clone().oneshot(search("/search")).await.unwrap();
+    assert_eq!(response.status(), StatusCode::NOT_FOUND);
+    let body = text(response).await;
+    assert!(body.contains("is empty"), "{}", body);
+
+    let response = app.oneshot(search("/v1/unindexed/search")).await.unwrap();
+    assert_eq!(response.status(), StatusCode::NOT_FOUND);
+    let body = text(response).await;
+    assert!(body.contains("No index found"), "{}", body);
+    assert!(body.contains("--workspace unindexed"), "{}", body);
+    assert!(!Path::new(&db_path).join("unindexed").exists());
+
+    cleanup_test_db(&db_path);
+}
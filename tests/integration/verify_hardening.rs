@@ -3,11 +3,13 @@ use axum::{
     body::Body,
     http::{Request, StatusCode},
 };
+use code_rag::embedding::RemoteOptions;
 use code_rag::server::{
     create_router,
     workspace_manager::{WorkspaceManager, WorkspaceStats},
     AppState, ServerStartConfig,
 };
+use code_rag::storage::Metric;
 use std::sync::Arc;
 use tower::ServiceExt;
 
@@ -16,14 +18,28 @@ fn create_test_config(db_path: &str) -> ServerStartConfig {
         host: "127.0.0.1".to_string(),
         port: 0,
         db_path: db_path.to_string(),
+        storage_backend: "lancedb".to_string(),
+        vector_index: None,
+        multi_vector: None,
+        distance_metric: Metric::Cosine,
+        bm25_doc_boost: 2.0,
+        query_cache_size: 0,
+        embedding_provider: "fastembed".to_string(),
+        embedding_remote: RemoteOptions::default(),
         embedding_model: "dummy".to_string(),
         reranker_model: "dummy".to_string(),
+        reranker: "cross-encoder".to_string(),
+        rerank_top_k: 30,
+        symbol_weight: 1.0,
+        min_score: None,
         embedding_model_path: None,
         reranker_model_path: None,
+        onnx_reranker: Default::default(),
         device: "cpu".to_string(),
         llm_enabled: false,
         llm_host: "".to_string(),
         llm_model: "".to_string(),
+        auth_token: None,
     }
 }
 
@@ -39,6 +55,7 @@ async fn test_server_status_endpoint() {
     // 3. Create Router
     let state = AppState {
         workspace_manager: Arc::new(manager),
+        auth_token: None,
     };
     let app = create_router(state);
 